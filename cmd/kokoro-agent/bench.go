@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/Vincentkeio/agent/internal/bench"
+	"github.com/Vincentkeio/agent/internal/config"
+	"github.com/Vincentkeio/agent/internal/version"
+)
+
+// cmdBench runs the micro-benchmarks, prints them and stores the result in
+// state_dir so the next hello carries it (sys.bench).
+func cmdBench(args []string) int {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	cfgPath := fs.String("config", "", "path to config.json (for state_dir)")
+	dir := fs.String("dir", "", "directory for the disk test (default: state_dir)")
+	noDisk := fs.Bool("no-disk", false, "skip the disk test")
+	noSave := fs.Bool("no-save", false, "don't store the result for the agent")
+	asJSON := fs.Bool("json", false, "print JSON")
+	_ = fs.Parse(args)
+
+	stateDir := config.DefaultStateDir
+	if cfg, _, err := config.Load(*cfgPath); err == nil {
+		stateDir = cfg.StateDir
+	}
+	diskDir := *dir
+	if diskDir == "" {
+		diskDir = stateDir
+	}
+	if *noDisk {
+		diskDir = ""
+	}
+
+	if !*asJSON {
+		fmt.Fprintf(os.Stderr, "running benchmarks (~10s, writes %d MB to %s)...\n", bench.DiskBytes>>20, diskDir)
+	}
+	r := bench.Run(diskDir)
+	r.AgentVer = version.Version
+
+	if *asJSON {
+		b, _ := json.MarshalIndent(r, "", "  ")
+		fmt.Println(string(b))
+	} else {
+		fmt.Printf("cpu single   %10.1f MB/s (sha256)\n", r.CPUSingleMBps)
+		fmt.Printf("cpu multi    %10.1f MB/s (%d cpus)\n", r.CPUMultiMBps, r.NumCPU)
+		fmt.Printf("mem copy     %10.2f GB/s\n", r.MemCopyGBps)
+		switch {
+		case diskDir == "":
+		case r.DiskErr != "":
+			fmt.Printf("disk         error: %s\n", r.DiskErr)
+		default:
+			fmt.Printf("disk write   %10.1f MB/s (fsync)\n", r.DiskWriteMBps)
+			fmt.Printf("disk read    %10.1f MB/s (may be cached)\n", r.DiskReadMBps)
+		}
+	}
+
+	if !*noSave {
+		if err := bench.Save(stateDir, r); err != nil {
+			fmt.Fprintf(os.Stderr, "save result: %v\n", err)
+			return 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Vincentkeio/agent/internal/config"
+	"github.com/Vincentkeio/agent/internal/tcpping"
+)
+
+// cmdCheckConfig loads and validates the config (plus env/flag overrides)
+// without changing anything, prints it normalized and exits non-zero on
+// any problem. Meant for CI and deploy pipelines.
+func cmdCheckConfig(args []string) int {
+	fs := flag.NewFlagSet("check-config", flag.ExitOnError)
+	cfgPath := fs.String("config", "", "path to config.json")
+	targets := fs.String("targets", "", "also check a tcpping target list (JSON array, or an object with \"targets\")")
+	quiet := fs.Bool("q", false, "only report problems")
+	secrets := fs.Bool("show-secrets", false, "print the token and sign_key instead of redacting them")
+	ovs := overrideFlags{}
+	ovs.register(fs)
+	_ = fs.Parse(args)
+	if err := config.SetOverrides(ovs); err != nil {
+		fmt.Fprintf(os.Stderr, "kokoro-agent: %v\n", err)
+		return 2
+	}
+
+	cfg, path, err := config.LoadReadOnly(*cfgPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "FAIL %v\n", err)
+		return exitConfig
+	}
+	problems := 0
+	for _, p := range config.Validate(path, cfg) {
+		fmt.Fprintf(os.Stderr, "FAIL %v\n", p)
+		problems++
+	}
+	if *targets != "" {
+		problems += checkTargetsFile(*targets)
+	}
+
+	if !*quiet {
+		if !*secrets {
+			if cfg.Token != "" {
+				cfg.Token = "REDACTED"
+			}
+			if cfg.SignKey != "" {
+				cfg.SignKey = "REDACTED"
+			}
+			// header values are usually credentials too
+			hs := make(map[string]string, len(cfg.MasterHeaders))
+			for k, v := range cfg.MasterHeaders {
+				if !strings.EqualFold(k, "Host") {
+					v = "REDACTED"
+				}
+				hs[k] = v
+			}
+			cfg.MasterHeaders = hs
+		}
+		b, _ := json.MarshalIndent(cfg, "", "  ")
+		fmt.Println(string(b))
+	}
+	if problems > 0 {
+		fmt.Fprintf(os.Stderr, "%s: %d problem(s)\n", path, problems)
+		return exitConfig
+	}
+	if !*quiet {
+		fmt.Fprintf(os.Stderr, "%s: OK\n", path)
+	}
+	return 0
+}
+
+func checkTargetsFile(path string) int {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "FAIL %v\n", err)
+		return 1
+	}
+	var ts []tcpping.Target
+	if err := json.Unmarshal(b, &ts); err != nil {
+		var wrapped struct {
+			Targets []tcpping.Target `json:"targets"`
+		}
+		if err2 := json.Unmarshal(b, &wrapped); err2 != nil {
+			fmt.Fprintf(os.Stderr, "FAIL %s: %v\n", path, err)
+			return 1
+		}
+		ts = wrapped.Targets
+	}
+	n := 0
+	for i, t := range ts {
+		if err := t.Check(); err != nil {
+			fmt.Fprintf(os.Stderr, "FAIL %s: target %d (%s:%d): %v\n", path, i, t.Host, t.Port, err)
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/Vincentkeio/agent/internal/config"
+	"github.com/Vincentkeio/agent/internal/metrics"
+)
+
+// cmdCollect runs the metrics collector twice (rates need two samples) and
+// prints the second snapshot: exactly what the agent would report, without
+// connecting anywhere.
+func cmdCollect(args []string) int {
+	fs := flag.NewFlagSet("collect", flag.ExitOnError)
+	cfgPath := fs.String("config", "", "path to config.json (for net_iface, net_ifaces and numa)")
+	asJSON := fs.Bool("json", false, "print the full snapshot as JSON")
+	iface := fs.String("iface", "", "network interface (default: net_iface from the config, else auto)")
+	numa := fs.Bool("numa", false, "include the per NUMA node breakdown")
+	interval := fs.Duration("interval", time.Second, "time between the two samples")
+	_ = fs.Parse(args)
+
+	netIface, withNUMA := "auto", *numa
+	var ifaces map[string]string
+	if cfg, _, err := config.LoadReadOnly(*cfgPath); err == nil {
+		netIface, withNUMA, ifaces = cfg.NetIface, withNUMA || cfg.NUMA, cfg.NetIfaces
+	}
+	if *iface != "" {
+		netIface = *iface
+	}
+
+	c := metrics.NewCollector(netIface)
+	c.SetNUMA(withNUMA)
+	c.SetIfaces(ifaces)
+	if _, err := c.Collect(); err != nil {
+		fmt.Fprintf(os.Stderr, "collect: %v\n", err)
+		return 1
+	}
+	time.Sleep(*interval)
+	snap, err := c.Collect()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "collect: %v\n", err)
+		return 1
+	}
+
+	if *asJSON {
+		b, _ := json.MarshalIndent(snap, "", "  ")
+		fmt.Println(string(b))
+		return 0
+	}
+	if snap.Stub {
+		fmt.Println("note: no /proc on this platform, only Go runtime stats are collected")
+	}
+	fmt.Printf("cpu        %6.1f %%\n", snap.CPU)
+	fmt.Printf("mem        %6.1f %%  %s / %s\n", snap.Mem, bytesStr(snap.MemUsedBytes), bytesStr(snap.MemTotalBytes))
+	fmt.Printf("swap       %6.1f %%  %s / %s\n", snap.Swap, bytesStr(snap.SwapUsedBytes), bytesStr(snap.SwapTotalBytes))
+	fmt.Printf("disk       %6.1f %%  %s / %s\n", snap.Disk, bytesStr(snap.DiskUsedBytes), bytesStr(snap.DiskTotalBytes))
+	fmt.Printf("net        %s: up %s/s  down %s/s  (totals %s / %s)\n", netIface,
+		bytesStr(snap.NetUpBPS), bytesStr(snap.NetDownBPS), bytesStr(snap.BytesUpTotal), bytesStr(snap.BytesDownTotal))
+	labels := make([]string, 0, len(snap.Ifaces))
+	for l := range snap.Ifaces {
+		labels = append(labels, l)
+	}
+	sort.Strings(labels)
+	for _, l := range labels {
+		t := snap.Ifaces[l]
+		if t.Err != "" {
+			fmt.Printf("  %-8s %s: %s\n", l, t.Iface, t.Err)
+			continue
+		}
+		fmt.Printf("  %-8s %s: up %s/s  down %s/s  (totals %s / %s)\n", l, t.Iface,
+			bytesStr(t.NetUpBPS), bytesStr(t.NetDownBPS), bytesStr(t.BytesUpTotal), bytesStr(t.BytesDownTotal))
+	}
+	fmt.Printf("sched      ctxt %d/s  intr %d/s  running %d  blocked %d\n", snap.CtxtPS, snap.IntrPS, snap.ProcsRunning, snap.ProcsBlocked)
+	fmt.Printf("uptime     %s\n", time.Duration(snap.UptimeSec)*time.Second)
+	fmt.Println("(-json prints every field)")
+	return 0
+}
+
+func bytesStr(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
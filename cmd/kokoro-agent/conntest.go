@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/Vincentkeio/agent/internal/config"
+	"github.com/Vincentkeio/agent/internal/version"
+	"github.com/Vincentkeio/agent/internal/ws"
+	"github.com/Vincentkeio/agent/pkg/agentproto"
+)
+
+// checkMaster dials the master, sends a hello and waits for hello_ok (or
+// auth_err), reporting every step to tr (may be nil). It returns the
+// hello_ok message; the session is closed right after.
+func checkMaster(cfg config.Config, timeout time.Duration, tr ws.Trace) (map[string]any, error) {
+	if tr == nil {
+		tr = func(string, time.Duration, string, error) {}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	ech, _ := ws.CheckECH(cfg.TLSECHConfig) // validated by config.Load
+	conn, _, err := ws.DialWith(ctx, cfg.MasterWSURL, ws.Options{
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+		ServerName:         cfg.TLSServerName,
+		ECHConfigList:      ech,
+		PreferIP:           cfg.PreferIP,
+		Resolve:            cfg.MasterResolve.Lookup,
+		Headers:            cfg.MasterHeaders,
+		KeepAlive:          time.Duration(cfg.TCPKeepAliveSec) * time.Second,
+		UserTimeout:        time.Duration(cfg.TCPUserTimeoutSec) * time.Second,
+		Subprotocols:       []string{agentproto.Subprotocol},
+		Trace:              tr,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("connect: %w", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+
+	start := time.Now()
+	fail := func(err error) (map[string]any, error) {
+		tr("auth", time.Since(start), "", err)
+		return nil, err
+	}
+	hello, _ := json.Marshal(map[string]any{
+		"type":      "hello",
+		"agent_id":  cfg.AgentID,
+		"token":     cfg.Token,
+		"agent_ver": version.Version,
+		"proto_ver": agentproto.ProtoVersion,
+		"client_ts": time.Now().Unix(),
+		"cap":       []string{},
+		"sys":       map[string]any{"os": runtime.GOOS, "arch": runtime.GOARCH},
+	})
+	if err := conn.WriteText(hello); err != nil {
+		return fail(fmt.Errorf("send hello: %w", err))
+	}
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return fail(fmt.Errorf("wait for hello_ok: %w", err))
+		}
+		var m map[string]any
+		if json.Unmarshal(data, &m) != nil {
+			continue
+		}
+		switch m["type"] {
+		case "hello_ok", "hello_ack":
+			tr("auth", time.Since(start), fmt.Sprint(m["type"]), nil)
+			_ = conn.WriteClose(1000, "test done")
+			return m, nil
+		case "auth_err":
+			return fail(errors.New("master rejected the token (auth_err)"))
+		case "kick":
+			return fail(errors.New("master kicked the connection"))
+		}
+	}
+}
+
+// cmdTestConnection walks through DNS, TCP, TLS, the WebSocket upgrade and
+// hello/auth against the configured master, printing each step, then exits.
+func cmdTestConnection(args []string) int {
+	fs := flag.NewFlagSet("test-connection", flag.ExitOnError)
+	cfgPath := fs.String("config", "", "path to config.json")
+	timeout := fs.Duration("timeout", 10*time.Second, "overall timeout")
+	ovs := overrideFlags{}
+	ovs.register(fs)
+	_ = fs.Parse(args)
+	if err := config.SetOverrides(ovs); err != nil {
+		fmt.Fprintf(os.Stderr, "kokoro-agent: %v\n", err)
+		return 2
+	}
+
+	cfg, path, err := config.LoadReadOnly(*cfgPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "FAIL config: %v\n", err)
+		return exitConfig
+	}
+	fmt.Printf("config   %s\nmaster   %s\nagent_id %s\n\n", path, cfg.MasterWSURL, cfg.AgentID)
+
+	total := time.Now()
+	step := func(name string, took time.Duration, detail string, err error) {
+		if err != nil {
+			fmt.Printf("FAIL %-8s %8s  %s: %v\n", name, took.Round(time.Millisecond), detail, err)
+			if hint := connHint(name, err); hint != "" {
+				fmt.Printf("     hint: %s\n", hint)
+			}
+			return
+		}
+		fmt.Printf("ok   %-8s %8s  %s\n", name, took.Round(time.Millisecond), detail)
+	}
+	ok, err := checkMaster(cfg, *timeout, step)
+	if err != nil {
+		fmt.Printf("\nconnection failed after %s\n", time.Since(total).Round(time.Millisecond))
+		return 1
+	}
+	fmt.Printf("\nconnected in %s", time.Since(total).Round(time.Millisecond))
+	for _, k := range []string{"encoding", "sign", "proto_ver", "config_version"} {
+		if v, ok := ok[k]; ok {
+			fmt.Printf(", %s=%v", k, v)
+		}
+	}
+	fmt.Println()
+	return 0
+}
+
+// connHint suggests the usual fix for a failed step.
+func connHint(step string, err error) string {
+	switch step {
+	case "dns":
+		return "check the host name in master_ws_url and /etc/resolv.conf"
+	case "tcp":
+		return "check the port, firewalls and that the master is running"
+	case "tls":
+		if retry := ws.ECHRetryConfig(err); len(retry) > 0 {
+			return "the master rejected tls_ech_config; it offers " + base64.StdEncoding.EncodeToString(retry)
+		}
+		return "the certificate must match the host name (or tls_server_name); insecure_skip_verify only for testing"
+	case "upgrade":
+		if errors.Is(err, ws.ErrUnauthorized) {
+			return "the master or a proxy in front of it wants credentials: set master_headers (e.g. Authorization, CF-Access-Client-Id/-Secret)"
+		}
+		if errors.Is(err, ws.ErrSubprotocol) {
+			return "the master requires a newer protocol version: upgrade the agent"
+		}
+		if errors.Is(err, ws.ErrBadHandshake) {
+			return "the URL path is not the master's WebSocket endpoint (or a proxy drops Upgrade headers)"
+		}
+		return "a proxy or the server closed the connection during the HTTP upgrade"
+	case "auth":
+		return "copy the agent token from the master UI"
+	}
+	return ""
+}
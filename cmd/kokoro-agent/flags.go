@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/Vincentkeio/agent/internal/config"
+)
+
+// overrideFlags collects config overrides from the command line: a few
+// shorthands for the usual deployment fields plus repeatable -set.
+type overrideFlags map[string]string
+
+// shorthands maps flag name -> config path.
+var shorthands = []struct{ flag, path, usage string }{
+	{"master", "master_ws_url", "master WebSocket URL"},
+	{"token", "token", "agent token"},
+	{"agent-id", "agent_id", "agent id"},
+	{"alias", "alias", "display name"},
+	{"state-dir", "state_dir", "state directory"},
+	{"log-level", "log_level", "debug|info|warn|error"},
+}
+
+func (o overrideFlags) register(fs *flag.FlagSet) {
+	for _, s := range shorthands {
+		path := s.path
+		fs.Func(s.flag, s.usage+" (overrides "+path+")", func(v string) error {
+			o[path] = v
+			return nil
+		})
+	}
+	fs.Func("set", "override any config field: path=value, repeatable (e.g. tcpping.interval_sec=30)", func(v string) error {
+		path, val, ok := strings.Cut(v, "=")
+		if !ok || path == "" {
+			return fmt.Errorf("want path=value")
+		}
+		o[path] = val
+		return nil
+	})
+}
+
+func usage(fs *flag.FlagSet) func() {
+	return func() {
+		out := fs.Output()
+		fmt.Fprintf(out, "usage: kokoro-agent [flags]\n       kokoro-agent init -master URL -token TOKEN [flags]\n       kokoro-agent service install|uninstall|status|print [flags]\n       kokoro-agent check-config [flags]\n       kokoro-agent test-connection [flags]\n       kokoro-agent collect [-json]\n       kokoro-agent bench [flags]\n\nflags:\n")
+		fs.PrintDefaults()
+		fmt.Fprintf(out, "\nEvery field can also be set with KOKORO_<PATH> (e.g. KOKORO_MASTER_WS_URL,\nKOKORO_TCPPING_INTERVAL_SEC). Precedence: config.json < env < flags. Fields:\n")
+		for _, p := range config.Fields() {
+			fmt.Fprintf(out, "  %s\n", p)
+		}
+	}
+}
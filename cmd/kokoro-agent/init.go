@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Vincentkeio/agent/internal/config"
+	"github.com/Vincentkeio/agent/internal/util"
+)
+
+const defaultConfigPath = "/etc/kokoro-agent/config.json"
+
+// cmdInit writes a first config.json (with a fresh agent_id; mode 0600, as
+// it holds the token), optionally checks that the master accepts it and
+// installs the systemd unit.
+func cmdInit(args []string) int {
+	fs := flag.NewFlagSet("init", flag.ExitOnError)
+	path := fs.String("config", defaultConfigPath, "where to write config.json")
+	master := fs.String("master", "", "master WebSocket URL (wss://HOST/agent/ws) (required)")
+	token := fs.String("token", "", "agent token from the master UI (required)")
+	alias := fs.String("alias", "", "display name")
+	stateDir := fs.String("state-dir", "", "state directory (default "+config.DefaultStateDir+")")
+	insecure := fs.Bool("insecure", false, "skip TLS certificate verification")
+	force := fs.Bool("force", false, "overwrite an existing config (agent_id is kept)")
+	test := fs.Bool("test", false, "connect to the master and check the token")
+	install := fs.Bool("install-service", false, "install and start the systemd unit")
+	_ = fs.Parse(args)
+
+	if *master == "" || *token == "" {
+		fmt.Fprintln(os.Stderr, "kokoro-agent init: -master and -token are required")
+		fs.Usage()
+		return 2
+	}
+
+	var cfg config.Config
+	if _, err := os.Stat(*path); err == nil {
+		if !*force {
+			fmt.Fprintf(os.Stderr, "kokoro-agent init: %s exists (use -force to overwrite)\n", *path)
+			return 1
+		}
+		// Keep the node's identity even if the old file no longer loads.
+		var old struct {
+			AgentID string `json:"agent_id"`
+		}
+		if b, err := os.ReadFile(*path); err == nil && json.Unmarshal(b, &old) == nil {
+			cfg.AgentID = old.AgentID
+		}
+	}
+	cfg.MasterWSURL = *master
+	cfg.Token = *token
+	cfg.Alias = *alias
+	cfg.StateDir = *stateDir
+	cfg.InsecureSkipVerify = *insecure
+	if cfg.AgentID == "" {
+		cfg.AgentID = util.NewUUIDv4()
+	}
+
+	// Check before writing so a typo never replaces a working config.
+	loaded := cfg
+	if err := config.Normalize(*path, &loaded); err != nil {
+		fmt.Fprintf(os.Stderr, "kokoro-agent init: %v\n", err)
+		return exitConfig
+	}
+	for _, p := range config.Validate(*path, loaded) {
+		fmt.Fprintf(os.Stderr, "warning: %v\n", p)
+	}
+	if err := config.Create(*path, cfg); err != nil {
+		fmt.Fprintf(os.Stderr, "kokoro-agent init: %v\n", err)
+		return 1
+	}
+	fmt.Printf("wrote %s (agent_id %s)\n", *path, cfg.AgentID)
+
+	if *test {
+		fmt.Printf("testing connection to %s ...\n", loaded.MasterWSURL)
+		if _, err := checkMaster(loaded, 10*time.Second, nil); err != nil {
+			fmt.Fprintf(os.Stderr, "connection test failed: %v\n", err)
+			return 1
+		}
+		fmt.Println("connection test OK")
+	}
+	if *install {
+		if err := installService(serviceOptions{ConfigPath: *path}); err != nil {
+			fmt.Fprintf(os.Stderr, "install service: %v\n", err)
+			return 1
+		}
+		fmt.Println("service installed and started")
+	}
+	return 0
+}
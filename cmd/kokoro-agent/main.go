@@ -1,29 +1,76 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"os"
 	"os/signal"
 	"syscall"
 
 	"github.com/Vincentkeio/agent/internal/agent"
 	"github.com/Vincentkeio/agent/internal/config"
+	"github.com/Vincentkeio/agent/internal/logx"
+	"github.com/Vincentkeio/agent/internal/pprofsrv"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "bench":
+			os.Exit(cmdBench(os.Args[2:]))
+		case "init":
+			os.Exit(cmdInit(os.Args[2:]))
+		case "service":
+			os.Exit(cmdService(os.Args[2:]))
+		case "test-connection":
+			os.Exit(cmdTestConnection(os.Args[2:]))
+		case "collect":
+			os.Exit(cmdCollect(os.Args[2:]))
+		case "check-config":
+			os.Exit(cmdCheckConfig(os.Args[2:]))
+		}
+	}
+
 	var cfgPath string
 	flag.StringVar(&cfgPath, "config", "", "path to config.json (default: /etc/kokoro-agent/config.json, /opt/kokoro-agent/config.json, ./config.json)")
+	ovs := overrideFlags{}
+	ovs.register(flag.CommandLine)
+	flag.Usage = usage(flag.CommandLine)
 	flag.Parse()
+	if err := config.SetOverrides(ovs); err != nil {
+		fmt.Fprintf(os.Stderr, "kokoro-agent: %v\n", err)
+		os.Exit(2)
+	}
 
 	cfg, cfgFile, err := config.Load(cfgPath)
 	if err != nil {
-		log.Fatalf("load config: %v", err)
+		configFailed(err)
+	}
+	if err := logx.Setup(logOptions(cfg)); err != nil {
+		log.Fatalf("setup logging: %v", err)
+	}
+	slog.Info("starting", "config", cfgFile, "agent_id", cfg.AgentID, "master", cfg.MasterWSURL)
+	if err := dropPrivileges(cfg); err != nil {
+		// never carry on as root when asked not to
+		slog.Error("run_as_user: dropping root failed", "err", err)
+		os.Exit(exitConfig)
+	}
+
+	if cfg.DebugPprof {
+		if err := pprofsrv.Start(cfg.DebugPprofAddr); err != nil {
+			slog.Error("pprof disabled", "err", err)
+		}
 	}
-	fmt.Printf("[kokoro-agent] config=%s agent_id=%s master=%s\n", cfgFile, cfg.AgentID, cfg.MasterWSURL)
 
 	a := agent.New(cfg, cfgFile)
+	a.OnReload(func(c config.Config) {
+		if err := logx.Setup(logOptions(c)); err != nil {
+			slog.Error("reload logging failed", "err", err)
+		}
+	})
 
 	// Signals
 	sigCh := make(chan os.Signal, 2)
@@ -33,19 +80,47 @@ func main() {
 		for s := range sigCh {
 			switch s {
 			case syscall.SIGHUP:
-				fmt.Println("[kokoro-agent] received SIGHUP: reload config and reconnect if needed")
+				slog.Info("received SIGHUP: reload config")
 				if err := a.ReloadConfig(); err != nil {
-					fmt.Printf("[kokoro-agent] reload config failed: %v\n", err)
+					slog.Error("reload config failed", "err", err)
 				}
 			default:
-				fmt.Printf("[kokoro-agent] received %v: exiting...\n", s)
-				a.Stop()
+				slog.Info("received signal: exiting", "signal", s.String())
+				a.Shutdown("signal: " + s.String())
 				return
 			}
 		}
 	}()
 
 	if err := a.Run(); err != nil {
-		log.Fatalf("agent exited: %v", err)
+		slog.Error("agent exited", "err", err)
+		os.Exit(1)
+	}
+}
+
+// exitConfig (EX_CONFIG) tells systemd not to restart-loop on a bad config
+// (see RestartPreventExitStatus in the unit file).
+const exitConfig = 78
+
+// configFailed prints a readable, positioned error plus one structured
+// line for the journal, then exits.
+func configFailed(err error) {
+	fmt.Fprintf(os.Stderr, "kokoro-agent: %v\n", err)
+	attrs := []any{"err", err.Error()}
+	var le *config.LoadError
+	if errors.As(err, &le) {
+		attrs = le.Attrs()
+	}
+	slog.New(slog.NewJSONHandler(os.Stderr, nil)).Error("config load failed", attrs...)
+	os.Exit(exitConfig)
+}
+
+func logOptions(cfg config.Config) logx.Options {
+	return logx.Options{
+		Level:      cfg.LogLevel,
+		Format:     cfg.LogFormat,
+		File:       cfg.LogFile,
+		MaxSizeMB:  cfg.LogMaxSizeMB,
+		MaxBackups: cfg.LogMaxBackups,
 	}
 }
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/Vincentkeio/agent/internal/config"
+	"github.com/Vincentkeio/agent/internal/privdrop"
+	"github.com/Vincentkeio/agent/internal/tcpping"
+)
+
+// dropPrivileges switches to run_as_user when started as root: state_dir
+// (and the log file) are handed over first, and only the capabilities the
+// enabled features need are kept.
+func dropPrivileges(cfg config.Config) error {
+	if cfg.RunAsUser == "" {
+		return nil
+	}
+	if os.Geteuid() != 0 {
+		slog.Info("not running as root, run_as_user has nothing to drop", "uid", os.Geteuid())
+		return nil
+	}
+	uid, gid, err := privdrop.Lookup(cfg.RunAsUser)
+	if err != nil {
+		return err
+	}
+	if err := privdrop.Chown(cfg.StateDir, uid, gid); err != nil {
+		return fmt.Errorf("state_dir: %w", err)
+	}
+	if cfg.LogFile != "" {
+		if err := os.Lchown(cfg.LogFile, uid, gid); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("log_file: %w", err)
+		}
+	}
+	keep := neededCaps(cfg)
+	if err := privdrop.Drop(uid, gid, keep); err != nil {
+		return err
+	}
+	slog.Info("dropped root", "user", cfg.RunAsUser, "uid", uid, "gid", gid, "kept", fmt.Sprint(keep))
+	return nil
+}
+
+// neededCaps are the capabilities the configured features can't do
+// without: raw sockets for pcap, SO_MARK for tcpping.fwmark and binding
+// ports below 1024.
+func neededCaps(cfg config.Config) []privdrop.Cap {
+	var keep []privdrop.Cap
+	if cfg.Pcap.Enabled {
+		keep = append(keep, privdrop.CapNetRaw)
+	}
+	if cfg.TCPPing.Fwmark != 0 {
+		keep = append(keep, privdrop.CapNetAdmin)
+	}
+	lo, _, _ := tcpping.ParsePortRange(cfg.TCPPing.SrcPorts)
+	if lo > 0 && lo < 1024 || cfg.Iperf.Enabled && cfg.Iperf.Port < 1024 {
+		keep = append(keep, privdrop.CapNetBindService)
+	}
+	return keep
+}
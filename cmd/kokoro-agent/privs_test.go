@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/Vincentkeio/agent/internal/config"
+)
+
+func TestNeededCaps(t *testing.T) {
+	tests := []struct {
+		name string
+		set  func(*config.Config)
+		want string
+	}{
+		{"nothing", func(*config.Config) {}, "[]"},
+		{"pcap", func(c *config.Config) { c.Pcap.Enabled = true }, "[CAP_NET_RAW]"},
+		{"fwmark", func(c *config.Config) { c.TCPPing.Fwmark = 7 }, "[CAP_NET_ADMIN]"},
+		{"high source ports", func(c *config.Config) { c.TCPPing.SrcPorts = "40000-40999" }, "[]"},
+		{"low source ports", func(c *config.Config) { c.TCPPing.SrcPorts = "900-999" }, "[CAP_NET_BIND_SERVICE]"},
+		{"iperf default port", func(c *config.Config) { c.Iperf.Enabled = true; c.Iperf.Port = 5201 }, "[]"},
+		{"iperf low port", func(c *config.Config) { c.Iperf.Enabled = true; c.Iperf.Port = 520 }, "[CAP_NET_BIND_SERVICE]"},
+		{"iperf low port, off", func(c *config.Config) { c.Iperf.Port = 520 }, "[]"},
+		{"all", func(c *config.Config) {
+			c.Pcap.Enabled = true
+			c.TCPPing.Fwmark = 1
+			c.TCPPing.SrcPorts = "100-200"
+		}, "[CAP_NET_RAW CAP_NET_ADMIN CAP_NET_BIND_SERVICE]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg config.Config
+			tt.set(&cfg)
+			if got := fmt.Sprint(neededCaps(cfg)); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/Vincentkeio/agent/internal/config"
+)
+
+const (
+	serviceName     = "kokoro-agent"
+	systemdUnitPath = "/etc/systemd/system/kokoro-agent.service"
+	launchdLabel    = "com.kokoro.agent"
+	launchdPlist    = "/Library/LaunchDaemons/com.kokoro.agent.plist"
+)
+
+type serviceOptions struct {
+	ConfigPath string
+	StateDir   string
+	LogFile    string // from the config; its directory must stay writable
+	// User runs the agent unprivileged (systemd: User=, plus the
+	// capabilities fwmark/low source ports need; launchd: UserName).
+	User string
+}
+
+// cmdService manages the OS service: install, uninstall, status, or print
+// (show the generated unit without installing it).
+func cmdService(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: kokoro-agent service install|uninstall|status|print [flags]")
+		return 2
+	}
+	action := args[0]
+	fs := flag.NewFlagSet("service "+action, flag.ExitOnError)
+	var o serviceOptions
+	fs.StringVar(&o.ConfigPath, "config", defaultConfigPath, "config.json the service runs with")
+	fs.StringVar(&o.StateDir, "state-dir", "", "state directory (default: state_dir from the config)")
+	fs.StringVar(&o.User, "user", "", "run as this user instead of root")
+	_ = fs.Parse(args[1:])
+
+	var err error
+	switch action {
+	case "install":
+		if err = installService(o); err == nil {
+			fmt.Println("service installed and started")
+		}
+	case "uninstall":
+		if err = uninstallService(); err == nil {
+			fmt.Println("service removed (config and state are kept)")
+		}
+	case "status":
+		err = serviceStatus()
+	case "print":
+		var text string
+		if text, _, err = serviceFile(o); err == nil {
+			fmt.Print(text)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "kokoro-agent service: unknown action %q\n", action)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "kokoro-agent service %s: %v\n", action, err)
+		return 1
+	}
+	return 0
+}
+
+// serviceFile renders the unit/plist for this binary and returns it with
+// the path it belongs at.
+func serviceFile(o serviceOptions) (text, path string, err error) {
+	bin, err := os.Executable()
+	if err != nil {
+		return "", "", err
+	}
+	if bin, err = filepath.EvalSymlinks(bin); err != nil {
+		return "", "", err
+	}
+	if o.ConfigPath, err = filepath.Abs(o.ConfigPath); err != nil {
+		return "", "", err
+	}
+	if o.StateDir == "" {
+		o.StateDir = config.DefaultStateDir
+	}
+	if cfg, _, err := config.LoadReadOnly(o.ConfigPath); err == nil {
+		if o.StateDir == config.DefaultStateDir {
+			o.StateDir = cfg.StateDir
+		}
+		o.LogFile = cfg.LogFile
+	}
+	switch runtime.GOOS {
+	case "linux":
+		return systemdUnit(bin, o), systemdUnitPath, nil
+	case "darwin":
+		return launchdPlistText(bin, o), launchdPlist, nil
+	}
+	return "", "", errUnsupportedOS
+}
+
+// errUnsupportedOS: only systemd and launchd are generated. On Windows the
+// agent doesn't implement the Service Control Manager protocol, so it has
+// to run under a wrapper that does (see README).
+var errUnsupportedOS = errors.New(runtime.GOOS + " is not supported: run the agent under a service wrapper (e.g. NSSM on Windows)")
+
+// systemdUnit follows systemd/kokoro-agent.service, with the filesystem
+// locked down to the config directory (token_rotate rewrites config.json)
+// and state_dir.
+func systemdUnit(bin string, o serviceOptions) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, `[Unit]
+Description=kokoro agent (Go)
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+Type=simple
+ExecStart=%s --config %s
+ExecReload=/bin/kill -HUP $MAINPID
+Restart=always
+RestartSec=2
+# exit 78 = invalid config: don't crash-loop, fix it and restart
+RestartPreventExitStatus=78
+LimitNOFILE=65535
+`, bin, o.ConfigPath)
+	if o.User != "" {
+		fmt.Fprintf(&b, `User=%s
+# tcpping.fwmark (SO_MARK) and low tcpping.src_ports
+AmbientCapabilities=CAP_NET_ADMIN CAP_NET_BIND_SERVICE
+CapabilityBoundingSet=CAP_NET_ADMIN CAP_NET_BIND_SERVICE
+`, o.User)
+	}
+	rw := []string{filepath.Dir(o.ConfigPath), "-" + o.StateDir}
+	if o.LogFile != "" {
+		rw = append(rw, "-"+filepath.Dir(o.LogFile))
+	}
+	if o.StateDir == config.DefaultStateDir {
+		// created (and chowned to User=) by systemd
+		b.WriteString("StateDirectory=kokoro-agent\n")
+	}
+	fmt.Fprintf(&b, `
+# Hardening
+NoNewPrivileges=true
+PrivateTmp=true
+ProtectSystem=strict
+ProtectHome=true
+ReadWritePaths=%s
+ProtectKernelModules=true
+ProtectControlGroups=true
+RestrictSUIDSGID=true
+LockPersonality=true
+
+[Install]
+WantedBy=multi-user.target
+`, strings.Join(rw, " "))
+	return b.String()
+}
+
+func launchdPlistText(bin string, o serviceOptions) string {
+	user := ""
+	if o.User != "" {
+		user = fmt.Sprintf("\t<key>UserName</key>\n\t<string>%s</string>\n", o.User)
+	}
+	return fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>%s</string>
+	<key>ProgramArguments</key>
+	<array>
+		<string>%s</string>
+		<string>--config</string>
+		<string>%s</string>
+	</array>
+%s	<key>RunAtLoad</key>
+	<true/>
+	<key>KeepAlive</key>
+	<true/>
+	<key>ThrottleInterval</key>
+	<integer>2</integer>
+	<key>StandardErrorPath</key>
+	<string>/var/log/kokoro-agent.log</string>
+</dict>
+</plist>
+`, launchdLabel, bin, o.ConfigPath, user)
+}
+
+// installService writes the unit/plist for this binary, then enables and
+// (re)starts it.
+func installService(o serviceOptions) error {
+	text, path, err := serviceFile(o)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, []byte(text), 0644); err != nil {
+		return err
+	}
+	if runtime.GOOS == "darwin" {
+		_ = run("launchctl", "bootout", "system/"+launchdLabel) // may not be loaded
+		return run("launchctl", "bootstrap", "system", path)
+	}
+	if err := run("systemctl", "daemon-reload"); err != nil {
+		return err
+	}
+	if err := run("systemctl", "enable", serviceName); err != nil {
+		return err
+	}
+	return run("systemctl", "restart", serviceName)
+}
+
+func uninstallService() error {
+	switch runtime.GOOS {
+	case "darwin":
+		_ = run("launchctl", "bootout", "system/"+launchdLabel)
+		if err := os.Remove(launchdPlist); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	case "linux":
+		_ = run("systemctl", "disable", "--now", serviceName)
+		if err := os.Remove(systemdUnitPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return run("systemctl", "daemon-reload")
+	}
+	return errUnsupportedOS
+}
+
+func serviceStatus() error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("launchctl", "print", "system/"+launchdLabel)
+	case "linux":
+		cmd = exec.Command("systemctl", "status", "--no-pager", serviceName)
+	default:
+		return errUnsupportedOS
+	}
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	err := cmd.Run()
+	var ee *exec.ExitError
+	if errors.As(err, &ee) {
+		// systemctl status exits non-zero for stopped units; the output says why.
+		return fmt.Errorf("service not running (exit %d)", ee.ExitCode())
+	}
+	return err
+}
+
+func run(name string, args ...string) error {
+	if out, err := exec.Command(name, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s %s: %v: %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
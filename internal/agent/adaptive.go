@@ -0,0 +1,113 @@
+package agent
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Vincentkeio/agent/internal/metrics"
+)
+
+const (
+	// After a reconnect, stay stretched this long before restoring.
+	reconnectCooldown = 60 * time.Second
+	// A metrics write slower than this means the socket is backing up.
+	slowWriteThreshold = 500 * time.Millisecond
+	slowWriteCooldown  = 30 * time.Second
+	// Stay backed off this long after the last CPU sample above threshold.
+	cpuPressureCooldown = 30 * time.Second
+	// tcpping intervals are multiplied by this while CPU is pressured.
+	cpuPressureProbeFactor = 2
+)
+
+// stretch marks the link degraded for reason until now+d. While any reason
+// is active the metrics interval is raised to degraded_metrics_interval_ms.
+func (a *Agent) stretch(reason string, d time.Duration) {
+	a.adaptMu.Lock()
+	defer a.adaptMu.Unlock()
+	if a.adapt == nil {
+		a.adapt = map[string]time.Time{}
+	}
+	until := time.Now().Add(d)
+	if until.After(a.adapt[reason]) {
+		a.adapt[reason] = until
+	}
+}
+
+// stretchReasons returns the active reasons joined with "," ("" = normal).
+func (a *Agent) stretchReasons() string {
+	a.adaptMu.Lock()
+	defer a.adaptMu.Unlock()
+	now := time.Now()
+	var rs []string
+	for r, until := range a.adapt {
+		if now.After(until) {
+			delete(a.adapt, r)
+			continue
+		}
+		rs = append(rs, r)
+	}
+	sort.Strings(rs)
+	return strings.Join(rs, ",")
+}
+
+// stretchedFor reports whether reason is currently active.
+func (a *Agent) stretchedFor(reason string) bool {
+	a.adaptMu.Lock()
+	defer a.adaptMu.Unlock()
+	return time.Now().Before(a.adapt[reason])
+}
+
+// noteCPU backs collection and probing off while the node's own CPU is above
+// cpu_pressure_threshold, so the agent never adds to an overload.
+func (a *Agent) noteCPU(pct float64) {
+	th := a.getCfg().CPUPressureThreshold
+	if th <= 0 || th >= 100 || pct < th {
+		return
+	}
+	a.stretch("cpu_high", cpuPressureCooldown)
+}
+
+// effectiveMetricsInterval is the pushed/configured interval, stretched while
+// the link is degraded. The reason is "" when not stretched.
+func (a *Agent) effectiveMetricsInterval() (time.Duration, string) {
+	base := a.getMetricsInterval()
+	reason := a.stretchReasons()
+	if reason == "" {
+		return base, ""
+	}
+	slow := time.Duration(a.getCfg().DegradedMetricsIntervalMS) * time.Millisecond
+	if slow <= base {
+		return base, ""
+	}
+	return slow, reason
+}
+
+// cpuSampleLoop samples CPU every cpu_sample_ms for the cpu_stats of the
+// next metrics, while metrics go out at least two steps apart (a long
+// pushed interval, or a stretched one); at shorter intervals the plain cpu
+// figure is fine-grained enough and the sampler stays idle.
+func (a *Agent) cpuSampleLoop(ctx context.Context, s *metrics.CPUSampler) {
+	for {
+		step := time.Duration(a.getCfg().CPUSampleMS) * time.Millisecond
+		interval, _ := a.effectiveMetricsInterval()
+		if step > 0 && interval >= 2*step && !a.isPaused() {
+			s.SetEvery(step)
+			s.Sample()
+		} else {
+			s.Reset()
+			step = time.Second
+		}
+		t := time.NewTimer(step)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-a.stopCh:
+			t.Stop()
+			return
+		}
+	}
+}
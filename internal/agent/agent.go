@@ -2,28 +2,60 @@ package agent
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
-	"fmt"
-	"os"
-	"runtime"
+	"log/slog"
+	"path/filepath"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/Vincentkeio/agent/internal/alerts"
+	"github.com/Vincentkeio/agent/internal/authlog"
+	"github.com/Vincentkeio/agent/internal/bench"
+	"github.com/Vincentkeio/agent/internal/capstats"
+	"github.com/Vincentkeio/agent/internal/clock"
+	"github.com/Vincentkeio/agent/internal/codec"
 	"github.com/Vincentkeio/agent/internal/config"
+	"github.com/Vincentkeio/agent/internal/k8s"
+	"github.com/Vincentkeio/agent/internal/logx"
+	"github.com/Vincentkeio/agent/internal/lua"
 	"github.com/Vincentkeio/agent/internal/metrics"
 	"github.com/Vincentkeio/agent/internal/netprobe"
+	"github.com/Vincentkeio/agent/internal/netwatch"
+	"github.com/Vincentkeio/agent/internal/platform"
+	"github.com/Vincentkeio/agent/internal/ports"
+	"github.com/Vincentkeio/agent/internal/preflight"
+	"github.com/Vincentkeio/agent/internal/presets"
+	"github.com/Vincentkeio/agent/internal/procwatch"
+	"github.com/Vincentkeio/agent/internal/statecheck"
+	"github.com/Vincentkeio/agent/internal/tasks"
 	"github.com/Vincentkeio/agent/internal/tcpping"
+	"github.com/Vincentkeio/agent/internal/traffic"
+	"github.com/Vincentkeio/agent/internal/version"
 	"github.com/Vincentkeio/agent/internal/ws"
+	"github.com/Vincentkeio/agent/pkg/agentproto"
 )
 
 type runtimeConfig struct {
-	MetricsIntervalMS  int
-	TCPPingEnabled     bool
-	TCPPingIntervalSec int
-	TCPPingTargets     []tcpping.Target
-	ConfigVersion      int64
+	MetricsIntervalMS  int                 `json:"metrics_interval_ms,omitempty"`
+	TCPPingEnabled     bool                `json:"tcpping_enabled,omitempty"`
+	TCPPingIntervalSec int                 `json:"tcpping_interval_sec,omitempty"`
+	TCPPingTargets     []tcpping.Target    `json:"tcpping_targets,omitempty"`
+	TCPPingPresets     []string            `json:"tcpping_presets,omitempty"` // nil = use config
+	TCPPingWorkers     int                 `json:"tcpping_workers,omitempty"`
+	TCPPingAggregate   int                 `json:"tcpping_aggregate,omitempty"`    // 0 = use config, <0 = off
+	BatchMS            int                 `json:"batch_ms,omitempty"`             // 0 = use config, <0 = off
+	RollupSec          int                 `json:"rollup_sec,omitempty"`           // 0 = use config, <0 = off
+	NetProbeRefreshSec int                 `json:"netprobe_refresh_sec,omitempty"` // 0 = use config, <0 = off
+	IPEcho             *netprobe.Endpoints `json:"ip_echo,omitempty"`              // nil = use config
+	Traffic            *pushedTraffic      `json:"traffic,omitempty"`              // nil = use config
+	AlertRules         []alerts.Rule       `json:"alert_rules,omitempty"`          // nil = use config
+	Tags               []string            `json:"tags"`                           // nil = use config
+	Watch              []procwatch.Watch   `json:"watch"`                          // nil = use config
+	Tasks              []tasks.Task        `json:"tasks"`                          // nil = use config
+	ConfigVersion      int64               `json:"config_version,omitempty"`
 }
 
 type Agent struct {
@@ -38,20 +70,200 @@ type Agent struct {
 	stopped     atomic.Bool
 	reconnectCh chan struct{} // SIGHUP -> ask current connection to reconnect
 
-	seq atomic.Uint64
+	// seq numbers metrics, tcpping batches and agent_stats; it continues
+	// across restarts (seq.json in state_dir). seqEpoch is new every run.
+	seq         atomic.Uint64
+	seqLeaseEnd atomic.Uint64
+	seqLeaseMu  sync.Mutex
+	seqEpoch    string
+	seqBase     uint64 // first seq of this run
+	seqReset    bool   // no seq state: seqs started over at 1
 
-	// One-time per process start (reported in hello only; not in metrics)
+	// Per-capability run/failure counters, persisted in state_dir.
+	stats *capstats.Store
+
+	// Interface byte accounting per billing month, persisted in state_dir.
+	traffic *traffic.Store
+
+	// Local alert rule evaluation; events wait in alertQueue for a session.
+	alerts     *alerts.Engine
+	alertMu    sync.Mutex
+	alertQueue []alerts.Event
+	alertKick  chan struct{}
+
+	// Scheduled tasks; results wait in taskQueue for a session.
+	tasks     tasks.Runner
+	taskMu    sync.Mutex
+	taskQueue []tasks.Result
+	taskKick  chan struct{}
+
+	// Failed ssh logins (ssh_auth_log); nil while off.
+	authMu sync.Mutex
+	auth   *authlog.Counter
+
+	// Last listening-port inventory, kept across sessions for the diff.
+	portsMu    sync.Mutex
+	ports      []ports.Listener
+	portsKnown bool
+
+	// Last path traced per tcpping target, kept across sessions.
+	pathMu sync.Mutex
+	paths  map[string]*watchedPath
+
+	// Collector plugin processes, kept running across sessions.
+	pluginMu sync.Mutex
+	sidecars map[string]*runningPlugin
+
+	// Last Kubernetes node report (kubernetes.enabled), kept across
+	// sessions.
+	k8sMu   sync.Mutex
+	k8sNode *k8s.Node
+
+	// Transform script (transform.script), reloaded when the file changes.
+	scriptMu     sync.Mutex
+	script       *lua.State
+	scriptKey    string // path, size and mtime of the file loaded
+	scriptWarned time.Time
+
+	// Public IP probe: at process start (reported in hello), then re-run
+	// every netprobe_refresh_sec (netprobe_update on change)
+	netMu        sync.Mutex
 	netProbe     netprobe.Result
 	netProbeDone bool
+	geo          *netprobe.Geo // optional geoip/ASN of the public address
+
+	// Default routes last seen (net_watch_sec), and a net_change held back
+	// for the next session when the change cost the connection.
+	route            netwatch.Route
+	pendingNetChange map[string]any
+
+	// Startup prerequisite checks; failures are reported in hello.
+	degraded map[string]string
+
+	// Hypervisor, container and cloud instance, detected at startup
+	// (hello sys.platform).
+	platform platform.Info
+
+	// Adaptive metrics interval: reason -> stretched until
+	adaptMu    sync.Mutex
+	adapt      map[string]time.Time
+	failStreak int       // consecutive failed sessions (touched only by Run)
+	reconnect  backoff   // reset once a session gets hello_ok (Run only)
+	sessionUp  time.Time // when the current session got hello_ok (Run only)
+
+	// TLS session tickets from the master, so reconnects resume
+	tlsSessions tls.ClientSessionCache
+
+	// pause/resume from master (maintenance mode)
+	pauseMu sync.Mutex
+	pause   pauseState
+
+	// log level override from master (set_log_level)
+	logOv logOverride
+
+	// state_dir integrity findings not yet reported (state_event)
+	stateMu     sync.Mutex
+	stateIssues []statecheck.Issue
+
+	// clock offset vs master, measured on hello_ok
+	helloSentMS   atomic.Int64
+	clockOffsetMS atomic.Int64
+	clockKnown    atomic.Bool
+
+	// outgoing encoder (codec.Encoder): config `encoding`, hello_ok may override
+	enc atomic.Value
+
+	// control ping round trips on the current connection (ws_rtt_ms)
+	rttMu    sync.Mutex
+	rtts     []time.Duration
+	lastPong atomic.Int64 // unix ns, any pong to one of our pings
+
+	// tcpping_summary window being collected (tcpping.aggregate_sec)
+	summaryMu   sync.Mutex
+	summary     *tcpping.Aggregator
+	summaryFrom time.Time
+	summaryTo   time.Time
+
+	// recent tcpping_batch messages for master-requested re-sends
+	batches batchCache
+
+	// capabilities switched on/off by the master in hello_ok
+	capMu      sync.Mutex
+	masterCaps map[string]bool
+
+	// HMAC-signed frames (negotiated in hello_ok)
+	signing atomic.Bool
+	sigSeq  atomic.Uint64
+
+	// metrics as deltas (hello_ok "delta": "metrics-v1")
+	delta atomic.Bool
+
+	// zstd-compressed replays (hello_ok "compress": "zstd")
+	compress atomic.Bool
+
+	// protocol version of the current session (hello_ok "proto_ver")
+	protoVer atomic.Int32
+
+	// master's max_frame (hello_ok); larger messages go out as chunks
+	maxFrame atomic.Int64
+
+	// a pcap_request is being captured
+	pcapBusy atomic.Bool
+	// an iperf_request test is running
+	iperfBusy atomic.Bool
+	// netinfo_request queries running
+	netinfoRunning atomic.Int32
+
+	// the session's outbox once hello_ok arrived, nil between sessions
+	sessOut atomic.Pointer[outbox]
+
+	// wall clock watchdog / fallback source for reported timestamps
+	clock       *clock.Guard
+	clockEvMu   sync.Mutex
+	clockEvents []clock.Event
+
+	// sign_key of the current session; a reload only changes cfg.SignKey,
+	// which the next session uses
+	sessSignKey atomic.Value
+
+	// target preset catalog (presets_update may replace it)
+	presets atomic.Pointer[presets.Catalog]
+
+	// called with the new config after every successful reload
+	onReload func(config.Config)
+
+	// graceful shutdown: why we stop, and work that should finish first
+	stopReason atomic.Value
+	inflight   atomic.Int64
+
+	// outbox counters (send_queue in agent_stats) and the fate of every
+	// seq (gaps in agent_stats)
+	sendStats sendStats
+	seqs      seqTracker
 }
 
 func New(cfg config.Config, cfgFile string) *Agent {
-	return &Agent{
+	a := &Agent{
 		cfg:         cfg,
 		cfgFile:     cfgFile,
 		stopCh:      make(chan struct{}),
 		reconnectCh: make(chan struct{}, 1),
+		clock:       clock.NewGuard(cfg.ClockSource),
+		alerts:      alerts.New(),
+		alertKick:   make(chan struct{}, 1),
+		taskKick:    make(chan struct{}, 1),
+		tlsSessions: tls.NewLRUClientSessionCache(4),
 	}
+	// Quarantine files truncated by a crash before anything loads them.
+	a.checkState()
+	a.loadRuntimeConfig()
+	a.loadSeq()
+	a.stats = capstats.Open(filepath.Join(cfg.StateDir, "capstats.json"))
+	a.traffic = traffic.Open(filepath.Join(cfg.StateDir, "traffic.json"))
+	a.presets.Store(presets.Load(cfg.StateDir))
+	a.warnUnknownPresets(cfg.TCPPing.Presets)
+	applyProbeSocketOptions(cfg)
+	return a
 }
 
 func (a *Agent) Stop() {
@@ -60,8 +272,22 @@ func (a *Agent) Stop() {
 	}
 }
 
-// ReloadConfig reloads local config.json (token/master url etc) and requests reconnect.
+// ReloadConfig reloads local config.json. Only changes to the transport
+// (master url, token, TLS) or to what hello announces force a reconnect;
+// the rest (metrics interval, net_iface, numa, tcpping defaults, ...) is
+// picked up live by the running loops.
 func (a *Agent) ReloadConfig() error {
+	if err := a.reloadConfig(); err != nil {
+		return err
+	}
+	a.syncAlertRules()
+	if a.onReload != nil {
+		a.onReload(a.getCfg())
+	}
+	return nil
+}
+
+func (a *Agent) reloadConfig() error {
 	a.mu.Lock()
 	defer a.mu.Unlock()
 
@@ -69,8 +295,19 @@ func (a *Agent) ReloadConfig() error {
 	if err != nil {
 		return err
 	}
+	old := a.cfg
 	a.cfg = newCfg
+	applyProbeSocketOptions(newCfg)
 
+	if fs := needsRestart(old, newCfg); len(fs) > 0 {
+		slog.Warn("config changes need a restart to take effect", "fields", fs)
+	}
+	fs := needsReconnect(old, newCfg)
+	if len(fs) == 0 {
+		slog.Info("config reloaded without reconnect")
+		return nil
+	}
+	slog.Info("config reloaded: reconnecting", "fields", fs)
 	select {
 	case a.reconnectCh <- struct{}{}:
 	default:
@@ -78,12 +315,79 @@ func (a *Agent) ReloadConfig() error {
 	return nil
 }
 
+// OnReload registers f to run after each successful ReloadConfig (SIGHUP
+// or file change). Set it before Run.
+func (a *Agent) OnReload(f func(config.Config)) {
+	a.onReload = f
+}
+
+// Config returns the current local config (after any reloads).
+func (a *Agent) Config() config.Config {
+	return a.getCfg()
+}
+
 func (a *Agent) Run() error {
-	// One-time net probe at process start (reported in hello only).
-	a.netProbe = netprobe.Probe(3*time.Second, a.cfg.InsecureSkipVerify)
-	a.netProbeDone = true
+	// One-time net probe and platform detection at process start
+	// (reported in hello only).
+	platformDone := make(chan struct{})
+	go func() {
+		defer close(platformDone)
+		a.detectPlatform()
+	}()
+	a.runNetProbe()
+	<-platformDone
+	a.route = netwatch.Current()
+
+	a.degraded = preflight.Degraded(preflight.Run(preflight.Options{
+		StateDir:       a.cfg.StateDir,
+		TCPPingWorkers: a.cfg.TCPPing.Concurrency,
+	}))
+	for _, c := range builtinCaps {
+		if !a.localCapOff(c) && a.refusedAsRoot(c) {
+			if a.degraded == nil {
+				a.degraded = map[string]string{}
+			}
+			a.degraded[c] = "refused as root: set run_as_user, or allow_root"
+		}
+	}
+	for c, why := range a.degraded {
+		slog.Warn("capability degraded", "cap", c, "reason", why)
+	}
+
+	go a.clockGuardLoop()
+	go a.configWatchLoop()
+	go a.trafficLoop()
+	go a.securityLoop()
+	go a.tcppingLoop()
+	go a.procwatchLoop()
+	go a.taskLoop()
+	go a.k8sLoop()
+	a.syncAlertRules()
+	go a.alertLoop()
+
+	// collector plugins run across sessions; stop them on exit
+	defer a.closePlugins()
+
+	// Persist capability counters periodically and on exit; re-check
+	// state_dir integrity now and then.
+	defer a.saveStats()
+	go func() {
+		t := time.NewTicker(time.Minute)
+		defer t.Stop()
+		ct := time.NewTicker(stateCheckInterval)
+		defer ct.Stop()
+		for {
+			select {
+			case <-t.C:
+				a.saveStats()
+			case <-ct.C:
+				a.checkState()
+			case <-a.stopCh:
+				return
+			}
+		}
+	}()
 
-	backoff := time.Second
 	for {
 		select {
 		case <-a.stopCh:
@@ -92,23 +396,24 @@ func (a *Agent) Run() error {
 		}
 
 		err := a.runOnce()
+		up := a.sessionUp
+		a.sessionUp = time.Time{}
 		if err == nil {
-			backoff = time.Second
+			a.reconnect.reset()
 			continue
 		}
+		if !up.IsZero() {
+			a.hookDisconnect(err, time.Since(up))
+		}
 
-		fmt.Printf("[kokoro-agent] disconnected: %v; reconnect in %v\n", err, backoff)
+		a.failStreak++
+		wait := a.reconnect.next(a.backoffParams())
+		slog.Warn("disconnected", "err", err, "reconnect_in", wait.Round(time.Millisecond).String())
 		select {
-		case <-time.After(backoff):
+		case <-time.After(wait):
 		case <-a.stopCh:
 			return nil
 		}
-		if backoff < 30*time.Second {
-			backoff *= 2
-			if backoff > 30*time.Second {
-				backoff = 30*time.Second
-			}
-		}
 	}
 }
 
@@ -118,71 +423,150 @@ func (a *Agent) runOnce() error {
 	ctxDial, cancelDial := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancelDial()
 
-	conn, _, err := ws.Dial(ctxDial, cfg.MasterWSURL, cfg.InsecureSkipVerify)
+	ech, _ := ws.CheckECH(cfg.TLSECHConfig) // validated by config.Load
+	conn, _, err := ws.DialWith(ctxDial, cfg.MasterWSURL, ws.Options{
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+		ServerName:         cfg.TLSServerName,
+		ECHConfigList:      ech,
+		Pins:               tlsPins(cfg),
+		PreferIP:           cfg.PreferIP,
+		Resolve:            cfg.MasterResolve.Lookup,
+		Headers:            cfg.MasterHeaders,
+		KeepAlive:          time.Duration(cfg.TCPKeepAliveSec) * time.Second,
+		UserTimeout:        time.Duration(cfg.TCPUserTimeoutSec) * time.Second,
+		TLSSessions:        a.tlsSessions,
+		Subprotocols:       []string{agentproto.Subprotocol},
+	})
 	if err != nil {
 		return err
 	}
-	defer conn.Close()
+	a.sessSignKey.Store(cfg.SignKey)
+
+	// Every goroutine of this session hangs off ctx and is waited for on
+	// return, so none outlives the connection (or writes to a dead one).
+	// Closing conn unblocks recvLoop's read.
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	spawn := func(f func()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f()
+		}()
+	}
+	defer func() {
+		cancel()
+		_ = conn.Close()
+		wg.Wait()
+	}()
 
 	// Reconnect trigger (SIGHUP)
-	go func() {
+	spawn(func() {
 		select {
 		case <-a.reconnectCh:
 			_ = conn.WriteClose(1000, "reload")
 			_ = conn.Close()
-		case <-a.stopCh:
-			return
+		case <-ctx.Done():
 		}
-	}()
+	})
 
-	// Client keepalive ping
-	go func() {
-		t := time.NewTicker(30 * time.Second)
-		defer t.Stop()
-		for {
-			select {
-			case <-t.C:
-				_ = conn.WritePing([]byte("ping"))
-			case <-a.stopCh:
-				return
-			}
-		}
-	}()
+	// Client keepalive ping and liveness check; the pongs also measure
+	// control-plane RTT
+	a.resetWSRTT()
+	conn.SetPongHandler(a.notePong)
+	recvErr := make(chan error, 1)
+	spawn(func() { a.keepalive(ctx, conn, recvErr) })
 
 	// Send hello (first message)
+	sysNow := platform.ReadSystem()
+	sys := sysNow.Fields()
+	if topo := metrics.Topology(); topo != nil {
+		sys["numa"] = topo
+	}
+	if b, err := bench.Load(cfg.StateDir); err == nil {
+		sys["bench"] = b
+	}
+	if p := a.platform; p.Virt != "" || p.Container != "" || p.Cloud != nil {
+		sys["platform"] = p
+	}
 	hello := map[string]any{
 		"type":      "hello",
 		"agent_id":  cfg.AgentID,
 		"token":     cfg.Token,
-		"agent_ver": "0.1.0",
+		"agent_ver": version.Version,
+		"proto_ver": agentproto.ProtoVersion,
 		"client_ts": time.Now().Unix(),
-		"cap":       []string{"metrics", "tcpping"},
-		"sys": map[string]any{
-			"hostname": mustHostname(),
-			"os":       runtime.GOOS,
-			"arch":     runtime.GOARCH,
-		},
+		"cap":       a.announcedCaps(),
+		"encodings": codec.Names(),
+		"sign":      a.signOffer(),
+		"delta":     a.deltaOffer(),
+		"compress":  a.compressOffer(),
+		"presets":   a.catalog().Version,
+		"sys":       sys,
 	}
 	if cfg.Alias != "" {
 		hello["alias"] = cfg.Alias
 	}
-	if a.netProbeDone {
-		hello["net_probe"] = a.netProbe
+	if tags := a.tags(); len(tags) > 0 {
+		hello["tags"] = tags
+	}
+	if np, ok := a.lastNetProbe(); ok {
+		hello["net_probe"] = np
+	}
+	if g := a.lastGeo(); g != nil {
+		hello["geo"] = g
+	}
+	if len(a.degraded) > 0 {
+		hello["cap_degraded"] = a.degraded
+	}
+	if n := a.maxFrameOffer(); n > 0 {
+		hello["max_frame"] = n
+	}
+	if cfg.SignKey != "" {
+		hello["sign_key_id"] = agentproto.SignKeyID(cfg.SignKey)
+	}
+	if v := a.getConfigVersion(); v > 0 {
+		hello["config_version"] = v
+	}
+	hello["seq_epoch"] = a.seqEpoch
+	hello["seq_base"] = a.seqBase
+	hello["seq_next"] = a.seq.Load() + 1
+	if a.seqReset {
+		hello["seq_reset"] = true
+	}
+	if cfg.Kubernetes.Enabled {
+		id := k8s.IdentityFromEnv()
+		id.Cluster = cfg.Kubernetes.Cluster
+		hello["k8s"] = id
 	}
 
+	// hello is always JSON; hello_ok picks the encoding for the rest
+	a.enc.Store(codec.Default())
+	a.signing.Store(false)
+	a.maxFrame.Store(0)
+	a.helloSentMS.Store(time.Now().UnixMilli())
 	if err := writeJSON(conn, hello); err != nil {
 		return err
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	// All messages after hello go through the session's single writer.
+	out := a.newOutbox(conn)
+	spawn(func() { out.run(ctx) })
+	defer a.sessOut.CompareAndSwap(out, nil)
 
-	recvErr := make(chan error, 1)
 	ready := make(chan struct{})
-	go a.recvLoop(ctx, conn, ready, recvErr)
+	spawn(func() { a.recvLoop(ctx, conn, out, ready, recvErr) })
 
 	select {
 	case <-ready:
+		a.sessOut.Store(out)
+		a.reconnect.reset()
+		a.sessionUp = time.Now()
+		if a.failStreak > 0 {
+			// just came back from backoff: don't flood the master right away
+			a.stretch("reconnect", reconnectCooldown)
+			a.failStreak = 0
+		}
 	case err := <-recvErr:
 		return err
 	case <-time.After(10 * time.Second):
@@ -192,8 +576,14 @@ func (a *Agent) runOnce() error {
 	}
 
 	// metrics loop
-	metCollector := metrics.NewCollector(cfg.NetIface)
-	go func() {
+	metIface := cfg.NetIface
+	metCollector := metrics.NewCollector(metIface)
+	metCollector.SetNUMA(cfg.NUMA)
+	metCollector.SetIfaces(cfg.NetIfaces)
+	cpuSampler := metrics.NewCPUSampler(time.Second)
+	var roll rollup
+	spawn(func() { a.cpuSampleLoop(ctx, cpuSampler) })
+	spawn(func() {
 		for {
 			select {
 			case <-ctx.Done():
@@ -203,13 +593,36 @@ func (a *Agent) runOnce() error {
 			default:
 			}
 
-			interval := a.getMetricsInterval()
+			interval, stretched := a.effectiveMetricsInterval()
 			timer := time.NewTimer(interval)
 			select {
 			case <-timer.C:
+				if a.isPaused() || !a.capAllowed("metrics") {
+					continue
+				}
+				// net_iface / net_ifaces / numa may change on SIGHUP
+				// without reconnect
+				live := a.getCfg()
+				if live.NetIface != metIface {
+					metIface = live.NetIface
+					metCollector = metrics.NewCollector(metIface)
+				}
+				metCollector.SetNUMA(live.NUMA)
+				metCollector.SetIfaces(live.NetIfaces)
+				done := a.busy()
+				start := time.Now()
 				snap, err := metCollector.Collect()
+				a.stats.Record("metrics", time.Since(start), err)
 				if err == nil {
-					seq := a.seq.Add(1)
+					snap.CPUStats = cpuSampler.Take()
+					a.noteCPU(snap.CPU)
+					snap.Security = a.securityInfo()
+					snap.K8s = a.k8sInfo()
+					if snap.Health != nil {
+						snap.Health.ClockSource = a.clock.SourceName()
+					}
+					snap.TS = a.reportTS(snap.TS)
+					seq := a.nextSeq()
 					msg := map[string]any{
 						"type":     "metrics",
 						"agent_id": cfg.AgentID,
@@ -217,8 +630,24 @@ func (a *Agent) runOnce() error {
 						"ts":       snap.TS,
 						"metrics":  snap,
 					}
-					_ = writeJSON(conn, msg)
+					if off, ok := a.clockOffset(); ok {
+						msg["clock_offset_ms"] = off
+					}
+					if rtt, ok := a.wsRTT(); ok {
+						msg["ws_rtt_ms"] = rtt
+					}
+					if stretched != "" {
+						msg["interval_ms"] = interval.Milliseconds()
+						msg["stretched"] = stretched
+					}
+					_ = out.send(msg)
+					if sec := a.getRollup(); sec > 0 {
+						a.sendRollup(out, cfg.AgentID, roll.add(snap, snap.TS, sec))
+					} else {
+						roll = rollup{}
+					}
 				}
+				done()
 			case <-ctx.Done():
 				timer.Stop()
 				return
@@ -227,78 +656,110 @@ func (a *Agent) runOnce() error {
 				return
 			}
 		}
-	}()
+	})
 
-	// tcpping loop
-	go func() {
+	// alert_fire / alert_resolve, including those raised while disconnected
+	spawn(func() { a.alertSendLoop(ctx, out, cfg.AgentID) })
+
+	// task_result, including runs finished while disconnected
+	spawn(func() { a.taskSendLoop(ctx, out, cfg.AgentID) })
+
+	// public IP refresh
+	spawn(func() { a.netProbeLoop(ctx, out, cfg.AgentID) })
+
+	// default route changes (netlink), reconnecting if they cost the
+	// connection its source address
+	spawn(func() { a.netChangeLoop(ctx, out, cfg.AgentID, conn) })
+
+	// hostname, kernel, distro and size changes since hello
+	spawn(func() { a.sysinfoLoop(ctx, out, cfg.AgentID, sysNow) })
+
+	// WireGuard / tunnel interfaces
+	spawn(func() { a.tunnelLoop(ctx, out, cfg.AgentID) })
+
+	// listening ports inventory
+	spawn(func() { a.portsLoop(ctx, out, cfg.AgentID) })
+
+	// first hops towards the tcpping targets
+	spawn(func() { a.pathWatchLoop(ctx, out, cfg.AgentID) })
+
+	// plugin_metrics from the collector plugins
+	spawn(func() { a.pluginLoop(ctx, out, cfg.AgentID) })
+
+	// agent_stats loop (capability counters)
+	spawn(func() {
+		t := time.NewTicker(60 * time.Second)
+		defer t.Stop()
 		for {
+			msg := map[string]any{
+				"type":       "agent_stats",
+				"agent_id":   cfg.AgentID,
+				"seq":        a.nextSeq(),
+				"ts":         a.reportTS(time.Now().Unix()),
+				"caps":       a.stats.Snapshot(),
+				"pause":      a.pauseInfo(),
+				"deploy":     a.deployInfo(),
+				"send_queue": a.sendQueueInfo(),
+				"traffic":    a.trafficInfo(),
+				"alerts":     a.alertInfo(),
+				"proto_ver":  a.protoVer.Load(),
+			}
+			if gaps := a.seqs.report(); gaps != nil {
+				msg["gaps"] = gaps
+			}
+			_ = out.send(msg)
+
+			a.flushEvents(out, cfg.AgentID)
+
 			select {
+			case <-t.C:
 			case <-ctx.Done():
 				return
 			case <-a.stopCh:
 				return
-			default:
 			}
-
-			enabled, interval, targets := a.getTCPPing()
-			if !enabled || interval <= 0 || len(targets) == 0 {
-				time.Sleep(2 * time.Second)
-				continue
-			}
-
-			t := time.NewTicker(time.Duration(interval) * time.Second)
-			for {
-				select {
-				case <-t.C:
-					ctx2, cancel2 := context.WithTimeout(ctx, 4*time.Second)
-					samples := make([]tcpping.Sample, 0, len(targets))
-					for _, tg := range targets {
-						samples = append(samples, tcpping.Ping(ctx2, tg))
-					}
-					cancel2()
-
-					seq := a.seq.Add(1)
-					msg := map[string]any{
-						"type":     "tcpping_batch",
-						"agent_id": cfg.AgentID,
-						"seq":      seq,
-						"ts":       time.Now().Unix(),
-						"samples":  samples,
-					}
-					_ = writeJSON(conn, msg)
-
-				case <-ctx.Done():
-					t.Stop()
-					return
-				case <-a.stopCh:
-					t.Stop()
-					return
-				default:
-					en2, i2, tg2 := a.getTCPPing()
-					if !en2 || i2 != interval || len(tg2) != len(targets) {
-						t.Stop()
-						goto OUTER
-					}
-					time.Sleep(200 * time.Millisecond)
-				}
-			}
-		OUTER:
-			continue
 		}
-	}()
+	})
 
 	select {
 	case err := <-recvErr:
-		cancel()
 		return err
 	case <-a.stopCh:
-		cancel()
+		a.goodbye(conn, out, cfg.AgentID)
 		return nil
 	}
 }
 
-func (a *Agent) recvLoop(ctx context.Context, conn *ws.Conn, ready chan<- struct{}, recvErr chan<- error) {
+// flushEvents sends queued clock_event / state_event messages.
+func (a *Agent) flushEvents(out *outbox, agentID string) {
+	if evs := a.takeClockEvents(); len(evs) > 0 {
+		_ = out.send(map[string]any{
+			"type":     "clock_event",
+			"agent_id": agentID,
+			"ts":       a.reportTS(time.Now().Unix()),
+			"source":   a.clock.SourceName(),
+			"events":   evs,
+		})
+	}
+
+	if issues := a.takeStateIssues(); len(issues) > 0 {
+		ev := map[string]any{
+			"type":     "state_event",
+			"agent_id": agentID,
+			"ts":       time.Now().Unix(),
+			"issues":   issues,
+		}
+		if err := out.send(ev); err != nil {
+			a.requeueStateIssues(issues)
+		}
+	}
+}
+
+func (a *Agent) recvLoop(ctx context.Context, conn *ws.Conn, out *outbox, ready chan<- struct{}, recvErr chan<- error) {
 	seenReady := false
+	chunks := agentproto.Reassembler{MaxBytes: a.getCfg().MaxMessageMB << 20}
+	fwd := a.newForwarder(out)
+	defer fwd.close()
 
 	for {
 		select {
@@ -315,7 +776,11 @@ func (a *Agent) recvLoop(ctx context.Context, conn *ws.Conn, ready chan<- struct
 			recvErr <- err
 			return
 		}
-		if op != 0x1 { // only text
+		if op == 0x2 { // binary: tunnel stream frames
+			fwd.handleFrame(data)
+			continue
+		}
+		if op != 0x1 {
 			continue
 		}
 
@@ -324,61 +789,174 @@ func (a *Agent) recvLoop(ctx context.Context, conn *ws.Conn, ready chan<- struct
 			continue
 		}
 		typ, _ := m["type"].(string)
+		if typ == agentproto.TypeChunk {
+			if data = reassemble(&chunks, data); data == nil {
+				continue
+			}
+			m = nil
+			if err := json.Unmarshal(data, &m); err != nil {
+				continue
+			}
+			typ, _ = m["type"].(string)
+		}
 
 		switch typ {
-		case "hello_ok", "hello_ack":
-			a.applyConfigFromMessage(m)
+		case agentproto.TypeHelloOK, agentproto.TypeHelloAck:
+			a.noteServerTime(m)
+			enc, _ := m["encoding"].(string)
+			a.selectEncoder(enc)
+			a.selectSigning(m)
+			a.selectDelta(m)
+			a.selectCompress(m)
+			a.selectProto(m, conn.Subprotocol())
+			a.selectMaxFrame(m)
+			if _, pushed := m["config"]; !pushed {
+				a.requestConfig(out, "connect")
+			} else if err := a.applyConfigFromMessage(m); a.configRejected(err) {
+				a.requestConfig(out, "stale_push")
+			}
+			if a.applyMasterCaps(m) {
+				st := a.capState()
+				st["type"] = "cap_state"
+				st["agent_id"] = a.getCfg().AgentID
+				st["ts"] = time.Now().Unix()
+				_ = out.send(st)
+			}
 			if !seenReady {
 				seenReady = true
 				close(ready)
 			}
-		case "auth_err":
+		case agentproto.TypeAuthErr:
 			recvErr <- netprobe.ErrAuth
 			return
-		case "config_push":
-			a.applyConfigFromMessage(m)
+		case agentproto.TypeConfigPush:
+			err := a.applyConfigFromMessage(m)
 			ack := map[string]any{
 				"type":           "config_ack",
 				"agent_id":       a.getCfg().AgentID,
 				"config_version": a.getConfigVersion(),
-				"ok":             true,
+				"ok":             err == nil,
 				"ts":             time.Now().Unix(),
 			}
-			_ = writeJSON(conn, ack)
-		case "kick":
+			if err != nil {
+				ack["err"] = err.Error()
+			}
+			_ = out.send(ack)
+			if err == nil {
+				a.hookConfigPush(m)
+			} else if a.configRejected(err) {
+				a.requestConfig(out, "stale_push")
+			}
+		case agentproto.TypePause, agentproto.TypeResume:
+			if typ == agentproto.TypePause {
+				a.handlePause(m)
+			} else {
+				a.handleResume()
+			}
+			st := a.pauseInfo()
+			st["type"] = "pause_state"
+			st["agent_id"] = a.getCfg().AgentID
+			st["ts"] = time.Now().Unix()
+			_ = out.send(st)
+		case agentproto.TypeSetLogLevel:
+			st := a.handleSetLogLevel(m)
+			st["type"] = "log_level"
+			st["agent_id"] = a.getCfg().AgentID
+			st["ts"] = time.Now().Unix()
+			_ = out.send(st)
+		case agentproto.TypeTCPPingAck:
+			upTo, _ := m["up_to"].(float64)
+			a.batches.ack(seqList(m["seqs"]), uint64(upTo))
+		case agentproto.TypeMetricsKeyframe:
+			out.requestKeyframe()
+		case agentproto.TypeTCPPingResend:
+			a.handleTCPPingResend(out, m)
+		case agentproto.TypeTokenRotate:
+			st := a.handleTokenRotate(m)
+			st["type"] = agentproto.TypeTokenRotateAck
+			st["agent_id"] = a.getCfg().AgentID
+			st["ts"] = time.Now().Unix()
+			_ = out.send(st)
+		case agentproto.TypeTLSPinUpdate:
+			st := a.handleTLSPinUpdate(m)
+			st["type"] = agentproto.TypeTLSPinUpdateAck
+			st["agent_id"] = a.getCfg().AgentID
+			st["ts"] = time.Now().Unix()
+			_ = out.send(st)
+		case agentproto.TypePresetsUpdate:
+			st := a.handlePresetsUpdate(m)
+			st["type"] = agentproto.TypePresetsState
+			st["agent_id"] = a.getCfg().AgentID
+			st["ts"] = time.Now().Unix()
+			_ = out.send(st)
+		case agentproto.TypeKick:
 			recvErr <- errors.New("kicked by server")
 			return
+		case agentproto.TypeTunnelOpen:
+			fwd.handleTunnelOpen(m)
+		case agentproto.TypeTunnelClose:
+			fwd.handleTunnelClose(m)
+		case agentproto.TypeStreamOpen:
+			fwd.handleStreamOpen(m)
+		case agentproto.TypePcapRequest:
+			a.handlePcapRequest(ctx, out, m)
+		case agentproto.TypeIperfRequest:
+			a.handleIperfRequest(ctx, out, m)
+		case agentproto.TypeNetinfoRequest:
+			a.handleNetinfoRequest(ctx, out, m)
 		default:
 			// ignore
 		}
 	}
 }
 
-func (a *Agent) applyConfigFromMessage(m map[string]any) {
+// applyConfigFromMessage applies the `config` of a hello_ok or
+// config_push. A config_version below the applied one is refused with
+// errStaleConfig unless the message is marked "full", which also resets
+// everything the message leaves out to config.json.
+func (a *Agent) applyConfigFromMessage(m map[string]any) error {
 	cfgAny, ok := m["config"]
 	if !ok {
-		return
+		return nil
 	}
 	b, err := json.Marshal(cfgAny)
 	if err != nil {
-		return
-	}
-	var c struct {
-		MetricsIntervalMS int `json:"metrics_interval_ms"`
-		TCPPing struct {
-			Enabled     bool             `json:"enabled"`
-			IntervalSec int              `json:"interval_sec"`
-			Targets     []tcpping.Target `json:"targets"`
-		} `json:"tcpping"`
+		return err
 	}
+	var c agentproto.Config
 	if err := json.Unmarshal(b, &c); err != nil {
-		return
+		return err
 	}
-
 	var ver int64
 	if v, ok := m["config_version"].(float64); ok {
 		ver = int64(v)
 	}
+	full, _ := m["full"].(bool)
+
+	a.rtMu.Lock()
+	if cur := a.rt.ConfigVersion; !full && ver > 0 && ver < cur {
+		a.rtMu.Unlock()
+		return &staleConfigError{got: ver, have: cur}
+	}
+	if full {
+		a.rt = runtimeConfig{}
+	}
+	a.rtMu.Unlock()
+
+	rulesPushed := full
+	defer func() {
+		// runs after rtMu is released below
+		if rulesPushed {
+			a.syncAlertRules()
+		}
+		a.saveRuntimeConfig()
+	}()
+
+	if c.LogLevel != "" {
+		if err := logx.SetLevel(c.LogLevel); err != nil {
+			slog.Warn("ignoring pushed log_level", "err", err)
+		}
+	}
 
 	a.rtMu.Lock()
 	defer a.rtMu.Unlock()
@@ -390,15 +968,78 @@ func (a *Agent) applyConfigFromMessage(m map[string]any) {
 	if c.TCPPing.IntervalSec > 0 {
 		a.rt.TCPPingIntervalSec = c.TCPPing.IntervalSec
 	}
-	if c.TCPPing.Targets != nil {
-		a.rt.TCPPingTargets = c.TCPPing.Targets
+	if c.TCPPing.Targets != nil || c.TCPPing.Preset != "" || c.TCPPing.Presets != nil {
+		a.rt.TCPPingTargets = targetsFromWire(c.TCPPing.Targets)
+		a.rt.TCPPingPresets = c.TCPPing.PresetNames()
+		a.warnUnknownPresets(a.rt.TCPPingPresets)
+	}
+	if c.TCPPing.Concurrency > 0 {
+		a.rt.TCPPingWorkers = c.TCPPing.Concurrency
+	}
+	if c.TCPPing.AggregateSec != 0 {
+		a.rt.TCPPingAggregate = min(c.TCPPing.AggregateSec, 3600)
+	}
+	if c.BatchMS != 0 {
+		a.rt.BatchMS = c.BatchMS
+	}
+	if c.RollupSec != 0 {
+		a.rt.RollupSec = min(c.RollupSec, 86400)
+	}
+	if c.NetProbeRefreshSec != 0 {
+		a.rt.NetProbeRefreshSec = c.NetProbeRefreshSec
+	}
+	if c.IPEcho != nil {
+		a.rt.IPEcho = ipEchoFromWire(*c.IPEcho)
+	}
+	if c.Traffic != nil {
+		t := trafficFromWire(*c.Traffic)
+		if err := checkPushedActions(t.Actions, a.getCfg().Traffic.Scripts); err != nil {
+			slog.Warn("ignoring pushed traffic cap", "err", err)
+		} else {
+			a.rt.Traffic = t
+		}
+	}
+	if c.AlertRules != nil {
+		a.rt.AlertRules = rulesFromWire(c.AlertRules)
+		rulesPushed = true
+	}
+	if c.Tags != nil {
+		if err := config.CheckTags(c.Tags); err != nil {
+			slog.Warn("ignoring pushed tags", "err", err)
+		} else {
+			a.rt.Tags = c.Tags
+		}
+	}
+	if c.Watch != nil {
+		ws := watchesFromWire(c.Watch)
+		if err := procwatch.CheckList(ws); err != nil {
+			slog.Warn("ignoring pushed watch list", "err", err)
+		} else {
+			for _, w := range c.Watch {
+				if w.Restart != nil {
+					slog.Warn("ignoring pushed restart command, using the configured one", "watch", w.Name)
+				}
+			}
+			a.rt.Watch = ws
+		}
+	}
+	if c.Tasks != nil {
+		ts := tasksFromWire(c.Tasks)
+		if err := tasks.CheckList(ts); err != nil {
+			slog.Warn("ignoring pushed tasks", "err", err)
+		} else {
+			a.rt.Tasks = ts
+		}
 	}
 	if ver > 0 {
 		a.rt.ConfigVersion = ver
 	}
 
-	fmt.Printf("[kokoro-agent] applied config: metrics=%dms tcpping=%v interval=%ds targets=%d ver=%d\n",
-		a.rt.MetricsIntervalMS, a.rt.TCPPingEnabled, a.rt.TCPPingIntervalSec, len(a.rt.TCPPingTargets), a.rt.ConfigVersion)
+	slog.Info("applied config",
+		"metrics_ms", a.rt.MetricsIntervalMS, "tcpping", a.rt.TCPPingEnabled,
+		"interval_sec", a.rt.TCPPingIntervalSec, "targets", len(a.rt.TCPPingTargets),
+		"ver", a.rt.ConfigVersion, "full", full, "log_level", logx.Level())
+	return nil
 }
 
 func (a *Agent) getMetricsInterval() time.Duration {
@@ -411,6 +1052,35 @@ func (a *Agent) getMetricsInterval() time.Duration {
 	return time.Duration(ms) * time.Millisecond
 }
 
+// getBatchInterval is how long metrics/tcpping_batch messages may be held
+// for a `batch` (0 = batching off).
+func (a *Agent) getBatchInterval() time.Duration {
+	a.rtMu.RLock()
+	defer a.rtMu.RUnlock()
+	ms := a.rt.BatchMS
+	if ms == 0 {
+		ms = a.cfg.BatchMS
+	}
+	if ms <= 0 {
+		return 0
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// getTCPPingAggregate is the tcpping_summary window, 0 when off.
+func (a *Agent) getTCPPingAggregate() time.Duration {
+	a.rtMu.RLock()
+	defer a.rtMu.RUnlock()
+	sec := a.rt.TCPPingAggregate
+	if sec == 0 {
+		sec = a.cfg.TCPPing.AggregateSec
+	}
+	if sec <= 0 {
+		return 0
+	}
+	return time.Duration(sec) * time.Second
+}
+
 func (a *Agent) getTCPPing() (bool, int, []tcpping.Target) {
 	a.rtMu.RLock()
 	defer a.rtMu.RUnlock()
@@ -423,6 +1093,35 @@ func (a *Agent) getTCPPing() (bool, int, []tcpping.Target) {
 	return enabled, interval, a.rt.TCPPingTargets
 }
 
+// tcppingTargets is getTCPPing's target list plus the selected presets.
+func (a *Agent) tcppingTargets() (bool, int, []tcpping.Target) {
+	enabled, interval, targets := a.getTCPPing()
+	if ps := a.presetTargets(); len(ps) > 0 {
+		targets = append(append([]tcpping.Target(nil), targets...), ps...)
+	}
+	return enabled, interval, targets
+}
+
+func (a *Agent) getTCPPingWorkers() int {
+	a.rtMu.RLock()
+	defer a.rtMu.RUnlock()
+	if a.rt.TCPPingWorkers > 0 {
+		return a.rt.TCPPingWorkers
+	}
+	return a.cfg.TCPPing.Concurrency
+}
+
+// tags are the pushed grouping tags, or config.json's until a push.
+func (a *Agent) tags() []string {
+	a.rtMu.RLock()
+	tags := a.rt.Tags
+	a.rtMu.RUnlock()
+	if tags != nil {
+		return tags
+	}
+	return a.getCfg().Tags
+}
+
 func (a *Agent) getConfigVersion() int64 {
 	a.rtMu.RLock()
 	defer a.rtMu.RUnlock()
@@ -435,12 +1134,30 @@ func (a *Agent) getCfg() config.Config {
 	return a.cfg
 }
 
-func mustHostname() string {
-	h, err := os.Hostname()
-	if err != nil || h == "" {
-		return "unknown"
+func (a *Agent) saveStats() {
+	if err := a.stats.Save(); err != nil {
+		slog.Error("save capstats failed", "err", err)
+	}
+	if err := a.traffic.Save(); err != nil {
+		slog.Error("save traffic failed", "err", err)
+	}
+}
+
+// roundErr reports a tcpping round as failed only when no target answered.
+func roundErr(samples []tcpping.Sample) error {
+	var first string
+	for _, s := range samples {
+		if s.OK {
+			return nil
+		}
+		if first == "" {
+			first = s.Host + ": " + s.Err
+		}
+	}
+	if first == "" {
+		return nil
 	}
-	return h
+	return errors.New(first)
 }
 
 func writeJSON(conn *ws.Conn, v any) error {
@@ -0,0 +1,144 @@
+package agent
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/Vincentkeio/agent/internal/alerts"
+	"github.com/Vincentkeio/agent/internal/metrics"
+	"github.com/Vincentkeio/agent/internal/tcpping"
+)
+
+const (
+	// alertEvalInterval is how often metric rules are evaluated; it runs
+	// whether or not the master is reachable.
+	alertEvalInterval = 10 * time.Second
+	// maxQueuedAlerts bounds events kept while disconnected.
+	maxQueuedAlerts = 500
+)
+
+// alertRules is the pushed rule set if any, else the configured one.
+func (a *Agent) alertRules() []alerts.Rule {
+	a.rtMu.RLock()
+	pushed := a.rt.AlertRules
+	a.rtMu.RUnlock()
+	if pushed != nil {
+		return pushed
+	}
+	return a.getCfg().AlertRules
+}
+
+// syncAlertRules hands the current rules to the engine (after start,
+// config_push and reload).
+func (a *Agent) syncAlertRules() {
+	a.raiseAlerts(a.alerts.SetRules(a.alertRules(), time.Now()))
+}
+
+// alertLoop evaluates metric rules on its own snapshots so alerts keep
+// firing and resolving during link flaps; the events wait in the queue
+// until a session sends them.
+func (a *Agent) alertLoop() {
+	t := time.NewTicker(alertEvalInterval)
+	defer t.Stop()
+	iface := a.getCfg().NetIface
+	c := metrics.NewCollector(iface)
+	for {
+		select {
+		case <-t.C:
+		case <-a.stopCh:
+			return
+		}
+		if !a.alerts.HasMetricRules() {
+			continue
+		}
+		if cur := a.getCfg().NetIface; cur != iface {
+			iface = cur
+			c = metrics.NewCollector(iface)
+		}
+		snap, err := c.Collect()
+		if err != nil {
+			continue
+		}
+		snap.Security = a.securityInfo()
+		a.raiseAlerts(a.alerts.ObserveMetrics(snap, time.Now()))
+	}
+}
+
+// observeProbes feeds a tcpping round to the target rules.
+func (a *Agent) observeProbes(samples []tcpping.Sample) {
+	now := time.Now()
+	for _, s := range samples {
+		addr := net.JoinHostPort(s.Host, strconv.Itoa(s.Port))
+		a.raiseAlerts(a.alerts.ObserveTarget(s.ID, addr, s.OK, now))
+	}
+}
+
+// raiseAlerts queues events for the master.
+func (a *Agent) raiseAlerts(evs []alerts.Event) {
+	if len(evs) == 0 {
+		return
+	}
+	for _, ev := range evs {
+		a.hookAlert(ev)
+	}
+	a.alertMu.Lock()
+	a.alertQueue = append(a.alertQueue, evs...)
+	if n := len(a.alertQueue); n > maxQueuedAlerts {
+		a.alertQueue = a.alertQueue[n-maxQueuedAlerts:]
+	}
+	a.alertMu.Unlock()
+	select {
+	case a.alertKick <- struct{}{}:
+	default:
+	}
+}
+
+// alertSendLoop delivers queued alert events as soon as they are raised
+// (and right after connecting).
+func (a *Agent) alertSendLoop(ctx context.Context, out *outbox, agentID string) {
+	for {
+		a.alertMu.Lock()
+		evs := a.alertQueue
+		a.alertQueue = nil
+		a.alertMu.Unlock()
+		for i, ev := range evs {
+			msg := map[string]any{
+				"type":     ev.Type,
+				"agent_id": agentID,
+				"ts":       a.reportTS(ev.TS), // when it happened, not when sent
+				"rule_id":  ev.RuleID,
+				"value":    ev.Value,
+				"since":    a.reportTS(ev.Since),
+			}
+			for k, v := range map[string]string{"severity": ev.Severity, "metric": ev.Metric, "target": ev.Target, "reason": ev.Reason} {
+				if v != "" {
+					msg[k] = v
+				}
+			}
+			if ev.Metric != "" {
+				msg["threshold"] = ev.Limit
+			}
+			if out.send(msg) != nil {
+				a.alertMu.Lock()
+				a.alertQueue = append(evs[i:], a.alertQueue...)
+				a.alertMu.Unlock()
+				return
+			}
+		}
+		select {
+		case <-a.alertKick:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// alertInfo is reported as `alerts` in agent_stats.
+func (a *Agent) alertInfo() map[string]any {
+	return map[string]any{
+		"rules":  len(a.alerts.Rules()),
+		"firing": a.alerts.Firing(),
+	}
+}
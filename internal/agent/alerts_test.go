@@ -0,0 +1,107 @@
+package agent
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Vincentkeio/agent/internal/alerts"
+	"github.com/Vincentkeio/agent/internal/clock"
+	"github.com/Vincentkeio/agent/internal/config"
+	"github.com/Vincentkeio/agent/internal/tcpping"
+)
+
+func testAlertAgent(cfg config.Config) *Agent {
+	return &Agent{cfg: cfg, clock: clock.NewGuard(""), alerts: alerts.New(), alertKick: make(chan struct{}, 1)}
+}
+
+func TestAlertRulesPushedOverConfig(t *testing.T) {
+	a := testAlertAgent(config.Config{AlertRules: []alerts.Rule{{ID: "local", Metric: "cpu"}}})
+	a.syncAlertRules()
+	if r := a.alerts.Rules(); len(r) != 1 || r[0].ID != "local" {
+		t.Fatalf("rules %+v", r)
+	}
+	a.rt.AlertRules = []alerts.Rule{{ID: "pushed", Target: "x", DownRounds: 1}}
+	a.syncAlertRules()
+	if r := a.alerts.Rules(); len(r) != 1 || r[0].ID != "pushed" {
+		t.Fatalf("rules %+v", r)
+	}
+	// an empty pushed set clears the local rules too
+	a.rt.AlertRules = []alerts.Rule{}
+	a.syncAlertRules()
+	if r := a.alerts.Rules(); len(r) != 0 {
+		t.Errorf("rules %+v", r)
+	}
+}
+
+func TestObserveProbesQueuesEvents(t *testing.T) {
+	a := testAlertAgent(config.Config{})
+	a.rt.AlertRules = []alerts.Rule{{ID: "by-addr", Target: "192.0.2.1:443", DownRounds: 1}}
+	a.syncAlertRules()
+	a.observeProbes([]tcpping.Sample{{ID: "t1", Host: "192.0.2.1", Port: 443, OK: false}})
+	select {
+	case <-a.alertKick:
+	default:
+		t.Error("sender not woken")
+	}
+	if len(a.alertQueue) != 1 || a.alertQueue[0].Type != "alert_fire" {
+		t.Fatalf("queue %+v", a.alertQueue)
+	}
+
+	// the queue keeps the newest maxQueuedAlerts while disconnected
+	evs := make([]alerts.Event, maxQueuedAlerts+10)
+	for i := range evs {
+		evs[i] = alerts.Event{Type: "alert_fire", RuleID: "r", TS: int64(i)}
+	}
+	a.raiseAlerts(evs)
+	if n := len(a.alertQueue); n != maxQueuedAlerts {
+		t.Fatalf("queue holds %d", n)
+	}
+	if last := a.alertQueue[maxQueuedAlerts-1].TS; last != int64(len(evs)-1) {
+		t.Errorf("newest event %d dropped", last)
+	}
+}
+
+func TestAlertSendLoop(t *testing.T) {
+	a := testAlertAgent(config.Config{})
+	a.raiseAlerts([]alerts.Event{
+		{Type: "alert_fire", RuleID: "cpu", Metric: "cpu", Value: 97, Limit: 90, Severity: "crit", Since: 100, TS: 160},
+		{Type: "alert_resolve", RuleID: "gone", Target: "t1", Value: 3, Since: 50, TS: 170, Reason: "rule_removed"},
+	})
+
+	// a closed outbox leaves the events queued for the next session
+	closed := a.sessionOutbox()
+	a.alertSendLoop(context.Background(), closed, "a1")
+	if len(a.alertQueue) != 2 {
+		t.Fatalf("queue after a closed session: %d", len(a.alertQueue))
+	}
+
+	o := a.newOutbox(nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		a.alertSendLoop(ctx, o, "a1")
+		close(done)
+	}()
+	fire := expect(t, o, "alert_fire", func(v any) bool { return msgType(v) == "alert_fire" }).(map[string]any)
+	want := map[string]any{"agent_id": "a1", "rule_id": "cpu", "metric": "cpu", "value": 97.0, "threshold": 90.0,
+		"severity": "crit", "since": int64(100), "ts": int64(160)}
+	for k, v := range want {
+		if fire[k] != v {
+			t.Errorf("alert_fire %s = %#v, want %#v", k, fire[k], v)
+		}
+	}
+	res := expect(t, o, "alert_resolve", func(v any) bool { return msgType(v) == "alert_resolve" }).(map[string]any)
+	if res["reason"] != "rule_removed" || res["target"] != "t1" || res["threshold"] != nil || res["metric"] != nil {
+		t.Errorf("alert_resolve %v", res)
+	}
+
+	// events raised while connected go out right away
+	a.raiseAlerts([]alerts.Event{{Type: "alert_fire", RuleID: "late", TS: time.Now().Unix()}})
+	late := expect(t, o, "alert_fire", func(v any) bool { return msgType(v) == "alert_fire" }).(map[string]any)
+	if late["rule_id"] != "late" {
+		t.Errorf("got %v", late)
+	}
+	cancel()
+	<-done
+}
@@ -0,0 +1,52 @@
+package agent
+
+import (
+	"math/rand"
+	"time"
+)
+
+// backoff is the reconnect delay: it doubles from reconnect_min_ms up to
+// reconnect_max_ms, and every wait is randomized to the lower
+// reconnect_jitter share of the current step, so a fleet that lost its
+// master at the same moment doesn't come back in lockstep.
+type backoff struct {
+	cur time.Duration
+}
+
+func (b *backoff) reset() { b.cur = 0 }
+
+// next returns how long to wait before the next attempt and advances.
+func (b *backoff) next(min, max time.Duration, jitter float64) time.Duration {
+	if max < min {
+		max = min
+	}
+	if b.cur < min {
+		b.cur = min
+	}
+	d := b.cur
+	if b.cur < max {
+		b.cur *= 2
+		if b.cur > max {
+			b.cur = max
+		}
+	}
+	return jittered(d, jitter)
+}
+
+// jittered picks a delay uniformly in [d*(1-j), d].
+func jittered(d time.Duration, j float64) time.Duration {
+	if j <= 0 || d <= 0 {
+		return d
+	}
+	if j > 1 {
+		j = 1
+	}
+	return d - time.Duration(rand.Float64()*j*float64(d))
+}
+
+func (a *Agent) backoffParams() (min, max time.Duration, jitter float64) {
+	cfg := a.getCfg()
+	return time.Duration(cfg.ReconnectMinMS) * time.Millisecond,
+		time.Duration(cfg.ReconnectMaxMS) * time.Millisecond,
+		cfg.ReconnectJitter
+}
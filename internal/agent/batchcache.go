@@ -0,0 +1,116 @@
+package agent
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Vincentkeio/agent/internal/tcpping"
+)
+
+// Recent tcpping batches are kept this long (and at most this many) so the
+// master can ask for the ones it failed to persist.
+const (
+	batchCacheTTL = 15 * time.Minute
+	batchCacheMax = 512
+)
+
+type cachedBatch struct {
+	seq uint64
+	at  time.Time
+	msg map[string]any
+}
+
+// batchCache is a seq-ordered short-term store of sent tcpping_batch (and
+// tcpping_summary) messages.
+type batchCache struct {
+	mu sync.Mutex
+	b  []cachedBatch
+}
+
+func (c *batchCache) put(seq uint64, msg map[string]any) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.b = append(c.b, cachedBatch{seq: seq, at: time.Now(), msg: msg})
+	c.expireLocked()
+}
+
+func (c *batchCache) expireLocked() {
+	cut := time.Now().Add(-batchCacheTTL)
+	i := 0
+	for i < len(c.b) && (c.b[i].at.Before(cut) || len(c.b)-i > batchCacheMax) {
+		i++
+	}
+	if i > 0 {
+		c.b = append(c.b[:0], c.b[i:]...)
+	}
+}
+
+// ack drops the listed seqs and everything at or below upTo (0 = none).
+func (c *batchCache) ack(seqs []uint64, upTo uint64) {
+	drop := make(map[uint64]bool, len(seqs))
+	for _, s := range seqs {
+		drop[s] = true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := c.b[:0]
+	for _, e := range c.b {
+		if e.seq <= upTo || drop[e.seq] {
+			continue
+		}
+		out = append(out, e)
+	}
+	c.b = out
+}
+
+// get returns cached batches for seqs (in the order asked) and the seqs
+// that are no longer available.
+func (c *batchCache) get(seqs []uint64) (found []map[string]any, missing []uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.expireLocked()
+	for _, s := range seqs {
+		var hit map[string]any
+		for _, e := range c.b {
+			if e.seq == s {
+				hit = e.msg
+				break
+			}
+		}
+		if hit == nil {
+			missing = append(missing, s)
+			continue
+		}
+		found = append(found, hit)
+	}
+	return found, missing
+}
+
+func seqList(v any) []uint64 {
+	arr, _ := v.([]any)
+	out := make([]uint64, 0, len(arr))
+	for _, x := range arr {
+		if f, ok := x.(float64); ok && f > 0 {
+			out = append(out, uint64(f))
+		}
+	}
+	return out
+}
+
+// pending counts the cached (not yet acked) batches and their samples.
+func (c *batchCache) pending() (batches, samples int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.expireLocked()
+	for _, e := range c.b {
+		if s, ok := e.msg["samples"].([]tcpping.Sample); ok {
+			samples += len(s)
+		}
+		if s, ok := e.msg["summaries"].([]tcpping.Summary); ok {
+			for _, t := range s {
+				samples += t.Rounds
+			}
+		}
+	}
+	return len(c.b), samples
+}
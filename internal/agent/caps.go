@@ -0,0 +1,126 @@
+package agent
+
+import (
+	"log/slog"
+	"os"
+	"sort"
+)
+
+// builtinCaps are the capabilities this build implements; hello announces
+// the ones not disabled in config.
+var builtinCaps = []string{"metrics", "netprobe", "tcpping", "tunnels", "ports", "procwatch", "scheduled_tasks", "port_forward", "socks5_egress", "pcap", "iperf", "netinfo", "path_watch", "plugins", "kubernetes", "replay_zstd"}
+
+// rootRefused are the capabilities that run commands or reach into the
+// host and its networks on the master's behalf; they stay off while the
+// agent runs as root, unless allow_root is set.
+var rootRefused = map[string]bool{
+	"scheduled_tasks": true,
+	"plugins":         true,
+	"port_forward":    true,
+	"socks5_egress":   true,
+	"pcap":            true,
+}
+
+// localCapDisabled reports whether config.json hard-disables c. Local
+// disables always win over the master. port_forward, socks5_egress, pcap,
+// iperf, path_watch, plugins and kubernetes are opt-in: off without a
+// port_forward list, their enabled flag or configured plugins. As root,
+// the rootRefused ones are off too.
+func (a *Agent) localCapDisabled(c string) bool {
+	return a.localCapOff(c) || a.refusedAsRoot(c)
+}
+
+// refusedAsRoot reports whether c is off because the agent runs as root.
+func (a *Agent) refusedAsRoot(c string) bool {
+	return rootRefused[c] && !a.getCfg().AllowRoot && os.Geteuid() == 0
+}
+
+func (a *Agent) localCapOff(c string) bool {
+	cfg := a.getCfg()
+	if c == "port_forward" && len(cfg.PortForward) == 0 ||
+		c == "socks5_egress" && !cfg.SOCKS5Egress.Enabled ||
+		c == "pcap" && !cfg.Pcap.Enabled ||
+		c == "iperf" && !cfg.Iperf.Enabled ||
+		c == "path_watch" && !cfg.PathWatch.Enabled ||
+		c == "plugins" && len(cfg.Plugins) == 0 ||
+		c == "kubernetes" && !cfg.Kubernetes.Enabled {
+		return true
+	}
+	on, ok := cfg.Capabilities[c]
+	return ok && !on
+}
+
+// announcedCaps is the `cap` list for hello.
+func (a *Agent) announcedCaps() []string {
+	var out []string
+	for _, c := range builtinCaps {
+		if !a.localCapDisabled(c) {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// applyMasterCaps takes the `caps` object of hello_ok ({"tcpping": false}).
+// Capabilities the master doesn't mention stay enabled. It returns false
+// when the message carried no caps.
+func (a *Agent) applyMasterCaps(m map[string]any) bool {
+	raw, ok := m["caps"].(map[string]any)
+	if !ok {
+		return false
+	}
+	caps := make(map[string]bool, len(raw))
+	for k, v := range raw {
+		if b, ok := v.(bool); ok {
+			caps[k] = b
+		}
+	}
+	a.capMu.Lock()
+	a.masterCaps = caps
+	a.capMu.Unlock()
+	slog.Info("capabilities negotiated", "enabled", a.capState()["enabled"])
+	return true
+}
+
+// capAllowed reports whether capability c may run right now.
+func (a *Agent) capAllowed(c string) bool {
+	if a.localCapDisabled(c) {
+		return false
+	}
+	a.capMu.Lock()
+	defer a.capMu.Unlock()
+	on, ok := a.masterCaps[c]
+	return !ok || on
+}
+
+// capState is the effective capability set, as sent in cap_state.
+func (a *Agent) capState() map[string]any {
+	var enabled, disabled []string
+	for _, c := range builtinCaps {
+		if a.capAllowed(c) {
+			enabled = append(enabled, c)
+		} else {
+			disabled = append(disabled, c)
+		}
+	}
+	// caps the master asked for that this build doesn't have
+	var unsupported []string
+	a.capMu.Lock()
+	for c, on := range a.masterCaps {
+		if on && !hasCap(c) {
+			unsupported = append(unsupported, c)
+		}
+	}
+	a.capMu.Unlock()
+	sort.Strings(unsupported)
+	return map[string]any{"enabled": enabled, "disabled": disabled, "unsupported": unsupported}
+}
+
+func hasCap(c string) bool {
+	for _, b := range builtinCaps {
+		if b == c {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,63 @@
+package agent
+
+import (
+	"os"
+	"slices"
+	"testing"
+
+	"github.com/Vincentkeio/agent/internal/config"
+)
+
+func TestRefusedAsRoot(t *testing.T) {
+	var cfg config.Config
+	cfg.PortForward = []string{"127.0.0.1:22"}
+	cfg.SOCKS5Egress.Enabled = true
+	cfg.Pcap.Enabled = true
+	cfg.Iperf.Enabled = true
+
+	root := os.Geteuid() == 0
+	a := &Agent{cfg: cfg}
+	for _, c := range []string{"port_forward", "socks5_egress", "pcap", "scheduled_tasks"} {
+		if got := a.refusedAsRoot(c); got != root {
+			t.Errorf("%s refused %v as uid %d", c, got, os.Geteuid())
+		}
+		if got := slices.Contains(a.announcedCaps(), c); got == root {
+			t.Errorf("%s announced %v as uid %d", c, got, os.Geteuid())
+		}
+	}
+	for _, c := range []string{"metrics", "tcpping", "iperf"} {
+		if a.refusedAsRoot(c) || !a.capAllowed(c) {
+			t.Errorf("%s refused", c)
+		}
+	}
+
+	cfg.AllowRoot = true
+	a = &Agent{cfg: cfg}
+	for _, c := range []string{"port_forward", "socks5_egress", "pcap", "scheduled_tasks"} {
+		if a.refusedAsRoot(c) || !a.capAllowed(c) {
+			t.Errorf("%s refused with allow_root", c)
+		}
+	}
+}
+
+func TestLocalCapOff(t *testing.T) {
+	a := &Agent{cfg: config.Config{AllowRoot: true, Capabilities: map[string]bool{"tcpping": false, "ports": true}}}
+	tests := []struct {
+		c   string
+		off bool
+	}{
+		{"tcpping", true},
+		{"ports", false},
+		{"metrics", false},
+		// opt-in, not configured
+		{"port_forward", true},
+		{"socks5_egress", true},
+		{"pcap", true},
+		{"plugins", true},
+	}
+	for _, tt := range tests {
+		if got := a.localCapDisabled(tt.c); got != tt.off {
+			t.Errorf("%s off = %v, want %v", tt.c, got, tt.off)
+		}
+	}
+}
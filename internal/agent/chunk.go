@@ -0,0 +1,79 @@
+package agent
+
+import (
+	"encoding/json"
+	"log/slog"
+
+	"github.com/Vincentkeio/agent/internal/ws"
+	"github.com/Vincentkeio/agent/pkg/agentproto"
+)
+
+// Messages larger than the peer's max_frame travel as agentproto.Chunk
+// frames: hello announces ours (max_frame_kb), hello_ok the master's.
+// Without a max_frame in hello_ok nothing is chunked towards the master.
+
+// selectMaxFrame picks up hello_ok's max_frame for outgoing messages.
+func (a *Agent) selectMaxFrame(m map[string]any) {
+	n, _ := m["max_frame"].(float64)
+	if n > 0 && n < agentproto.MinMaxFrame {
+		n = agentproto.MinMaxFrame
+	}
+	a.maxFrame.Store(int64(n))
+}
+
+// maxFrameOffer is hello's max_frame; 0 (not announced) when max_frame_kb
+// is negative.
+func (a *Agent) maxFrameOffer() int {
+	if kb := a.getCfg().MaxFrameKB; kb > 0 {
+		return kb << 10
+	}
+	return 0
+}
+
+// writeFrame writes one encoded message, split into chunk frames when it
+// exceeds the master's max_frame. It returns the bytes written.
+func (a *Agent) writeFrame(conn *ws.Conn, b []byte, bin bool) (int, error) {
+	var chunks []agentproto.Chunk
+	if max := a.maxFrame.Load(); max > 0 {
+		chunks = agentproto.SplitChunks(b, bin, int(max))
+	}
+	if chunks == nil {
+		if bin {
+			return len(b), conn.WriteBinary(b)
+		}
+		return len(b), conn.WriteText(b)
+	}
+	n := 0
+	for _, c := range chunks {
+		cb, err := json.Marshal(c)
+		if err != nil {
+			return n, err
+		}
+		if err := conn.WriteText(cb); err != nil {
+			return n, err
+		}
+		n += len(cb)
+	}
+	a.sendStats.chunked.Add(1)
+	return n, nil
+}
+
+// reassemble feeds a chunk frame from the master to r. It returns the
+// completed message, or nil while parts are missing or the chunk was
+// rejected.
+func reassemble(r *agentproto.Reassembler, data []byte) []byte {
+	var c agentproto.Chunk
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil
+	}
+	msg, bin, err := r.Add(c)
+	if err != nil {
+		slog.Warn("dropping chunked message from master", "msg_id", c.MsgID, "err", err)
+		return nil
+	}
+	if bin {
+		// master -> agent messages are JSON text
+		return nil
+	}
+	return msg
+}
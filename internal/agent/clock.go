@@ -0,0 +1,91 @@
+package agent
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/Vincentkeio/agent/internal/clock"
+)
+
+// Offsets below this are noise from the hello round trip and are not logged.
+const clockSkewWarn = 2 * time.Second
+
+// noteServerTime estimates the local clock offset from the server timestamp
+// in hello_ok ("server_ts_ms", or "server_ts" in seconds), assuming the
+// server stamped it halfway through the hello round trip.
+func (a *Agent) noteServerTime(m map[string]any) {
+	var server time.Time
+	if v, ok := m["server_ts_ms"].(float64); ok && v > 0 {
+		server = time.UnixMilli(int64(v))
+	} else if v, ok := m["server_ts"].(float64); ok && v > 0 {
+		server = time.UnixMilli(int64(v * 1000))
+	} else {
+		return
+	}
+	sent := a.helloSentMS.Load()
+	if sent == 0 {
+		return
+	}
+	now := time.Now().UnixMilli()
+	off := server.UnixMilli() - (sent+now)/2
+	a.clockOffsetMS.Store(off)
+	a.clockKnown.Store(true)
+
+	if d := time.Duration(off) * time.Millisecond; d > clockSkewWarn || d < -clockSkewWarn {
+		slog.Warn("local clock skewed against master", "offset", d.String(), "rtt_ms", now-sent)
+	}
+}
+
+// clockOffset returns server minus local time in ms, and whether it is known.
+func (a *Agent) clockOffset() (int64, bool) {
+	return a.clockOffsetMS.Load(), a.clockKnown.Load()
+}
+
+// reportTS converts a local unix timestamp to the one put on the wire. While
+// the wall clock is frozen or stepping, the guarded clock source replaces
+// it; with correct_clock_skew the offset to the master is applied too.
+func (a *Agent) reportTS(local int64) int64 {
+	if a.clock.Fallback() {
+		local = a.clock.Now().Unix()
+	}
+	if !a.getCfg().CorrectClockSkew {
+		return local
+	}
+	off, ok := a.clockOffset()
+	if !ok {
+		return local
+	}
+	return local + (off+500)/1000
+}
+
+// clockGuardLoop checks the wall clock against the monotonic clock and
+// queues clock_event messages for anomalies.
+func (a *Agent) clockGuardLoop() {
+	t := time.NewTicker(5 * time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-a.stopCh:
+			return
+		}
+		ev := a.clock.Check()
+		if ev == nil {
+			continue
+		}
+		slog.Warn("clock anomaly", "kind", ev.Kind, "delta_ms", ev.DeltaMS, "source", ev.Source)
+		a.clockEvMu.Lock()
+		if len(a.clockEvents) < 100 {
+			a.clockEvents = append(a.clockEvents, *ev)
+		}
+		a.clockEvMu.Unlock()
+	}
+}
+
+func (a *Agent) takeClockEvents() []clock.Event {
+	a.clockEvMu.Lock()
+	defer a.clockEvMu.Unlock()
+	out := a.clockEvents
+	a.clockEvents = nil
+	return out
+}
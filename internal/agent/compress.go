@@ -0,0 +1,101 @@
+package agent
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/Vincentkeio/agent/internal/codec"
+	"github.com/Vincentkeio/agent/internal/zstd"
+	"github.com/Vincentkeio/agent/pkg/agentproto"
+)
+
+const (
+	// replayCompressMin: a replay of fewer messages goes out as it is.
+	replayCompressMin = 2
+	// replayFrameInput caps the encoded items of one compressed frame, so
+	// a large replay becomes several frames the master can decode one at
+	// a time.
+	replayFrameInput = 4 << 20
+)
+
+// zstdFrame is a compressed replay (agentproto.CompressedFrame), queued
+// with the probes and written as a binary frame.
+type zstdFrame struct {
+	b []byte
+}
+
+// selectCompress enables compressed replays when hello_ok picks zstd.
+func (a *Agent) selectCompress(m map[string]any) {
+	s, _ := m["compress"].(string)
+	a.compress.Store(s == agentproto.CompressZstd && !a.localCapDisabled("replay_zstd"))
+}
+
+// compressOffer is hello's `compress` list; empty when replay_zstd is
+// disabled in config.json.
+func (a *Agent) compressOffer() []string {
+	if a.localCapDisabled("replay_zstd") {
+		return nil
+	}
+	return []string{agentproto.CompressZstd}
+}
+
+// sendReplay queues re-sent messages, compressed when the session allows
+// it: a slow uplink then carries a fraction of the bytes instead of one
+// JSON message per batch.
+func (a *Agent) sendReplay(out *outbox, items []map[string]any) {
+	if len(items) < replayCompressMin || !a.compress.Load() || a.signing.Load() || !a.capAllowed("replay_zstd") {
+		for _, it := range items {
+			_ = out.send(it)
+		}
+		return
+	}
+	e := a.encoder()
+	var orig []map[string]any
+	var group []any
+	size := 0
+	for _, it := range items {
+		// the transform script sees replays as it would uncompressed
+		v, keep := a.transformMsg(it)
+		if !keep {
+			a.seqs.dropped(v, "script")
+			continue
+		}
+		b, err := e.Encode(v)
+		if err != nil {
+			continue // would fail uncompressed as well
+		}
+		if size+len(b) > replayFrameInput && len(group) > 0 {
+			a.queueCompressed(out, e, orig, group)
+			orig, group, size = nil, nil, 0
+		}
+		orig, group = append(orig, it), append(group, v)
+		size += len(b)
+	}
+	if len(group) > 0 {
+		a.queueCompressed(out, e, orig, group)
+	}
+}
+
+// queueCompressed wraps the transformed items in a `batch` and queues it
+// as one zstd frame, or sends the originals one by one if that fails.
+func (a *Agent) queueCompressed(out *outbox, e codec.Encoder, orig []map[string]any, items []any) {
+	b, err := e.Encode(map[string]any{
+		"type":     "batch",
+		"agent_id": a.getCfg().AgentID,
+		"ts":       a.reportTS(time.Now().Unix()),
+		"count":    len(items),
+		"items":    items,
+	})
+	if err == nil {
+		b, err = zstd.Compress(b)
+	}
+	if err != nil {
+		slog.Warn("compressing replay failed, sending it uncompressed", "items", len(items), "err", err)
+		for _, it := range orig {
+			_ = out.send(it)
+		}
+		return
+	}
+	a.sendStats.compressed.Add(1)
+	_ = out.send(zstdFrame{b: agentproto.CompressedFrame(b)})
+}
@@ -0,0 +1,51 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// staleConfigError refuses a push older than the applied config_version,
+// e.g. one delayed behind a newer push, or from a master restored from an
+// old backup.
+type staleConfigError struct {
+	got, have int64
+}
+
+func (e *staleConfigError) Error() string {
+	return fmt.Sprintf("stale config_version %d, have %d", e.got, e.have)
+}
+
+// configRejected logs why a pushed config wasn't applied and reports
+// whether it was for being stale (so the master should send full state).
+func (a *Agent) configRejected(err error) bool {
+	if err == nil {
+		return false
+	}
+	var stale *staleConfigError
+	if errors.As(err, &stale) {
+		slog.Warn("refusing pushed config", "err", err)
+		return true
+	}
+	slog.Warn("ignoring malformed pushed config", "err", err)
+	return false
+}
+
+// requestConfig asks the master for its full current config:
+//
+//	{"type":"config_request","config_version":5,"reason":"stale_push"}
+//
+// config_version is what the agent has applied; reason is "connect" (sent
+// after a hello_ok without config) or "stale_push". The master answers with
+// a config_push marked "full": true, applied whatever its version.
+func (a *Agent) requestConfig(out *outbox, reason string) {
+	_ = out.send(map[string]any{
+		"type":           "config_request",
+		"agent_id":       a.getCfg().AgentID,
+		"ts":             a.reportTS(time.Now().Unix()),
+		"config_version": a.getConfigVersion(),
+		"reason":         reason,
+	})
+}
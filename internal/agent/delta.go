@@ -0,0 +1,165 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// deltaScheme is offered in hello `delta`; hello_ok turns it on with
+// "delta": "metrics-v1".
+const deltaScheme = "metrics-v1"
+
+const defaultKeyframeInterval = 60 * time.Second
+
+// With delta on, `metrics` carries only what changed since the previous
+// metrics message of the session:
+//
+//	{"type":"metrics","seq":1045,"delta":true,"base_seq":1044,
+//	 "metrics":{"ts":..,"cpu":3.1,"psi":{"cpu":{"some":{"avg10":0.2}}}},
+//	 "unset":["frag"]}
+//
+// Objects are diffed recursively, anything else (numbers, strings, arrays)
+// is sent whole when it differs; "unset" lists dotted paths that are gone.
+// The master merges the delta into the snapshot of base_seq. The first
+// message of a session, one at least every delta_keyframe_sec (default 60)
+// and one after a metrics_keyframe request are full snapshots marked
+// "keyframe": true. A delta whose base_seq the master doesn't have can't be
+// applied: drop it and ask for a keyframe.
+
+// selectDelta enables delta metrics when hello_ok picks the scheme.
+func (a *Agent) selectDelta(m map[string]any) {
+	s, _ := m["delta"].(string)
+	a.delta.Store(s == deltaScheme && a.keyframeInterval() > 0)
+}
+
+// deltaOffer is hello's `delta` list; empty when delta_keyframe_sec < 0.
+func (a *Agent) deltaOffer() []string {
+	if a.keyframeInterval() <= 0 {
+		return nil
+	}
+	return []string{deltaScheme}
+}
+
+func (a *Agent) keyframeInterval() time.Duration {
+	sec := a.getCfg().DeltaKeyframeSec
+	switch {
+	case sec < 0:
+		return 0
+	case sec == 0:
+		return defaultKeyframeInterval
+	}
+	return time.Duration(sec) * time.Second
+}
+
+// deltaState is the writer's view of the last metrics written this session.
+type deltaState struct {
+	base    map[string]any
+	baseSeq uint64
+	keyAt   time.Time
+}
+
+// requestKeyframe makes the next metrics message a full snapshot
+// (master's metrics_keyframe).
+func (o *outbox) requestKeyframe() {
+	o.keyframeReq.Store(true)
+}
+
+// encodeDelta turns metrics (also inside a batch) into keyframes or
+// deltas. It runs in the writer right before the write, so the base is
+// always the last snapshot that went out; a failed write ends the session
+// and the next one starts with a keyframe.
+func (o *outbox) encodeDelta(v any) any {
+	msg, ok := v.(map[string]any)
+	if !ok || !o.a.delta.Load() {
+		return v
+	}
+	switch msgType(msg) {
+	case "batch":
+		items := msg["items"].([]any)
+		enc := make([]any, len(items))
+		for i, it := range items {
+			enc[i] = o.encodeDelta(it)
+		}
+		return withFields(msg, map[string]any{"items": enc})
+	case "metrics":
+	default:
+		return v
+	}
+	cur, err := tree(msg["metrics"])
+	if err != nil {
+		return v
+	}
+	d := &o.delta
+	seq, _ := msg["seq"].(uint64)
+	base, baseSeq := d.base, d.baseSeq
+	d.base, d.baseSeq = cur, seq
+	if base == nil || o.keyframeReq.Swap(false) || time.Since(d.keyAt) >= o.a.keyframeInterval() {
+		d.keyAt = time.Now()
+		return withFields(msg, map[string]any{"keyframe": true})
+	}
+	var unset []string
+	extra := map[string]any{
+		"metrics":  diffTree(base, cur, "", &unset),
+		"delta":    true,
+		"base_seq": baseSeq,
+	}
+	if len(unset) > 0 {
+		sort.Strings(unset)
+		extra["unset"] = unset
+	}
+	return withFields(msg, extra)
+}
+
+// withFields is a copy of m with extra set.
+func withFields(m, extra map[string]any) map[string]any {
+	out := make(map[string]any, len(m)+len(extra))
+	for k, v := range m {
+		out[k] = v
+	}
+	for k, v := range extra {
+		out[k] = v
+	}
+	return out
+}
+
+// tree converts v to nested maps through its JSON form (numbers kept
+// exact as json.Number).
+func tree(v any) (map[string]any, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var m map[string]any
+	err = dec.Decode(&m)
+	return m, err
+}
+
+func diffTree(old, cur map[string]any, prefix string, unset *[]string) map[string]any {
+	d := map[string]any{}
+	for k, nv := range cur {
+		ov, ok := old[k]
+		if ok && reflect.DeepEqual(ov, nv) {
+			continue
+		}
+		om, oldObj := ov.(map[string]any)
+		nm, newObj := nv.(map[string]any)
+		if ok && oldObj && newObj {
+			if sub := diffTree(om, nm, prefix+k+".", unset); len(sub) > 0 {
+				d[k] = sub
+			}
+			continue
+		}
+		d[k] = nv
+	}
+	for k := range old {
+		if _, ok := cur[k]; !ok {
+			*unset = append(*unset, prefix+k)
+		}
+	}
+	return d
+}
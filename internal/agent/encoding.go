@@ -0,0 +1,58 @@
+package agent
+
+import (
+	"log/slog"
+
+	"github.com/Vincentkeio/agent/internal/codec"
+	"github.com/Vincentkeio/agent/internal/ws"
+)
+
+// encoder returns the encoder for outgoing messages on the current connection.
+func (a *Agent) encoder() codec.Encoder {
+	if e, ok := a.enc.Load().(codec.Encoder); ok {
+		return e
+	}
+	return codec.Default()
+}
+
+// selectEncoder switches to the named encoder; unknown names keep the
+// current one. An empty name means the configured `encoding` (default json).
+func (a *Agent) selectEncoder(name string) {
+	if name == "" {
+		name = a.getCfg().Encoding
+	}
+	e, ok := codec.Get(name)
+	if !ok {
+		if name != "" {
+			slog.Warn("unknown encoding, keeping current", "encoding", name, "current", a.encoder().Name())
+		}
+		e = a.encoder()
+	}
+	a.enc.Store(e)
+}
+
+// write encodes v with the negotiated encoder: text frames for JSON, binary
+// frames otherwise. With signing on, the encoded message is wrapped in a
+// signed JSON frame, and split into chunks beyond the master's max_frame.
+// A rawFrame goes out as it is, a zstdFrame as one binary message. Only the session's outbox writer calls it;
+// it returns the payload size.
+func (a *Agent) write(conn *ws.Conn, v any) (int, error) {
+	if f, ok := v.(rawFrame); ok {
+		return len(f.b), conn.WriteBinary(f.b)
+	}
+	if f, ok := v.(zstdFrame); ok {
+		return a.writeFrame(conn, f.b, true)
+	}
+	e := a.encoder()
+	b, err := e.Encode(v)
+	if err != nil {
+		return 0, err
+	}
+	if a.signing.Load() {
+		if b, err = a.wrapSigned(e.Name(), b); err != nil {
+			return 0, err
+		}
+		return a.writeFrame(conn, b, false)
+	}
+	return a.writeFrame(conn, b, e.Binary())
+}
@@ -0,0 +1,50 @@
+package agent
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/Vincentkeio/agent/internal/version"
+)
+
+// features lists what this agent is actually doing right now, so the master
+// can group footprint/loss numbers by feature set during rollouts.
+func (a *Agent) features() []string {
+	cfg := a.getCfg()
+	fs := []string{"metrics", "platform=" + runtime.GOOS + "/" + runtime.GOARCH}
+
+	a.rtMu.RLock()
+	if a.rt.TCPPingEnabled {
+		fs = append(fs, "tcpping")
+	}
+	a.rtMu.RUnlock()
+
+	if cfg.NUMA {
+		fs = append(fs, "numa")
+	}
+	if cfg.LogFormat != "" && cfg.LogFormat != "text" {
+		fs = append(fs, "log="+cfg.LogFormat)
+	}
+	for c := range a.degraded {
+		fs = append(fs, "degraded="+c)
+	}
+	sort.Strings(fs)
+	return fs
+}
+
+// deployInfo is the low-cardinality fingerprint attached to agent_stats:
+// release, build hash and a short hash of the active feature set.
+func (a *Agent) deployInfo() map[string]any {
+	fs := a.features()
+	sum := sha256.Sum256([]byte(strings.Join(fs, ",")))
+	return map[string]any{
+		"ver":          version.Version,
+		"build":        version.Build(),
+		"go":           runtime.Version(),
+		"feature_hash": hex.EncodeToString(sum[:4]),
+		"features":     fs,
+	}
+}
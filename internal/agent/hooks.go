@@ -0,0 +1,50 @@
+package agent
+
+import (
+	"time"
+
+	"github.com/Vincentkeio/agent/internal/alerts"
+	"github.com/Vincentkeio/agent/internal/hooks"
+)
+
+// fireHook runs a configured local hook with the agent's identity added
+// to the event data.
+func (a *Agent) fireHook(h *hooks.Hook, event string, data map[string]any) {
+	if h == nil {
+		return
+	}
+	cfg := a.getCfg()
+	if data == nil {
+		data = map[string]any{}
+	}
+	data["agent_id"] = cfg.AgentID
+	if cfg.Alias != "" {
+		data["alias"] = cfg.Alias
+	}
+	if tags := a.tags(); len(tags) > 0 {
+		data["tags"] = tags
+	}
+	data["ts"] = time.Now().Unix()
+	hooks.Fire(h, event, data)
+}
+
+// hookDisconnect runs on_disconnect once per lost session (not for every
+// failed reconnect attempt).
+func (a *Agent) hookDisconnect(err error, up time.Duration) {
+	a.fireHook(a.getCfg().Hooks.OnDisconnect, "disconnect", map[string]any{
+		"err":          err.Error(),
+		"connected_ms": up.Milliseconds(),
+		"master":       a.getCfg().MasterWSURL,
+	})
+}
+
+func (a *Agent) hookAlert(ev alerts.Event) {
+	a.fireHook(a.getCfg().Hooks.OnAlert, ev.Type, map[string]any{"alert": ev})
+}
+
+func (a *Agent) hookConfigPush(m map[string]any) {
+	a.fireHook(a.getCfg().Hooks.OnConfigPush, "config_push", map[string]any{
+		"config_version": a.getConfigVersion(),
+		"config":         m["config"],
+	})
+}
@@ -0,0 +1,141 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/Vincentkeio/agent/internal/iperf"
+	"github.com/Vincentkeio/agent/pkg/agentproto"
+)
+
+const (
+	defaultIperfDuration = 10 // seconds
+	defaultIperfWait     = 30 // seconds a server waits for its client
+	maxIperfWait         = 600
+)
+
+// handleIperfRequest starts the server or client side of a throughput
+// test and answers with iperf_result once it is done; a server also sends
+// iperf_ready once it listens. One test runs at a time, and it stops with
+// the session.
+func (a *Agent) handleIperfRequest(ctx context.Context, out *outbox, m map[string]any) {
+	cfg := a.getCfg()
+	id, _ := m["id"].(string)
+	role, _ := m["role"].(string)
+	host, _ := m["host"].(string)
+	port, _ := m["port"].(float64)
+	dur, _ := m["duration"].(float64)
+	parallel, _ := m["parallel"].(float64)
+	reverse, _ := m["reverse"].(bool)
+	wait, _ := m["wait_sec"].(float64)
+	maxDur := time.Duration(cfg.Iperf.MaxDurationSec) * time.Second
+	res := map[string]any{
+		"type":     agentproto.TypeIperfResult,
+		"agent_id": cfg.AgentID,
+		"role":     role,
+		"ok":       false,
+	}
+	if id != "" {
+		res["id"] = id
+	}
+	send := func(err error) {
+		if err != nil {
+			res["err"] = err.Error()
+		}
+		res["ts"] = a.reportTS(time.Now().Unix())
+		_ = out.send(res)
+	}
+
+	var err error
+	switch {
+	case !a.capAllowed("iperf"):
+		err = errors.New("iperf is disabled")
+	case role != "server" && role != "client":
+		err = fmt.Errorf("role %q: want server or client", role)
+	case role == "client" && host == "":
+		err = errors.New("a client needs a host")
+	case !a.iperfBusy.CompareAndSwap(false, true):
+		err = errors.New("a test is already running")
+	}
+	if err != nil {
+		slog.Warn("iperf_request refused", "id", id, "role", role, "err", err)
+		send(err)
+		return
+	}
+
+	var run func() (iperf.Result, error)
+	if role == "server" {
+		ln, err := net.Listen("tcp", net.JoinHostPort("", strconv.Itoa(cfg.Iperf.Port)))
+		if err != nil {
+			a.iperfBusy.Store(false)
+			slog.Warn("iperf server failed", "id", id, "err", err)
+			send(err)
+			return
+		}
+		if wait <= 0 {
+			wait = defaultIperfWait
+		}
+		wait = min(wait, maxIperfWait)
+		slog.Info("iperf server listening", "id", id, "port", cfg.Iperf.Port, "wait_sec", int(wait))
+		ready := map[string]any{
+			"type":     agentproto.TypeIperfReady,
+			"agent_id": cfg.AgentID,
+			"port":     cfg.Iperf.Port,
+			"ts":       a.reportTS(time.Now().Unix()),
+		}
+		if id != "" {
+			ready["id"] = id
+		}
+		_ = out.send(ready)
+		// the wait only bounds the client's arrival
+		_ = ln.(*net.TCPListener).SetDeadline(time.Now().Add(time.Duration(wait) * time.Second))
+		run = func() (iperf.Result, error) { return iperf.Serve(ctx, ln, maxDur) }
+	} else {
+		if port <= 0 {
+			port = iperf.DefaultPort
+		}
+		if dur <= 0 {
+			dur = defaultIperfDuration
+		}
+		o := iperf.Options{Duration: time.Duration(dur) * time.Second, Parallel: int(parallel), Reverse: reverse}
+		if o.Duration > maxDur {
+			a.iperfBusy.Store(false)
+			send(fmt.Errorf("duration %gs: at most %ds", dur, cfg.Iperf.MaxDurationSec))
+			return
+		}
+		addr := net.JoinHostPort(host, strconv.Itoa(int(port)))
+		slog.Info("iperf client starting", "id", id, "addr", addr, "duration", int(dur), "parallel", o.Parallel, "reverse", reverse)
+		run = func() (iperf.Result, error) { return iperf.Client(ctx, addr, o) }
+	}
+
+	go func() {
+		defer a.iperfBusy.Store(false)
+		r, err := run()
+		if r.Peer != "" {
+			res["peer"] = r.Peer
+		}
+		if err == nil {
+			res["ok"] = true
+			res["sender"] = r.Sender
+			res["reverse"] = r.Reverse
+			res["parallel"] = r.Parallel
+			res["duration_ms"] = int64(r.Seconds * 1000)
+			res["bytes"] = r.Bytes
+			res["sent_bytes"] = r.SentBytes
+			res["mbps"] = math.Round(r.Mbps*100) / 100
+			res["retransmits"] = r.Retransmits
+			res["cpu_pct"] = math.Round(r.CPUPct*10) / 10
+			if r.PeerCPUPct >= 0 {
+				res["peer_cpu_pct"] = math.Round(r.PeerCPUPct*10) / 10
+			}
+		}
+		slog.Info("iperf test done", "id", id, "role", role, "peer", r.Peer, "mbps", res["mbps"], "retransmits", r.Retransmits, "err", err)
+		send(err)
+	}()
+}
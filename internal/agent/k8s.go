@@ -0,0 +1,84 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/Vincentkeio/agent/internal/k8s"
+)
+
+// k8sLoop reads the Kubernetes node state every kubernetes.interval_sec
+// for the metrics `k8s` section, rebuilding the client when the settings
+// change on reload. It runs whether or not the master is reachable, so a
+// reconnect reports fresh state right away.
+func (a *Agent) k8sLoop() {
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	var (
+		opts   k8s.Options
+		client *k8s.Client
+		tried  bool // NewClient ran for opts
+		next   time.Time
+	)
+	for {
+		select {
+		case <-t.C:
+		case <-a.stopCh:
+			return
+		}
+		kc := a.getCfg().Kubernetes
+		if !kc.Enabled || !a.capAllowed("kubernetes") {
+			client, tried = nil, false
+			a.setK8sNode(nil)
+			continue
+		}
+		o := k8s.Options{
+			APIServer:       kc.APIServer,
+			KubeletURL:      kc.KubeletURL,
+			TokenFile:       kc.TokenFile,
+			CAFile:          kc.CAFile,
+			KubeletInsecure: kc.KubeletInsecureSkipVerify,
+		}
+		if !tried || o != opts {
+			// a bad setup is reported once and retried when it changes
+			opts, tried, next = o, true, time.Time{}
+			c, err := k8s.NewClient(k8s.IdentityFromEnv(), o)
+			if err != nil {
+				slog.Error("kubernetes node mode unavailable", "err", err)
+				a.setK8sNode(nil)
+			}
+			client = c
+		}
+		if client == nil || time.Now().Before(next) {
+			continue
+		}
+		next = time.Now().Add(time.Duration(kc.IntervalSec) * time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		start := time.Now()
+		n := client.Fetch(ctx)
+		cancel()
+		var err error
+		if len(n.Errs) > 0 {
+			err = errors.New(n.Errs[0])
+		}
+		a.stats.Record("kubernetes", time.Since(start), err)
+		n.TS = a.reportTS(n.TS)
+		a.setK8sNode(&n)
+	}
+}
+
+func (a *Agent) setK8sNode(n *k8s.Node) {
+	a.k8sMu.Lock()
+	a.k8sNode = n
+	a.k8sMu.Unlock()
+}
+
+// k8sInfo is the `k8s` metrics section: the last node report, nil outside
+// kubernetes mode.
+func (a *Agent) k8sInfo() *k8s.Node {
+	a.k8sMu.Lock()
+	defer a.k8sMu.Unlock()
+	return a.k8sNode
+}
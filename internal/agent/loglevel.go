@@ -0,0 +1,90 @@
+package agent
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/Vincentkeio/agent/internal/logx"
+)
+
+// logOverride tracks a level set by the master with set_log_level.
+type logOverride struct {
+	mu     sync.Mutex
+	timer  *time.Timer // pending auto-revert, nil if none
+	until  time.Time
+	active bool
+}
+
+// handleSetLogLevel applies a `set_log_level` message:
+//
+//	{"type":"set_log_level","level":"debug","duration_sec":900}
+//
+// An empty level (or "reset") reverts to log_level from config.json. With
+// duration_sec the override reverts by itself, so a forgotten debug session
+// does not fill the disk.
+func (a *Agent) handleSetLogLevel(m map[string]any) map[string]any {
+	lvl, _ := m["level"].(string)
+	var dur time.Duration
+	if v, ok := m["duration_sec"].(float64); ok && v > 0 {
+		dur = time.Duration(v) * time.Second
+	}
+
+	reply := map[string]any{"ok": true}
+	if lvl == "" || lvl == "reset" {
+		a.revertLogLevel()
+	} else if err := logx.SetLevel(lvl); err != nil {
+		reply["ok"] = false
+		reply["err"] = err.Error()
+	} else {
+		a.logOv.mu.Lock()
+		if a.logOv.timer != nil {
+			a.logOv.timer.Stop()
+			a.logOv.timer = nil
+		}
+		a.logOv.active = true
+		a.logOv.until = time.Time{}
+		if dur > 0 {
+			a.logOv.until = time.Now().Add(dur)
+			a.logOv.timer = time.AfterFunc(dur, a.revertLogLevel)
+		}
+		a.logOv.mu.Unlock()
+		slog.Info("log level set by master", "level", logx.Level(), "duration", dur.String())
+	}
+
+	for k, v := range a.logLevelInfo() {
+		reply[k] = v
+	}
+	return reply
+}
+
+// revertLogLevel drops a master override and goes back to the configured level.
+func (a *Agent) revertLogLevel() {
+	a.logOv.mu.Lock()
+	if a.logOv.timer != nil {
+		a.logOv.timer.Stop()
+		a.logOv.timer = nil
+	}
+	wasActive := a.logOv.active
+	a.logOv.active = false
+	a.logOv.until = time.Time{}
+	a.logOv.mu.Unlock()
+
+	if err := logx.SetLevel(a.getCfg().LogLevel); err != nil {
+		_ = logx.SetLevel("info")
+	}
+	if wasActive {
+		slog.Info("log level override reverted", "level", logx.Level())
+	}
+}
+
+// logLevelInfo is what log_level replies report.
+func (a *Agent) logLevelInfo() map[string]any {
+	a.logOv.mu.Lock()
+	defer a.logOv.mu.Unlock()
+	out := map[string]any{"level": logx.Level(), "override": a.logOv.active}
+	if !a.logOv.until.IsZero() {
+		out["revert_at"] = a.logOv.until.Unix()
+	}
+	return out
+}
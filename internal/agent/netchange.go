@@ -0,0 +1,116 @@
+package agent
+
+import (
+	"context"
+	"log/slog"
+	"net/netip"
+	"time"
+
+	"github.com/Vincentkeio/agent/internal/netwatch"
+	"github.com/Vincentkeio/agent/internal/ws"
+)
+
+// netChangeSettle lets a burst of netlink events (an interface coming up
+// announces its link, addresses and routes separately) play out before
+// the route is read.
+const netChangeSettle = 2 * time.Second
+
+// netChangeLoop reads the host's default routes whenever the kernel
+// announces a change, and every net_watch_sec anyway, and sends
+// net_change when they differ from the last ones seen, with a fresh net
+// probe. If the session's own source address is gone the connection is
+// dead: the agent reconnects right away and sends net_change after the new
+// hello.
+func (a *Agent) netChangeLoop(ctx context.Context, out *outbox, agentID string, conn *ws.Conn) {
+	a.netMu.Lock()
+	pending := a.pendingNetChange
+	a.pendingNetChange = nil
+	a.netMu.Unlock()
+	if pending != nil {
+		_ = out.send(pending)
+	}
+
+	events := netwatch.Watch(ctx)
+	t := time.NewTicker(5 * time.Second)
+	defer t.Stop()
+	var last time.Time
+	for {
+		sec := a.getCfg().NetWatchSec
+		if sec > 0 && time.Since(last) >= time.Duration(sec)*time.Second {
+			last = time.Now()
+			if a.checkRoute(ctx, out, agentID, conn) {
+				return
+			}
+		}
+		select {
+		case <-t.C:
+		case _, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			select {
+			case <-time.After(netChangeSettle):
+			case <-ctx.Done():
+				return
+			}
+			last = time.Time{}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// checkRoute compares the routes with the last ones seen and reports a
+// change. It returns true when it asked for a reconnect.
+func (a *Agent) checkRoute(ctx context.Context, out *outbox, agentID string, conn *ws.Conn) bool {
+	cur := netwatch.Current()
+	a.netMu.Lock()
+	prev := a.route
+	a.route = cur
+	a.netMu.Unlock()
+	if cur == prev {
+		return false
+	}
+	slog.Info("default route changed",
+		"iface4", cur.Iface4, "src4", cur.Src4, "gateway4", cur.Gateway4,
+		"iface6", cur.Iface6, "src6", cur.Src6, "gateway6", cur.Gateway6)
+
+	msg := map[string]any{
+		"type":       "net_change",
+		"agent_id":   agentID,
+		"ts":         a.reportTS(time.Now().Unix()),
+		"route":      cur,
+		"prev_route": prev,
+	}
+	if a.capAllowed("netprobe") {
+		prevNP, np := a.runNetProbe()
+		msg["net_probe"], msg["prev_net_probe"] = np, prevNP
+		if g := a.lastGeo(); g != nil {
+			msg["geo"] = g
+		}
+		if ctx.Err() != nil {
+			// session ended while probing: the next one reports it
+			a.netMu.Lock()
+			a.pendingNetChange = msg
+			a.netMu.Unlock()
+			return true
+		}
+	}
+
+	local, err := netip.ParseAddrPort(conn.LocalAddr().String())
+	if err != nil || netwatch.HasAddr(local.Addr()) {
+		_ = out.send(msg)
+		return false
+	}
+	slog.Warn("connection's source address is gone: reconnecting", "addr", local.Addr().String())
+	msg["reconnect"] = true
+	a.netMu.Lock()
+	a.pendingNetChange = msg
+	a.netMu.Unlock()
+	select {
+	case a.reconnectCh <- struct{}{}:
+	default:
+	}
+	return true
+}
@@ -0,0 +1,79 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/Vincentkeio/agent/internal/netinfo"
+	"github.com/Vincentkeio/agent/pkg/agentproto"
+)
+
+// maxNetinfoRunning bounds the looking-glass queries run at once.
+const maxNetinfoRunning = 4
+
+// handleNetinfoRequest runs a looking-glass query in the background and
+// answers with netinfo_result.
+func (a *Agent) handleNetinfoRequest(ctx context.Context, out *outbox, m map[string]any) {
+	cfg := a.getCfg()
+	req := netinfo.Request{}
+	req.Query, _ = m["query"].(string)
+	req.Target, _ = m["target"].(string)
+	req.Family, _ = m["family"].(string)
+	id, _ := m["id"].(string)
+	res := map[string]any{
+		"type":     agentproto.TypeNetinfoResult,
+		"agent_id": cfg.AgentID,
+		"query":    req.Query,
+		"ok":       false,
+	}
+	if id != "" {
+		res["id"] = id
+	}
+	if req.Target != "" {
+		res["target"] = req.Target
+	}
+	if req.Family != "" {
+		res["family"] = req.Family
+	}
+	send := func(err error) {
+		if err != nil {
+			res["err"] = err.Error()
+		} else {
+			res["ok"] = true
+		}
+		res["ts"] = a.reportTS(time.Now().Unix())
+		_ = out.send(res)
+	}
+
+	err := req.Check()
+	switch {
+	case !a.capAllowed("netinfo"):
+		err = errors.New("netinfo is disabled")
+	case err != nil:
+	case a.netinfoRunning.Add(1) > maxNetinfoRunning:
+		a.netinfoRunning.Add(-1)
+		err = errors.New("too many queries running")
+	}
+	if err != nil {
+		slog.Warn("netinfo_request refused", "id", id, "query", req.Query, "err", err)
+		send(err)
+		return
+	}
+	go func() {
+		defer a.netinfoRunning.Add(-1)
+		r, err := netinfo.Run(ctx, req)
+		if r.Source != "" {
+			res["source"] = r.Source
+		}
+		if err == nil {
+			res["data"] = r.Data
+			if r.Truncated {
+				res["truncated"] = true
+			}
+		}
+		slog.Debug("netinfo query done", "id", id, "query", req.Query, "target", req.Target, "source", r.Source, "err", err)
+		send(err)
+	}()
+}
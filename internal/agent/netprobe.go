@@ -0,0 +1,200 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/Vincentkeio/agent/internal/netprobe"
+	"github.com/Vincentkeio/agent/internal/platform"
+)
+
+const netProbeTimeout = 3 * time.Second
+
+// runNetProbe probes public IPs and stores the result for hello. It returns
+// the previous result. A family whose probe failed keeps its last known
+// address (with IPv4OK/IPv6OK false), so a lost echo request doesn't read
+// as the address changing, then changing back.
+func (a *Agent) runNetProbe() (prev, cur netprobe.Result) {
+	start := time.Now()
+	cfg := a.getCfg()
+	cur = netprobe.Probe(netProbeTimeout, cfg.InsecureSkipVerify, a.getIPEcho())
+	var err error
+	if !cur.IPv4OK && !cur.IPv6OK {
+		err = errors.New("no public ip")
+	}
+	a.stats.Record("netprobe", time.Since(start), err)
+
+	if len(cfg.STUNServers) > 0 {
+		start = time.Now()
+		nat := netprobe.DetectNAT(cfg.STUNServers, netProbeTimeout)
+		err = nil
+		if nat.Err != "" {
+			err = errors.New(nat.Err)
+		}
+		a.stats.Record("nat", time.Since(start), err)
+		cur.NAT = &nat
+	}
+
+	a.netMu.Lock()
+	prev = a.netProbe
+	if !cur.IPv4OK {
+		cur.PublicIPv4, cur.IPv4Source = prev.PublicIPv4, prev.IPv4Source
+	}
+	if !cur.IPv6OK {
+		cur.PublicIPv6, cur.IPv6Source = prev.PublicIPv6, prev.IPv6Source
+	}
+	a.netProbe = cur
+	a.netProbeDone = true
+	a.netMu.Unlock()
+
+	if ipChanged(prev, cur) {
+		a.refreshGeo(cur)
+	}
+	return prev, cur
+}
+
+// refreshGeo looks up location/ASN of the public address when geoip is
+// configured (IPv4 preferred).
+func (a *Agent) refreshGeo(np netprobe.Result) {
+	cfg := a.getCfg()
+	if !cfg.GeoIP.Enabled() {
+		return
+	}
+	ip := np.PublicIPv4
+	if ip == "" {
+		ip = np.PublicIPv6
+	}
+	if ip == "" {
+		return
+	}
+	start := time.Now()
+	g := netprobe.LookupGeo(ip, cfg.GeoIP, netProbeTimeout, cfg.InsecureSkipVerify)
+	var err error
+	if g.Err != "" {
+		err = errors.New(g.Err)
+		slog.Warn("geoip lookup failed", "ip", ip, "source", g.Source, "err", g.Err)
+	}
+	a.stats.Record("geoip", time.Since(start), err)
+
+	a.netMu.Lock()
+	a.geo = &g
+	a.netMu.Unlock()
+}
+
+// detectPlatform works out the hypervisor, container runtime and cloud
+// instance for hello.
+func (a *Agent) detectPlatform() {
+	start := time.Now()
+	cfg := a.getCfg()
+	p := platform.Detect(context.Background(), cfg.CloudMetadata)
+	var err error
+	if p.Cloud != nil && p.Cloud.Err != "" {
+		err = errors.New(p.Cloud.Err)
+		slog.Warn("cloud metadata lookup failed", "provider", p.Cloud.Provider, "err", p.Cloud.Err)
+	}
+	a.stats.Record("platform", time.Since(start), err)
+	a.platform = p
+}
+
+// lastGeo returns the latest geoip result (nil if disabled or not yet known).
+func (a *Agent) lastGeo() *netprobe.Geo {
+	a.netMu.Lock()
+	defer a.netMu.Unlock()
+	return a.geo
+}
+
+// lastNetProbe returns the latest result (false before the first probe).
+func (a *Agent) lastNetProbe() (netprobe.Result, bool) {
+	a.netMu.Lock()
+	defer a.netMu.Unlock()
+	return a.netProbe, a.netProbeDone
+}
+
+// netProbeLoop re-probes every netprobe_refresh_sec (config or config_push)
+// and sends netprobe_update when the public IPv4/IPv6 or NAT type changed.
+func (a *Agent) netProbeLoop(ctx context.Context, out *outbox, agentID string) {
+	t := time.NewTicker(30 * time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		case <-a.stopCh:
+			return
+		}
+
+		iv := a.getNetProbeRefresh()
+		if iv <= 0 || !a.capAllowed("netprobe") {
+			continue
+		}
+		last, _ := a.lastNetProbe()
+		if time.Since(time.Unix(last.ProbeTS, 0)) < iv {
+			continue
+		}
+
+		prev, cur := a.runNetProbe()
+		if ctx.Err() != nil {
+			return // session ended while probing
+		}
+		if !ipChanged(prev, cur) && natType(prev) == natType(cur) {
+			continue
+		}
+		slog.Info("public ip or nat changed", "nat", natType(cur),
+			"ipv4", cur.PublicIPv4, "prev_ipv4", prev.PublicIPv4,
+			"ipv6", cur.PublicIPv6, "prev_ipv6", prev.PublicIPv6)
+		msg := map[string]any{
+			"type":      "netprobe_update",
+			"agent_id":  agentID,
+			"ts":        a.reportTS(time.Now().Unix()),
+			"net_probe": cur,
+			"prev":      prev,
+		}
+		if g := a.lastGeo(); g != nil {
+			msg["geo"] = g
+		}
+		_ = out.send(msg)
+	}
+}
+
+// ipChanged reports whether a family that answered found a new address;
+// runNetProbe has already carried the old one over for those that failed.
+func ipChanged(prev, cur netprobe.Result) bool {
+	return cur.IPv4OK && cur.PublicIPv4 != prev.PublicIPv4 ||
+		cur.IPv6OK && cur.PublicIPv6 != prev.PublicIPv6
+}
+
+func natType(r netprobe.Result) string {
+	if r.NAT == nil {
+		return ""
+	}
+	return r.NAT.Type
+}
+
+// getNetProbeRefresh is the pushed interval, else the configured one;
+// zero disables re-probing.
+func (a *Agent) getNetProbeRefresh() time.Duration {
+	a.rtMu.RLock()
+	sec := a.rt.NetProbeRefreshSec
+	a.rtMu.RUnlock()
+	if sec == 0 {
+		sec = a.getCfg().NetProbeRefreshSec
+	}
+	if sec <= 0 {
+		return 0
+	}
+	return time.Duration(sec) * time.Second
+}
+
+// getIPEcho is the pushed echo endpoint list, else the configured one.
+func (a *Agent) getIPEcho() netprobe.Endpoints {
+	a.rtMu.RLock()
+	pushed := a.rt.IPEcho
+	a.rtMu.RUnlock()
+	if pushed != nil {
+		return *pushed
+	}
+	return a.getCfg().IPEcho
+}
@@ -0,0 +1,401 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Vincentkeio/agent/internal/ws"
+)
+
+const (
+	defaultSendQueue   = 256
+	defaultSendTimeout = 10 * time.Second
+)
+
+var errOutboxClosed = errors.New("connection closed")
+
+// droppable lists the periodic data messages that may be discarded when
+// the send queue is full (the next one supersedes them, tcpping batches
+// stay in the re-send cache). Replies, acks and events are always queued.
+var droppable = map[string]bool{
+	"metrics":         true,
+	"plugin_metrics":  true,
+	"tcpping_batch":   true,
+	"tcpping_summary": true,
+	"agent_stats":     true,
+	"tunnel_status":   true,
+}
+
+// batchable lists the messages held for a `batch` when batch_ms is set.
+var batchable = map[string]bool{
+	"metrics":         true,
+	"tcpping_batch":   true,
+	"tcpping_summary": true,
+}
+
+// batchMaxItems caps a batch; it is sent as soon as it is full.
+const batchMaxItems = 100
+
+type outMsg struct {
+	v         any
+	class     msgClass
+	droppable bool
+}
+
+// outbox serializes all writes of one session through a single writer
+// goroutine. Producers never block: when the queue is full a droppable
+// message is discarded according to send_queue_policy, so a stalled TCP
+// connection can't hold up the collectors. A write that exceeds
+// send_timeout_ms ends the session. Messages are queued per class and
+// written by priority, see msgClass.
+type outbox struct {
+	a    *Agent
+	conn *ws.Conn
+
+	mu       sync.Mutex
+	q        [numClasses][]outMsg
+	buckets  [numClasses]rateBucket
+	writing  bool // a message is being written or held for a batch
+	flushing bool
+	closed   bool
+	wake     chan struct{}
+
+	held        []any      // writer goroutine only
+	delta       deltaState // writer goroutine only
+	keyframeReq atomic.Bool
+}
+
+// sendStats are the queue counters reported in agent_stats (send_queue);
+// they span sessions.
+type sendStats struct {
+	enqueued   atomic.Uint64
+	sent       atomic.Uint64
+	dropped    atomic.Uint64
+	errors     atomic.Uint64
+	slowWrites atomic.Uint64
+	batches    atomic.Uint64
+	chunked    atomic.Uint64 // messages split for the master's max_frame
+	compressed atomic.Uint64 // zstd replay frames
+	maxDepth   atomic.Int64
+	depth      atomic.Int64
+	classes    [numClasses]classStats
+}
+
+type classStats struct {
+	sent      atomic.Uint64
+	bytes     atomic.Uint64
+	throttled atomic.Uint64 // times the writer skipped the class for its rate limit
+}
+
+func (a *Agent) newOutbox(conn *ws.Conn) *outbox {
+	return &outbox{a: a, conn: conn, wake: make(chan struct{}, 1)}
+}
+
+// sessionOutbox returns the current session's outbox or, while
+// disconnected, a closed one: what's sent to it is recorded as lost
+// ("disconnect") and shows up in the next agent_stats gaps.
+func (a *Agent) sessionOutbox() *outbox {
+	if o := a.sessOut.Load(); o != nil {
+		return o
+	}
+	return &outbox{a: a, closed: true}
+}
+
+func (o *outbox) limits() (size int, policy string, timeout time.Duration) {
+	cfg := o.a.getCfg()
+	size, policy, timeout = cfg.SendQueue, cfg.SendQueuePolicy, defaultSendTimeout
+	if size <= 0 {
+		size = defaultSendQueue
+	}
+	if cfg.SendTimeoutMS > 0 {
+		timeout = time.Duration(cfg.SendTimeoutMS) * time.Millisecond
+	}
+	return size, policy, timeout
+}
+
+// send queues v for the writer. It only fails once the session is over.
+func (o *outbox) send(v any) error {
+	v, keep := o.a.transformMsg(v)
+	if !keep {
+		o.a.seqs.dropped(v, "script")
+		return nil
+	}
+	m := outMsg{v: v, class: classFor(v), droppable: droppable[msgType(v)]}
+	size, policy, _ := o.limits()
+	st := &o.a.sendStats
+
+	o.mu.Lock()
+	if o.closed {
+		o.mu.Unlock()
+		o.a.seqs.dropped(v, "disconnect")
+		return errOutboxClosed
+	}
+	if o.lenLocked() >= size && m.droppable {
+		// messages are maps: whether v itself went can't be told by ==
+		victim, ok := v, false
+		if policy != "drop_newest" {
+			victim, ok = o.dropOldestLocked()
+		}
+		st.dropped.Add(1)
+		if !ok {
+			o.mu.Unlock()
+			o.a.seqs.dropped(v, "queue_full")
+			return nil
+		}
+		o.a.seqs.dropped(victim, "queue_full")
+	}
+	o.q[m.class] = append(o.q[m.class], m)
+	o.a.seqs.queued(v)
+	depth := int64(o.lenLocked())
+	o.mu.Unlock()
+
+	st.enqueued.Add(1)
+	st.depth.Store(depth)
+	for {
+		max := st.maxDepth.Load()
+		if depth <= max || st.maxDepth.CompareAndSwap(max, depth) {
+			break
+		}
+	}
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// dropOldestLocked removes the oldest droppable message of the lowest
+// class and returns it; false when none is queued.
+func (o *outbox) dropOldestLocked() (any, bool) {
+	for c := numClasses - 1; c >= classControl; c-- {
+		for i, m := range o.q[c] {
+			if m.droppable {
+				o.q[c] = append(o.q[c][:i], o.q[c][i+1:]...)
+				return m.v, true
+			}
+		}
+	}
+	return nil, false
+}
+
+func (o *outbox) lenLocked() int {
+	n := 0
+	for _, q := range o.q {
+		n += len(q)
+	}
+	return n
+}
+
+// run is the writer goroutine; it returns when ctx ends or a write fails
+// (closing the connection so the session notices). With batch_ms set,
+// metrics and tcpping_batch messages are held and go out together as one
+// `batch` message once the oldest has waited batch_ms, batchMaxItems are
+// held, or another message has to be written (order is kept).
+func (o *outbox) run(ctx context.Context) {
+	defer o.close()
+	var due <-chan time.Time
+	for {
+		o.mu.Lock()
+		m, ok, throttled := o.nextLocked(time.Now())
+		if !ok {
+			flushing := o.flushing
+			o.mu.Unlock()
+			if len(o.held) > 0 && flushing {
+				if !o.writeHeld() {
+					return
+				}
+				due = nil
+				continue
+			}
+			var retry <-chan time.Time
+			if throttled > 0 {
+				retry = time.After(throttled)
+			}
+			select {
+			case <-o.wake:
+			case <-retry:
+			case <-due:
+				if !o.writeHeld() {
+					return
+				}
+				due = nil
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+		o.writing = true
+		o.a.sendStats.depth.Store(int64(o.lenLocked()))
+		o.mu.Unlock()
+
+		wait := o.a.getBatchInterval()
+		hold := wait > 0 && batchable[msgType(m.v)]
+		if hold {
+			o.held = append(o.held, m.v)
+			if len(o.held) == 1 {
+				due = time.After(wait)
+			}
+			if len(o.held) < batchMaxItems {
+				o.setWriting(false)
+				continue
+			}
+		}
+		if len(o.held) > 0 {
+			if !o.writeHeld() {
+				return
+			}
+			due = nil
+			if hold {
+				continue
+			}
+		}
+		if !o.writeOne(m.v, m.class) {
+			return
+		}
+		o.setWriting(false)
+	}
+}
+
+func (o *outbox) setWriting(w bool) {
+	o.mu.Lock()
+	o.writing = w || len(o.held) > 0
+	o.mu.Unlock()
+}
+
+// writeHeld sends the held messages as one batch (a single one as is).
+func (o *outbox) writeHeld() bool {
+	var v any = o.held[0]
+	if len(o.held) > 1 {
+		v = map[string]any{
+			"type":     "batch",
+			"agent_id": o.a.getCfg().AgentID,
+			"ts":       o.a.reportTS(time.Now().Unix()),
+			"count":    len(o.held),
+			"items":    o.held,
+		}
+		o.a.sendStats.batches.Add(1)
+	}
+	o.held = nil
+	if !o.writeOne(v, classMetrics) {
+		return false
+	}
+	o.setWriting(false)
+	return true
+}
+
+// writeOne writes v under send_timeout_ms and charges it to class c; on
+// failure it closes the connection and reports false.
+func (o *outbox) writeOne(v any, c msgClass) bool {
+	v = o.encodeDelta(v)
+	_, _, timeout := o.limits()
+	_ = o.conn.SetWriteDeadline(time.Now().Add(timeout))
+	start := time.Now()
+	n, err := o.a.write(o.conn, v)
+	if time.Since(start) > slowWriteThreshold {
+		// the socket is backing up: stretch metrics until it drains
+		o.a.sendStats.slowWrites.Add(1)
+		o.a.stretch("slow_write", slowWriteCooldown)
+	}
+	releaseRaw(v)
+	if err != nil {
+		o.a.sendStats.errors.Add(1)
+		o.a.seqs.dropped(v, "write_error")
+		_ = o.conn.Close()
+		return false
+	}
+	o.mu.Lock()
+	o.buckets[c].spend(n)
+	o.mu.Unlock()
+	cs := &o.a.sendStats.classes[c]
+	cs.sent.Add(1)
+	cs.bytes.Add(uint64(n))
+	o.a.sendStats.sent.Add(1)
+	o.a.seqs.sent(v)
+	return true
+}
+
+func msgType(v any) string {
+	m, _ := v.(map[string]any)
+	t, _ := m["type"].(string)
+	return t
+}
+
+// close ends the session's queue; whatever is still queued or held is
+// recorded as lost.
+func (o *outbox) close() {
+	o.mu.Lock()
+	o.closed = true
+	var lost []outMsg
+	for c := range o.q {
+		lost = append(lost, o.q[c]...)
+		o.q[c] = nil
+	}
+	o.mu.Unlock()
+	o.a.sendStats.depth.Store(0)
+	for _, v := range o.held {
+		o.a.seqs.dropped(v, "disconnect")
+	}
+	o.held = nil
+	for _, m := range lost {
+		releaseRaw(m.v)
+		o.a.seqs.dropped(m.v, "disconnect")
+	}
+}
+
+// flush waits until everything queued so far (including a held batch) is
+// written, the session is over or deadline passes; it reports whether the
+// queue drained.
+func (o *outbox) flush(deadline time.Time) bool {
+	o.mu.Lock()
+	o.flushing = true
+	o.mu.Unlock()
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+	for {
+		o.mu.Lock()
+		empty := o.lenLocked() == 0 && !o.writing
+		done := o.closed || empty
+		o.mu.Unlock()
+		if done {
+			return empty
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (a *Agent) sendQueueInfo() map[string]any {
+	st := &a.sendStats
+	size, _, _ := (&outbox{a: a}).limits()
+	classes := make(map[string]any, numClasses)
+	for c := classControl; c < numClasses; c++ {
+		cs := &st.classes[c]
+		classes[classNames[c]] = map[string]any{
+			"sent":      cs.sent.Load(),
+			"bytes":     cs.bytes.Load(),
+			"throttled": cs.throttled.Load(),
+			"rate":      a.classRate(c),
+		}
+	}
+	return map[string]any{
+		"depth":       st.depth.Load(),
+		"max_depth":   st.maxDepth.Load(),
+		"capacity":    size,
+		"enqueued":    st.enqueued.Load(),
+		"sent":        st.sent.Load(),
+		"dropped":     st.dropped.Load(),
+		"errors":      st.errors.Load(),
+		"slow_writes": st.slowWrites.Load(),
+		"batches":     st.batches.Load(),
+		"chunked":     st.chunked.Load(),
+		"compressed":  st.compressed.Load(),
+		"classes":     classes,
+	}
+}
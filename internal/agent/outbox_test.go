@@ -0,0 +1,84 @@
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Vincentkeio/agent/internal/config"
+)
+
+func testOutbox(cfg config.Config) *outbox {
+	return (&Agent{cfg: cfg}).newOutbox(nil)
+}
+
+func typed(t string) map[string]any { return map[string]any{"type": t} }
+
+// drain pops everything nextLocked hands out at now, in order.
+func drain(o *outbox, now time.Time) []string {
+	var got []string
+	for {
+		m, ok, _ := o.nextLocked(now)
+		if !ok {
+			return got
+		}
+		if _, raw := m.v.(rawFrame); raw {
+			got = append(got, "raw")
+		} else {
+			got = append(got, msgType(m.v))
+		}
+	}
+}
+
+func sameOrder(got, want []string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestOutboxQueueFull(t *testing.T) {
+	tests := []struct {
+		name, policy string
+		in           []string
+		want         []string
+	}{
+		{"default drops oldest", "", []string{"metrics", "tcpping_batch", "metrics"}, []string{"metrics", "metrics"}},
+		{"lowest class first", "drop_oldest", []string{"tcpping_batch", "metrics", "agent_stats"}, []string{"agent_stats", "metrics"}},
+		{"drop newest", "drop_newest", []string{"metrics", "tcpping_batch", "metrics"}, []string{"metrics", "tcpping_batch"}},
+		{"replies over the limit", "drop_newest", []string{"metrics", "metrics", "ack", "pong"}, []string{"ack", "pong", "metrics", "metrics"}},
+		{"nothing droppable queued", "", []string{"ack", "pong", "metrics"}, []string{"ack", "pong"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := testOutbox(config.Config{SendQueue: 2, SendQueuePolicy: tt.policy})
+			for _, typ := range tt.in {
+				if err := o.send(typed(typ)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := drain(o, time.Now()); !sameOrder(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+			if d := o.a.sendStats.dropped.Load(); d != uint64(len(tt.in)-len(tt.want)) {
+				t.Errorf("dropped %d", d)
+			}
+		})
+	}
+}
+
+func TestOutboxClosed(t *testing.T) {
+	o := testOutbox(config.Config{})
+	_ = o.send(map[string]any{"type": "metrics", "seq": uint64(7), "ts": int64(1)})
+	o.close()
+	if err := o.send(typed("ack")); err != errOutboxClosed {
+		t.Errorf("send after close: %v", err)
+	}
+	if gaps := o.a.seqs.report(); gaps == nil || gaps["missing"] != uint64(1) {
+		t.Errorf("queued seq not recorded as lost: %v", gaps)
+	}
+}
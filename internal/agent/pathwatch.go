@@ -0,0 +1,219 @@
+package agent
+
+import (
+	"context"
+	"log/slog"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/Vincentkeio/agent/internal/netprobe"
+	"github.com/Vincentkeio/agent/internal/pathtrace"
+	"github.com/Vincentkeio/agent/internal/tcpping"
+	"github.com/Vincentkeio/agent/pkg/agentproto"
+)
+
+// pathWatchWorkers bounds the traces run at once.
+const pathWatchWorkers = 4
+
+// watchedPath is the last known path towards a target's address.
+type watchedPath struct {
+	ip   string
+	hops []pathtrace.Hop
+	next time.Time
+}
+
+// pathWatchLoop traces the first hops towards every tcpping target once per
+// path_watch.interval_sec and sends path_change when a hop answers from
+// another address than in the last trace. A difference is traced again
+// right away and only reported if it holds, so that a late or
+// load-balanced answer doesn't pass for a routing change. The first trace
+// of a target (or of a new address it resolves to) only sets the baseline.
+func (a *Agent) pathWatchLoop(ctx context.Context, out *outbox, agentID string) {
+	t := time.NewTicker(10 * time.Second)
+	defer t.Stop()
+	for {
+		var now time.Time
+		select {
+		case now = <-t.C:
+		case <-ctx.Done():
+			return
+		case <-a.stopCh:
+			return
+		}
+
+		enabled, _, targets := a.tcppingTargets()
+		if !enabled || a.isPaused() || !a.capAllowed("path_watch") {
+			continue
+		}
+		cfg := a.getCfg()
+		var due []tcpping.Target
+		live := make(map[string]bool, len(targets))
+		a.pathMu.Lock()
+		if a.paths == nil {
+			a.paths = map[string]*watchedPath{}
+		}
+		for _, tg := range targets {
+			k := targetKey(tg)
+			live[k] = true
+			p := a.paths[k]
+			if p == nil {
+				p = &watchedPath{}
+				a.paths[k] = p
+			}
+			if now.Before(p.next) {
+				continue
+			}
+			p.next = now.Add(time.Duration(cfg.PathWatch.IntervalSec) * time.Second)
+			due = append(due, tg)
+		}
+		for k := range a.paths {
+			if !live[k] {
+				delete(a.paths, k)
+			}
+		}
+		a.pathMu.Unlock()
+
+		sem := make(chan struct{}, pathWatchWorkers)
+		var wg sync.WaitGroup
+		for _, tg := range due {
+			sem <- struct{}{}
+			wg.Add(1)
+			go func(tg tcpping.Target) {
+				defer func() { <-sem; wg.Done() }()
+				if msg := a.watchPath(ctx, tg, cfg.PathWatch.MaxHops); msg != nil {
+					msg["agent_id"] = agentID
+					_ = out.send(msg)
+				}
+			}(tg)
+		}
+		wg.Wait()
+	}
+}
+
+// watchPath traces towards tg and returns a path_change message (without
+// agent_id) when its path changed.
+func (a *Agent) watchPath(ctx context.Context, tg tcpping.Target, maxHops int) map[string]any {
+	k := targetKey(tg)
+	start := time.Now()
+	ipStr, err := tcpping.Resolve(ctx, tg)
+	if err != nil {
+		a.stats.Record("path_watch", time.Since(start), err)
+		return nil
+	}
+	ip, _ := netip.ParseAddr(ipStr)
+	cur, err := a.tracePath(ctx, ip, maxHops)
+	a.stats.Record("path_watch", time.Since(start), err)
+	if err != nil {
+		slog.Debug("path trace failed", "target", k, "ip", ipStr, "err", err)
+		return nil
+	}
+
+	a.pathMu.Lock()
+	p := a.paths[k]
+	var prev []pathtrace.Hop
+	if p != nil && p.ip == ipStr {
+		prev = p.hops
+	}
+	a.pathMu.Unlock()
+	if p == nil {
+		return nil // dropped from the targets meanwhile
+	}
+
+	var changed []int
+	if prev != nil {
+		if changed = pathtrace.Changed(prev, cur.Hops); len(changed) > 0 {
+			again, err := a.tracePath(ctx, ip, maxHops)
+			if err != nil {
+				return nil
+			}
+			if changed = pathtrace.Changed(prev, again.Hops); len(changed) == 0 {
+				slog.Debug("path change not confirmed", "target", k, "ip", ipStr)
+			}
+			cur = again
+		}
+	}
+
+	a.pathMu.Lock()
+	p.ip, p.hops = ipStr, mergeHops(prev, cur.Hops, len(changed) > 0)
+	a.pathMu.Unlock()
+	if len(changed) == 0 {
+		return nil
+	}
+
+	slog.Info("path changed", "target", k, "ip", ipStr, "ttls", changed)
+	msg := map[string]any{
+		"type":      agentproto.TypePathChange,
+		"ts":        a.reportTS(time.Now().Unix()),
+		"target":    k,
+		"host":      tg.Host,
+		"ip":        ipStr,
+		"ttls":      changed,
+		"hops":      cur.Hops,
+		"prev_hops": prev,
+	}
+	if cur.Reached {
+		msg["reached"] = true
+	}
+	if as := pathtrace.ASPath(cur.Hops); len(as) > 0 {
+		msg["as_path"] = as
+		prevAS := pathtrace.ASPath(prev)
+		msg["prev_as_path"] = prevAS
+		msg["as_changed"] = !equalASPath(prevAS, as)
+	}
+	return msg
+}
+
+// tracePath traces ip and fills in the hops' ASNs from the local geoip
+// databases, when configured.
+func (a *Agent) tracePath(ctx context.Context, ip netip.Addr, maxHops int) (pathtrace.Path, error) {
+	p, err := pathtrace.Trace(ctx, ip, maxHops)
+	if err != nil {
+		return p, err
+	}
+	geo := a.getCfg().GeoIP
+	if geo.MMDB == "" && geo.ASNMMDB == "" {
+		return p, nil
+	}
+	ips := make([]string, 0, len(p.Hops))
+	for _, h := range p.Hops {
+		if h.IP != "" {
+			ips = append(ips, h.IP)
+		}
+	}
+	asns, err := netprobe.LookupASNs(ips, geo)
+	if err != nil {
+		slog.Debug("hop ASN lookup failed", "err", err)
+	}
+	for i, h := range p.Hops {
+		p.Hops[i].ASN = asns[h.IP]
+	}
+	return p, nil
+}
+
+// mergeHops is the new baseline: the current hops, with hops that didn't
+// answer this time taken from the previous trace unless the path changed.
+func mergeHops(prev, cur []pathtrace.Hop, changed bool) []pathtrace.Hop {
+	if changed {
+		return cur
+	}
+	merged := append([]pathtrace.Hop(nil), cur...)
+	for i := range merged {
+		if merged[i].IP == "" && i < len(prev) {
+			merged[i] = prev[i]
+		}
+	}
+	return merged
+}
+
+func equalASPath(a, b []uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,69 @@
+package agent
+
+import (
+	"log/slog"
+	"time"
+)
+
+type pauseState struct {
+	paused bool
+	until  time.Time // zero = until resume
+	reason string
+}
+
+// handlePause applies a `pause` message:
+//
+//	{"type":"pause","reason":"kernel upgrade","maintenance_until":1760000000}
+//
+// Without maintenance_until (or "until") the agent stays paused until `resume`.
+func (a *Agent) handlePause(m map[string]any) {
+	var until time.Time
+	for _, k := range []string{"maintenance_until", "until"} {
+		if v, ok := m[k].(float64); ok && v > 0 {
+			until = time.Unix(int64(v), 0)
+			break
+		}
+	}
+	reason, _ := m["reason"].(string)
+
+	a.pauseMu.Lock()
+	a.pause = pauseState{paused: true, until: until, reason: reason}
+	a.pauseMu.Unlock()
+	slog.Info("paused by master", "until", until, "reason", reason)
+}
+
+func (a *Agent) handleResume() {
+	a.pauseMu.Lock()
+	a.pause = pauseState{}
+	a.pauseMu.Unlock()
+	slog.Info("resumed by master")
+}
+
+// isPaused reports whether probes and metrics are suspended; an expired
+// maintenance window resumes automatically.
+func (a *Agent) isPaused() bool {
+	a.pauseMu.Lock()
+	defer a.pauseMu.Unlock()
+	if a.pause.paused && !a.pause.until.IsZero() && time.Now().After(a.pause.until) {
+		a.pause = pauseState{}
+		slog.Info("maintenance window over: resumed")
+	}
+	return a.pause.paused
+}
+
+// pauseInfo is what heartbeats (agent_stats) and pause_state report.
+func (a *Agent) pauseInfo() map[string]any {
+	paused := a.isPaused()
+	a.pauseMu.Lock()
+	defer a.pauseMu.Unlock()
+	out := map[string]any{"paused": paused}
+	if paused {
+		if !a.pause.until.IsZero() {
+			out["maintenance_until"] = a.pause.until.Unix()
+		}
+		if a.pause.reason != "" {
+			out["reason"] = a.pause.reason
+		}
+	}
+	return out
+}
@@ -0,0 +1,98 @@
+package agent
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/Vincentkeio/agent/internal/pcap"
+	"github.com/Vincentkeio/agent/pkg/agentproto"
+)
+
+const defaultPcapDuration = 10 // seconds
+
+// handlePcapRequest starts the capture a pcap_request asks for and answers
+// with pcap_result once it is done. One capture runs at a time, and it
+// stops with the session.
+func (a *Agent) handlePcapRequest(ctx context.Context, out *outbox, m map[string]any) {
+	cfg := a.getCfg()
+	id, _ := m["id"].(string)
+	iface, _ := m["iface"].(string)
+	bpf, _ := m["bpf"].(string)
+	dur, _ := m["duration"].(float64)
+	maxBytes, _ := m["max_bytes"].(float64)
+	duration := int(dur)
+	if duration <= 0 {
+		duration = defaultPcapDuration
+	}
+	duration = min(duration, cfg.Pcap.MaxDurationSec)
+	limit := cfg.Pcap.MaxBytes
+	if maxBytes > 0 && int(maxBytes) < limit {
+		limit = int(maxBytes)
+	}
+	res := map[string]any{
+		"type":     agentproto.TypePcapResult,
+		"agent_id": cfg.AgentID,
+		"iface":    iface,
+		"duration": duration,
+		"ok":       false,
+	}
+	if id != "" {
+		res["id"] = id
+	}
+	if bpf != "" {
+		res["bpf"] = bpf
+	}
+
+	var err error
+	switch {
+	case !a.capAllowed("pcap"):
+		err = errors.New("pcap is disabled")
+	case iface == "":
+		err = errors.New("pcap_request needs an iface")
+	case !a.pcapBusy.CompareAndSwap(false, true):
+		err = errors.New("a capture is already running")
+	}
+	if err != nil {
+		slog.Warn("pcap_request refused", "id", id, "iface", iface, "err", err)
+		res["err"] = err.Error()
+		res["ts"] = a.reportTS(time.Now().Unix())
+		_ = out.send(res)
+		return
+	}
+
+	slog.Info("packet capture started", "id", id, "iface", iface, "bpf", bpf,
+		"duration", duration, "max_bytes", limit)
+	go func() {
+		defer a.pcapBusy.Store(false)
+		start := time.Now()
+		r, err := pcap.Capture(ctx, pcap.Request{
+			Iface:    iface,
+			BPF:      bpf,
+			Duration: time.Duration(duration) * time.Second,
+			MaxBytes: limit,
+		})
+		res["duration_ms"] = time.Since(start).Milliseconds()
+		res["packets"] = r.Packets
+		if r.Method != "" {
+			res["method"] = r.Method
+		}
+		if r.Truncated {
+			res["truncated"] = true
+		}
+		if len(r.Data) > 0 {
+			res["data"] = base64.StdEncoding.EncodeToString(r.Data)
+		}
+		if err != nil {
+			res["err"] = err.Error()
+		} else {
+			res["ok"] = true
+		}
+		res["ts"] = a.reportTS(time.Now().Unix())
+		slog.Info("packet capture done", "id", id, "iface", iface, "method", r.Method,
+			"packets", r.Packets, "bytes", len(r.Data), "truncated", r.Truncated, "err", err)
+		_ = out.send(res)
+	}()
+}
@@ -0,0 +1,137 @@
+package agent
+
+import (
+	"context"
+	"log/slog"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/Vincentkeio/agent/internal/plugins"
+	"github.com/Vincentkeio/agent/pkg/agentproto"
+)
+
+// runningPlugin is a configured plugin's sidecar and its schedule.
+type runningPlugin struct {
+	sc   *plugins.Sidecar
+	next time.Time
+	busy bool // a Collect is in flight
+}
+
+// pluginLoop asks every configured plugin for data once per its interval
+// and sends plugin_metrics. The plugin processes outlive the session: they
+// are only stopped when the plugin leaves (or changes in) the config, when
+// the plugins capability is turned off, and at exit.
+func (a *Agent) pluginLoop(ctx context.Context, out *outbox, agentID string) {
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for {
+		var now time.Time
+		select {
+		case now = <-t.C:
+		case <-ctx.Done():
+			return
+		case <-a.stopCh:
+			return
+		}
+		if a.isPaused() {
+			continue
+		}
+		for _, rp := range a.duePlugins(now) {
+			go func(rp *runningPlugin) {
+				msg := a.collectPlugin(rp.sc)
+				a.pluginMu.Lock()
+				rp.busy = false
+				a.pluginMu.Unlock()
+				if ctx.Err() == nil {
+					msg["agent_id"] = agentID
+					_ = out.send(msg)
+				}
+			}(rp)
+		}
+	}
+}
+
+// duePlugins brings the sidecars in line with the config and returns the
+// ones due at now, marked busy.
+func (a *Agent) duePlugins(now time.Time) []*runningPlugin {
+	want := a.getCfg().Plugins
+	if !a.capAllowed("plugins") {
+		want = nil
+	}
+	a.pluginMu.Lock()
+	defer a.pluginMu.Unlock()
+	if a.sidecars == nil {
+		a.sidecars = map[string]*runningPlugin{}
+	}
+	var due []*runningPlugin
+	live := make(map[string]bool, len(want))
+	for _, p := range want {
+		live[p.Name] = true
+		rp := a.sidecars[p.Name]
+		if rp != nil && !reflect.DeepEqual(rp.sc.Plugin(), p) {
+			slog.Info("plugin config changed, restarting it", "plugin", p.Name)
+			go rp.sc.Close()
+			rp = nil
+		}
+		if rp == nil {
+			rp = &runningPlugin{sc: plugins.NewSidecar(p), next: now}
+			a.sidecars[p.Name] = rp
+		}
+		if rp.busy || now.Before(rp.next) {
+			continue
+		}
+		rp.busy = true
+		rp.next = now.Add(p.Interval())
+		due = append(due, rp)
+	}
+	for name, rp := range a.sidecars {
+		if !live[name] {
+			slog.Info("plugin removed, stopping it", "plugin", name)
+			go rp.sc.Close()
+			delete(a.sidecars, name)
+		}
+	}
+	return due
+}
+
+// collectPlugin runs one Collect and returns its plugin_metrics message
+// (without agent_id).
+func (a *Agent) collectPlugin(sc *plugins.Sidecar) map[string]any {
+	start := time.Now()
+	data, err := sc.Collect(context.Background())
+	dur := time.Since(start)
+	a.stats.Record("plugins", dur, err)
+	msg := map[string]any{
+		"type":        agentproto.TypePluginMetrics,
+		"plugin":      sc.Name(),
+		"ts":          a.reportTS(start.Unix()),
+		"duration_ms": dur.Milliseconds(),
+	}
+	if v := sc.Version(); v != "" {
+		msg["version"] = v
+	}
+	if err != nil {
+		slog.Warn("plugin collect failed", "plugin", sc.Name(), "err", err)
+		msg["err"] = err.Error()
+	} else {
+		msg["data"] = data
+	}
+	return msg
+}
+
+// closePlugins stops all plugin processes.
+func (a *Agent) closePlugins() {
+	a.pluginMu.Lock()
+	defer a.pluginMu.Unlock()
+	var wg sync.WaitGroup
+	for _, rp := range a.sidecars {
+		wg.Add(1)
+		go func(sc *plugins.Sidecar) {
+			defer wg.Done()
+			_ = sc.Close()
+		}(rp.sc)
+	}
+	wg.Wait()
+	a.sidecars = nil
+}
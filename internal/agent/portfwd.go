@@ -0,0 +1,436 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/Vincentkeio/agent/pkg/agentproto"
+)
+
+const (
+	maxFwdStreams  = 64 // open streams per session
+	fwdDialTimeout = 10 * time.Second
+	fwdReadSize    = 16 << 10
+	// fwdInFrames frames from the master are buffered per stream; when the
+	// target doesn't take them within fwdInWait the stream is reset rather
+	// than stalling every other message of the session.
+	fwdInFrames = 64
+	fwdInWait   = 5 * time.Second
+	// fwdOutFrames bounds stream frames waiting in the send queue (all
+	// streams together); readers wait for room, which pushes back on the
+	// targets through TCP.
+	fwdOutFrames = 256
+)
+
+// rawFrame is a binary frame queued as it is (a stream frame); release is
+// called once it was written or dropped.
+type rawFrame struct {
+	b       []byte
+	release func()
+}
+
+func releaseRaw(v any) {
+	if f, ok := v.(rawFrame); ok && f.release != nil {
+		f.release()
+	}
+}
+
+// forwarder holds one session's tunnels and streams (port_forward,
+// socks5_egress). It is driven by recvLoop and closed with the session.
+type forwarder struct {
+	a       *Agent
+	out     *outbox
+	credits chan struct{}
+
+	mu      sync.Mutex
+	closed  bool
+	tunnels map[string]fwdTunnel
+	streams map[uint32]*fwdStream
+}
+
+type fwdTunnel struct {
+	target string // port_forward target; "" for socks5
+	socks5 bool
+}
+
+type fwdStream struct {
+	id     uint32
+	tunnel string
+	in     chan []byte   // data from the master
+	fin    chan struct{} // closed on the master's fin
+	done   chan struct{} // closed by close
+	once   sync.Once
+	finned bool // fin received (recvLoop only)
+
+	mu      sync.Mutex
+	conn    io.ReadWriteCloser // nil until connected
+	outDone bool               // the target's side is finished
+	inDone  bool               // the master's side is finished
+}
+
+func (a *Agent) newForwarder(out *outbox) *forwarder {
+	return &forwarder{
+		a:       a,
+		out:     out,
+		credits: make(chan struct{}, fwdOutFrames),
+		tunnels: map[string]fwdTunnel{},
+		streams: map[uint32]*fwdStream{},
+	}
+}
+
+// portForwardAllowed reports whether target is in port_forward.
+func (a *Agent) portForwardAllowed(target string) bool {
+	return slices.Contains(a.getCfg().PortForward, target)
+}
+
+func (f *forwarder) agentID() string { return f.a.getCfg().AgentID }
+
+// handleTunnelOpen registers a tunnel to a port_forward target, or a
+// SOCKS5 tunnel.
+func (f *forwarder) handleTunnelOpen(m map[string]any) {
+	id, _ := m["tunnel_id"].(string)
+	target, _ := m["remote_target"].(string)
+	socks, _ := m["socks5"].(bool)
+	port, _ := m["local_port"].(float64)
+	res := map[string]any{
+		"type":      agentproto.TypeTunnelOpenResult,
+		"agent_id":  f.agentID(),
+		"tunnel_id": id,
+		"ok":        false,
+	}
+	if socks {
+		res["socks5"] = true
+	} else {
+		res["remote_target"] = target
+	}
+	if port > 0 {
+		res["local_port"] = int(port)
+	}
+	var err error
+	switch {
+	case id == "":
+		err = errors.New("tunnel_open needs a tunnel_id")
+	case socks && target != "":
+		err = errors.New("a socks5 tunnel takes no remote_target")
+	case socks && !f.a.capAllowed("socks5_egress"):
+		err = errors.New("socks5_egress is disabled")
+	case socks:
+	case !f.a.capAllowed("port_forward"):
+		err = errors.New("port_forward is disabled")
+	case !f.a.portForwardAllowed(target):
+		err = fmt.Errorf("%q is not in port_forward", target)
+	}
+	if err == nil {
+		f.mu.Lock()
+		if _, dup := f.tunnels[id]; dup {
+			err = fmt.Errorf("tunnel %q is already open", id)
+		} else {
+			f.tunnels[id] = fwdTunnel{target: target, socks5: socks}
+		}
+		f.mu.Unlock()
+	}
+	if err != nil {
+		res["err"] = err.Error()
+		slog.Warn("tunnel_open refused", "tunnel", id, "target", target, "socks5", socks, "err", err)
+	} else {
+		res["ok"] = true
+		slog.Info("tunnel opened", "tunnel", id, "target", target, "socks5", socks, "local_port", int(port))
+	}
+	_ = f.out.send(res)
+}
+
+// handleTunnelClose drops a tunnel and resets its streams.
+func (f *forwarder) handleTunnelClose(m map[string]any) {
+	id, _ := m["tunnel_id"].(string)
+	f.mu.Lock()
+	_, ok := f.tunnels[id]
+	delete(f.tunnels, id)
+	var victims []*fwdStream
+	for _, s := range f.streams {
+		if s.tunnel == id {
+			victims = append(victims, s)
+		}
+	}
+	f.mu.Unlock()
+	for _, s := range victims {
+		f.drop(s, false)
+	}
+	if ok {
+		slog.Info("tunnel closed", "tunnel", id, "streams", len(victims))
+	}
+}
+
+// handleStreamOpen connects a new stream to its tunnel's target, or to a
+// SOCKS5 server for the stream; the dial runs in the background and frames
+// for the stream are buffered meanwhile.
+func (f *forwarder) handleStreamOpen(m map[string]any) {
+	tid, _ := m["tunnel_id"].(string)
+	n, _ := m["stream_id"].(float64)
+	id := uint32(n)
+	fail := func(err error) {
+		_ = f.out.send(map[string]any{
+			"type":      agentproto.TypeStreamOpenResult,
+			"agent_id":  f.agentID(),
+			"tunnel_id": tid,
+			"stream_id": id,
+			"ok":        false,
+			"err":       err.Error(),
+		})
+	}
+
+	f.mu.Lock()
+	tun, ok := f.tunnels[tid]
+	switch {
+	case f.closed:
+		f.mu.Unlock()
+		return
+	case !ok:
+		f.mu.Unlock()
+		fail(fmt.Errorf("no tunnel %q", tid))
+		return
+	case n < 1 || n > 1<<32-1 || float64(id) != n:
+		f.mu.Unlock()
+		fail(errors.New("stream_id must be a non-zero uint32"))
+		return
+	case f.streams[id] != nil:
+		f.mu.Unlock()
+		fail(fmt.Errorf("stream %d is already open", id))
+		return
+	case len(f.streams) >= maxFwdStreams:
+		f.mu.Unlock()
+		fail(fmt.Errorf("too many streams (%d)", maxFwdStreams))
+		return
+	}
+	s := &fwdStream{id: id, tunnel: tid, in: make(chan []byte, fwdInFrames), fin: make(chan struct{}), done: make(chan struct{})}
+	f.streams[id] = s
+	f.mu.Unlock()
+
+	go func() {
+		var conn io.ReadWriteCloser
+		var err error
+		if tun.socks5 {
+			conn = f.socksServer(s)
+		} else {
+			conn, err = net.DialTimeout("tcp", tun.target, fwdDialTimeout)
+		}
+		if err == nil {
+			s.mu.Lock()
+			select {
+			case <-s.done: // reset while dialing
+				err = errors.New("stream closed")
+			default:
+				s.conn = conn
+			}
+			s.mu.Unlock()
+		}
+		if err != nil {
+			if conn != nil {
+				conn.Close()
+			}
+			f.drop(s, false)
+			fail(err)
+			return
+		}
+		_ = f.out.send(map[string]any{
+			"type":      agentproto.TypeStreamOpenResult,
+			"agent_id":  f.agentID(),
+			"tunnel_id": tid,
+			"stream_id": id,
+			"ok":        true,
+		})
+		go f.pumpIn(s)
+		f.pumpOut(s)
+	}()
+}
+
+// handleFrame takes a binary frame from the master.
+func (f *forwarder) handleFrame(b []byte) {
+	op, id, payload, ok := agentproto.ParseStreamFrame(b)
+	if !ok {
+		return
+	}
+	f.mu.Lock()
+	s := f.streams[id]
+	f.mu.Unlock()
+	if s == nil {
+		if op != agentproto.StreamReset {
+			f.sendCtl(agentproto.StreamReset, id)
+		}
+		return
+	}
+	switch op {
+	case agentproto.StreamData:
+		if s.finned || len(payload) == 0 {
+			return
+		}
+		t := time.NewTimer(fwdInWait)
+		defer t.Stop()
+		select {
+		case s.in <- append([]byte(nil), payload...): // payload is reused by the next read
+		case <-s.done:
+		case <-t.C:
+			slog.Warn("tunnel stream reset: target too slow", "tunnel", s.tunnel, "stream", id)
+			f.drop(s, true)
+		}
+	case agentproto.StreamFin:
+		if !s.finned {
+			s.finned = true
+			close(s.fin)
+		}
+	case agentproto.StreamReset:
+		f.drop(s, false)
+	}
+}
+
+// pumpIn writes the master's data to the target, then half-closes it.
+func (f *forwarder) pumpIn(s *fwdStream) {
+	write := func(b []byte) bool {
+		if _, err := s.conn.Write(b); err != nil {
+			f.drop(s, true)
+			return false
+		}
+		return true
+	}
+	for {
+		select {
+		case b := <-s.in:
+			if !write(b) {
+				return
+			}
+			continue
+		case <-s.fin:
+		case <-s.done:
+			return
+		}
+		// fin: what was sent before it is already buffered
+		for {
+			select {
+			case b := <-s.in:
+				if !write(b) {
+					return
+				}
+				continue
+			default:
+			}
+			break
+		}
+		if cw, ok := s.conn.(interface{ CloseWrite() error }); ok {
+			_ = cw.CloseWrite()
+		}
+		f.finish(s, false)
+		return
+	}
+}
+
+// pumpOut reads the target and queues data frames for the master, a
+// frame at a time within max_frame, then sends fin.
+func (f *forwarder) pumpOut(s *fwdStream) {
+	size := fwdReadSize
+	if mf := int(f.a.maxFrame.Load()); mf > 0 {
+		size = min(size, max(mf, agentproto.MinMaxFrame)-agentproto.StreamHeaderLen)
+	}
+	buf := make([]byte, size)
+	for {
+		n, err := s.conn.Read(buf)
+		if n > 0 {
+			if !f.sendData(s, buf[:n]) {
+				f.drop(s, false)
+				return
+			}
+		}
+		if err != nil {
+			select {
+			case <-s.done:
+				return
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			f.sendCtl(agentproto.StreamFin, s.id)
+			f.finish(s, true)
+			return
+		}
+	}
+}
+
+// sendData queues one data frame, waiting for room in the send queue.
+func (f *forwarder) sendData(s *fwdStream, b []byte) bool {
+	select {
+	case f.credits <- struct{}{}:
+	case <-s.done:
+		return false
+	}
+	frame := rawFrame{b: agentproto.StreamFrame(agentproto.StreamData, s.id, b), release: func() { <-f.credits }}
+	if f.out.send(frame) != nil {
+		frame.release()
+		return false
+	}
+	return true
+}
+
+func (f *forwarder) sendCtl(op byte, id uint32) {
+	_ = f.out.send(rawFrame{b: agentproto.StreamFrame(op, id, nil)})
+}
+
+// finish marks one direction of s done and closes s once both are.
+func (f *forwarder) finish(s *fwdStream, read bool) {
+	s.mu.Lock()
+	if read {
+		s.outDone = true
+	} else {
+		s.inDone = true
+	}
+	both := s.outDone && s.inDone
+	s.mu.Unlock()
+	if both {
+		f.drop(s, false)
+	}
+}
+
+// drop closes s; with reset the master is told the stream is gone.
+func (f *forwarder) drop(s *fwdStream, reset bool) {
+	first := false
+	s.once.Do(func() {
+		first = true
+		close(s.done)
+		s.mu.Lock()
+		if s.conn != nil {
+			s.conn.Close()
+		}
+		s.mu.Unlock()
+	})
+	f.remove(s)
+	if first && reset {
+		f.sendCtl(agentproto.StreamReset, s.id)
+	}
+}
+
+func (f *forwarder) remove(s *fwdStream) {
+	f.mu.Lock()
+	if f.streams[s.id] == s {
+		delete(f.streams, s.id)
+	}
+	f.mu.Unlock()
+}
+
+// close ends every stream with the session.
+func (f *forwarder) close() {
+	f.mu.Lock()
+	f.closed = true
+	streams := make([]*fwdStream, 0, len(f.streams))
+	for _, s := range f.streams {
+		streams = append(streams, s)
+	}
+	f.tunnels = map[string]fwdTunnel{}
+	f.mu.Unlock()
+	for _, s := range streams {
+		f.drop(s, false)
+	}
+}
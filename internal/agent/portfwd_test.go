@@ -0,0 +1,234 @@
+package agent
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Vincentkeio/agent/internal/config"
+	"github.com/Vincentkeio/agent/pkg/agentproto"
+)
+
+// expect pops queued messages until one satisfies match, standing in for
+// the writer goroutine; it fails the test after a few seconds.
+func expect(t *testing.T, o *outbox, what string, match func(v any) bool) any {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	var seen []string
+	for time.Now().Before(deadline) {
+		o.mu.Lock()
+		m, ok, _ := o.nextLocked(time.Now())
+		o.mu.Unlock()
+		if !ok {
+			time.Sleep(5 * time.Millisecond)
+			continue
+		}
+		releaseRaw(m.v)
+		if match(m.v) {
+			return m.v
+		}
+		seen = append(seen, describe(m.v))
+	}
+	t.Fatalf("no %s; got %v", what, seen)
+	return nil
+}
+
+func describe(v any) string {
+	if f, ok := v.(rawFrame); ok {
+		op, id, p, _ := agentproto.ParseStreamFrame(f.b)
+		return fmt.Sprintf("frame op %d stream %d %q", op, id, p)
+	}
+	return msgType(v)
+}
+
+func result(typ string, ok bool) func(v any) bool {
+	return func(v any) bool {
+		m, _ := v.(map[string]any)
+		return msgType(v) == typ && m["ok"] == ok
+	}
+}
+
+func frame(op byte, id uint32, payload string) func(v any) bool {
+	return func(v any) bool {
+		f, ok := v.(rawFrame)
+		if !ok {
+			return false
+		}
+		o, i, p, _ := agentproto.ParseStreamFrame(f.b)
+		return o == op && i == id && (payload == "" || string(p) == payload)
+	}
+}
+
+// echoServer accepts connections and echoes them until the client
+// half-closes.
+func echoServer(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_, _ = io.Copy(c, c)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func testForwarder(t *testing.T, cfg config.Config) (*forwarder, *outbox) {
+	cfg.AllowRoot = true
+	o := testOutbox(cfg)
+	f := o.a.newForwarder(o)
+	t.Cleanup(f.close)
+	return f, o
+}
+
+func TestTunnelOpen(t *testing.T) {
+	target := echoServer(t)
+	f, o := testForwarder(t, config.Config{PortForward: []string{target}})
+	tests := []struct {
+		name string
+		msg  map[string]any
+		err  string
+	}{
+		{"allowed", map[string]any{"tunnel_id": "t1", "remote_target": target, "local_port": 8080.0}, ""},
+		{"duplicate", map[string]any{"tunnel_id": "t1", "remote_target": target}, "already open"},
+		{"no id", map[string]any{"remote_target": target}, "needs a tunnel_id"},
+		{"not listed", map[string]any{"tunnel_id": "t2", "remote_target": "127.0.0.1:1"}, "not in port_forward"},
+		{"socks5 disabled", map[string]any{"tunnel_id": "t3", "socks5": true}, "socks5_egress is disabled"},
+		{"socks5 with target", map[string]any{"tunnel_id": "t4", "socks5": true, "remote_target": target}, "no remote_target"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f.handleTunnelOpen(tt.msg)
+			res := expect(t, o, "tunnel_open_result", result(agentproto.TypeTunnelOpenResult, tt.err == "")).(map[string]any)
+			if e, _ := res["err"].(string); !strings.Contains(e, tt.err) {
+				t.Errorf("err %q, want %q", e, tt.err)
+			}
+			if res["tunnel_id"] != tt.msg["tunnel_id"] && tt.msg["tunnel_id"] != nil {
+				t.Errorf("tunnel_id %v", res["tunnel_id"])
+			}
+		})
+	}
+
+	// without a port_forward list the capability is off altogether
+	f, o = testForwarder(t, config.Config{})
+	f.handleTunnelOpen(map[string]any{"tunnel_id": "t1", "remote_target": target})
+	res := expect(t, o, "tunnel_open_result", result(agentproto.TypeTunnelOpenResult, false)).(map[string]any)
+	if res["err"] != "port_forward is disabled" {
+		t.Errorf("err %v", res["err"])
+	}
+}
+
+func TestStreamRelay(t *testing.T) {
+	target := echoServer(t)
+	f, o := testForwarder(t, config.Config{PortForward: []string{target}})
+	f.handleTunnelOpen(map[string]any{"tunnel_id": "t", "remote_target": target})
+	expect(t, o, "tunnel_open_result", result(agentproto.TypeTunnelOpenResult, true))
+
+	f.handleStreamOpen(map[string]any{"tunnel_id": "t", "stream_id": 1.0})
+	// data may come before the agent has connected
+	f.handleFrame(agentproto.StreamFrame(agentproto.StreamData, 1, []byte("hello")))
+	expect(t, o, "stream_open_result", result(agentproto.TypeStreamOpenResult, true))
+	expect(t, o, "echoed data", frame(agentproto.StreamData, 1, "hello"))
+
+	// fin half-closes the target, which echoes what's left and closes:
+	// the agent sends fin back and forgets the stream
+	f.handleFrame(agentproto.StreamFrame(agentproto.StreamData, 1, []byte("bye")))
+	f.handleFrame(agentproto.StreamFrame(agentproto.StreamFin, 1, nil))
+	expect(t, o, "echoed data", frame(agentproto.StreamData, 1, "bye"))
+	expect(t, o, "fin", frame(agentproto.StreamFin, 1, ""))
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		f.mu.Lock()
+		n := len(f.streams)
+		f.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("stream still open after fin both ways")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// frames for a stream that isn't open are answered with a reset
+	f.handleFrame(agentproto.StreamFrame(agentproto.StreamData, 1, []byte("late")))
+	expect(t, o, "reset", frame(agentproto.StreamReset, 1, ""))
+}
+
+func TestStreamOpenErrors(t *testing.T) {
+	f, o := testForwarder(t, config.Config{PortForward: []string{"127.0.0.1:1"}})
+	f.handleTunnelOpen(map[string]any{"tunnel_id": "t", "remote_target": "127.0.0.1:1"})
+	expect(t, o, "tunnel_open_result", result(agentproto.TypeTunnelOpenResult, true))
+	tests := []struct {
+		name string
+		msg  map[string]any
+		err  string
+	}{
+		{"no tunnel", map[string]any{"tunnel_id": "x", "stream_id": 1.0}, "no tunnel"},
+		{"zero id", map[string]any{"tunnel_id": "t", "stream_id": 0.0}, "non-zero uint32"},
+		{"fractional id", map[string]any{"tunnel_id": "t", "stream_id": 1.5}, "non-zero uint32"},
+		{"id too large", map[string]any{"tunnel_id": "t", "stream_id": float64(1 << 33)}, "non-zero uint32"},
+		{"dial fails", map[string]any{"tunnel_id": "t", "stream_id": 2.0}, "refused"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f.handleStreamOpen(tt.msg)
+			res := expect(t, o, "stream_open_result", result(agentproto.TypeStreamOpenResult, false)).(map[string]any)
+			if e, _ := res["err"].(string); !strings.Contains(e, tt.err) {
+				t.Errorf("err %q, want %q", e, tt.err)
+			}
+		})
+	}
+}
+
+func TestTunnelClose(t *testing.T) {
+	target := echoServer(t)
+	f, o := testForwarder(t, config.Config{PortForward: []string{target}})
+	f.handleTunnelOpen(map[string]any{"tunnel_id": "t", "remote_target": target})
+	expect(t, o, "tunnel_open_result", result(agentproto.TypeTunnelOpenResult, true))
+	for _, id := range []float64{1, 2} {
+		f.handleStreamOpen(map[string]any{"tunnel_id": "t", "stream_id": id})
+		expect(t, o, "stream_open_result", result(agentproto.TypeStreamOpenResult, true))
+	}
+	f.handleStreamOpen(map[string]any{"tunnel_id": "t", "stream_id": 2.0})
+	expect(t, o, "duplicate stream refused", result(agentproto.TypeStreamOpenResult, false))
+
+	f.handleTunnelClose(map[string]any{"tunnel_id": "t"})
+	f.mu.Lock()
+	n, tunnels := len(f.streams), len(f.tunnels)
+	f.mu.Unlock()
+	if n != 0 || tunnels != 0 {
+		t.Errorf("%d streams, %d tunnels left", n, tunnels)
+	}
+	f.handleStreamOpen(map[string]any{"tunnel_id": "t", "stream_id": 3.0})
+	expect(t, o, "stream on a closed tunnel refused", result(agentproto.TypeStreamOpenResult, false))
+}
+
+func TestStreamFrame(t *testing.T) {
+	b := agentproto.StreamFrame(agentproto.StreamData, 0x01020304, []byte("xy"))
+	if string(b[:2]) != "KT" || len(b) != agentproto.StreamHeaderLen+2 {
+		t.Fatalf("frame % x", b)
+	}
+	op, id, p, ok := agentproto.ParseStreamFrame(b)
+	if !ok || op != agentproto.StreamData || id != 0x01020304 || string(p) != "xy" {
+		t.Errorf("parsed %d %x %q %v", op, id, p, ok)
+	}
+	for _, bad := range [][]byte{nil, []byte("KT"), []byte("KX\x01\x00\x00\x00\x01"), {0x81, 0xa1, 'a', 1, 2, 3, 4}} {
+		if _, _, _, ok := agentproto.ParseStreamFrame(bad); ok {
+			t.Errorf("parsed % x", bad)
+		}
+	}
+}
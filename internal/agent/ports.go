@@ -0,0 +1,79 @@
+package agent
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/Vincentkeio/agent/internal/ports"
+)
+
+// portsLoop scans the listening sockets every ports_interval_sec. The
+// first scan of a session sends the full inventory (with the changes since
+// the last one reported, which may be from a previous session); later scans
+// send it only when something opened or closed.
+func (a *Agent) portsLoop(ctx context.Context, out *outbox, agentID string) {
+	t := time.NewTicker(5 * time.Second)
+	defer t.Stop()
+	var next time.Time
+	first := true
+	for {
+		var now time.Time
+		select {
+		case now = <-t.C:
+		case <-ctx.Done():
+			return
+		case <-a.stopCh:
+			return
+		}
+
+		sec := a.getCfg().PortsIntervalSec
+		if sec <= 0 || a.isPaused() || !a.capAllowed("ports") || now.Before(next) {
+			continue
+		}
+		next = now.Add(time.Duration(sec) * time.Second)
+
+		start := time.Now()
+		cur, err := ports.List()
+		a.stats.Record("ports", time.Since(start), err)
+		if err != nil {
+			continue
+		}
+
+		a.portsMu.Lock()
+		prev, known := a.ports, a.portsKnown
+		a.ports, a.portsKnown = cur, true
+		a.portsMu.Unlock()
+
+		msg := map[string]any{
+			"type":     "ports",
+			"agent_id": agentID,
+			"ts":       a.reportTS(now.Unix()),
+			"ports":    cur,
+		}
+		if known {
+			opened, closed := ports.Diff(prev, cur)
+			if len(opened) == 0 && len(closed) == 0 && !first {
+				continue
+			}
+			if len(opened) > 0 {
+				msg["opened"] = opened
+				slog.Warn("new listening ports", "opened", portKeys(opened))
+			}
+			if len(closed) > 0 {
+				msg["closed"] = closed
+				slog.Info("listening ports closed", "closed", portKeys(closed))
+			}
+		}
+		first = false
+		_ = out.send(msg)
+	}
+}
+
+func portKeys(ls []ports.Listener) []string {
+	out := make([]string, len(ls))
+	for i, l := range ls {
+		out[i] = l.Key()
+	}
+	return out
+}
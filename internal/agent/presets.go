@@ -0,0 +1,84 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/Vincentkeio/agent/internal/presets"
+	"github.com/Vincentkeio/agent/internal/tcpping"
+)
+
+// catalog is the preset catalog in use (built-in or a newer one from
+// state_dir / presets_update).
+func (a *Agent) catalog() *presets.Catalog {
+	if c := a.presets.Load(); c != nil {
+		return c
+	}
+	return presets.Builtin()
+}
+
+// presetTargets expands the selected presets: pushed ones if the master
+// sent any tcpping targets/presets, else tcpping.presets from config.json.
+func (a *Agent) presetTargets() []tcpping.Target {
+	a.rtMu.RLock()
+	names := a.rt.TCPPingPresets
+	a.rtMu.RUnlock()
+	if names == nil {
+		names = a.getCfg().TCPPing.Presets
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	ts, _ := a.catalog().Expand(names)
+	return ts
+}
+
+func (a *Agent) warnUnknownPresets(names []string) {
+	if _, missing := a.catalog().Expand(names); len(missing) > 0 {
+		slog.Warn("unknown tcpping presets", "presets", missing, "known", a.catalog().Names())
+	}
+}
+
+// handlePresetsUpdate installs a newer catalog sent by the master:
+//
+//	{"type":"presets_update","catalog":{"version":3,"presets":{...}}}
+//
+// Older or equal versions are ignored; a newer one is stored in state_dir
+// so it survives restarts and binary downgrades to older built-ins.
+func (a *Agent) handlePresetsUpdate(m map[string]any) map[string]any {
+	reply := map[string]any{"ok": true}
+	if err := a.updatePresets(m["catalog"]); err != nil {
+		slog.Warn("presets update rejected", "err", err)
+		reply["ok"] = false
+		reply["err"] = err.Error()
+	}
+	c := a.catalog()
+	reply["version"] = c.Version
+	reply["presets"] = c.Names()
+	return reply
+}
+
+func (a *Agent) updatePresets(raw any) error {
+	if raw == nil {
+		return errors.New("missing catalog")
+	}
+	b, err := json.Marshal(raw)
+	if err != nil {
+		return err
+	}
+	c, err := presets.Parse(b)
+	if err != nil {
+		return err
+	}
+	if cur := a.catalog(); c.Version <= cur.Version {
+		return fmt.Errorf("catalog version %d is not newer than %d", c.Version, cur.Version)
+	}
+	if err := presets.Save(a.getCfg().StateDir, c); err != nil {
+		return err
+	}
+	a.presets.Store(c)
+	slog.Info("presets updated", "version", c.Version, "presets", c.Names())
+	return nil
+}
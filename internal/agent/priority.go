@@ -0,0 +1,123 @@
+package agent
+
+import (
+	"time"
+)
+
+// msgClass orders the send queue: the writer always takes the oldest
+// message of the highest class that is within its rate limit, so bulk
+// output can't starve heartbeats and metrics on a slow uplink.
+type msgClass int
+
+const (
+	classControl msgClass = iota // replies, acks, events, agent_stats, bye
+	classMetrics                 // metrics (and batches of them), plugin_metrics
+	classProbes                  // tcpping_batch/summary (and their replays), netprobe_update, tunnel_status, ports, proc_status
+	classLogs                    // bulk output
+	classTunnel                  // tunnel stream frames
+	numClasses
+)
+
+var classNames = [numClasses]string{"control", "metrics", "probes", "logs", "tunnel"}
+
+// defaultClassRates are bytes/s per class when send_rate_limits doesn't
+// set one (0 = unlimited).
+var defaultClassRates = [numClasses]int{classLogs: 64 << 10}
+
+var classOf = map[string]msgClass{
+	"metrics":         classMetrics,
+	"plugin_metrics":  classMetrics,
+	"tcpping_batch":   classProbes,
+	"tcpping_summary": classProbes,
+	"netprobe_update": classProbes,
+	"tunnel_status":   classProbes,
+	"ports":           classProbes,
+	"proc_status":     classProbes,
+	"pcap_result":     classLogs,
+	"netinfo_result":  classLogs,
+}
+
+func classFor(v any) msgClass {
+	if _, ok := v.(rawFrame); ok {
+		return classTunnel
+	}
+	if _, ok := v.(zstdFrame); ok {
+		return classProbes
+	}
+	if c, ok := classOf[msgType(v)]; ok {
+		return c
+	}
+	return classControl
+}
+
+// classRate is the send_rate_limits entry for c in bytes/s; 0 means
+// unlimited (a negative config value lifts a default limit).
+func (a *Agent) classRate(c msgClass) int {
+	r, ok := a.getCfg().SendRateLimits[classNames[c]]
+	if !ok {
+		r = defaultClassRates[c]
+	}
+	if r < 0 {
+		return 0
+	}
+	return r
+}
+
+// rateBucket is a byte token bucket holding at most one second of rate.
+// A message is sent whenever the bucket isn't in debt, so one larger than
+// the bucket still goes out and just delays the next ones of its class.
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// wait refills the bucket and returns how long until the class may send.
+func (b *rateBucket) wait(rate int, now time.Time) time.Duration {
+	if rate <= 0 {
+		return 0
+	}
+	if b.last.IsZero() {
+		b.tokens = float64(rate)
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * float64(rate)
+		if b.tokens > float64(rate) {
+			b.tokens = float64(rate)
+		}
+	}
+	b.last = now
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / float64(rate) * float64(time.Second))
+}
+
+func (b *rateBucket) spend(n int) {
+	b.tokens -= float64(n)
+}
+
+// nextLocked pops the next message to write. When every non-empty class
+// is over its limit it returns the shortest wait instead. Limits are off
+// while flushing for shutdown (bounded by shutdown_timeout_ms anyway).
+func (o *outbox) nextLocked(now time.Time) (outMsg, bool, time.Duration) {
+	var wait time.Duration
+	for c := classControl; c < numClasses; c++ {
+		if len(o.q[c]) == 0 {
+			continue
+		}
+		rate := o.a.classRate(c)
+		if o.flushing {
+			rate = 0
+		}
+		if w := o.buckets[c].wait(rate, now); w > 0 {
+			o.a.sendStats.classes[c].throttled.Add(1)
+			if wait == 0 || w < wait {
+				wait = w
+			}
+			continue
+		}
+		m := o.q[c][0]
+		o.q[c] = o.q[c][1:]
+		return m, true, 0
+	}
+	return outMsg{}, false, wait
+}
@@ -0,0 +1,117 @@
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Vincentkeio/agent/internal/config"
+)
+
+func TestClassFor(t *testing.T) {
+	tests := []struct {
+		v    any
+		want msgClass
+	}{
+		{typed("ack"), classControl},
+		{typed("agent_stats"), classControl},
+		{typed("bye"), classControl},
+		{typed("metrics"), classMetrics},
+		{typed("plugin_metrics"), classMetrics},
+		{typed("tcpping_batch"), classProbes},
+		{typed("proc_status"), classProbes},
+		{typed("pcap_result"), classLogs},
+		{rawFrame{}, classTunnel},
+		{zstdFrame{}, classProbes},
+		{"not a message", classControl},
+	}
+	for _, tt := range tests {
+		if got := classFor(tt.v); got != tt.want {
+			t.Errorf("classFor(%v) = %s, want %s", tt.v, classNames[got], classNames[tt.want])
+		}
+	}
+}
+
+func TestOutboxPriority(t *testing.T) {
+	o := testOutbox(config.Config{})
+	for _, v := range []any{
+		rawFrame{}, typed("pcap_result"), typed("tcpping_batch"), typed("metrics"),
+		typed("ack"), typed("metrics"), typed("hello_reply"),
+	} {
+		if err := o.send(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := drain(o, time.Now())
+	want := []string{"ack", "hello_reply", "metrics", "metrics", "tcpping_batch", "pcap_result", "raw"}
+	if !sameOrder(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestOutboxRateLimit(t *testing.T) {
+	o := testOutbox(config.Config{SendRateLimits: map[string]int{"metrics": 1000}})
+	now := time.Now()
+	_ = o.send(typed("metrics"))
+	_ = o.send(typed("pcap_result")) // logs: 64 KiB/s by default
+	// a 3000-byte metrics message just went out: two seconds in debt
+	o.buckets[classMetrics].wait(1000, now)
+	o.buckets[classMetrics].spend(3000)
+
+	m, ok, _ := o.nextLocked(now)
+	if !ok || msgType(m.v) != "pcap_result" {
+		t.Fatalf("throttled metrics held up logs: got %v %v", m.v, ok)
+	}
+	if _, ok, wait := o.nextLocked(now); ok || wait != 2*time.Second {
+		t.Errorf("got ok %v, wait %v; want a 2s wait", ok, wait)
+	}
+	if n := o.a.sendStats.classes[classMetrics].throttled.Load(); n == 0 {
+		t.Error("throttled not counted")
+	}
+	if _, ok, _ := o.nextLocked(now.Add(2 * time.Second)); !ok {
+		t.Error("metrics still throttled once the bucket refilled")
+	}
+
+	// a negative limit lifts the default one
+	o = testOutbox(config.Config{SendRateLimits: map[string]int{"logs": -1}})
+	if r := o.a.classRate(classLogs); r != 0 {
+		t.Errorf("logs rate %d, want unlimited", r)
+	}
+}
+
+func TestOutboxFlushIgnoresLimits(t *testing.T) {
+	o := testOutbox(config.Config{SendRateLimits: map[string]int{"metrics": 10}})
+	now := time.Now()
+	o.buckets[classMetrics].wait(10, now)
+	o.buckets[classMetrics].spend(1 << 20)
+	_ = o.send(typed("metrics"))
+	if _, ok, _ := o.nextLocked(now); ok {
+		t.Fatal("sent over the limit")
+	}
+	o.flushing = true
+	if _, ok, _ := o.nextLocked(now); !ok {
+		t.Error("limit applied while flushing")
+	}
+}
+
+func TestRateBucket(t *testing.T) {
+	now := time.Now()
+	var b rateBucket
+	if w := b.wait(0, now); w != 0 {
+		t.Errorf("unlimited: %v", w)
+	}
+	if w := b.wait(100, now); w != 0 {
+		t.Errorf("fresh bucket: %v", w)
+	}
+	b.spend(300) // one message larger than the bucket still went out
+	if w := b.wait(100, now); w != 2*time.Second {
+		t.Errorf("in debt: %v, want 2s", w)
+	}
+	if w := b.wait(100, now.Add(2*time.Second)); w != 0 {
+		t.Errorf("after 2s: %v", w)
+	}
+	// idle time refills at most one second's worth
+	b.wait(100, now.Add(time.Hour))
+	if b.tokens != 100 {
+		t.Errorf("tokens %v, want capped at 100", b.tokens)
+	}
+}
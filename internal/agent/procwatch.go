@@ -0,0 +1,147 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/Vincentkeio/agent/internal/procwatch"
+)
+
+// restartTimeout bounds a watch's restart command.
+const restartTimeout = time.Minute
+
+// watches is the pushed watch list if any, else the configured one. Pushed
+// watches get their restart command from the configured watch of the same
+// name; the master can't make the agent run anything else.
+func (a *Agent) watches() []procwatch.Watch {
+	a.rtMu.RLock()
+	pushed := a.rt.Watch
+	a.rtMu.RUnlock()
+	local := a.getCfg().Watch
+	if pushed == nil {
+		return local
+	}
+	out := make([]procwatch.Watch, len(pushed))
+	for i, w := range pushed {
+		w.Restart = nil
+		for _, l := range local {
+			if l.Name == w.Name {
+				w.Restart = l.Restart
+			}
+		}
+		out[i] = w
+	}
+	return out
+}
+
+type restartResult struct {
+	name string
+	err  error
+}
+
+// procwatchLoop checks the watched processes every watch_interval_sec and
+// sends proc_status when something changed, and once per session. It
+// keeps checking (and restarting) while disconnected; nothing is checked
+// while paused, so maintenance doesn't trigger restarts.
+func (a *Agent) procwatchLoop() {
+	var (
+		w     procwatch.Watcher
+		last  []procwatch.Status
+		sent  *outbox
+		next  time.Time
+		dirty bool
+	)
+	done := make(chan restartResult, procwatch.MaxWatches)
+
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for {
+		var now time.Time
+		select {
+		case now = <-tick.C:
+		case r := <-done:
+			w.Restarted(r.name, r.err, time.Now())
+			next = time.Time{} // see whether it came up
+			continue
+		case <-a.stopCh:
+			return
+		}
+
+		sec := a.getCfg().WatchIntervalSec
+		if sec <= 0 || a.isPaused() || !a.capAllowed("procwatch") {
+			continue
+		}
+		if !now.Before(next) {
+			next = now.Add(time.Duration(sec) * time.Second)
+			if ws := a.watches(); len(ws) > 0 || last != nil {
+				var changed bool
+				var due []procwatch.Watch
+				prev := last
+				last, changed, due = w.Check(ws, now)
+				dirty = dirty || changed
+				if changed {
+					logProcChanges(prev, last)
+				}
+				for _, wt := range due {
+					go func(wt procwatch.Watch) {
+						done <- restartResult{wt.Name, runRestart(wt)}
+					}(wt)
+				}
+			}
+		}
+
+		out := a.sessOut.Load()
+		if out == nil || (!dirty && (out == sent || last == nil)) {
+			continue
+		}
+		procs := make([]procwatch.Status, len(last))
+		for i, s := range last {
+			s.Since = a.reportTS(s.Since)
+			procs[i] = s
+		}
+		if out.send(map[string]any{
+			"type":     "proc_status",
+			"agent_id": a.getCfg().AgentID,
+			"ts":       a.reportTS(now.Unix()),
+			"procs":    procs,
+		}) == nil {
+			sent, dirty = out, false
+		}
+	}
+}
+
+// logProcChanges logs watches that went down or started failing.
+func logProcChanges(prev, cur []procwatch.Status) {
+	was := make(map[string]procwatch.Status, len(prev))
+	for _, s := range prev {
+		was[s.Name] = s
+	}
+	for _, s := range cur {
+		p, known := was[s.Name]
+		switch {
+		case s.Err != "" && (!known || p.Err != s.Err):
+			slog.Warn("process check failed", "watch", s.Name, "err", s.Err)
+		case s.Err == "" && !s.Up && (!known || p.Up || p.Err != ""):
+			slog.Warn("watched process is down", "watch", s.Name)
+		case s.Up && known && !p.Up:
+			slog.Info("watched process is up", "watch", s.Name, "pids", s.PIDs)
+		}
+	}
+}
+
+// runRestart runs a watch's restart command.
+func runRestart(w procwatch.Watch) error {
+	ctx, cancel := context.WithTimeout(context.Background(), restartTimeout)
+	defer cancel()
+	slog.Info("restarting watched process", "watch", w.Name, "cmd", w.Restart)
+	out, err := exec.CommandContext(ctx, w.Restart[0], w.Restart[1:]...).CombinedOutput()
+	if err != nil {
+		err = fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+		slog.Error("restart command failed", "watch", w.Name, "err", err)
+	}
+	return err
+}
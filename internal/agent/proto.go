@@ -0,0 +1,28 @@
+package agent
+
+import (
+	"log/slog"
+
+	"github.com/Vincentkeio/agent/pkg/agentproto"
+)
+
+// The agent offers agentproto.Subprotocol in the handshake and
+// agentproto.ProtoVersion as hello.proto_ver. The master's hello_ok
+// proto_ver (or, failing that, the subprotocol it accepted) says which
+// version the session speaks; a master that answers with neither predates
+// versioning and speaks version 1. Only version 1 exists, so for now the
+// result is reported in agent_stats and logged, not acted on.
+
+// selectProto records the protocol version the master picked.
+func (a *Agent) selectProto(m map[string]any, subprotocol string) {
+	v := 1
+	if f, ok := m["proto_ver"].(float64); ok && f > 0 {
+		v = int(f)
+	}
+	if v > agentproto.ProtoVersion {
+		slog.Warn("master asked for a newer protocol; staying on ours", "master", v, "agent", agentproto.ProtoVersion)
+		v = agentproto.ProtoVersion
+	}
+	a.protoVer.Store(int32(v))
+	slog.Debug("protocol negotiated", "proto_ver", v, "subprotocol", subprotocol)
+}
@@ -0,0 +1,64 @@
+package agent
+
+import (
+	"maps"
+	"slices"
+
+	"github.com/Vincentkeio/agent/internal/config"
+)
+
+// needsReconnect reports which changed fields only take effect on a new
+// session: the transport (URL, token, TLS) and what hello announces.
+// Everything else is read live from a.cfg by the loops.
+func needsReconnect(old, cur config.Config) []string {
+	var out []string
+	if old.MasterWSURL != cur.MasterWSURL {
+		out = append(out, "master_ws_url")
+	}
+	if old.Token != cur.Token {
+		out = append(out, "token")
+	}
+	if old.InsecureSkipVerify != cur.InsecureSkipVerify {
+		out = append(out, "insecure_skip_verify")
+	}
+	if old.TLSServerName != cur.TLSServerName {
+		out = append(out, "tls_server_name")
+	}
+	if old.TLSECHConfig != cur.TLSECHConfig {
+		out = append(out, "tls_ech_config")
+	}
+	if !slices.Equal(old.TLSPins, cur.TLSPins) || !slices.Equal(old.TLSPinsGrace.Pins, cur.TLSPinsGrace.Pins) {
+		out = append(out, "tls_pins")
+	}
+	if !maps.Equal(old.MasterHeaders, cur.MasterHeaders) {
+		out = append(out, "master_headers")
+	}
+	if old.AgentID != cur.AgentID {
+		out = append(out, "agent_id")
+	}
+	if old.Alias != cur.Alias {
+		out = append(out, "alias")
+	}
+	if !slices.Equal(old.Tags, cur.Tags) {
+		out = append(out, "tags")
+	}
+	if old.Encoding != cur.Encoding {
+		out = append(out, "encoding")
+	}
+	return out
+}
+
+// needsRestart lists changed fields that are only read at process start.
+func needsRestart(old, cur config.Config) []string {
+	var out []string
+	if old.StateDir != cur.StateDir {
+		out = append(out, "state_dir")
+	}
+	if old.RunAsUser != cur.RunAsUser {
+		out = append(out, "run_as_user")
+	}
+	if old.DebugPprof != cur.DebugPprof || old.DebugPprofAddr != cur.DebugPprofAddr {
+		out = append(out, "debug_pprof")
+	}
+	return out
+}
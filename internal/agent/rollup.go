@@ -0,0 +1,138 @@
+package agent
+
+import (
+	"encoding/json"
+	"math"
+	"strings"
+
+	"github.com/Vincentkeio/agent/pkg/agentproto"
+)
+
+// rollup folds the metrics samples of one window into a metrics_rollup.
+// It is owned by the session's metrics loop.
+type rollup struct {
+	from, to int64 // window [from, to), 0 before the first sample
+	samples  int
+	last     map[string]any     // the latest sample's tree
+	sum      map[string]float64 // by dotted path
+	n        map[string]int
+	frac     map[string]bool // a sample had a fraction: don't round the average
+	max      map[string]float64
+}
+
+// add folds snapshot m, taken at ts, into the window of width sec. When ts
+// falls into a later window, the finished one is returned first, as a
+// metrics_rollup message (agentproto.MetricsRollup) without agent_id and
+// seq.
+func (r *rollup) add(m any, ts int64, sec int) map[string]any {
+	t, err := tree(m)
+	if err != nil {
+		return nil
+	}
+	var done map[string]any
+	if r.samples > 0 && ts >= r.to {
+		done = r.finish()
+	}
+	if r.samples == 0 {
+		r.from = ts - ts%int64(sec)
+		r.to = r.from + int64(sec)
+		r.sum, r.n, r.frac, r.max = map[string]float64{}, map[string]int{}, map[string]bool{}, map[string]float64{}
+	}
+	r.samples++
+	r.last = t
+	r.fold(t, "")
+	return done
+}
+
+func (r *rollup) fold(t map[string]any, prefix string) {
+	for k, v := range t {
+		switch v := v.(type) {
+		case json.Number:
+			f, err := v.Float64()
+			if err != nil {
+				continue
+			}
+			p := prefix + k
+			r.sum[p] += f
+			r.n[p]++
+			if strings.ContainsAny(v.String(), ".eE") {
+				r.frac[p] = true
+			}
+			if prefix == "" && !isCounter(k) {
+				if cur, ok := r.max[p]; !ok || f > cur {
+					r.max[p] = f
+				}
+			}
+		case map[string]any:
+			r.fold(v, prefix+k+".")
+		}
+	}
+}
+
+// finish returns the window's rollup and starts over.
+func (r *rollup) finish() map[string]any {
+	out := map[string]any{
+		"type":    agentproto.TypeMetricsRollup,
+		"ts":      r.to,
+		"from":    r.from,
+		"to":      r.to,
+		"samples": r.samples,
+		"metrics": r.average(r.last, ""),
+		"max":     r.max,
+	}
+	r.samples = 0
+	return out
+}
+
+// average is t with every number replaced by its window average, except
+// counters, which keep the latest value.
+func (r *rollup) average(t map[string]any, prefix string) map[string]any {
+	out := make(map[string]any, len(t))
+	for k, v := range t {
+		p := prefix + k
+		switch v := v.(type) {
+		case json.Number:
+			if isCounter(k) || r.n[p] == 0 {
+				out[k] = v
+				continue
+			}
+			avg := r.sum[p] / float64(r.n[p])
+			if r.frac[p] {
+				out[k] = math.Round(avg*1000) / 1000
+			} else {
+				out[k] = math.Round(avg)
+			}
+		case map[string]any:
+			out[k] = r.average(v, p+".")
+		default:
+			out[k] = v
+		}
+	}
+	return out
+}
+
+func isCounter(key string) bool {
+	return strings.HasSuffix(key, "_total") || key == "uptime_sec" || key == "ts"
+}
+
+// getRollup is the metrics_rollup window (pushed, else configured), 0 when
+// off.
+func (a *Agent) getRollup() int {
+	a.rtMu.RLock()
+	defer a.rtMu.RUnlock()
+	sec := a.rt.RollupSec
+	if sec == 0 {
+		sec = a.cfg.RollupSec
+	}
+	return max(sec, 0)
+}
+
+// sendRollup stamps and queues a finished window.
+func (a *Agent) sendRollup(out *outbox, agentID string, msg map[string]any) {
+	if msg == nil {
+		return
+	}
+	msg["agent_id"] = agentID
+	msg["seq"] = a.nextSeq()
+	_ = out.send(msg)
+}
@@ -0,0 +1,67 @@
+package agent
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Vincentkeio/agent/internal/util"
+)
+
+// rtCacheFile keeps the last applied runtime config (everything config_push
+// and hello_ok have set) in state_dir, so an agent restarted while the master
+// is unreachable goes on probing its assigned targets at the pushed
+// intervals instead of falling back to config.json until it reconnects.
+const rtCacheFile = "runtime_config.json"
+
+// rtCache is the file's content. It only applies to the agent_id and
+// master it was pushed by.
+type rtCache struct {
+	AgentID string        `json:"agent_id"`
+	Master  string        `json:"master"`
+	SavedAt int64         `json:"saved_at"`
+	Config  runtimeConfig `json:"config"`
+}
+
+// saveRuntimeConfig persists a.rt; failures are only logged.
+func (a *Agent) saveRuntimeConfig() {
+	cfg := a.getCfg()
+	a.rtMu.RLock()
+	b, err := json.MarshalIndent(rtCache{
+		AgentID: cfg.AgentID,
+		Master:  cfg.MasterWSURL,
+		SavedAt: time.Now().Unix(),
+		Config:  a.rt,
+	}, "", "  ")
+	a.rtMu.RUnlock()
+	if err == nil {
+		err = util.WriteFileAtomic(filepath.Join(cfg.StateDir, rtCacheFile), b, 0600)
+	}
+	if err != nil {
+		slog.Warn("save runtime config failed", "err", err)
+	}
+}
+
+// loadRuntimeConfig restores the cached runtime config at startup; the
+// first hello_ok / config_push of a session replaces it as usual.
+func (a *Agent) loadRuntimeConfig() {
+	b, err := os.ReadFile(filepath.Join(a.cfg.StateDir, rtCacheFile))
+	if err != nil {
+		return
+	}
+	var c rtCache
+	if err := json.Unmarshal(b, &c); err != nil {
+		slog.Warn("ignoring runtime config cache", "err", err)
+		return
+	}
+	if c.AgentID != a.cfg.AgentID || c.Master != a.cfg.MasterWSURL {
+		slog.Info("ignoring runtime config cache from another agent_id or master")
+		return
+	}
+	a.rt = c.Config
+	slog.Info("restored runtime config from last push",
+		"ver", c.Config.ConfigVersion, "targets", len(c.Config.TCPPingTargets),
+		"age", time.Since(time.Unix(c.SavedAt, 0)).Round(time.Second))
+}
@@ -0,0 +1,58 @@
+package agent
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/Vincentkeio/agent/internal/authlog"
+	"github.com/Vincentkeio/agent/internal/metrics"
+)
+
+// securityLoop follows sshd's log named by ssh_auth_log, restarting the
+// follower when the setting changes on reload. It runs whether or not the
+// master is reachable, so counts cover the time spent disconnected.
+func (a *Agent) securityLoop() {
+	t := time.NewTicker(10 * time.Second)
+	defer t.Stop()
+	var (
+		source string
+		stop   = func() {}
+	)
+	defer func() { stop() }()
+	for {
+		if cur := a.getCfg().SSHAuthLog; cur != source {
+			stop()
+			stop = func() {}
+			source = cur
+			var c *authlog.Counter
+			if source != "" {
+				c = &authlog.Counter{}
+				ctx, cancel := context.WithCancel(context.Background())
+				stop = cancel
+				go authlog.Follow(ctx, source, c)
+				slog.Info("following ssh auth log", "source", source)
+			}
+			a.authMu.Lock()
+			a.auth = c
+			a.authMu.Unlock()
+		}
+		select {
+		case <-t.C:
+		case <-a.stopCh:
+			return
+		}
+	}
+}
+
+// securityInfo is the `security` metrics section (nil while ssh_auth_log
+// is off).
+func (a *Agent) securityInfo() *metrics.Security {
+	a.authMu.Lock()
+	c := a.auth
+	a.authMu.Unlock()
+	if c == nil {
+		return nil
+	}
+	return &metrics.Security{SSH: c.Stats(time.Now())}
+}
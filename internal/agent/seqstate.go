@@ -0,0 +1,75 @@
+package agent
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/Vincentkeio/agent/internal/util"
+)
+
+// seqStateFile keeps the seq counter's high-water mark in state_dir, so
+// seqs keep counting up across restarts and a master can tell a restart
+// from lost messages and drop replayed duplicates. Only the end of a lease
+// of seqLease seqs is written, once per lease: after a crash the counter
+// skips the rest of the lease but never repeats a seq.
+const (
+	seqStateFile = "seq.json"
+	seqLease     = 1000
+)
+
+type seqState struct {
+	AgentID string `json:"agent_id"`
+	// Every seq below Next may have been sent.
+	Next uint64 `json:"next"`
+}
+
+// loadSeq continues the counter where the last run's lease ended. Without
+// a state file for this agent_id, seqs start over at 1 and hello says so
+// (seq_reset).
+func (a *Agent) loadSeq() {
+	a.seqEpoch = util.NewUUIDv4()
+	var st seqState
+	b, err := os.ReadFile(filepath.Join(a.cfg.StateDir, seqStateFile))
+	if err == nil {
+		err = json.Unmarshal(b, &st)
+	}
+	switch {
+	case err != nil && !os.IsNotExist(err):
+		slog.Warn("ignoring seq state", "err", err)
+		a.seqReset = true
+	case err != nil || st.AgentID != a.cfg.AgentID || st.Next == 0:
+		a.seqReset = true
+	default:
+		a.seq.Store(st.Next - 1)
+	}
+	a.seqBase = a.seq.Load() + 1
+	a.extendSeqLease(a.seqBase)
+}
+
+// nextSeq numbers an outgoing message.
+func (a *Agent) nextSeq() uint64 {
+	n := a.seq.Add(1)
+	if n >= a.seqLeaseEnd.Load() {
+		a.extendSeqLease(n)
+	}
+	return n
+}
+
+// extendSeqLease records that seqs up to n+seqLease may be used.
+func (a *Agent) extendSeqLease(n uint64) {
+	a.seqLeaseMu.Lock()
+	defer a.seqLeaseMu.Unlock()
+	if n < a.seqLeaseEnd.Load() {
+		return // another sender got here first
+	}
+	cfg := a.getCfg()
+	end := n + seqLease
+	b, _ := json.Marshal(seqState{AgentID: cfg.AgentID, Next: end})
+	if err := util.WriteFileAtomic(filepath.Join(cfg.StateDir, seqStateFile), b, 0600); err != nil {
+		slog.Warn("save seq state failed", "err", err)
+	}
+	// even unsaved, don't retry on every message
+	a.seqLeaseEnd.Store(end)
+}
@@ -0,0 +1,190 @@
+package agent
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// maxGaps bounds the unreported gap list; the oldest ranges go first.
+	maxGaps = 100
+	// resendDedupWindow: a seq re-sent this recently is not sent again for
+	// a repeated tcpping_resend.
+	resendDedupWindow = 10 * time.Second
+)
+
+// seqGap is a run of consecutive seqs of one type that never reached the
+// socket, reported in agent_stats as `gaps`.
+type seqGap struct {
+	id      uint64
+	From    uint64 `json:"from"`
+	To      uint64 `json:"to"`
+	Type    string `json:"type"`
+	Reason  string `json:"reason"` // queue_full, write_error, disconnect, script
+	FirstTS int64  `json:"first_ts"`
+	LastTS  int64  `json:"last_ts"`
+}
+
+// seqTracker follows every seq-numbered message (metrics, tcpping_batch,
+// agent_stats) from the send queue to the socket, across sessions, so the
+// master is told exactly which seqs are missing instead of guessing from
+// timestamps.
+type seqTracker struct {
+	mu       sync.Mutex
+	pending  map[uint64]bool // queued or held, not yet written
+	sentUpTo uint64          // highest seq written
+	gaps     []seqGap
+	nextID   uint64
+	lostGaps int // ranges pushed out by maxGaps
+	resentAt map[uint64]time.Time
+}
+
+func msgSeq(v any) (uint64, bool) {
+	m, _ := v.(map[string]any)
+	if m["resent"] == true {
+		return 0, false
+	}
+	seq, ok := m["seq"].(uint64)
+	return seq, ok && seq > 0
+}
+
+func (t *seqTracker) queued(v any) {
+	seq, ok := msgSeq(v)
+	if !ok {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.pending == nil {
+		t.pending = map[uint64]bool{}
+	}
+	t.pending[seq] = true
+}
+
+// sent records a successful write of v (a `batch` counts for its items).
+// Writing an agent_stats clears the gaps it reported.
+func (t *seqTracker) sent(v any) {
+	if msgType(v) == "batch" {
+		for _, it := range v.(map[string]any)["items"].([]any) {
+			t.sent(it)
+		}
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if seq, ok := msgSeq(v); ok {
+		delete(t.pending, seq)
+		if seq > t.sentUpTo {
+			t.sentUpTo = seq
+		}
+	}
+	m, _ := v.(map[string]any)
+	if g, ok := m["gaps"].(map[string]any); ok {
+		upTo, _ := g["id"].(uint64)
+		i := 0
+		for i < len(t.gaps) && t.gaps[i].id <= upTo {
+			i++
+		}
+		t.gaps = t.gaps[i:]
+		t.lostGaps = 0
+	}
+}
+
+// dropped records that v will never be written.
+func (t *seqTracker) dropped(v any, reason string) {
+	if msgType(v) == "batch" {
+		for _, it := range v.(map[string]any)["items"].([]any) {
+			t.dropped(it, reason)
+		}
+		return
+	}
+	seq, ok := msgSeq(v)
+	if !ok {
+		return
+	}
+	typ := msgType(v)
+	ts, _ := v.(map[string]any)["ts"].(int64)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.pending, seq)
+	if n := len(t.gaps); n > 0 {
+		g := &t.gaps[n-1]
+		if g.To+1 == seq && g.Type == typ && g.Reason == reason {
+			g.To, g.LastTS = seq, ts
+			return
+		}
+	}
+	t.nextID++
+	t.gaps = append(t.gaps, seqGap{id: t.nextID, From: seq, To: seq, Type: typ, Reason: reason, FirstTS: ts, LastTS: ts})
+	if len(t.gaps) > maxGaps {
+		t.gaps = t.gaps[1:]
+		t.lostGaps++
+	}
+}
+
+// report is the `gaps` object for agent_stats, nil when nothing is
+// missing. "id" marks which ranges it covers; they are cleared once it is
+// written.
+func (t *seqTracker) report() map[string]any {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.gaps) == 0 {
+		return nil
+	}
+	ranges := append([]seqGap(nil), t.gaps...)
+	missing := uint64(0)
+	for _, g := range ranges {
+		missing += g.To - g.From + 1
+	}
+	out := map[string]any{
+		"id":         ranges[len(ranges)-1].id,
+		"ranges":     ranges,
+		"missing":    missing,
+		"sent_up_to": t.sentUpTo,
+	}
+	if t.lostGaps > 0 {
+		out["truncated"] = t.lostGaps
+	}
+	return out
+}
+
+// resendable filters a tcpping_resend request: seqs still waiting in the
+// send queue or re-sent within resendDedupWindow are not sent again.
+func (t *seqTracker) resendable(seqs []uint64) (send, dup []uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	if t.resentAt == nil {
+		t.resentAt = map[uint64]time.Time{}
+	}
+	for s, at := range t.resentAt {
+		if now.Sub(at) > resendDedupWindow {
+			delete(t.resentAt, s)
+		}
+	}
+	seen := map[uint64]bool{}
+	for _, s := range seqs {
+		if t.pending[s] || seen[s] {
+			dup = append(dup, s)
+			continue
+		}
+		if _, ok := t.resentAt[s]; ok {
+			dup = append(dup, s)
+			continue
+		}
+		seen[s] = true
+		send = append(send, s)
+	}
+	return send, dup
+}
+
+// markResent starts the dedup window for seqs actually re-sent.
+func (t *seqTracker) markResent(seqs []uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	for _, s := range seqs {
+		t.resentAt[s] = now
+	}
+}
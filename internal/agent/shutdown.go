@@ -0,0 +1,65 @@
+package agent
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/Vincentkeio/agent/internal/ws"
+)
+
+const defaultShutdownTimeout = 3 * time.Second
+
+// Shutdown stops the agent like Stop and records why; the reason is sent
+// to the master in `bye`.
+func (a *Agent) Shutdown(reason string) {
+	a.stopReason.Store(reason)
+	a.Stop()
+}
+
+// busy marks a metrics sample or tcpping round in progress; goodbye waits
+// for these before closing the connection.
+func (a *Agent) busy() func() {
+	a.inflight.Add(1)
+	return func() { a.inflight.Add(-1) }
+}
+
+// goodbye runs on Stop while connected: it lets the sample or probe round
+// in progress finish (bounded by shutdown_timeout_ms), sends queued events,
+// and whatever is still in the send queue, then a `bye` and a normal close
+// (1000), so the master can tell a clean shutdown from a crash and knows
+// what may be missing.
+func (a *Agent) goodbye(conn *ws.Conn, out *outbox, agentID string) {
+	timeout := defaultShutdownTimeout
+	if ms := a.getCfg().ShutdownTimeoutMS; ms > 0 {
+		timeout = time.Duration(ms) * time.Millisecond
+	}
+	deadline := time.Now().Add(timeout)
+	for a.inflight.Load() > 0 && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	aborted := a.inflight.Load()
+
+	a.flushTCPPingSummary(out, time.Now(), true)
+	a.flushEvents(out, agentID)
+	// drain first: bye is a control message and would overtake metrics
+	drained := out.flush(deadline)
+
+	reason, _ := a.stopReason.Load().(string)
+	if reason == "" {
+		reason = "stop"
+	}
+	batches, samples := a.batches.pending()
+	_ = out.send(map[string]any{
+		"type":            "bye",
+		"agent_id":        agentID,
+		"ts":              a.reportTS(time.Now().Unix()),
+		"reason":          reason,
+		"aborted":         aborted, // rounds cut off by the deadline
+		"pending_batches": batches, // sent but not acked (tcpping_ack)
+		"pending_samples": samples,
+	})
+	drained = out.flush(deadline) && drained
+	_ = conn.SetDeadline(time.Now().Add(time.Second))
+	_ = conn.WriteClose(1000, "shutdown")
+	slog.Info("said goodbye to master", "reason", reason, "aborted", aborted, "pending_samples", samples, "drained", drained)
+}
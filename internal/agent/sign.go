@@ -0,0 +1,75 @@
+package agent
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/Vincentkeio/agent/pkg/agentproto"
+)
+
+// signScheme is the only signing scheme; hello offers it in `sign` when
+// sign_key is set and hello_ok turns it on with "sign": "hmac-sha256".
+const signScheme = "hmac-sha256"
+
+// Once signing is negotiated every encoded message goes out wrapped in an
+// agentproto.SignedFrame:
+//
+//	sig = hex(HMAC-SHA256(sign_key, "<seq>.<ts_ms>.<nonce>." + payload))
+//
+// sign_key is the one the session started with, even after a reload. It
+// is never sent (hello only has sign_key_id), so unlike the token a proxy
+// that reads hello can't sign.
+//
+// payload is the message as encoded by the active encoder (base64 in the
+// frame). seq grows by one per frame for the life of the process and nonce
+// is random, so a master can reject reordered or replayed frames; any change
+// to the payload breaks sig.
+
+// wrapSigned returns the signed JSON frame for an encoded payload.
+func (a *Agent) wrapSigned(enc string, payload []byte) ([]byte, error) {
+	var n [12]byte
+	if _, err := rand.Read(n[:]); err != nil {
+		return nil, err
+	}
+	f := agentproto.SignedFrame{
+		Type:    agentproto.TypeSigned,
+		Enc:     enc,
+		Seq:     a.sigSeq.Add(1),
+		TSMS:    time.Now().UnixMilli(),
+		Nonce:   hex.EncodeToString(n[:]),
+		Payload: base64.StdEncoding.EncodeToString(payload),
+	}
+	key, _ := a.sessSignKey.Load().(string)
+	f.Sig = signPayload(key, f.Seq, f.TSMS, f.Nonce, payload)
+	return json.Marshal(f)
+}
+
+func signPayload(key string, seq uint64, tsMS int64, nonce string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(strconv.FormatUint(seq, 10) + "." + strconv.FormatInt(tsMS, 10) + "." + nonce + "."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// selectSigning enables signing when hello_ok asks for it, or when
+// `sign_messages` is set locally (then a master that doesn't answer with
+// the scheme still gets signed frames). Never without a sign_key.
+func (a *Agent) selectSigning(m map[string]any) {
+	s, _ := m["sign"].(string)
+	key, _ := a.sessSignKey.Load().(string)
+	a.signing.Store(key != "" && (s == signScheme || a.getCfg().SignMessages))
+}
+
+// signOffer is hello's `sign` list; empty without a sign_key.
+func (a *Agent) signOffer() []string {
+	if a.getCfg().SignKey == "" {
+		return nil
+	}
+	return []string{signScheme}
+}
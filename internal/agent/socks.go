@@ -0,0 +1,107 @@
+package agent
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/Vincentkeio/agent/internal/socks5"
+)
+
+// socksHandshakeWait bounds a SOCKS5 client's handshake, dial included.
+const socksHandshakeWait = 30 * time.Second
+
+// cgnat is shared address space (RFC 6598), as private as 10/8 in practice.
+var cgnat = netip.MustParsePrefix("100.64.0.0/10")
+
+// pipeConn is one end of an in-memory connection; each direction closes on
+// its own, so fin can travel both ways through a SOCKS5 stream.
+type pipeConn struct {
+	r *io.PipeReader
+	w *io.PipeWriter
+}
+
+func (p pipeConn) Read(b []byte) (int, error)  { return p.r.Read(b) }
+func (p pipeConn) Write(b []byte) (int, error) { return p.w.Write(b) }
+func (p pipeConn) CloseWrite() error           { return p.w.Close() }
+
+func (p pipeConn) Close() error {
+	p.r.Close()
+	return p.w.Close()
+}
+
+// socksServer runs a SOCKS5 server for stream s of a socks5 tunnel and
+// returns the stream's end of the connection to it.
+func (f *forwarder) socksServer(s *fwdStream) io.ReadWriteCloser {
+	inR, inW := io.Pipe()   // master -> server
+	outR, outW := io.Pipe() // server -> master
+	srv := pipeConn{r: inR, w: outW}
+	go func() {
+		stall := time.AfterFunc(socksHandshakeWait, func() { srv.Close() })
+		dst, addr, err := socks5.Accept(srv, f.a.socksDial)
+		stall.Stop()
+		if err != nil {
+			slog.Debug("socks5 connect failed", "tunnel", s.tunnel, "stream", s.id, "dest", addr, "err", err)
+			srv.Close()
+			return
+		}
+		slog.Debug("socks5 connected", "tunnel", s.tunnel, "stream", s.id, "dest", addr)
+		relayed := make(chan struct{})
+		go func() {
+			select {
+			case <-s.done:
+			case <-relayed:
+			}
+			dst.Close()
+		}()
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = io.Copy(dst, srv)
+			if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+				_ = cw.CloseWrite()
+			}
+		}()
+		_, _ = io.Copy(srv, dst)
+		srv.CloseWrite()
+		wg.Wait()
+		close(relayed)
+		srv.Close()
+	}()
+	return pipeConn{r: outR, w: inW}
+}
+
+// socksDial connects a SOCKS5 client to host:port. Names are resolved
+// here and each address is checked, so a name can't lead to a refused
+// destination.
+func (a *Agent) socksDial(ctx context.Context, host string, port int) (net.Conn, error) {
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	allowPrivate := a.getCfg().SOCKS5Egress.AllowPrivate
+	var d net.Dialer
+	err = socks5.ErrNotAllowed
+	for _, ip := range ips {
+		ip = ip.Unmap()
+		if !allowPrivate && !publicAddr(ip) {
+			continue
+		}
+		var c net.Conn
+		if c, err = d.DialContext(ctx, "tcp", netip.AddrPortFrom(ip, uint16(port)).String()); err == nil {
+			return c, nil
+		}
+	}
+	return nil, err
+}
+
+// publicAddr reports whether ip is a unicast address outside loopback,
+// private, link-local and shared ranges.
+func publicAddr(ip netip.Addr) bool {
+	return ip.IsGlobalUnicast() && !ip.IsPrivate() && !cgnat.Contains(ip)
+}
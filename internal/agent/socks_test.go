@@ -0,0 +1,113 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"strconv"
+	"testing"
+
+	"github.com/Vincentkeio/agent/internal/config"
+	"github.com/Vincentkeio/agent/internal/socks5"
+	"github.com/Vincentkeio/agent/pkg/agentproto"
+)
+
+func TestPublicAddr(t *testing.T) {
+	tests := []struct {
+		ip     string
+		public bool
+	}{
+		{"8.8.8.8", true},
+		{"2001:4860:4860::8888", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"100.64.0.1", false},
+		{"100.127.255.255", false},
+		{"100.128.0.1", true},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"0.0.0.0", false},
+		{"224.0.0.1", false},
+		{"255.255.255.255", false},
+	}
+	for _, tt := range tests {
+		if got := publicAddr(netip.MustParseAddr(tt.ip)); got != tt.public {
+			t.Errorf("publicAddr(%s) = %v, want %v", tt.ip, got, tt.public)
+		}
+	}
+}
+
+func TestSocksDialPrivate(t *testing.T) {
+	target := echoServer(t)
+	host, port, _ := net.SplitHostPort(target)
+	p, _ := strconv.Atoi(port)
+
+	a := &Agent{}
+	for _, h := range []string{host, "localhost", "::ffff:127.0.0.1"} {
+		if _, err := a.socksDial(context.Background(), h, p); !errors.Is(err, socks5.ErrNotAllowed) {
+			t.Errorf("%s: got %v, want ErrNotAllowed", h, err)
+		}
+	}
+
+	a = &Agent{}
+	a.cfg.SOCKS5Egress.AllowPrivate = true
+	c, err := a.socksDial(context.Background(), host, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
+
+func TestSocksTunnel(t *testing.T) {
+	target := echoServer(t)
+	ap := netip.MustParseAddrPort(target)
+	var cfg config.Config
+	cfg.SOCKS5Egress.Enabled = true
+	cfg.SOCKS5Egress.AllowPrivate = true
+	f, o := testForwarder(t, cfg)
+
+	f.handleTunnelOpen(map[string]any{"tunnel_id": "s", "socks5": true})
+	expect(t, o, "tunnel_open_result", result(agentproto.TypeTunnelOpenResult, true))
+	f.handleStreamOpen(map[string]any{"tunnel_id": "s", "stream_id": 7.0})
+	expect(t, o, "stream_open_result", result(agentproto.TypeStreamOpenResult, true))
+
+	// greeting and CONNECT in one frame, as a client may pipeline them
+	ip := ap.Addr().As4()
+	req := []byte{5, 1, 0, 5, 1, 0, 1, ip[0], ip[1], ip[2], ip[3], byte(ap.Port() >> 8), byte(ap.Port())}
+	f.handleFrame(agentproto.StreamFrame(agentproto.StreamData, 7, req))
+	var got []byte
+	for len(got) < 12 {
+		fr := expect(t, o, "socks5 reply", frame(agentproto.StreamData, 7, "")).(rawFrame)
+		_, _, p, _ := agentproto.ParseStreamFrame(fr.b)
+		got = append(got, p...)
+	}
+	if got[0] != 5 || got[1] != 0 || got[2] != 5 || got[3] != 0 {
+		t.Fatalf("reply % x", got)
+	}
+	f.handleFrame(agentproto.StreamFrame(agentproto.StreamData, 7, []byte("through")))
+	expect(t, o, "echoed data", frame(agentproto.StreamData, 7, "through"))
+
+	// a private destination is refused when allow_private is off
+	cfg.AllowRoot = true
+	cfg.SOCKS5Egress.AllowPrivate = false
+	f.a.mu.Lock()
+	f.a.cfg = cfg
+	f.a.mu.Unlock()
+	f.handleStreamOpen(map[string]any{"tunnel_id": "s", "stream_id": 8.0})
+	expect(t, o, "stream_open_result", result(agentproto.TypeStreamOpenResult, true))
+	f.handleFrame(agentproto.StreamFrame(agentproto.StreamData, 8, req))
+	got = nil
+	for len(got) < 4 {
+		fr := expect(t, o, "socks5 reply", frame(agentproto.StreamData, 8, "")).(rawFrame)
+		_, _, p, _ := agentproto.ParseStreamFrame(fr.b)
+		got = append(got, p...)
+	}
+	if got[3] != 2 {
+		t.Errorf("reply % x, want not allowed (2)", got)
+	}
+}
@@ -0,0 +1,40 @@
+package agent
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/Vincentkeio/agent/internal/statecheck"
+)
+
+const stateCheckInterval = time.Hour
+
+// checkState scans state_dir and queues any findings for the master.
+func (a *Agent) checkState() {
+	issues := statecheck.Check(a.getCfg().StateDir)
+	if len(issues) == 0 {
+		return
+	}
+	for _, is := range issues {
+		slog.Warn("state dir integrity", "file", is.File, "action", is.Action, "reason", is.Reason)
+	}
+	a.stateMu.Lock()
+	a.stateIssues = append(a.stateIssues, issues...)
+	a.stateMu.Unlock()
+}
+
+// takeStateIssues returns and clears findings not yet sent to the master.
+func (a *Agent) takeStateIssues() []statecheck.Issue {
+	a.stateMu.Lock()
+	defer a.stateMu.Unlock()
+	out := a.stateIssues
+	a.stateIssues = nil
+	return out
+}
+
+// requeueStateIssues puts back findings whose send failed.
+func (a *Agent) requeueStateIssues(issues []statecheck.Issue) {
+	a.stateMu.Lock()
+	a.stateIssues = append(issues, a.stateIssues...)
+	a.stateMu.Unlock()
+}
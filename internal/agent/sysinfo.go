@@ -0,0 +1,60 @@
+package agent
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"time"
+
+	"github.com/Vincentkeio/agent/internal/platform"
+)
+
+// sysinfoLoop re-reads the host details hello sent in sys every
+// sysinfo_refresh_sec and sends sysinfo_update when one changed, e.g.
+// after a rename, a kernel upgrade or a VM resize.
+func (a *Agent) sysinfoLoop(ctx context.Context, out *outbox, agentID string, sent platform.System) {
+	t := time.NewTicker(10 * time.Second)
+	defer t.Stop()
+	last := time.Now()
+	for {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+		sec := a.getCfg().SysinfoRefreshSec
+		if sec <= 0 || time.Since(last) < time.Duration(sec)*time.Second {
+			continue
+		}
+		last = time.Now()
+		cur := platform.ReadSystem()
+		if cur == sent {
+			continue
+		}
+		prev, now := sent.Fields(), cur.Fields()
+		var changed []string
+		for k, v := range now {
+			if prev[k] != v {
+				changed = append(changed, k)
+			}
+		}
+		for k := range prev {
+			if _, ok := now[k]; !ok {
+				changed = append(changed, k)
+			}
+		}
+		sort.Strings(changed)
+		slog.Info("host details changed", "changed", changed)
+		msg := map[string]any{
+			"type":     "sysinfo_update",
+			"agent_id": agentID,
+			"ts":       a.reportTS(time.Now().Unix()),
+			"sys":      now,
+			"prev":     prev,
+			"changed":  changed,
+		}
+		if out.send(msg) == nil {
+			sent = cur
+		}
+	}
+}
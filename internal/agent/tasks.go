@@ -0,0 +1,109 @@
+package agent
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/Vincentkeio/agent/internal/tasks"
+)
+
+// maxQueuedTaskResults bounds results kept while disconnected.
+const maxQueuedTaskResults = 200
+
+// scheduledTasks is the pushed task list if any, else the configured one.
+func (a *Agent) scheduledTasks() []tasks.Task {
+	a.rtMu.RLock()
+	pushed := a.rt.Tasks
+	a.rtMu.RUnlock()
+	if pushed != nil {
+		return pushed
+	}
+	return a.getCfg().Tasks
+}
+
+// taskLoop starts the tasks due each minute. Tasks run whether or not the
+// master is reachable, but not while paused.
+func (a *Agent) taskLoop() {
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for {
+		var now time.Time
+		select {
+		case now = <-tick.C:
+		case <-a.stopCh:
+			return
+		}
+		due := a.tasks.Due(a.scheduledTasks(), now)
+		if len(due) == 0 || a.isPaused() || !a.capAllowed("scheduled_tasks") {
+			continue
+		}
+		cmds := a.getCfg().TaskCommands
+		for _, t := range due {
+			argv := cmds[t.Command]
+			go func(t tasks.Task) {
+				res := a.tasks.Run(t, argv)
+				lvl := slog.LevelInfo
+				if res.ExitCode != 0 {
+					lvl = slog.LevelWarn
+				}
+				slog.Log(context.Background(), lvl, "task finished", "task", t.ID, "command", t.Command,
+					"exit_code", res.ExitCode, "duration_ms", res.DurationMS, "err", res.Err)
+				a.queueTaskResult(res)
+			}(t)
+		}
+	}
+}
+
+func (a *Agent) queueTaskResult(res tasks.Result) {
+	a.taskMu.Lock()
+	a.taskQueue = append(a.taskQueue, res)
+	if n := len(a.taskQueue); n > maxQueuedTaskResults {
+		a.taskQueue = a.taskQueue[n-maxQueuedTaskResults:]
+	}
+	a.taskMu.Unlock()
+	select {
+	case a.taskKick <- struct{}{}:
+	default:
+	}
+}
+
+// taskSendLoop delivers queued task results as runs finish (and right
+// after connecting).
+func (a *Agent) taskSendLoop(ctx context.Context, out *outbox, agentID string) {
+	for {
+		a.taskMu.Lock()
+		rs := a.taskQueue
+		a.taskQueue = nil
+		a.taskMu.Unlock()
+		for i, r := range rs {
+			msg := map[string]any{
+				"type":        r.Type,
+				"agent_id":    agentID,
+				"ts":          a.reportTS(r.TS), // when it finished, not when sent
+				"task_id":     r.TaskID,
+				"command":     r.Command,
+				"start":       a.reportTS(r.Start),
+				"duration_ms": r.DurationMS,
+				"exit_code":   r.ExitCode,
+			}
+			if r.Output != "" {
+				msg["output"] = r.Output
+			}
+			if r.Err != "" {
+				msg["err"] = r.Err
+			}
+			if out.send(msg) != nil {
+				a.taskMu.Lock()
+				a.taskQueue = append(rs[i:], a.taskQueue...)
+				a.taskMu.Unlock()
+				return
+			}
+		}
+		select {
+		case <-a.taskKick:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
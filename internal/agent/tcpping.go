@@ -0,0 +1,219 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/Vincentkeio/agent/internal/config"
+	"github.com/Vincentkeio/agent/internal/cron"
+	"github.com/Vincentkeio/agent/internal/tcpping"
+)
+
+// tcppingLoop wakes every second and probes the targets that are due.
+// A target is due once its own interval_sec (or the global interval) has
+// elapsed, and only while its optional cron `schedule` window matches.
+// It keeps probing while disconnected: those batches stay in the re-send
+// cache and are reported as gaps once a session is back. With
+// tcpping.aggregate_sec set, rounds are folded into per-target summaries
+// and a tcpping_summary goes out once per window instead.
+func (a *Agent) tcppingLoop() {
+	next := map[string]time.Time{}
+	scheds := map[string]*cron.Schedule{}
+
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for {
+		var now time.Time
+		select {
+		case now = <-tick.C:
+		case <-a.stopCh:
+			return
+		}
+
+		agg := a.getTCPPingAggregate()
+		a.flushTCPPingSummary(a.sessionOutbox(), now, agg == 0)
+		if a.isPaused() || !a.capAllowed("tcpping") {
+			continue
+		}
+		enabled, interval, targets := a.tcppingTargets()
+		if !enabled || interval <= 0 || len(targets) == 0 {
+			continue
+		}
+
+		pressured := a.stretchedFor("cpu_high")
+		var batch []tcpping.Target
+		minIv := 0
+		live := make(map[string]bool, len(targets))
+		for _, tg := range targets {
+			k := targetKey(tg)
+			live[k] = true
+			if n, ok := next[k]; ok && now.Before(n) {
+				continue
+			}
+			iv := tg.IntervalSec
+			if iv <= 0 {
+				iv = interval
+			}
+			if pressured {
+				iv *= cpuPressureProbeFactor
+			}
+			next[k] = now.Add(time.Duration(iv) * time.Second)
+
+			if tg.Schedule != "" {
+				sc, ok := scheds[tg.Schedule]
+				if !ok {
+					var err error
+					if sc, err = cron.Parse(tg.Schedule); err != nil {
+						slog.Warn("tcpping target has bad schedule", "target", k, "err", err)
+					}
+					scheds[tg.Schedule] = sc
+				}
+				if sc == nil || !sc.Match(now) {
+					continue
+				}
+			}
+			batch = append(batch, tg)
+			if minIv == 0 || iv < minIv {
+				minIv = iv
+			}
+		}
+		for k := range next {
+			if !live[k] {
+				delete(next, k)
+			}
+		}
+		if len(batch) == 0 {
+			continue
+		}
+
+		// a round must never overlap the next one
+		done := a.busy()
+		ctx2, cancel2 := context.WithTimeout(context.Background(), time.Duration(minIv)*time.Second)
+		start := time.Now()
+		samples := tcpping.PingAll(ctx2, batch, a.getTCPPingWorkers())
+		cancel2()
+		took := time.Since(start)
+		a.stats.Record("tcpping", took, roundErr(samples))
+		a.observeProbes(samples)
+		if agg > 0 {
+			a.addTCPPingSummary(samples, start, agg)
+			done()
+			continue
+		}
+
+		seq := a.nextSeq()
+		msg := map[string]any{
+			"type":        "tcpping_batch",
+			"agent_id":    a.getCfg().AgentID,
+			"seq":         seq,
+			"ts":          a.reportTS(time.Now().Unix()),
+			"duration_ms": took.Milliseconds(),
+			"samples":     samples,
+		}
+		if pressured {
+			msg["stretched"] = "cpu_high"
+		}
+		a.batches.put(seq, msg)
+		_ = a.sessionOutbox().send(msg)
+		done()
+	}
+}
+
+// addTCPPingSummary folds a round into the current summary window; a new
+// window starts at the multiple of its length the round falls in.
+func (a *Agent) addTCPPingSummary(samples []tcpping.Sample, at time.Time, window time.Duration) {
+	a.summaryMu.Lock()
+	defer a.summaryMu.Unlock()
+	if a.summary == nil {
+		a.summary = tcpping.NewAggregator(a.getCfg().TCPPing.HistogramMS)
+		a.summaryFrom = at.Truncate(window)
+		a.summaryTo = a.summaryFrom.Add(window)
+	}
+	for _, s := range samples {
+		k := targetKey(tcpping.Target{ID: s.ID, Proto: s.Proto, Host: s.Host, Port: s.Port, IPVer: s.IPVer})
+		a.summary.Add(k, s)
+	}
+}
+
+// flushTCPPingSummary sends the summary window once it has ended, or right
+// away with force (aggregation turned off, shutdown) marked "partial" if it
+// hasn't. Like batches, summaries stay in the re-send cache until acked.
+func (a *Agent) flushTCPPingSummary(out *outbox, now time.Time, force bool) {
+	a.summaryMu.Lock()
+	g, from, to := a.summary, a.summaryFrom, a.summaryTo
+	if g == nil || !force && now.Before(to) {
+		a.summaryMu.Unlock()
+		return
+	}
+	a.summary = nil
+	a.summaryMu.Unlock()
+
+	seq := a.nextSeq()
+	msg := map[string]any{
+		"type":      "tcpping_summary",
+		"agent_id":  a.getCfg().AgentID,
+		"seq":       seq,
+		"ts":        a.reportTS(now.Unix()),
+		"from":      a.reportTS(from.Unix()),
+		"to":        a.reportTS(to.Unix()),
+		"hist_ms":   g.Bounds(),
+		"summaries": g.Flush(),
+	}
+	if now.Before(to) {
+		msg["partial"] = true
+	}
+	a.batches.put(seq, msg)
+	_ = out.send(msg)
+}
+
+func targetKey(t tcpping.Target) string {
+	if t.ID != "" {
+		return t.ID
+	}
+	return fmt.Sprintf("%s/%s:%d/%d", t.Proto, t.Host, t.Port, t.IPVer)
+}
+
+// applyProbeSocketOptions pushes tcpping.src_ports / tcpping.fwmark from the
+// local config to the probe dialer (Load already validated the range).
+func applyProbeSocketOptions(cfg config.Config) {
+	lo, hi, _ := tcpping.ParsePortRange(cfg.TCPPing.SrcPorts)
+	tcpping.SetSocketOptions(tcpping.SocketOptions{SrcPortMin: lo, SrcPortMax: hi, Mark: cfg.TCPPing.Fwmark})
+}
+
+// handleTCPPingResend re-sends cached batches the master asks for:
+//
+//	{"type":"tcpping_resend","seqs":[1041,1042]}
+//
+// Each one goes out again as tcpping_batch with "resent": true; seqs that
+// have expired from the cache are listed in a tcpping_resend_result, seqs
+// not re-sent because the original is still queued or they were re-sent
+// moments ago as "duplicate".
+func (a *Agent) handleTCPPingResend(out *outbox, m map[string]any) {
+	seqs, dup := a.seqs.resendable(seqList(m["seqs"]))
+	found, missing := a.batches.get(seqs)
+	resent := make([]uint64, 0, len(found))
+	for _, b := range found {
+		resent = append(resent, b["seq"].(uint64))
+	}
+	a.seqs.markResent(resent)
+	items := make([]map[string]any, 0, len(found))
+	for _, b := range found {
+		c := make(map[string]any, len(b)+1)
+		for k, v := range b {
+			c[k] = v
+		}
+		c["resent"] = true
+		items = append(items, c)
+	}
+	a.sendReplay(out, items)
+	_ = out.send(map[string]any{
+		"type":      "tcpping_resend_result",
+		"agent_id":  a.getCfg().AgentID,
+		"ts":        a.reportTS(time.Now().Unix()),
+		"resent":    len(found),
+		"missing":   missing,
+		"duplicate": dup,
+	})
+}
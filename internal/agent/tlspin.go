@@ -0,0 +1,110 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/Vincentkeio/agent/internal/config"
+	"github.com/Vincentkeio/agent/internal/ws"
+	"github.com/Vincentkeio/agent/pkg/agentproto"
+)
+
+const maxTLSPins = 16
+
+// tlsPins are the pins a dial must match: tls_pins, plus the ones a
+// tls_pin_update replaced while their grace period lasts. Entries are
+// validated by config.Load.
+func tlsPins(cfg config.Config) []ws.Pin {
+	list := cfg.TLSPins
+	if time.Now().Unix() < cfg.TLSPinsGrace.Until {
+		list = append(list[:len(list):len(list)], cfg.TLSPinsGrace.Pins...)
+	}
+	var pins []ws.Pin
+	for _, s := range list {
+		if p, err := ws.ParsePin(s); err == nil {
+			pins = append(pins, p)
+		}
+	}
+	return pins
+}
+
+// handleTLSPinUpdate applies a `tls_pin_update` (agentproto.TLSPinUpdate).
+// Like token_rotate, the pins are written to config.json before they are
+// used, and only the next dial checks them: the running session stays up.
+func (a *Agent) handleTLSPinUpdate(m map[string]any) map[string]any {
+	var u agentproto.TLSPinUpdate
+	if b, err := json.Marshal(m); err == nil {
+		_ = json.Unmarshal(b, &u)
+	}
+	reply := map[string]any{"ok": true, "version": u.Version}
+	until, err := a.updatePins(u)
+	if err != nil {
+		slog.Warn("tls pin update rejected", "version", u.Version, "err", err)
+		reply["ok"] = false
+		reply["err"] = err.Error()
+		return reply
+	}
+	if until > 0 {
+		reply["grace_until"] = until
+	}
+	slog.Info("tls pins updated; checked from the next reconnect", "version", u.Version, "pins", len(u.Pins), "grace_until", until)
+	return reply
+}
+
+// updatePins persists u and returns when the replaced pins expire (0: at
+// once).
+func (a *Agent) updatePins(u agentproto.TLSPinUpdate) (int64, error) {
+	key, _ := a.sessSignKey.Load().(string)
+	if key == "" {
+		return 0, errors.New("no sign_key to check the update with")
+	}
+	if !agentproto.VerifyPinUpdate(key, u) {
+		return 0, errors.New("bad signature")
+	}
+	if len(u.Pins) == 0 || len(u.Pins) > maxTLSPins {
+		return 0, fmt.Errorf("%d pins: want 1 to %d", len(u.Pins), maxTLSPins)
+	}
+	for _, p := range u.Pins {
+		if _, err := ws.ParsePin(p); err != nil {
+			return 0, err
+		}
+	}
+	grace := u.GraceSec
+	switch {
+	case grace == 0:
+		grace = agentproto.DefaultPinGraceSec
+	case grace > agentproto.MaxPinGraceSec:
+		return 0, fmt.Errorf("grace_sec %d: at most %d", grace, agentproto.MaxPinGraceSec)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	switch {
+	case len(a.cfg.TLSPins) == 0:
+		return 0, errors.New("pinning is off: set tls_pins in config.json first")
+	case u.Version <= a.cfg.TLSPinsVersion:
+		return 0, fmt.Errorf("version %d: already at %d", u.Version, a.cfg.TLSPinsVersion)
+	case a.cfgFile == "":
+		return 0, errors.New("no config file to persist the pins to")
+	case config.Overridden("tls_pins"):
+		return 0, errors.New("tls_pins is set by KOKORO_TLS_PINS or -set; update it there")
+	}
+	var old []string
+	var until int64
+	if grace > 0 {
+		old, until = a.cfg.TLSPins, time.Now().Unix()+grace
+	}
+	set := func(c *config.Config) {
+		c.TLSPins = u.Pins
+		c.TLSPinsVersion = u.Version
+		c.TLSPinsGrace.Pins, c.TLSPinsGrace.Until = old, until
+	}
+	if err := config.Update(a.cfgFile, set); err != nil {
+		return 0, err
+	}
+	set(&a.cfg)
+	return until, nil
+}
@@ -0,0 +1,74 @@
+package agent
+
+import (
+	"errors"
+	"log/slog"
+	"strings"
+
+	"github.com/Vincentkeio/agent/internal/config"
+)
+
+const (
+	minTokenLen = 16
+	maxTokenLen = 512
+)
+
+// handleTokenRotate applies a `token_rotate` message:
+//
+//	{"type":"token_rotate","token":"<new>","rotate_id":"r-42"}
+//
+// The new token is written to config.json first and only then swapped in,
+// so a failed write leaves the agent on the old token (and says so in the
+// ack). The running session keeps its token (and signing key); the next
+// hello authenticates with the new one.
+func (a *Agent) handleTokenRotate(m map[string]any) map[string]any {
+	tok, _ := m["token"].(string)
+	reply := map[string]any{"ok": true}
+	if id, ok := m["rotate_id"].(string); ok && id != "" {
+		reply["rotate_id"] = id
+	}
+	if err := a.rotateToken(tok); err != nil {
+		slog.Warn("token rotation rejected", "err", err)
+		reply["ok"] = false
+		reply["err"] = err.Error()
+		return reply
+	}
+	slog.Info("token rotated; used from the next reconnect")
+	return reply
+}
+
+func (a *Agent) rotateToken(tok string) error {
+	if err := validToken(tok); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if tok == a.cfg.Token {
+		return nil
+	}
+	if a.cfgFile == "" {
+		return errors.New("no config file to persist the token to")
+	}
+	if config.Overridden("token") {
+		return errors.New("token is set by KOKORO_TOKEN or -token; update it there")
+	}
+	if err := config.Update(a.cfgFile, func(c *config.Config) { c.Token = tok }); err != nil {
+		return err
+	}
+	a.cfg.Token = tok
+	return nil
+}
+
+func validToken(tok string) error {
+	switch {
+	case tok == "":
+		return errors.New("empty token")
+	case len(tok) < minTokenLen:
+		return errors.New("token too short")
+	case len(tok) > maxTokenLen:
+		return errors.New("token too long")
+	case strings.IndexFunc(tok, func(r rune) bool { return r <= ' ' || r >= 0x7f }) >= 0:
+		return errors.New("token contains whitespace or non-printable characters")
+	}
+	return nil
+}
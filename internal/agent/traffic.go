@@ -0,0 +1,61 @@
+package agent
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/Vincentkeio/agent/internal/metrics"
+	"github.com/Vincentkeio/agent/internal/traffic"
+)
+
+// trafficSampleInterval is how often interface counters are accounted; it
+// runs whether or not the master is reachable.
+const trafficSampleInterval = 30 * time.Second
+
+func (a *Agent) trafficLoop() {
+	t := time.NewTicker(trafficSampleInterval)
+	defer t.Stop()
+	warned := false
+	for {
+		a.sampleTraffic(&warned)
+		select {
+		case <-t.C:
+		case <-a.stopCh:
+			a.sampleTraffic(&warned)
+			return
+		}
+	}
+}
+
+func (a *Agent) sampleTraffic(warned *bool) {
+	iface := a.trafficIface()
+	name, rx, tx, err := metrics.NetCounters(iface)
+	if err != nil {
+		if !*warned {
+			slog.Warn("traffic accounting: cannot read interface counters", "iface", iface, "err", err)
+			*warned = true
+		}
+		return
+	}
+	*warned = false
+	a.traffic.Add(name, rx, tx, time.Now())
+	a.checkTrafficCap()
+}
+
+func (a *Agent) trafficIface() string {
+	cfg := a.getCfg()
+	if cfg.Traffic.Iface != "" {
+		return cfg.Traffic.Iface
+	}
+	return cfg.NetIface
+}
+
+// trafficInfo is this billing month's usage, reported as `traffic` in
+// agent_stats, with the cap state when one is set.
+func (a *Agent) trafficInfo() any {
+	u := a.traffic.Usage(time.Now(), a.getTrafficCap().resetDay)
+	return struct {
+		traffic.Usage
+		Cap map[string]any `json:"cap,omitempty"`
+	}{u, a.capInfo(u)}
+}
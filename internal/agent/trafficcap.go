@@ -0,0 +1,153 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/Vincentkeio/agent/internal/traffic"
+)
+
+const capScriptTimeout = time.Minute
+
+// defaultCapActions apply when a cap is set without actions.
+var defaultCapActions = []traffic.Action{{AtPct: 80, Do: "warn"}, {AtPct: 100, Do: "warn"}}
+
+// trafficCap is the pushed cap if any, else the configured one (capBytes
+// 0 = no cap).
+type trafficCap struct {
+	capBytes uint64
+	count    string
+	resetDay int
+	actions  []traffic.Action
+	pushed   bool
+}
+
+func (a *Agent) getTrafficCap() trafficCap {
+	cfg := a.getCfg().Traffic
+	c := trafficCap{capBytes: uint64(cfg.CapGB * 1e9), count: cfg.CapCount, resetDay: cfg.ResetDay, actions: cfg.Actions}
+	a.rtMu.RLock()
+	if p := a.rt.Traffic; p != nil {
+		c = trafficCap{capBytes: uint64(p.CapGB * 1e9), count: p.CapCount, resetDay: p.ResetDay, actions: p.Actions, pushed: true}
+		if c.resetDay == 0 {
+			c.resetDay = cfg.ResetDay
+		}
+	}
+	a.rtMu.RUnlock()
+	if len(c.actions) == 0 {
+		c.actions = defaultCapActions
+	}
+	return c
+}
+
+// checkTrafficCap runs after every traffic sample, so it keeps enforcing
+// the cap while the master is unreachable. Each action is taken once per
+// billing month (remembered across restarts); throttle stays in effect
+// until the month rolls over or the cap is raised.
+func (a *Agent) checkTrafficCap() {
+	c := a.getTrafficCap()
+	if c.capBytes == 0 {
+		return
+	}
+	u := a.traffic.Usage(time.Now(), c.resetDay)
+	used := u.Counted(c.count)
+	pct := float64(used) * 100 / float64(c.capBytes)
+	for _, act := range c.actions {
+		if pct < act.AtPct {
+			continue
+		}
+		if act.Do == "throttle" {
+			// renewed every sample; lapses shortly after we're back under
+			a.stretch("traffic_cap", 2*trafficSampleInterval)
+		}
+		if !a.traffic.MarkFired(u.Start, act.Key()) {
+			continue
+		}
+		slog.Warn("monthly traffic cap threshold reached",
+			"used_gb", fmt.Sprintf("%.2f", float64(used)/1e9), "cap_gb", float64(c.capBytes)/1e9,
+			"pct", fmt.Sprintf("%.1f", pct), "at_pct", act.AtPct, "action", act.Do)
+		if act.Do == "script" {
+			if argv := a.capScript(act, c.pushed); argv != nil {
+				go runCapScript(argv, act, u, c, pct)
+			}
+		}
+	}
+}
+
+// checkPushedActions validates the actions of a pushed cap against the
+// local traffic.scripts.
+func checkPushedActions(acts []traffic.Action, scripts map[string][]string) error {
+	for i, act := range acts {
+		if err := act.CheckPushed(scripts); err != nil {
+			return fmt.Errorf("actions[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// capScript is the command a script action runs, or nil. Pushed actions
+// (also ones restored from the runtime cache) only get a configured
+// traffic.scripts entry, and not while running as root without
+// allow_root, like the other commands the master can start.
+func (a *Agent) capScript(act traffic.Action, pushed bool) []string {
+	cfg := a.getCfg()
+	if !pushed && len(act.Command) > 0 {
+		return act.Command
+	}
+	if pushed && os.Geteuid() == 0 && !cfg.AllowRoot {
+		slog.Warn("not running pushed traffic cap script as root: set run_as_user, or allow_root", "script", act.Script)
+		return nil
+	}
+	argv := cfg.Traffic.Scripts[act.Script]
+	if act.Script == "" || len(argv) == 0 || argv[0] == "" {
+		slog.Warn("traffic cap script not configured in traffic.scripts", "script", act.Script)
+		return nil
+	}
+	return argv
+}
+
+// runCapScript runs argv with the usage as JSON on stdin and in
+// KOKORO_TRAFFIC_* variables.
+func runCapScript(argv []string, act traffic.Action, u traffic.Usage, c trafficCap, pct float64) {
+	ctx, cancel := context.WithTimeout(context.Background(), capScriptTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("KOKORO_TRAFFIC_USED_BYTES=%d", u.Counted(c.count)),
+		fmt.Sprintf("KOKORO_TRAFFIC_CAP_BYTES=%d", c.capBytes),
+		fmt.Sprintf("KOKORO_TRAFFIC_PCT=%.1f", pct),
+		fmt.Sprintf("KOKORO_TRAFFIC_AT_PCT=%g", act.AtPct),
+		"KOKORO_TRAFFIC_PERIOD_START="+u.Start,
+	)
+	in, _ := json.Marshal(u)
+	cmd.Stdin = bytes.NewReader(in)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		slog.Error("traffic cap script failed", "cmd", argv, "err", err, "output", string(out))
+		return
+	}
+	slog.Info("traffic cap script ran", "cmd", argv, "output", string(out))
+}
+
+// capInfo is added to agent_stats `traffic` while a cap is set.
+func (a *Agent) capInfo(u traffic.Usage) map[string]any {
+	c := a.getTrafficCap()
+	if c.capBytes == 0 {
+		return nil
+	}
+	count := c.count
+	if count == "" {
+		count = "total"
+	}
+	return map[string]any{
+		"cap_bytes": c.capBytes,
+		"cap_count": count,
+		"used_pct":  float64(u.Counted(c.count)) * 100 / float64(c.capBytes),
+		"throttled": a.stretchedFor("traffic_cap"),
+	}
+}
@@ -0,0 +1,144 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/Vincentkeio/agent/internal/lua"
+)
+
+// transformable are the messages a transform script may rewrite or drop:
+// periodic data the next message supersedes. Replies, events and tcpping
+// batches (acked and re-sent by seq) are never handed to it.
+var transformable = map[string]bool{
+	"metrics":         true,
+	"plugin_metrics":  true,
+	"tunnel_status":   true,
+	"ports":           true,
+	"proc_status":     true,
+	"netprobe_update": true,
+	"path_change":     true,
+}
+
+// transformKept are the fields a script can't change: the outbox and the
+// seq tracking rely on them.
+var transformKept = []string{"type", "agent_id", "seq", "ts"}
+
+// transformMsg runs the transform script on v when one is configured for
+// its type, and returns the message to send, or false when the script
+// dropped it. Without a usable script, or when the script fails, v goes
+// out as it is.
+func (a *Agent) transformMsg(v any) (any, bool) {
+	msg, ok := v.(map[string]any)
+	if !ok {
+		return v, true
+	}
+	t := a.getCfg().Transform
+	typ := msgType(msg)
+	if t.Script == "" || !transformable[typ] || !slices.Contains(t.Types, typ) {
+		return v, true
+	}
+
+	a.scriptMu.Lock()
+	defer a.scriptMu.Unlock()
+	st := a.loadScript(t.Script)
+	if st == nil {
+		return v, true
+	}
+	start := time.Now()
+	out, keep, err := runTransform(st, msg)
+	a.stats.Record("transform", time.Since(start), err)
+	if err != nil {
+		// at most one warning a minute; the counters have the rest
+		if time.Since(a.scriptWarned) > time.Minute {
+			a.scriptWarned = time.Now()
+			slog.Warn("transform script failed, message sent as is", "type", typ, "err", err)
+		}
+		return v, true
+	}
+	return out, keep
+}
+
+// loadScript returns the script at path, (re)loading it when the path or
+// the file changed; nil when it can't be loaded. Callers hold scriptMu.
+func (a *Agent) loadScript(path string) *lua.State {
+	key := path
+	fi, err := os.Stat(path)
+	if err == nil {
+		key = fmt.Sprintf("%s %d %d", path, fi.Size(), fi.ModTime().UnixNano())
+	}
+	if key == a.scriptKey {
+		return a.script
+	}
+	a.scriptKey, a.script = key, nil
+	var src []byte
+	if err == nil {
+		src, err = os.ReadFile(path)
+	}
+	var st *lua.State
+	if err == nil {
+		st, err = lua.Load(filepath.Base(path), string(src))
+	}
+	if err == nil && !st.HasFunction("transform") {
+		err = errors.New("defines no function transform(msg)")
+	}
+	if err != nil {
+		slog.Error("transform script not loaded, messages go out untransformed", "script", path, "err", err)
+		return nil
+	}
+	slog.Info("transform script loaded", "script", path)
+	a.script = st
+	return st
+}
+
+// runTransform calls transform(msg) on a copy of msg as Lua tables. The
+// script changes the table in place or returns a new one; false drops the
+// message.
+func runTransform(st *lua.State, msg map[string]any) (map[string]any, bool, error) {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return nil, false, err
+	}
+	t, err := lua.DecodeJSON(b)
+	if err != nil {
+		return nil, false, err
+	}
+	rs, err := st.Call("transform", t)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(rs) > 0 {
+		switch r := rs[0].(type) {
+		case nil, bool:
+			if r == false {
+				return nil, false, nil
+			}
+		case *lua.Table:
+			t = r
+		default:
+			return nil, false, fmt.Errorf("transform returned a %s, want a table, false or nothing", lua.TypeName(r))
+		}
+	}
+	v, err := lua.ToJSON(t)
+	if err != nil {
+		return nil, false, err
+	}
+	out, ok := v.(map[string]any)
+	if !ok {
+		return nil, false, errors.New("transform made the message an array")
+	}
+	for _, k := range transformKept {
+		if x, ok := msg[k]; ok {
+			out[k] = x
+		} else {
+			delete(out, k)
+		}
+	}
+	return out, true, nil
+}
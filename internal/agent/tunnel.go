@@ -0,0 +1,70 @@
+package agent
+
+import (
+	"context"
+	"time"
+
+	"github.com/Vincentkeio/agent/internal/tunnel"
+)
+
+// tunnelLoop sends tunnel_status every tunnel_interval_sec while the host
+// has tunnel interfaces (and once more when the last one goes away).
+func (a *Agent) tunnelLoop(ctx context.Context, out *outbox, agentID string) {
+	t := time.NewTicker(5 * time.Second)
+	defer t.Stop()
+	var (
+		next   time.Time
+		prev   = map[string]tunnel.Tunnel{}
+		prevAt time.Time
+		sent   bool
+	)
+	for {
+		var now time.Time
+		select {
+		case now = <-t.C:
+		case <-ctx.Done():
+			return
+		case <-a.stopCh:
+			return
+		}
+
+		sec := a.getCfg().TunnelIntervalSec
+		if sec <= 0 || a.isPaused() || !a.capAllowed("tunnels") || now.Before(next) {
+			continue
+		}
+		next = now.Add(time.Duration(sec) * time.Second)
+
+		start := time.Now()
+		tuns, err := tunnel.Collect(now)
+		a.stats.Record("tunnels", time.Since(start), err)
+		if err != nil || (len(tuns) == 0 && !sent) {
+			continue
+		}
+		cur := make(map[string]tunnel.Tunnel, len(tuns))
+		for i := range tuns {
+			if p, ok := prev[tuns[i].Name]; ok {
+				dt := now.Sub(prevAt).Seconds()
+				tuns[i].RxBPS = rate(p.RxBytes, tuns[i].RxBytes, dt)
+				tuns[i].TxBPS = rate(p.TxBytes, tuns[i].TxBytes, dt)
+			}
+			cur[tuns[i].Name] = tuns[i]
+		}
+		prev, prevAt = cur, now
+
+		_ = out.send(map[string]any{
+			"type":     "tunnel_status",
+			"agent_id": agentID,
+			"ts":       a.reportTS(now.Unix()),
+			"tunnels":  tuns,
+		})
+		sent = len(tuns) > 0
+	}
+}
+
+// rate is bytes/s between two counter readings (0 after a reset).
+func rate(prev, cur uint64, dt float64) uint64 {
+	if cur < prev || dt <= 0 {
+		return 0
+	}
+	return uint64(float64(cur-prev) / dt)
+}
@@ -0,0 +1,71 @@
+package agent
+
+import (
+	"crypto/sha256"
+	"log/slog"
+	"os"
+	"time"
+)
+
+const defaultConfigWatch = 2 * time.Second
+
+// configWatchLoop reloads config.json when it changes on disk, so edits
+// apply without SIGHUP. The file is polled (no inotify dependency); a
+// change is only acted on once size and mtime have been stable for one
+// more poll, so an editor's half-written file is never loaded. Invalid
+// files are rejected by ReloadConfig and the running config stays.
+func (a *Agent) configWatchLoop() {
+	type stamp struct {
+		size  int64
+		mtime time.Time
+	}
+	read := func() (stamp, [32]byte, bool) {
+		st, err := os.Stat(a.cfgFile)
+		if err != nil {
+			return stamp{}, [32]byte{}, false
+		}
+		b, err := os.ReadFile(a.cfgFile)
+		if err != nil {
+			return stamp{}, [32]byte{}, false
+		}
+		return stamp{st.Size(), st.ModTime()}, sha256.Sum256(b), true
+	}
+
+	last, applied, _ := read()
+	pending := false
+	for {
+		every := defaultConfigWatch
+		if s := a.getCfg().ConfigWatchSec; s > 0 {
+			every = time.Duration(s) * time.Second
+		}
+		select {
+		case <-time.After(every):
+		case <-a.stopCh:
+			return
+		}
+		if a.getCfg().ConfigWatchSec < 0 {
+			continue
+		}
+		cur, sum, ok := read()
+		if !ok {
+			continue
+		}
+		if cur != last {
+			// changed since the last poll: wait until it settles
+			last, pending = cur, true
+			continue
+		}
+		if !pending {
+			continue
+		}
+		pending = false
+		if sum == applied {
+			continue // touched, or rewritten with the same content
+		}
+		applied = sum
+		slog.Info("config file changed: reloading", "path", a.cfgFile)
+		if err := a.ReloadConfig(); err != nil {
+			slog.Error("reload config failed; keeping the running config", "err", err)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package agent
+
+import (
+	"github.com/Vincentkeio/agent/internal/alerts"
+	"github.com/Vincentkeio/agent/internal/netprobe"
+	"github.com/Vincentkeio/agent/internal/procwatch"
+	"github.com/Vincentkeio/agent/internal/tasks"
+	"github.com/Vincentkeio/agent/internal/tcpping"
+	"github.com/Vincentkeio/agent/internal/traffic"
+	"github.com/Vincentkeio/agent/pkg/agentproto"
+)
+
+// Conversions from the agentproto wire types of a pushed config to the
+// internal ones. The internal types can grow fields the protocol doesn't
+// have (or shouldn't take from a master); only what is listed here is
+// taken from a push. A nil list stays nil: for the runtime config that
+// means "use config.json".
+
+// pushedTraffic is a pushed traffic cap (runtimeConfig.Traffic).
+type pushedTraffic struct {
+	ResetDay int              `json:"reset_day,omitempty"`
+	CapGB    float64          `json:"cap_gb"`
+	CapCount string           `json:"cap_count,omitempty"`
+	Actions  []traffic.Action `json:"actions,omitempty"`
+}
+
+func trafficFromWire(t agentproto.Traffic) *pushedTraffic {
+	p := &pushedTraffic{ResetDay: t.ResetDay, CapGB: t.CapGB, CapCount: t.CapCount}
+	for _, act := range t.Actions {
+		p.Actions = append(p.Actions, traffic.Action{AtPct: act.AtPct, Do: act.Do, Command: act.Command, Script: act.Script})
+	}
+	return p
+}
+
+func targetsFromWire(ts []agentproto.Target) []tcpping.Target {
+	if ts == nil {
+		return nil
+	}
+	out := make([]tcpping.Target, len(ts))
+	for i, t := range ts {
+		out[i] = tcpping.Target{
+			ID: t.ID, Province: t.Province, Carrier: t.Carrier, IPVer: t.IPVer,
+			Host: t.Host, Port: t.Port, Label: t.Label, TimeoutMS: t.TimeoutMS,
+			Proto: t.Proto, Payload: t.Payload, ALPN: t.ALPN, Count: t.Count,
+			ResolveMode: t.ResolveMode, IP: t.IP,
+			TLS: t.TLS, TLSSkipVerify: t.TLSSkipVerify, SNI: t.SNI,
+			IntervalSec: t.IntervalSec, Schedule: t.Schedule,
+		}
+	}
+	return out
+}
+
+func ipEchoFromWire(e agentproto.IPEcho) *netprobe.Endpoints {
+	conv := func(eps []agentproto.EchoEndpoint) []netprobe.Endpoint {
+		var out []netprobe.Endpoint
+		for _, ep := range eps {
+			out = append(out, netprobe.Endpoint{URL: ep.URL, Format: ep.Format})
+		}
+		return out
+	}
+	return &netprobe.Endpoints{IPv4: conv(e.IPv4), IPv6: conv(e.IPv6)}
+}
+
+func rulesFromWire(rs []agentproto.AlertRule) []alerts.Rule {
+	if rs == nil {
+		return nil
+	}
+	out := make([]alerts.Rule, len(rs))
+	for i, r := range rs {
+		out[i] = alerts.Rule{
+			ID: r.ID, Severity: r.Severity,
+			Metric: r.Metric, Op: r.Op, Value: r.Value, ForSec: r.ForSec,
+			Target: r.Target, DownRounds: r.DownRounds,
+		}
+	}
+	return out
+}
+
+// watchesFromWire drops pushed restart commands: the agent only runs the
+// one configured locally for the name.
+func watchesFromWire(ws []agentproto.Watch) []procwatch.Watch {
+	if ws == nil {
+		return nil
+	}
+	out := make([]procwatch.Watch, len(ws))
+	for i, w := range ws {
+		out[i] = procwatch.Watch{Name: w.Name, Process: w.Process, Pidfile: w.Pidfile, RestartAfter: w.RestartAfter}
+	}
+	return out
+}
+
+func tasksFromWire(ts []agentproto.Task) []tasks.Task {
+	if ts == nil {
+		return nil
+	}
+	out := make([]tasks.Task, len(ts))
+	for i, t := range ts {
+		out[i] = tasks.Task{ID: t.ID, Schedule: t.Schedule, Command: t.Command, TimeoutSec: t.TimeoutSec}
+	}
+	return out
+}
@@ -0,0 +1,102 @@
+package agent
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/Vincentkeio/agent/internal/ws"
+)
+
+// Number of ping round trips the rolling ws_rtt_ms average covers.
+const wsRTTWindow = 10
+
+// pingPayload stamps a control ping with its send time so the pong can be
+// matched back to it.
+func pingPayload() []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(time.Now().UnixNano()))
+}
+
+// notePong records the round trip of one of our pings. Pongs with foreign or
+// unsolicited payloads are ignored.
+func (a *Agent) notePong(payload []byte) {
+	if len(payload) != 8 {
+		return
+	}
+	sent := time.Unix(0, int64(binary.BigEndian.Uint64(payload)))
+	rtt := time.Since(sent)
+	if rtt < 0 || rtt > time.Minute {
+		return
+	}
+
+	a.lastPong.Store(time.Now().UnixNano())
+	a.rttMu.Lock()
+	defer a.rttMu.Unlock()
+	a.rtts = append(a.rtts, rtt)
+	if len(a.rtts) > wsRTTWindow {
+		a.rtts = a.rtts[len(a.rtts)-wsRTTWindow:]
+	}
+}
+
+// wsRTT is the average control-plane RTT over the last pings (false if none).
+func (a *Agent) wsRTT() (float64, bool) {
+	a.rttMu.Lock()
+	defer a.rttMu.Unlock()
+	if len(a.rtts) == 0 {
+		return 0, false
+	}
+	var sum time.Duration
+	for _, d := range a.rtts {
+		sum += d
+	}
+	avg := float64(sum) / float64(len(a.rtts)) / float64(time.Millisecond)
+	return float64(int64(avg*100+0.5)) / 100, true
+}
+
+// resetWSRTT drops samples from a previous connection.
+func (a *Agent) resetWSRTT() {
+	a.rttMu.Lock()
+	a.rtts = nil
+	a.rttMu.Unlock()
+	a.lastPong.Store(time.Now().UnixNano())
+}
+
+// keepalive pings the master every ping_interval_sec and ends the session
+// (through recvErr) once the master has sent nothing at all, or left our
+// pings unanswered, for liveness_timeout_sec: a dead path is noticed well
+// before the 90s read deadline.
+func (a *Agent) keepalive(ctx context.Context, conn *ws.Conn, recvErr chan<- error) {
+	cfg := a.getCfg()
+	ping := time.NewTicker(time.Duration(cfg.PingIntervalSec) * time.Second)
+	defer ping.Stop()
+	check := time.NewTicker(time.Second)
+	defer check.Stop()
+	timeout := time.Duration(cfg.LivenessTimeoutSec) * time.Second
+	for {
+		select {
+		case <-ping.C:
+			_ = conn.WritePing(pingPayload())
+			continue
+		case <-check.C:
+		case <-ctx.Done():
+			return
+		}
+		if timeout <= 0 {
+			continue
+		}
+		var err error
+		if silent := time.Since(conn.LastRead()); silent > timeout {
+			err = fmt.Errorf("master silent for %s", silent.Round(time.Second))
+		} else if nopong := time.Since(time.Unix(0, a.lastPong.Load())); nopong > timeout {
+			err = fmt.Errorf("no pong for %s", nopong.Round(time.Second))
+		}
+		if err != nil {
+			select {
+			case recvErr <- err:
+			default:
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,298 @@
+// Package alerts evaluates threshold rules on the agent itself, so alerts
+// fire and resolve on time even while the link to the master is down.
+package alerts
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rule is either a metric rule (Metric Op Value, held for ForSec) or a
+// target rule (tcpping Target failing DownRounds rounds in a row):
+//
+//	{"id":"cpu","metric":"cpu","op":">","value":90,"for_sec":300}
+//	{"id":"disk","metric":"disk","op":">","value":95}
+//	{"id":"dns","target":"preset:public-dns:cf-v4","down_rounds":3}
+//
+// Metric is a dotted path into the metrics snapshot ("psi.io.some.avg10").
+type Rule struct {
+	ID       string `json:"id"`
+	Severity string `json:"severity,omitempty"`
+
+	Metric string  `json:"metric,omitempty"`
+	Op     string  `json:"op,omitempty"` // > >= < <= == != (default >)
+	Value  float64 `json:"value,omitempty"`
+	ForSec int     `json:"for_sec,omitempty"`
+
+	Target     string `json:"target,omitempty"`      // tcpping target id, or host:port
+	DownRounds int    `json:"down_rounds,omitempty"` // default 3
+}
+
+// Check validates a single rule.
+func (r Rule) Check() error {
+	if r.ID == "" {
+		return errors.New("rule needs an id")
+	}
+	switch {
+	case r.Metric != "" && r.Target != "":
+		return fmt.Errorf("rule %s: metric and target are exclusive", r.ID)
+	case r.Metric != "":
+		switch r.Op {
+		case "", ">", ">=", "<", "<=", "==", "!=":
+		default:
+			return fmt.Errorf("rule %s: op %q: want > >= < <= == !=", r.ID, r.Op)
+		}
+		if r.ForSec < 0 {
+			return fmt.Errorf("rule %s: for_sec %d: want >= 0", r.ID, r.ForSec)
+		}
+	case r.Target != "":
+		if r.DownRounds < 0 {
+			return fmt.Errorf("rule %s: down_rounds %d: want >= 1", r.ID, r.DownRounds)
+		}
+	default:
+		return fmt.Errorf("rule %s: needs a metric or a target", r.ID)
+	}
+	return nil
+}
+
+// Event is an alert_fire or alert_resolve.
+type Event struct {
+	Type     string  `json:"type"` // alert_fire, alert_resolve
+	RuleID   string  `json:"rule_id"`
+	Severity string  `json:"severity,omitempty"`
+	Metric   string  `json:"metric,omitempty"`
+	Target   string  `json:"target,omitempty"`
+	Value    float64 `json:"value"`               // metric value, or failed rounds
+	Limit    float64 `json:"threshold,omitempty"` // metric rules
+	Since    int64   `json:"since"`               // first breach, unix seconds
+	TS       int64   `json:"ts"`                  // when it fired/resolved
+	Reason   string  `json:"reason,omitempty"`    // resolve: "rule_removed"
+}
+
+type state struct {
+	since  time.Time
+	firing bool
+	down   int
+	value  float64
+}
+
+// Engine holds the rules and their state; it is safe for concurrent use.
+type Engine struct {
+	mu    sync.Mutex
+	rules []Rule
+	st    map[string]*state
+}
+
+func New() *Engine {
+	return &Engine{st: map[string]*state{}}
+}
+
+// SetRules replaces the rule set. Rules that keep their id keep their
+// state; firing alerts of removed rules are resolved.
+func (e *Engine) SetRules(rules []Rule, now time.Time) []Event {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	keep := map[string]bool{}
+	for _, r := range rules {
+		keep[r.ID] = true
+	}
+	var out []Event
+	for _, r := range e.rules {
+		if keep[r.ID] {
+			continue
+		}
+		if s := e.st[r.ID]; s != nil && s.firing {
+			ev := e.event("alert_resolve", r, s, now)
+			ev.Reason = "rule_removed"
+			out = append(out, ev)
+		}
+		delete(e.st, r.ID)
+	}
+	e.rules = append([]Rule(nil), rules...)
+	return out
+}
+
+// Rules returns the current rule set.
+func (e *Engine) Rules() []Rule {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]Rule(nil), e.rules...)
+}
+
+// HasMetricRules reports whether any rule needs metrics snapshots.
+func (e *Engine) HasMetricRules() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, r := range e.rules {
+		if r.Metric != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// ObserveMetrics evaluates metric rules against a snapshot (any value
+// that marshals to a JSON object).
+func (e *Engine) ObserveMetrics(snap any, now time.Time) []Event {
+	b, err := json.Marshal(snap)
+	if err != nil {
+		return nil
+	}
+	var m map[string]any
+	if json.Unmarshal(b, &m) != nil {
+		return nil
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var out []Event
+	for _, r := range e.rules {
+		if r.Metric == "" {
+			continue
+		}
+		v, ok := lookup(m, r.Metric)
+		if !ok {
+			continue
+		}
+		s := e.stateLocked(r.ID)
+		s.value = v
+		if !breached(r.Op, v, r.Value) {
+			s.since = time.Time{}
+			if s.firing {
+				s.firing = false
+				out = append(out, e.event("alert_resolve", r, s, now))
+			}
+			continue
+		}
+		if s.since.IsZero() {
+			s.since = now
+		}
+		if !s.firing && now.Sub(s.since) >= time.Duration(r.ForSec)*time.Second {
+			s.firing = true
+			out = append(out, e.event("alert_fire", r, s, now))
+		}
+	}
+	return out
+}
+
+// ObserveTarget evaluates target rules for one probe result; id is the
+// target id and addr its host:port.
+func (e *Engine) ObserveTarget(id, addr string, ok bool, now time.Time) []Event {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var out []Event
+	for _, r := range e.rules {
+		if r.Target == "" || (r.Target != id && r.Target != addr) {
+			continue
+		}
+		s := e.stateLocked(r.ID)
+		if ok {
+			s.down, s.since = 0, time.Time{}
+			if s.firing {
+				s.firing = false
+				out = append(out, e.event("alert_resolve", r, s, now))
+			}
+			continue
+		}
+		s.down++
+		s.value = float64(s.down)
+		if s.since.IsZero() {
+			s.since = now
+		}
+		need := r.DownRounds
+		if need <= 0 {
+			need = 3
+		}
+		if !s.firing && s.down >= need {
+			s.firing = true
+			out = append(out, e.event("alert_fire", r, s, now))
+		}
+	}
+	return out
+}
+
+// Firing lists the ids of the rules currently firing.
+func (e *Engine) Firing() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	out := []string{}
+	for id, s := range e.st {
+		if s.firing {
+			out = append(out, id)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+func (e *Engine) stateLocked(id string) *state {
+	s := e.st[id]
+	if s == nil {
+		s = &state{}
+		e.st[id] = s
+	}
+	return s
+}
+
+func (e *Engine) event(typ string, r Rule, s *state, now time.Time) Event {
+	ev := Event{Type: typ, RuleID: r.ID, Severity: r.Severity, Metric: r.Metric, Target: r.Target,
+		Value: s.value, Since: s.since.Unix(), TS: now.Unix()}
+	if s.since.IsZero() {
+		ev.Since = now.Unix()
+	}
+	if r.Metric != "" {
+		ev.Limit = r.Value
+	}
+	return ev
+}
+
+func breached(op string, v, limit float64) bool {
+	switch op {
+	case ">=":
+		return v >= limit
+	case "<":
+		return v < limit
+	case "<=":
+		return v <= limit
+	case "==":
+		return v == limit
+	case "!=":
+		return v != limit
+	}
+	return v > limit
+}
+
+// lookup resolves a dotted path; array elements are addressed by index
+// ("frag.zones.2.unusable_pct").
+func lookup(m map[string]any, path string) (float64, bool) {
+	var cur any = m
+	for _, k := range strings.Split(path, ".") {
+		switch c := cur.(type) {
+		case map[string]any:
+			cur = c[k]
+		case []any:
+			i, err := strconv.Atoi(k)
+			if err != nil || i < 0 || i >= len(c) {
+				return 0, false
+			}
+			cur = c[i]
+		default:
+			return 0, false
+		}
+	}
+	switch v := cur.(type) {
+	case float64:
+		return v, true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
@@ -0,0 +1,223 @@
+package alerts
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRuleCheck(t *testing.T) {
+	tests := []struct {
+		rule Rule
+		msg  string // "" = valid
+	}{
+		{Rule{ID: "cpu", Metric: "cpu", Op: ">", Value: 90}, ""},
+		{Rule{ID: "cpu", Metric: "cpu"}, ""},
+		{Rule{ID: "dns", Target: "a", DownRounds: 3}, ""},
+		{Rule{ID: "dns", Target: "a"}, ""},
+		{Rule{Metric: "cpu"}, "needs an id"},
+		{Rule{ID: "x"}, "needs a metric or a target"},
+		{Rule{ID: "x", Metric: "cpu", Target: "a"}, "exclusive"},
+		{Rule{ID: "x", Metric: "cpu", Op: "=>"}, "op"},
+		{Rule{ID: "x", Metric: "cpu", ForSec: -1}, "for_sec"},
+		{Rule{ID: "x", Target: "a", DownRounds: -1}, "down_rounds"},
+	}
+	for _, tt := range tests {
+		err := tt.rule.Check()
+		if tt.msg == "" && err != nil {
+			t.Errorf("%+v: %v", tt.rule, err)
+		}
+		if tt.msg != "" && (err == nil || !strings.Contains(err.Error(), tt.msg)) {
+			t.Errorf("%+v: got %v, want an error mentioning %q", tt.rule, err, tt.msg)
+		}
+	}
+}
+
+func TestBreached(t *testing.T) {
+	tests := []struct {
+		op   string
+		v    float64
+		want bool
+	}{
+		{"", 11, true}, {"", 10, false},
+		{">", 11, true}, {">", 10, false},
+		{">=", 10, true}, {">=", 9, false},
+		{"<", 9, true}, {"<", 10, false},
+		{"<=", 10, true}, {"<=", 11, false},
+		{"==", 10, true}, {"==", 11, false},
+		{"!=", 11, true}, {"!=", 10, false},
+	}
+	for _, tt := range tests {
+		if got := breached(tt.op, tt.v, 10); got != tt.want {
+			t.Errorf("%v %s 10 = %v", tt.v, tt.op, got)
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	m := map[string]any{
+		"cpu": 12.5,
+		"psi": map[string]any{"io": map[string]any{"some": map[string]any{"avg10": 3.0}}},
+		"frag": map[string]any{"zones": []any{
+			map[string]any{"unusable_pct": 1.0},
+			map[string]any{"unusable_pct": 7.0},
+		}},
+		"security": map[string]any{"locked": true, "name": "x"},
+	}
+	tests := []struct {
+		path string
+		want float64
+		ok   bool
+	}{
+		{"cpu", 12.5, true},
+		{"psi.io.some.avg10", 3, true},
+		{"frag.zones.1.unusable_pct", 7, true},
+		{"security.locked", 1, true},
+		{"security.name", 0, false},
+		{"frag.zones.2.unusable_pct", 0, false},
+		{"frag.zones.-1.unusable_pct", 0, false},
+		{"frag.zones.x", 0, false},
+		{"cpu.user", 0, false},
+		{"psi.io", 0, false},
+		{"missing", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := lookup(m, tt.path)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("%s: got %v %v, want %v %v", tt.path, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func types(evs []Event) string {
+	var s []string
+	for _, ev := range evs {
+		s = append(s, ev.Type+":"+ev.RuleID)
+	}
+	return strings.Join(s, ",")
+}
+
+func TestMetricRule(t *testing.T) {
+	e := New()
+	e.SetRules([]Rule{
+		{ID: "cpu", Metric: "cpu", Op: ">", Value: 90, ForSec: 60, Severity: "warn"},
+		{ID: "load", Metric: "load.1", Op: ">=", Value: 4},
+	}, time.Unix(0, 0))
+	if !e.HasMetricRules() {
+		t.Fatal("HasMetricRules false")
+	}
+	t0 := time.Unix(1000, 0)
+	type snap struct {
+		CPU  float64            `json:"cpu"`
+		Load map[string]float64 `json:"load"`
+	}
+	steps := []struct {
+		at   int
+		cpu  float64
+		load float64
+		want string
+	}{
+		{0, 95, 1, ""}, // cpu breached, not held long enough
+		{30, 99, 1, ""},
+		{60, 92, 4, "alert_fire:cpu,alert_fire:load"},
+		{70, 93, 5, ""}, // already firing
+		{80, 50, 5, "alert_resolve:cpu"},
+		{90, 95, 1, "alert_resolve:load"}, // cpu breached again: the hold restarts
+		{149, 95, 1, ""},
+		{150, 95, 1, "alert_fire:cpu"},
+	}
+	for _, s := range steps {
+		now := t0.Add(time.Duration(s.at) * time.Second)
+		evs := e.ObserveMetrics(snap{CPU: s.cpu, Load: map[string]float64{"1": s.load}}, now)
+		if got := types(evs); got != s.want {
+			t.Fatalf("t+%ds: got %q, want %q", s.at, got, s.want)
+		}
+		for _, ev := range evs {
+			if ev.Type == "alert_fire" && ev.RuleID == "cpu" {
+				if ev.Value != s.cpu || ev.Limit != 90 || ev.Severity != "warn" || ev.TS != now.Unix() {
+					t.Errorf("t+%ds: event %+v", s.at, ev)
+				}
+				if want := now.Add(-60 * time.Second).Unix(); ev.Since != want {
+					t.Errorf("t+%ds: since %d, want the first breach %d", s.at, ev.Since, want)
+				}
+			}
+		}
+	}
+	if got := e.Firing(); !reflect.DeepEqual(got, []string{"cpu"}) {
+		t.Errorf("Firing = %v", got)
+	}
+	// a snapshot without the metric leaves the rule alone
+	if evs := e.ObserveMetrics(map[string]any{}, t0.Add(200*time.Second)); len(evs) != 0 {
+		t.Errorf("missing metric: %v", types(evs))
+	}
+	if evs := e.ObserveMetrics(func() {}, t0); evs != nil {
+		t.Errorf("unmarshalable snapshot: %v", types(evs))
+	}
+}
+
+func TestTargetRule(t *testing.T) {
+	e := New()
+	e.SetRules([]Rule{
+		{ID: "by-id", Target: "cf"},
+		{ID: "by-addr", Target: "1.1.1.1:53", DownRounds: 1},
+	}, time.Now())
+	if e.HasMetricRules() {
+		t.Error("HasMetricRules true")
+	}
+	now := time.Unix(2000, 0)
+	steps := []struct {
+		id, addr string
+		ok       bool
+		want     string
+	}{
+		{"cf", "1.1.1.1:53", false, "alert_fire:by-addr"},
+		{"cf", "1.1.1.1:53", false, ""},
+		{"other", "9.9.9.9:53", false, ""}, // not matched: doesn't count
+		{"cf", "1.1.1.1:53", false, "alert_fire:by-id"},
+		{"cf", "1.1.1.1:53", true, "alert_resolve:by-id,alert_resolve:by-addr"},
+		{"cf", "1.1.1.1:53", false, "alert_fire:by-addr"},
+		{"cf", "1.1.1.1:53", false, ""}, // by-id counts from 0 again
+	}
+	for i, s := range steps {
+		evs := e.ObserveTarget(s.id, s.addr, s.ok, now.Add(time.Duration(i)*time.Second))
+		if got := types(evs); got != s.want {
+			t.Fatalf("step %d: got %q, want %q", i, got, s.want)
+		}
+		for _, ev := range evs {
+			if ev.RuleID == "by-id" && ev.Type == "alert_fire" && (ev.Value != 3 || ev.Since != now.Unix()) {
+				t.Errorf("step %d: event %+v", i, ev)
+			}
+		}
+	}
+}
+
+func TestSetRules(t *testing.T) {
+	e := New()
+	now := time.Unix(3000, 0)
+	e.SetRules([]Rule{{ID: "a", Target: "x", DownRounds: 1}, {ID: "b", Target: "x", DownRounds: 1}, {ID: "c", Target: "y"}}, now)
+	if evs := e.ObserveTarget("x", "", false, now); types(evs) != "alert_fire:a,alert_fire:b" {
+		t.Fatalf("got %q", types(evs))
+	}
+	// a keeps its state (still firing, no new fire); b is resolved as
+	// removed; c never fired
+	evs := e.SetRules([]Rule{{ID: "a", Target: "x", DownRounds: 1}}, now.Add(time.Second))
+	if len(evs) != 1 || evs[0].Type != "alert_resolve" || evs[0].RuleID != "b" || evs[0].Reason != "rule_removed" {
+		t.Fatalf("got %+v", evs)
+	}
+	if got := e.Firing(); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Errorf("Firing = %v", got)
+	}
+	if evs := e.ObserveTarget("x", "", false, now); len(evs) != 0 {
+		t.Errorf("kept rule fired again: %v", types(evs))
+	}
+	if n := len(e.Rules()); n != 1 {
+		t.Errorf("%d rules", n)
+	}
+	if evs := e.SetRules(nil, now); types(evs) != "alert_resolve:a" {
+		t.Errorf("got %q", types(evs))
+	}
+	if got := e.Firing(); len(got) != 0 {
+		t.Errorf("Firing = %v", got)
+	}
+}
@@ -0,0 +1,156 @@
+// Package authlog follows sshd's log (an auth log file or journald) and
+// counts failed logins per source IP over the last hour.
+package authlog
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	window = time.Hour
+	topN   = 10
+)
+
+// Stats is the `security.ssh` metrics section.
+type Stats struct {
+	Source       string    `json:"source"`
+	FailedTotal  uint64    `json:"failed_total"` // since the agent started
+	Failed5m     uint64    `json:"failed_5m"`
+	Failed1h     uint64    `json:"failed_1h"`
+	InvalidUser  uint64    `json:"invalid_user_1h"`
+	UniqueIPs    int       `json:"unique_ips_1h"`
+	TopIPs       []IPCount `json:"top_ips,omitempty"` // by failures in the last hour
+	Err          string    `json:"err,omitempty"`     // source unreadable
+	ErrSinceUnix int64     `json:"err_since,omitempty"`
+}
+
+type IPCount struct {
+	IP    string `json:"ip"`
+	Count uint64 `json:"count"`
+}
+
+var (
+	// Failed password for root from 1.2.3.4 port 22 ssh2
+	// Failed publickey for invalid user bob from 2001:db8::1 port 5022 ssh2
+	reFailed = regexp.MustCompile(`\bFailed (?:password|publickey|keyboard-interactive(?:/pam)?|none) for (?:invalid user )?.*? from (\S+) port \d+`)
+	// Invalid user admin from 1.2.3.4 port 41234
+	reInvalid = regexp.MustCompile(`\bInvalid user .*? from (\S+)(?: port \d+)?`)
+	// rsyslog: message repeated 3 times: [ Failed password for ...]
+	reRepeated = regexp.MustCompile(`message repeated (\d+) times: \[`)
+)
+
+// minute is one bucket of the sliding window.
+type minute struct {
+	at      int64 // unix minute
+	failed  uint64
+	invalid uint64
+	ips     map[string]uint64
+}
+
+// Counter aggregates parsed sshd lines.
+type Counter struct {
+	mu      sync.Mutex
+	source  string
+	total   uint64
+	buckets [60]minute
+	err     string
+	errAt   time.Time
+}
+
+// Line counts one log line (other lines are ignored).
+func (c *Counter) Line(s string, now time.Time) {
+	n := uint64(1)
+	if m := reRepeated.FindStringSubmatch(s); m != nil {
+		if v, err := strconv.ParseUint(m[1], 10, 32); err == nil && v > 0 {
+			n = v
+		}
+	}
+	var ip string
+	failed := false
+	if m := reFailed.FindStringSubmatch(s); m != nil {
+		ip, failed = m[1], true
+	} else if m := reInvalid.FindStringSubmatch(s); m != nil {
+		ip = m[1]
+	} else {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b := c.bucketLocked(now)
+	if failed {
+		c.total += n
+		b.failed += n
+		b.ips[ip] += n
+	} else {
+		b.invalid += n
+	}
+}
+
+func (c *Counter) bucketLocked(now time.Time) *minute {
+	at := now.Unix() / 60
+	b := &c.buckets[at%int64(len(c.buckets))]
+	if b.at != at {
+		*b = minute{at: at, ips: map[string]uint64{}}
+	}
+	return b
+}
+
+// setSource records where lines come from and whether reading it fails.
+func (c *Counter) setSource(src string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.source = src
+	switch {
+	case err == nil:
+		c.err, c.errAt = "", time.Time{}
+	case c.err == "":
+		c.err, c.errAt = err.Error(), time.Now()
+	default:
+		c.err = err.Error()
+	}
+}
+
+// Stats summarizes the last hour.
+func (c *Counter) Stats(now time.Time) *Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := &Stats{Source: c.source, FailedTotal: c.total, Err: c.err}
+	if !c.errAt.IsZero() {
+		s.ErrSinceUnix = c.errAt.Unix()
+	}
+	cur := now.Unix() / 60
+	ips := map[string]uint64{}
+	for _, b := range c.buckets {
+		age := cur - b.at
+		if b.ips == nil || age < 0 || age >= int64(window/time.Minute) {
+			continue
+		}
+		s.Failed1h += b.failed
+		s.InvalidUser += b.invalid
+		if age < 5 {
+			s.Failed5m += b.failed
+		}
+		for ip, n := range b.ips {
+			ips[ip] += n
+		}
+	}
+	s.UniqueIPs = len(ips)
+	for ip, n := range ips {
+		s.TopIPs = append(s.TopIPs, IPCount{IP: ip, Count: n})
+	}
+	sort.Slice(s.TopIPs, func(i, j int) bool {
+		if s.TopIPs[i].Count != s.TopIPs[j].Count {
+			return s.TopIPs[i].Count > s.TopIPs[j].Count
+		}
+		return s.TopIPs[i].IP < s.TopIPs[j].IP
+	})
+	if len(s.TopIPs) > topN {
+		s.TopIPs = s.TopIPs[:topN]
+	}
+	return s
+}
@@ -0,0 +1,155 @@
+package authlog
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	pollInterval = 2 * time.Second
+	retryDelay   = 30 * time.Second
+)
+
+// authFiles are tried in order by "auto" before falling back to journald.
+var authFiles = []string{"/var/log/auth.log", "/var/log/secure"}
+
+// Follow feeds new sshd lines from source into c until ctx is done. source
+// is a log file path (followed from its current end, across rotation),
+// "journald", or "auto" (the first existing authFiles entry, else journald).
+// History from before the call is not counted.
+func Follow(ctx context.Context, source string, c *Counter) {
+	if source == "auto" {
+		source = "journald"
+		for _, p := range authFiles {
+			if _, err := os.Stat(p); err == nil {
+				source = p
+				break
+			}
+		}
+	}
+	if source == "journald" {
+		followJournal(ctx, c)
+		return
+	}
+	followFile(ctx, source, c)
+}
+
+func followFile(ctx context.Context, path string, c *Counter) {
+	var (
+		f     *os.File
+		fi    os.FileInfo
+		off   int64
+		start = true // skip what is already in the file
+	)
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
+	for {
+		if f == nil {
+			var err error
+			if f, err = os.Open(path); err == nil {
+				if fi, err = f.Stat(); err != nil {
+					f.Close()
+					f = nil
+				}
+			}
+			c.setSource(path, err)
+			if f != nil {
+				off = 0
+				if start {
+					off = fi.Size()
+				}
+				start = false
+			}
+		}
+		if f != nil {
+			off = readLines(f, off, c)
+			cur, err := os.Stat(path)
+			switch {
+			case err != nil || !os.SameFile(fi, cur):
+				// rotated: finish the old file, the next open reads the
+				// new one from the top
+				readLines(f, off, c)
+				f.Close()
+				f = nil
+			case cur.Size() < off:
+				off = 0 // truncated in place (copytruncate)
+			}
+		}
+		select {
+		case <-time.After(pollInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// readLines counts the complete lines after off and returns the new
+// offset (a partial last line is read again next time).
+func readLines(f *os.File, off int64, c *Counter) int64 {
+	if _, err := f.Seek(off, io.SeekStart); err != nil {
+		return off
+	}
+	r := bufio.NewReader(f)
+	now := time.Now()
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return off
+		}
+		off += int64(len(line))
+		c.Line(line, now)
+	}
+}
+
+func followJournal(ctx context.Context, c *Counter) {
+	for {
+		err := runJournal(ctx, c)
+		if ctx.Err() != nil {
+			return
+		}
+		c.setSource("journald", err)
+		select {
+		case <-time.After(retryDelay):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func runJournal(ctx context.Context, c *Counter) error {
+	// sshd-session logs the auth lines since OpenSSH 9.8
+	cmd := exec.CommandContext(ctx, "journalctl", "-f", "-n", "0", "-o", "cat",
+		"_COMM=sshd", "_COMM=sshd-session")
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	c.setSource("journald", nil)
+	sc := bufio.NewScanner(out)
+	for sc.Scan() {
+		c.Line(sc.Text(), time.Now())
+	}
+	err = cmd.Wait()
+	if msg := strings.TrimSpace(stderr.String()); msg != "" {
+		return fmt.Errorf("journalctl: %v: %s", err, msg)
+	}
+	if err == nil {
+		err = errors.New("exited")
+	}
+	return fmt.Errorf("journalctl: %v", err)
+}
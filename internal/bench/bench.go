@@ -0,0 +1,183 @@
+// Package bench runs short, bounded micro-benchmarks so nodes across a fleet
+// get comparable baseline scores. A full run takes about 10 seconds and
+// writes at most DiskBytes to disk.
+package bench
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Vincentkeio/agent/internal/util"
+)
+
+const (
+	cpuDuration = 2 * time.Second
+	memDuration = time.Second
+	memBytes    = 64 << 20
+	DiskBytes   = 128 << 20
+	diskBlock   = 1 << 20
+)
+
+// Result is what `kokoro-agent bench` prints and stores as bench.json.
+type Result struct {
+	TS       int64  `json:"ts"`
+	AgentVer string `json:"agent_ver,omitempty"`
+	NumCPU   int    `json:"num_cpu"`
+
+	// CPU: MB/s of SHA-256 on one core and on all cores.
+	CPUSingleMBps float64 `json:"cpu_single_mbps"`
+	CPUMultiMBps  float64 `json:"cpu_multi_mbps"`
+	// Memory copy bandwidth.
+	MemCopyGBps float64 `json:"mem_copy_gbps"`
+	// Sequential write with fsync, then read back. Reads may be served from
+	// the page cache; treat them as an upper bound.
+	DiskWriteMBps float64 `json:"disk_write_mbps,omitempty"`
+	DiskReadMBps  float64 `json:"disk_read_mbps,omitempty"`
+	DiskErr       string  `json:"disk_err,omitempty"`
+
+	DurationMS int64 `json:"duration_ms"`
+}
+
+// Run executes all benchmarks; the disk test uses a temp file in dir
+// (skipped when dir is "").
+func Run(dir string) Result {
+	start := time.Now()
+	r := Result{TS: start.Unix(), NumCPU: runtime.NumCPU()}
+	r.CPUSingleMBps = round1(cpuScore(1))
+	r.CPUMultiMBps = round1(cpuScore(runtime.GOMAXPROCS(0)))
+	r.MemCopyGBps = round2(memCopy())
+	if dir != "" {
+		w, rd, err := disk(dir)
+		if err != nil {
+			r.DiskErr = err.Error()
+		} else {
+			r.DiskWriteMBps, r.DiskReadMBps = round1(w), round1(rd)
+		}
+	}
+	r.DurationMS = time.Since(start).Milliseconds()
+	return r
+}
+
+func cpuScore(workers int) float64 {
+	buf := make([]byte, 64<<10)
+	for i := range buf {
+		buf[i] = byte(i)
+	}
+	var total atomic.Int64
+	deadline := time.Now().Add(cpuDuration)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var n int64
+			for time.Now().Before(deadline) {
+				for i := 0; i < 16; i++ {
+					sha256.Sum256(buf)
+				}
+				n += 16 * int64(len(buf))
+			}
+			total.Add(n)
+		}()
+	}
+	wg.Wait()
+	return float64(total.Load()) / cpuDuration.Seconds() / 1e6
+}
+
+func memCopy() float64 {
+	src := make([]byte, memBytes)
+	dst := make([]byte, memBytes)
+	for i := 0; i < len(src); i += 4096 {
+		src[i] = byte(i) // fault pages in before timing
+		dst[i] = 0
+	}
+	var n int64
+	start := time.Now()
+	for time.Since(start) < memDuration {
+		copy(dst, src)
+		n += memBytes
+	}
+	return float64(n) / time.Since(start).Seconds() / 1e9
+}
+
+func disk(dir string) (writeMBps, readMBps float64, err error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, 0, err
+	}
+	f, err := os.CreateTemp(dir, ".bench-*")
+	if err != nil {
+		return 0, 0, err
+	}
+	name := f.Name()
+	defer os.Remove(name)
+
+	block := make([]byte, diskBlock)
+	for i := range block {
+		block[i] = byte(i * 7)
+	}
+	start := time.Now()
+	for written := 0; written < DiskBytes; written += diskBlock {
+		if _, err := f.Write(block); err != nil {
+			f.Close()
+			return 0, 0, err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return 0, 0, err
+	}
+	writeMBps = DiskBytes / time.Since(start).Seconds() / 1e6
+	if err := f.Close(); err != nil {
+		return 0, 0, err
+	}
+
+	f, err = os.Open(name)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	start = time.Now()
+	for {
+		n, err := f.Read(block)
+		if n == 0 || err != nil {
+			break
+		}
+	}
+	readMBps = DiskBytes / time.Since(start).Seconds() / 1e6
+	return writeMBps, readMBps, nil
+}
+
+// FileName is where the last result is kept inside state_dir.
+const FileName = "bench.json"
+
+// Save stores r in dir/bench.json for the agent to attach to hello.
+func Save(dir string, r Result) error {
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return util.WriteFileAtomic(filepath.Join(dir, FileName), b, 0644)
+}
+
+// Load returns the stored result, if any.
+func Load(dir string) (*Result, error) {
+	b, err := os.ReadFile(filepath.Join(dir, FileName))
+	if err != nil {
+		return nil, err
+	}
+	var r Result
+	if err := json.Unmarshal(b, &r); err != nil {
+		return nil, fmt.Errorf("%s: %w", FileName, err)
+	}
+	return &r, nil
+}
+
+func round1(f float64) float64 { return float64(int64(f*10+0.5)) / 10 }
+func round2(f float64) float64 { return float64(int64(f*100+0.5)) / 100 }
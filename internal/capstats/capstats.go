@@ -0,0 +1,103 @@
+package capstats
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Vincentkeio/agent/internal/util"
+)
+
+// Counter is the running tally for one capability ("metrics", "tcpping", ...).
+type Counter struct {
+	Runs          uint64  `json:"runs"`
+	Failures      uint64  `json:"failures"`
+	AvgDurationMS float64 `json:"avg_duration_ms"`
+	LastRunTS     int64   `json:"last_run_ts,omitempty"`
+
+	LastError   string `json:"last_error,omitempty"`
+	LastErrorTS int64  `json:"last_error_ts,omitempty"`
+	// FailingSinceTS is set on the first failure of a streak and cleared on success.
+	FailingSinceTS int64 `json:"failing_since_ts,omitempty"`
+}
+
+// Store keeps per-capability counters and persists them as JSON so they
+// survive restarts.
+type Store struct {
+	mu    sync.Mutex
+	path  string
+	caps  map[string]*Counter
+	dirty bool
+}
+
+// Open loads counters from path. A missing or unreadable file starts empty.
+func Open(path string) *Store {
+	s := &Store{path: path, caps: map[string]*Counter{}}
+	if path == "" {
+		return s
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return s
+	}
+	var caps map[string]*Counter
+	if json.Unmarshal(b, &caps) == nil && caps != nil {
+		s.caps = caps
+	}
+	return s
+}
+
+// Record accounts one run of capability name.
+func (s *Store) Record(name string, dur time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := s.caps[name]
+	if c == nil {
+		c = &Counter{}
+		s.caps[name] = c
+	}
+	now := time.Now().Unix()
+	c.Runs++
+	c.AvgDurationMS += (float64(dur)/float64(time.Millisecond) - c.AvgDurationMS) / float64(c.Runs)
+	c.LastRunTS = now
+	if err != nil {
+		c.Failures++
+		c.LastError = err.Error()
+		c.LastErrorTS = now
+		if c.FailingSinceTS == 0 {
+			c.FailingSinceTS = now
+		}
+	} else {
+		c.FailingSinceTS = 0
+	}
+	s.dirty = true
+}
+
+// Snapshot returns a copy of all counters.
+func (s *Store) Snapshot() map[string]Counter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]Counter, len(s.caps))
+	for k, v := range s.caps {
+		out[k] = *v
+	}
+	return out
+}
+
+// Save writes counters to disk if anything changed since the last save.
+func (s *Store) Save() error {
+	s.mu.Lock()
+	if !s.dirty || s.path == "" {
+		s.mu.Unlock()
+		return nil
+	}
+	b, err := json.MarshalIndent(s.caps, "", "  ")
+	s.dirty = false
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return util.WriteFileAtomic(s.path, b, 0644)
+}
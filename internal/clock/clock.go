@@ -0,0 +1,156 @@
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Source is where reported timestamps come from.
+type Source interface {
+	Now() time.Time
+	Name() string
+}
+
+// System is the kernel wall clock.
+type System struct{}
+
+func (System) Now() time.Time { return time.Now() }
+func (System) Name() string   { return "system" }
+
+// Monotonic derives wall time from the monotonic clock, anchored at a wall
+// time believed to be good. It never freezes or steps, but drifts slowly.
+type Monotonic struct {
+	anchor time.Time // carries a monotonic reading
+	wall   time.Time // wall time at anchor
+}
+
+// NewMonotonic anchors at wall (use time.Now() when the clock is healthy).
+func NewMonotonic(wall time.Time) *Monotonic {
+	return &Monotonic{anchor: time.Now(), wall: wall.Round(0)}
+}
+
+func (m *Monotonic) Now() time.Time { return m.wall.Add(time.Since(m.anchor)) }
+func (m *Monotonic) Name() string   { return "monotonic" }
+
+// Event describes a clock anomaly or recovery.
+type Event struct {
+	Kind    string `json:"kind"`     // frozen|step|recovered
+	DeltaMS int64  `json:"delta_ms"` // wall minus monotonic drift over the check
+	Source  string `json:"source"`   // source in use after the event
+	TS      int64  `json:"ts"`
+}
+
+const (
+	// The wall clock must advance at least this fraction of monotonic time.
+	frozenRatio = 0.5
+	// Wall vs monotonic disagreement counted as a step.
+	stepThreshold = 5 * time.Second
+	// In auto mode, this many steps within stepWindow mean the clock is
+	// unreliable and reporting switches to the monotonic source.
+	stepLimit  = 3
+	stepWindow = 10 * time.Minute
+	// Wall clock must track monotonic this long before switching back.
+	recoverAfter = time.Minute
+)
+
+// Guard watches the wall clock against the monotonic clock and, in "auto"
+// mode, falls back to a monotonic-derived source while the wall clock is
+// frozen or stepping wildly. Modes: auto (default), system (detect and
+// report only), monotonic (always monotonic-derived).
+type Guard struct {
+	mu       sync.Mutex
+	mode     string
+	cur      Source
+	last     time.Time // previous check, with monotonic reading
+	goodWall time.Time // last wall time that looked right
+	steps    []time.Time
+	goodFor  time.Duration
+}
+
+func NewGuard(mode string) *Guard {
+	now := time.Now()
+	g := &Guard{mode: mode, cur: System{}, last: now, goodWall: now}
+	if mode == "monotonic" {
+		g.cur = NewMonotonic(now)
+	}
+	return g
+}
+
+// Now returns the time from the active source.
+func (g *Guard) Now() time.Time {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.cur.Now()
+}
+
+// Fallback reports whether timestamps come from something other than the
+// system clock.
+func (g *Guard) Fallback() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	_, sys := g.cur.(System)
+	return !sys
+}
+
+// SourceName is the active source.
+func (g *Guard) SourceName() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.cur.Name()
+}
+
+// Check compares wall and monotonic progress since the previous call and
+// returns an event when something changed. Call it every few seconds.
+func (g *Guard) Check() *Event {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	mono := now.Sub(g.last)
+	wall := now.Round(0).Sub(g.last.Round(0))
+	g.last = now
+	if mono <= 0 {
+		return nil
+	}
+	drift := wall - mono
+
+	var kind string
+	switch {
+	case float64(wall) < frozenRatio*float64(mono):
+		kind = "frozen"
+	case drift > stepThreshold || drift < -stepThreshold:
+		kind = "step"
+	}
+
+	if kind == "" {
+		g.goodFor += mono
+		if _, sys := g.cur.(System); !sys && g.mode == "auto" && g.goodFor >= recoverAfter {
+			g.cur = System{}
+			g.steps = nil
+			return g.event("recovered", drift)
+		}
+		if _, sys := g.cur.(System); sys {
+			g.goodWall = now
+		}
+		return nil
+	}
+
+	g.goodFor = 0
+	if g.mode == "auto" {
+		if kind == "step" {
+			g.steps = append(g.steps, now)
+			for len(g.steps) > 0 && now.Sub(g.steps[0]) > stepWindow {
+				g.steps = g.steps[1:]
+			}
+		}
+		if _, sys := g.cur.(System); sys && (kind == "frozen" || len(g.steps) >= stepLimit) {
+			// continue from the last wall time that looked right
+			g.cur = NewMonotonic(g.goodWall.Add(now.Sub(g.goodWall)))
+		}
+	}
+	return g.event(kind, drift)
+}
+
+func (g *Guard) event(kind string, drift time.Duration) *Event {
+	return &Event{Kind: kind, DeltaMS: drift.Milliseconds(), Source: g.cur.Name(), TS: g.cur.Now().Unix()}
+}
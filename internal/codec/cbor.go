@@ -0,0 +1,95 @@
+package codec
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// cborEncoder writes CBOR (RFC 8949) with definite lengths and sorted map keys.
+type cborEncoder struct{}
+
+func (cborEncoder) Name() string { return "cbor" }
+func (cborEncoder) Binary() bool { return true }
+
+func (cborEncoder) Encode(v any) ([]byte, error) {
+	g, err := generic(v)
+	if err != nil {
+		return nil, err
+	}
+	return cborAppend(nil, g)
+}
+
+func init() { Register(cborEncoder{}) }
+
+const (
+	cborUint   = 0 << 5
+	cborNegInt = 1 << 5
+	cborText   = 3 << 5
+	cborArray  = 4 << 5
+	cborMap    = 5 << 5
+)
+
+func cborHead(b []byte, major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return append(b, major|byte(n))
+	case n <= math.MaxUint8:
+		return append(b, major|24, byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, major|25), uint16(n))
+	case n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(b, major|26), uint32(n))
+	}
+	return binary.BigEndian.AppendUint64(append(b, major|27), n)
+}
+
+func cborAppend(b []byte, v any) ([]byte, error) {
+	var err error
+	switch x := v.(type) {
+	case nil:
+		return append(b, 0xf6), nil
+	case bool:
+		if x {
+			return append(b, 0xf5), nil
+		}
+		return append(b, 0xf4), nil
+	case string:
+		return append(cborHead(b, cborText, uint64(len(x))), x...), nil
+	case json.Number:
+		if i, e := x.Int64(); e == nil {
+			if i >= 0 {
+				return cborHead(b, cborUint, uint64(i)), nil
+			}
+			return cborHead(b, cborNegInt, uint64(-1-i)), nil
+		}
+		if u, e := strconv.ParseUint(string(x), 10, 64); e == nil {
+			return cborHead(b, cborUint, u), nil // above MaxInt64
+		}
+		f, e := x.Float64()
+		if e != nil {
+			return nil, fmt.Errorf("cbor: bad number %q", x)
+		}
+		return binary.BigEndian.AppendUint64(append(b, 0xfb), math.Float64bits(f)), nil
+	case []any:
+		b = cborHead(b, cborArray, uint64(len(x)))
+		for _, e := range x {
+			if b, err = cborAppend(b, e); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case map[string]any:
+		b = cborHead(b, cborMap, uint64(len(x)))
+		for _, k := range sortedKeys(x) {
+			b = append(cborHead(b, cborText, uint64(len(k))), k...)
+			if b, err = cborAppend(b, x[k]); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("cbor: unsupported type %T", v)
+}
@@ -0,0 +1,83 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"sync"
+)
+
+// Encoder turns an outgoing message into a frame payload.
+type Encoder interface {
+	// Name is what hello advertises and config/hello_ok select ("json", ...).
+	Name() string
+	// Binary reports whether payloads go out as binary frames.
+	Binary() bool
+	Encode(v any) ([]byte, error)
+}
+
+var (
+	mu       sync.RWMutex
+	registry = map[string]Encoder{}
+)
+
+// Register makes e selectable by name. Implementations call it from init,
+// so an encoder is available iff its file is compiled in.
+func Register(e Encoder) {
+	mu.Lock()
+	defer mu.Unlock()
+	registry[e.Name()] = e
+}
+
+// Get returns the encoder registered under name.
+func Get(name string) (Encoder, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	e, ok := registry[name]
+	return e, ok
+}
+
+// Default is the JSON encoder; every master understands it.
+func Default() Encoder {
+	e, _ := Get("json")
+	return e
+}
+
+// Names lists the registered encoders, sorted.
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	out := make([]string, 0, len(registry))
+	for n := range registry {
+		out = append(out, n)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// generic converts v to plain maps/slices/strings/numbers through its JSON
+// form, so binary encoders honour the same field names and omitempty rules.
+// Numbers come back as json.Number.
+func generic(v any) (any, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var out any
+	if err := d.Decode(&out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// sortedKeys keeps binary output deterministic.
+func sortedKeys(m map[string]any) []string {
+	ks := make([]string, 0, len(m))
+	for k := range m {
+		ks = append(ks, k)
+	}
+	sort.Strings(ks)
+	return ks
+}
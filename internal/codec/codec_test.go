@@ -0,0 +1,138 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math"
+	"strings"
+	"testing"
+)
+
+type goldenCase struct {
+	name string
+	in   any
+	want string // hex
+}
+
+func checkGolden(t *testing.T, enc string, tests []goldenCase) {
+	t.Helper()
+	e, ok := Get(enc)
+	if !ok {
+		t.Fatalf("%s not registered", enc)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := e.Encode(tt.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, _ := hex.DecodeString(strings.ReplaceAll(tt.want, " ", ""))
+			if !bytes.Equal(got, want) {
+				t.Errorf("got % x, want % x", got, want)
+			}
+		})
+	}
+}
+
+func TestMsgpack(t *testing.T) {
+	checkGolden(t, "msgpack", []goldenCase{
+		{"nil", nil, "c0"},
+		{"true", true, "c3"},
+		{"false", false, "c2"},
+		{"positive fixint", 127, "7f"},
+		{"uint8", 128, "cc 80"},
+		{"uint16", 256, "cd 01 00"},
+		{"uint32", 65536, "ce 00 01 00 00"},
+		{"uint64", uint64(1) << 32, "cf 00 00 00 01 00 00 00 00"},
+		{"max uint64", uint64(math.MaxUint64), "cf ff ff ff ff ff ff ff ff"},
+		{"negative fixint", -32, "e0"},
+		{"int8", -33, "d0 df"},
+		{"int16", -129, "d1 ff 7f"},
+		{"int32", -32769, "d2 ff ff 7f ff"},
+		{"int64", int64(math.MinInt64), "d3 80 00 00 00 00 00 00 00"},
+		{"float", 1.5, "cb 3f f8 00 00 00 00 00 00"},
+		{"fixstr", "a", "a1 61"},
+		{"str8", strings.Repeat("x", 32), "d9 20" + strings.Repeat("78", 32)},
+		{"str16", strings.Repeat("x", 256), "da 01 00" + strings.Repeat("78", 256)},
+		{"fixarray", []int{1, 2}, "92 01 02"},
+		{"array16", make([]int, 16), "dc 00 10" + strings.Repeat("00", 16)},
+		{"fixmap sorted", map[string]int{"b": 1, "a": 2}, "82 a1 61 02 a1 62 01"},
+		{"struct tags", struct {
+			A int    `json:"a"`
+			B string `json:"b,omitempty"`
+		}{A: 1}, "81 a1 61 01"},
+	})
+}
+
+func TestCBOR(t *testing.T) {
+	// RFC 8949 appendix A, except that floats are always 64-bit
+	checkGolden(t, "cbor", []goldenCase{
+		{"0", 0, "00"},
+		{"23", 23, "17"},
+		{"24", 24, "18 18"},
+		{"1000", 1000, "19 03 e8"},
+		{"1000000", 1000000, "1a 00 0f 42 40"},
+		{"1000000000000", int64(1000000000000), "1b 00 00 00 e8 d4 a5 10 00"},
+		{"max uint64", uint64(math.MaxUint64), "1b ff ff ff ff ff ff ff ff"},
+		{"-1", -1, "20"},
+		{"-100", -100, "38 63"},
+		{"-1000", -1000, "39 03 e7"},
+		{"min int64", int64(math.MinInt64), "3b 7f ff ff ff ff ff ff ff"},
+		{"float", 1.5, "fb 3f f8 00 00 00 00 00 00"},
+		{"false", false, "f4"},
+		{"true", true, "f5"},
+		{"null", nil, "f6"},
+		{"empty string", "", "60"},
+		{"IETF", "IETF", "64 49 45 54 46"},
+		{"utf-8", "ü", "62 c3 bc"},
+		{"empty array", []int{}, "80"},
+		{"nested arrays", []any{1, []int{2, 3}, []int{4, 5}}, "83 01 82 02 03 82 04 05"},
+		{"map", map[string]any{"b": []int{2, 3}, "a": 1}, "a2 61 61 01 61 62 82 02 03"},
+		{"array of 25", make([]int, 25), "98 19" + strings.Repeat("00", 25)},
+	})
+}
+
+func TestProtobuf(t *testing.T) {
+	checkGolden(t, "protobuf", []goldenCase{
+		{"empty", map[string]any{}, ""},
+		// fields{key: "a", value: {number_value: 1}}
+		{"number", map[string]any{"a": 1}, "0a 0e 0a 01 61 12 09 11 00 00 00 00 00 00 f0 3f"},
+		// fields{key: "s", value: {string_value: "x"}}
+		{"string", map[string]any{"s": "x"}, "0a 08 0a 01 73 12 03 1a 01 78"},
+		// null_value, bool_value, then an empty list_value
+		{"null bool list", map[string]any{"n": nil, "t": true, "l": []any{}},
+			"0a 07 0a 01 6c 12 02 32 00" + "0a 07 0a 01 6e 12 02 08 00" + "0a 07 0a 01 74 12 02 20 01"},
+		// struct_value holding {"k": "v"}
+		{"nested", map[string]any{"o": map[string]any{"k": "v"}},
+			"0a 11 0a 01 6f 12 0c 2a 0a 0a 08 0a 01 6b 12 03 1a 01 76"},
+	})
+	e, _ := Get("protobuf")
+	if _, err := e.Encode([]int{1}); err == nil {
+		t.Error("encoded a top-level array")
+	}
+}
+
+func TestUnsupported(t *testing.T) {
+	for _, name := range Names() {
+		e, _ := Get(name)
+		if _, err := e.Encode(map[string]any{"f": func() {}}); err == nil {
+			t.Errorf("%s encoded a func", name)
+		}
+		if _, err := e.Encode(math.NaN()); err == nil {
+			t.Errorf("%s encoded NaN", name)
+		}
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	want := []string{"cbor", "json", "msgpack", "protobuf"}
+	if got := Names(); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("Names() = %v, want %v", got, want)
+	}
+	if Default().Name() != "json" || Default().Binary() {
+		t.Error("Default is not text JSON")
+	}
+	if _, ok := Get("xml"); ok {
+		t.Error("Get found xml")
+	}
+}
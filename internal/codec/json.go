@@ -0,0 +1,11 @@
+package codec
+
+import "encoding/json"
+
+type jsonEncoder struct{}
+
+func (jsonEncoder) Name() string                 { return "json" }
+func (jsonEncoder) Binary() bool                 { return false }
+func (jsonEncoder) Encode(v any) ([]byte, error) { return json.Marshal(v) }
+
+func init() { Register(jsonEncoder{}) }
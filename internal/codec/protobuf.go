@@ -0,0 +1,102 @@
+package codec
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+)
+
+// protobufEncoder writes the message as a google.protobuf.Struct, so a
+// master can decode it with the well-known types and no agent-specific
+// schema. Numbers become doubles, as in Struct's JSON mapping.
+type protobufEncoder struct{}
+
+func (protobufEncoder) Name() string { return "protobuf" }
+func (protobufEncoder) Binary() bool { return true }
+
+func (protobufEncoder) Encode(v any) ([]byte, error) {
+	g, err := generic(v)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := g.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("protobuf: top level must be an object, got %T", g)
+	}
+	return pbStruct(nil, m)
+}
+
+func init() { Register(protobufEncoder{}) }
+
+const (
+	pbVarint = 0
+	pbI64    = 1
+	pbLen    = 2
+)
+
+func pbTag(b []byte, field, wire int) []byte {
+	return binary.AppendUvarint(b, uint64(field<<3|wire))
+}
+
+func pbBytes(b []byte, field int, p []byte) []byte {
+	b = pbTag(b, field, pbLen)
+	b = binary.AppendUvarint(b, uint64(len(p)))
+	return append(b, p...)
+}
+
+// Struct { map<string, Value> fields = 1; }
+func pbStruct(b []byte, m map[string]any) ([]byte, error) {
+	for _, k := range sortedKeys(m) {
+		val, err := pbValue(nil, m[k])
+		if err != nil {
+			return nil, err
+		}
+		entry := pbBytes(nil, 1, []byte(k))
+		entry = pbBytes(entry, 2, val)
+		b = pbBytes(b, 1, entry)
+	}
+	return b, nil
+}
+
+// Value { oneof kind { NullValue null_value = 1; double number_value = 2;
+// string string_value = 3; bool bool_value = 4; Struct struct_value = 5;
+// ListValue list_value = 6; } }
+func pbValue(b []byte, v any) ([]byte, error) {
+	switch x := v.(type) {
+	case nil:
+		return append(pbTag(b, 1, pbVarint), 0), nil
+	case json.Number:
+		f, err := x.Float64()
+		if err != nil {
+			return nil, fmt.Errorf("protobuf: bad number %q", x)
+		}
+		return binary.LittleEndian.AppendUint64(pbTag(b, 2, pbI64), math.Float64bits(f)), nil
+	case string:
+		return pbBytes(b, 3, []byte(x)), nil
+	case bool:
+		n := byte(0)
+		if x {
+			n = 1
+		}
+		return append(pbTag(b, 4, pbVarint), n), nil
+	case map[string]any:
+		s, err := pbStruct(nil, x)
+		if err != nil {
+			return nil, err
+		}
+		return pbBytes(b, 5, s), nil
+	case []any:
+		// ListValue { repeated Value values = 1; }
+		var l []byte
+		for _, e := range x {
+			ev, err := pbValue(nil, e)
+			if err != nil {
+				return nil, err
+			}
+			l = pbBytes(l, 1, ev)
+		}
+		return pbBytes(b, 6, l), nil
+	}
+	return nil, fmt.Errorf("protobuf: unsupported type %T", v)
+}
@@ -4,10 +4,20 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"time"
 
+	"github.com/Vincentkeio/agent/internal/alerts"
+	"github.com/Vincentkeio/agent/internal/hooks"
+	"github.com/Vincentkeio/agent/internal/k8s"
+	"github.com/Vincentkeio/agent/internal/netprobe"
+	"github.com/Vincentkeio/agent/internal/plugins"
+	"github.com/Vincentkeio/agent/internal/procwatch"
+	"github.com/Vincentkeio/agent/internal/tasks"
+	"github.com/Vincentkeio/agent/internal/tcpping"
+	"github.com/Vincentkeio/agent/internal/traffic"
 	"github.com/Vincentkeio/agent/internal/util"
 )
 
@@ -22,22 +32,382 @@ type Config struct {
 	// Optional; shown in UI (master may also allow editing server-side)
 	Alias string `json:"alias,omitempty"`
 
+	// Grouping tags ("prod", "hk", "bgp") sent in hello for target
+	// assignment and filtering; config_push may replace them.
+	Tags []string `json:"tags,omitempty"`
+
 	// Defaults (master may override via config_push)
 	MetricsIntervalMS int `json:"metrics_interval_ms,omitempty"`
 
+	// Used instead of the normal interval while the link is degraded
+	// (right after reconnect backoff, or when writes stall). Default 10000.
+	DegradedMetricsIntervalMS int `json:"degraded_metrics_interval_ms,omitempty"`
+
+	// Back off metrics (to degraded_metrics_interval_ms) and tcpping (2x
+	// interval) while host CPU % is at or above this. Default 90; >= 100
+	// disables.
+	CPUPressureThreshold float64 `json:"cpu_pressure_threshold,omitempty"`
+
+	// While metrics go out at intervals of at least twice this, CPU is also
+	// sampled every cpu_sample_ms and each metrics carries its min/avg/max/
+	// p95 as cpu_stats, so short spikes show. Default 1000; negative
+	// disables.
+	CPUSampleMS int `json:"cpu_sample_ms,omitempty"`
+
+	// Shift reported sample timestamps by the clock offset measured against
+	// the master on hello_ok (the offset is always reported in metrics).
+	CorrectClockSkew bool `json:"correct_clock_skew,omitempty"`
+
+	// Timestamp source: auto (system clock, monotonic-derived fallback while
+	// it is frozen or stepping), system (detect/report only) or monotonic.
+	ClockSource string `json:"clock_source,omitempty"`
+
+	// Hold metrics and tcpping_batch messages up to this long and send them
+	// together as one `batch` message (master may override via
+	// config_push). Default 0 = off.
+	BatchMS int `json:"batch_ms,omitempty"`
+
+	// Besides the raw metrics, send a metrics_rollup with the averages of
+	// every window of this many seconds (master may override via
+	// config_push), e.g. 60 for long-term storage. Default 0 = off.
+	RollupSec int `json:"rollup_sec,omitempty"`
+
+	// When the master enables delta metrics (hello_ok "delta"), send a full
+	// keyframe at least this often. Default 60; negative stops offering
+	// delta metrics.
+	DeltaKeyframeSec int `json:"delta_keyframe_sec,omitempty"`
+
+	// Break CPU/memory down per NUMA node (multi-socket hosts only)
+	NUMA bool `json:"numa,omitempty"`
+
 	// Network
 	NetIface string `json:"net_iface,omitempty"` // "auto" or specific iface
 
+	// Uplinks of a multi-homed host reported one by one in metrics
+	// `ifaces`, label -> interface, e.g. {"transit": "eth0", "cn2":
+	// "eth1"}. The top-level net fields stay net_iface's.
+	NetIfaces map[string]string `json:"net_ifaces,omitempty"`
+
+	// Re-run the public IP probe this often (master may override via
+	// config_push). Default 3600; negative disables.
+	NetProbeRefreshSec int `json:"netprobe_refresh_sec,omitempty"`
+
+	// Re-read hello's sys details (hostname, kernel, distro, CPU, memory)
+	// this often and send sysinfo_update when they changed. Default 300,
+	// negative disables.
+	SysinfoRefreshSec int `json:"sysinfo_refresh_sec,omitempty"`
+
+	// Check the default routes this often, and whenever the kernel
+	// announces a link, address or route change (Linux), sending
+	// net_change when they moved. Default 30; negative disables.
+	NetWatchSec int `json:"net_watch_sec,omitempty"`
+
+	// Report WireGuard peers and tunnel interfaces (tunnel_status) this
+	// often. Default 60; negative disables.
+	TunnelIntervalSec int `json:"tunnel_interval_sec,omitempty"`
+
+	// Scan listening TCP/UDP sockets this often and report the inventory
+	// when it changes (ports). Default 300; negative disables.
+	PortsIntervalSec int `json:"ports_interval_sec,omitempty"`
+
+	// Processes to watch (proc_status), by name or pidfile, checked every
+	// watch_interval_sec (default 10; negative disables). The master may
+	// replace the list via config_push, but restart commands only ever
+	// come from here: a pushed watch uses the one configured under its name.
+	Watch            []procwatch.Watch `json:"watch,omitempty"`
+	WatchIntervalSec int               `json:"watch_interval_sec,omitempty"`
+
+	// Scheduled tasks (task_result): each task runs a command named in
+	// task_commands (name -> argv) on its cron schedule. The master may
+	// replace the tasks via config_push, but only ever with commands named
+	// here.
+	TaskCommands map[string][]string `json:"task_commands,omitempty"`
+	Tasks        []tasks.Task        `json:"tasks,omitempty"`
+
+	// Reverse tunnels (tunnel_open): host:port targets the master may relay
+	// TCP connections to, e.g. ["127.0.0.1:8443"]. Empty (default) = off.
+	PortForward []string `json:"port_forward,omitempty"`
+
+	// SOCKS5 egress (tunnel_open with "socks5": true): the master may relay
+	// SOCKS5 clients, e.g. of a proxy on its own loopback, so that their
+	// connections leave from this node. The agent listens on no port; the
+	// handshake runs inside the tunnel's streams. Off unless enabled;
+	// loopback, private and link-local destinations are refused unless
+	// allow_private is set.
+	SOCKS5Egress struct {
+		Enabled      bool `json:"enabled,omitempty"`
+		AllowPrivate bool `json:"allow_private,omitempty"`
+	} `json:"socks5_egress,omitempty"`
+
+	// Packet capture on request (pcap_request), off unless enabled. A
+	// capture runs for at most max_duration_sec (default 60) and returns at
+	// most max_bytes of pcap (default 1 MiB, at most 16 MiB). BPF filters
+	// need tcpdump; without it Linux captures from an AF_PACKET socket.
+	// Both need root or CAP_NET_RAW.
+	Pcap struct {
+		Enabled        bool `json:"enabled,omitempty"`
+		MaxDurationSec int  `json:"max_duration_sec,omitempty"`
+		MaxBytes       int  `json:"max_bytes,omitempty"`
+	} `json:"pcap,omitempty"`
+
+	// Throughput tests (iperf_request) over the iperf3 protocol, off unless
+	// enabled. As server the agent listens on port (default 5201) for one
+	// test; tests run for at most max_duration_sec (default 30).
+	Iperf struct {
+		Enabled        bool `json:"enabled,omitempty"`
+		Port           int  `json:"port,omitempty"`
+		MaxDurationSec int  `json:"max_duration_sec,omitempty"`
+	} `json:"iperf,omitempty"`
+
+	// Path watch, off unless enabled: every interval_sec (default 900) the
+	// agent traces the first max_hops hops (default 6) towards each
+	// tcpping target's address and sends path_change when they differ
+	// from the last trace. Needs Linux.
+	PathWatch struct {
+		Enabled     bool `json:"enabled,omitempty"`
+		IntervalSec int  `json:"interval_sec,omitempty"`
+		MaxHops     int  `json:"max_hops,omitempty"`
+	} `json:"path_watch,omitempty"`
+
+	// Collector plugins: binaries the agent starts and keeps running, and
+	// asks for data every interval_sec (default 60) over the sidecar
+	// protocol of pkg/agentplugin; each answer is sent as plugin_metrics.
+	// Only read from this file, never from the master.
+	Plugins []plugins.Plugin `json:"plugins,omitempty"`
+
+	// Transform script: a Lua file (the subset internal/lua implements)
+	// defining transform(msg), called for every outgoing message of the
+	// listed types (default ["metrics"]) before it is queued. It may
+	// change the message, or return false to drop it.
+	Transform struct {
+		Script string   `json:"script,omitempty"`
+		Types  []string `json:"types,omitempty"`
+	} `json:"transform,omitempty"`
+
+	// Kubernetes node mode, for an agent run as a DaemonSet: the identity
+	// comes from the downward API (NODE_NAME, POD_NAME, POD_NAMESPACE,
+	// HOST_IP), and every interval_sec (default 60) the agent reads the
+	// node's conditions and pods from the API server and its usage from
+	// the kubelet's summary API, reported in metrics `k8s`. The URLs and
+	// credential files default to the in-cluster ones.
+	Kubernetes struct {
+		Enabled     bool   `json:"enabled,omitempty"`
+		Cluster     string `json:"cluster,omitempty"` // part of the derived agent_id
+		IntervalSec int    `json:"interval_sec,omitempty"`
+		APIServer   string `json:"api_server,omitempty"`
+		KubeletURL  string `json:"kubelet_url,omitempty"`
+		TokenFile   string `json:"token_file,omitempty"`
+		CAFile      string `json:"ca_file,omitempty"`
+		// The kubelet's serving certificate is self-signed on many clusters.
+		KubeletInsecureSkipVerify bool `json:"kubelet_insecure_skip_verify,omitempty"`
+	} `json:"kubernetes,omitempty"`
+
+	// Count failed ssh logins (metrics `security.ssh`) from this log: a
+	// file such as /var/log/auth.log, "journald", or "auto" (auth.log or
+	// secure if present, else journald). Empty = off.
+	SSHAuthLog string `json:"ssh_auth_log,omitempty"`
+
+	// Public IP echo services per family, tried in order (default ipify).
+	// Master may replace them via config_push.
+	IPEcho netprobe.Endpoints `json:"ip_echo,omitempty"`
+
+	// Optional location/ASN self-identification (reported in hello):
+	// a JSON endpoint ("url", "{ip}" placeholder) and/or local "mmdb" /
+	// "asn_mmdb" MaxMind files.
+	GeoIP netprobe.GeoOptions `json:"geoip,omitempty"`
+
+	// Cloud instance metadata (reported in hello sys.platform): "auto"
+	// (default) asks the provider the firmware names, or every one on an
+	// unrecognised VM; "aws", "gcp", "azure" or "openstack" asks that one;
+	// "off" never asks. Checked once at startup.
+	CloudMetadata string `json:"cloud_metadata,omitempty"`
+
+	// STUN servers ("host:port") for NAT type detection; empty disables it.
+	STUNServers []string `json:"stun_servers,omitempty"`
+
+	// Reconnect backoff: doubles from reconnect_min_ms (default 1000) to
+	// reconnect_max_ms (default 30000); each wait is shortened by a random
+	// share of up to reconnect_jitter (default 0.5, negative disables) so
+	// agents don't reconnect in lockstep after a master restart.
+	ReconnectMinMS  int     `json:"reconnect_min_ms,omitempty"`
+	ReconnectMaxMS  int     `json:"reconnect_max_ms,omitempty"`
+	ReconnectJitter float64 `json:"reconnect_jitter,omitempty"`
+
+	// Messages to the master go through one writer with a queue of up to
+	// send_queue (default 256). When it is full, metrics, tcpping_batch and
+	// agent_stats are dropped: the oldest queued one (send_queue_policy
+	// "drop_oldest", default) or the new one ("drop_newest"); replies and
+	// events are always queued. A write stalled for send_timeout_ms
+	// (default 10000) drops the connection.
+	SendQueue       int    `json:"send_queue,omitempty"`
+	SendQueuePolicy string `json:"send_queue_policy,omitempty"`
+	SendTimeoutMS   int    `json:"send_timeout_ms,omitempty"`
+
+	// Bytes/s per message class (control, metrics, probes, logs, tunnel), e.g.
+	// {"logs": 32768}. Higher classes are always written first; logs
+	// default to 65536, the rest to unlimited; negative lifts a limit.
+	SendRateLimits map[string]int `json:"send_rate_limits,omitempty"`
+
+	// On shutdown, wait this long for a metrics sample or tcpping round in
+	// progress before sending `bye` and closing. Default 3000.
+	ShutdownTimeoutMS int `json:"shutdown_timeout_ms,omitempty"`
+
+	// Poll config.json this often and reload it when it changes (same as
+	// SIGHUP). Default 2; negative disables.
+	ConfigWatchSec int `json:"config_watch_sec,omitempty"`
+
+	// Interface byte accounting per billing month (reported in agent_stats
+	// as `traffic`, kept in state_dir/traffic.json across restarts and
+	// reboots). iface defaults to net_iface; the month starts on reset_day
+	// (1-28, default 1).
+	//
+	// cap_gb (10^9 bytes) sets a monthly cap on cap_count ("total"
+	// default, "rx", "tx" or "max") with local actions, each taken once per
+	// month when the usage reaches at_pct: warn, throttle or script. The
+	// master may replace these via config_push; its script actions can
+	// only name an entry of scripts (name -> argv), never a command.
+	Traffic struct {
+		Iface    string              `json:"iface,omitempty"`
+		ResetDay int                 `json:"reset_day,omitempty"`
+		CapGB    float64             `json:"cap_gb,omitempty"`
+		CapCount string              `json:"cap_count,omitempty"`
+		Actions  []traffic.Action    `json:"actions,omitempty"`
+		Scripts  map[string][]string `json:"scripts,omitempty"`
+	} `json:"traffic,omitempty"`
+
+	// Threshold rules evaluated on the agent (alert_fire / alert_resolve);
+	// the master may replace them via config_push.
+	AlertRules []alerts.Rule `json:"alert_rules,omitempty"`
+
+	// Local actions on events: a script (event JSON on stdin) and/or a
+	// webhook (event JSON POSTed) for on_disconnect, on_alert and
+	// on_config_push.
+	Hooks hooks.Set `json:"hooks,omitempty"`
+
+	// Local state (capability counters etc). Default: /var/lib/kokoro-agent
+	StateDir string `json:"state_dir,omitempty"`
+
+	// Logging: level debug|info|warn|error (master may change it via
+	// config_push), format text|json, optional file with size rotation.
+	LogLevel      string `json:"log_level,omitempty"`
+	LogFormat     string `json:"log_format,omitempty"`
+	LogFile       string `json:"log_file,omitempty"`
+	LogMaxSizeMB  int    `json:"log_max_size_mb,omitempty"`
+	LogMaxBackups int    `json:"log_max_backups,omitempty"`
+
+	// Serve net/http/pprof on a loopback address (default 127.0.0.1:6060).
+	DebugPprof     bool   `json:"debug_pprof,omitempty"`
+	DebugPprofAddr string `json:"debug_pprof_addr,omitempty"`
+
+	// Outgoing message encoding: json (default), msgpack, cbor, protobuf
+	// (google.protobuf.Struct). The master may choose another in hello_ok.
+	Encoding string `json:"encoding,omitempty"`
+
+	// Largest frame the master should send (announced in hello, default
+	// 1024 KiB; negative: don't announce, the master sends messages whole)
+	// and the largest message reassembled from chunks (default 64 MiB).
+	MaxFrameKB   int `json:"max_frame_kb,omitempty"`
+	MaxMessageMB int `json:"max_message_mb,omitempty"`
+
+	// Hard-disable capabilities locally, e.g. {"tcpping": false}. The
+	// master cannot turn these back on.
+	Capabilities map[string]bool `json:"capabilities,omitempty"`
+
+	// Privilege separation (Linux). Started as root, the agent switches to
+	// this user (name or uid) right after loading the config, handing it
+	// state_dir and keeping only the capabilities enabled features need.
+	RunAsUser string `json:"run_as_user,omitempty"`
+	// While running as root, capabilities that run commands or reach into
+	// the host's networks for the master (scheduled_tasks, plugins,
+	// port_forward, socks5_egress, pcap) stay off unless this is set.
+	AllowRoot bool `json:"allow_root,omitempty"`
+
+	// Secret for signed frames and tls_pin_update, shared with the master
+	// out of band. Unlike the token it never goes over the wire, so a proxy
+	// that sees hello can't forge signatures. Signing is only offered with
+	// a sign_key.
+	SignKey string `json:"sign_key,omitempty"`
+	// Sign every message after hello (HMAC-SHA256 keyed by sign_key) even
+	// if hello_ok doesn't ask for it.
+	SignMessages bool `json:"sign_messages,omitempty"`
+
+	// Static addresses for the master's host, used instead of DNS (a
+	// poisoned or not yet propagated domain); see HostMap.
+	MasterResolve HostMap `json:"master_resolve,omitempty"`
+
+	// Extra headers for the WebSocket upgrade, e.g. "Authorization":
+	// "Bearer ..." or CF-Access-Client-Id/-Secret for an access proxy in
+	// front of the master; "Host" overrides the Host header for
+	// host-based routing.
+	MasterHeaders map[string]string `json:"master_headers,omitempty"`
+
+	// Keepalive: ping the master every ping_interval_sec (default 30) and
+	// reconnect once nothing at all has been read from it, or our pings
+	// went unanswered, for liveness_timeout_sec (default 75; negative
+	// leaves only the 90s read deadline).
+	PingIntervalSec    int `json:"ping_interval_sec,omitempty"`
+	LivenessTimeoutSec int `json:"liveness_timeout_sec,omitempty"`
+
+	// TCP tuning of the master connection: keepalive probe period
+	// (default 15) and TCP_USER_TIMEOUT on linux (default 60: give up once
+	// sent data has gone unacknowledged that long); negative disables
+	// either. Both apply from the next connect.
+	TCPKeepAliveSec   int `json:"tcp_keepalive_sec,omitempty"`
+	TCPUserTimeoutSec int `json:"tcp_user_timeout_sec,omitempty"`
+
+	// Address family tried first when dialing the master: auto (resolver
+	// order), v4 or v6. Both families are raced, so a broken one only
+	// delays the connect by 250ms.
+	PreferIP string `json:"prefer_ip,omitempty"`
+
 	// TLS
 	InsecureSkipVerify bool `json:"insecure_skip_verify,omitempty"`
+	// SNI and certificate name when it differs from master_ws_url's host
+	// (master fronted by a CDN domain; set master_headers.Host for the
+	// origin if the CDN routes by it).
+	TLSServerName string `json:"tls_server_name,omitempty"`
+	// Encrypted Client Hello: base64 ECHConfigList, the "ech" value of the
+	// master domain's HTTPS DNS record. Needs a Go 1.23+ build.
+	TLSECHConfig string `json:"tls_ech_config,omitempty"`
+	// Certificate pins: the master's chain must contain one of them.
+	// "sha256/<base64>" is the SHA-256 of a SubjectPublicKeyInfo (as
+	// `openssl x509 -pubkey | openssl pkey -pubin -outform der | openssl
+	// dgst -sha256 -binary | base64`), "cert-sha256/<base64>" of a whole
+	// certificate. A tls_pin_update from the master replaces them and
+	// moves the old ones to tls_pins_grace until its grace period ends.
+	TLSPins        []string `json:"tls_pins,omitempty"`
+	TLSPinsVersion int64    `json:"tls_pins_version,omitempty"` // last tls_pin_update applied
+	TLSPinsGrace   struct {
+		Pins  []string `json:"pins,omitempty"`
+		Until int64    `json:"until,omitempty"` // unix seconds
+	} `json:"tls_pins_grace,omitempty"`
 
 	// Optional: TCP-PING defaults (master usually pushes targets)
 	TCPPing struct {
 		Enabled     bool `json:"enabled,omitempty"`
 		IntervalSec int  `json:"interval_sec,omitempty"`
+		Concurrency int  `json:"concurrency,omitempty"` // worker pool size (default 16)
+
+		// Built-in target presets to probe ("public-dns", "global-cdn",
+		// "cn-three-carriers", ...) until the master pushes targets.
+		Presets []string `json:"presets,omitempty"`
+
+		// Probe sockets: source port range ("40000-40999") and SO_MARK
+		// fwmark (Linux, needs CAP_NET_ADMIN) for policy routing/firewalls.
+		SrcPorts string `json:"src_ports,omitempty"`
+		Fwmark   int    `json:"fwmark,omitempty"`
+
+		// Send per-target tcpping_summary messages every aggregate_sec
+		// instead of a tcpping_batch per round (0 = off), with RTT
+		// histogram buckets up to histogram_ms (default 5, 10, 20, 50,
+		// 100, 200, 500, 1000).
+		AggregateSec int       `json:"aggregate_sec,omitempty"`
+		HistogramMS  []float64 `json:"histogram_ms,omitempty"`
 	} `json:"tcpping,omitempty"`
 }
 
+const DefaultStateDir = "/var/lib/kokoro-agent"
+
 // Candidate default locations (ordered)
 var defaultPaths = []string{
 	"/etc/kokoro-agent/config.json",
@@ -46,6 +416,16 @@ var defaultPaths = []string{
 }
 
 func Load(explicitPath string) (cfg Config, usedPath string, err error) {
+	return load(explicitPath, true)
+}
+
+// LoadReadOnly is Load without side effects: a missing agent_id is left
+// empty instead of being generated and written back.
+func LoadReadOnly(explicitPath string) (cfg Config, usedPath string, err error) {
+	return load(explicitPath, false)
+}
+
+func load(explicitPath string, persist bool) (cfg Config, usedPath string, err error) {
 	if explicitPath != "" {
 		usedPath = explicitPath
 	} else if env := os.Getenv("KOKORO_CONFIG"); env != "" {
@@ -63,38 +443,201 @@ func Load(explicitPath string) (cfg Config, usedPath string, err error) {
 	}
 
 	b, e := os.ReadFile(usedPath)
-	if e != nil {
+	switch {
+	case e == nil:
+		if e := json.Unmarshal(b, &cfg); e != nil {
+			return cfg, usedPath, parseError(usedPath, b, e)
+		}
+	case errors.Is(e, fs.ErrNotExist) && hasOverrides():
+		// Configured entirely through KOKORO_* / flags (containers).
+	default:
 		return cfg, usedPath, fmt.Errorf("read %s: %w", usedPath, e)
 	}
-	if e := json.Unmarshal(b, &cfg); e != nil {
-		return cfg, usedPath, fmt.Errorf("parse %s: %w", usedPath, e)
+	if e := applyOverrides(&cfg); e != nil {
+		return cfg, usedPath, e
+	}
+
+	if e := Normalize(usedPath, &cfg); e != nil {
+		return cfg, usedPath, e
+	}
+
+	// A DaemonSet pod has nowhere to persist an id: derive it from the
+	// node, so a recreated pod reports as the same agent.
+	if cfg.AgentID == "" && cfg.Kubernetes.Enabled {
+		if node := os.Getenv("NODE_NAME"); node != "" {
+			cfg.AgentID = k8s.AgentID(cfg.Kubernetes.Cluster, node)
+			if cfg.Alias == "" {
+				cfg.Alias = node
+			}
+		}
 	}
 
+	// Generate persistent AgentID on first run.
+	if cfg.AgentID == "" && persist {
+		id := util.NewUUIDv4()
+		if e := Update(usedPath, func(c *Config) { c.AgentID = id }); e != nil {
+			return cfg, usedPath, fmt.Errorf("save generated agent_id: %w", e)
+		}
+		cfg.AgentID = id
+	}
+
+	return cfg, usedPath, nil
+}
+
+// Normalize checks the fields the agent cannot run without and fills in
+// defaults. path only labels errors.
+func Normalize(path string, cfg *Config) error {
 	if cfg.MasterWSURL == "" {
-		return cfg, usedPath, errors.New("master_ws_url is required")
+		return &LoadError{Path: path, Field: "master_ws_url", Msg: "master_ws_url is required",
+			Hint: `add "master_ws_url": "wss://YOUR_DOMAIN/agent/ws"`}
+	}
+	if e := checkMasterURL(path, cfg.MasterWSURL); e != nil {
+		return e
 	}
 	if cfg.Token == "" {
-		return cfg, usedPath, errors.New("token is required")
+		return &LoadError{Path: path, Field: "token", Msg: "token is required",
+			Hint: "copy the agent token from the master UI"}
+	}
+	if _, _, e := tcpping.ParsePortRange(cfg.TCPPing.SrcPorts); e != nil {
+		return &LoadError{Path: path, Field: "tcpping.src_ports", Msg: e.Error(),
+			Hint: `use "LOW-HIGH", e.g. "40000-40999"`}
 	}
 	if cfg.MetricsIntervalMS <= 0 {
 		cfg.MetricsIntervalMS = 1000 // your default
 	}
+	if cfg.DegradedMetricsIntervalMS <= 0 {
+		cfg.DegradedMetricsIntervalMS = 10000
+	}
+	if cfg.CPUSampleMS == 0 {
+		cfg.CPUSampleMS = 1000
+	}
+	if cfg.CPUPressureThreshold <= 0 {
+		cfg.CPUPressureThreshold = 90
+	}
+	if cfg.NetProbeRefreshSec == 0 {
+		cfg.NetProbeRefreshSec = 3600
+	}
+	if cfg.SysinfoRefreshSec == 0 {
+		cfg.SysinfoRefreshSec = 300
+	}
+	if cfg.NetWatchSec == 0 {
+		cfg.NetWatchSec = 30
+	}
+	if cfg.TunnelIntervalSec == 0 {
+		cfg.TunnelIntervalSec = 60
+	}
+	if cfg.PortsIntervalSec == 0 {
+		cfg.PortsIntervalSec = 300
+	}
+	if cfg.WatchIntervalSec == 0 {
+		cfg.WatchIntervalSec = 10
+	}
+	if cfg.Pcap.MaxDurationSec <= 0 {
+		cfg.Pcap.MaxDurationSec = 60
+	}
+	if cfg.Pcap.MaxBytes <= 0 {
+		cfg.Pcap.MaxBytes = 1 << 20
+	}
+	if cfg.Iperf.Port == 0 {
+		cfg.Iperf.Port = 5201
+	}
+	if cfg.Iperf.MaxDurationSec <= 0 {
+		cfg.Iperf.MaxDurationSec = 30
+	}
+	if cfg.PathWatch.IntervalSec <= 0 {
+		cfg.PathWatch.IntervalSec = 900
+	}
+	if cfg.PathWatch.MaxHops <= 0 {
+		cfg.PathWatch.MaxHops = 6
+	}
+	if cfg.Kubernetes.IntervalSec <= 0 {
+		cfg.Kubernetes.IntervalSec = 60
+	}
+	if cfg.Transform.Script != "" && len(cfg.Transform.Types) == 0 {
+		cfg.Transform.Types = []string{"metrics"}
+	}
+	if cfg.ReconnectMinMS <= 0 {
+		cfg.ReconnectMinMS = 1000
+	}
+	if cfg.ReconnectMaxMS <= 0 {
+		cfg.ReconnectMaxMS = 30000
+	}
+	if cfg.ReconnectJitter == 0 {
+		cfg.ReconnectJitter = 0.5
+	}
+	switch cfg.ClockSource {
+	case "":
+		cfg.ClockSource = "auto"
+	case "auto", "system", "monotonic":
+	default:
+		return &LoadError{Path: path, Field: "clock_source",
+			Msg: fmt.Sprintf("clock_source %q: want auto, system or monotonic", cfg.ClockSource)}
+	}
 	if cfg.NetIface == "" {
 		cfg.NetIface = "auto"
 	}
+	if cfg.PingIntervalSec <= 0 {
+		cfg.PingIntervalSec = 30
+	}
+	if cfg.LivenessTimeoutSec == 0 {
+		cfg.LivenessTimeoutSec = 75
+	}
+	if cfg.MaxFrameKB == 0 {
+		cfg.MaxFrameKB = 1024
+	}
+	if cfg.MaxMessageMB <= 0 {
+		cfg.MaxMessageMB = 64
+	}
+	if cfg.TCPKeepAliveSec == 0 {
+		cfg.TCPKeepAliveSec = 15
+	}
+	if cfg.TCPUserTimeoutSec == 0 {
+		cfg.TCPUserTimeoutSec = 60
+	}
+	if cfg.PreferIP == "" {
+		cfg.PreferIP = "auto"
+	}
+	if cfg.StateDir == "" {
+		cfg.StateDir = DefaultStateDir
+	}
+	return nil
+}
 
-	// Generate persistent AgentID on first run.
-	if cfg.AgentID == "" {
-		cfg.AgentID = util.NewUUIDv4()
-		if e := SaveAtomic(usedPath, cfg); e != nil {
-			return cfg, usedPath, fmt.Errorf("save generated agent_id: %w", e)
+// Update rewrites the file at path with fn applied to its contents as
+// written (no defaults, no KOKORO_* / flag overrides), creating it if
+// missing.
+func Update(path string, fn func(*Config)) error {
+	var cfg Config
+	b, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(b, &cfg); err != nil {
+			return parseError(path, b, err)
 		}
+	case !errors.Is(err, fs.ErrNotExist):
+		return err
 	}
-
-	return cfg, usedPath, nil
+	fn(&cfg)
+	return SaveAtomic(path, cfg)
 }
 
+// SaveAtomic replaces the file at path with cfg, keeping the file's mode;
+// a new file is created 0600, as it holds the token.
 func SaveAtomic(path string, cfg Config) error {
+	mode := fs.FileMode(0600)
+	if st, err := os.Stat(path); err == nil {
+		mode = st.Mode().Perm()
+	}
+	return saveAtomic(path, cfg, mode)
+}
+
+// Create is SaveAtomic for a fresh config: the file ends up 0600 even if
+// it replaces one that was readable by others.
+func Create(path string, cfg Config) error {
+	return saveAtomic(path, cfg, 0600)
+}
+
+func saveAtomic(path string, cfg Config, mode fs.FileMode) error {
 	dir := filepath.Dir(path)
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		return err
@@ -105,7 +648,12 @@ func SaveAtomic(path string, cfg Config) error {
 		return err
 	}
 	tmp := fmt.Sprintf("%s.tmp.%d", path, time.Now().UnixNano())
-	if err := os.WriteFile(tmp, b, 0644); err != nil {
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	// WriteFile's mode is masked by the umask
+	if err := os.Chmod(tmp, mode); err != nil {
+		os.Remove(tmp)
 		return err
 	}
 	return os.Rename(tmp, path)
@@ -0,0 +1,151 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// LoadError is a config.json problem with its position (when known) and a
+// hint for the usual mistakes. Error() is multi-line, meant for a terminal
+// or the journal.
+type LoadError struct {
+	Path    string
+	Line    int // 1-based; 0 = not tied to a position
+	Col     int
+	Field   string
+	Msg     string
+	Hint    string
+	Snippet string // offending line
+	Err     error
+}
+
+func (e *LoadError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "config %s", e.Path)
+	if e.Line > 0 {
+		fmt.Fprintf(&b, ":%d:%d", e.Line, e.Col)
+	}
+	fmt.Fprintf(&b, ": %s", e.Msg)
+	if e.Snippet != "" {
+		fmt.Fprintf(&b, "\n    %s\n    %s^", e.Snippet, strings.Repeat(" ", max(e.Col-1, 0)))
+	}
+	if e.Hint != "" {
+		fmt.Fprintf(&b, "\n  hint: %s", e.Hint)
+	}
+	return b.String()
+}
+
+func (e *LoadError) Unwrap() error { return e.Err }
+
+// Attrs returns the failure as key/value pairs for structured logging.
+func (e *LoadError) Attrs() []any {
+	out := []any{"path", e.Path, "error", e.Msg}
+	if e.Line > 0 {
+		out = append(out, "line", e.Line, "col", e.Col)
+	}
+	if e.Field != "" {
+		out = append(out, "field", e.Field)
+	}
+	if e.Hint != "" {
+		out = append(out, "hint", e.Hint)
+	}
+	return out
+}
+
+// parseError turns a json.Unmarshal failure into a positioned LoadError.
+func parseError(path string, b []byte, err error) error {
+	le := &LoadError{Path: path, Msg: err.Error(), Err: err}
+
+	var off int64 = -1
+	var se *json.SyntaxError
+	var te *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &se):
+		off = se.Offset
+		le.Msg = se.Error()
+		le.Hint = syntaxHint(b, se.Offset)
+	case errors.As(err, &te):
+		off = te.Offset
+		le.Field = te.Field
+		le.Msg = fmt.Sprintf("%s: got %s, want %s", te.Field, te.Value, te.Type)
+		if te.Value == "string" && te.Type.Kind().String() != "string" {
+			le.Hint = "remove the quotes around the value"
+		}
+	}
+	if off >= 0 {
+		le.Line, le.Col, le.Snippet = position(b, off)
+	}
+	return le
+}
+
+// position maps a byte offset (as reported by encoding/json, i.e. just past
+// the offending byte) to a 1-based line/column and that line's text.
+func position(b []byte, off int64) (line, col int, text string) {
+	if off > int64(len(b)) {
+		off = int64(len(b))
+	}
+	if off > 0 {
+		off-- // point at the offending byte itself
+	}
+	head := b[:off]
+	line = bytes.Count(head, []byte("\n")) + 1
+	start := bytes.LastIndexByte(head, '\n') + 1
+	col = int(off) - start + 1
+	end := bytes.IndexByte(b[start:], '\n')
+	if end < 0 {
+		end = len(b) - start
+	}
+	text = strings.TrimRight(string(b[start:start+end]), "\r")
+	if len(text) > 120 {
+		text = text[:120]
+	}
+	return line, col, text
+}
+
+func syntaxHint(b []byte, off int64) string {
+	if off <= 0 || off > int64(len(b)) {
+		return ""
+	}
+	c := b[off-1]
+	prev := bytes.TrimRight(b[:off-1], " \t\r\n")
+	switch {
+	case (c == '}' || c == ']') && bytes.HasSuffix(prev, []byte(",")):
+		return "trailing comma before '" + string(c) + "': JSON does not allow it"
+	case c == '\'':
+		return "JSON strings need double quotes (\"), not single quotes"
+	case c == '/' || c == '#':
+		return "JSON does not support comments; remove them"
+	case c == '"' && len(prev) > 0 && (prev[len(prev)-1] == '"' || prev[len(prev)-1] == '}' || prev[len(prev)-1] == ']' || isDigit(prev[len(prev)-1])):
+		return "missing comma between fields"
+	case c == '\n' || off == int64(len(b)):
+		return "file ends early: check for a missing closing brace or quote"
+	}
+	return ""
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+// checkMasterURL validates master_ws_url and suggests the usual fixes.
+func checkMasterURL(path, raw string) error {
+	u, err := url.Parse(raw)
+	le := &LoadError{Path: path, Field: "master_ws_url"}
+	switch {
+	case err != nil:
+		le.Msg = fmt.Sprintf("master_ws_url %q: %v", raw, err)
+	case u.Scheme == "http" || u.Scheme == "https":
+		le.Msg = fmt.Sprintf("master_ws_url %q: scheme must be ws:// or wss://", raw)
+		le.Hint = "use " + strings.Replace(raw, "http", "ws", 1)
+	case u.Scheme != "ws" && u.Scheme != "wss":
+		le.Msg = fmt.Sprintf("master_ws_url %q: scheme must be ws:// or wss://", raw)
+		le.Hint = "e.g. wss://YOUR_DOMAIN/agent/ws"
+	case u.Host == "":
+		le.Msg = fmt.Sprintf("master_ws_url %q: missing host", raw)
+	default:
+		return nil
+	}
+	return le
+}
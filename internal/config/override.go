@@ -0,0 +1,179 @@
+package config
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Every config.json field can be overridden without touching the file:
+//
+//	KOKORO_<PATH>=value      e.g. KOKORO_MASTER_WS_URL, KOKORO_TCPPING_SRC_PORTS
+//	-set <path>=value        e.g. -set tcpping.interval_sec=30
+//
+// <path> is the JSON key, dotted for nested objects; the environment name
+// is the path upper-cased with "." turned into "_". Strings, numbers and
+// bools take the plain value, string lists a comma-separated one, anything
+// else (objects, lists of objects) JSON. Precedence: file < env < flags.
+// Overrides are applied on every Load, so SIGHUP reloads keep them.
+
+const envPrefix = "KOKORO_"
+
+var (
+	ovMu    sync.Mutex
+	flagOvs map[string]string // path -> raw value
+)
+
+// SetOverrides registers command-line overrides (path -> raw value). Paths
+// are checked here so a typo fails at startup.
+func SetOverrides(ovs map[string]string) error {
+	known := fieldIndex()
+	for p := range ovs {
+		if _, ok := known[p]; !ok {
+			return fmt.Errorf("unknown config field %q", p)
+		}
+	}
+	ovMu.Lock()
+	defer ovMu.Unlock()
+	flagOvs = ovs
+	return nil
+}
+
+// Overridden reports whether path is set by the environment or a flag, in
+// which case writing it to config.json has no effect.
+func Overridden(path string) bool {
+	if _, ok := os.LookupEnv(envName(path)); ok {
+		return true
+	}
+	ovMu.Lock()
+	defer ovMu.Unlock()
+	_, ok := flagOvs[path]
+	return ok
+}
+
+// Fields lists every overridable path.
+func Fields() []string {
+	idx := fieldIndex()
+	out := make([]string, 0, len(idx))
+	for p := range idx {
+		out = append(out, p)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func envName(path string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(path, ".", "_"))
+}
+
+// hasOverrides reports whether any override is set at all (a missing
+// config.json is fine then).
+func hasOverrides() bool {
+	for p := range fieldIndex() {
+		if Overridden(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyOverrides sets env then flag values on cfg.
+func applyOverrides(cfg *Config) error {
+	idx := fieldIndex()
+	for _, p := range Fields() {
+		if v, ok := os.LookupEnv(envName(p)); ok {
+			if err := setField(cfg, idx[p], v); err != nil {
+				return &LoadError{Path: "env " + envName(p), Field: p, Msg: err.Error(), Err: err}
+			}
+		}
+	}
+	ovMu.Lock()
+	ovs := flagOvs
+	ovMu.Unlock()
+	for p, v := range ovs {
+		if err := setField(cfg, idx[p], v); err != nil {
+			return &LoadError{Path: "flag", Field: p, Msg: err.Error(), Err: err}
+		}
+	}
+	return nil
+}
+
+// fieldIndex maps every leaf path to its reflect index.
+func fieldIndex() map[string][]int {
+	out := map[string][]int{}
+	walkFields(reflect.TypeOf(Config{}), "", nil, out)
+	return out
+}
+
+func walkFields(t reflect.Type, prefix string, index []int, out map[string][]int) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if !f.IsExported() || name == "-" || name == "" {
+			continue
+		}
+		path := prefix + name
+		idx := append(append([]int(nil), index...), i)
+		if f.Type.Kind() == reflect.Struct {
+			walkFields(f.Type, path+".", idx, out)
+			continue
+		}
+		out[path] = idx
+	}
+}
+
+func setField(cfg *Config, index []int, raw string) error {
+	v := reflect.ValueOf(cfg).Elem().FieldByIndex(index)
+	// types with a plain-text form (master_resolve) take it unless the
+	// value is JSON
+	if u, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok && !strings.HasPrefix(raw, "{") && !strings.HasPrefix(raw, "[") && !strings.HasPrefix(raw, `"`) {
+		return u.UnmarshalText([]byte(raw))
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("%q: want true or false", raw)
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%q: want an integer", raw)
+		}
+		v.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return fmt.Errorf("%q: want a number", raw)
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.String && !strings.HasPrefix(strings.TrimSpace(raw), "[") {
+			var parts []string
+			for _, s := range strings.Split(raw, ",") {
+				if s = strings.TrimSpace(s); s != "" {
+					parts = append(parts, s)
+				}
+			}
+			v.Set(reflect.ValueOf(parts))
+			return nil
+		}
+		fallthrough
+	default:
+		p := reflect.New(v.Type())
+		if err := json.Unmarshal([]byte(raw), p.Interface()); err != nil {
+			return fmt.Errorf("want JSON: %v", err)
+		}
+		v.Set(p.Elem())
+	}
+	return nil
+}
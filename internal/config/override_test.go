@@ -0,0 +1,167 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const baseConfig = `{"master_ws_url": "wss://master.example/agent/ws", "token": "file-token", "agent_id": "a1",
+	"tcpping": {"interval_sec": 5}}`
+
+func writeConfig(t *testing.T, body string) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(p, []byte(body), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func setFlags(t *testing.T, ovs map[string]string) {
+	t.Helper()
+	if err := SetOverrides(ovs); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = SetOverrides(nil) })
+}
+
+func TestOverridePrecedence(t *testing.T) {
+	p := writeConfig(t, baseConfig)
+	load := func() Config {
+		t.Helper()
+		cfg, _, err := LoadReadOnly(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cfg
+	}
+	if got := load().Token; got != "file-token" {
+		t.Errorf("file: token %q", got)
+	}
+	t.Setenv("KOKORO_TOKEN", "env-token")
+	t.Setenv("KOKORO_TCPPING_INTERVAL_SEC", "7")
+	if cfg := load(); cfg.Token != "env-token" || cfg.TCPPing.IntervalSec != 7 {
+		t.Errorf("env: token %q, interval %d", cfg.Token, cfg.TCPPing.IntervalSec)
+	}
+	setFlags(t, map[string]string{"token": "flag-token"})
+	if cfg := load(); cfg.Token != "flag-token" || cfg.TCPPing.IntervalSec != 7 {
+		t.Errorf("flag: token %q, interval %d", cfg.Token, cfg.TCPPing.IntervalSec)
+	}
+	if !Overridden("token") || !Overridden("tcpping.interval_sec") || Overridden("alias") {
+		t.Error("Overridden doesn't match what is set")
+	}
+
+	// Update writes the file as it is, without the overrides
+	if err := Update(p, func(c *Config) { c.Alias = "edge" }); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := os.ReadFile(p)
+	var onDisk Config
+	if err := json.Unmarshal(b, &onDisk); err != nil {
+		t.Fatal(err)
+	}
+	if onDisk.Token != "file-token" || onDisk.TCPPing.IntervalSec != 5 || onDisk.Alias != "edge" {
+		t.Errorf("Update wrote %+v", onDisk)
+	}
+}
+
+func TestOverrideTypes(t *testing.T) {
+	tests := []struct {
+		path, raw string
+		get       func(Config) any
+		want      any
+	}{
+		{"alias", "web 1", func(c Config) any { return c.Alias }, "web 1"},
+		{"tcpping.interval_sec", "30", func(c Config) any { return c.TCPPing.IntervalSec }, 30},
+		{"tcpping.enabled", "true", func(c Config) any { return c.TCPPing.Enabled }, true},
+		{"cpu_pressure_threshold", "0.75", func(c Config) any { return c.CPUPressureThreshold }, 0.75},
+		{"stun_servers", "a:3478, b:3478,,", func(c Config) any { return c.STUNServers }, []string{"a:3478", "b:3478"}},
+		{"stun_servers", `["c:3478"]`, func(c Config) any { return c.STUNServers }, []string{"c:3478"}},
+		{"net_ifaces", `{"wan":"eth0"}`, func(c Config) any { return c.NetIfaces }, map[string]string{"wan": "eth0"}},
+		{"master_resolve", "192.0.2.1:443, 192.0.2.2:443", func(c Config) any { return map[string][]string(c.MasterResolve) },
+			map[string][]string{AnyHost: {"192.0.2.1:443", "192.0.2.2:443"}}},
+		{"master_resolve", `{"master.example":"192.0.2.3"}`, func(c Config) any { return map[string][]string(c.MasterResolve) },
+			map[string][]string{"master.example": {"192.0.2.3"}}},
+	}
+	idx := fieldIndex()
+	for _, tt := range tests {
+		t.Run(tt.path+"="+tt.raw, func(t *testing.T) {
+			var cfg Config
+			if err := setField(&cfg, idx[tt.path], tt.raw); err != nil {
+				t.Fatal(err)
+			}
+			if got := tt.get(cfg); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOverrideErrors(t *testing.T) {
+	p := writeConfig(t, baseConfig)
+	tests := []struct {
+		env, val, field string
+	}{
+		{"KOKORO_TCPPING_INTERVAL_SEC", "soon", "tcpping.interval_sec"},
+		{"KOKORO_TCPPING_ENABLED", "yes please", "tcpping.enabled"},
+		{"KOKORO_CPU_PRESSURE_THRESHOLD", "high", "cpu_pressure_threshold"},
+		{"KOKORO_NET_IFACES", "{wan", "net_ifaces"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.env, func(t *testing.T) {
+			t.Setenv(tt.env, tt.val)
+			_, _, err := LoadReadOnly(p)
+			var le *LoadError
+			if !errors.As(err, &le) || le.Field != tt.field || !strings.Contains(le.Path, tt.env) {
+				t.Errorf("got %v, want a LoadError for %s", err, tt.field)
+			}
+		})
+	}
+
+	if err := SetOverrides(map[string]string{"tcpping.intervalsec": "1"}); err == nil {
+		t.Error("unknown -set path accepted")
+	}
+	setFlags(t, map[string]string{"tcpping.interval_sec": "x"})
+	var le *LoadError
+	if _, _, err := LoadReadOnly(p); !errors.As(err, &le) || le.Path != "flag" {
+		t.Errorf("bad flag value: %v", err)
+	}
+}
+
+func TestOverridesWithoutFile(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "missing.json")
+	if _, _, err := LoadReadOnly(p); err == nil {
+		t.Fatal("missing file without overrides loaded")
+	}
+	t.Setenv("KOKORO_MASTER_WS_URL", "wss://master.example/agent/ws")
+	t.Setenv("KOKORO_TOKEN", "t")
+	t.Setenv("KOKORO_AGENT_ID", "a2")
+	cfg, _, err := LoadReadOnly(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.AgentID != "a2" || cfg.StateDir != DefaultStateDir {
+		t.Errorf("got agent_id %q, state_dir %q", cfg.AgentID, cfg.StateDir)
+	}
+}
+
+func TestFields(t *testing.T) {
+	fields := Fields()
+	for _, want := range []string{"master_ws_url", "tcpping.interval_sec", "tls_pins_grace.until", "socks5_egress.enabled"} {
+		found := false
+		for _, f := range fields {
+			found = found || f == want
+		}
+		if !found {
+			t.Errorf("%s not overridable", want)
+		}
+	}
+	if got := envName("tcpping.src_ports"); got != "KOKORO_TCPPING_SRC_PORTS" {
+		t.Errorf("envName = %s", got)
+	}
+}
@@ -0,0 +1,108 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// AnyHost is the HostMap key of addresses given without a host name.
+const AnyHost = "*"
+
+// HostMap is master_resolve: static addresses for the master's host name,
+// used instead of DNS. It accepts one address or a list for whatever host
+// master_ws_url names,
+//
+//	"master_resolve": "203.0.113.5"
+//	"master_resolve": ["203.0.113.5", "2001:db8::5"]
+//
+// or a hosts-style object keyed by name:
+//
+//	"master_resolve": {"master.example.com": "203.0.113.5"}
+type HostMap map[string][]string
+
+// Lookup returns the static addresses for host, if any.
+func (m HostMap) Lookup(host string) []string {
+	if a, ok := m[host]; ok {
+		return a
+	}
+	return m[AnyHost]
+}
+
+func (m *HostMap) UnmarshalJSON(b []byte) error {
+	var addrs []string
+	if err := unmarshalAddrs(b, &addrs); err == nil {
+		*m = HostMap{AnyHost: addrs}
+		return nil
+	}
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(b, &obj); err != nil {
+		return errors.New(`want an address, a list of addresses or {"host": address(es)}`)
+	}
+	out := make(HostMap, len(obj))
+	for host, raw := range obj {
+		var addrs []string
+		if err := unmarshalAddrs(raw, &addrs); err != nil {
+			return fmt.Errorf("%s: %v", host, err)
+		}
+		out[host] = addrs
+	}
+	*m = out
+	return nil
+}
+
+// MarshalJSON writes the form it was read in.
+func (m HostMap) MarshalJSON() ([]byte, error) {
+	if a, ok := m[AnyHost]; ok && len(m) == 1 {
+		if len(a) == 1 {
+			return json.Marshal(a[0])
+		}
+		return json.Marshal(a)
+	}
+	return json.Marshal(map[string][]string(m))
+}
+
+// UnmarshalText takes comma-separated addresses (KOKORO_MASTER_RESOLVE,
+// -set master_resolve=...).
+func (m *HostMap) UnmarshalText(b []byte) error {
+	var addrs []string
+	for _, s := range strings.Split(string(b), ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			addrs = append(addrs, s)
+		}
+	}
+	*m = HostMap{AnyHost: addrs}
+	return nil
+}
+
+func unmarshalAddrs(b []byte, out *[]string) error {
+	var one string
+	if err := json.Unmarshal(b, &one); err == nil {
+		*out = []string{one}
+		return nil
+	}
+	if err := json.Unmarshal(b, out); err != nil {
+		return errors.New("want an address or a list of addresses")
+	}
+	return nil
+}
+
+// check reports the first entry that is not an IP literal.
+func (m HostMap) check() error {
+	for host, addrs := range m {
+		if len(addrs) == 0 {
+			return fmt.Errorf("%s: no addresses", host)
+		}
+		for _, a := range addrs {
+			if net.ParseIP(a) == nil {
+				if host == AnyHost {
+					return fmt.Errorf("%q is not an IP address", a)
+				}
+				return fmt.Errorf("%s: %q is not an IP address", host, a)
+			}
+		}
+	}
+	return nil
+}
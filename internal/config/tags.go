@@ -0,0 +1,35 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// MaxTags bounds `tags`, in config.json and in a push.
+const MaxTags = 32
+
+// CheckTags validates grouping tags: at most MaxTags distinct ones of 1-64
+// letters, digits and - _ . : / =.
+func CheckTags(tags []string) error {
+	if len(tags) > MaxTags {
+		return fmt.Errorf("%d tags, want at most %d", len(tags), MaxTags)
+	}
+	seen := make(map[string]bool, len(tags))
+	for _, t := range tags {
+		if t == "" || len(t) > 64 || strings.IndexFunc(t, badTagChar) >= 0 {
+			return fmt.Errorf("%q: want 1-64 letters, digits or - _ . : / =", t)
+		}
+		if seen[t] {
+			return fmt.Errorf("%q is listed twice", t)
+		}
+		seen[t] = true
+	}
+	return nil
+}
+
+func badTagChar(r rune) bool {
+	if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+		return false
+	}
+	return !strings.ContainsRune("-_.:/=", r)
+}
@@ -0,0 +1,352 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/Vincentkeio/agent/internal/codec"
+	"github.com/Vincentkeio/agent/internal/hooks"
+	"github.com/Vincentkeio/agent/internal/logx"
+	"github.com/Vincentkeio/agent/internal/lua"
+	"github.com/Vincentkeio/agent/internal/netprobe"
+	"github.com/Vincentkeio/agent/internal/platform"
+	"github.com/Vincentkeio/agent/internal/plugins"
+	"github.com/Vincentkeio/agent/internal/presets"
+	"github.com/Vincentkeio/agent/internal/privdrop"
+	"github.com/Vincentkeio/agent/internal/procwatch"
+	"github.com/Vincentkeio/agent/internal/tasks"
+	"github.com/Vincentkeio/agent/internal/ws"
+)
+
+// Validate checks a loaded config for values Load accepts but the agent
+// would reject, ignore or choke on at runtime (ranges, enums, URLs, preset
+// names). path is only used to label the problems.
+func Validate(path string, cfg Config) []*LoadError {
+	var out []*LoadError
+	bad := func(field, format string, args ...any) {
+		out = append(out, &LoadError{Path: path, Field: field, Msg: field + ": " + fmt.Sprintf(format, args...)})
+	}
+
+	if err := CheckTags(cfg.Tags); err != nil {
+		bad("tags", "%v", err)
+	}
+	if cfg.MetricsIntervalMS < 100 || cfg.MetricsIntervalMS > 3600_000 {
+		bad("metrics_interval_ms", "%d: want 100-3600000", cfg.MetricsIntervalMS)
+	}
+	if cfg.DegradedMetricsIntervalMS < cfg.MetricsIntervalMS {
+		bad("degraded_metrics_interval_ms", "%d is below metrics_interval_ms (%d)", cfg.DegradedMetricsIntervalMS, cfg.MetricsIntervalMS)
+	}
+	if cfg.CPUSampleMS > 0 && cfg.CPUSampleMS < 100 {
+		bad("cpu_sample_ms", "%d: want at least 100", cfg.CPUSampleMS)
+	}
+	if cfg.BatchMS > 60_000 {
+		bad("batch_ms", "%d: want at most 60000", cfg.BatchMS)
+	}
+	if cfg.RollupSec > 86400 {
+		bad("rollup_sec", "%d: want at most 86400", cfg.RollupSec)
+	}
+	if cfg.TCPPing.AggregateSec > 3600 {
+		bad("tcpping.aggregate_sec", "%d: want at most 3600", cfg.TCPPing.AggregateSec)
+	}
+	for i, b := range cfg.TCPPing.HistogramMS {
+		if b <= 0 || i > 0 && b <= cfg.TCPPing.HistogramMS[i-1] {
+			bad("tcpping.histogram_ms", "%v: want ascending positive bounds", cfg.TCPPing.HistogramMS)
+			break
+		}
+	}
+	if cfg.ReconnectMaxMS < cfg.ReconnectMinMS {
+		bad("reconnect_max_ms", "%d is below reconnect_min_ms (%d)", cfg.ReconnectMaxMS, cfg.ReconnectMinMS)
+	}
+	if cfg.ReconnectJitter > 1 {
+		bad("reconnect_jitter", "%g: want 0-1", cfg.ReconnectJitter)
+	}
+	switch cfg.SendQueuePolicy {
+	case "", "drop_oldest", "drop_newest":
+	default:
+		bad("send_queue_policy", "%q: want drop_oldest or drop_newest", cfg.SendQueuePolicy)
+	}
+	for class := range cfg.SendRateLimits {
+		switch class {
+		case "control", "metrics", "probes", "logs", "tunnel":
+		default:
+			bad("send_rate_limits", "unknown class %q: want control, metrics, probes, logs or tunnel", class)
+		}
+	}
+	if cfg.Traffic.ResetDay < 0 || cfg.Traffic.ResetDay > 28 {
+		bad("traffic.reset_day", "%d: want 1-28", cfg.Traffic.ResetDay)
+	}
+	if cfg.Traffic.CapGB < 0 {
+		bad("traffic.cap_gb", "%g: want a positive size in GB", cfg.Traffic.CapGB)
+	}
+	switch cfg.Traffic.CapCount {
+	case "", "total", "rx", "tx", "max":
+	default:
+		bad("traffic.cap_count", "%q: want total, rx, tx or max", cfg.Traffic.CapCount)
+	}
+	for name, argv := range cfg.Traffic.Scripts {
+		if len(argv) == 0 || argv[0] == "" {
+			bad("traffic.scripts."+name, "needs a command")
+		}
+	}
+	for i, act := range cfg.Traffic.Actions {
+		field := fmt.Sprintf("traffic.actions[%d]", i)
+		if err := act.Check(); err != nil {
+			bad(field, "%v", err)
+		} else if _, ok := cfg.Traffic.Scripts[act.Script]; act.Script != "" && !ok {
+			bad(field, "script %q is not in traffic.scripts", act.Script)
+		}
+	}
+	seen := map[string]bool{}
+	for i, r := range cfg.AlertRules {
+		field := fmt.Sprintf("alert_rules[%d]", i)
+		if err := r.Check(); err != nil {
+			bad(field, "%v", err)
+		} else if seen[r.ID] {
+			bad(field, "duplicate id %q", r.ID)
+		}
+		seen[r.ID] = true
+	}
+	if err := procwatch.CheckList(cfg.Watch); err != nil {
+		bad("watch", "%v", err)
+	}
+	for name, argv := range cfg.TaskCommands {
+		if len(argv) == 0 || argv[0] == "" {
+			bad("task_commands."+name, "needs a command")
+		}
+	}
+	if err := tasks.CheckList(cfg.Tasks); err != nil {
+		bad("tasks", "%v", err)
+	}
+	for i, t := range cfg.Tasks {
+		if _, ok := cfg.TaskCommands[t.Command]; !ok && t.Command != "" {
+			bad(fmt.Sprintf("tasks[%d]", i), "command %q is not in task_commands", t.Command)
+		}
+	}
+	for i, t := range cfg.PortForward {
+		_, port, err := net.SplitHostPort(t)
+		if n, perr := strconv.Atoi(port); err != nil || perr != nil || n < 1 || n > 65535 {
+			bad(fmt.Sprintf("port_forward[%d]", i), "%q: want host:port", t)
+		}
+	}
+	if cfg.Pcap.MaxDurationSec > 600 {
+		bad("pcap.max_duration_sec", "%d: want at most 600", cfg.Pcap.MaxDurationSec)
+	}
+	if cfg.Pcap.MaxBytes < 4096 || cfg.Pcap.MaxBytes > 16<<20 {
+		bad("pcap.max_bytes", "%d: want 4096-16777216", cfg.Pcap.MaxBytes)
+	}
+	if cfg.Iperf.Port < 1 || cfg.Iperf.Port > 65535 {
+		bad("iperf.port", "%d: want 1-65535", cfg.Iperf.Port)
+	}
+	if cfg.Iperf.MaxDurationSec > 300 {
+		bad("iperf.max_duration_sec", "%d: want at most 300", cfg.Iperf.MaxDurationSec)
+	}
+	if cfg.PathWatch.IntervalSec < 60 {
+		bad("path_watch.interval_sec", "%d: want at least 60", cfg.PathWatch.IntervalSec)
+	}
+	if cfg.PathWatch.MaxHops > 30 {
+		bad("path_watch.max_hops", "%d: want at most 30", cfg.PathWatch.MaxHops)
+	}
+	if err := plugins.CheckList(cfg.Plugins); err != nil {
+		bad("plugins", "%v", err)
+	}
+	if s := cfg.Transform.Script; s != "" {
+		if err := checkScript(s); err != nil {
+			bad("transform.script", "%v", err)
+		}
+	}
+	for _, t := range cfg.Transform.Types {
+		switch t {
+		case "metrics", "plugin_metrics", "tunnel_status", "ports", "proc_status", "netprobe_update", "path_change":
+		default:
+			bad("transform.types", "%q: want metrics, plugin_metrics, tunnel_status, ports, proc_status, netprobe_update or path_change", t)
+		}
+	}
+	if cfg.Kubernetes.Enabled && cfg.Kubernetes.IntervalSec < 10 {
+		bad("kubernetes.interval_sec", "%d: want at least 10", cfg.Kubernetes.IntervalSec)
+	}
+	for field, u := range map[string]string{
+		"kubernetes.api_server":  cfg.Kubernetes.APIServer,
+		"kubernetes.kubelet_url": cfg.Kubernetes.KubeletURL,
+	} {
+		if u != "" && !isHTTPURL(u) {
+			bad(field, "%q: want an http(s) URL", u)
+		}
+	}
+	for name, h := range map[string]*hooks.Hook{
+		"hooks.on_disconnect":  cfg.Hooks.OnDisconnect,
+		"hooks.on_alert":       cfg.Hooks.OnAlert,
+		"hooks.on_config_push": cfg.Hooks.OnConfigPush,
+	} {
+		if h == nil {
+			continue
+		}
+		if err := h.Check(); err != nil {
+			bad(name, "%v", err)
+		}
+	}
+	if cfg.LivenessTimeoutSec > 0 && cfg.LivenessTimeoutSec <= cfg.PingIntervalSec {
+		bad("liveness_timeout_sec", "%d is not above ping_interval_sec (%d)", cfg.LivenessTimeoutSec, cfg.PingIntervalSec)
+	}
+	if err := cfg.MasterResolve.check(); err != nil {
+		bad("master_resolve", "%v", err)
+	}
+	if s := cfg.TLSServerName; s != "" && (strings.ContainsAny(s, ":/ ") || net.ParseIP(s) != nil) {
+		bad("tls_server_name", "%q: want a host name", s)
+	}
+	if _, err := ws.CheckECH(cfg.TLSECHConfig); err != nil {
+		bad("tls_ech_config", "%v", err)
+	}
+	if k := cfg.SignKey; k != "" && len(k) < 32 {
+		bad("sign_key", "%d characters: want at least 32", len(k))
+	}
+	if cfg.SignMessages && cfg.SignKey == "" {
+		bad("sign_messages", "needs sign_key")
+	}
+	if cfg.RunAsUser != "" {
+		if uid, _, err := privdrop.Lookup(cfg.RunAsUser); err != nil {
+			bad("run_as_user", "%v", err)
+		} else if uid == 0 {
+			bad("run_as_user", "%q is root", cfg.RunAsUser)
+		}
+	}
+	if len(cfg.TLSPins) > 0 && !strings.HasPrefix(cfg.MasterWSURL, "wss://") {
+		bad("tls_pins", "master_ws_url isn't wss://")
+	}
+	if len(cfg.TLSPins) > 16 {
+		bad("tls_pins", "%d pins: at most 16", len(cfg.TLSPins))
+	}
+	for _, p := range cfg.TLSPins {
+		if _, err := ws.ParsePin(p); err != nil {
+			bad("tls_pins", "%v", err)
+		}
+	}
+	for _, p := range cfg.TLSPinsGrace.Pins {
+		if _, err := ws.ParsePin(p); err != nil {
+			bad("tls_pins_grace.pins", "%v", err)
+		}
+	}
+	if cfg.MaxFrameKB > 0 && (cfg.MaxFrameKB < 4 || cfg.MaxFrameKB > 32<<10) {
+		bad("max_frame_kb", "%d: want 4 to 32768", cfg.MaxFrameKB)
+	}
+	if err := ws.CheckHeaders(cfg.MasterHeaders); err != nil {
+		bad("master_headers", "%v", err)
+	}
+	if err := ws.CheckPreferIP(cfg.PreferIP); err != nil {
+		bad("prefer_ip", "%v", err)
+	}
+	if len(cfg.NetIfaces) > 16 {
+		bad("net_ifaces", "%d interfaces: at most 16", len(cfg.NetIfaces))
+	}
+	for label, iface := range cfg.NetIfaces {
+		if label == "" || iface == "" || strings.ContainsAny(iface, " :/") {
+			bad("net_ifaces", "%q: %q: want a label and an interface name", label, iface)
+		}
+	}
+	switch s := cfg.SSHAuthLog; {
+	case s == "", s == "auto", s == "journald", filepath.IsAbs(s):
+	default:
+		bad("ssh_auth_log", "%q: want a log file path, \"journald\" or \"auto\"", s)
+	}
+	if cfg.NetProbeRefreshSec > 0 && cfg.NetProbeRefreshSec < 60 {
+		bad("netprobe_refresh_sec", "%d: want >= 60 (or negative to disable)", cfg.NetProbeRefreshSec)
+	}
+	if cfg.SysinfoRefreshSec > 0 && cfg.SysinfoRefreshSec < 10 {
+		bad("sysinfo_refresh_sec", "%d: want >= 10 (or negative to disable)", cfg.SysinfoRefreshSec)
+	}
+	if cfg.NetWatchSec > 0 && cfg.NetWatchSec < 5 {
+		bad("net_watch_sec", "%d: want >= 5 (or negative to disable)", cfg.NetWatchSec)
+	}
+
+	if _, err := logx.ParseLevel(cfg.LogLevel); cfg.LogLevel != "" && err != nil {
+		bad("log_level", "%v", err)
+	}
+	switch strings.ToLower(cfg.LogFormat) {
+	case "", "text", "json":
+	default:
+		bad("log_format", "%q: want text or json", cfg.LogFormat)
+	}
+	if cfg.LogMaxSizeMB < 0 || cfg.LogMaxBackups < 0 {
+		bad("log_max_size_mb", "log_max_size_mb and log_max_backups must not be negative")
+	}
+	if cfg.Encoding != "" && !slices.Contains(codec.Names(), cfg.Encoding) {
+		bad("encoding", "%q: want one of %s", cfg.Encoding, strings.Join(codec.Names(), ", "))
+	}
+	if cfg.DebugPprofAddr != "" {
+		if _, _, err := net.SplitHostPort(cfg.DebugPprofAddr); err != nil {
+			bad("debug_pprof_addr", "%v", err)
+		}
+	}
+
+	checkEndpoints := func(field string, eps []netprobe.Endpoint) {
+		for i, ep := range eps {
+			if !isHTTPURL(ep.URL) {
+				bad(fmt.Sprintf("%s[%d].url", field, i), "%q: want an http(s) URL", ep.URL)
+			}
+			if ep.Format != "" && ep.Format != "json" && ep.Format != "text" {
+				bad(fmt.Sprintf("%s[%d].format", field, i), "%q: want json or text", ep.Format)
+			}
+		}
+	}
+	checkEndpoints("ip_echo.ipv4", cfg.IPEcho.IPv4)
+	checkEndpoints("ip_echo.ipv6", cfg.IPEcho.IPv6)
+	switch c := cfg.CloudMetadata; {
+	case c == "", c == "auto", c == "off", slices.Contains(platform.Providers, c):
+	default:
+		bad("cloud_metadata", "%q: want auto, off, %s", c, strings.Join(platform.Providers, ", "))
+	}
+	if cfg.GeoIP.URL != "" && !isHTTPURL(cfg.GeoIP.URL) {
+		bad("geoip.url", "%q: want an http(s) URL", cfg.GeoIP.URL)
+	}
+	for i, s := range cfg.STUNServers {
+		if _, _, err := net.SplitHostPort(s); err != nil {
+			bad(fmt.Sprintf("stun_servers[%d]", i), "%q: want host:port", s)
+		}
+	}
+
+	tp := cfg.TCPPing
+	if tp.IntervalSec < 0 || tp.IntervalSec > 86400 {
+		bad("tcpping.interval_sec", "%d: want 0-86400", tp.IntervalSec)
+	}
+	if tp.Concurrency < 0 || tp.Concurrency > 1024 {
+		bad("tcpping.concurrency", "%d: want 0-1024", tp.Concurrency)
+	}
+	if tp.Fwmark < 0 {
+		bad("tcpping.fwmark", "%d is negative", tp.Fwmark)
+	}
+	cat := presets.Load(cfg.StateDir)
+	if _, missing := cat.Expand(tp.Presets); len(missing) > 0 {
+		bad("tcpping.presets", "unknown %s (known: %s)", strings.Join(missing, ", "), strings.Join(cat.Names(), ", "))
+	}
+	return out
+}
+
+// checkScript loads a transform script the way the agent will.
+func checkScript(path string) error {
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("%q: want an absolute path", path)
+	}
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	st, err := lua.Load(filepath.Base(path), string(src))
+	if err != nil {
+		return err
+	}
+	if !st.HasFunction("transform") {
+		return errors.New("defines no function transform(msg)")
+	}
+	return nil
+}
+
+func isHTTPURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
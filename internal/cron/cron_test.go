@@ -0,0 +1,130 @@
+package cron
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		expr, msg string
+	}{
+		{"", "want 5 fields"},
+		{"* * * *", "want 5 fields"},
+		{"* * * * * *", "want 5 fields"},
+		{"@often", "want 5 fields"},
+		{"60 * * * *", "minute"},
+		{"* 24 * * *", "hour"},
+		{"* * 0 * *", "day-of-month"},
+		{"* * 32 * *", "day-of-month"},
+		{"* * * 13 *", "month"},
+		{"* * * * 8", "day-of-week"},
+		{"5-1 * * * *", "out of range"},
+		{"*/0 * * * *", "bad step"},
+		{"*/-1 * * * *", "bad step"},
+		{"*/x * * * *", "bad step"},
+		{"a * * * *", "bad value"},
+		{"1-x * * * *", "bad range"},
+		{"-5 * * * *", "bad range"},
+		{"1,,2 * * * *", "bad value"},
+		{"1- * * * *", "bad range"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			_, err := Parse(tt.expr)
+			if err == nil {
+				t.Fatal("parsed")
+			}
+			if !strings.Contains(err.Error(), tt.msg) {
+				t.Errorf("error %q doesn't mention %q", err, tt.msg)
+			}
+		})
+	}
+}
+
+func at(s string) time.Time {
+	t, err := time.Parse("2006-01-02 15:04", s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		expr string
+		yes  []string
+		no   []string
+	}{
+		{"* * * * *", []string{"2024-01-01 00:00", "2024-12-31 23:59"}, nil},
+		{"30 2 * * *", []string{"2024-03-05 02:30"}, []string{"2024-03-05 02:31", "2024-03-05 03:30"}},
+		{"*/15 * * * *", []string{"2024-01-01 10:00", "2024-01-01 10:45"}, []string{"2024-01-01 10:20"}},
+		{"10-20/5 * * * *", []string{"2024-01-01 10:10", "2024-01-01 10:20"}, []string{"2024-01-01 10:25", "2024-01-01 10:12"}},
+		{"5/20 * * * *", []string{"2024-01-01 10:05", "2024-01-01 10:45"}, []string{"2024-01-01 10:00"}},
+		{"0,30 9,17 * * *", []string{"2024-01-01 09:30", "2024-01-01 17:00"}, []string{"2024-01-01 12:00"}},
+		// 2024-01-07 is a Sunday: 0 and 7 both mean it
+		{"0 0 * * 0", []string{"2024-01-07 00:00"}, []string{"2024-01-08 00:00"}},
+		{"0 0 * * 7", []string{"2024-01-07 00:00"}, []string{"2024-01-06 00:00"}},
+		{"0 0 * * 1-5", []string{"2024-01-08 00:00", "2024-01-12 00:00"}, []string{"2024-01-13 00:00"}},
+		// both day fields restricted: either one matching is enough
+		{"0 0 13 * 5", []string{"2024-01-13 00:00", "2024-01-05 00:00"}, []string{"2024-01-06 00:00"}},
+		// only one restricted: it alone decides
+		{"0 0 13 * *", []string{"2024-01-13 00:00"}, []string{"2024-01-05 00:00"}},
+		{"0 0 1 1 *", []string{"2025-01-01 00:00"}, []string{"2025-02-01 00:00"}},
+		{"@hourly", []string{"2024-01-01 05:00"}, []string{"2024-01-01 05:01"}},
+		{"@weekly", []string{"2024-01-07 00:00"}, []string{"2024-01-08 00:00"}},
+		{" @daily ", []string{"2024-01-02 00:00"}, []string{"2024-01-02 01:00"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			s, err := Parse(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, ts := range tt.yes {
+				if !s.Match(at(ts)) {
+					t.Errorf("doesn't match %s", ts)
+				}
+			}
+			for _, ts := range tt.no {
+				if s.Match(at(ts)) {
+					t.Errorf("matches %s", ts)
+				}
+			}
+		})
+	}
+}
+
+func TestNext(t *testing.T) {
+	tests := []struct {
+		expr, from, want string
+	}{
+		{"* * * * *", "2024-01-01 10:00", "2024-01-01 10:01"},
+		{"0 * * * *", "2024-01-01 10:00", "2024-01-01 11:00"},
+		{"0 0 * * *", "2024-12-31 23:59", "2025-01-01 00:00"},
+		{"0 0 29 2 *", "2024-03-01 00:00", "2028-02-29 00:00"},
+		{"0 0 31 * *", "2024-04-01 00:00", "2024-05-31 00:00"},
+		{"15 14 1 * *", "2024-01-01 14:15", "2024-02-01 14:15"},
+		{"0 0 * * 1", "2024-01-03 12:00", "2024-01-08 00:00"},
+		{"0 0 30 2 *", "2024-01-01 00:00", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr+" from "+tt.from, func(t *testing.T) {
+			s, err := Parse(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := s.Next(at(tt.from).Add(30 * time.Second))
+			if tt.want == "" {
+				if !got.IsZero() {
+					t.Errorf("got %v, want none", got)
+				}
+				return
+			}
+			if want := at(tt.want); !got.Equal(want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+// Package hooks runs user-configured local actions on agent events: a
+// script that gets the event JSON on stdin, and/or a webhook that gets it
+// POSTed.
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	defaultTimeout = 10 * time.Second
+	// maxRunning bounds hooks in flight; further events are dropped (and
+	// logged) until one finishes.
+	maxRunning = 4
+)
+
+// Hook is one configured action. Either or both of Command and URL may be
+// set.
+type Hook struct {
+	Command    []string          `json:"command,omitempty"`
+	URL        string            `json:"url,omitempty"`
+	Headers    map[string]string `json:"headers,omitempty"` // webhook only
+	TimeoutSec int               `json:"timeout_sec,omitempty"`
+}
+
+// Set is the per-event hook configuration.
+type Set struct {
+	OnDisconnect *Hook `json:"on_disconnect,omitempty"`
+	OnAlert      *Hook `json:"on_alert,omitempty"`
+	OnConfigPush *Hook `json:"on_config_push,omitempty"`
+}
+
+// Check validates a single hook.
+func (h Hook) Check() error {
+	if len(h.Command) == 0 && h.URL == "" {
+		return errors.New("needs a command or a url")
+	}
+	if h.URL != "" {
+		u, err := url.Parse(h.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("url %q: want http(s)://host/...", h.URL)
+		}
+	}
+	if h.TimeoutSec < 0 {
+		return fmt.Errorf("timeout_sec %d: want >= 0", h.TimeoutSec)
+	}
+	return nil
+}
+
+var running = make(chan struct{}, maxRunning)
+
+// Fire runs h (if set) in the background with event and its data merged
+// into one JSON object: {"event": "...", ...data}.
+func Fire(h *Hook, event string, data map[string]any) {
+	if h == nil {
+		return
+	}
+	body := map[string]any{"event": event}
+	for k, v := range data {
+		body[k] = v
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		slog.Error("hook: encode event", "event", event, "err", err)
+		return
+	}
+	select {
+	case running <- struct{}{}:
+	default:
+		slog.Warn("hook skipped: too many hooks running", "event", event)
+		return
+	}
+	go func() {
+		defer func() { <-running }()
+		timeout := defaultTimeout
+		if h.TimeoutSec > 0 {
+			timeout = time.Duration(h.TimeoutSec) * time.Second
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if len(h.Command) > 0 {
+			if err := runScript(ctx, h.Command, event, b); err != nil {
+				slog.Warn("hook script failed", "event", event, "cmd", h.Command, "err", err)
+			}
+		}
+		if h.URL != "" {
+			if err := post(ctx, h, b); err != nil {
+				slog.Warn("hook webhook failed", "event", event, "url", h.URL, "err", err)
+			}
+		}
+	}()
+}
+
+func runScript(ctx context.Context, command []string, event string, b []byte) error {
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Env = append(os.Environ(), "KOKORO_EVENT="+event)
+	cmd.Stdin = bytes.NewReader(b)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func post(ctx context.Context, h *Hook, b []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range h.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,18 @@
+package iperf
+
+import "time"
+
+// cpuUsage is the process's CPU time so far.
+type cpuUsage struct{ user, sys time.Duration }
+
+func (u cpuUsage) sub(v cpuUsage) cpuUsage {
+	return cpuUsage{user: u.user - v.user, sys: u.sys - v.sys}
+}
+
+// pct is the usage as a share of elapsed, in percent of one CPU.
+func (u cpuUsage) pct(elapsed time.Duration) (user, sys float64) {
+	if elapsed <= 0 {
+		return 0, 0
+	}
+	return 100 * u.user.Seconds() / elapsed.Seconds(), 100 * u.sys.Seconds() / elapsed.Seconds()
+}
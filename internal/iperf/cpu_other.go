@@ -0,0 +1,5 @@
+//go:build !unix
+
+package iperf
+
+func cpuTime() cpuUsage { return cpuUsage{} }
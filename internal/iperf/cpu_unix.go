@@ -0,0 +1,19 @@
+//go:build unix
+
+package iperf
+
+import (
+	"syscall"
+	"time"
+)
+
+func cpuTime() cpuUsage {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return cpuUsage{}
+	}
+	return cpuUsage{
+		user: time.Duration(ru.Utime.Nano()),
+		sys:  time.Duration(ru.Stime.Nano()),
+	}
+}
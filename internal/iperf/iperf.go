@@ -0,0 +1,524 @@
+// Package iperf runs TCP throughput tests over the iperf3 protocol, so an
+// agent can test against another agent as well as against a stock iperf3
+// server or client. Only what a TCP test needs is implemented: parallel
+// streams and reverse mode, no UDP, bidirectional or authentication.
+package iperf
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultPort is iperf3's.
+	DefaultPort = 5201
+	// MaxParallel bounds the streams of a test.
+	MaxParallel = 16
+
+	blockLen    = 128 << 10
+	maxBlockLen = 1 << 20
+	cookieLen   = 37 // 36 characters and a NUL
+	ctlTimeout  = 10 * time.Second
+)
+
+// Control states (iperf.h); each travels as one signed byte.
+const (
+	testStart       = 1
+	testRunning     = 2
+	testEnd         = 4
+	paramExchange   = 9
+	createStreams   = 10
+	serverTerminate = 11
+	clientTerminate = 12
+	exchangeResults = 13
+	displayResults  = 14
+	iperfDone       = 16
+	accessDenied    = -1
+	serverError     = -2
+)
+
+// Options are a client's test parameters.
+type Options struct {
+	Duration time.Duration // whole seconds
+	Parallel int           // streams, 1 if zero
+	Reverse  bool          // the server sends
+}
+
+// Result is one side's view of a finished test.
+type Result struct {
+	Peer     string  // the other side's address
+	Sender   bool    // this side sent the data
+	Parallel int     // streams
+	Reverse  bool    // the server sent
+	Seconds  float64 // length of the transfer
+	// Bytes is what the receiving side got: this side's count when it
+	// received, else the peer's as reported in the results exchange (this
+	// side's sent count if the peer didn't report).
+	Bytes     int64
+	SentBytes int64   // the sending side's count, likewise
+	Mbps      float64 // Bytes over Seconds
+	// Retransmits are the sender's TCP retransmissions (TCP_INFO); -1 when
+	// the sender can't tell.
+	Retransmits int
+	CPUPct      float64 // this process, user + system, over the transfer
+	PeerCPUPct  float64 // as the peer reported it; -1 unknown
+}
+
+// params is the test description a client sends. iperf3 treats keys such
+// as reverse and udp as set when present, so false ones must be left out.
+type params struct {
+	TCP           bool   `json:"tcp,omitempty"`
+	Omit          int    `json:"omit"`
+	Time          int    `json:"time"`
+	Num           int64  `json:"num"`
+	Blockcount    int64  `json:"blockcount"`
+	Parallel      int    `json:"parallel"`
+	Reverse       bool   `json:"reverse,omitempty"`
+	Len           int    `json:"len"`
+	PacingTimer   int    `json:"pacing_timer"`
+	ClientVersion string `json:"client_version"`
+}
+
+// results is what each side sends in the results exchange.
+type results struct {
+	CPUTotal             float64        `json:"cpu_util_total"`
+	CPUUser              float64        `json:"cpu_util_user"`
+	CPUSystem            float64        `json:"cpu_util_system"`
+	SenderHasRetransmits int            `json:"sender_has_retransmits"`
+	Streams              []streamResult `json:"streams"`
+}
+
+type streamResult struct {
+	ID          int     `json:"id"`
+	Bytes       int64   `json:"bytes"`
+	Retransmits int     `json:"retransmits"`
+	Jitter      float64 `json:"jitter"`
+	Errors      int64   `json:"errors"`
+	Packets     int64   `json:"packets"`
+	StartTime   float64 `json:"start_time"`
+	EndTime     float64 `json:"end_time"`
+}
+
+type stream struct {
+	id    int
+	conn  net.Conn
+	bytes atomic.Int64
+}
+
+// streamID numbers streams the way iperf3 does (1, 3, 4, 5, ...); both
+// sides must agree, results are matched by id.
+func streamID(i int) int {
+	if i == 0 {
+		return 1
+	}
+	return i + 2
+}
+
+// Client runs a test against the iperf3 server at addr (host:port).
+func Client(ctx context.Context, addr string, o Options) (Result, error) {
+	res := Result{Peer: addr, Sender: !o.Reverse, Parallel: max(o.Parallel, 1), Reverse: o.Reverse, Retransmits: -1, PeerCPUPct: -1}
+	secs := int(o.Duration / time.Second)
+	if secs < 1 {
+		return res, errors.New("duration must be at least 1s")
+	}
+	if res.Parallel > MaxParallel {
+		return res, fmt.Errorf("parallel %d: at most %d", res.Parallel, MaxParallel)
+	}
+	d := net.Dialer{Timeout: ctlTimeout}
+	ctl, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return res, err
+	}
+	defer ctl.Close()
+	stopCtl := context.AfterFunc(ctx, func() { ctl.Close() })
+	defer stopCtl()
+	res.Peer = ctl.RemoteAddr().String()
+
+	cookie := newCookie()
+	ctl.SetDeadline(time.Now().Add(ctlTimeout))
+	if _, err := ctl.Write(cookie); err != nil {
+		return res, err
+	}
+	if err := expect(ctl, paramExchange); err != nil {
+		return res, err
+	}
+	p := params{TCP: true, Time: secs, Parallel: res.Parallel, Reverse: o.Reverse, Len: blockLen, PacingTimer: 1000, ClientVersion: "3.9"}
+	if err := writeJSON(ctl, p); err != nil {
+		return res, err
+	}
+	if err := expect(ctl, createStreams); err != nil {
+		return res, err
+	}
+	var streams []*stream
+	defer func() {
+		for _, s := range streams {
+			s.conn.Close()
+		}
+	}()
+	for i := 0; i < res.Parallel; i++ {
+		c, err := d.DialContext(ctx, "tcp", ctl.RemoteAddr().String())
+		if err != nil {
+			return res, fmt.Errorf("stream: %w", err)
+		}
+		streams = append(streams, &stream{id: streamID(i), conn: c})
+		c.SetWriteDeadline(time.Now().Add(ctlTimeout))
+		if _, err := c.Write(cookie); err != nil {
+			return res, fmt.Errorf("stream: %w", err)
+		}
+		c.SetWriteDeadline(time.Time{})
+	}
+	if err := expect(ctl, testStart); err != nil {
+		return res, err
+	}
+	if err := expect(ctl, testRunning); err != nil {
+		return res, err
+	}
+
+	ctl.SetDeadline(time.Time{})
+	cpu0, start := cpuTime(), time.Now()
+	stop := make(chan struct{})
+	wait := transfer(streams, res.Sender, blockLen, stop)
+	select {
+	case <-time.After(o.Duration):
+	case <-ctx.Done():
+	}
+	close(stop)
+	wait()
+	elapsed := time.Since(start)
+	if ctx.Err() != nil {
+		_ = writeState(ctl, clientTerminate)
+		return res, ctx.Err()
+	}
+	local := localResults(streams, res.Sender, elapsed, cpuTime().sub(cpu0))
+
+	ctl.SetDeadline(time.Now().Add(ctlTimeout))
+	if err := writeState(ctl, testEnd); err != nil {
+		return res, err
+	}
+	if err := expect(ctl, exchangeResults); err != nil {
+		return res, err
+	}
+	if err := writeJSON(ctl, local); err != nil {
+		return res, err
+	}
+	var peer results
+	if err := readJSON(ctl, &peer); err != nil {
+		return res, fmt.Errorf("results: %w", err)
+	}
+	if err := expect(ctl, displayResults); err == nil {
+		_ = writeState(ctl, iperfDone)
+	}
+	fill(&res, local, &peer, elapsed)
+	return res, nil
+}
+
+// Serve runs one test for the first client that connects to ln before
+// ctx ends (or ln's deadline passes), and closes ln once the test's
+// streams are connected. Clients
+// asking for more than maxDuration, for UDP or for bidirectional mode are
+// refused as busy, the only refusal iperf3 clients understand.
+func Serve(ctx context.Context, ln net.Listener, maxDuration time.Duration) (Result, error) {
+	res := Result{Retransmits: -1, PeerCPUPct: -1}
+	var lnOnce sync.Once
+	closeLn := func() { lnOnce.Do(func() { ln.Close() }) }
+	defer closeLn()
+	stopLn := context.AfterFunc(ctx, closeLn)
+	defer stopLn()
+
+	ctl, err := ln.Accept()
+	if err != nil {
+		if ctx.Err() != nil || errors.Is(err, os.ErrDeadlineExceeded) {
+			return res, errors.New("no client connected")
+		}
+		return res, err
+	}
+	defer ctl.Close()
+	stopCtl := context.AfterFunc(ctx, func() { ctl.Close() })
+	defer stopCtl()
+	res.Peer = ctl.RemoteAddr().String()
+
+	ctl.SetDeadline(time.Now().Add(ctlTimeout))
+	cookie := make([]byte, cookieLen)
+	if _, err := io.ReadFull(ctl, cookie); err != nil {
+		return res, err
+	}
+	if err := writeState(ctl, paramExchange); err != nil {
+		return res, err
+	}
+	var p map[string]any
+	if err := readJSON(ctl, &p); err != nil {
+		return res, fmt.Errorf("params: %w", err)
+	}
+	secs, _ := p["time"].(float64)
+	parallel, _ := p["parallel"].(float64)
+	blen, _ := p["len"].(float64)
+	_, res.Reverse = p["reverse"]
+	res.Sender = res.Reverse
+	res.Parallel = max(int(parallel), 1)
+	var refuse error
+	switch {
+	case p["tcp"] == nil || p["udp"] != nil || p["sctp"] != nil:
+		refuse = errors.New("only TCP tests are supported")
+	case p["bidirectional"] != nil:
+		refuse = errors.New("bidirectional tests are not supported")
+	case secs < 1:
+		refuse = errors.New("only timed tests are supported")
+	case time.Duration(secs)*time.Second > maxDuration:
+		refuse = fmt.Errorf("client asked for %gs, at most %gs", secs, maxDuration.Seconds())
+	case res.Parallel > MaxParallel:
+		refuse = fmt.Errorf("client asked for %d streams, at most %d", res.Parallel, MaxParallel)
+	}
+	if refuse != nil {
+		_ = writeState(ctl, accessDenied)
+		return res, refuse
+	}
+	sendLen := blockLen
+	if blen > 0 {
+		sendLen = min(int(blen), maxBlockLen)
+	}
+
+	if err := writeState(ctl, createStreams); err != nil {
+		return res, err
+	}
+	var streams []*stream
+	defer func() {
+		for _, s := range streams {
+			s.conn.Close()
+		}
+	}()
+	if tl, ok := ln.(interface{ SetDeadline(time.Time) error }); ok {
+		tl.SetDeadline(time.Now().Add(ctlTimeout))
+	}
+	for len(streams) < res.Parallel {
+		c, err := ln.Accept()
+		if err != nil {
+			return res, fmt.Errorf("stream: %w", err)
+		}
+		got := make([]byte, cookieLen)
+		c.SetDeadline(time.Now().Add(ctlTimeout))
+		if _, err := io.ReadFull(c, got); err != nil || string(got) != string(cookie) {
+			// another client: iperf3 tells it the server is busy
+			_ = writeState(c, accessDenied)
+			c.Close()
+			continue
+		}
+		c.SetDeadline(time.Time{})
+		streams = append(streams, &stream{id: streamID(len(streams)), conn: c})
+	}
+	closeLn()
+
+	if err := writeState(ctl, testStart); err != nil {
+		return res, err
+	}
+	if err := writeState(ctl, testRunning); err != nil {
+		return res, err
+	}
+	cpu0, start := cpuTime(), time.Now()
+	stop := make(chan struct{})
+	wait := transfer(streams, res.Sender, sendLen, stop)
+	// the client ends the test; give it a little slack over its time
+	ctl.SetDeadline(start.Add(time.Duration(secs)*time.Second + ctlTimeout))
+	st, err := readState(ctl)
+	close(stop)
+	wait()
+	elapsed := time.Since(start)
+	switch {
+	case err != nil:
+		return res, fmt.Errorf("waiting for the end of the test: %w", err)
+	case st == clientTerminate:
+		return res, errors.New("client ended the test early")
+	case st != testEnd:
+		return res, fmt.Errorf("unexpected state %d from client", st)
+	}
+	local := localResults(streams, res.Sender, elapsed, cpuTime().sub(cpu0))
+
+	ctl.SetDeadline(time.Now().Add(ctlTimeout))
+	if err := writeState(ctl, exchangeResults); err != nil {
+		return res, err
+	}
+	var peer results
+	if err := readJSON(ctl, &peer); err != nil {
+		return res, fmt.Errorf("results: %w", err)
+	}
+	if err := writeJSON(ctl, local); err != nil {
+		return res, err
+	}
+	if err := writeState(ctl, displayResults); err != nil {
+		return res, err
+	}
+	_, _ = readState(ctl) // iperf_done
+	fill(&res, local, &peer, elapsed)
+	return res, nil
+}
+
+// transfer moves data on every stream until stop; the returned func
+// waits for the streams to settle.
+func transfer(streams []*stream, send bool, blen int, stop <-chan struct{}) func() {
+	var wg sync.WaitGroup
+	for _, s := range streams {
+		wg.Add(1)
+		go func(s *stream) {
+			defer wg.Done()
+			buf := make([]byte, blen)
+			for {
+				var n int
+				var err error
+				if send {
+					n, err = s.conn.Write(buf)
+				} else {
+					n, err = s.conn.Read(buf)
+				}
+				s.bytes.Add(int64(n))
+				if err != nil {
+					return
+				}
+			}
+		}(s)
+	}
+	go func() {
+		<-stop
+		for _, s := range streams {
+			s.conn.SetDeadline(time.Now()) // unblock reads and writes
+		}
+	}()
+	return wg.Wait
+}
+
+func localResults(streams []*stream, sender bool, elapsed time.Duration, cpu cpuUsage) results {
+	r := results{SenderHasRetransmits: -1}
+	r.CPUUser, r.CPUSystem = cpu.pct(elapsed)
+	r.CPUTotal = r.CPUUser + r.CPUSystem
+	if sender {
+		r.SenderHasRetransmits = 1
+	}
+	for _, s := range streams {
+		sr := streamResult{ID: s.id, Bytes: s.bytes.Load(), Retransmits: -1, EndTime: elapsed.Seconds()}
+		if sender {
+			if n, ok := retransmits(s.conn); ok {
+				sr.Retransmits = n
+			} else {
+				r.SenderHasRetransmits = 0
+			}
+		}
+		r.Streams = append(r.Streams, sr)
+	}
+	return r
+}
+
+// fill completes res from both sides' results.
+func fill(res *Result, local results, peer *results, elapsed time.Duration) {
+	res.Seconds = elapsed.Seconds()
+	res.CPUPct = local.CPUTotal
+	res.PeerCPUPct = peer.CPUTotal
+	var mine, theirs int64
+	for _, s := range local.Streams {
+		mine += s.Bytes
+	}
+	for _, s := range peer.Streams {
+		theirs += s.Bytes
+	}
+	sender := &local
+	if res.Sender {
+		res.SentBytes, res.Bytes = mine, theirs
+		if len(peer.Streams) == 0 {
+			res.Bytes = mine
+		}
+	} else {
+		res.SentBytes, res.Bytes = theirs, mine
+		sender = peer
+	}
+	if sender.SenderHasRetransmits == 1 {
+		res.Retransmits = 0
+		for _, s := range sender.Streams {
+			res.Retransmits += max(s.Retransmits, 0)
+		}
+	}
+	if res.Seconds > 0 {
+		res.Mbps = float64(res.Bytes) * 8 / res.Seconds / 1e6
+	}
+}
+
+func newCookie() []byte {
+	const chars = "abcdefghijklmnopqrstuvwxyz234567"
+	b := make([]byte, cookieLen)
+	_, _ = rand.Read(b)
+	for i := range b[:cookieLen-1] {
+		b[i] = chars[int(b[i])%len(chars)]
+	}
+	b[cookieLen-1] = 0
+	return b
+}
+
+func writeState(c net.Conn, st int8) error {
+	_, err := c.Write([]byte{byte(st)})
+	return err
+}
+
+func readState(c net.Conn) (int8, error) {
+	var b [1]byte
+	if _, err := io.ReadFull(c, b[:]); err != nil {
+		return 0, err
+	}
+	return int8(b[0]), nil
+}
+
+// expect reads the next state from the server, turning refusals into
+// errors.
+func expect(c net.Conn, want int8) error {
+	st, err := readState(c)
+	if err != nil {
+		return err
+	}
+	switch st {
+	case want:
+		return nil
+	case accessDenied:
+		return errors.New("server is busy or refused the test")
+	case serverError:
+		var e [8]byte
+		if _, err := io.ReadFull(c, e[:]); err != nil {
+			return errors.New("server error")
+		}
+		return fmt.Errorf("server error %d (errno %d)", int32(binary.BigEndian.Uint32(e[:4])), int32(binary.BigEndian.Uint32(e[4:])))
+	case serverTerminate:
+		return errors.New("server ended the test")
+	}
+	return fmt.Errorf("unexpected state %d from server, want %d", st, want)
+}
+
+// writeJSON and readJSON frame JSON with a 4-byte big-endian length.
+func writeJSON(c net.Conn, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	msg := binary.BigEndian.AppendUint32(nil, uint32(len(b)))
+	_, err = c.Write(append(msg, b...))
+	return err
+}
+
+func readJSON(c net.Conn, v any) error {
+	var n [4]byte
+	if _, err := io.ReadFull(c, n[:]); err != nil {
+		return err
+	}
+	size := binary.BigEndian.Uint32(n[:])
+	if size > 1<<20 {
+		return fmt.Errorf("%d byte message", size)
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(c, b); err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
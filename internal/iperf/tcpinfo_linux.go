@@ -0,0 +1,39 @@
+//go:build linux && !386
+
+// 386 has no getsockopt syscall of its own (it goes through socketcall),
+// so it gets the stub in tcpinfo_other.go.
+
+package iperf
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// tcpi_total_retrans in struct tcp_info (linux/tcp.h)
+const tcpInfoTotalRetransOff = 100
+
+// retransmits reads the connection's total retransmitted segments.
+func retransmits(c net.Conn) (int, bool) {
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		return 0, false
+	}
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return 0, false
+	}
+	var info [232]byte
+	size := uint32(len(info))
+	var errno syscall.Errno
+	err = rc.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.IPPROTO_TCP, syscall.TCP_INFO,
+			uintptr(unsafe.Pointer(&info[0])), uintptr(unsafe.Pointer(&size)), 0)
+	})
+	if err != nil || errno != 0 || size < tcpInfoTotalRetransOff+4 {
+		return 0, false
+	}
+	return int(binary.NativeEndian.Uint32(info[tcpInfoTotalRetransOff:])), true
+}
@@ -0,0 +1,9 @@
+//go:build !linux || 386
+
+package iperf
+
+import "net"
+
+// retransmits needs TCP_INFO as Linux has it, through a getsockopt
+// syscall linux/386 lacks.
+func retransmits(net.Conn) (int, bool) { return 0, false }
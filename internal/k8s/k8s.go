@@ -0,0 +1,373 @@
+// Package k8s reads what an agent running as a DaemonSet pod can learn
+// about its Kubernetes node: its identity from the downward API, the
+// node's conditions and pods from the API server, and resource usage
+// from the kubelet's summary API.
+package k8s
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// ServiceAccountDir holds the pod's service account token and the
+	// cluster CA.
+	ServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	// KubeletPort is the kubelet's authenticated HTTPS port.
+	KubeletPort = 10250
+	// MaxTopPods bounds the pods listed by CPU usage.
+	MaxTopPods = 10
+
+	timeout = 10 * time.Second
+	maxBody = 32 << 20
+)
+
+// Identity is the pod's place in the cluster, from environment variables
+// the DaemonSet sets through the downward API: NODE_NAME (spec.nodeName),
+// POD_NAME (metadata.name), POD_NAMESPACE (metadata.namespace) and
+// HOST_IP (status.hostIP).
+type Identity struct {
+	Cluster   string `json:"cluster,omitempty"` // from config, not the downward API
+	Node      string `json:"node"`
+	Pod       string `json:"pod,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	HostIP    string `json:"host_ip,omitempty"`
+}
+
+// IdentityFromEnv reads the downward-API variables.
+func IdentityFromEnv() Identity {
+	return Identity{
+		Node:      os.Getenv("NODE_NAME"),
+		Pod:       os.Getenv("POD_NAME"),
+		Namespace: os.Getenv("POD_NAMESPACE"),
+		HostIP:    os.Getenv("HOST_IP"),
+	}
+}
+
+// AgentID derives a stable agent_id for a node, so that a pod recreated
+// without persistent storage reports as the same agent: a name-based
+// (version 5 style) UUID of the cluster and node names.
+func AgentID(cluster, node string) string {
+	h := sha1.Sum([]byte("kokoro-agent/k8s\x00" + cluster + "\x00" + node))
+	h[6] = h[6]&0x0f | 0x50
+	h[8] = h[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", h[0:4], h[4:6], h[6:8], h[8:10], h[10:16])
+}
+
+// Options locate the API server and kubelet; zero values use the
+// in-cluster defaults.
+type Options struct {
+	APIServer  string // default https://$KUBERNETES_SERVICE_HOST:$KUBERNETES_SERVICE_PORT
+	KubeletURL string // default https://HOST_IP:10250
+	TokenFile  string // default ServiceAccountDir/token
+	CAFile     string // default ServiceAccountDir/ca.crt
+	// KubeletInsecure skips verifying the kubelet's serving certificate,
+	// which is self-signed on many clusters.
+	KubeletInsecure bool
+}
+
+// Client fetches Node reports for one node.
+type Client struct {
+	id                Identity
+	api, kubelet      string
+	tokenFile         string
+	apiHTTP, kubeHTTP *http.Client
+}
+
+// NewClient checks id and o and prepares the HTTP clients.
+func NewClient(id Identity, o Options) (*Client, error) {
+	if id.Node == "" {
+		return nil, errors.New("no node name: set NODE_NAME from spec.nodeName")
+	}
+	c := &Client{id: id, api: o.APIServer, kubelet: o.KubeletURL, tokenFile: o.TokenFile}
+	if c.api == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, errors.New("not in a cluster (no KUBERNETES_SERVICE_HOST): set kubernetes.api_server")
+		}
+		c.api = "https://" + net.JoinHostPort(host, port)
+	}
+	if c.kubelet == "" {
+		host := id.HostIP
+		if host == "" {
+			host = "127.0.0.1" // hostNetwork pods share the node's loopback
+		}
+		c.kubelet = "https://" + net.JoinHostPort(host, strconv.Itoa(KubeletPort))
+	}
+	c.api, c.kubelet = strings.TrimRight(c.api, "/"), strings.TrimRight(c.kubelet, "/")
+	if c.tokenFile == "" {
+		c.tokenFile = filepath.Join(ServiceAccountDir, "token")
+	}
+	caFile := o.CAFile
+	if caFile == "" {
+		caFile = filepath.Join(ServiceAccountDir, "ca.crt")
+	}
+	var pool *x509.CertPool
+	if pem, err := os.ReadFile(caFile); err == nil {
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates", caFile)
+		}
+	} else if o.CAFile != "" {
+		return nil, err
+	}
+	c.apiHTTP = httpClient(&tls.Config{RootCAs: pool})
+	c.kubeHTTP = httpClient(&tls.Config{RootCAs: pool, InsecureSkipVerify: o.KubeletInsecure})
+	return c, nil
+}
+
+func httpClient(tc *tls.Config) *http.Client {
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: &http.Transport{TLSClientConfig: tc, Proxy: nil, MaxIdleConns: 2, IdleConnTimeout: 5 * time.Minute},
+	}
+}
+
+// Node is the node's state as metrics report it (`k8s`). Sources that
+// fail leave their fields out and add to Errs.
+type Node struct {
+	TS             int64             `json:"ts"` // when it was fetched
+	Name           string            `json:"name"`
+	Conditions     map[string]string `json:"conditions,omitempty"` // Ready, MemoryPressure, ...: True, False or Unknown
+	Unschedulable  bool              `json:"unschedulable,omitempty"`
+	KubeletVersion string            `json:"kubelet_version,omitempty"`
+	PodsCapacity   int               `json:"pods_capacity,omitempty"`
+	Pods           *PodCounts        `json:"pods,omitempty"`
+	Usage          *Usage            `json:"usage,omitempty"`
+	TopPods        []PodUsage        `json:"top_pods,omitempty"` // by CPU, at most MaxTopPods
+	Errs           []string          `json:"errs,omitempty"`
+}
+
+// PodCounts are the node's pods by phase, with the containers' restarts.
+type PodCounts struct {
+	Total     int   `json:"total"`
+	Running   int   `json:"running"`
+	Pending   int   `json:"pending"`
+	Succeeded int   `json:"succeeded"`
+	Failed    int   `json:"failed"`
+	NotReady  int   `json:"not_ready"` // running but not Ready
+	Restarts  int64 `json:"restarts"`  // sum over all containers
+}
+
+// Usage is the node's resource usage as the kubelet sees it.
+type Usage struct {
+	CPUMillicores         float64 `json:"cpu_millicores"`
+	MemoryWorkingSetBytes uint64  `json:"memory_working_set_bytes"`
+	MemoryAvailableBytes  uint64  `json:"memory_available_bytes,omitempty"`
+	FSUsedBytes           uint64  `json:"fs_used_bytes,omitempty"`
+	FSCapacityBytes       uint64  `json:"fs_capacity_bytes,omitempty"`
+	ImageFSUsedBytes      uint64  `json:"imagefs_used_bytes,omitempty"`
+	ImageFSCapacityBytes  uint64  `json:"imagefs_capacity_bytes,omitempty"`
+}
+
+// PodUsage is one pod's usage from the summary API.
+type PodUsage struct {
+	Namespace             string  `json:"namespace"`
+	Name                  string  `json:"name"`
+	CPUMillicores         float64 `json:"cpu_millicores"`
+	MemoryWorkingSetBytes uint64  `json:"memory_working_set_bytes"`
+}
+
+// Fetch asks the API server for the node and its pods and the kubelet for
+// usage.
+func (c *Client) Fetch(ctx context.Context) Node {
+	n := Node{TS: time.Now().Unix(), Name: c.id.Node}
+	fail := func(what string, err error) {
+		n.Errs = append(n.Errs, what+": "+err.Error())
+	}
+	if err := c.node(ctx, &n); err != nil {
+		fail("node", err)
+	}
+	if err := c.pods(ctx, &n); err != nil {
+		fail("pods", err)
+	}
+	if err := c.summary(ctx, &n); err != nil {
+		fail("summary", err)
+	}
+	return n
+}
+
+func (c *Client) node(ctx context.Context, n *Node) error {
+	var node struct {
+		Spec struct {
+			Unschedulable bool `json:"unschedulable"`
+		} `json:"spec"`
+		Status struct {
+			Capacity   map[string]string `json:"capacity"`
+			Conditions []struct {
+				Type   string `json:"type"`
+				Status string `json:"status"`
+			} `json:"conditions"`
+			NodeInfo struct {
+				KubeletVersion string `json:"kubeletVersion"`
+			} `json:"nodeInfo"`
+		} `json:"status"`
+	}
+	if err := c.get(ctx, c.apiHTTP, c.api+"/api/v1/nodes/"+url.PathEscape(c.id.Node), &node); err != nil {
+		return err
+	}
+	n.Unschedulable = node.Spec.Unschedulable
+	n.KubeletVersion = node.Status.NodeInfo.KubeletVersion
+	n.PodsCapacity, _ = strconv.Atoi(node.Status.Capacity["pods"])
+	n.Conditions = make(map[string]string, len(node.Status.Conditions))
+	for _, cond := range node.Status.Conditions {
+		n.Conditions[cond.Type] = cond.Status
+	}
+	return nil
+}
+
+func (c *Client) pods(ctx context.Context, n *Node) error {
+	var list struct {
+		Items []struct {
+			Status struct {
+				Phase      string `json:"phase"`
+				Conditions []struct {
+					Type   string `json:"type"`
+					Status string `json:"status"`
+				} `json:"conditions"`
+				ContainerStatuses []struct {
+					RestartCount int64 `json:"restartCount"`
+				} `json:"containerStatuses"`
+			} `json:"status"`
+		} `json:"items"`
+	}
+	q := url.Values{"fieldSelector": {"spec.nodeName=" + c.id.Node}}
+	if err := c.get(ctx, c.apiHTTP, c.api+"/api/v1/pods?"+q.Encode(), &list); err != nil {
+		return err
+	}
+	p := &PodCounts{Total: len(list.Items)}
+	for _, it := range list.Items {
+		switch it.Status.Phase {
+		case "Running":
+			p.Running++
+			ready := false
+			for _, cond := range it.Status.Conditions {
+				if cond.Type == "Ready" {
+					ready = cond.Status == "True"
+				}
+			}
+			if !ready {
+				p.NotReady++
+			}
+		case "Pending":
+			p.Pending++
+		case "Succeeded":
+			p.Succeeded++
+		case "Failed":
+			p.Failed++
+		}
+		for _, cs := range it.Status.ContainerStatuses {
+			p.Restarts += cs.RestartCount
+		}
+	}
+	n.Pods = p
+	return nil
+}
+
+// summary reads the kubelet's /stats/summary.
+func (c *Client) summary(ctx context.Context, n *Node) error {
+	type fsStats struct {
+		UsedBytes     uint64 `json:"usedBytes"`
+		CapacityBytes uint64 `json:"capacityBytes"`
+	}
+	type cpuStats struct {
+		UsageNanoCores uint64 `json:"usageNanoCores"`
+	}
+	type memStats struct {
+		WorkingSetBytes uint64 `json:"workingSetBytes"`
+		AvailableBytes  uint64 `json:"availableBytes"`
+	}
+	var s struct {
+		Node struct {
+			CPU     cpuStats `json:"cpu"`
+			Memory  memStats `json:"memory"`
+			FS      fsStats  `json:"fs"`
+			Runtime struct {
+				ImageFS fsStats `json:"imageFs"`
+			} `json:"runtime"`
+		} `json:"node"`
+		Pods []struct {
+			PodRef struct {
+				Name      string `json:"name"`
+				Namespace string `json:"namespace"`
+			} `json:"podRef"`
+			CPU    cpuStats `json:"cpu"`
+			Memory memStats `json:"memory"`
+		} `json:"pods"`
+	}
+	if err := c.get(ctx, c.kubeHTTP, c.kubelet+"/stats/summary", &s); err != nil {
+		return err
+	}
+	n.Usage = &Usage{
+		CPUMillicores:         millicores(s.Node.CPU.UsageNanoCores),
+		MemoryWorkingSetBytes: s.Node.Memory.WorkingSetBytes,
+		MemoryAvailableBytes:  s.Node.Memory.AvailableBytes,
+		FSUsedBytes:           s.Node.FS.UsedBytes,
+		FSCapacityBytes:       s.Node.FS.CapacityBytes,
+		ImageFSUsedBytes:      s.Node.Runtime.ImageFS.UsedBytes,
+		ImageFSCapacityBytes:  s.Node.Runtime.ImageFS.CapacityBytes,
+	}
+	top := make([]PodUsage, 0, len(s.Pods))
+	for _, p := range s.Pods {
+		top = append(top, PodUsage{
+			Namespace:             p.PodRef.Namespace,
+			Name:                  p.PodRef.Name,
+			CPUMillicores:         millicores(p.CPU.UsageNanoCores),
+			MemoryWorkingSetBytes: p.Memory.WorkingSetBytes,
+		})
+	}
+	sort.Slice(top, func(i, j int) bool { return top[i].CPUMillicores > top[j].CPUMillicores })
+	if len(top) > MaxTopPods {
+		top = top[:MaxTopPods]
+	}
+	n.TopPods = top
+	return nil
+}
+
+func millicores(nano uint64) float64 {
+	return float64(nano/10_000) / 100
+}
+
+// get fetches u with the service account token and decodes the JSON.
+func (c *Client) get(ctx context.Context, hc *http.Client, u string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	// bound tokens rotate, so read it every time
+	if tok, err := os.ReadFile(c.tokenFile); err == nil {
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(tok)))
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		var st struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(msg, &st) == nil && st.Message != "" {
+			return fmt.Errorf("%s: %s", resp.Status, st.Message)
+		}
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, maxBody)).Decode(v)
+}
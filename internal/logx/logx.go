@@ -0,0 +1,82 @@
+package logx
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Options configures the process-wide logger.
+type Options struct {
+	Level      string // debug|info|warn|error (default info)
+	Format     string // text|json (default text)
+	File       string // empty = stdout (journald)
+	MaxSizeMB  int    // rotate after this size (default 10)
+	MaxBackups int    // rotated files to keep (default 3)
+}
+
+var level = new(slog.LevelVar)
+
+// Setup installs the default slog logger. It can be called again (e.g. after
+// a config reload); the previous log file is closed.
+func Setup(opt Options) error {
+	if err := SetLevel(opt.Level); err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if opt.File != "" {
+		rf, err := openRotating(opt.File, opt.MaxSizeMB, opt.MaxBackups)
+		if err != nil {
+			return err
+		}
+		swapFile(rf)
+		w = rf
+	} else {
+		swapFile(nil)
+	}
+
+	hopt := &slog.HandlerOptions{Level: level}
+	var h slog.Handler
+	switch strings.ToLower(opt.Format) {
+	case "", "text":
+		h = slog.NewTextHandler(w, hopt)
+	case "json":
+		h = slog.NewJSONHandler(w, hopt)
+	default:
+		return fmt.Errorf("unknown log_format %q (want text or json)", opt.Format)
+	}
+	slog.SetDefault(slog.New(h))
+	return nil
+}
+
+// SetLevel changes the level at runtime; "" means info.
+func SetLevel(s string) error {
+	l, err := ParseLevel(s)
+	if err != nil {
+		return err
+	}
+	level.Set(l)
+	return nil
+}
+
+// Level returns the current level name in lower case.
+func Level() string {
+	return strings.ToLower(level.Level().String())
+}
+
+func ParseLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
@@ -0,0 +1,106 @@
+package logx
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// rotatingFile is an io.Writer that renames path -> path.1 -> path.2 ...
+// once the current file exceeds max bytes.
+type rotatingFile struct {
+	mu      sync.Mutex
+	path    string
+	max     int64
+	backups int
+	f       *os.File
+	size    int64
+}
+
+var (
+	curMu   sync.Mutex
+	curFile *rotatingFile
+)
+
+func openRotating(path string, maxMB, backups int) (*rotatingFile, error) {
+	if maxMB <= 0 {
+		maxMB = 10
+	}
+	if backups <= 0 {
+		backups = 3
+	}
+	r := &rotatingFile{path: path, max: int64(maxMB) << 20, backups: backups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// swapFile records the active log file and closes the previous one.
+func swapFile(r *rotatingFile) {
+	curMu.Lock()
+	old := curFile
+	curFile = r
+	curMu.Unlock()
+	if old != nil && old != r {
+		old.close()
+	}
+}
+
+func (r *rotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(r.path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	r.f = f
+	r.size = st.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return 0, os.ErrClosed
+	}
+	if r.size+int64(len(p)) > r.max && r.size > 0 {
+		if err := r.rotate(); err != nil {
+			// keep logging into the old file rather than dropping lines
+			fmt.Fprintf(os.Stderr, "log rotate failed: %v\n", err)
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) rotate() error {
+	_ = r.f.Close()
+	r.f = nil
+	for i := r.backups - 1; i >= 1; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+	}
+	if err := os.Rename(r.path, r.path+".1"); err != nil && !os.IsNotExist(err) {
+		_ = r.open()
+		return err
+	}
+	return r.open()
+}
+
+func (r *rotatingFile) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f != nil {
+		_ = r.f.Close()
+		r.f = nil
+	}
+}
@@ -0,0 +1,593 @@
+package lua
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+)
+
+const (
+	// MaxSteps bounds the statements and loop rounds of one Load or Call,
+	// so a runaway loop fails instead of hanging the caller.
+	MaxSteps = 1_000_000
+	// maxDepth bounds nested calls.
+	maxDepth = 200
+)
+
+// Error is a syntax or runtime error at a line of the script.
+type Error struct {
+	Line int
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+	}
+	return e.Msg
+}
+
+func rtErr(line int, format string, args ...any) error {
+	return &Error{Line: line, Msg: fmt.Sprintf(format, args...)}
+}
+
+// atLine gives an error from a builtin the line of the call.
+func atLine(err error, line int) error {
+	var e *Error
+	if errors.As(err, &e) {
+		return err
+	}
+	return &Error{Line: line, Msg: err.Error()}
+}
+
+// scope holds the locals of a block.
+type scope struct {
+	vars   map[string]*Value
+	parent *scope
+}
+
+func (s *scope) lookup(name string) *Value {
+	for ; s != nil; s = s.parent {
+		if v, ok := s.vars[name]; ok {
+			return v
+		}
+	}
+	return nil
+}
+
+func (s *scope) declare(name string, v Value) {
+	if s.vars == nil {
+		s.vars = map[string]*Value{}
+	}
+	s.vars[name] = &v
+}
+
+// ctl is how a block ended.
+type ctl int
+
+const (
+	ctlNone ctl = iota
+	ctlBreak
+	ctlReturn
+)
+
+// interp runs a chunk's code against its globals.
+type interp struct {
+	globals *Table
+	steps   int
+	depth   int
+}
+
+func (it *interp) step(line int) error {
+	it.steps++
+	if it.steps > MaxSteps {
+		return rtErr(line, "script took more than %d steps", MaxSteps)
+	}
+	return nil
+}
+
+func (it *interp) exec(body []stmt, env *scope) (ctl, []Value, error) {
+	for _, s := range body {
+		if err := it.step(0); err != nil {
+			return 0, nil, err
+		}
+		c, ret, err := it.execStmt(s, env)
+		if err != nil || c != ctlNone {
+			return c, ret, err
+		}
+	}
+	return ctlNone, nil, nil
+}
+
+func (it *interp) execStmt(s stmt, env *scope) (ctl, []Value, error) {
+	switch s := s.(type) {
+	case localStmt:
+		vals, err := it.evalList(s.exprs, env, len(s.names))
+		if err != nil {
+			return 0, nil, err
+		}
+		for i, n := range s.names {
+			env.declare(n, vals[i])
+		}
+	case localFuncStmt:
+		env.declare(s.name, nil)
+		*env.lookup(s.name) = &closure{fn: s.fn, env: env}
+	case assignStmt:
+		vals, err := it.evalList(s.exprs, env, len(s.targets))
+		if err != nil {
+			return 0, nil, err
+		}
+		for i, tg := range s.targets {
+			if err := it.assign(tg, vals[i], env); err != nil {
+				return 0, nil, err
+			}
+		}
+	case callStmt:
+		if _, err := it.evalCall(s.call, env); err != nil {
+			return 0, nil, err
+		}
+	case doStmt:
+		return it.exec(s.body, &scope{parent: env})
+	case ifStmt:
+		for i, cond := range s.conds {
+			v, err := it.eval(cond, env)
+			if err != nil {
+				return 0, nil, err
+			}
+			if truthy(v) {
+				return it.exec(s.blocks[i], &scope{parent: env})
+			}
+		}
+		if s.els != nil {
+			return it.exec(s.els, &scope{parent: env})
+		}
+	case whileStmt:
+		for {
+			if err := it.step(0); err != nil {
+				return 0, nil, err
+			}
+			v, err := it.eval(s.cond, env)
+			if err != nil || !truthy(v) {
+				return ctlNone, nil, err
+			}
+			c, ret, err := it.exec(s.body, &scope{parent: env})
+			if err != nil || c == ctlReturn {
+				return c, ret, err
+			}
+			if c == ctlBreak {
+				return ctlNone, nil, nil
+			}
+		}
+	case repeatStmt:
+		for {
+			if err := it.step(0); err != nil {
+				return 0, nil, err
+			}
+			inner := &scope{parent: env}
+			c, ret, err := it.exec(s.body, inner)
+			if err != nil || c == ctlReturn {
+				return c, ret, err
+			}
+			if c == ctlBreak {
+				return ctlNone, nil, nil
+			}
+			v, err := it.eval(s.cond, inner)
+			if err != nil || truthy(v) {
+				return ctlNone, nil, err
+			}
+		}
+	case numForStmt:
+		var nums [3]float64
+		nums[2] = 1
+		for i, e := range []expr{s.start, s.limit, s.step} {
+			if e == nil {
+				continue
+			}
+			v, err := it.eval(e, env)
+			if err != nil {
+				return 0, nil, err
+			}
+			n, ok := toNumber(v)
+			if !ok {
+				return 0, nil, rtErr(s.line, "'for' %s must be a number", [3]string{"initial value", "limit", "step"}[i])
+			}
+			nums[i] = n
+		}
+		start, limit, step := nums[0], nums[1], nums[2]
+		if step == 0 {
+			return 0, nil, rtErr(s.line, "'for' step is zero")
+		}
+		for i := start; step > 0 && i <= limit || step < 0 && i >= limit; i += step {
+			if err := it.step(s.line); err != nil {
+				return 0, nil, err
+			}
+			inner := &scope{parent: env}
+			inner.declare(s.name, i)
+			c, ret, err := it.exec(s.body, inner)
+			if err != nil || c == ctlReturn {
+				return c, ret, err
+			}
+			if c == ctlBreak {
+				break
+			}
+		}
+	case genForStmt:
+		init, err := it.evalList(s.exprs, env, 3)
+		if err != nil {
+			return 0, nil, err
+		}
+		f, state, control := init[0], init[1], init[2]
+		for {
+			if err := it.step(s.line); err != nil {
+				return 0, nil, err
+			}
+			rs, err := it.call(f, []Value{state, control}, s.line)
+			if err != nil {
+				return 0, nil, err
+			}
+			if len(rs) == 0 || rs[0] == nil {
+				break
+			}
+			control = rs[0]
+			inner := &scope{parent: env}
+			for i, n := range s.names {
+				var v Value
+				if i < len(rs) {
+					v = rs[i]
+				}
+				inner.declare(n, v)
+			}
+			c, ret, err := it.exec(s.body, inner)
+			if err != nil || c == ctlReturn {
+				return c, ret, err
+			}
+			if c == ctlBreak {
+				break
+			}
+		}
+	case returnStmt:
+		vals, err := it.evalList(s.exprs, env, -1)
+		return ctlReturn, vals, err
+	case breakStmt:
+		return ctlBreak, nil, nil
+	}
+	return ctlNone, nil, nil
+}
+
+func (it *interp) assign(target expr, v Value, env *scope) error {
+	switch t := target.(type) {
+	case nameExpr:
+		if p := env.lookup(t.name); p != nil {
+			*p = v
+			return nil
+		}
+		return it.globals.Set(t.name, v)
+	case indexExpr:
+		obj, err := it.eval(t.obj, env)
+		if err != nil {
+			return err
+		}
+		k, err := it.eval(t.key, env)
+		if err != nil {
+			return err
+		}
+		tbl, ok := obj.(*Table)
+		if !ok {
+			return rtErr(t.line, "attempt to index %s", what(t.obj, obj))
+		}
+		if err := tbl.Set(k, v); err != nil {
+			return rtErr(t.line, "%v", err)
+		}
+	}
+	return nil
+}
+
+// evalList evaluates exprs, the last one with all its results, and pads
+// or cuts them to want values (want < 0 keeps them all).
+func (it *interp) evalList(exprs []expr, env *scope, want int) ([]Value, error) {
+	var vals []Value
+	for i, e := range exprs {
+		if i == len(exprs)-1 {
+			vs, err := it.evalMulti(e, env)
+			if err != nil {
+				return nil, err
+			}
+			vals = append(vals, vs...)
+			break
+		}
+		v, err := it.eval(e, env)
+		if err != nil {
+			return nil, err
+		}
+		vals = append(vals, v)
+	}
+	if want >= 0 {
+		for len(vals) < want {
+			vals = append(vals, nil)
+		}
+		vals = vals[:want]
+	}
+	return vals, nil
+}
+
+// evalMulti is eval keeping all results of a call.
+func (it *interp) evalMulti(e expr, env *scope) ([]Value, error) {
+	if c, ok := e.(*callExpr); ok {
+		return it.evalCall(c, env)
+	}
+	v, err := it.eval(e, env)
+	return []Value{v}, err
+}
+
+func (it *interp) eval(e expr, env *scope) (Value, error) {
+	switch e := e.(type) {
+	case constExpr:
+		return e.v, nil
+	case nameExpr:
+		if p := env.lookup(e.name); p != nil {
+			return *p, nil
+		}
+		return it.globals.Get(e.name), nil
+	case parenExpr:
+		return it.eval(e.e, env)
+	case indexExpr:
+		obj, err := it.eval(e.obj, env)
+		if err != nil {
+			return nil, err
+		}
+		k, err := it.eval(e.key, env)
+		if err != nil {
+			return nil, err
+		}
+		return it.index(obj, k, e.obj, e.line)
+	case *callExpr:
+		vs, err := it.evalCall(e, env)
+		if err != nil || len(vs) == 0 {
+			return nil, err
+		}
+		return vs[0], nil
+	case *funcExpr:
+		return &closure{fn: e, env: env}, nil
+	case tableExpr:
+		t := NewTable()
+		n := 0
+		for i, ke := range e.keys {
+			if ke == nil {
+				vals := []Value{nil}
+				var err error
+				if i == len(e.keys)-1 {
+					vals, err = it.evalMulti(e.vals[i], env)
+				} else {
+					vals[0], err = it.eval(e.vals[i], env)
+				}
+				if err != nil {
+					return nil, err
+				}
+				for _, v := range vals {
+					n++
+					_ = t.Set(float64(n), v)
+				}
+				continue
+			}
+			k, err := it.eval(ke, env)
+			if err != nil {
+				return nil, err
+			}
+			v, err := it.eval(e.vals[i], env)
+			if err != nil {
+				return nil, err
+			}
+			if err := t.Set(k, v); err != nil {
+				return nil, rtErr(e.line, "%v", err)
+			}
+		}
+		return t, nil
+	case unExpr:
+		v, err := it.eval(e.e, env)
+		if err != nil {
+			return nil, err
+		}
+		switch e.op {
+		case "not":
+			return !truthy(v), nil
+		case "-":
+			if n, ok := toNumber(v); ok {
+				return -n, nil
+			}
+			return nil, rtErr(e.line, "attempt to perform arithmetic on %s", what(e.e, v))
+		case "#":
+			switch x := v.(type) {
+			case string:
+				return float64(len(x)), nil
+			case *Table:
+				return float64(x.Len()), nil
+			}
+			return nil, rtErr(e.line, "attempt to get length of %s", what(e.e, v))
+		}
+	case binExpr:
+		l, err := it.eval(e.l, env)
+		if err != nil {
+			return nil, err
+		}
+		switch e.op {
+		case "and":
+			if !truthy(l) {
+				return l, nil
+			}
+			return it.eval(e.r, env)
+		case "or":
+			if truthy(l) {
+				return l, nil
+			}
+			return it.eval(e.r, env)
+		}
+		r, err := it.eval(e.r, env)
+		if err != nil {
+			return nil, err
+		}
+		return arith(e, l, r)
+	}
+	return nil, fmt.Errorf("unknown expression %T", e)
+}
+
+func arith(e binExpr, l, r Value) (Value, error) {
+	switch e.op {
+	case "==":
+		return rawEqual(l, r), nil
+	case "~=":
+		return !rawEqual(l, r), nil
+	case "<", "<=", ">", ">=":
+		if isNumber(l) && isNumber(r) {
+			a, _ := toNumber(l)
+			b, _ := toNumber(r)
+			return compare(e.op, a < b, a == b), nil
+		}
+		a, ok1 := l.(string)
+		b, ok2 := r.(string)
+		if ok1 && ok2 {
+			return compare(e.op, a < b, a == b), nil
+		}
+		return nil, rtErr(e.line, "attempt to compare %s with %s", typeName(l), typeName(r))
+	case "..":
+		a, ok1 := concatString(l)
+		b, ok2 := concatString(r)
+		if !ok1 {
+			return nil, rtErr(e.line, "attempt to concatenate %s", what(e.l, l))
+		}
+		if !ok2 {
+			return nil, rtErr(e.line, "attempt to concatenate %s", what(e.r, r))
+		}
+		return a + b, nil
+	}
+	a, ok := toNumber(l)
+	if !ok {
+		return nil, rtErr(e.line, "attempt to perform arithmetic on %s", what(e.l, l))
+	}
+	b, ok := toNumber(r)
+	if !ok {
+		return nil, rtErr(e.line, "attempt to perform arithmetic on %s", what(e.r, r))
+	}
+	switch e.op {
+	case "+":
+		return a + b, nil
+	case "-":
+		return a - b, nil
+	case "*":
+		return a * b, nil
+	case "/":
+		return a / b, nil
+	case "%":
+		return a - math.Floor(a/b)*b, nil
+	case "^":
+		return math.Pow(a, b), nil
+	}
+	return nil, rtErr(e.line, "unknown operator %s", e.op)
+}
+
+func compare(op string, less, equal bool) bool {
+	switch op {
+	case "<":
+		return less
+	case "<=":
+		return less || equal
+	case ">":
+		return !less && !equal
+	}
+	return !less
+}
+
+func concatString(v Value) (string, bool) {
+	switch x := v.(type) {
+	case string:
+		return x, true
+	case float64, json.Number:
+		return toString(x), true
+	}
+	return "", false
+}
+
+// what names the expression e with value v for error messages, as Lua
+// does: "field 'cpu' (a nil value)".
+func what(e expr, v Value) string {
+	kind := fmt.Sprintf("a %s value", typeName(v))
+	switch e := e.(type) {
+	case nameExpr:
+		return fmt.Sprintf("'%s' (%s)", e.name, kind)
+	case indexExpr:
+		if k, ok := e.key.(constExpr); ok {
+			if s, ok := k.v.(string); ok {
+				return fmt.Sprintf("field '%s' (%s)", s, kind)
+			}
+		}
+	}
+	return kind
+}
+
+func (it *interp) index(obj, k Value, objExpr expr, line int) (Value, error) {
+	switch x := obj.(type) {
+	case *Table:
+		return x.Get(k), nil
+	case string:
+		// s:upper() and friends
+		if lib, ok := it.globals.Get("string").(*Table); ok {
+			return lib.Get(k), nil
+		}
+		return nil, nil
+	}
+	return nil, rtErr(line, "attempt to index %s", what(objExpr, obj))
+}
+
+func (it *interp) evalCall(c *callExpr, env *scope) ([]Value, error) {
+	fn, err := it.eval(c.fn, env)
+	if err != nil {
+		return nil, err
+	}
+	var self []Value
+	callee := c.fn
+	if c.method != "" {
+		self = []Value{fn}
+		callee = indexExpr{c.fn, constExpr{c.method}, c.line}
+		if fn, err = it.index(fn, c.method, c.fn, c.line); err != nil {
+			return nil, err
+		}
+	}
+	args, err := it.evalList(c.args, env, -1)
+	if err != nil {
+		return nil, err
+	}
+	switch fn.(type) {
+	case *Builtin, *closure:
+	default:
+		return nil, rtErr(c.line, "attempt to call %s", what(callee, fn))
+	}
+	return it.call(fn, append(self, args...), c.line)
+}
+
+func (it *interp) call(fn Value, args []Value, line int) ([]Value, error) {
+	switch f := fn.(type) {
+	case *Builtin:
+		rs, err := f.Fn(args)
+		if err != nil {
+			return nil, atLine(err, line)
+		}
+		return rs, nil
+	case *closure:
+		if it.depth >= maxDepth {
+			return nil, rtErr(line, "stack overflow")
+		}
+		it.depth++
+		defer func() { it.depth-- }()
+		env := &scope{parent: f.env}
+		for i, p := range f.fn.params {
+			var v Value
+			if i < len(args) {
+				v = args[i]
+			}
+			env.declare(p, v)
+		}
+		_, ret, err := it.exec(f.fn.body, env)
+		return ret, err
+	}
+	return nil, rtErr(line, "attempt to call a %s value", typeName(fn))
+}
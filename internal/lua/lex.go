@@ -0,0 +1,215 @@
+package lua
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type tokKind int
+
+const (
+	tEOF tokKind = iota
+	tName
+	tNumber
+	tString
+	tKeyword
+	tSymbol
+)
+
+type token struct {
+	kind tokKind
+	s    string  // name, keyword, symbol or string contents
+	n    float64 // tNumber
+	line int
+}
+
+var keywords = map[string]bool{
+	"and": true, "break": true, "do": true, "else": true, "elseif": true, "end": true,
+	"false": true, "for": true, "function": true, "if": true, "in": true, "local": true,
+	"nil": true, "not": true, "or": true, "repeat": true, "return": true, "then": true,
+	"true": true, "until": true, "while": true,
+}
+
+// symbols, longest first.
+var symbols = []string{
+	"...", "..", "==", "~=", "<=", ">=",
+	"+", "-", "*", "/", "%", "^", "#", "<", ">", "=",
+	"(", ")", "{", "}", "[", "]", ";", ":", ",", ".",
+}
+
+// lex splits src into tokens.
+func lex(src string) ([]token, error) {
+	var toks []token
+	line := 1
+	i := 0
+	errf := func(format string, args ...any) error {
+		return &Error{Line: line, Msg: fmt.Sprintf(format, args...)}
+	}
+	for i < len(src) {
+		c := src[i]
+		switch {
+		case c == '\n':
+			line++
+			i++
+			continue
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+			continue
+		case strings.HasPrefix(src[i:], "--"):
+			i += 2
+			if s, n, ok := longBracket(src[i:]); ok {
+				line += strings.Count(s, "\n")
+				i += n
+				continue
+			}
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+			continue
+		case isLetter(c):
+			j := i + 1
+			for j < len(src) && (isLetter(src[j]) || isDigit(src[j])) {
+				j++
+			}
+			w := src[i:j]
+			kind := tName
+			if keywords[w] {
+				kind = tKeyword
+			}
+			toks = append(toks, token{kind: kind, s: w, line: line})
+			i = j
+			continue
+		case isDigit(c) || c == '.' && i+1 < len(src) && isDigit(src[i+1]):
+			j := i
+			if strings.HasPrefix(src[i:], "0x") || strings.HasPrefix(src[i:], "0X") {
+				j += 2
+				for j < len(src) && strings.IndexByte("0123456789abcdefABCDEF", src[j]) >= 0 {
+					j++
+				}
+				n, err := strconv.ParseUint(src[i+2:j], 16, 64)
+				if err != nil {
+					return nil, errf("malformed number near %q", src[i:j])
+				}
+				toks = append(toks, token{kind: tNumber, n: float64(n), line: line})
+				i = j
+				continue
+			}
+			for j < len(src) && (isDigit(src[j]) || src[j] == '.') {
+				j++
+			}
+			if j < len(src) && (src[j] == 'e' || src[j] == 'E') {
+				j++
+				if j < len(src) && (src[j] == '+' || src[j] == '-') {
+					j++
+				}
+				for j < len(src) && isDigit(src[j]) {
+					j++
+				}
+			}
+			n, err := strconv.ParseFloat(src[i:j], 64)
+			if err != nil {
+				return nil, errf("malformed number near %q", src[i:j])
+			}
+			toks = append(toks, token{kind: tNumber, n: n, line: line})
+			i = j
+			continue
+		case c == '"' || c == '\'':
+			var b strings.Builder
+			j := i + 1
+			for {
+				if j >= len(src) || src[j] == '\n' {
+					return nil, errf("unfinished string")
+				}
+				if src[j] == c {
+					break
+				}
+				if src[j] != '\\' {
+					b.WriteByte(src[j])
+					j++
+					continue
+				}
+				j++
+				if j >= len(src) {
+					return nil, errf("unfinished string")
+				}
+				switch e := src[j]; e {
+				case 'n':
+					b.WriteByte('\n')
+				case 't':
+					b.WriteByte('\t')
+				case 'r':
+					b.WriteByte('\r')
+				case '\\', '"', '\'':
+					b.WriteByte(e)
+				case '\n':
+					b.WriteByte('\n')
+					line++
+				default:
+					if !isDigit(e) {
+						return nil, errf("invalid escape sequence \\%c", e)
+					}
+					k := j
+					for k < len(src) && k < j+3 && isDigit(src[k]) {
+						k++
+					}
+					n, _ := strconv.Atoi(src[j:k])
+					if n > 255 {
+						return nil, errf("escape sequence too large")
+					}
+					b.WriteByte(byte(n))
+					j = k - 1
+				}
+				j++
+			}
+			toks = append(toks, token{kind: tString, s: b.String(), line: line})
+			i = j + 1
+			continue
+		case c == '[':
+			if s, n, ok := longBracket(src[i:]); ok {
+				toks = append(toks, token{kind: tString, s: strings.TrimPrefix(s, "\n"), line: line})
+				line += strings.Count(s, "\n")
+				i += n
+				continue
+			}
+		}
+		sym := ""
+		for _, s := range symbols {
+			if strings.HasPrefix(src[i:], s) {
+				sym = s
+				break
+			}
+		}
+		if sym == "" {
+			return nil, errf("unexpected symbol %q", c)
+		}
+		toks = append(toks, token{kind: tSymbol, s: sym, line: line})
+		i += len(sym)
+	}
+	return append(toks, token{kind: tEOF, line: line}), nil
+}
+
+// longBracket reads [[...]] or [==[...]==] at the start of s and returns
+// its contents and length.
+func longBracket(s string) (string, int, bool) {
+	if len(s) < 2 || s[0] != '[' {
+		return "", 0, false
+	}
+	level := 0
+	for 1+level < len(s) && s[1+level] == '=' {
+		level++
+	}
+	if 1+level >= len(s) || s[1+level] != '[' {
+		return "", 0, false
+	}
+	open := 2 + level
+	closing := "]" + strings.Repeat("=", level) + "]"
+	end := strings.Index(s[open:], closing)
+	if end < 0 {
+		return "", 0, false
+	}
+	return s[open : open+end], open + end + len(closing), true
+}
+
+func isLetter(c byte) bool { return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' }
+func isDigit(c byte) bool  { return c >= '0' && c <= '9' }
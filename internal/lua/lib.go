@@ -0,0 +1,398 @@
+package lua
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"strings"
+	"time"
+)
+
+// maxString bounds strings built by string.rep and table.concat.
+const maxString = 1 << 20
+
+// openLibs sets the builtins: the base functions and parts of the string,
+// table, math and os libraries.
+func openLibs(g *Table, name string) {
+	fns := func(t *Table, list map[string]func([]Value) ([]Value, error), prefix string) {
+		for n, f := range list {
+			_ = t.Set(n, &Builtin{Name: prefix + n, Fn: f})
+		}
+	}
+	fns(g, map[string]func([]Value) ([]Value, error){
+		"print": func(args []Value) ([]Value, error) {
+			s := make([]string, len(args))
+			for i, a := range args {
+				s[i] = toString(a)
+			}
+			slog.Info("script print", "script", name, "msg", strings.Join(s, "\t"))
+			return nil, nil
+		},
+		"type": func(args []Value) ([]Value, error) {
+			if len(args) == 0 {
+				return nil, errors.New("bad argument #1 to 'type' (value expected)")
+			}
+			return []Value{typeName(args[0])}, nil
+		},
+		"tostring": func(args []Value) ([]Value, error) {
+			return []Value{toString(arg(args, 0))}, nil
+		},
+		"tonumber": func(args []Value) ([]Value, error) {
+			if n, ok := toNumber(arg(args, 0)); ok {
+				return []Value{n}, nil
+			}
+			return []Value{nil}, nil
+		},
+		"pairs": func(args []Value) ([]Value, error) {
+			t, err := tableArg(args, 0, "pairs")
+			if err != nil {
+				return nil, err
+			}
+			keys, i := t.Keys(), 0
+			next := &Builtin{Name: "next", Fn: func([]Value) ([]Value, error) {
+				for ; i < len(keys); i++ {
+					if v := t.Get(keys[i]); v != nil {
+						i++
+						return []Value{keys[i-1], v}, nil
+					}
+				}
+				return []Value{nil}, nil
+			}}
+			return []Value{next, t, nil}, nil
+		},
+		"ipairs": func(args []Value) ([]Value, error) {
+			t, err := tableArg(args, 0, "ipairs")
+			if err != nil {
+				return nil, err
+			}
+			i := 0
+			next := &Builtin{Name: "inext", Fn: func([]Value) ([]Value, error) {
+				i++
+				v := t.Get(float64(i))
+				if v == nil {
+					return []Value{nil}, nil
+				}
+				return []Value{float64(i), v}, nil
+			}}
+			return []Value{next, t, nil}, nil
+		},
+		"error": func(args []Value) ([]Value, error) {
+			return nil, errors.New(toString(arg(args, 0)))
+		},
+		"assert": func(args []Value) ([]Value, error) {
+			if truthy(arg(args, 0)) {
+				return args, nil
+			}
+			if len(args) > 1 {
+				return nil, errors.New(toString(args[1]))
+			}
+			return nil, errors.New("assertion failed!")
+		},
+	}, "")
+
+	str := NewTable()
+	fns(str, map[string]func([]Value) ([]Value, error){
+		"len": func(args []Value) ([]Value, error) {
+			s, err := stringArg(args, 0, "len")
+			return []Value{float64(len(s))}, err
+		},
+		"lower": func(args []Value) ([]Value, error) {
+			s, err := stringArg(args, 0, "lower")
+			return []Value{strings.ToLower(s)}, err
+		},
+		"upper": func(args []Value) ([]Value, error) {
+			s, err := stringArg(args, 0, "upper")
+			return []Value{strings.ToUpper(s)}, err
+		},
+		"rep": func(args []Value) ([]Value, error) {
+			s, err := stringArg(args, 0, "rep")
+			if err != nil {
+				return nil, err
+			}
+			n, _ := toNumber(arg(args, 1))
+			if n <= 0 {
+				return []Value{""}, nil
+			}
+			if float64(len(s))*n > maxString {
+				return nil, errors.New("resulting string too large")
+			}
+			return []Value{strings.Repeat(s, int(n))}, nil
+		},
+		"sub": func(args []Value) ([]Value, error) {
+			s, err := stringArg(args, 0, "sub")
+			if err != nil {
+				return nil, err
+			}
+			i, j := intArg(args, 1, 1), intArg(args, 2, -1)
+			n := len(s)
+			if i < 0 {
+				i = max(n+i+1, 1)
+			} else if i == 0 {
+				i = 1
+			}
+			if j < 0 {
+				j = n + j + 1
+			} else if j > n {
+				j = n
+			}
+			if i > j {
+				return []Value{""}, nil
+			}
+			return []Value{s[i-1 : j]}, nil
+		},
+		// find only searches for plain text: Lua patterns are not
+		// supported.
+		"find": func(args []Value) ([]Value, error) {
+			s, err := stringArg(args, 0, "find")
+			if err != nil {
+				return nil, err
+			}
+			sub, err := stringArg(args, 1, "find")
+			if err != nil {
+				return nil, err
+			}
+			init := intArg(args, 2, 1)
+			if init < 0 {
+				init = max(len(s)+init+1, 1)
+			} else if init == 0 {
+				init = 1
+			}
+			if init > len(s)+1 {
+				return []Value{nil}, nil
+			}
+			k := strings.Index(s[init-1:], sub)
+			if k < 0 {
+				return []Value{nil}, nil
+			}
+			start := init + k
+			return []Value{float64(start), float64(start + len(sub) - 1)}, nil
+		},
+		"format": func(args []Value) ([]Value, error) {
+			f, err := stringArg(args, 0, "format")
+			if err != nil {
+				return nil, err
+			}
+			s, err := format(f, args[1:])
+			return []Value{s}, err
+		},
+	}, "string.")
+	_ = g.Set("string", str)
+
+	tbl := NewTable()
+	fns(tbl, map[string]func([]Value) ([]Value, error){
+		"insert": func(args []Value) ([]Value, error) {
+			t, err := tableArg(args, 0, "insert")
+			if err != nil {
+				return nil, err
+			}
+			n := t.Len()
+			switch len(args) {
+			case 2:
+				return nil, t.Set(float64(n+1), args[1])
+			case 3:
+				pos := intArg(args, 1, n+1)
+				if pos < 1 || pos > n+1 {
+					return nil, errors.New("bad argument #2 to 'insert' (position out of bounds)")
+				}
+				for i := n; i >= pos; i-- {
+					_ = t.Set(float64(i+1), t.Get(float64(i)))
+				}
+				return nil, t.Set(float64(pos), args[2])
+			}
+			return nil, errors.New("wrong number of arguments to 'insert'")
+		},
+		"remove": func(args []Value) ([]Value, error) {
+			t, err := tableArg(args, 0, "remove")
+			if err != nil {
+				return nil, err
+			}
+			n := t.Len()
+			pos := intArg(args, 1, n)
+			if n == 0 {
+				return []Value{nil}, nil
+			}
+			if pos < 1 || pos > n {
+				return nil, errors.New("bad argument #2 to 'remove' (position out of bounds)")
+			}
+			v := t.Get(float64(pos))
+			for i := pos; i < n; i++ {
+				_ = t.Set(float64(i), t.Get(float64(i+1)))
+			}
+			_ = t.Set(float64(n), nil)
+			return []Value{v}, nil
+		},
+		"concat": func(args []Value) ([]Value, error) {
+			t, err := tableArg(args, 0, "concat")
+			if err != nil {
+				return nil, err
+			}
+			sep, _ := arg(args, 1).(string)
+			var b strings.Builder
+			for i, n := intArg(args, 2, 1), intArg(args, 3, t.Len()); i <= n; i++ {
+				s, ok := concatString(t.Get(float64(i)))
+				if !ok {
+					return nil, fmt.Errorf("invalid value (at index %d) in table for 'concat'", i)
+				}
+				if i > 1 {
+					b.WriteString(sep)
+				}
+				b.WriteString(s)
+				if b.Len() > maxString {
+					return nil, errors.New("resulting string too large")
+				}
+			}
+			return []Value{b.String()}, nil
+		},
+	}, "table.")
+	_ = g.Set("table", tbl)
+
+	m := NewTable()
+	num := func(name string, f func(float64) float64) func([]Value) ([]Value, error) {
+		return func(args []Value) ([]Value, error) {
+			x, ok := toNumber(arg(args, 0))
+			if !ok {
+				return nil, fmt.Errorf("bad argument #1 to '%s' (number expected, got %s)", name, typeName(arg(args, 0)))
+			}
+			return []Value{f(x)}, nil
+		}
+	}
+	extreme := func(name string, better func(a, b float64) bool) func([]Value) ([]Value, error) {
+		return func(args []Value) ([]Value, error) {
+			if len(args) == 0 {
+				return nil, fmt.Errorf("bad argument #1 to '%s' (number expected, got no value)", name)
+			}
+			var best float64
+			for i, a := range args {
+				x, ok := toNumber(a)
+				if !ok {
+					return nil, fmt.Errorf("bad argument #%d to '%s' (number expected, got %s)", i+1, name, typeName(a))
+				}
+				if i == 0 || better(x, best) {
+					best = x
+				}
+			}
+			return []Value{best}, nil
+		}
+	}
+	fns(m, map[string]func([]Value) ([]Value, error){
+		"floor": num("floor", math.Floor),
+		"ceil":  num("ceil", math.Ceil),
+		"abs":   num("abs", math.Abs),
+		"sqrt":  num("sqrt", math.Sqrt),
+		"max":   extreme("max", func(a, b float64) bool { return a > b }),
+		"min":   extreme("min", func(a, b float64) bool { return a < b }),
+	}, "math.")
+	_ = m.Set("huge", math.Inf(1))
+	_ = m.Set("pi", math.Pi)
+	_ = g.Set("math", m)
+
+	osLib := NewTable()
+	fns(osLib, map[string]func([]Value) ([]Value, error){
+		"getenv": func(args []Value) ([]Value, error) {
+			k, err := stringArg(args, 0, "getenv")
+			if err != nil {
+				return nil, err
+			}
+			if v, ok := os.LookupEnv(k); ok {
+				return []Value{v}, nil
+			}
+			return []Value{nil}, nil
+		},
+		"time": func([]Value) ([]Value, error) {
+			return []Value{float64(time.Now().Unix())}, nil
+		},
+	}, "os.")
+	_ = g.Set("os", osLib)
+}
+
+func arg(args []Value, i int) Value {
+	if i < len(args) {
+		return args[i]
+	}
+	return nil
+}
+
+func tableArg(args []Value, i int, fn string) (*Table, error) {
+	t, ok := arg(args, i).(*Table)
+	if !ok {
+		return nil, fmt.Errorf("bad argument #%d to '%s' (table expected, got %s)", i+1, fn, typeName(arg(args, i)))
+	}
+	return t, nil
+}
+
+// stringArg takes a string argument; numbers are converted as in Lua.
+func stringArg(args []Value, i int, fn string) (string, error) {
+	switch v := arg(args, i).(type) {
+	case string:
+		return v, nil
+	case float64, json.Number:
+		return toString(v), nil
+	}
+	return "", fmt.Errorf("bad argument #%d to '%s' (string expected, got %s)", i+1, fn, typeName(arg(args, i)))
+}
+
+func intArg(args []Value, i, def int) int {
+	if n, ok := toNumber(arg(args, i)); ok {
+		return int(n)
+	}
+	return def
+}
+
+// format is string.format for %d %i %u %c %x %X %o %e %E %f %g %G %q %s
+// and %%, with flags, width and precision.
+func format(f string, args []Value) (string, error) {
+	var b strings.Builder
+	n := 0
+	for i := 0; i < len(f); i++ {
+		if f[i] != '%' {
+			b.WriteByte(f[i])
+			continue
+		}
+		j := i + 1
+		for j < len(f) && strings.IndexByte("-+ #0123456789.", f[j]) >= 0 {
+			j++
+		}
+		if j >= len(f) {
+			return "", errors.New("invalid format (ends with '%')")
+		}
+		spec, verb := f[i:j], f[j]
+		i = j
+		if verb == '%' {
+			b.WriteByte('%')
+			continue
+		}
+		if n >= len(args) {
+			return "", fmt.Errorf("bad argument #%d to 'format' (no value)", n+2)
+		}
+		a := args[n]
+		n++
+		switch verb {
+		case 'd', 'i', 'u', 'c', 'x', 'X', 'o':
+			x, ok := toNumber(a)
+			if !ok {
+				return "", fmt.Errorf("bad argument #%d to 'format' (number expected, got %s)", n+1, typeName(a))
+			}
+			v := verb
+			if v == 'i' || v == 'u' {
+				v = 'd'
+			}
+			fmt.Fprintf(&b, spec+string(v), int64(x))
+		case 'e', 'E', 'f', 'g', 'G':
+			x, ok := toNumber(a)
+			if !ok {
+				return "", fmt.Errorf("bad argument #%d to 'format' (number expected, got %s)", n+1, typeName(a))
+			}
+			fmt.Fprintf(&b, spec+string(verb), x)
+		case 's':
+			fmt.Fprintf(&b, spec+"s", toString(a))
+		case 'q':
+			fmt.Fprintf(&b, "%q", toString(a))
+		default:
+			return "", fmt.Errorf("invalid option '%%%c' to 'format'", verb)
+		}
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,168 @@
+// Package lua is a small interpreter for a subset of Lua 5.1, enough for
+// user scripts that filter and rewrite the agent's outgoing messages.
+//
+// Supported: nil, booleans, numbers (float64), strings, tables and
+// functions with closures; local, assignment, if/elseif/else, while,
+// repeat, numeric and generic for, break, return and multiple results;
+// the usual operators, method calls (s:upper()) and long strings and
+// comments. The builtins are print, type, tostring, tonumber, pairs,
+// ipairs, error, assert, string.len/lower/upper/rep/sub/find/format,
+// table.insert/remove/concat, math.floor/ceil/abs/sqrt/max/min/huge/pi and
+// os.getenv/time. Not supported: varargs, metatables, coroutines, goto,
+// integer division and Lua patterns (string.find matches plain text).
+// There is no io and no way to load code or run commands.
+package lua
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// State is a loaded script: its globals after the main chunk ran. It is
+// not safe for concurrent use.
+type State struct {
+	it *interp
+}
+
+// Load parses src and runs its main chunk; name labels print output.
+func Load(name, src string) (*State, error) {
+	body, err := parse(src)
+	if err != nil {
+		return nil, err
+	}
+	g := NewTable()
+	openLibs(g, name)
+	it := &interp{globals: g}
+	if _, _, err := it.exec(body, &scope{}); err != nil {
+		return nil, err
+	}
+	return &State{it: it}, nil
+}
+
+// HasFunction reports whether the global name is a function.
+func (s *State) HasFunction(name string) bool {
+	switch s.it.globals.Get(name).(type) {
+	case *closure, *Builtin:
+		return true
+	}
+	return false
+}
+
+// Call calls the global function name with args, within MaxSteps.
+func (s *State) Call(name string, args ...Value) ([]Value, error) {
+	fn := s.it.globals.Get(name)
+	if !s.HasFunction(name) {
+		return nil, fmt.Errorf("%s is not a function", name)
+	}
+	s.it.steps, s.it.depth = 0, 0
+	return s.it.call(fn, args, 0)
+}
+
+// TypeName is what type(v) returns in Lua.
+func TypeName(v Value) string { return typeName(v) }
+
+// FromJSON turns JSON data (as decoded into any, preferably with
+// UseNumber) into Lua values: objects become tables with their keys in
+// sorted order, arrays tables indexed from 1.
+func FromJSON(v any) Value {
+	switch x := v.(type) {
+	case map[string]any:
+		t := NewTable()
+		keys := make([]string, 0, len(x))
+		for k := range x {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			_ = t.Set(k, FromJSON(x[k]))
+		}
+		return t
+	case []any:
+		t := NewTable()
+		t.array = true
+		for i, e := range x {
+			_ = t.Set(float64(i+1), FromJSON(e))
+		}
+		return t
+	case int:
+		return float64(x)
+	case int64:
+		return float64(x)
+	}
+	return v
+}
+
+// ToJSON turns a Lua value back into JSON data. A table is an array when
+// it came from one or its keys are exactly 1..n, an object otherwise; an
+// array from JSON runs to its highest index, so its nulls (holes in Lua)
+// come back as null. Functions, NaN and infinities can't be encoded.
+func ToJSON(v Value) (any, error) {
+	return toJSON(v, 0)
+}
+
+func toJSON(v Value, depth int) (any, error) {
+	if depth > 100 {
+		return nil, errors.New("tables nested too deep (a cycle?)")
+	}
+	switch x := v.(type) {
+	case nil, bool, string, json.Number:
+		return x, nil
+	case float64:
+		if math.IsNaN(x) || math.IsInf(x, 0) {
+			return nil, fmt.Errorf("can't encode %s", formatNumber(x))
+		}
+		return x, nil
+	case *Table:
+		keys := x.Keys()
+		n := x.Len()
+		if x.array {
+			n = x.maxIndex()
+		}
+		if x.array || n > 0 && n == len(keys) {
+			out := make([]any, n)
+			for i := range out {
+				e, err := toJSON(x.Get(float64(i+1)), depth+1)
+				if err != nil {
+					return nil, err
+				}
+				out[i] = e
+			}
+			return out, nil
+		}
+		out := make(map[string]any, len(keys))
+		for _, k := range keys {
+			var ks string
+			switch kk := k.(type) {
+			case string:
+				ks = kk
+			case float64:
+				ks = formatNumber(kk)
+			default:
+				return nil, fmt.Errorf("can't encode a %s key", typeName(k))
+			}
+			e, err := toJSON(x.Get(k), depth+1)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", ks, err)
+			}
+			out[ks] = e
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("can't encode a %s value", typeName(v))
+}
+
+// DecodeJSON decodes b keeping numbers exact, then converts it with
+// FromJSON.
+func DecodeJSON(b []byte) (Value, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return FromJSON(v), nil
+}
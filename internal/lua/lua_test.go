@@ -0,0 +1,293 @@
+package lua
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// eval runs src as the body of a function and returns its results.
+func eval(t *testing.T, src string) ([]Value, error) {
+	t.Helper()
+	st, err := Load("test", "function f()\n"+src+"\nend")
+	if err != nil {
+		return nil, err
+	}
+	return st.Call("f")
+}
+
+func TestEval(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want []Value
+	}{
+		{"arith", "return 1 + 2 * 3 - 4 / 2", []Value{5.0}},
+		{"precedence", "return 2 ^ 3 ^ 2, -2 ^ 2", []Value{512.0, -4.0}},
+		{"modulo", "return 7 % 3, -7 % 3", []Value{1.0, 2.0}},
+		{"concat", `return "a" .. 1 .. "b"`, []Value{"a1b"}},
+		{"compare", `return 1 < 2, "a" < "b", 1 == 1.0, "1" == 1`, []Value{true, true, true, false}},
+		{"logic", "return nil or 3, false and 1, not nil, 1 and 2", []Value{3.0, false, true, 2.0}},
+		{"length", `return #"abc", #{1, 2, 3}`, []Value{3.0, 3.0}},
+		{"multiple results", "local function g() return 1, 2 end\nlocal a, b, c = g()\nreturn a, b, c", []Value{1.0, 2.0, nil}},
+		{"closure", "local n = 0\nlocal function inc() n = n + 1 return n end\ninc() inc()\nreturn inc()", []Value{3.0}},
+		{"numeric for", "local s = 0\nfor i = 10, 1, -3 do s = s + i end\nreturn s", []Value{22.0}},
+		{"generic for", "local s = ''\nfor _, v in ipairs({'a', 'b', 'c'}) do s = s .. v end\nreturn s", []Value{"abc"}},
+		{"pairs order", "local s = ''\nlocal t = {}\nt.z = 1 t.a = 2 t.m = 3\nfor k in pairs(t) do s = s .. k end\nreturn s", []Value{"zam"}},
+		{"while break", "local i = 0\nwhile true do i = i + 1 if i == 5 then break end end\nreturn i", []Value{5.0}},
+		{"repeat", "local i = 0\nrepeat i = i + 2 until i >= 7\nreturn i", []Value{8.0}},
+		{"elseif", "local x = 2\nif x == 1 then return 'a' elseif x == 2 then return 'b' else return 'c' end", []Value{"b"}},
+		{"table fields", "local t = {a = 1, ['b c'] = 2, [3] = 'x', 'y'}\nreturn t.a, t['b c'], t[3], t[1]", []Value{1.0, 2.0, "x", "y"}},
+		{"method call", `local s = "Hello" return s:upper(), s:len()`, []Value{"HELLO", 5.0}},
+		{"long string", "return [[a\nb]], [==[x]]y]==]", []Value{"a\nb", "x]]y"}},
+		{"escapes", `return "a\tb\n", "\65\066", '\''`, []Value{"a\tb\n", "AB", "'"}},
+		{"comments", "-- line\n--[[ block\n]] return 1 --[==[ x ]==]", []Value{1.0}},
+		{"hex", "return 0x10, 0xff", []Value{16.0, 255.0}},
+		{"string.sub", `return ("hello"):sub(2, -2), ("hello"):sub(-3)`, []Value{"ell", "llo"}},
+		{"string.find plain", `return string.find("a.b.c", ".b", 1, true)`, []Value{2.0, 3.0}},
+		{"string.find missing", `return string.find("abc", "x")`, []Value{nil}},
+		{"string.format", `return string.format("%s=%d %.2f %q", "k", 3, 1.5, "x")`, []Value{`k=3 1.50 "x"`}},
+		{"string.rep", `return string.rep("ab", 3)`, []Value{"ababab"}},
+		{"table.concat", `return table.concat({1, "a", 2}, "-")`, []Value{"1-a-2"}},
+		{"table.insert remove", "local t = {1, 3}\ntable.insert(t, 2, 2)\nlocal r = table.remove(t)\nreturn #t, t[2], r", []Value{2.0, 2.0, 3.0}},
+		{"tostring tonumber", `return tostring(10), tostring(1.5), tonumber("0x1A"), tonumber("z")`, []Value{"10", "1.5", 26.0, nil}},
+		{"math", "return math.floor(1.7), math.ceil(1.2), math.max(3, 9, 1), math.abs(-2)", []Value{1.0, 2.0, 9.0, 2.0}},
+		{"type", "return type(nil), type(1), type('s'), type({}), type(print)", []Value{"nil", "number", "string", "table", "function"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := eval(t, tt.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSyntaxErrors(t *testing.T) {
+	tests := []struct {
+		name, src, msg string
+	}{
+		{"unclosed string", `x = "abc`, "line 1"},
+		{"unclosed long string", "x = [[abc", "line 1"},
+		{"missing end", "if true then\nx = 1", "line 2"},
+		{"bad token", "x = 1 @ 2", "line 1"},
+		{"unexpected symbol", "x = = 1", "line 1"},
+		{"goto", "goto done", ""},
+		{"varargs", "function f(...) end", ""},
+		{"integer division", "x = 3 // 2", ""},
+		{"escape too large", `x = "\300"`, "escape"},
+		{"assign to call", "f() = 1", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Load("test", tt.src)
+			if err == nil {
+				t.Fatal("loaded")
+			}
+			if !strings.Contains(err.Error(), tt.msg) {
+				t.Errorf("error %q doesn't mention %q", err, tt.msg)
+			}
+		})
+	}
+}
+
+func TestRuntimeErrors(t *testing.T) {
+	tests := []struct {
+		name, src, msg string
+	}{
+		{"call nil", "local x\nx()", "attempt to call"},
+		{"index nil", "local x\nreturn x.y", "attempt to index"},
+		{"arith on string", `return {} + 1`, "arithmetic"},
+		{"compare mixed", `return 1 < "2"`, "compare"},
+		{"concat table", `return "a" .. {}`, "concatenate"},
+		{"error()", `error("boom")`, "boom"},
+		{"assert", `assert(false, "nope")`, "nope"},
+		{"nil key", "local t = {}\nt[nil] = 1", "nil"},
+		{"for step", "for i = 1, 2, 'x' do end", "'for' step must be a number"},
+		{"string.rep too large", `return string.rep("x", 1e7)`, "too large"},
+		{"table.concat too large", "local t = {}\nlocal s = string.rep('x', 1e5)\nfor i = 1, 20 do t[i] = s end\nreturn table.concat(t)", "too large"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := eval(t, tt.src)
+			if err == nil {
+				t.Fatal("no error")
+			}
+			if !strings.Contains(err.Error(), tt.msg) {
+				t.Errorf("error %q doesn't mention %q", err, tt.msg)
+			}
+			var le *Error
+			if !errors.As(err, &le) || le.Line == 0 {
+				t.Errorf("error %q has no line", err)
+			}
+		})
+	}
+}
+
+func TestLimits(t *testing.T) {
+	t.Run("steps", func(t *testing.T) {
+		_, err := eval(t, "while true do end")
+		if err == nil || !strings.Contains(err.Error(), "steps") {
+			t.Fatalf("got %v, want a step limit error", err)
+		}
+	})
+	t.Run("steps in main chunk", func(t *testing.T) {
+		_, err := Load("test", "local i = 0\nrepeat i = i + 1 until false")
+		if err == nil || !strings.Contains(err.Error(), "steps") {
+			t.Fatalf("got %v, want a step limit error", err)
+		}
+	})
+	t.Run("steps reset per call", func(t *testing.T) {
+		// more than half of MaxSteps each, so a second call would fail
+		// if the count carried over
+		st, err := Load("test", "function f() for i = 1, 600000 do end end")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			if _, err := st.Call("f"); err != nil {
+				t.Fatalf("call %d: %v", i, err)
+			}
+		}
+	})
+	t.Run("depth", func(t *testing.T) {
+		_, err := eval(t, "local function r(n) return r(n + 1) end\nreturn r(0)")
+		if err == nil || !strings.Contains(err.Error(), "stack overflow") {
+			t.Fatalf("got %v, want a stack overflow", err)
+		}
+	})
+	t.Run("depth within limit", func(t *testing.T) {
+		got, err := eval(t, "local function r(n) if n == 0 then return 0 end return 1 + r(n - 1) end\nreturn r(150)")
+		if err != nil || got[0] != 150.0 {
+			t.Fatalf("got %v, %v", got, err)
+		}
+	})
+	for name, src := range map[string]string{
+		"nested parens": "x = " + strings.Repeat("(", 100000) + "1" + strings.Repeat(")", 100000),
+		"nested tables": "x = " + strings.Repeat("{", 100000) + strings.Repeat("}", 100000),
+		"nested blocks": strings.Repeat("do ", 100000) + strings.Repeat("end ", 100000),
+		"unary chain":   "x = " + strings.Repeat("- ", 100000) + "1",
+		"concat chain":  "x = 'a'" + strings.Repeat(" .. 'a'", 100000),
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := Load("test", src)
+			if err == nil || !strings.Contains(err.Error(), "too many syntax levels") {
+				t.Fatalf("got %v, want a nesting error", err)
+			}
+		})
+	}
+	t.Run("nesting within limit", func(t *testing.T) {
+		src := "x = " + strings.Repeat("(", maxNesting/2) + "1" + strings.Repeat(")", maxNesting/2)
+		if _, err := Load("test", src); err != nil {
+			t.Fatal(err)
+		}
+	})
+	t.Run("json cycle", func(t *testing.T) {
+		st, err := Load("test", "function f() local t = {} t.self = t return t end")
+		if err != nil {
+			t.Fatal(err)
+		}
+		rs, err := st.Call("f")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ToJSON(rs[0]); err == nil || !strings.Contains(err.Error(), "too deep") {
+			t.Fatalf("got %v, want a nesting error", err)
+		}
+	})
+}
+
+func TestJSONRoundTrip(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"object", `{"b":1,"a":"x","c":null}`, `{"a":"x","b":1}`},
+		{"array", `[1,"two",true,null,{"k":[]}]`, `[1,"two",true,null,{"k":[]}]`},
+		{"empty array stays array", `{"a":[]}`, `{"a":[]}`},
+		{"nulls in arrays survive", `[null,1,null,null,2,null]`, `[null,1,null,null,2]`},
+		{"big numbers keep digits", `{"n":18446744073709551615,"f":0.1}`, `{"f":0.1,"n":18446744073709551615}`},
+		{"nested", `{"a":{"b":{"c":[1,[2,[3]]]}}}`, `{"a":{"b":{"c":[1,[2,[3]]]}}}`},
+		{"unicode", `{"s":"héllo ☃"}`, `{"s":"héllo ☃"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := DecodeJSON([]byte(tt.in))
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, err := ToJSON(v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := json.Marshal(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tt.want {
+				t.Errorf("got %s, want %s", b, tt.want)
+			}
+		})
+	}
+}
+
+func TestJSONFromScript(t *testing.T) {
+	st, err := Load("test", `
+function transform(msg)
+  msg.count = msg.count + 1
+  msg.tags[#msg.tags + 1] = "x"
+  msg.drop = nil
+  msg[1] = "one"
+  return msg
+end
+function bad(msg) msg.f = print return msg end
+function nan(msg) msg.v = 0/0 return msg end`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in, err := DecodeJSON([]byte(`{"count":41,"tags":["a"],"drop":true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs, err := st.Call("transform", in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := ToJSON(rs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := json.Marshal(out)
+	if want := `{"1":"one","count":42,"tags":["a","x"]}`; string(b) != want {
+		t.Errorf("got %s, want %s", b, want)
+	}
+
+	for _, fn := range []string{"bad", "nan"} {
+		rs, err := st.Call(fn, NewTable())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ToJSON(rs[0]); err == nil {
+			t.Errorf("%s: encoded", fn)
+		}
+	}
+	if _, err := st.Call("missing"); err == nil {
+		t.Error("called a missing function")
+	}
+	if !st.HasFunction("transform") || st.HasFunction("count") {
+		t.Error("HasFunction")
+	}
+}
+
+func TestDecodeJSONMalformed(t *testing.T) {
+	for _, in := range []string{``, `{`, `{"a":}`, `[1,]`, `nul`} {
+		if _, err := DecodeJSON([]byte(in)); err == nil {
+			t.Errorf("%q: decoded", in)
+		}
+	}
+}
@@ -0,0 +1,523 @@
+package lua
+
+import "fmt"
+
+// Expressions.
+type (
+	expr any
+
+	constExpr struct{ v Value }
+	nameExpr  struct {
+		name string
+		line int
+	}
+	indexExpr struct {
+		obj, key expr
+		line     int
+	}
+	// callExpr calls fn, or with method set obj:method(args) where fn is obj.
+	callExpr struct {
+		fn     expr
+		method string
+		args   []expr
+		line   int
+	}
+	funcExpr struct {
+		name   string // for error messages
+		params []string
+		body   []stmt
+	}
+	binExpr struct {
+		op   string
+		l, r expr
+		line int
+	}
+	unExpr struct {
+		op   string
+		e    expr
+		line int
+	}
+	tableExpr struct {
+		keys []expr // nil for positional fields
+		vals []expr
+		line int
+	}
+	// parenExpr cuts a call's results to one.
+	parenExpr struct{ e expr }
+)
+
+// Statements.
+type (
+	stmt any
+
+	localStmt struct {
+		names []string
+		exprs []expr
+		line  int
+	}
+	assignStmt struct {
+		targets []expr // nameExpr or indexExpr
+		exprs   []expr
+		line    int
+	}
+	callStmt struct {
+		call *callExpr
+	}
+	ifStmt struct {
+		conds  []expr
+		blocks [][]stmt
+		els    []stmt
+	}
+	whileStmt struct {
+		cond expr
+		body []stmt
+	}
+	repeatStmt struct {
+		body []stmt
+		cond expr
+	}
+	numForStmt struct {
+		name               string
+		start, limit, step expr
+		body               []stmt
+		line               int
+	}
+	genForStmt struct {
+		names []string
+		exprs []expr
+		body  []stmt
+		line  int
+	}
+	doStmt     struct{ body []stmt }
+	returnStmt struct {
+		exprs []expr
+	}
+	breakStmt     struct{}
+	localFuncStmt struct {
+		name string
+		fn   *funcExpr
+	}
+)
+
+// binary operator priorities (left, right), as in Lua 5.1.
+var binPrio = map[string][2]int{
+	"or": {1, 1}, "and": {2, 2},
+	"<": {3, 3}, ">": {3, 3}, "<=": {3, 3}, ">=": {3, 3}, "~=": {3, 3}, "==": {3, 3},
+	"..": {5, 4}, "+": {6, 6}, "-": {6, 6},
+	"*": {7, 7}, "/": {7, 7}, "%": {7, 7},
+	"^": {10, 9},
+}
+
+const unaryPrio = 8
+
+// maxNesting bounds nested blocks and expressions, as LUAI_MAXCCALLS does
+// in Lua 5.1: parsing and running them recurses in Go.
+const maxNesting = 200
+
+type parser struct {
+	toks  []token
+	pos   int
+	depth int
+}
+
+// parse turns src into the statements of its main chunk.
+func parse(src string) ([]stmt, error) {
+	toks, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{toks: toks}
+	var body []stmt
+	err = catch(func() {
+		body = p.block()
+		if t := p.peek(); t.kind != tEOF {
+			p.fail(t, "'<eof>' expected")
+		}
+	})
+	return body, err
+}
+
+// parseError carries a syntax error through the recursive descent.
+type parseError struct{ err *Error }
+
+func catch(f func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			pe, ok := r.(parseError)
+			if !ok {
+				panic(r)
+			}
+			err = pe.err
+		}
+	}()
+	f()
+	return nil
+}
+
+func (p *parser) fail(t token, format string, args ...any) {
+	near := t.s
+	switch t.kind {
+	case tEOF:
+		near = "<eof>"
+	case tNumber:
+		near = fmt.Sprint(t.n)
+	}
+	panic(parseError{&Error{Line: t.line, Msg: fmt.Sprintf(format, args...) + fmt.Sprintf(" near '%s'", near)}})
+}
+
+func (p *parser) peek() token { return p.toks[p.pos] }
+
+func (p *parser) next() token {
+	t := p.toks[p.pos]
+	if t.kind != tEOF {
+		p.pos++
+	}
+	return t
+}
+
+// is reports whether the next token is the keyword or symbol s.
+func (p *parser) is(s string) bool {
+	t := p.peek()
+	return (t.kind == tKeyword || t.kind == tSymbol) && t.s == s
+}
+
+func (p *parser) accept(s string) bool {
+	if p.is(s) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(s string) token {
+	t := p.peek()
+	if !p.is(s) {
+		p.fail(t, "'%s' expected", s)
+	}
+	return p.next()
+}
+
+// enter counts a nesting level; callers defer p.leave().
+func (p *parser) enter() {
+	p.depth++
+	if p.depth > maxNesting {
+		p.fail(p.peek(), "chunk has too many syntax levels")
+	}
+}
+
+func (p *parser) leave() { p.depth-- }
+
+func (p *parser) name() string {
+	t := p.peek()
+	if t.kind != tName {
+		p.fail(t, "name expected")
+	}
+	p.next()
+	return t.s
+}
+
+// block reads statements up to a block end (end, else, elseif, until or
+// the end of input).
+func (p *parser) block() []stmt {
+	p.enter()
+	defer p.leave()
+	var body []stmt
+	for {
+		switch {
+		case p.peek().kind == tEOF, p.is("end"), p.is("else"), p.is("elseif"), p.is("until"):
+			return body
+		case p.is("return"):
+			p.next()
+			var r returnStmt
+			if !p.blockEnd() && !p.is(";") {
+				r.exprs = p.exprList()
+			}
+			p.accept(";")
+			if !p.blockEnd() {
+				p.fail(p.peek(), "'end' expected")
+			}
+			return append(body, r)
+		}
+		if s := p.statement(); s != nil {
+			body = append(body, s)
+		}
+	}
+}
+
+func (p *parser) blockEnd() bool {
+	return p.peek().kind == tEOF || p.is("end") || p.is("else") || p.is("elseif") || p.is("until")
+}
+
+func (p *parser) statement() stmt {
+	t := p.peek()
+	switch {
+	case p.accept(";"):
+		return nil
+	case p.accept("break"):
+		return breakStmt{}
+	case p.accept("do"):
+		body := p.block()
+		p.expect("end")
+		return doStmt{body}
+	case p.accept("while"):
+		cond := p.expr(0)
+		p.expect("do")
+		body := p.block()
+		p.expect("end")
+		return whileStmt{cond, body}
+	case p.accept("repeat"):
+		body := p.block()
+		p.expect("until")
+		return repeatStmt{body, p.expr(0)}
+	case p.accept("if"):
+		var s ifStmt
+		for {
+			s.conds = append(s.conds, p.expr(0))
+			p.expect("then")
+			s.blocks = append(s.blocks, p.block())
+			if !p.accept("elseif") {
+				break
+			}
+		}
+		if p.accept("else") {
+			s.els = p.block()
+		}
+		p.expect("end")
+		return s
+	case p.accept("for"):
+		first := p.name()
+		if p.accept("=") {
+			s := numForStmt{name: first, line: t.line}
+			s.start = p.expr(0)
+			p.expect(",")
+			s.limit = p.expr(0)
+			if p.accept(",") {
+				s.step = p.expr(0)
+			}
+			p.expect("do")
+			s.body = p.block()
+			p.expect("end")
+			return s
+		}
+		s := genForStmt{names: []string{first}, line: t.line}
+		for p.accept(",") {
+			s.names = append(s.names, p.name())
+		}
+		p.expect("in")
+		s.exprs = p.exprList()
+		p.expect("do")
+		s.body = p.block()
+		p.expect("end")
+		return s
+	case p.accept("function"):
+		name := p.name()
+		var target expr = nameExpr{name, t.line}
+		method := false
+		for p.is(".") || p.is(":") {
+			method = p.next().s == ":"
+			key := p.name()
+			name += "." + key
+			target = indexExpr{target, constExpr{key}, t.line}
+			if method {
+				break
+			}
+		}
+		fn := p.funcBody(name, method)
+		return assignStmt{targets: []expr{target}, exprs: []expr{fn}, line: t.line}
+	case p.accept("local"):
+		if p.accept("function") {
+			name := p.name()
+			return localFuncStmt{name, p.funcBody(name, false)}
+		}
+		s := localStmt{names: []string{p.name()}, line: t.line}
+		for p.accept(",") {
+			s.names = append(s.names, p.name())
+		}
+		if p.accept("=") {
+			s.exprs = p.exprList()
+		}
+		return s
+	}
+
+	e := p.suffixed()
+	if p.is("=") || p.is(",") {
+		s := assignStmt{targets: []expr{e}, line: t.line}
+		for p.accept(",") {
+			s.targets = append(s.targets, p.suffixed())
+		}
+		p.expect("=")
+		s.exprs = p.exprList()
+		for _, tg := range s.targets {
+			switch tg.(type) {
+			case nameExpr, indexExpr:
+			default:
+				p.fail(t, "syntax error")
+			}
+		}
+		return s
+	}
+	call, ok := e.(*callExpr)
+	if !ok {
+		p.fail(p.peek(), "syntax error")
+	}
+	return callStmt{call}
+}
+
+// funcBody reads (params) block end; a method gets self first.
+func (p *parser) funcBody(name string, method bool) *funcExpr {
+	fn := &funcExpr{name: name}
+	if method {
+		fn.params = append(fn.params, "self")
+	}
+	p.expect("(")
+	if !p.is(")") {
+		for {
+			if p.is("...") {
+				p.fail(p.peek(), "varargs are not supported")
+			}
+			fn.params = append(fn.params, p.name())
+			if !p.accept(",") {
+				break
+			}
+		}
+	}
+	p.expect(")")
+	fn.body = p.block()
+	p.expect("end")
+	return fn
+}
+
+func (p *parser) exprList() []expr {
+	list := []expr{p.expr(0)}
+	for p.accept(",") {
+		list = append(list, p.expr(0))
+	}
+	return list
+}
+
+// expr reads an expression whose binary operators bind tighter than limit.
+func (p *parser) expr(limit int) expr {
+	p.enter()
+	defer p.leave()
+	var e expr
+	t := p.peek()
+	if p.is("not") || p.is("-") || p.is("#") {
+		p.next()
+		e = unExpr{t.s, p.expr(unaryPrio), t.line}
+	} else {
+		e = p.simple()
+	}
+	for {
+		op := p.peek()
+		prio, ok := binPrio[op.s]
+		if !ok || op.kind != tSymbol && op.kind != tKeyword || prio[0] <= limit {
+			return e
+		}
+		p.next()
+		e = binExpr{op.s, e, p.expr(prio[1]), op.line}
+	}
+}
+
+func (p *parser) simple() expr {
+	t := p.peek()
+	switch {
+	case t.kind == tNumber:
+		p.next()
+		return constExpr{t.n}
+	case t.kind == tString:
+		p.next()
+		return constExpr{t.s}
+	case p.accept("nil"):
+		return constExpr{nil}
+	case p.accept("true"):
+		return constExpr{true}
+	case p.accept("false"):
+		return constExpr{false}
+	case p.is("..."):
+		p.fail(t, "varargs are not supported")
+	case p.accept("function"):
+		return p.funcBody("anonymous", false)
+	case p.is("{"):
+		return p.table()
+	}
+	return p.suffixed()
+}
+
+// suffixed reads a name or parenthesized expression followed by field
+// accesses and calls.
+func (p *parser) suffixed() expr {
+	t := p.peek()
+	var e expr
+	switch {
+	case t.kind == tName:
+		p.next()
+		e = nameExpr{t.s, t.line}
+	case p.accept("("):
+		e = parenExpr{p.expr(0)}
+		p.expect(")")
+	default:
+		p.fail(t, "unexpected symbol")
+	}
+	for {
+		t := p.peek()
+		switch {
+		case p.accept("."):
+			e = indexExpr{e, constExpr{p.name()}, t.line}
+		case p.accept("["):
+			k := p.expr(0)
+			p.expect("]")
+			e = indexExpr{e, k, t.line}
+		case p.accept(":"):
+			m := p.name()
+			e = &callExpr{fn: e, method: m, args: p.args(), line: t.line}
+		case p.is("("), p.is("{"), t.kind == tString:
+			e = &callExpr{fn: e, args: p.args(), line: t.line}
+		default:
+			return e
+		}
+	}
+}
+
+// args reads call arguments: (list), a table or a string.
+func (p *parser) args() []expr {
+	t := p.peek()
+	switch {
+	case t.kind == tString:
+		p.next()
+		return []expr{constExpr{t.s}}
+	case p.is("{"):
+		return []expr{p.table()}
+	}
+	p.expect("(")
+	if p.accept(")") {
+		return nil
+	}
+	list := p.exprList()
+	p.expect(")")
+	return list
+}
+
+func (p *parser) table() expr {
+	t := p.expect("{")
+	e := tableExpr{line: t.line}
+	for !p.is("}") {
+		switch {
+		case p.accept("["):
+			k := p.expr(0)
+			p.expect("]")
+			p.expect("=")
+			e.keys = append(e.keys, k)
+		case p.peek().kind == tName && p.toks[p.pos+1].kind == tSymbol && p.toks[p.pos+1].s == "=":
+			e.keys = append(e.keys, constExpr{p.name()})
+			p.next()
+		default:
+			e.keys = append(e.keys, nil)
+		}
+		e.vals = append(e.vals, p.expr(0))
+		if !p.accept(",") && !p.accept(";") {
+			break
+		}
+	}
+	p.expect("}")
+	return e
+}
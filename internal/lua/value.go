@@ -0,0 +1,229 @@
+package lua
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Value is a Lua value: nil, bool, float64, string, *Table or a function
+// (*Builtin, *closure). Numbers decoded from JSON stay json.Number until
+// the script computes with them, so counters it doesn't touch keep all
+// their digits.
+type Value = any
+
+// Builtin is a function implemented in Go.
+type Builtin struct {
+	Name string
+	Fn   func(args []Value) ([]Value, error)
+}
+
+// closure is a function defined by the script.
+type closure struct {
+	fn  *funcExpr
+	env *scope
+}
+
+// Table is a Lua table. Keys keep the order they were first set in, so
+// pairs walks JSON objects in their decoded (sorted) order.
+type Table struct {
+	m     map[any]Value
+	keys  []any
+	array bool // decoded from a JSON array; encodes back as one even when empty
+}
+
+// NewTable returns an empty table.
+func NewTable() *Table {
+	return &Table{m: map[any]Value{}}
+}
+
+// normKey makes numeric keys comparable: 1, 1.0 and "1" as a JSON number
+// are the same key.
+func normKey(k Value) Value {
+	if n, ok := k.(json.Number); ok {
+		if f, err := n.Float64(); err == nil {
+			return f
+		}
+	}
+	return k
+}
+
+// Get returns t[k], nil when unset.
+func (t *Table) Get(k Value) Value {
+	return t.m[normKey(k)]
+}
+
+// Set sets t[k]; a nil v removes the key.
+func (t *Table) Set(k, v Value) error {
+	k = normKey(k)
+	switch x := k.(type) {
+	case nil:
+		return fmt.Errorf("table index is nil")
+	case float64:
+		if math.IsNaN(x) {
+			return fmt.Errorf("table index is NaN")
+		}
+	}
+	if v == nil {
+		delete(t.m, k)
+		if len(t.keys) > 2*len(t.m)+8 {
+			t.compact()
+		}
+		return nil
+	}
+	if _, ok := t.m[k]; !ok {
+		t.keys = append(t.keys, k)
+	}
+	t.m[k] = v
+	return nil
+}
+
+// Len is the length operator: n such that t[n] is set and t[n+1] is not.
+func (t *Table) Len() int {
+	n := 0
+	for t.m[float64(n+1)] != nil {
+		n++
+	}
+	return n
+}
+
+// maxIndex is the highest positive integer key, 0 if none.
+func (t *Table) maxIndex() int {
+	n := 0
+	for k := range t.m {
+		if f, ok := k.(float64); ok && f >= 1 && f == math.Trunc(f) && f > float64(n) {
+			n = int(f)
+		}
+	}
+	return n
+}
+
+// Keys returns the set keys in insertion order.
+func (t *Table) Keys() []Value {
+	t.compact()
+	return append([]Value(nil), t.keys...)
+}
+
+func (t *Table) compact() {
+	keys := t.keys[:0]
+	seen := make(map[any]bool, len(t.m))
+	for _, k := range t.keys {
+		if _, ok := t.m[k]; ok && !seen[k] {
+			seen[k] = true
+			keys = append(keys, k)
+		}
+	}
+	t.keys = keys
+}
+
+// typeName is what type() returns.
+func typeName(v Value) string {
+	switch v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return "boolean"
+	case float64, json.Number:
+		return "number"
+	case string:
+		return "string"
+	case *Table:
+		return "table"
+	case *Builtin, *closure:
+		return "function"
+	}
+	return "userdata"
+}
+
+func truthy(v Value) bool {
+	switch x := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return x
+	}
+	return true
+}
+
+// toNumber converts numbers and numeric strings.
+func toNumber(v Value) (float64, bool) {
+	switch x := v.(type) {
+	case float64:
+		return x, true
+	case json.Number:
+		f, err := x.Float64()
+		return f, err == nil
+	case string:
+		s := strings.TrimSpace(x)
+		if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
+			n, err := strconv.ParseUint(s[2:], 16, 64)
+			return float64(n), err == nil
+		}
+		f, err := strconv.ParseFloat(s, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func isNumber(v Value) bool {
+	switch v.(type) {
+	case float64, json.Number:
+		return true
+	}
+	return false
+}
+
+// formatNumber prints integers in full and other numbers like Lua's %.14g.
+func formatNumber(f float64) string {
+	if f == math.Trunc(f) && math.Abs(f) < 1e15 {
+		return strconv.FormatInt(int64(f), 10)
+	}
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	case math.IsNaN(f):
+		return "nan"
+	}
+	return strconv.FormatFloat(f, 'g', 14, 64)
+}
+
+// toString is tostring().
+func toString(v Value) string {
+	switch x := v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return strconv.FormatBool(x)
+	case float64:
+		return formatNumber(x)
+	case json.Number:
+		return string(x)
+	case string:
+		return x
+	case *Table:
+		return fmt.Sprintf("table: %p", x)
+	case *Builtin:
+		return fmt.Sprintf("builtin: %s", x.Name)
+	case *closure:
+		return fmt.Sprintf("function: %p", x)
+	}
+	return fmt.Sprint(v)
+}
+
+// rawEqual is ==: numbers by value, tables and functions by identity.
+func rawEqual(a, b Value) bool {
+	if isNumber(a) && isNumber(b) {
+		x, _ := toNumber(a)
+		y, _ := toNumber(b)
+		return x == y
+	}
+	switch a.(type) {
+	case nil, bool, string, *Table, *Builtin, *closure:
+		return a == b
+	}
+	return false
+}
@@ -0,0 +1,66 @@
+package metrics
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// readConntrack reports the nf_conntrack table fill level and the drop
+// counters of /proc/net/stat/nf_conntrack (summed over CPUs). It returns
+// nil when the module isn't loaded.
+func readConntrack() *Conntrack {
+	count, ok := readSysUint("/proc/sys/net/netfilter/nf_conntrack_count")
+	if !ok {
+		return nil
+	}
+	c := &Conntrack{Count: count}
+	c.Max, _ = readSysUint("/proc/sys/net/netfilter/nf_conntrack_max")
+	if c.Max > 0 {
+		c.Pct = float64(c.Count) * 100.0 / float64(c.Max)
+	}
+	c.Buckets, _ = readSysUint("/proc/sys/net/netfilter/nf_conntrack_buckets")
+
+	f, err := os.Open("/proc/net/stat/nf_conntrack")
+	if err != nil {
+		return c
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	var hdr []string
+	for sc.Scan() {
+		p := strings.Fields(sc.Text())
+		if hdr == nil {
+			hdr = p
+			continue
+		}
+		for i, v := range p {
+			if i >= len(hdr) {
+				break
+			}
+			n, err := strconv.ParseUint(v, 16, 64)
+			if err != nil {
+				continue
+			}
+			switch hdr[i] {
+			case "drop":
+				c.Drop += n
+			case "early_drop":
+				c.EarlyDrop += n
+			case "insert_failed":
+				c.InsertFailed += n
+			}
+		}
+	}
+	return c
+}
+
+func readSysUint(path string) (uint64, bool) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, false
+	}
+	v, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+	return v, err == nil
+}
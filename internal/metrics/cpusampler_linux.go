@@ -0,0 +1,59 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+)
+
+// CPUSampler measures CPU % over short steps, between two metrics
+// snapshots: call Sample every step (see SetEvery) and Take with each
+// snapshot.
+type CPUSampler struct {
+	mu    sync.Mutex
+	every time.Duration
+	prev  *cpuTimes
+	pcts  []float64
+}
+
+func NewCPUSampler(every time.Duration) *CPUSampler {
+	return &CPUSampler{every: every}
+}
+
+// SetEvery records the step Sample is called at, reported in CPUStats.
+func (s *CPUSampler) SetEvery(d time.Duration) {
+	s.mu.Lock()
+	s.every = d
+	s.mu.Unlock()
+}
+
+// Sample records CPU % since the previous Sample.
+func (s *CPUSampler) Sample() {
+	ct, err := readCPUTimes()
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.prev != nil {
+		s.pcts = append(s.pcts, cpuPercent(*s.prev, ct))
+	}
+	s.prev = &ct
+}
+
+// Reset forgets the samples and the last reading, e.g. while sampling is
+// paused.
+func (s *CPUSampler) Reset() {
+	s.mu.Lock()
+	s.prev, s.pcts = nil, nil
+	s.mu.Unlock()
+}
+
+// Take returns the summary of the samples since the last Take (nil if
+// none) and starts over.
+func (s *CPUSampler) Take() *CPUStats {
+	s.mu.Lock()
+	pcts, every := s.pcts, s.every
+	s.pcts = nil
+	s.mu.Unlock()
+	return cpuStats(pcts, every)
+}
@@ -0,0 +1,20 @@
+//go:build darwin || freebsd
+
+package metrics
+
+import "syscall"
+
+const rootPath = "/"
+
+func readDisk(path string) (total, used uint64, err error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, 0, err
+	}
+	total = uint64(st.Blocks) * uint64(st.Bsize)
+	free := uint64(st.Bavail) * uint64(st.Bsize)
+	if total > free {
+		used = total - free
+	}
+	return total, used, nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd
+
+package metrics
+
+import "errors"
+
+const rootPath = "/"
+
+func readDisk(string) (uint64, uint64, error) {
+	return 0, 0, errors.New("disk stats not supported on this platform")
+}
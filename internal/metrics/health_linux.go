@@ -0,0 +1,41 @@
+package metrics
+
+import "syscall"
+
+// adjtimex (linux/timex.h)
+const (
+	staUnsync = 0x0040
+	staNano   = 0x2000
+	timeError = 5
+)
+
+var clockStates = map[int]string{0: "ok", 1: "ins", 2: "del", 3: "oop", 4: "wait", timeError: "error"}
+
+// readHealth reads the entropy pool and the kernel clock discipline state
+// (adjtimex, read-only). It returns nil if neither is available.
+func readHealth() *Health {
+	h := &Health{}
+	avail, okE := readSysUint("/proc/sys/kernel/random/entropy_avail")
+	h.EntropyAvail = avail
+	h.EntropyPoolSize, _ = readSysUint("/proc/sys/kernel/random/poolsize")
+
+	var tx syscall.Timex
+	state, err := syscall.Adjtimex(&tx)
+	if err != nil {
+		if !okE {
+			return nil
+		}
+		return h
+	}
+	h.ClockState = clockStates[state]
+	h.NTPSynced = state != timeError && tx.Status&staUnsync == 0
+	off := float64(tx.Offset) / 1e3 // usec
+	if tx.Status&staNano != 0 {
+		off = float64(tx.Offset) / 1e6
+	}
+	h.OffsetMS = off
+	h.FreqPPM = float64(tx.Freq) / 65536 // 16.16 fixed point
+	h.MaxErrorMS = float64(tx.Maxerror) / 1e3
+	h.EstErrorMS = float64(tx.Esterror) / 1e3
+	return h
+}
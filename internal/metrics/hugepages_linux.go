@@ -0,0 +1,111 @@
+package metrics
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+)
+
+func readHugePages() *HugePages {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var h HugePages
+	seen := false
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		parts := strings.Fields(sc.Text())
+		if len(parts) < 2 {
+			continue
+		}
+		v, e := strconv.ParseUint(parts[1], 10, 64)
+		if e != nil {
+			continue
+		}
+		switch strings.TrimSuffix(parts[0], ":") {
+		case "HugePages_Total": // counts, not kB
+			h.Total = v
+			seen = true
+		case "HugePages_Free":
+			h.Free = v
+		case "HugePages_Rsvd":
+			h.Rsvd = v
+		case "HugePages_Surp":
+			h.Surp = v
+		case "Hugepagesize":
+			h.PageSizeBytes = v * 1024
+		case "AnonHugePages":
+			h.AnonHugeBytes = v * 1024
+		}
+	}
+	if !seen {
+		return nil
+	}
+	return &h
+}
+
+// readFragmentation parses lines like
+//
+//	Node 0, zone   Normal   5187   4103   2670    861 ...
+//
+// where column i is the number of free blocks of 2^i pages.
+func readFragmentation(hugePageSize uint64) *Fragmentation {
+	f, err := os.Open("/proc/buddyinfo")
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	page := uint64(os.Getpagesize())
+	order := 9 // 2 MiB on 4 KiB pages
+	if hugePageSize > page {
+		order = 0
+		for s := hugePageSize / page; s > 1; s >>= 1 {
+			order++
+		}
+	}
+
+	fr := Fragmentation{Order: order}
+	var allFree, allUsable uint64
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		parts := strings.Fields(strings.ReplaceAll(sc.Text(), ",", " "))
+		// Node N zone NAME c0 c1 ...
+		if len(parts) < 5 || parts[0] != "Node" || parts[2] != "zone" {
+			continue
+		}
+		node, _ := strconv.Atoi(parts[1])
+		var free, usable uint64
+		for i, c := range parts[4:] {
+			n, e := strconv.ParseUint(c, 10, 64)
+			if e != nil {
+				continue
+			}
+			pages := n << uint(i)
+			free += pages
+			if i >= order {
+				usable += pages
+			}
+		}
+		allFree += free
+		allUsable += usable
+		fr.Zones = append(fr.Zones, ZoneFrag{Node: node, Zone: parts[3], Unusable: unusablePct(free, usable)})
+	}
+	if len(fr.Zones) == 0 {
+		return nil
+	}
+	fr.FreeBytes = allFree * page
+	fr.Unusable = unusablePct(allFree, allUsable)
+	return &fr
+}
+
+func unusablePct(free, usable uint64) float64 {
+	if free == 0 {
+		return 0
+	}
+	return float64(free-usable) * 100.0 / float64(free)
+}
@@ -0,0 +1,51 @@
+package metrics
+
+import "time"
+
+type ipOctets struct {
+	in4, out4, in6, out6 uint64
+}
+
+// readIPOctets reads host-wide IP byte counters. IPv4 octets live in the
+// IpExt section of /proc/net/netstat (/proc/net/snmp only counts packets),
+// IPv6 ones in /proc/net/snmp6.
+func readIPOctets() (ipOctets, bool) {
+	var o ipOctets
+	ok := false
+	if t, err := readPairedTable("/proc/net/netstat"); err == nil {
+		if ext, found := t["IpExt"]; found {
+			o.in4, o.out4 = ext["InOctets"], ext["OutOctets"]
+			ok = true
+		}
+	}
+	if t, err := readFlatTable("/proc/net/snmp6"); err == nil {
+		o.in6, o.out6 = t["Ip6InOctets"], t["Ip6OutOctets"]
+		ok = true
+	}
+	return o, ok
+}
+
+func (c *Collector) collectIPFamily(now time.Time) *IPFamilyTraffic {
+	o, ok := readIPOctets()
+	if !ok {
+		return nil
+	}
+	t := &IPFamilyTraffic{
+		V4InBytes: o.in4, V4OutBytes: o.out4,
+		V6InBytes: o.in6, V6OutBytes: o.out6,
+	}
+	if c.prevIP != nil {
+		if dt := now.Sub(c.prevIPTS).Seconds(); dt > 0 {
+			t.V4InBPS = uint64(float64(diffU64(c.prevIP.in4, o.in4)) / dt)
+			t.V4OutBPS = uint64(float64(diffU64(c.prevIP.out4, o.out4)) / dt)
+			t.V6InBPS = uint64(float64(diffU64(c.prevIP.in6, o.in6)) / dt)
+			t.V6OutBPS = uint64(float64(diffU64(c.prevIP.out6, o.out6)) / dt)
+		}
+	}
+	if total := o.in4 + o.out4 + o.in6 + o.out6; total > 0 {
+		t.V6SharePct = float64(o.in6+o.out6) * 100.0 / float64(total)
+	}
+	c.prevIP = &o
+	c.prevIPTS = now
+	return t
+}
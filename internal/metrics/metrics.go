@@ -0,0 +1,308 @@
+package metrics
+
+import (
+	"math"
+	"runtime"
+	"sort"
+	"time"
+
+	"github.com/Vincentkeio/agent/internal/authlog"
+	"github.com/Vincentkeio/agent/internal/k8s"
+)
+
+type Snapshot struct {
+	TS int64 `json:"ts"`
+
+	CPU float64 `json:"cpu"` // %
+	Mem float64 `json:"mem"` // %
+
+	// CPU % sampled faster than the metrics interval (see CPUSampler)
+	CPUStats *CPUStats `json:"cpu_stats,omitempty"`
+
+	MemTotalBytes uint64 `json:"mem_total_bytes,omitempty"`
+	MemUsedBytes  uint64 `json:"mem_used_bytes,omitempty"`
+
+	Disk float64 `json:"disk"` // %
+	DiskTotalBytes uint64 `json:"disk_total_bytes,omitempty"`
+	DiskUsedBytes  uint64 `json:"disk_used_bytes,omitempty"`
+
+	Swap float64 `json:"swap"` // %
+	SwapTotalBytes uint64 `json:"swap_total_bytes,omitempty"`
+	SwapUsedBytes  uint64 `json:"swap_used_bytes,omitempty"`
+
+	BytesUpTotal   uint64 `json:"bytes_up_total"`
+	BytesDownTotal uint64 `json:"bytes_down_total"`
+	NetUpBPS       uint64 `json:"net_up_bps"`
+	NetDownBPS     uint64 `json:"net_down_bps"`
+
+	// Labelled uplinks of multi-homed hosts (net_ifaces), by label
+	Ifaces map[string]*IfaceTraffic `json:"ifaces,omitempty"`
+
+	UptimeSec uint64 `json:"uptime_sec,omitempty"`
+
+	// Host-wide IPv4 vs IPv6 byte counters (all interfaces)
+	IPFamily *IPFamilyTraffic `json:"ip_family,omitempty"`
+
+	// Scheduler activity from /proc/stat
+	CtxtPS       uint64 `json:"ctxt_ps,omitempty"` // context switches/sec
+	IntrPS       uint64 `json:"intr_ps,omitempty"` // interrupts/sec
+	ProcsRunning uint64 `json:"procs_running,omitempty"`
+	ProcsBlocked uint64 `json:"procs_blocked,omitempty"`
+
+	// Per NUMA node breakdown (only with numa enabled on multi-node hosts)
+	NUMA []NUMANode `json:"numa,omitempty"`
+
+	Sockets *SockStat `json:"sockets,omitempty"`
+
+	// Passive TCP link quality: retransmissions from /proc/net/snmp and
+	// the RTT of established sockets
+	TCP *TCPQuality `json:"tcp,omitempty"`
+
+	// Netfilter connection tracking (nil without nf_conntrack)
+	Conntrack *Conntrack `json:"conntrack,omitempty"`
+
+	HugePages *HugePages     `json:"hugepages,omitempty"`
+	Frag      *Fragmentation `json:"frag,omitempty"`
+
+	// Pressure stall information (Linux >= 4.20, nil when unavailable)
+	PSI *PSI `json:"psi,omitempty"`
+
+	// Entropy and kernel clock sync (Linux)
+	Health *Health `json:"health,omitempty"`
+
+	// Failed logins from sshd's log (filled in by the agent when
+	// ssh_auth_log is set)
+	Security *Security `json:"security,omitempty"`
+
+	// Kubernetes node state (filled in by the agent in kubernetes mode)
+	K8s *k8s.Node `json:"k8s,omitempty"`
+
+	// Set only by the fallback collector on platforms without /proc.
+	Stub    bool          `json:"stub,omitempty"`
+	Runtime *RuntimeStats `json:"runtime,omitempty"`
+}
+
+// Health covers what silently breaks TLS and time series on small VPSes:
+// a starved entropy pool and an unsynchronized clock. The clock fields come
+// from adjtimex: NTPSynced is false while the kernel flags the clock
+// unsynchronized (no NTP daemon, or it lost its servers), OffsetMS is the
+// last offset the daemon fed in, FreqPPM the frequency correction (drift)
+// being applied and MaxErrorMS/EstErrorMS the kernel's error bounds.
+type Health struct {
+	EntropyAvail    uint64  `json:"entropy_avail"`
+	EntropyPoolSize uint64  `json:"entropy_pool_size,omitempty"`
+	NTPSynced       bool    `json:"ntp_synced"`
+	ClockState      string  `json:"clock_state,omitempty"` // ok, ins, del, oop, wait, error
+	OffsetMS        float64 `json:"offset_ms"`
+	FreqPPM         float64 `json:"freq_ppm"`
+	MaxErrorMS      float64 `json:"max_error_ms"`
+	EstErrorMS      float64 `json:"est_error_ms"`
+	// Where the agent's timestamps come from (see clock_source)
+	ClockSource string `json:"clock_source,omitempty"`
+}
+
+// Security holds intrusion-visibility counters.
+type Security struct {
+	SSH *authlog.Stats `json:"ssh,omitempty"`
+}
+
+// PSI holds /proc/pressure/* averages (percent of wall time stalled).
+type PSI struct {
+	CPU    *PSIResource `json:"cpu,omitempty"`
+	Memory *PSIResource `json:"memory,omitempty"`
+	IO     *PSIResource `json:"io,omitempty"`
+}
+
+type PSIResource struct {
+	Some PSIAvg  `json:"some"`
+	Full *PSIAvg `json:"full,omitempty"` // not reported for cpu on older kernels
+}
+
+type PSIAvg struct {
+	Avg10  float64 `json:"avg10"`
+	Avg60  float64 `json:"avg60"`
+	Avg300 float64 `json:"avg300"`
+}
+
+type IPFamilyTraffic struct {
+	V4InBytes  uint64  `json:"v4_in_bytes"`
+	V4OutBytes uint64  `json:"v4_out_bytes"`
+	V6InBytes  uint64  `json:"v6_in_bytes"`
+	V6OutBytes uint64  `json:"v6_out_bytes"`
+	V4InBPS    uint64  `json:"v4_in_bps"`
+	V4OutBPS   uint64  `json:"v4_out_bps"`
+	V6InBPS    uint64  `json:"v6_in_bps"`
+	V6OutBPS   uint64  `json:"v6_out_bps"`
+	V6SharePct float64 `json:"v6_share_pct"` // of all bytes since boot
+}
+
+// SockStat is socket usage and TCP buffer memory from /proc/net/sockstat.
+// TCPMemPressure is true once TCP memory reaches the tcp_mem pressure
+// threshold, where the kernel starts shrinking socket buffers.
+type SockStat struct {
+	SocketsUsed uint64 `json:"sockets_used"`
+	TCPInUse    uint64 `json:"tcp_inuse"` // v4 + v6
+	TCPOrphan   uint64 `json:"tcp_orphan"`
+	TCPTimeWait uint64 `json:"tcp_tw"`
+	TCPAlloc    uint64 `json:"tcp_alloc"`
+	UDPInUse    uint64 `json:"udp_inuse"` // v4 + v6
+
+	TCPMemBytes         uint64  `json:"tcp_mem_bytes"`
+	TCPMemPressureBytes uint64  `json:"tcp_mem_pressure_bytes,omitempty"`
+	TCPMemHighBytes     uint64  `json:"tcp_mem_high_bytes,omitempty"`
+	TCPMemPct           float64 `json:"tcp_mem_pct"` // of the high threshold
+	TCPMemPressure      bool    `json:"tcp_mem_pressure"`
+	TCPMaxOrphans       uint64  `json:"tcp_max_orphans,omitempty"`
+
+	UDPMemBytes uint64 `json:"udp_mem_bytes"`
+	FragMemory  uint64 `json:"frag_mem_bytes"`
+}
+
+// TCPQuality is host-wide TCP health. RetransPct is retransmitted segments
+// as a share of segments sent since the previous sample.
+type TCPQuality struct {
+	CurrEstab   uint64  `json:"curr_estab"`
+	OutSegs     uint64  `json:"out_segs"`
+	RetransSegs uint64  `json:"retrans_segs"`
+	RetransPct  float64 `json:"retrans_pct"`
+	RetransPS   uint64  `json:"retrans_ps"`
+	InErrsPS    uint64  `json:"in_errs_ps"`
+	OutRstsPS   uint64  `json:"out_rsts_ps"`
+	RTT         *TCPRTT `json:"rtt,omitempty"`
+}
+
+// TCPRTT summarizes the smoothed RTT (TCP_INFO) of established sockets to
+// non-loopback peers, refreshed every 15s.
+type TCPRTT struct {
+	Sockets int     `json:"sockets"`
+	AvgMS   float64 `json:"avg_ms"`
+	P50MS   float64 `json:"p50_ms"`
+	P95MS   float64 `json:"p95_ms"`
+	MaxMS   float64 `json:"max_ms"`
+}
+
+// Conntrack is the nf_conntrack table fill level. Drop, EarlyDrop and
+// InsertFailed are cumulative since boot; they grow once the table is full.
+type Conntrack struct {
+	Count        uint64  `json:"count"`
+	Max          uint64  `json:"max"`
+	Pct          float64 `json:"pct"` // count of max
+	Buckets      uint64  `json:"buckets,omitempty"`
+	Drop         uint64  `json:"drop"`
+	EarlyDrop    uint64  `json:"early_drop"`
+	InsertFailed uint64  `json:"insert_failed"`
+}
+
+type NUMANode struct {
+	Node          int     `json:"node"`
+	CPU           float64 `json:"cpu"` // %
+	Mem           float64 `json:"mem"` // %
+	MemTotalBytes uint64  `json:"mem_total_bytes"`
+	MemUsedBytes  uint64  `json:"mem_used_bytes"`
+}
+
+// IfaceTraffic is one labelled interface's counters and rates.
+type IfaceTraffic struct {
+	Iface          string `json:"iface"`
+	BytesUpTotal   uint64 `json:"bytes_up_total"`
+	BytesDownTotal uint64 `json:"bytes_down_total"`
+	NetUpBPS       uint64 `json:"net_up_bps"`
+	NetDownBPS     uint64 `json:"net_down_bps"`
+	Err            string `json:"err,omitempty"`
+}
+
+// NUMATopo describes one node for the hello inventory.
+type NUMATopo struct {
+	Node          int    `json:"node"`
+	CPUs          []int  `json:"cpus"`
+	MemTotalBytes uint64 `json:"mem_total_bytes"`
+}
+
+// HugePages mirrors the hugetlb counters of /proc/meminfo.
+type HugePages struct {
+	Total         uint64 `json:"total"`
+	Free          uint64 `json:"free"`
+	Rsvd          uint64 `json:"rsvd"`
+	Surp          uint64 `json:"surp"`
+	PageSizeBytes uint64 `json:"page_size_bytes"`
+	AnonHugeBytes uint64 `json:"anon_huge_bytes"` // transparent hugepages in use
+}
+
+// Fragmentation is derived from /proc/buddyinfo. Unusable is the share of
+// free memory sitting in blocks too small for one huge page (0 = none,
+// 100 = no huge-page-sized block left), the kernel's "unusable free space
+// index" at the huge page order.
+type Fragmentation struct {
+	Order     int        `json:"order"`
+	FreeBytes uint64     `json:"free_bytes"`
+	Unusable  float64    `json:"unusable_pct"`
+	Zones     []ZoneFrag `json:"zones,omitempty"`
+}
+
+type ZoneFrag struct {
+	Node     int     `json:"node"`
+	Zone     string  `json:"zone"`
+	Unusable float64 `json:"unusable_pct"`
+}
+
+// RuntimeStats describes the agent process itself (Go runtime view).
+type RuntimeStats struct {
+	Goroutines  int    `json:"goroutines"`
+	HeapAlloc   uint64 `json:"heap_alloc_bytes"`
+	SysBytes    uint64 `json:"sys_bytes"`
+	NumGC       uint32 `json:"num_gc"`
+	NumCPU      int    `json:"num_cpu"`
+	ProcUptimeS uint64 `json:"proc_uptime_sec"`
+}
+
+var procStart = time.Now()
+
+func readRuntime() *RuntimeStats {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return &RuntimeStats{
+		Goroutines:  runtime.NumGoroutine(),
+		HeapAlloc:   ms.HeapAlloc,
+		SysBytes:    ms.Sys,
+		NumGC:       ms.NumGC,
+		NumCPU:      runtime.NumCPU(),
+		ProcUptimeS: uint64(time.Since(procStart).Seconds()),
+	}
+}
+
+// CPUStats summarizes CPU % sampled every IntervalMS since the previous
+// metrics, so a spike shorter than a long reporting interval isn't
+// averaged away in Snapshot.CPU.
+type CPUStats struct {
+	Samples    int     `json:"samples"`
+	IntervalMS int64   `json:"interval_ms"`
+	Min        float64 `json:"min"`
+	Avg        float64 `json:"avg"`
+	Max        float64 `json:"max"`
+	P95        float64 `json:"p95"`
+}
+
+func cpuStats(pcts []float64, every time.Duration) *CPUStats {
+	if len(pcts) == 0 {
+		return nil
+	}
+	sorted := append([]float64(nil), pcts...)
+	sort.Float64s(sorted)
+	var sum float64
+	for _, v := range sorted {
+		sum += v
+	}
+	rank := int(math.Ceil(0.95 * float64(len(sorted))))
+	return &CPUStats{
+		Samples:    len(sorted),
+		IntervalMS: every.Milliseconds(),
+		Min:        round2(sorted[0]),
+		Avg:        round2(sum / float64(len(sorted))),
+		Max:        round2(sorted[len(sorted)-1]),
+		P95:        round2(sorted[max(rank, 1)-1]),
+	}
+}
+
+func round2(v float64) float64 {
+	return math.Round(v*100) / 100
+}
@@ -11,35 +11,31 @@ import (
 	"time"
 )
 
-type Snapshot struct {
-	TS int64 `json:"ts"`
-
-	CPU float64 `json:"cpu"` // %
-	Mem float64 `json:"mem"` // %
-
-	MemTotalBytes uint64 `json:"mem_total_bytes,omitempty"`
-	MemUsedBytes  uint64 `json:"mem_used_bytes,omitempty"`
-
-	Disk float64 `json:"disk"` // %
-	DiskTotalBytes uint64 `json:"disk_total_bytes,omitempty"`
-	DiskUsedBytes  uint64 `json:"disk_used_bytes,omitempty"`
-
-	Swap float64 `json:"swap"` // %
-	SwapTotalBytes uint64 `json:"swap_total_bytes,omitempty"`
-	SwapUsedBytes  uint64 `json:"swap_used_bytes,omitempty"`
-
-	BytesUpTotal   uint64 `json:"bytes_up_total"`
-	BytesDownTotal uint64 `json:"bytes_down_total"`
-	NetUpBPS       uint64 `json:"net_up_bps"`
-	NetDownBPS     uint64 `json:"net_down_bps"`
-}
-
 type Collector struct {
 	iface string
 
 	prevCPU *cpuTimes
 	prevNet *netCounters
 	prevTS  time.Time
+
+	prevSched   *schedCounters
+	prevSchedTS time.Time
+
+	prevIP   *ipOctets
+	prevIPTS time.Time
+
+	prevTCP   *tcpCounters
+	prevTCPTS time.Time
+	tcpRTT    *TCPRTT
+	tcpRTTTS  time.Time
+
+	numa       bool
+	numaTopo   []NUMATopo
+	prevPerCPU map[int]cpuTimes
+
+	ifaces       map[string]string // label -> interface
+	prevIfaces   map[string]netCounters
+	prevIfacesTS time.Time
 }
 
 func NewCollector(netIface string) *Collector {
@@ -48,6 +44,17 @@ func NewCollector(netIface string) *Collector {
 	}
 }
 
+// SetNUMA enables the per NUMA node breakdown (no-op on single-node hosts).
+func (c *Collector) SetNUMA(on bool) {
+	c.numa = on
+}
+
+// SetIfaces sets the labelled uplinks reported in `ifaces`, label ->
+// interface name.
+func (c *Collector) SetIfaces(m map[string]string) {
+	c.ifaces = m
+}
+
 func (c *Collector) Collect() (Snapshot, error) {
 	now := time.Now()
 	s := Snapshot{TS: now.Unix()}
@@ -61,6 +68,20 @@ func (c *Collector) Collect() (Snapshot, error) {
 		c.prevCPU = &ct
 	}
 
+	// Context switches / interrupts / run queue
+	if sc, err := readSched(); err == nil {
+		s.ProcsRunning = sc.procsRunning
+		s.ProcsBlocked = sc.procsBlocked
+		if c.prevSched != nil {
+			if dt := now.Sub(c.prevSchedTS).Seconds(); dt > 0 {
+				s.CtxtPS = uint64(float64(diffU64(c.prevSched.ctxt, sc.ctxt)) / dt)
+				s.IntrPS = uint64(float64(diffU64(c.prevSched.intr, sc.intr)) / dt)
+			}
+		}
+		c.prevSched = &sc
+		c.prevSchedTS = now
+	}
+
 	// Mem + Swap
 	if mt, mu, st, su, err := readMemSwap(); err == nil {
 		s.MemTotalBytes = mt
@@ -105,6 +126,30 @@ func (c *Collector) Collect() (Snapshot, error) {
 		c.prevTS = now
 	}
 
+	s.Ifaces = c.collectIfaces(now)
+	s.IPFamily = c.collectIPFamily(now)
+	s.Sockets = readSockStat()
+	s.TCP = c.collectTCP(now)
+	s.Conntrack = readConntrack()
+
+	if up, err := readUptime(); err == nil {
+		s.UptimeSec = up
+	}
+
+	s.PSI = readPSI()
+	s.Health = readHealth()
+
+	if c.numa {
+		s.NUMA = c.collectNUMA()
+	}
+
+	s.HugePages = readHugePages()
+	var hpSize uint64
+	if s.HugePages != nil {
+		hpSize = s.HugePages.PageSizeBytes
+	}
+	s.Frag = readFragmentation(hpSize)
+
 	// If we can't read anything meaningful, return error
 	if c.prevCPU == nil && c.prevNet == nil && s.MemTotalBytes == 0 && s.DiskTotalBytes == 0 {
 		return s, errors.New("no metrics available (unsupported platform?)")
@@ -148,6 +193,45 @@ func readCPUTimes() (cpuTimes, error) {
 	return cpuTimes{}, fmt.Errorf("cpu line not found in /proc/stat")
 }
 
+type schedCounters struct {
+	ctxt, intr                 uint64
+	procsRunning, procsBlocked uint64
+}
+
+func readSched() (schedCounters, error) {
+	f, err := os.Open("/proc/stat")
+	if err != nil {
+		return schedCounters{}, err
+	}
+	defer f.Close()
+
+	var sc schedCounters
+	s := bufio.NewScanner(f)
+	// the intr line lists every IRQ; only the leading total matters
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	for s.Scan() {
+		parts := strings.Fields(s.Text())
+		if len(parts) < 2 {
+			continue
+		}
+		v, e := strconv.ParseUint(parts[1], 10, 64)
+		if e != nil {
+			continue
+		}
+		switch parts[0] {
+		case "ctxt":
+			sc.ctxt = v
+		case "intr":
+			sc.intr = v
+		case "procs_running":
+			sc.procsRunning = v
+		case "procs_blocked":
+			sc.procsBlocked = v
+		}
+	}
+	return sc, s.Err()
+}
+
 func cpuPercent(prev, cur cpuTimes) float64 {
 	prevIdle := prev.idle + prev.iowait
 	curIdle := cur.idle + cur.iowait
@@ -243,6 +327,22 @@ func readDisk(path string) (total, used uint64, err error) {
 	return total, used, nil
 }
 
+func readUptime() (uint64, error) {
+	b, err := os.ReadFile("/proc/uptime")
+	if err != nil {
+		return 0, err
+	}
+	f := strings.Fields(string(b))
+	if len(f) < 1 {
+		return 0, fmt.Errorf("bad /proc/uptime")
+	}
+	v, err := strconv.ParseFloat(f[0], 64)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(v), nil
+}
+
 type netCounters struct {
 	iface   string
 	rxBytes uint64
@@ -277,11 +377,25 @@ func pickIface() string {
 }
 
 func readNet(iface string) (netCounters, error) {
-	f, err := os.Open("/proc/net/dev")
+	all, err := readNetDev()
 	if err != nil {
 		return netCounters{}, err
 	}
+	nc, ok := all[iface]
+	if !ok {
+		return netCounters{}, fmt.Errorf("iface not found: %s", iface)
+	}
+	return nc, nil
+}
+
+// readNetDev reads the byte counters of every interface.
+func readNetDev() (map[string]netCounters, error) {
+	f, err := os.Open("/proc/net/dev")
+	if err != nil {
+		return nil, err
+	}
 	defer f.Close()
+	all := map[string]netCounters{}
 	sc := bufio.NewScanner(f)
 	for sc.Scan() {
 		line := strings.TrimSpace(sc.Text())
@@ -292,19 +406,60 @@ func readNet(iface string) (netCounters, error) {
 		if len(parts) != 2 {
 			continue
 		}
-		if strings.TrimSpace(parts[0]) != iface {
-			continue
-		}
+		iface := strings.TrimSpace(parts[0])
 		fields := strings.Fields(parts[1])
 		// rx bytes is field[0], tx bytes is field[8]
 		if len(fields) < 9 {
-			return netCounters{}, fmt.Errorf("bad /proc/net/dev line for %s", iface)
+			continue
 		}
 		rx, _ := strconv.ParseUint(fields[0], 10, 64)
 		tx, _ := strconv.ParseUint(fields[8], 10, 64)
-		return netCounters{iface: iface, rxBytes: rx, txBytes: tx}, nil
+		all[iface] = netCounters{iface: iface, rxBytes: rx, txBytes: tx}
 	}
-	return netCounters{}, fmt.Errorf("iface not found: %s", iface)
+	return all, sc.Err()
+}
+
+// collectIfaces reads the labelled uplinks of net_ifaces; rates need the
+// same interface under the label in the previous sample.
+func (c *Collector) collectIfaces(now time.Time) map[string]*IfaceTraffic {
+	if len(c.ifaces) == 0 {
+		c.prevIfaces = nil
+		return nil
+	}
+	all, err := readNetDev()
+	out := make(map[string]*IfaceTraffic, len(c.ifaces))
+	cur := make(map[string]netCounters, len(c.ifaces))
+	dt := now.Sub(c.prevIfacesTS).Seconds()
+	for label, iface := range c.ifaces {
+		t := &IfaceTraffic{Iface: iface}
+		out[label] = t
+		nc, ok := all[iface]
+		if !ok {
+			t.Err = "iface not found"
+			if err != nil {
+				t.Err = err.Error()
+			}
+			continue
+		}
+		cur[label] = nc
+		t.BytesUpTotal, t.BytesDownTotal = nc.txBytes, nc.rxBytes
+		if prev, ok := c.prevIfaces[label]; ok && prev.iface == iface && dt > 0 {
+			t.NetUpBPS = uint64(float64(diffU64(prev.txBytes, nc.txBytes)) / dt)
+			t.NetDownBPS = uint64(float64(diffU64(prev.rxBytes, nc.rxBytes)) / dt)
+		}
+	}
+	c.prevIfaces, c.prevIfacesTS = cur, now
+	return out
+}
+
+// NetCounters returns the byte counters of iface ("" or "auto" picks one
+// like the collector does) and the interface actually read.
+func NetCounters(iface string) (name string, rx, tx uint64, err error) {
+	if iface == "" || iface == "auto" {
+		iface = pickIface()
+	}
+	nc, err := readNet(iface)
+	return iface, nc.rxBytes, nc.txBytes, err
 }
 
 func diffU64(prev, cur uint64) uint64 {
@@ -0,0 +1,65 @@
+//go:build !linux
+
+package metrics
+
+import (
+	"errors"
+	"time"
+)
+
+// Collector is the fallback for platforms without /proc: it reports disk
+// usage where the OS offers a statfs-like call, plus the agent's own Go
+// runtime stats, so the node still works as a probe vantage point.
+type Collector struct {
+	iface string
+}
+
+func NewCollector(netIface string) *Collector {
+	return &Collector{iface: netIface}
+}
+
+// SetNUMA is a no-op without /sys topology.
+func (c *Collector) SetNUMA(bool) {}
+
+// SetIfaces is a no-op without /proc/net/dev.
+func (c *Collector) SetIfaces(map[string]string) {}
+
+// Topology is unavailable on this platform.
+func Topology() []NUMATopo { return nil }
+
+// NetCounters is unavailable without /proc/net/dev.
+func NetCounters(iface string) (string, uint64, uint64, error) {
+	return iface, 0, 0, errors.New("interface counters not supported on this platform")
+}
+
+func (c *Collector) Collect() (Snapshot, error) {
+	now := time.Now()
+	s := Snapshot{TS: now.Unix(), Stub: true}
+
+	if dt, du, err := readDisk(rootPath); err == nil {
+		s.DiskTotalBytes = dt
+		s.DiskUsedBytes = du
+		if dt > 0 {
+			s.Disk = float64(du) * 100.0 / float64(dt)
+		}
+	}
+
+	s.Runtime = readRuntime()
+	s.UptimeSec = s.Runtime.ProcUptimeS
+	return s, nil
+}
+
+// CPUSampler has nothing to sample without /proc/stat; Take returns nil.
+type CPUSampler struct{}
+
+func NewCPUSampler(time.Duration) *CPUSampler {
+	return &CPUSampler{}
+}
+
+func (s *CPUSampler) SetEvery(time.Duration) {}
+
+func (s *CPUSampler) Sample() {}
+
+func (s *CPUSampler) Reset() {}
+
+func (s *CPUSampler) Take() *CPUStats { return nil }
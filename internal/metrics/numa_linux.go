@@ -0,0 +1,182 @@
+package metrics
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const nodeRoot = "/sys/devices/system/node"
+
+// Topology lists NUMA nodes with their CPUs and memory. It returns nil on
+// single-node machines, where a breakdown adds nothing.
+func Topology() []NUMATopo {
+	dirs, _ := filepath.Glob(filepath.Join(nodeRoot, "node[0-9]*"))
+	if len(dirs) < 2 {
+		return nil
+	}
+	var out []NUMATopo
+	for _, d := range dirs {
+		n, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(d), "node"))
+		if err != nil {
+			continue
+		}
+		t := NUMATopo{Node: n}
+		if b, err := os.ReadFile(filepath.Join(d, "cpulist")); err == nil {
+			t.CPUs = parseCPUList(strings.TrimSpace(string(b)))
+		}
+		t.MemTotalBytes, _ = readNodeMem(d)
+		out = append(out, t)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Node < out[j].Node })
+	return out
+}
+
+// parseCPUList expands "0-3,8-11,16" into individual CPU ids.
+func parseCPUList(s string) []int {
+	var out []int
+	for _, part := range strings.Split(s, ",") {
+		if part == "" {
+			continue
+		}
+		lo, hi, isRange := strings.Cut(part, "-")
+		a, err := strconv.Atoi(lo)
+		if err != nil {
+			continue
+		}
+		b := a
+		if isRange {
+			if b, err = strconv.Atoi(hi); err != nil {
+				continue
+			}
+		}
+		for i := a; i <= b; i++ {
+			out = append(out, i)
+		}
+	}
+	return out
+}
+
+// readNodeMem returns total and used bytes from nodeN/meminfo. Used excludes
+// page cache and reclaimable slab, matching Snapshot.Mem semantics.
+func readNodeMem(dir string) (total, used uint64) {
+	f, err := os.Open(filepath.Join(dir, "meminfo"))
+	if err != nil {
+		return 0, 0
+	}
+	defer f.Close()
+
+	var free, filePages, sreclaim uint64
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		// Node 0 MemTotal:  4947704 kB
+		p := strings.Fields(sc.Text())
+		if len(p) < 4 {
+			continue
+		}
+		v, e := strconv.ParseUint(p[3], 10, 64)
+		if e != nil {
+			continue
+		}
+		v *= 1024
+		switch strings.TrimSuffix(p[2], ":") {
+		case "MemTotal":
+			total = v
+		case "MemFree":
+			free = v
+		case "FilePages":
+			filePages = v
+		case "SReclaimable":
+			sreclaim = v
+		}
+	}
+	avail := free + filePages + sreclaim
+	if total > avail {
+		used = total - avail
+	}
+	return total, used
+}
+
+// readPerCPU returns cpuN -> times from /proc/stat.
+func readPerCPU() (map[int]cpuTimes, error) {
+	f, err := os.Open("/proc/stat")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	out := map[int]cpuTimes{}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := sc.Text()
+		if !strings.HasPrefix(line, "cpu") || strings.HasPrefix(line, "cpu ") {
+			if len(out) > 0 {
+				break // cpu lines are contiguous
+			}
+			continue
+		}
+		p := strings.Fields(line)
+		if len(p) < 9 {
+			continue
+		}
+		id, err := strconv.Atoi(strings.TrimPrefix(p[0], "cpu"))
+		if err != nil {
+			continue
+		}
+		var v [8]uint64
+		for i := range v {
+			v[i], _ = strconv.ParseUint(p[i+1], 10, 64)
+		}
+		out[id] = cpuTimes{
+			user: v[0], nice: v[1], system: v[2], idle: v[3],
+			iowait: v[4], irq: v[5], softirq: v[6], steal: v[7],
+		}
+	}
+	return out, sc.Err()
+}
+
+func (c *Collector) collectNUMA() []NUMANode {
+	if c.numaTopo == nil {
+		c.numaTopo = Topology()
+		if c.numaTopo == nil {
+			c.numa = false // single node: stop trying
+			return nil
+		}
+	}
+	cur, err := readPerCPU()
+	if err != nil {
+		return nil
+	}
+	prev := c.prevPerCPU
+	c.prevPerCPU = cur
+
+	out := make([]NUMANode, 0, len(c.numaTopo))
+	for _, t := range c.numaTopo {
+		n := NUMANode{Node: t.Node}
+		if prev != nil {
+			var p, q cpuTimes
+			for _, id := range t.CPUs {
+				p = addCPU(p, prev[id])
+				q = addCPU(q, cur[id])
+			}
+			n.CPU = cpuPercent(p, q)
+		}
+		n.MemTotalBytes, n.MemUsedBytes = readNodeMem(filepath.Join(nodeRoot, "node"+strconv.Itoa(t.Node)))
+		if n.MemTotalBytes > 0 {
+			n.Mem = float64(n.MemUsedBytes) * 100.0 / float64(n.MemTotalBytes)
+		}
+		out = append(out, n)
+	}
+	return out
+}
+
+func addCPU(a, b cpuTimes) cpuTimes {
+	return cpuTimes{
+		user: a.user + b.user, nice: a.nice + b.nice, system: a.system + b.system,
+		idle: a.idle + b.idle, iowait: a.iowait + b.iowait, irq: a.irq + b.irq,
+		softirq: a.softirq + b.softirq, steal: a.steal + b.steal,
+	}
+}
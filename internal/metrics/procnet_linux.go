@@ -0,0 +1,74 @@
+package metrics
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// readPairedTable parses the header/value line pairs used by /proc/net/snmp
+// and /proc/net/netstat:
+//
+//	Tcp: RtoAlgorithm RtoMin ...
+//	Tcp: 1 200 ...
+//
+// into section -> field -> value.
+func readPairedTable(path string) (map[string]map[string]uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	out := map[string]map[string]uint64{}
+	var hdr []string
+	var hdrSect string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		p := strings.Fields(sc.Text())
+		if len(p) < 2 {
+			continue
+		}
+		sect := strings.TrimSuffix(p[0], ":")
+		if hdr == nil || hdrSect != sect {
+			hdr, hdrSect = p[1:], sect
+			continue
+		}
+		m := map[string]uint64{}
+		for i, v := range p[1:] {
+			if i >= len(hdr) {
+				break
+			}
+			// some fields (e.g. Tcp MaxConn) may be -1
+			if n, e := strconv.ParseUint(v, 10, 64); e == nil {
+				m[hdr[i]] = n
+			}
+		}
+		out[sect] = m
+		hdr = nil
+	}
+	return out, sc.Err()
+}
+
+// readFlatTable parses "Name value" lines as in /proc/net/snmp6.
+func readFlatTable(path string) (map[string]uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	out := map[string]uint64{}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		p := strings.Fields(sc.Text())
+		if len(p) != 2 {
+			continue
+		}
+		if n, e := strconv.ParseUint(p[1], 10, 64); e == nil {
+			out[p[0]] = n
+		}
+	}
+	return out, sc.Err()
+}
@@ -0,0 +1,71 @@
+package metrics
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+)
+
+func readPSI() *PSI {
+	var p PSI
+	p.CPU = readPSIFile("/proc/pressure/cpu")
+	p.Memory = readPSIFile("/proc/pressure/memory")
+	p.IO = readPSIFile("/proc/pressure/io")
+	if p.CPU == nil && p.Memory == nil && p.IO == nil {
+		return nil
+	}
+	return &p
+}
+
+// readPSIFile parses lines like:
+//
+//	some avg10=0.12 avg60=0.05 avg300=0.01 total=12345
+//	full avg10=0.00 avg60=0.00 avg300=0.00 total=0
+func readPSIFile(path string) *PSIResource {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var r PSIResource
+	seen := false
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		parts := strings.Fields(sc.Text())
+		if len(parts) < 4 {
+			continue
+		}
+		var a PSIAvg
+		for _, kv := range parts[1:] {
+			k, v, ok := strings.Cut(kv, "=")
+			if !ok {
+				continue
+			}
+			fv, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+			switch k {
+			case "avg10":
+				a.Avg10 = fv
+			case "avg60":
+				a.Avg60 = fv
+			case "avg300":
+				a.Avg300 = fv
+			}
+		}
+		switch parts[0] {
+		case "some":
+			r.Some = a
+			seen = true
+		case "full":
+			r.Full = &a
+		}
+	}
+	if !seen {
+		return nil
+	}
+	return &r
+}
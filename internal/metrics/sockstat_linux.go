@@ -0,0 +1,79 @@
+package metrics
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// readSockstatFile parses "PROTO: key val key val ..." lines into
+// proto -> key -> value.
+func readSockstatFile(path string) map[string]map[string]uint64 {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	out := map[string]map[string]uint64{}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		p := strings.Fields(sc.Text())
+		if len(p) < 3 {
+			continue
+		}
+		m := map[string]uint64{}
+		for i := 1; i+1 < len(p); i += 2 {
+			if v, e := strconv.ParseUint(p[i+1], 10, 64); e == nil {
+				m[p[i]] = v
+			}
+		}
+		out[strings.TrimSuffix(p[0], ":")] = m
+	}
+	return out
+}
+
+// readSockStat combines /proc/net/sockstat{,6} with the tcp_mem thresholds.
+// TCP memory and the thresholds are in pages.
+func readSockStat() *SockStat {
+	t := readSockstatFile("/proc/net/sockstat")
+	if t == nil {
+		return nil
+	}
+	page := uint64(os.Getpagesize())
+	s := &SockStat{
+		SocketsUsed: t["sockets"]["used"],
+		TCPInUse:    t["TCP"]["inuse"],
+		TCPOrphan:   t["TCP"]["orphan"],
+		TCPTimeWait: t["TCP"]["tw"],
+		TCPAlloc:    t["TCP"]["alloc"],
+		TCPMemBytes: t["TCP"]["mem"] * page,
+		UDPInUse:    t["UDP"]["inuse"],
+		UDPMemBytes: t["UDP"]["mem"] * page,
+		FragMemory:  t["FRAG"]["memory"],
+	}
+	if t6 := readSockstatFile("/proc/net/sockstat6"); t6 != nil {
+		s.TCPInUse += t6["TCP6"]["inuse"]
+		s.UDPInUse += t6["UDP6"]["inuse"]
+	}
+
+	if b, err := os.ReadFile("/proc/sys/net/ipv4/tcp_mem"); err == nil {
+		f := strings.Fields(string(b))
+		if len(f) == 3 {
+			pressure, _ := strconv.ParseUint(f[1], 10, 64)
+			high, _ := strconv.ParseUint(f[2], 10, 64)
+			mem := t["TCP"]["mem"]
+			s.TCPMemPressureBytes = pressure * page
+			s.TCPMemHighBytes = high * page
+			if high > 0 {
+				s.TCPMemPct = float64(mem) * 100.0 / float64(high)
+			}
+			s.TCPMemPressure = pressure > 0 && mem >= pressure
+		}
+	}
+	if b, err := os.ReadFile("/proc/sys/net/ipv4/tcp_max_orphans"); err == nil {
+		s.TCPMaxOrphans, _ = strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+	}
+	return s
+}
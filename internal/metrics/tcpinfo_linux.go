@@ -0,0 +1,190 @@
+package metrics
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// tcpInfoInterval rate-limits the sock_diag dump: it walks every
+// established socket, which is too much work for every metrics tick on
+// busy hosts.
+const tcpInfoInterval = 15 * time.Second
+
+type tcpCounters struct {
+	currEstab, outSegs, retransSegs, inErrs, outRsts uint64
+}
+
+// readTCPCounters reads the Tcp MIB of /proc/net/snmp (shared by IPv4 and
+// IPv6).
+func readTCPCounters() (tcpCounters, bool) {
+	t, err := readPairedTable("/proc/net/snmp")
+	if err != nil {
+		return tcpCounters{}, false
+	}
+	m, ok := t["Tcp"]
+	if !ok {
+		return tcpCounters{}, false
+	}
+	return tcpCounters{
+		currEstab:   m["CurrEstab"],
+		outSegs:     m["OutSegs"],
+		retransSegs: m["RetransSegs"],
+		inErrs:      m["InErrs"],
+		outRsts:     m["OutRsts"],
+	}, true
+}
+
+func (c *Collector) collectTCP(now time.Time) *TCPQuality {
+	tc, ok := readTCPCounters()
+	if !ok {
+		return nil
+	}
+	q := &TCPQuality{CurrEstab: tc.currEstab, OutSegs: tc.outSegs, RetransSegs: tc.retransSegs}
+	if c.prevTCP != nil {
+		if dt := now.Sub(c.prevTCPTS).Seconds(); dt > 0 {
+			dOut := diffU64(c.prevTCP.outSegs, tc.outSegs)
+			dRe := diffU64(c.prevTCP.retransSegs, tc.retransSegs)
+			q.RetransPS = uint64(float64(dRe) / dt)
+			q.InErrsPS = uint64(float64(diffU64(c.prevTCP.inErrs, tc.inErrs)) / dt)
+			q.OutRstsPS = uint64(float64(diffU64(c.prevTCP.outRsts, tc.outRsts)) / dt)
+			if dOut > 0 {
+				q.RetransPct = float64(dRe) * 100.0 / float64(dOut)
+			}
+		}
+	}
+	c.prevTCP = &tc
+	c.prevTCPTS = now
+
+	if now.Sub(c.tcpRTTTS) >= tcpInfoInterval {
+		c.tcpRTT, _ = readTCPRTT()
+		c.tcpRTTTS = now
+	}
+	q.RTT = c.tcpRTT
+	return q
+}
+
+// sock_diag (linux/inet_diag.h, linux/sock_diag.h)
+const (
+	sockDiagByFamily = 20
+	inetDiagInfo     = 2
+	tcpEstablished   = 1
+
+	inetDiagReqLen = 56 // inet_diag_req_v2
+	inetDiagMsgLen = 72 // inet_diag_msg
+	tcpInfoRTTOff  = 68 // tcp_info.tcpi_rtt (usec)
+)
+
+// readTCPRTT summarizes the smoothed RTT of established TCP sockets to
+// non-loopback peers, from TCP_INFO as dumped by NETLINK_SOCK_DIAG.
+func readTCPRTT() (*TCPRTT, error) {
+	var rtts []float64 // ms
+	for _, fam := range []uint8{syscall.AF_INET, syscall.AF_INET6} {
+		if err := dumpTCPInfo(fam, func(dst net.IP, info []byte) {
+			if dst.IsLoopback() || len(info) < tcpInfoRTTOff+4 {
+				return
+			}
+			rtts = append(rtts, float64(binary.NativeEndian.Uint32(info[tcpInfoRTTOff:]))/1000)
+		}); err != nil {
+			return nil, err
+		}
+	}
+	if len(rtts) == 0 {
+		return &TCPRTT{}, nil
+	}
+	sort.Float64s(rtts)
+	sum := 0.0
+	for _, v := range rtts {
+		sum += v
+	}
+	return &TCPRTT{
+		Sockets: len(rtts),
+		AvgMS:   sum / float64(len(rtts)),
+		P50MS:   rtts[len(rtts)/2],
+		P95MS:   rtts[(len(rtts)*95)/100],
+		MaxMS:   rtts[len(rtts)-1],
+	}, nil
+}
+
+// dumpTCPInfo calls fn with the peer address and tcp_info of every
+// established socket of family fam.
+func dumpTCPInfo(fam uint8, fn func(dst net.IP, info []byte)) error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, syscall.NETLINK_INET_DIAG)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return err
+	}
+
+	req := make([]byte, syscall.NLMSG_HDRLEN+inetDiagReqLen)
+	ne := binary.NativeEndian
+	ne.PutUint32(req[0:], uint32(len(req)))
+	ne.PutUint16(req[4:], sockDiagByFamily)
+	ne.PutUint16(req[6:], syscall.NLM_F_REQUEST|syscall.NLM_F_DUMP)
+	ne.PutUint32(req[8:], 1) // seq
+	r := req[syscall.NLMSG_HDRLEN:]
+	r[0] = fam
+	r[1] = syscall.IPPROTO_TCP
+	r[2] = 1 << (inetDiagInfo - 1)
+	ne.PutUint32(r[4:], 1<<tcpEstablished)
+	if err := syscall.Sendto(fd, req, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 64<<10)
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			switch m.Header.Type {
+			case syscall.NLMSG_DONE:
+				return nil
+			case syscall.NLMSG_ERROR:
+				return errors.New("sock_diag: netlink error")
+			}
+			if len(m.Data) < inetDiagMsgLen {
+				continue
+			}
+			// inet_diag_msg: family, state, timer, retrans, then
+			// inet_diag_sockid (sport, dport, src[16], dst[16], ...)
+			dst := net.IP(append([]byte(nil), m.Data[24:40]...))
+			if m.Data[0] == syscall.AF_INET {
+				dst = dst[:4]
+			}
+			if info := diagAttr(m.Data[inetDiagMsgLen:], inetDiagInfo); info != nil {
+				fn(dst, info)
+			}
+		}
+	}
+}
+
+// diagAttr returns the payload of the first rtattr of type typ.
+func diagAttr(b []byte, typ uint16) []byte {
+	for len(b) >= 4 {
+		l := int(binary.NativeEndian.Uint16(b[0:]))
+		t := binary.NativeEndian.Uint16(b[2:])
+		if l < 4 || l > len(b) {
+			return nil
+		}
+		if t == typ {
+			return b[4:l]
+		}
+		al := (l + 3) &^ 3
+		if al > len(b) {
+			return nil
+		}
+		b = b[al:]
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package netinfo
+
+import (
+	"net/netip"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Bird is the answer of birdc's "show route for X all".
+type Bird struct {
+	Version string      `json:"version,omitempty"` // "2.0.10"
+	Routes  []BirdRoute `json:"routes"`
+}
+
+// BirdRoute is one route: the primary (best) one and the alternatives
+// BIRD knows for a prefix each get one.
+type BirdRoute struct {
+	Table    string            `json:"table,omitempty"`
+	Prefix   string            `json:"prefix"`
+	Type     string            `json:"type,omitempty"` // unicast, blackhole, unreachable, ...
+	Protocol string            `json:"protocol"`       // the BIRD protocol (BGP session) it came from
+	Since    string            `json:"since,omitempty"`
+	Primary  bool              `json:"primary"`
+	Pref     int               `json:"pref,omitempty"`
+	Origin   string            `json:"origin,omitempty"` // "AS13335i"
+	Via      []NextHop         `json:"via,omitempty"`
+	ASPath   []uint32          `json:"as_path,omitempty"` // from BGP.as_path
+	Attrs    map[string]string `json:"attrs,omitempty"`   // BGP.*, Type, ...
+}
+
+// NextHop is a gateway and/or interface.
+type NextHop struct {
+	Gateway string `json:"gateway,omitempty"`
+	Dev     string `json:"dev,omitempty"`
+}
+
+// parseBird reads the text birdc prints for "show route ... all", in the
+// formats of BIRD 1.6 and 2.x:
+//
+//	BIRD 2.0.10 ready.
+//	Table master4:
+//	1.1.1.0/24           unicast [peer1 2024-01-02] * (100) [AS13335i]
+//		via 192.0.2.1 on eth0
+//		BGP.as_path: 64500 13335
+//	                     unicast [peer2 10:00:01] (100) [AS13335i]
+//		via 192.0.2.9 on eth1
+//
+// BIRD 1.6 puts the next hop on the route line ("1.1.1.0/24 via 192.0.2.1
+// on eth0 [peer1 2024-01-02] * (100) [AS13335i]"). A prefix BIRD doesn't
+// know ("Network not found") gives no routes.
+func parseBird(out []byte) Bird {
+	b := Bird{Routes: []BirdRoute{}}
+	var table, prefix string
+	var cur *BirdRoute
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimRight(line, "\r")
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "":
+			continue
+		case strings.HasPrefix(line, "BIRD ") && strings.HasSuffix(trimmed, "ready."):
+			b.Version = strings.TrimSuffix(strings.TrimPrefix(trimmed, "BIRD "), " ready.")
+			continue
+		case strings.HasPrefix(line, "Table ") && strings.HasSuffix(trimmed, ":"):
+			table = strings.TrimSuffix(strings.TrimPrefix(trimmed, "Table "), ":")
+			continue
+		case strings.HasPrefix(line, "\t"), strings.HasPrefix(line, "  ") && cur != nil && !strings.Contains(trimmed, "["):
+			// details of the current route
+			if cur == nil {
+				continue
+			}
+			if strings.HasPrefix(trimmed, "via ") || strings.HasPrefix(trimmed, "dev ") {
+				cur.Via = append(cur.Via, parseNextHop(strings.Fields(trimmed)))
+				continue
+			}
+			k, v, ok := strings.Cut(trimmed, ":")
+			if !ok {
+				continue
+			}
+			v = strings.TrimSpace(v)
+			if cur.Attrs == nil {
+				cur.Attrs = map[string]string{}
+			}
+			cur.Attrs[k] = v
+			if k == "BGP.as_path" {
+				cur.ASPath = parseASPath(v)
+			}
+			continue
+		}
+		// a route line: a new prefix, or another route for the last one
+		fields := strings.Fields(line)
+		if !strings.HasPrefix(line, " ") {
+			if _, err := netip.ParsePrefix(fields[0]); err != nil {
+				continue // "Network not found" and other chatter
+			}
+			prefix, fields = fields[0], fields[1:]
+		}
+		if prefix == "" {
+			continue
+		}
+		b.Routes = append(b.Routes, parseRouteLine(table, prefix, fields))
+		cur = &b.Routes[len(b.Routes)-1]
+	}
+	return b
+}
+
+// bracketed matches the [protocol since] and [origin] groups of a route
+// line.
+var bracketed = regexp.MustCompile(`\[([^\]]*)\]`)
+
+// parseRouteLine reads what follows the prefix on a route line.
+func parseRouteLine(table, prefix string, f []string) BirdRoute {
+	r := BirdRoute{Table: table, Prefix: prefix}
+	line := strings.Join(f, " ")
+	for i, g := range bracketed.FindAllStringSubmatch(line, 2) {
+		if i == 0 {
+			r.Protocol, r.Since, _ = strings.Cut(g[1], " ")
+		} else {
+			r.Origin = g[1]
+		}
+	}
+	f = strings.Fields(bracketed.ReplaceAllString(line, " "))
+	for i, w := range f {
+		switch {
+		case w == "via" || w == "dev":
+			r.Via = append(r.Via, parseNextHop(f[i:min(i+4, len(f))]))
+		case w == "*":
+			r.Primary = true
+		case strings.HasPrefix(w, "(") && strings.HasSuffix(w, ")"):
+			pref, _, _ := strings.Cut(strings.Trim(w, "()"), "/")
+			r.Pref, _ = strconv.Atoi(pref)
+		case i == 0:
+			r.Type = w // BIRD 2: unicast, blackhole, unreachable, ...
+		}
+	}
+	return r
+}
+
+// parseNextHop reads "via 192.0.2.1 on eth0" or "dev eth0".
+func parseNextHop(f []string) NextHop {
+	var h NextHop
+	for i := 0; i+1 < len(f); i++ {
+		switch f[i] {
+		case "via":
+			h.Gateway = f[i+1]
+		case "on", "dev":
+			h.Dev = f[i+1]
+		}
+	}
+	return h
+}
+
+// parseASPath reads "64500 13335 {65001 65002}"; AS sets are flattened.
+func parseASPath(s string) []uint32 {
+	var path []uint32
+	for _, w := range strings.Fields(strings.NewReplacer("{", " ", "}", " ", "(", " ", ")", " ").Replace(s)) {
+		if n, err := strconv.ParseUint(w, 10, 32); err == nil {
+			path = append(path, uint32(n))
+		}
+	}
+	return path
+}
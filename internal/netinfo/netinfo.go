@@ -0,0 +1,191 @@
+// Package netinfo answers looking-glass queries about the host's routing:
+// fixed, read-only commands (ip, birdc, vtysh) run without a shell, on a
+// validated address or prefix, with their output turned into JSON.
+package netinfo
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Queries.
+const (
+	RouteGet = "route_get" // ip route get TARGET: the route the kernel picks
+	Routes   = "routes"    // ip route show: the main table, Family "4" or "6"
+	BGPRoute = "bgp_route" // the BGP daemon's routes for TARGET (BIRD or FRR)
+)
+
+const (
+	// Timeout bounds one command.
+	Timeout = 10 * time.Second
+	// MaxRoutes bounds the routes in a result.
+	MaxRoutes = 1000
+	// maxOutput bounds what is read from a command.
+	maxOutput = 4 << 20
+)
+
+// Request is one query. Target is an address (RouteGet) or an address or
+// prefix (BGPRoute); Family applies to Routes.
+type Request struct {
+	Query  string
+	Target string
+	Family string
+}
+
+// Result is a query's answer. Data is the command's output as JSON values:
+// the route object for RouteGet, a list of routes for Routes and, for
+// BGPRoute, BIRD's routes as parsed by parseBird or FRR's own JSON.
+type Result struct {
+	Source    string // the command run: ip, birdc or vtysh
+	Data      any
+	Truncated bool // Routes or BGP routes were cut at MaxRoutes
+}
+
+// Check validates r without running anything.
+func (r Request) Check() error {
+	switch r.Query {
+	case RouteGet:
+		if _, err := netip.ParseAddr(r.Target); err != nil {
+			return fmt.Errorf("target %q: want an IP address", r.Target)
+		}
+	case Routes:
+		if r.Family != "" && r.Family != "4" && r.Family != "6" {
+			return fmt.Errorf("family %q: want 4 or 6", r.Family)
+		}
+	case BGPRoute:
+		if _, err := netip.ParseAddr(r.Target); err != nil {
+			if _, err := netip.ParsePrefix(r.Target); err != nil {
+				return fmt.Errorf("target %q: want an IP address or prefix", r.Target)
+			}
+		}
+	default:
+		return fmt.Errorf("query %q: want %s, %s or %s", r.Query, RouteGet, Routes, BGPRoute)
+	}
+	return nil
+}
+
+// Run answers r.
+func Run(ctx context.Context, r Request) (Result, error) {
+	if err := r.Check(); err != nil {
+		return Result{}, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, Timeout)
+	defer cancel()
+	switch r.Query {
+	case RouteGet:
+		var routes []map[string]any
+		if err := runJSON(ctx, &routes, "ip", "-j", "route", "get", r.Target); err != nil {
+			return Result{Source: "ip"}, err
+		}
+		if len(routes) == 0 {
+			return Result{Source: "ip"}, errors.New("no route")
+		}
+		return Result{Source: "ip", Data: routes[0]}, nil
+	case Routes:
+		args := []string{"-j"}
+		if r.Family == "6" {
+			args = append(args, "-6")
+		}
+		var routes []map[string]any
+		if err := runJSON(ctx, &routes, "ip", append(args, "route", "show")...); err != nil {
+			return Result{Source: "ip"}, err
+		}
+		res := Result{Source: "ip", Data: routes}
+		if len(routes) > MaxRoutes {
+			res.Data, res.Truncated = routes[:MaxRoutes], true
+		}
+		return res, nil
+	}
+	return bgpRoute(ctx, r.Target)
+}
+
+// bgpRoute asks BIRD (read-only birdc -r) or else FRR's vtysh.
+func bgpRoute(ctx context.Context, target string) (Result, error) {
+	if _, err := exec.LookPath("birdc"); err == nil {
+		out, err := run(ctx, "birdc", "-r", "show", "route", "for", target, "all")
+		if err != nil {
+			return Result{Source: "birdc"}, err
+		}
+		res := Result{Source: "birdc"}
+		bird := parseBird(out)
+		if len(bird.Routes) > MaxRoutes {
+			bird.Routes, res.Truncated = bird.Routes[:MaxRoutes], true
+		}
+		res.Data = bird
+		return res, nil
+	}
+	if _, err := exec.LookPath("vtysh"); err == nil {
+		afi := "ipv4"
+		if strings.Contains(target, ":") {
+			afi = "ipv6"
+		}
+		var data map[string]any
+		if err := runJSON(ctx, &data, "vtysh", "-c", "show bgp "+afi+" unicast "+target+" json"); err != nil {
+			return Result{Source: "vtysh"}, err
+		}
+		return Result{Source: "vtysh", Data: data}, nil
+	}
+	return Result{}, errors.New("no BGP daemon client (birdc or vtysh) found")
+}
+
+func runJSON(ctx context.Context, v any, name string, args ...string) error {
+	out, err := run(ctx, name, args...)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(out, v); err != nil {
+		return fmt.Errorf("%s: unexpected output: %v", name, err)
+	}
+	return nil
+}
+
+// run runs a command and returns its stdout; a failure carries the first
+// line of stderr.
+func run(ctx context.Context, name string, args ...string) ([]byte, error) {
+	var stdout, stderr limitedBuffer
+	stdout.max, stderr.max = maxOutput, 4096
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	cmd.WaitDelay = time.Second
+	err := cmd.Run()
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		return nil, fmt.Errorf("%s: timeout", name)
+	case err != nil:
+		msg, _, _ := strings.Cut(strings.TrimSpace(stderr.String()), "\n")
+		if msg == "" {
+			msg = strings.TrimSpace(stdout.String())
+			msg, _, _ = strings.Cut(msg, "\n")
+		}
+		if msg != "" {
+			return nil, fmt.Errorf("%s: %s", name, msg)
+		}
+		return nil, fmt.Errorf("%s: %v", name, err)
+	case stdout.cut:
+		return nil, fmt.Errorf("%s: more than %d bytes of output", name, maxOutput)
+	}
+	return stdout.Bytes(), nil
+}
+
+// limitedBuffer keeps the first max bytes written to it.
+type limitedBuffer struct {
+	bytes.Buffer
+	max int
+	cut bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - b.Len(); len(p) > room {
+		b.Buffer.Write(p[:max(room, 0)])
+		b.cut = true
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
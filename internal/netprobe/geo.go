@@ -0,0 +1,213 @@
+package netprobe
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GeoOptions selects where location/ASN data comes from. Local databases
+// win over the HTTP endpoint; any of them may be empty.
+type GeoOptions struct {
+	// JSON endpoint; "{ip}" is replaced with the public IP, e.g.
+	// "https://ipinfo.io/{ip}/json" or "http://ip-api.com/json/{ip}".
+	URL string `json:"url,omitempty"`
+	// MaxMind DB files (GeoLite2-City/Country and GeoLite2-ASN layout).
+	MMDB    string `json:"mmdb,omitempty"`
+	ASNMMDB string `json:"asn_mmdb,omitempty"`
+}
+
+func (o GeoOptions) Enabled() bool {
+	return o.URL != "" || o.MMDB != "" || o.ASNMMDB != ""
+}
+
+// Geo is the agent's self-identified location and network.
+type Geo struct {
+	IP          string `json:"ip"`
+	CountryCode string `json:"country_code,omitempty"`
+	Country     string `json:"country,omitempty"`
+	City        string `json:"city,omitempty"`
+	ASN         uint64 `json:"asn,omitempty"`
+	ASOrg       string `json:"as_org,omitempty"`
+	Source      string `json:"source"` // mmdb|http
+	Err         string `json:"err,omitempty"`
+}
+
+// LookupGeo resolves ip (normally the probed public address) to location and
+// ASN. Errors are reported in Geo.Err; the agent keeps running without geo.
+func LookupGeo(ip string, opt GeoOptions, timeout time.Duration, insecureSkipVerify bool) Geo {
+	g := Geo{IP: ip}
+	if opt.MMDB != "" || opt.ASNMMDB != "" {
+		g.Source = "mmdb"
+		if err := lookupMMDB(&g, opt); err != nil {
+			g.Err = err.Error()
+		}
+		if g.CountryCode != "" || g.ASN != 0 || opt.URL == "" {
+			return g
+		}
+	}
+	if opt.URL != "" {
+		g = Geo{IP: ip, Source: "http"}
+		if err := lookupHTTP(&g, opt.URL, timeout, insecureSkipVerify); err != nil {
+			g.Err = err.Error()
+		}
+	}
+	return g
+}
+
+func lookupMMDB(g *Geo, opt GeoOptions) error {
+	ip := net.ParseIP(g.IP)
+	if ip == nil {
+		return fmt.Errorf("bad ip %q", g.IP)
+	}
+	for _, p := range []string{opt.MMDB, opt.ASNMMDB} {
+		if p == "" {
+			continue
+		}
+		db, err := openMMDB(p)
+		if err != nil {
+			return err
+		}
+		rec, err := db.lookup(ip)
+		if err != nil {
+			return err
+		}
+		if g.CountryCode == "" {
+			g.CountryCode, _ = dig(rec, "country", "iso_code").(string)
+			g.Country, _ = dig(rec, "country", "names", "en").(string)
+		}
+		if g.City == "" {
+			g.City, _ = dig(rec, "city", "names", "en").(string)
+		}
+		if g.ASN == 0 {
+			g.ASN = asUint(rec["autonomous_system_number"])
+			g.ASOrg, _ = rec["autonomous_system_organization"].(string)
+		}
+	}
+	return nil
+}
+
+// LookupASNs maps addresses (such as traceroute hops) to their ASN from
+// the local databases only; the HTTP endpoint would take one request per
+// address. Addresses the databases don't cover are left out.
+func LookupASNs(ips []string, opt GeoOptions) (map[string]uint64, error) {
+	out := map[string]uint64{}
+	for _, p := range []string{opt.ASNMMDB, opt.MMDB} {
+		if p == "" {
+			continue
+		}
+		db, err := openMMDB(p)
+		if err != nil {
+			return out, err
+		}
+		for _, s := range ips {
+			ip := net.ParseIP(s)
+			if ip == nil || out[s] != 0 {
+				continue
+			}
+			if rec, _ := db.lookup(ip); rec != nil {
+				if n := asUint(rec["autonomous_system_number"]); n != 0 {
+					out[s] = n
+				}
+			}
+		}
+	}
+	return out, nil
+}
+
+func dig(m map[string]any, path ...string) any {
+	var v any = m
+	for _, k := range path {
+		mm, ok := v.(map[string]any)
+		if !ok {
+			return nil
+		}
+		v = mm[k]
+	}
+	return v
+}
+
+// lookupHTTP understands the common free services: ipinfo.io
+// (country/city/org "AS123 Name"), ip-api.com (countryCode/country/city/as)
+// and ipapi.co / ipwho.is style (country_code/country_name/asn/org).
+func lookupHTTP(g *Geo, url string, timeout time.Duration, insecureSkipVerify bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	url = strings.ReplaceAll(url, "{ip}", g.IP)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: insecureSkipVerify},
+	}}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("geo endpoint: %s", resp.Status)
+	}
+	var m map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&m); err != nil {
+		return err
+	}
+
+	str := func(keys ...string) string {
+		for _, k := range keys {
+			if s, ok := m[k].(string); ok && s != "" {
+				return s
+			}
+		}
+		return ""
+	}
+	g.CountryCode = str("country_code", "countryCode")
+	g.Country = str("country_name", "country")
+	if g.CountryCode == "" && len(g.Country) == 2 {
+		g.CountryCode, g.Country = g.Country, ""
+	}
+	g.City = str("city")
+
+	// "AS15169 Google LLC" (ipinfo org, ip-api as) or a bare number/string.
+	g.ASN, g.ASOrg = parseASN(str("as", "org"))
+	switch v := m["asn"].(type) {
+	case float64:
+		g.ASN = uint64(v)
+	case string:
+		if n, _ := parseASN(v); n != 0 {
+			g.ASN = n
+		}
+	case map[string]any: // ipwho.is style nesting
+		if n, ok := v["asn"].(float64); ok {
+			g.ASN = uint64(n)
+		}
+	}
+	if org := str("as_org", "asname", "isp"); g.ASOrg == "" {
+		g.ASOrg = org
+	}
+	return nil
+}
+
+func parseASN(s string) (uint64, string) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(strings.ToUpper(s), "AS") {
+		if n, err := strconv.ParseUint(s, 10, 64); err == nil {
+			return n, ""
+		}
+		return 0, s
+	}
+	num, org, _ := strings.Cut(s[2:], " ")
+	n, err := strconv.ParseUint(num, 10, 64)
+	if err != nil {
+		return 0, s
+	}
+	return n, strings.TrimSpace(org)
+}
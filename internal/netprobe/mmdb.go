@@ -0,0 +1,290 @@
+package netprobe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+)
+
+// mmdb is a minimal MaxMind DB (.mmdb) reader: enough to look up one
+// address in GeoLite2/GeoIP2 City, Country and ASN databases without
+// pulling in a dependency.
+type mmdb struct {
+	buf        []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	data       []byte // data section
+	ipv4Start  uint
+}
+
+var mmdbMetaMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+func openMMDB(path string) (*mmdb, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	i := bytes.LastIndex(buf, mmdbMetaMarker)
+	if i < 0 {
+		return nil, errors.New("mmdb: metadata not found")
+	}
+	meta := buf[i+len(mmdbMetaMarker):]
+	v, _, err := (&mmdbDecoder{b: meta}).decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("mmdb: metadata: %w", err)
+	}
+	m, ok := v.(map[string]any)
+	if !ok {
+		return nil, errors.New("mmdb: bad metadata")
+	}
+	db := &mmdb{
+		buf:        buf,
+		nodeCount:  uint(asUint(m["node_count"])),
+		recordSize: uint(asUint(m["record_size"])),
+		ipVersion:  uint(asUint(m["ip_version"])),
+	}
+	switch db.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("mmdb: unsupported record size %d", db.recordSize)
+	}
+	treeSize := db.nodeCount * db.recordSize / 4
+	if treeSize+16 > uint(i) {
+		return nil, errors.New("mmdb: truncated search tree")
+	}
+	db.data = buf[treeSize+16 : i]
+
+	// IPv4 addresses live under ::/96 in IPv6 trees.
+	if db.ipVersion == 6 {
+		node := uint(0)
+		for j := 0; j < 96 && node < db.nodeCount; j++ {
+			node = db.record(node, 0)
+		}
+		db.ipv4Start = node
+	}
+	return db, nil
+}
+
+func (db *mmdb) record(node, bit uint) uint {
+	switch db.recordSize {
+	case 24:
+		off := node*6 + bit*3
+		b := db.buf[off : off+3]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		off := node * 7
+		b := db.buf[off : off+7]
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		off := node*8 + bit*4
+		return uint(binary.BigEndian.Uint32(db.buf[off : off+4]))
+	}
+}
+
+// lookup returns the decoded record for ip, or nil if it is not in the db.
+func (db *mmdb) lookup(ip net.IP) (map[string]any, error) {
+	node := uint(0)
+	bits := ip.To16()
+	nbits := 128
+	if v4 := ip.To4(); v4 != nil {
+		bits = v4
+		nbits = 32
+		if db.ipVersion == 6 {
+			node = db.ipv4Start
+		}
+	} else if db.ipVersion == 4 {
+		return nil, nil
+	}
+
+	for i := 0; i < nbits && node < db.nodeCount; i++ {
+		bit := uint(bits[i>>3]>>(7-uint(i&7))) & 1
+		node = db.record(node, bit)
+	}
+	if node <= db.nodeCount {
+		return nil, nil
+	}
+	off := node - db.nodeCount - 16
+	if off >= uint(len(db.data)) {
+		return nil, errors.New("mmdb: bad data pointer")
+	}
+	v, _, err := (&mmdbDecoder{b: db.data}).decode(off)
+	if err != nil {
+		return nil, err
+	}
+	m, _ := v.(map[string]any)
+	return m, nil
+}
+
+// mmdbMaxDepth bounds nested maps, arrays and pointers, as libmaxminddb
+// does: a corrupt file could otherwise point back into itself forever.
+const mmdbMaxDepth = 512
+
+type mmdbDecoder struct {
+	b     []byte
+	depth int
+}
+
+func (d *mmdbDecoder) bytes(off, n uint) ([]byte, error) {
+	if off+n > uint(len(d.b)) {
+		return nil, errors.New("mmdb: unexpected end of data")
+	}
+	return d.b[off : off+n], nil
+}
+
+// decode returns the value at off and the offset just past it.
+func (d *mmdbDecoder) decode(off uint) (any, uint, error) {
+	if d.depth++; d.depth > mmdbMaxDepth {
+		return nil, 0, errors.New("mmdb: data nested too deep")
+	}
+	defer func() { d.depth-- }()
+	h, err := d.bytes(off, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	ctrl := h[0]
+	off++
+	typ := uint(ctrl >> 5)
+
+	if typ == 1 { // pointer
+		ss := uint(ctrl>>3) & 3
+		p, err := d.bytes(off, ss+1)
+		if err != nil {
+			return nil, 0, err
+		}
+		var ptr uint
+		switch ss {
+		case 0:
+			ptr = uint(ctrl&7)<<8 | uint(p[0])
+		case 1:
+			ptr = (uint(ctrl&7)<<16 | uint(p[0])<<8 | uint(p[1])) + 2048
+		case 2:
+			ptr = (uint(ctrl&7)<<24 | uint(p[0])<<16 | uint(p[1])<<8 | uint(p[2])) + 526336
+		default:
+			ptr = uint(binary.BigEndian.Uint32(p))
+		}
+		v, _, err := d.decode(ptr)
+		return v, off + ss + 1, err
+	}
+
+	if typ == 0 { // extended
+		e, err := d.bytes(off, 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		typ = 7 + uint(e[0])
+		off++
+	}
+
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		s, err := d.bytes(off, n)
+		if err != nil {
+			return nil, 0, err
+		}
+		off += n
+		switch n {
+		case 1:
+			size = 29 + uint(s[0])
+		case 2:
+			size = 285 + (uint(s[0])<<8 | uint(s[1]))
+		default:
+			size = 65821 + (uint(s[0])<<16 | uint(s[1])<<8 | uint(s[2]))
+		}
+	}
+
+	switch typ {
+	case 2: // utf8 string
+		b, err := d.bytes(off, size)
+		return string(b), off + size, err
+	case 3: // double
+		b, err := d.bytes(off, 8)
+		if err != nil {
+			return nil, 0, err
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), off + 8, nil
+	case 4: // bytes
+		b, err := d.bytes(off, size)
+		return b, off + size, err
+	case 5, 6, 9, 10: // uint16/32/64/128
+		b, err := d.bytes(off, size)
+		if err != nil {
+			return nil, 0, err
+		}
+		var v uint64
+		for _, c := range b {
+			v = v<<8 | uint64(c)
+		}
+		return v, off + size, nil
+	case 8: // int32
+		b, err := d.bytes(off, size)
+		if err != nil {
+			return nil, 0, err
+		}
+		var v uint32
+		for _, c := range b {
+			v = v<<8 | uint32(c)
+		}
+		if size == 4 {
+			return int64(int32(v)), off + size, nil
+		}
+		return int64(v), off + size, nil
+	case 7: // map
+		// every entry takes at least two bytes: don't trust size for the hint
+		m := make(map[string]any, min(size, uint(len(d.b))-off))
+		for i := uint(0); i < size; i++ {
+			k, next, err := d.decode(off)
+			if err != nil {
+				return nil, 0, err
+			}
+			v, next2, err := d.decode(next)
+			if err != nil {
+				return nil, 0, err
+			}
+			ks, _ := k.(string)
+			m[ks] = v
+			off = next2
+		}
+		return m, off, nil
+	case 11: // array
+		a := make([]any, 0, min(size, uint(len(d.b))-off))
+		for i := uint(0); i < size; i++ {
+			v, next, err := d.decode(off)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+			off = next
+		}
+		return a, off, nil
+	case 14: // boolean
+		return size != 0, off, nil
+	case 15: // float
+		b, err := d.bytes(off, 4)
+		if err != nil {
+			return nil, 0, err
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), off + 4, nil
+	}
+	return nil, 0, fmt.Errorf("mmdb: unsupported data type %d", typ)
+}
+
+func asUint(v any) uint64 {
+	switch x := v.(type) {
+	case uint64:
+		return x
+	case int64:
+		if x > 0 {
+			return uint64(x)
+		}
+	}
+	return 0
+}
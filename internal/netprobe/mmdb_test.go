@@ -0,0 +1,229 @@
+package netprobe
+
+import (
+	"encoding/binary"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// mmdb data section encoding, enough to build test databases.
+
+func mmCtrl(typ, size uint) []byte {
+	var b []byte
+	ctrl := byte(0)
+	if typ <= 7 {
+		ctrl = byte(typ << 5)
+	}
+	switch {
+	case size < 29:
+		b = append(b, ctrl|byte(size))
+	case size < 285:
+		b = append(b, ctrl|29, byte(size-29))
+	case size < 65821:
+		b = append(b, ctrl|30)
+		b = binary.BigEndian.AppendUint16(b, uint16(size-285))
+	default:
+		s := size - 65821
+		b = append(b, ctrl|31, byte(s>>16), byte(s>>8), byte(s))
+	}
+	if typ > 7 {
+		b = append(b[:1], append([]byte{byte(typ - 7)}, b[1:]...)...)
+	}
+	return b
+}
+
+func mmString(s string) []byte { return append(mmCtrl(2, uint(len(s))), s...) }
+
+func mmUint(typ uint, v uint64) []byte {
+	var val []byte
+	for ; v > 0; v >>= 8 {
+		val = append([]byte{byte(v)}, val...)
+	}
+	return append(mmCtrl(typ, uint(len(val))), val...)
+}
+
+// mmMap encodes keys and values in the order given.
+func mmMap(kv ...[]byte) []byte {
+	b := mmCtrl(7, uint(len(kv)/2))
+	for _, e := range kv {
+		b = append(b, e...)
+	}
+	return b
+}
+
+// buildMMDB writes a database in which IPv4 addresses with the top bit set
+// (found under ::/96 in a version 6 tree) have the record data; the rest
+// are not found.
+func buildMMDB(t *testing.T, ipVersion uint, data []byte) string {
+	t.Helper()
+	const recordSize = 24
+	depth := 0
+	if ipVersion == 6 {
+		depth = 96
+	}
+	nodes := uint(depth + 1)
+	rec := func(b []byte, v uint) []byte { return append(b, byte(v>>16), byte(v>>8), byte(v)) }
+	var tree []byte
+	for i := 0; i < depth; i++ {
+		// ::/96 follows the zero bits; anything else is not found
+		tree = rec(rec(tree, uint(i+1)), nodes)
+	}
+	tree = rec(rec(tree, nodes), nodes+16) // 0...: not found, 1...: data at 0
+
+	b := append(tree, make([]byte, 16)...)
+	b = append(b, data...)
+	b = append(b, mmdbMetaMarker...)
+	b = append(b, mmMap(
+		mmString("node_count"), mmUint(6, uint64(nodes)),
+		mmString("record_size"), mmUint(5, recordSize),
+		mmString("ip_version"), mmUint(5, uint64(ipVersion)),
+		mmString("database_type"), mmString("Test"),
+	)...)
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	if err := os.WriteFile(path, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestMMDBLookup(t *testing.T) {
+	rec := mmMap(
+		mmString("autonomous_system_number"), mmUint(6, 2497),
+		mmString("country"), mmMap(mmString("iso_code"), mmString("JP")),
+	)
+	want := map[string]any{
+		"autonomous_system_number": uint64(2497),
+		"country":                  map[string]any{"iso_code": "JP"},
+	}
+	for _, ver := range []uint{4, 6} {
+		db, err := openMMDB(buildMMDB(t, ver, rec))
+		if err != nil {
+			t.Fatalf("v%d: %v", ver, err)
+		}
+		tests := []struct {
+			ip    string
+			found bool
+		}{
+			{"203.0.113.1", true},
+			{"10.0.0.1", false},
+			{"2001:db8::1", false},
+		}
+		for _, tt := range tests {
+			got, err := db.lookup(net.ParseIP(tt.ip))
+			if err != nil {
+				t.Fatalf("v%d %s: %v", ver, tt.ip, err)
+			}
+			if tt.found && !reflect.DeepEqual(got, want) {
+				t.Errorf("v%d %s: got %v, want %v", ver, tt.ip, got, want)
+			}
+			if !tt.found && got != nil {
+				t.Errorf("v%d %s: got %v, want not found", ver, tt.ip, got)
+			}
+		}
+	}
+}
+
+func TestOpenMMDBErrors(t *testing.T) {
+	write := func(b []byte) string {
+		p := filepath.Join(t.TempDir(), "bad.mmdb")
+		if err := os.WriteFile(p, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	meta := func(nodes, size uint) []byte {
+		return append(append([]byte{}, mmdbMetaMarker...), mmMap(
+			mmString("node_count"), mmUint(6, uint64(nodes)),
+			mmString("record_size"), mmUint(5, uint64(size)),
+			mmString("ip_version"), mmUint(5, 4),
+		)...)
+	}
+	tests := []struct {
+		name, file, msg string
+	}{
+		{"missing", filepath.Join(t.TempDir(), "none.mmdb"), "no such file"},
+		{"no metadata", write([]byte("not a database")), "metadata not found"},
+		{"metadata not a map", write(append(append([]byte{}, mmdbMetaMarker...), mmString("x")...)), "bad metadata"},
+		{"truncated metadata", write(append(append([]byte{}, mmdbMetaMarker...), 0xe3, 0x44)), "metadata"},
+		{"record size", write(meta(1, 20)), "record size"},
+		{"truncated tree", write(append(make([]byte, 10), meta(100, 24)...)), "truncated"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := openMMDB(tt.file)
+			if err == nil || !strings.Contains(err.Error(), tt.msg) {
+				t.Errorf("got %v, want an error mentioning %q", err, tt.msg)
+			}
+		})
+	}
+}
+
+func TestMMDBDecode(t *testing.T) {
+	f64 := binary.BigEndian.AppendUint64(nil, math.Float64bits(1.5))
+	f32 := binary.BigEndian.AppendUint32(nil, math.Float32bits(0.5))
+	long := strings.Repeat("x", 300)
+	huge := strings.Repeat("y", 70000)
+	tests := []struct {
+		name string
+		b    []byte
+		want any
+		msg  string // error
+	}{
+		{"string", mmString("abc"), "abc", ""},
+		{"empty string", mmString(""), "", ""},
+		{"string size 29+", mmString(long[:100]), long[:100], ""},
+		{"string size 285+", mmString(long), long, ""},
+		{"string size 65821+", mmString(huge), huge, ""},
+		{"double", append([]byte{0x68}, f64...), 1.5, ""},
+		{"float", append(mmCtrl(15, 4), f32...), 0.5, ""},
+		{"bytes", append(mmCtrl(4, 2), 1, 2), []byte{1, 2}, ""},
+		{"uint16", mmUint(5, 0x1234), uint64(0x1234), ""},
+		{"uint32 zero", mmUint(6, 0), uint64(0), ""},
+		{"uint64", mmUint(9, math.MaxUint64), uint64(math.MaxUint64), ""},
+		{"int32 negative", append(mmCtrl(8, 4), 0xff, 0xff, 0xff, 0xfe), int64(-2), ""},
+		{"int32 short", append(mmCtrl(8, 1), 0x05), int64(5), ""},
+		{"bool", mmCtrl(14, 1), true, ""},
+		{"array", append(mmCtrl(11, 2), append(mmString("a"), mmUint(5, 1)...)...), []any{"a", uint64(1)}, ""},
+		{"map", mmMap(mmString("k"), mmString("v")), map[string]any{"k": "v"}, ""},
+		// pointer sizes: the value lives at the pointed-to offset
+		{"pointer 11 bit", append([]byte{0x20, 0x02}, mmString("p")...), "p", ""},
+		{"pointer 19 bit", append(append([]byte{0x28, 0x00, 0x00}, make([]byte, 2045)...), mmString("q")...), "q", ""},
+		{"pointer 32 bit", append([]byte{0x38, 0, 0, 0, 5}, mmString("r")...), "r", ""},
+		{"map with pointer value", append(mmMap(mmString("k"), []byte{0x20, 0x05}), mmString("v")...), map[string]any{"k": "v"}, ""},
+		{"empty", nil, nil, "end of data"},
+		{"truncated string", []byte{0x45, 'a'}, nil, "end of data"},
+		{"truncated size", []byte{0x5e, 0x01}, nil, "end of data"},
+		{"truncated double", []byte{0x68, 0, 0}, nil, "end of data"},
+		{"truncated map", mmCtrl(7, 3), nil, "end of data"},
+		{"huge array size", []byte{0x1f, 0x04, 0xff, 0xff, 0xff}, nil, "end of data"},
+		{"pointer past end", []byte{0x20, 0x40}, nil, "end of data"},
+		{"pointer loop", []byte{0x20, 0x00}, nil, "too deep"},
+		{"map pointing to itself", mmMap(mmString("k"), []byte{0x20, 0x00}), nil, "too deep"},
+		{"unsupported type", []byte{0x00, 0x06}, nil, "unsupported"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _, err := (&mmdbDecoder{b: tt.b}).decode(0)
+			if tt.msg != "" || tt.want == nil {
+				if err == nil {
+					t.Fatalf("got %v, want an error", got)
+				}
+				if !strings.Contains(err.Error(), tt.msg) {
+					t.Errorf("error %q doesn't mention %q", err, tt.msg)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
@@ -5,8 +5,10 @@ import (
 	"crypto/tls"
 	"encoding/json"
 	"errors"
+	"io"
 	"net"
 	"net/http"
+	"strings"
 	"time"
 )
 
@@ -17,31 +19,71 @@ type Result struct {
 	IPv6OK     bool   `json:"ipv6_ok"`
 	PublicIPv6 string `json:"public_ipv6,omitempty"`
 	ProbeTS    int64  `json:"probe_ts"`
+
+	// Echo URL that answered, when it was not the first one configured.
+	IPv4Source string `json:"ipv4_source,omitempty"`
+	IPv6Source string `json:"ipv6_source,omitempty"`
+
+	// STUN NAT detection, when stun_servers are configured.
+	NAT *NAT `json:"nat,omitempty"`
+}
+
+// Endpoint is an IP-echo service. Format "json" (default) expects
+// {"ip":"..."}; "text" takes the whole trimmed body as the address.
+type Endpoint struct {
+	URL    string `json:"url"`
+	Format string `json:"format,omitempty"`
+}
+
+// Endpoints lists echo services per family, tried in order until one answers.
+type Endpoints struct {
+	IPv4 []Endpoint `json:"ipv4,omitempty"`
+	IPv6 []Endpoint `json:"ipv6,omitempty"`
+}
+
+// DefaultEndpoints are the ipify services used when nothing is configured.
+var DefaultEndpoints = Endpoints{
+	IPv4: []Endpoint{{URL: "https://api.ipify.org?format=json"}},
+	IPv6: []Endpoint{{URL: "https://api6.ipify.org?format=json"}},
 }
 
 type ipifyResp struct {
 	IP string `json:"ip"`
 }
 
-// Probe does a one-time connectivity + public IP check via ipify endpoints.
-// - IPv4: https://api.ipify.org?format=json
-// - IPv6: https://api6.ipify.org?format=json
-func Probe(timeout time.Duration, insecureSkipVerify bool) Result {
+// Probe does a connectivity + public IP check per family, trying the echo
+// endpoints in order. An empty list for a family falls back to
+// DefaultEndpoints.
+func Probe(timeout time.Duration, insecureSkipVerify bool, eps Endpoints) Result {
 	now := time.Now().Unix()
 	r := Result{Done: true, ProbeTS: now}
 
-	ip4, ok4 := fetchIP("tcp4", "https://api.ipify.org?format=json", timeout, insecureSkipVerify)
-	r.IPv4OK = ok4
-	r.PublicIPv4 = ip4
-
-	ip6, ok6 := fetchIP("tcp6", "https://api6.ipify.org?format=json", timeout, insecureSkipVerify)
-	r.IPv6OK = ok6
-	r.PublicIPv6 = ip6
+	if len(eps.IPv4) == 0 {
+		eps.IPv4 = DefaultEndpoints.IPv4
+	}
+	if len(eps.IPv6) == 0 {
+		eps.IPv6 = DefaultEndpoints.IPv6
+	}
 
+	r.PublicIPv4, r.IPv4Source, r.IPv4OK = fetchFirst("tcp4", eps.IPv4, timeout, insecureSkipVerify)
+	r.PublicIPv6, r.IPv6Source, r.IPv6OK = fetchFirst("tcp6", eps.IPv6, timeout, insecureSkipVerify)
 	return r
 }
 
-func fetchIP(network, url string, timeout time.Duration, insecureSkipVerify bool) (string, bool) {
+// fetchFirst returns the first answer; source is set only for fallbacks.
+func fetchFirst(network string, eps []Endpoint, timeout time.Duration, insecureSkipVerify bool) (ip, source string, ok bool) {
+	for i, ep := range eps {
+		if ip, ok := fetchIP(network, ep, timeout, insecureSkipVerify); ok {
+			if i > 0 {
+				source = ep.URL
+			}
+			return ip, source, true
+		}
+	}
+	return "", "", false
+}
+
+func fetchIP(network string, ep Endpoint, timeout time.Duration, insecureSkipVerify bool) (string, bool) {
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
@@ -54,7 +96,10 @@ func fetchIP(network, url string, timeout time.Duration, insecureSkipVerify bool
 	}
 	client := &http.Client{Transport: tr}
 
-	req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", ep.URL, nil)
+	if err != nil {
+		return "", false
+	}
 	resp, err := client.Do(req)
 	if err != nil {
 		return "", false
@@ -64,8 +109,17 @@ func fetchIP(network, url string, timeout time.Duration, insecureSkipVerify bool
 		return "", false
 	}
 	var out ipifyResp
-	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
-		return "", false
+	switch ep.Format {
+	case "text":
+		b, err := io.ReadAll(io.LimitReader(resp.Body, 256))
+		if err != nil {
+			return "", false
+		}
+		out.IP = strings.TrimSpace(string(b))
+	default:
+		if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+			return "", false
+		}
 	}
 	if out.IP == "" {
 		return "", false
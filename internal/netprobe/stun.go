@@ -0,0 +1,215 @@
+package netprobe
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+)
+
+// NAT is the outcome of STUN-based NAT detection.
+type NAT struct {
+	// Type: open (no NAT), full_cone, restricted_cone, cone (endpoint-
+	// independent mapping; port-restricted, or the server ignored
+	// CHANGE-REQUEST), symmetric or udp_blocked.
+	Type       string `json:"type"`
+	MappedAddr string `json:"mapped_addr,omitempty"` // reflexive ip:port
+	LocalAddr  string `json:"local_addr,omitempty"`
+	Err        string `json:"err,omitempty"`
+}
+
+const (
+	stunMagic          = 0x2112A442
+	stunBindingRequest = 0x0001
+	stunBindingSuccess = 0x0101
+
+	stunAttrMappedAddress    = 0x0001
+	stunAttrChangeRequest    = 0x0003
+	stunAttrXORMappedAddress = 0x0020
+
+	stunChangeIP   = 0x04
+	stunChangePort = 0x02
+)
+
+// DetectNAT sends STUN binding requests from one UDP socket to the given
+// servers ("host:port"). Equal reflexive addresses across two servers mean
+// endpoint-independent mapping (cone); different ones mean symmetric NAT.
+// For cone NATs the first server is asked to answer from another IP/port
+// (RFC 5780 CHANGE-REQUEST); servers that ignore it leave the type at "cone".
+func DetectNAT(servers []string, timeout time.Duration) NAT {
+	if len(servers) == 0 {
+		return NAT{Err: "no stun servers"}
+	}
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return NAT{Err: err.Error()}
+	}
+	defer conn.Close()
+
+	var mapped []*net.UDPAddr
+	var firstSrv *net.UDPAddr
+	for _, s := range servers {
+		srv, err := net.ResolveUDPAddr("udp4", s)
+		if err != nil {
+			continue
+		}
+		m, err := stunBinding(conn, srv, 0, timeout)
+		if err != nil {
+			continue
+		}
+		if firstSrv == nil {
+			firstSrv = srv
+		}
+		mapped = append(mapped, m)
+		if len(mapped) == 2 {
+			break
+		}
+	}
+	if len(mapped) == 0 {
+		return NAT{Type: "udp_blocked", Err: "no stun response"}
+	}
+
+	r := NAT{MappedAddr: mapped[0].String(), LocalAddr: localAddr(conn, firstSrv)}
+	if la, err := net.ResolveUDPAddr("udp4", r.LocalAddr); err == nil && la.IP.Equal(mapped[0].IP) && la.Port == mapped[0].Port {
+		r.Type = "open"
+		return r
+	}
+	if len(mapped) == 2 && !addrEqual(mapped[0], mapped[1]) {
+		r.Type = "symmetric"
+		return r
+	}
+
+	r.Type = "cone"
+	if _, err := stunBinding(conn, firstSrv, stunChangeIP|stunChangePort, timeout); err == nil {
+		r.Type = "full_cone"
+	} else if _, err := stunBinding(conn, firstSrv, stunChangePort, timeout); err == nil {
+		r.Type = "restricted_cone"
+	}
+	return r
+}
+
+// localAddr is the address the kernel picks towards srv (ListenUDP binds
+// 0.0.0.0, which says nothing about being behind NAT).
+func localAddr(conn *net.UDPConn, srv *net.UDPAddr) string {
+	c, err := net.DialUDP("udp4", nil, srv)
+	if err != nil {
+		return conn.LocalAddr().String()
+	}
+	defer c.Close()
+	ip := c.LocalAddr().(*net.UDPAddr).IP
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	return (&net.UDPAddr{IP: ip, Port: port}).String()
+}
+
+func addrEqual(a, b *net.UDPAddr) bool {
+	return a.IP.Equal(b.IP) && a.Port == b.Port
+}
+
+var errSTUNTimeout = errors.New("stun: no response")
+
+// stunBinding sends one Binding request (with an optional CHANGE-REQUEST)
+// and returns the reflexive address from the matching response.
+func stunBinding(conn *net.UDPConn, srv *net.UDPAddr, change uint32, timeout time.Duration) (*net.UDPAddr, error) {
+	var tid [12]byte
+	if _, err := rand.Read(tid[:]); err != nil {
+		return nil, err
+	}
+	req := make([]byte, 20, 28)
+	binary.BigEndian.PutUint16(req[0:], stunBindingRequest)
+	binary.BigEndian.PutUint32(req[4:], stunMagic)
+	copy(req[8:], tid[:])
+	if change != 0 {
+		req = binary.BigEndian.AppendUint16(req, stunAttrChangeRequest)
+		req = binary.BigEndian.AppendUint16(req, 4)
+		req = binary.BigEndian.AppendUint32(req, change)
+	}
+	binary.BigEndian.PutUint16(req[2:], uint16(len(req)-20))
+
+	if _, err := conn.WriteToUDP(req, srv); err != nil {
+		return nil, err
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				return nil, errSTUNTimeout
+			}
+			return nil, err
+		}
+		// a late answer to an earlier request has another transaction id
+		if n < 20 || !bytes.Equal(buf[8:20], tid[:]) {
+			continue
+		}
+		return parseBindingResponse(buf[:n])
+	}
+}
+
+func parseBindingResponse(b []byte) (*net.UDPAddr, error) {
+	if len(b) < 20 {
+		return nil, errors.New("stun: short message")
+	}
+	if binary.BigEndian.Uint16(b[0:]) != stunBindingSuccess {
+		return nil, errors.New("stun: binding failed")
+	}
+	var mapped *net.UDPAddr
+	attrs := b[20:]
+	for len(attrs) >= 4 {
+		typ := binary.BigEndian.Uint16(attrs[0:])
+		l := int(binary.BigEndian.Uint16(attrs[2:]))
+		if 4+l > len(attrs) {
+			break
+		}
+		v := attrs[4 : 4+l]
+		switch typ {
+		case stunAttrXORMappedAddress:
+			if a := stunAddr(v, true, b[4:20]); a != nil {
+				return a, nil
+			}
+		case stunAttrMappedAddress:
+			mapped = stunAddr(v, false, nil)
+		}
+		// values are padded to 4 bytes, but the last one may come without
+		next := 4 + (l+3)&^3
+		if next > len(attrs) {
+			next = len(attrs)
+		}
+		attrs = attrs[next:]
+	}
+	if mapped == nil {
+		return nil, errors.New("stun: no mapped address")
+	}
+	return mapped, nil
+}
+
+// stunAddr decodes a (XOR-)MAPPED-ADDRESS value; key is magic cookie +
+// transaction id for the XOR variant.
+func stunAddr(v []byte, xor bool, key []byte) *net.UDPAddr {
+	if len(v) < 8 {
+		return nil
+	}
+	port := binary.BigEndian.Uint16(v[2:])
+	var ip net.IP
+	switch v[1] {
+	case 0x01:
+		ip = append(net.IP{}, v[4:8]...)
+	case 0x02:
+		if len(v) < 20 {
+			return nil
+		}
+		ip = append(net.IP{}, v[4:20]...)
+	default:
+		return nil
+	}
+	if xor {
+		port ^= stunMagic >> 16
+		for i := range ip {
+			ip[i] ^= key[i]
+		}
+	}
+	return &net.UDPAddr{IP: ip, Port: int(port)}
+}
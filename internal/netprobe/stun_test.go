@@ -0,0 +1,160 @@
+package netprobe
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testTID = []byte("abcdefghijkl")
+
+type stunAttr struct {
+	typ uint16
+	val []byte
+	pad bool
+}
+
+// stunMsg builds a STUN message; attributes are padded when pad is set,
+// and the header length always covers what follows.
+func stunMsg(typ uint16, attrs ...stunAttr) []byte {
+	b := make([]byte, 20)
+	binary.BigEndian.PutUint16(b[0:], typ)
+	binary.BigEndian.PutUint32(b[4:], stunMagic)
+	copy(b[8:], testTID)
+	for _, a := range attrs {
+		b = binary.BigEndian.AppendUint16(b, a.typ)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(a.val)))
+		b = append(b, a.val...)
+		if a.pad {
+			for len(b)%4 != 0 {
+				b = append(b, 0)
+			}
+		}
+	}
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)-20))
+	return b
+}
+
+// addrValue encodes a (XOR-)MAPPED-ADDRESS value.
+func addrValue(ip net.IP, port int, xor bool) []byte {
+	fam := byte(0x01)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	} else {
+		fam = 0x02
+	}
+	v := []byte{0, fam, 0, 0}
+	binary.BigEndian.PutUint16(v[2:], uint16(port))
+	a := append(net.IP{}, ip...)
+	if xor {
+		binary.BigEndian.PutUint16(v[2:], uint16(port)^stunMagic>>16)
+		key := binary.BigEndian.AppendUint32(nil, stunMagic)
+		key = append(key, testTID...)
+		for i := range a {
+			a[i] ^= key[i]
+		}
+	}
+	return append(v, a...)
+}
+
+func TestParseBindingResponse(t *testing.T) {
+	v4 := net.ParseIP("203.0.113.7")
+	v6 := net.ParseIP("2001:db8::1")
+	tests := []struct {
+		name string
+		msg  []byte
+		want string // "" for an error
+	}{
+		{"xor v4", stunMsg(stunBindingSuccess, stunAttr{stunAttrXORMappedAddress, addrValue(v4, 54321, true), true}), "203.0.113.7:54321"},
+		{"xor v6", stunMsg(stunBindingSuccess, stunAttr{stunAttrXORMappedAddress, addrValue(v6, 3478, true), true}), "[2001:db8::1]:3478"},
+		{"mapped only", stunMsg(stunBindingSuccess, stunAttr{stunAttrMappedAddress, addrValue(v4, 1000, false), true}), "203.0.113.7:1000"},
+		{"xor preferred", stunMsg(stunBindingSuccess,
+			stunAttr{stunAttrMappedAddress, addrValue(net.ParseIP("10.0.0.1"), 1, false), true},
+			stunAttr{stunAttrXORMappedAddress, addrValue(v4, 2, true), true}), "203.0.113.7:2"},
+		{"skips unknown attributes", stunMsg(stunBindingSuccess,
+			stunAttr{0x8022, []byte("software"), true},
+			stunAttr{0x8028, []byte{1, 2, 3}, true},
+			stunAttr{stunAttrXORMappedAddress, addrValue(v4, 9, true), true}), "203.0.113.7:9"},
+		{"unpadded last attribute", stunMsg(stunBindingSuccess,
+			stunAttr{stunAttrMappedAddress, addrValue(v4, 7, false), true},
+			stunAttr{0x8022, []byte("x"), false}), "203.0.113.7:7"},
+		{"unpadded only attribute", stunMsg(stunBindingSuccess, stunAttr{0x8022, []byte("abcde"), false}), ""},
+		{"attribute longer than message", append(stunMsg(stunBindingSuccess), 0x00, 0x20, 0x00, 0xff, 1, 2), ""},
+		{"truncated attribute header", append(stunMsg(stunBindingSuccess), 0x00, 0x20), ""},
+		{"short address", stunMsg(stunBindingSuccess, stunAttr{stunAttrXORMappedAddress, []byte{0, 1, 0, 0}, true}), ""},
+		{"short v6 address", stunMsg(stunBindingSuccess, stunAttr{stunAttrXORMappedAddress, append([]byte{0, 2, 0, 0}, make([]byte, 8)...), true}), ""},
+		{"unknown family", stunMsg(stunBindingSuccess, stunAttr{stunAttrXORMappedAddress, []byte{0, 9, 0, 0, 1, 2, 3, 4}, true}), ""},
+		{"error response", stunMsg(0x0111, stunAttr{stunAttrXORMappedAddress, addrValue(v4, 1, true), true}), ""},
+		{"no attributes", stunMsg(stunBindingSuccess), ""},
+		{"short header", []byte{0x01, 0x01, 0, 0}, ""},
+		{"empty", nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseBindingResponse(tt.msg)
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("got %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.String() != tt.want {
+				t.Errorf("got %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestDetectNATLoopback runs DetectNAT against a STUN server on
+// 127.0.0.1, which sees the agent's own address: no NAT.
+func TestDetectNATLoopback(t *testing.T) {
+	srv, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skip(err)
+	}
+	defer srv.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := srv.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if n < 20 || binary.BigEndian.Uint16(buf) != stunBindingRequest || n > 20 {
+				continue // ignore CHANGE-REQUEST: the client stays at "cone" there
+			}
+			resp := make([]byte, 20)
+			binary.BigEndian.PutUint16(resp[0:], stunBindingSuccess)
+			binary.BigEndian.PutUint32(resp[4:], stunMagic)
+			copy(resp[8:], buf[8:20])
+			v := []byte{0, 1, 0, 0}
+			binary.BigEndian.PutUint16(v[2:], uint16(from.Port)^stunMagic>>16)
+			key := resp[4:8]
+			for i, b := range from.IP.To4() {
+				v = append(v, b^key[i])
+			}
+			resp = binary.BigEndian.AppendUint16(resp, stunAttrXORMappedAddress)
+			resp = binary.BigEndian.AppendUint16(resp, uint16(len(v)))
+			resp = append(resp, v...)
+			binary.BigEndian.PutUint16(resp[2:], uint16(len(resp)-20))
+			_, _ = srv.WriteToUDP(resp, from)
+		}
+	}()
+
+	nat := DetectNAT([]string{srv.LocalAddr().String()}, time.Second)
+	if nat.Type != "open" {
+		t.Errorf("got %+v, want type open", nat)
+	}
+	if !strings.HasPrefix(nat.MappedAddr, "127.0.0.1:") || nat.MappedAddr != nat.LocalAddr {
+		t.Errorf("mapped %s, local %s", nat.MappedAddr, nat.LocalAddr)
+	}
+
+	if nat := DetectNAT(nil, time.Second); nat.Err == "" {
+		t.Error("no error without servers")
+	}
+}
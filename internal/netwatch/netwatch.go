@@ -0,0 +1,74 @@
+// Package netwatch notices when the host's way out to the internet
+// changes: another default gateway, interface or source address, as after
+// a DHCP renewal, a failover or a moved VM.
+package netwatch
+
+import (
+	"net"
+	"net/netip"
+)
+
+// Route is the host's current way out per family. Comparable, so a change
+// is one !=.
+type Route struct {
+	Iface4   string `json:"iface4,omitempty"`
+	Src4     string `json:"src4,omitempty"`     // source address the kernel picks
+	Gateway4 string `json:"gateway4,omitempty"` // Linux only
+	Iface6   string `json:"iface6,omitempty"`
+	Src6     string `json:"src6,omitempty"`
+	Gateway6 string `json:"gateway6,omitempty"`
+}
+
+// Addresses that are never dialed: connecting a UDP socket only asks the
+// kernel which route and source address it would use.
+var probeAddrs = [2]string{"1.1.1.1:53", "[2606:4700:4700::1111]:53"}
+
+// Current reads the route for both families; a family without one is left
+// empty.
+func Current() Route {
+	var r Route
+	ifaces := ifaceAddrs()
+	r.Src4, r.Iface4 = source(probeAddrs[0], ifaces)
+	r.Src6, r.Iface6 = source(probeAddrs[1], ifaces)
+	r.Gateway4, r.Gateway6 = gateways()
+	return r
+}
+
+func source(dst string, ifaces map[netip.Addr]string) (src, iface string) {
+	c, err := net.Dial("udp", dst)
+	if err != nil {
+		return "", ""
+	}
+	defer c.Close()
+	ap, err := netip.ParseAddrPort(c.LocalAddr().String())
+	if err != nil {
+		return "", ""
+	}
+	a := ap.Addr().Unmap()
+	return a.String(), ifaces[a]
+}
+
+// ifaceAddrs maps each local address to its interface.
+func ifaceAddrs() map[netip.Addr]string {
+	m := map[netip.Addr]string{}
+	ifs, err := net.Interfaces()
+	if err != nil {
+		return m
+	}
+	for _, ifc := range ifs {
+		addrs, _ := ifc.Addrs()
+		for _, a := range addrs {
+			if p, err := netip.ParsePrefix(a.String()); err == nil {
+				m[p.Addr().Unmap()] = ifc.Name
+			}
+		}
+	}
+	return m
+}
+
+// HasAddr reports whether ip is still assigned to one of the host's
+// interfaces, i.e. whether a connection bound to it can keep working.
+func HasAddr(ip netip.Addr) bool {
+	_, ok := ifaceAddrs()[ip.Unmap()]
+	return ok
+}
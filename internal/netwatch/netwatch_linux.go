@@ -0,0 +1,129 @@
+package netwatch
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// rtnetlink multicast groups (linux/rtnetlink.h), missing from syscall.
+const (
+	rtmgrpLink       = 0x1
+	rtmgrpIPv4Ifaddr = 0x10
+	rtmgrpIPv4Route  = 0x40
+	rtmgrpIPv6Ifaddr = 0x100
+	rtmgrpIPv6Route  = 0x400
+)
+
+// Watch signals on the returned channel when the kernel announces a link,
+// address or route change (rtnetlink multicast groups). Bursts coalesce
+// into one pending signal. It returns nil if the socket can't be opened;
+// the channel is closed when ctx ends.
+func Watch(ctx context.Context) <-chan struct{} {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil
+	}
+	groups := uint32(rtmgrpLink | rtmgrpIPv4Ifaddr | rtmgrpIPv4Route | rtmgrpIPv6Ifaddr | rtmgrpIPv6Route)
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: groups}); err != nil {
+		syscall.Close(fd)
+		return nil
+	}
+	// wake up now and then to notice ctx ending
+	tv := syscall.NsecToTimeval(int64(time.Second))
+	_ = syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv)
+
+	ch := make(chan struct{}, 1)
+	go func() {
+		defer close(ch)
+		defer syscall.Close(fd)
+		buf := make([]byte, 64<<10)
+		for ctx.Err() == nil {
+			n, _, err := syscall.Recvfrom(fd, buf, 0)
+			if err != nil {
+				if err == syscall.ENOBUFS {
+					n = 0 // overrun: changes were lost, so look anyway
+				} else {
+					continue // timeout or EINTR
+				}
+			}
+			if n > 0 && !relevant(buf[:n]) {
+				continue
+			}
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return ch
+}
+
+// relevant skips the messages that don't change the way out.
+func relevant(b []byte) bool {
+	msgs, err := syscall.ParseNetlinkMessage(b)
+	if err != nil {
+		return true
+	}
+	for _, m := range msgs {
+		switch m.Header.Type {
+		case syscall.RTM_NEWLINK, syscall.RTM_DELLINK,
+			syscall.RTM_NEWADDR, syscall.RTM_DELADDR,
+			syscall.RTM_NEWROUTE, syscall.RTM_DELROUTE:
+			return true
+		}
+	}
+	return false
+}
+
+// gateways reads the default routes with the lowest metric.
+func gateways() (gw4, gw6 string) {
+	best := -1
+	forEachField("/proc/net/route", func(f []string) {
+		// Iface Destination Gateway Flags RefCnt Use Metric Mask ...
+		if len(f) < 8 || f[1] != "00000000" || f[7] != "00000000" {
+			return
+		}
+		metric, _ := strconv.Atoi(f[6])
+		b, err := hex.DecodeString(f[2])
+		if err != nil || len(b) != 4 || best >= 0 && metric >= best {
+			return
+		}
+		best = metric
+		gw4 = netip.AddrFrom4([4]byte{b[3], b[2], b[1], b[0]}).String()
+	})
+	best = -1
+	forEachField("/proc/net/ipv6_route", func(f []string) {
+		// dest destlen src srclen nexthop metric refcnt use flags iface
+		if len(f) < 10 || f[1] != "00" || f[9] == "lo" || strings.Trim(f[0], "0") != "" {
+			return
+		}
+		metric64, _ := strconv.ParseUint(f[5], 16, 32)
+		metric := int(metric64)
+		b, err := hex.DecodeString(f[4])
+		if err != nil || len(b) != 16 || best >= 0 && metric >= best {
+			return
+		}
+		best = metric
+		gw6 = netip.AddrFrom16([16]byte(b)).String()
+	})
+	return gw4, gw6
+}
+
+func forEachField(path string, fn func([]string)) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fn(strings.Fields(sc.Text()))
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package netwatch
+
+import "context"
+
+// Watch has no change notifications to offer here: it returns nil and
+// callers rely on polling Current.
+func Watch(ctx context.Context) <-chan struct{} { return nil }
+
+// gateways aren't read without /proc.
+func gateways() (gw4, gw6 string) { return "", "" }
@@ -0,0 +1,82 @@
+// Package pathtrace records the first hops of the forward path to an
+// address, traceroute style, so that the agent can notice routing changes.
+//
+// Probes are UDP datagrams with increasing TTLs, all sent from one
+// connected socket: source and destination ports stay fixed, so routers
+// balancing flows over equal-cost paths (ECMP) keep the probes of a trace,
+// and of later traces, on one path (as Paris traceroute does). The ICMP
+// answers are read unprivileged from the socket's error queue on Linux;
+// elsewhere Trace returns ErrUnsupported.
+package pathtrace
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"time"
+)
+
+const (
+	// DefaultMaxHops is how many hops a trace records by default.
+	DefaultMaxHops = 6
+	// Port is the destination UDP port of the probes (traceroute's base
+	// port: nothing listens there, so the target answers port unreachable).
+	Port = 33434
+	// hopTimeout bounds the wait for one hop's answer.
+	hopTimeout = time.Second
+)
+
+// ErrUnsupported is returned off Linux.
+var ErrUnsupported = errors.New("path tracing is not supported on this platform")
+
+// Hop is one TTL of a trace. IP is empty when nothing answered in time.
+type Hop struct {
+	TTL   int     `json:"ttl"`
+	IP    string  `json:"ip,omitempty"`
+	RTTMS float64 `json:"rtt_ms,omitempty"`
+	ASN   uint64  `json:"asn,omitempty"` // set by the caller when it knows
+}
+
+// Path is the result of a trace.
+type Path struct {
+	Hops []Hop `json:"hops"`
+	// Reached is set when the target itself answered within the hops.
+	Reached bool `json:"reached,omitempty"`
+	// Unreachable is set when a router reported the target unreachable.
+	Unreachable bool `json:"unreachable,omitempty"`
+}
+
+// Trace probes ip with TTLs 1..maxHops (DefaultMaxHops when <= 0), one at
+// a time, and stops early once the target or an unreachable answers.
+func Trace(ctx context.Context, ip netip.Addr, maxHops int) (Path, error) {
+	if maxHops <= 0 {
+		maxHops = DefaultMaxHops
+	}
+	return trace(ctx, ip.Unmap(), maxHops)
+}
+
+// Changed lists the TTLs where both paths have an answering hop and the
+// addresses differ. Hops that didn't answer in either trace are unknown,
+// not changes; neither is a path that got longer or shorter by ending
+// earlier.
+func Changed(prev, cur []Hop) []int {
+	var ttls []int
+	for i := 0; i < len(prev) && i < len(cur); i++ {
+		if prev[i].IP != "" && cur[i].IP != "" && prev[i].IP != cur[i].IP {
+			ttls = append(ttls, cur[i].TTL)
+		}
+	}
+	return ttls
+}
+
+// ASPath is the sequence of distinct ASNs along hops, skipping hops
+// without one.
+func ASPath(hops []Hop) []uint64 {
+	var path []uint64
+	for _, h := range hops {
+		if h.ASN != 0 && (len(path) == 0 || path[len(path)-1] != h.ASN) {
+			path = append(path, h.ASN)
+		}
+	}
+	return path
+}
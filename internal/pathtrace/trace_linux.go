@@ -0,0 +1,158 @@
+package pathtrace
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/netip"
+	"os"
+	"syscall"
+	"time"
+)
+
+// ICMP(v6) destination unreachable types and the origins of sock_extended_err (linux/errqueue.h).
+const (
+	eeOriginICMP  = 2
+	eeOriginICMP6 = 3
+
+	icmpUnreach  = 3
+	icmp6Unreach = 1
+)
+
+// icmpErr is one answer read from the error queue.
+type icmpErr struct {
+	from    netip.Addr
+	unreach bool // destination unreachable (from the target: reached)
+}
+
+func trace(ctx context.Context, ip netip.Addr, maxHops int) (Path, error) {
+	network := "udp4"
+	level, recvErr, ttlOpt := syscall.SOL_IP, syscall.IP_RECVERR, syscall.IP_TTL
+	if ip.Is6() {
+		network = "udp6"
+		level, recvErr, ttlOpt = syscall.SOL_IPV6, syscall.IPV6_RECVERR, syscall.IPV6_UNICAST_HOPS
+	}
+	var d net.Dialer
+	c, err := d.DialContext(ctx, network, netip.AddrPortFrom(ip, Port).String())
+	if err != nil {
+		return Path{}, err
+	}
+	defer c.Close()
+	uc := c.(*net.UDPConn)
+	rc, err := uc.SyscallConn()
+	if err != nil {
+		return Path{}, err
+	}
+	if err := setsockopt(rc, level, recvErr, 1); err != nil {
+		return Path{}, fmt.Errorf("enable error queue: %w", err)
+	}
+
+	p := Path{Hops: []Hop{}}
+	payload := make([]byte, 32)
+	for ttl := 1; ttl <= maxHops; ttl++ {
+		if err := ctx.Err(); err != nil {
+			return p, err
+		}
+		// late answers to earlier probes would pass for this one's
+		drainErrQueue(rc)
+		if err := setsockopt(rc, level, ttlOpt, ttl); err != nil {
+			return p, fmt.Errorf("set ttl: %w", err)
+		}
+		start := time.Now()
+		if _, err := uc.Write(payload); err != nil {
+			return p, err
+		}
+		_ = uc.SetReadDeadline(start.Add(hopTimeout))
+		h := Hop{TTL: ttl}
+		e, err := readErrQueue(rc)
+		switch {
+		case errors.Is(err, os.ErrDeadlineExceeded):
+			p.Hops = append(p.Hops, h)
+			continue
+		case err != nil:
+			return p, err
+		}
+		h.IP = e.from.String()
+		h.RTTMS = math.Round(float64(time.Since(start).Microseconds())/10) / 100
+		p.Hops = append(p.Hops, h)
+		switch {
+		case e.from == ip:
+			p.Reached = true
+			return p, nil
+		case e.unreach:
+			p.Unreachable = true
+			return p, nil
+		}
+	}
+	return p, nil
+}
+
+func setsockopt(rc syscall.RawConn, level, opt, v int) error {
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), level, opt, v)
+	}); err != nil {
+		return err
+	}
+	return serr
+}
+
+func drainErrQueue(rc syscall.RawConn) {
+	buf, oob := make([]byte, 64), make([]byte, 512)
+	_ = rc.Control(func(fd uintptr) {
+		for {
+			if _, _, _, _, err := syscall.Recvmsg(int(fd), buf, oob, syscall.MSG_ERRQUEUE|syscall.MSG_DONTWAIT); err != nil {
+				return
+			}
+		}
+	})
+}
+
+// readErrQueue waits, until the read deadline, for an ICMP answer.
+// Local errors (such as EMSGSIZE) are skipped.
+func readErrQueue(rc syscall.RawConn) (icmpErr, error) {
+	buf, oob := make([]byte, 64), make([]byte, 512)
+	for {
+		var oobn int
+		var rerr error
+		err := rc.Read(func(fd uintptr) bool {
+			_, oobn, _, _, rerr = syscall.Recvmsg(int(fd), buf, oob, syscall.MSG_ERRQUEUE)
+			return rerr != syscall.EAGAIN
+		})
+		if err != nil {
+			return icmpErr{}, err
+		}
+		if rerr != nil {
+			return icmpErr{}, rerr
+		}
+		if e, ok := parseErr(oob[:oobn]); ok {
+			return e, nil
+		}
+	}
+}
+
+// parseErr reads the sock_extended_err control message and the offender
+// address after it.
+func parseErr(oob []byte) (icmpErr, bool) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return icmpErr{}, false
+	}
+	for _, m := range msgs {
+		if !(m.Header.Level == syscall.SOL_IP && m.Header.Type == syscall.IP_RECVERR ||
+			m.Header.Level == syscall.SOL_IPV6 && m.Header.Type == syscall.IPV6_RECVERR) || len(m.Data) < 16 {
+			continue
+		}
+		origin, typ := m.Data[4], m.Data[5]
+		off := m.Data[16:] // struct sockaddr_in / sockaddr_in6
+		switch {
+		case origin == eeOriginICMP && len(off) >= 8:
+			return icmpErr{from: netip.AddrFrom4([4]byte(off[4:8])), unreach: typ == icmpUnreach}, true
+		case origin == eeOriginICMP6 && len(off) >= 24:
+			return icmpErr{from: netip.AddrFrom16([16]byte(off[8:24])).Unmap(), unreach: typ == icmp6Unreach}, true
+		}
+	}
+	return icmpErr{}, false
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package pathtrace
+
+import (
+	"context"
+	"net/netip"
+)
+
+func trace(ctx context.Context, ip netip.Addr, maxHops int) (Path, error) {
+	return Path{}, ErrUnsupported
+}
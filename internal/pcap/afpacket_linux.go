@@ -0,0 +1,60 @@
+package pcap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+// afPacket captures from a raw AF_PACKET socket bound to the interface;
+// it needs CAP_NET_RAW and can't filter.
+func afPacket(ctx context.Context, r Request) (Result, error) {
+	res := Result{Method: "af_packet"}
+	ifi, err := net.InterfaceByName(r.Iface)
+	if err != nil {
+		return res, err
+	}
+	proto := htons(syscall.ETH_P_ALL)
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, int(proto))
+	if err != nil {
+		return res, fmt.Errorf("af_packet socket: %w", err)
+	}
+	defer syscall.Close(fd)
+	if err := syscall.Bind(fd, &syscall.SockaddrLinklayer{Protocol: proto, Ifindex: ifi.Index}); err != nil {
+		return res, fmt.Errorf("af_packet bind: %w", err)
+	}
+	// short reads so ctx is noticed
+	tv := syscall.NsecToTimeval(int64(200 * time.Millisecond))
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		return res, err
+	}
+
+	// loopback carries (zeroed) Ethernet headers; devices without a
+	// hardware address, like tun, carry bare IP packets
+	link := uint32(linkEthernet)
+	if ifi.Flags&net.FlagLoopback == 0 && len(ifi.HardwareAddr) == 0 {
+		link = linkRaw
+	}
+	w := newWriter(link, r.MaxBytes)
+	buf := make([]byte, snapLen)
+	for ctx.Err() == nil {
+		n, _, err := syscall.Recvfrom(fd, buf, syscall.MSG_TRUNC)
+		if err != nil {
+			if errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EINTR) {
+				continue
+			}
+			res.Data, res.Packets = w.buf, w.packets
+			return res, err
+		}
+		if !w.add(time.Now(), buf[:min(n, len(buf))], n) {
+			break
+		}
+	}
+	res.Data, res.Packets, res.Truncated = w.buf, w.packets, w.truncated
+	return res, nil
+}
+
+func htons(v uint16) uint16 { return v<<8 | v>>8 }
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package pcap
+
+import (
+	"context"
+	"errors"
+)
+
+// afPacket is Linux only; elsewhere captures need tcpdump.
+func afPacket(context.Context, Request) (Result, error) {
+	return Result{}, errors.New("packet capture needs tcpdump on this platform")
+}
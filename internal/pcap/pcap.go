@@ -0,0 +1,191 @@
+// Package pcap takes short packet captures for remote debugging: through
+// tcpdump when it is installed (with BPF filters), else from an AF_PACKET
+// socket on Linux. Captures come back as classic pcap files, cut at a
+// packet boundary to fit a size cap.
+package pcap
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	fileHeaderLen   = 24
+	recordHeaderLen = 16
+	snapLen         = 65535
+
+	linkEthernet = 1
+	linkRaw      = 101 // IP packets without a link header (tun devices)
+)
+
+// Request is one capture: up to Duration on Iface, at most MaxBytes of
+// pcap, only packets matching BPF (tcpdump filter syntax) if set.
+type Request struct {
+	Iface    string
+	BPF      string
+	Duration time.Duration
+	MaxBytes int
+}
+
+// Result is a finished capture. Data is a pcap file, possibly just the
+// header when nothing matched; Truncated reports the capture stopped at
+// MaxBytes before Duration was up.
+type Result struct {
+	Method    string // "tcpdump" or "af_packet"
+	Data      []byte
+	Packets   int
+	Truncated bool
+}
+
+// Capture runs r and waits for it; ctx cuts it short. A capture that got
+// packets before failing returns them along with the error.
+func Capture(ctx context.Context, r Request) (Result, error) {
+	if _, err := net.InterfaceByName(r.Iface); err != nil {
+		return Result{}, fmt.Errorf("iface %q: %v", r.Iface, err)
+	}
+	if r.MaxBytes < fileHeaderLen+recordHeaderLen {
+		return Result{}, fmt.Errorf("max_bytes %d is too small", r.MaxBytes)
+	}
+	ctx, cancel := context.WithTimeout(ctx, r.Duration)
+	defer cancel()
+	if path, err := exec.LookPath("tcpdump"); err == nil {
+		return tcpdump(ctx, path, r)
+	}
+	if r.BPF != "" {
+		return Result{}, errors.New("bpf filters need tcpdump, which is not installed")
+	}
+	return afPacket(ctx, r)
+}
+
+// tcpdump streams tcpdump's pcap output and stops it at the size cap.
+func tcpdump(ctx context.Context, path string, r Request) (Result, error) {
+	res := Result{Method: "tcpdump"}
+	args := []string{"-i", r.Iface, "-n", "-U", "-s", fmt.Sprint(snapLen), "-w", "-"}
+	if r.BPF != "" {
+		args = append(args, "--", r.BPF)
+	}
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Cancel = func() error { return cmd.Process.Signal(os.Interrupt) }
+	cmd.WaitDelay = 2 * time.Second
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return res, err
+	}
+	if err := cmd.Start(); err != nil {
+		return res, err
+	}
+	res.Data, res.Packets, res.Truncated, err = readCapped(bufio.NewReader(stdout), r.MaxBytes)
+	if res.Truncated {
+		_ = cmd.Process.Signal(os.Interrupt)
+	}
+	_, _ = io.Copy(io.Discard, stdout)
+	werr := cmd.Wait()
+	switch {
+	case err != nil && len(res.Data) == 0:
+		// tcpdump failed before writing anything: it says why on stderr
+		if msg := lastLine(stderr.String()); msg != "" {
+			return res, errors.New(msg)
+		}
+		if werr != nil {
+			return res, werr
+		}
+		return res, err
+	case err != nil:
+		return res, err
+	}
+	return res, nil
+}
+
+// readCapped copies a pcap stream up to limit bytes, whole packets only.
+func readCapped(rd io.Reader, limit int) (data []byte, packets int, truncated bool, err error) {
+	hdr := make([]byte, fileHeaderLen)
+	if _, err := io.ReadFull(rd, hdr); err != nil {
+		return nil, 0, false, err
+	}
+	var order binary.ByteOrder
+	switch binary.LittleEndian.Uint32(hdr) {
+	case 0xa1b2c3d4, 0xa1b23c4d:
+		order = binary.LittleEndian
+	case 0xd4c3b2a1, 0x4d3cb2a1:
+		order = binary.BigEndian
+	default:
+		return nil, 0, false, errors.New("not a pcap stream")
+	}
+	data = hdr
+	rec := make([]byte, recordHeaderLen)
+	for {
+		if _, err := io.ReadFull(rd, rec); err != nil {
+			if errors.Is(err, io.EOF) {
+				err = nil
+			}
+			return data, packets, false, err
+		}
+		n := int(order.Uint32(rec[8:]))
+		if n > 1<<18 {
+			return data, packets, false, fmt.Errorf("bad record length %d", n)
+		}
+		if len(data)+recordHeaderLen+n > limit {
+			return data, packets, true, nil
+		}
+		p := make([]byte, n)
+		if _, err := io.ReadFull(rd, p); err != nil {
+			if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+				err = nil // cut off mid-packet by the stop
+			}
+			return data, packets, false, err
+		}
+		data = append(append(data, rec...), p...)
+		packets++
+	}
+}
+
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// writer builds a little-endian pcap file in memory.
+type writer struct {
+	buf       []byte
+	limit     int
+	packets   int
+	truncated bool
+}
+
+func newWriter(linkType uint32, limit int) *writer {
+	h := make([]byte, fileHeaderLen)
+	binary.LittleEndian.PutUint32(h[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(h[4:], 2)
+	binary.LittleEndian.PutUint16(h[6:], 4)
+	binary.LittleEndian.PutUint32(h[16:], snapLen)
+	binary.LittleEndian.PutUint32(h[20:], linkType)
+	return &writer{buf: h, limit: limit}
+}
+
+// add appends a packet seen at ts with original length orig; it returns
+// false once the file is full.
+func (w *writer) add(ts time.Time, p []byte, orig int) bool {
+	if len(w.buf)+recordHeaderLen+len(p) > w.limit {
+		w.truncated = true
+		return false
+	}
+	var rec [recordHeaderLen]byte
+	binary.LittleEndian.PutUint32(rec[0:], uint32(ts.Unix()))
+	binary.LittleEndian.PutUint32(rec[4:], uint32(ts.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(rec[8:], uint32(len(p)))
+	binary.LittleEndian.PutUint32(rec[12:], uint32(orig))
+	w.buf = append(append(w.buf, rec[:]...), p...)
+	w.packets++
+	return true
+}
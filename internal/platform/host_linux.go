@@ -0,0 +1,139 @@
+package platform
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"strings"
+)
+
+type host struct {
+	virt, container string
+	provider        string // cloud the firmware names
+}
+
+// azureAssetTag is the chassis asset tag of every Azure VM.
+const azureAssetTag = "7783-7084-3265-9085-8269-3286-77"
+
+// detectHost reads what systemd-detect-virt reads: DMI strings, the Xen
+// sysfs node and the cpuid hypervisor flag for VMs, marker files and
+// environment for containers.
+func detectHost() host {
+	var h host
+	dmi := func(f string) string {
+		b, _ := os.ReadFile("/sys/class/dmi/id/" + f)
+		return strings.TrimSpace(string(b))
+	}
+	vendor, product, bios := dmi("sys_vendor"), dmi("product_name"), dmi("bios_vendor")
+	all := strings.ToLower(vendor + "\n" + product + "\n" + bios + "\n" + dmi("board_vendor"))
+	switch {
+	case vendor == "Amazon EC2" || bios == "Amazon EC2":
+		h.virt, h.provider = "amazon", "aws"
+	case product == "Google Compute Engine" || bios == "Google":
+		h.virt, h.provider = "kvm", "gcp"
+	case dmi("chassis_asset_tag") == azureAssetTag:
+		h.virt, h.provider = "hyperv", "azure"
+	case strings.HasPrefix(product, "OpenStack") || vendor == "OpenStack Foundation":
+		h.virt, h.provider = "kvm", "openstack"
+	case strings.Contains(all, "kvm"):
+		h.virt = "kvm"
+	case strings.Contains(all, "qemu"):
+		h.virt = "qemu"
+	case strings.Contains(all, "vmware"):
+		h.virt = "vmware"
+	case strings.Contains(all, "virtualbox"), strings.Contains(all, "innotek"):
+		h.virt = "virtualbox"
+	case strings.Contains(all, "xen"):
+		h.virt = "xen"
+	case strings.Contains(all, "parallels"):
+		h.virt = "parallels"
+	case strings.Contains(all, "bhyve"):
+		h.virt = "bhyve"
+	case vendor == "Microsoft Corporation" && product == "Virtual Machine":
+		h.virt = "hyperv"
+	}
+	if h.virt == "" {
+		if b, err := os.ReadFile("/sys/hypervisor/type"); err == nil && strings.TrimSpace(string(b)) == "xen" {
+			h.virt = "xen" // PV guests have no DMI
+			if b, _ := os.ReadFile("/sys/hypervisor/uuid"); bytes.HasPrefix(b, []byte("ec2")) {
+				h.provider = "aws"
+			}
+		} else if cpuHypervisor() {
+			h.virt = "vm"
+		} else if vendor != "" {
+			h.virt = "none"
+		}
+	}
+	h.container = detectContainer()
+	return h
+}
+
+// cpuHypervisor reports whether cpuid has the hypervisor bit set.
+func cpuHypervisor() bool {
+	f, err := os.Open("/proc/cpuinfo")
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1<<20)
+	for sc.Scan() {
+		if k, v, ok := strings.Cut(sc.Text(), ":"); ok && strings.TrimSpace(k) == "flags" {
+			for _, fl := range strings.Fields(v) {
+				if fl == "hypervisor" {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	return false
+}
+
+func detectContainer() string {
+	if os.Getenv("KUBERNETES_SERVICE_HOST") != "" {
+		return "kubernetes"
+	}
+	// set by lxc, podman, systemd-nspawn and friends for pid 1
+	c := os.Getenv("container")
+	if c == "" {
+		if b, err := os.ReadFile("/run/systemd/container"); err == nil {
+			c = strings.TrimSpace(string(b))
+		}
+	}
+	if c == "" {
+		if b, err := os.ReadFile("/proc/1/environ"); err == nil {
+			for _, kv := range bytes.Split(b, []byte{0}) {
+				if v, ok := bytes.CutPrefix(kv, []byte("container=")); ok {
+					c = string(v)
+				}
+			}
+		}
+	}
+	switch {
+	case c == "lxc", c == "lxc-libvirt":
+		return "lxc"
+	case c == "podman", c == "docker", c == "systemd-nspawn":
+		return c
+	case c != "":
+		return "container"
+	}
+	if exists("/.dockerenv") {
+		return "docker"
+	}
+	if exists("/run/.containerenv") {
+		return "podman"
+	}
+	if exists("/proc/vz") && !exists("/proc/bc") {
+		return "openvz"
+	}
+	if b, _ := os.ReadFile("/proc/sys/kernel/osrelease"); bytes.Contains(bytes.ToLower(b), []byte("microsoft")) {
+		return "wsl"
+	}
+	return ""
+}
+
+func exists(p string) bool {
+	_, err := os.Stat(p)
+	return err == nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package platform
+
+type host struct {
+	virt, container string
+	provider        string
+}
+
+// detectHost has nothing to read without /sys: the hypervisor stays
+// unknown, so cloud_metadata "auto" tries every metadata service.
+func detectHost() host { return host{} }
@@ -0,0 +1,214 @@
+// Package platform works out what the agent runs on: the hypervisor or
+// container runtime, and on a cloud instance the provider's own metadata
+// (instance type, region, zone), so nodes can be labelled without manual
+// tags.
+package platform
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Providers are the cloud_metadata settings naming one provider.
+var Providers = []string{"aws", "gcp", "azure", "openstack"}
+
+// metadataHost is the link-local address all four providers serve on.
+const metadataHost = "http://169.254.169.254"
+
+const timeout = 2 * time.Second
+
+// Info is reported in hello as sys.platform.
+type Info struct {
+	// kvm, qemu, xen, vmware, hyperv, virtualbox, parallels, bhyve,
+	// amazon, vm (some other hypervisor) or none (bare metal); empty
+	// where it can't be told.
+	Virt string `json:"virt,omitempty"`
+	// docker, podman, lxc, systemd-nspawn, openvz, wsl, kubernetes or
+	// container (some other runtime); empty outside one.
+	Container string `json:"container,omitempty"`
+	Cloud     *Cloud `json:"cloud,omitempty"`
+}
+
+// Cloud is what the provider's metadata service says about the instance.
+type Cloud struct {
+	Provider     string `json:"provider"`
+	InstanceID   string `json:"instance_id,omitempty"`
+	InstanceType string `json:"instance_type,omitempty"`
+	Region       string `json:"region,omitempty"`
+	Zone         string `json:"zone,omitempty"`
+	Err          string `json:"err,omitempty"`
+}
+
+// Detect inspects the host and, per cloud (cloud_metadata: "auto", "off"
+// or one of Providers), queries the metadata service. With "auto" only
+// the provider the firmware names is asked; on an unrecognised VM all are
+// tried and a failure isn't reported.
+func Detect(ctx context.Context, cloud string) Info {
+	h := detectHost()
+	info := Info{Virt: h.virt, Container: h.container}
+	switch {
+	case cloud == "off":
+	case cloud != "" && cloud != "auto":
+		info.Cloud = query(ctx, cloud)
+	case h.provider != "":
+		info.Cloud = query(ctx, h.provider)
+	case h.virt != "none":
+		info.Cloud = probeAll(ctx)
+	}
+	return info
+}
+
+func query(ctx context.Context, provider string) *Cloud {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	c, err := fetchers[provider](ctx)
+	c.Provider = provider
+	if err != nil {
+		c.Err = err.Error()
+	}
+	return &c
+}
+
+// probeAll asks every provider at once and keeps the first answer in
+// Providers order; nil if none answered.
+func probeAll(ctx context.Context) *Cloud {
+	res := make([]*Cloud, len(Providers))
+	var wg sync.WaitGroup
+	for i, p := range Providers {
+		wg.Add(1)
+		go func(i int, p string) {
+			defer wg.Done()
+			res[i] = query(ctx, p)
+		}(i, p)
+	}
+	wg.Wait()
+	for _, c := range res {
+		if c.Err == "" {
+			return c
+		}
+	}
+	return nil
+}
+
+var fetchers = map[string]func(context.Context) (Cloud, error){
+	"aws":       fetchAWS,
+	"gcp":       fetchGCP,
+	"azure":     fetchAzure,
+	"openstack": fetchOpenStack,
+}
+
+// fetchAWS reads the instance identity document, with an IMDSv2 session
+// token when the service hands one out.
+func fetchAWS(ctx context.Context) (Cloud, error) {
+	hdr := map[string]string{}
+	if tok, err := fetch(ctx, http.MethodPut, "/latest/api/token",
+		map[string]string{"X-aws-ec2-metadata-token-ttl-seconds": "60"}); err == nil {
+		hdr["X-aws-ec2-metadata-token"] = string(tok)
+	}
+	var doc struct {
+		InstanceID       string `json:"instanceId"`
+		InstanceType     string `json:"instanceType"`
+		Region           string `json:"region"`
+		AvailabilityZone string `json:"availabilityZone"`
+	}
+	if err := fetchJSON(ctx, "/latest/dynamic/instance-identity/document", hdr, &doc); err != nil {
+		return Cloud{}, err
+	}
+	return Cloud{InstanceID: doc.InstanceID, InstanceType: doc.InstanceType,
+		Region: doc.Region, Zone: doc.AvailabilityZone}, nil
+}
+
+func fetchGCP(ctx context.Context) (Cloud, error) {
+	var inst struct {
+		ID          json.Number `json:"id"`
+		MachineType string      `json:"machineType"` // projects/N/machineTypes/e2-small
+		Zone        string      `json:"zone"`        // projects/N/zones/europe-west1-b
+	}
+	if err := fetchJSON(ctx, "/computeMetadata/v1/instance/?recursive=true",
+		map[string]string{"Metadata-Flavor": "Google"}, &inst); err != nil {
+		return Cloud{}, err
+	}
+	c := Cloud{InstanceID: inst.ID.String(), InstanceType: lastPart(inst.MachineType), Zone: lastPart(inst.Zone)}
+	if i := strings.LastIndexByte(c.Zone, '-'); i > 0 {
+		c.Region = c.Zone[:i]
+	}
+	return c, nil
+}
+
+func fetchAzure(ctx context.Context) (Cloud, error) {
+	var comp struct {
+		VMID     string `json:"vmId"`
+		VMSize   string `json:"vmSize"`
+		Location string `json:"location"`
+		Zone     string `json:"zone"`
+	}
+	if err := fetchJSON(ctx, "/metadata/instance/compute?api-version=2021-02-01",
+		map[string]string{"Metadata": "true"}, &comp); err != nil {
+		return Cloud{}, err
+	}
+	return Cloud{InstanceID: comp.VMID, InstanceType: comp.VMSize, Region: comp.Location, Zone: comp.Zone}, nil
+}
+
+// fetchOpenStack reads Nova's metadata; the flavor only comes from its
+// EC2-compatible tree, and regions aren't published at all.
+func fetchOpenStack(ctx context.Context) (Cloud, error) {
+	var md struct {
+		UUID             string `json:"uuid"`
+		AvailabilityZone string `json:"availability_zone"`
+	}
+	if err := fetchJSON(ctx, "/openstack/latest/meta_data.json", nil, &md); err != nil {
+		return Cloud{}, err
+	}
+	c := Cloud{InstanceID: md.UUID, Zone: md.AvailabilityZone}
+	if b, err := fetch(ctx, http.MethodGet, "/latest/meta-data/instance-type", nil); err == nil {
+		c.InstanceType = strings.TrimSpace(string(b))
+	}
+	return c, nil
+}
+
+func lastPart(s string) string {
+	return s[strings.LastIndexByte(s, '/')+1:]
+}
+
+// metadata requests must not go through a proxy
+var client = &http.Client{Transport: &http.Transport{Proxy: nil}}
+
+func fetch(ctx context.Context, method, path string, hdr map[string]string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, metadataHost+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range hdr {
+		req.Header.Set(k, v)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, errors.New("metadata service not reachable")
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", path, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+func fetchJSON(ctx context.Context, path string, hdr map[string]string, v any) error {
+	b, err := fetch(ctx, http.MethodGet, path, hdr)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
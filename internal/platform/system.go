@@ -0,0 +1,58 @@
+package platform
+
+import (
+	"os"
+	"runtime"
+)
+
+// System is the host's identity and size as hello's sys reports it.
+// Comparable, so a change (a rename, an upgrade, a resized VM) is one !=.
+type System struct {
+	Hostname      string
+	Kernel        string
+	Distro        string // PRETTY_NAME from os-release
+	DistroID      string // ID
+	DistroVersion string // VERSION_ID
+	CPUModel      string
+	CPUCores      int // logical CPUs online
+	MemTotalBytes uint64
+}
+
+// ReadSystem reads the current System.
+func ReadSystem() System {
+	s := readSystem()
+	if h, err := os.Hostname(); err == nil && h != "" {
+		s.Hostname = h
+	} else {
+		s.Hostname = "unknown"
+	}
+	if s.CPUCores == 0 {
+		s.CPUCores = runtime.NumCPU()
+	}
+	return s
+}
+
+// Fields are s as hello sys keys, leaving out what is unknown.
+func (s System) Fields() map[string]any {
+	m := map[string]any{
+		"hostname":  s.Hostname,
+		"os":        runtime.GOOS,
+		"arch":      runtime.GOARCH,
+		"cpu_cores": s.CPUCores,
+	}
+	for k, v := range map[string]string{
+		"kernel":         s.Kernel,
+		"distro":         s.Distro,
+		"distro_id":      s.DistroID,
+		"distro_version": s.DistroVersion,
+		"cpu_model":      s.CPUModel,
+	} {
+		if v != "" {
+			m[k] = v
+		}
+	}
+	if s.MemTotalBytes > 0 {
+		m["mem_total_bytes"] = s.MemTotalBytes
+	}
+	return m
+}
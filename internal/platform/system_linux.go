@@ -0,0 +1,121 @@
+package platform
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+)
+
+func readSystem() System {
+	var s System
+	if b, err := os.ReadFile("/proc/sys/kernel/osrelease"); err == nil {
+		s.Kernel = strings.TrimSpace(string(b))
+	}
+	for _, p := range []string{"/etc/os-release", "/usr/lib/os-release"} {
+		if rel, err := readOSRelease(p); err == nil {
+			s.Distro, s.DistroID, s.DistroVersion = rel["PRETTY_NAME"], rel["ID"], rel["VERSION_ID"]
+			if s.Distro == "" {
+				s.Distro = strings.TrimSpace(rel["NAME"] + " " + rel["VERSION"])
+			}
+			break
+		}
+	}
+	s.CPUModel = cpuModel()
+	if b, err := os.ReadFile("/sys/devices/system/cpu/online"); err == nil {
+		s.CPUCores = countCPUList(strings.TrimSpace(string(b)))
+	}
+	s.MemTotalBytes = memTotal()
+	return s
+}
+
+// readOSRelease parses os-release(5): KEY=value lines, values optionally
+// quoted.
+func readOSRelease(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rel := map[string]string{}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		k, v, ok := strings.Cut(strings.TrimSpace(sc.Text()), "=")
+		if !ok || strings.HasPrefix(k, "#") {
+			continue
+		}
+		if uq, err := strconv.Unquote(v); err == nil {
+			v = uq
+		} else {
+			v = strings.Trim(v, `"'`)
+		}
+		rel[k] = v
+	}
+	return rel, sc.Err()
+}
+
+// cpuModel is the first CPU's model name; ARM boards name the SoC or the
+// board instead.
+func cpuModel() string {
+	f, err := os.Open("/proc/cpuinfo")
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	var hw string
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1<<20)
+	for sc.Scan() {
+		k, v, ok := strings.Cut(sc.Text(), ":")
+		if !ok {
+			continue
+		}
+		switch k, v = strings.TrimSpace(k), strings.TrimSpace(v); k {
+		case "model name", "cpu model":
+			return v
+		case "Hardware", "Model":
+			hw = v
+		}
+	}
+	if hw == "" {
+		b, _ := os.ReadFile("/sys/firmware/devicetree/base/model")
+		hw = strings.TrimSpace(strings.TrimRight(string(b), "\x00"))
+	}
+	return hw
+}
+
+// countCPUList counts the CPUs in a list such as "0-3,8-11,16".
+func countCPUList(s string) int {
+	n := 0
+	for _, part := range strings.Split(s, ",") {
+		lo, hi, isRange := strings.Cut(part, "-")
+		a, err := strconv.Atoi(lo)
+		if err != nil {
+			continue
+		}
+		b := a
+		if isRange {
+			if b, err = strconv.Atoi(hi); err != nil || b < a {
+				continue
+			}
+		}
+		n += b - a + 1
+	}
+	return n
+}
+
+func memTotal() uint64 {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if v, ok := strings.CutPrefix(sc.Text(), "MemTotal:"); ok {
+			kb, _ := strconv.ParseUint(strings.TrimSuffix(strings.TrimSpace(v), " kB"), 10, 64)
+			return kb * 1024
+		}
+	}
+	return 0
+}
@@ -0,0 +1,7 @@
+//go:build !linux
+
+package platform
+
+// readSystem has only the hostname and CPU count (filled in by
+// ReadSystem) without /proc and os-release.
+func readSystem() System { return System{} }
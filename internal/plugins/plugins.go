@@ -0,0 +1,314 @@
+// Package plugins runs third-party collectors: binaries the agent starts
+// as sidecars and asks for data over the length-prefixed JSON protocol of
+// pkg/agentplugin.
+package plugins
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/Vincentkeio/agent/internal/version"
+	"github.com/Vincentkeio/agent/pkg/agentplugin"
+)
+
+const (
+	DefaultIntervalSec = 60
+	DefaultTimeoutSec  = 10
+	// closeGrace is how long Close waits for a plugin to exit on its own
+	// once its stdin is closed.
+	closeGrace = 2 * time.Second
+	// maxBackoff bounds the wait before restarting a plugin that failed.
+	maxBackoff = 5 * time.Minute
+)
+
+// Collector produces one JSON object per Collect.
+type Collector interface {
+	Name() string
+	Collect(ctx context.Context) (json.RawMessage, error)
+	Close() error
+}
+
+// Plugin is one configured plugin.
+type Plugin struct {
+	Name        string   `json:"name"`
+	Command     []string `json:"command"` // absolute path of the binary, then its arguments
+	IntervalSec int      `json:"interval_sec,omitempty"`
+	TimeoutSec  int      `json:"timeout_sec,omitempty"` // per collect, and for the hello
+}
+
+var namePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+// Check validates a single plugin.
+func (p Plugin) Check() error {
+	if !namePattern.MatchString(p.Name) {
+		return fmt.Errorf("name %q: want 1-32 of a-z, 0-9, _ and -", p.Name)
+	}
+	if len(p.Command) == 0 || !filepath.IsAbs(p.Command[0]) {
+		return errors.New("command: want an absolute path to the plugin binary")
+	}
+	if p.IntervalSec != 0 && p.IntervalSec < 10 {
+		return fmt.Errorf("interval_sec %d: want at least 10", p.IntervalSec)
+	}
+	if p.TimeoutSec < 0 || p.TimeoutSec > 300 {
+		return fmt.Errorf("timeout_sec %d: want 0-300", p.TimeoutSec)
+	}
+	return nil
+}
+
+// CheckList validates plugins and that their names are unique.
+func CheckList(list []Plugin) error {
+	seen := map[string]bool{}
+	for i, p := range list {
+		if err := p.Check(); err != nil {
+			return fmt.Errorf("[%d]: %v", i, err)
+		}
+		if seen[p.Name] {
+			return fmt.Errorf("[%d]: duplicate name %q", i, p.Name)
+		}
+		seen[p.Name] = true
+	}
+	return nil
+}
+
+// Interval is IntervalSec or its default.
+func (p Plugin) Interval() time.Duration {
+	if p.IntervalSec > 0 {
+		return time.Duration(p.IntervalSec) * time.Second
+	}
+	return DefaultIntervalSec * time.Second
+}
+
+func (p Plugin) timeout() time.Duration {
+	if p.TimeoutSec > 0 {
+		return time.Duration(p.TimeoutSec) * time.Second
+	}
+	return DefaultTimeoutSec * time.Second
+}
+
+// Sidecar is a Collector backed by a plugin process. The process is
+// started by the first Collect and kept running; one that exits, times out
+// or breaks the protocol is killed and started again by a later Collect,
+// after a backoff that doubles with every failure in a row.
+type Sidecar struct {
+	p Plugin
+
+	mu       sync.Mutex // one Collect at a time
+	proc     *process
+	nextID   uint64
+	version  string
+	failures int
+	retryAt  time.Time
+}
+
+// process is one run of the plugin binary.
+type process struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	frames chan agentplugin.Message
+	stop   chan struct{} // closed by kill
+	done   chan struct{} // closed once stdout ends and the process is reaped
+}
+
+// NewSidecar returns the Sidecar for p; nothing is started yet.
+func NewSidecar(p Plugin) *Sidecar {
+	return &Sidecar{p: p}
+}
+
+func (s *Sidecar) Name() string { return s.p.Name }
+
+// Plugin is the configuration s runs.
+func (s *Sidecar) Plugin() Plugin { return s.p }
+
+// Version is what the plugin announced in its hello.
+func (s *Sidecar) Version() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.version
+}
+
+// Collect asks the plugin for one result, starting it if needed.
+func (s *Sidecar) Collect(ctx context.Context) (json.RawMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ctx, cancel := context.WithTimeout(ctx, s.p.timeout())
+	defer cancel()
+	if s.proc == nil {
+		if wait := time.Until(s.retryAt); wait > 0 {
+			return nil, fmt.Errorf("restarting in %s", wait.Round(time.Second))
+		}
+		if err := s.start(ctx); err != nil {
+			s.fail()
+			return nil, err
+		}
+	}
+	s.nextID++
+	m, err := s.roundTrip(ctx, agentplugin.Message{Type: agentplugin.TypeCollect, ID: s.nextID})
+	if err != nil {
+		s.fail()
+		return nil, err
+	}
+	s.failures = 0
+	if m.Err != "" {
+		return nil, errors.New(m.Err)
+	}
+	if len(m.Data) == 0 || m.Data[0] != '{' {
+		return nil, errors.New("result data is not a JSON object")
+	}
+	return m.Data, nil
+}
+
+// Close stops the plugin process, if any.
+func (s *Sidecar) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.proc == nil {
+		return nil
+	}
+	p := s.proc
+	s.proc = nil
+	_ = p.stdin.Close()
+	select {
+	case <-p.done:
+	case <-time.After(closeGrace):
+	}
+	p.kill()
+	return nil
+}
+
+// start runs the binary and exchanges hellos.
+func (s *Sidecar) start(ctx context.Context) error {
+	cmd := exec.Command(s.p.Command[0], s.p.Command[1:]...)
+	cmd.Env = append(os.Environ(), "KOKORO_PLUGIN="+s.p.Name)
+	cmd.Stderr = &logWriter{plugin: s.p.Name}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	p := &process{cmd: cmd, stdin: stdin, frames: make(chan agentplugin.Message), stop: make(chan struct{}), done: make(chan struct{})}
+	go p.read(s.p.Name, stdout)
+	s.proc = p
+
+	m, err := s.roundTrip(ctx, agentplugin.Message{Type: agentplugin.TypeHello, Proto: agentplugin.Proto, AgentVersion: version.Version})
+	if err != nil {
+		return fmt.Errorf("hello: %w", err)
+	}
+	if m.Name != "" && m.Name != s.p.Name {
+		slog.Info("plugin announces another name", "plugin", s.p.Name, "name", m.Name)
+	}
+	s.version = m.Version
+	slog.Info("plugin started", "plugin", s.p.Name, "version", m.Version, "pid", cmd.Process.Pid)
+	return nil
+}
+
+// roundTrip sends req and waits for the reply: a hello for a hello, the
+// result with the same id for a collect.
+func (s *Sidecar) roundTrip(ctx context.Context, req agentplugin.Message) (agentplugin.Message, error) {
+	p := s.proc
+	if err := agentplugin.WriteFrame(p.stdin, req); err != nil {
+		return agentplugin.Message{}, fmt.Errorf("write: %w", err)
+	}
+	for {
+		select {
+		case <-p.done:
+			return agentplugin.Message{}, fmt.Errorf("plugin exited: %s", p.cmd.ProcessState)
+		case m := <-p.frames:
+			if req.Type == agentplugin.TypeHello && m.Type == agentplugin.TypeHello ||
+				req.Type == agentplugin.TypeCollect && m.Type == agentplugin.TypeResult && m.ID == req.ID {
+				return m, nil
+			}
+			// a late answer to a request that timed out, or something newer
+		case <-ctx.Done():
+			return agentplugin.Message{}, errors.New("timeout")
+		}
+	}
+}
+
+// fail kills the process and schedules the restart.
+func (s *Sidecar) fail() {
+	if s.proc != nil {
+		s.proc.kill()
+		s.proc = nil
+	}
+	s.failures++
+	s.retryAt = time.Now().Add(min(time.Second<<min(s.failures, 16), maxBackoff))
+}
+
+// read passes frames from stdout on until it ends, then reaps the process.
+func (p *process) read(name string, stdout io.Reader) {
+	defer close(p.done)
+	br := bufio.NewReader(stdout)
+	for {
+		var m agentplugin.Message
+		if err := agentplugin.ReadFrame(br, &m); err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, os.ErrClosed) {
+				slog.Warn("plugin output unreadable", "plugin", name, "err", err)
+				_ = p.cmd.Process.Kill()
+			}
+			break
+		}
+		select {
+		case p.frames <- m:
+		case <-p.stop:
+			// nobody listens anymore; keep reading so the process
+			// doesn't block on a full pipe until it dies
+		}
+	}
+	_ = p.cmd.Wait()
+}
+
+func (p *process) kill() {
+	select {
+	case <-p.stop:
+	default:
+		close(p.stop)
+	}
+	_ = p.stdin.Close()
+	_ = p.cmd.Process.Kill()
+}
+
+// logWriter logs a plugin's stderr line by line.
+type logWriter struct {
+	plugin string
+	mu     sync.Mutex
+	buf    []byte
+}
+
+func (w *logWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = append(w.buf, b...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		if line := bytes.TrimSpace(w.buf[:i]); len(line) > 0 {
+			slog.Info("plugin stderr", "plugin", w.plugin, "line", string(line))
+		}
+		w.buf = w.buf[i+1:]
+	}
+	if len(w.buf) > 4096 {
+		slog.Info("plugin stderr", "plugin", w.plugin, "line", string(w.buf[:4096]))
+		w.buf = w.buf[:0]
+	}
+	return len(b), nil
+}
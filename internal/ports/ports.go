@@ -0,0 +1,58 @@
+// Package ports lists the host's listening sockets and diffs inventories,
+// so a new or vanished service shows up without scanning from outside.
+package ports
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Listener is one listening TCP socket or bound UDP socket.
+type Listener struct {
+	Proto   string `json:"proto"` // tcp, tcp6, udp, udp6
+	Addr    string `json:"addr"`
+	Port    int    `json:"port"`
+	PID     int    `json:"pid,omitempty"`
+	Process string `json:"process,omitempty"` // comm of the owning process
+}
+
+// Key identifies a listener across inventories; a service restarting
+// under a new pid is not a change.
+func (l Listener) Key() string {
+	return fmt.Sprintf("%s/%s:%d/%s", l.Proto, l.Addr, l.Port, l.Process)
+}
+
+// Diff returns the listeners in cur that are not in prev (opened) and those
+// in prev that are gone from cur (closed).
+func Diff(prev, cur []Listener) (opened, closed []Listener) {
+	had := make(map[string]bool, len(prev))
+	for _, l := range prev {
+		had[l.Key()] = true
+	}
+	has := make(map[string]bool, len(cur))
+	for _, l := range cur {
+		has[l.Key()] = true
+		if !had[l.Key()] {
+			opened = append(opened, l)
+		}
+	}
+	for _, l := range prev {
+		if !has[l.Key()] {
+			closed = append(closed, l)
+		}
+	}
+	return opened, closed
+}
+
+func sortListeners(ls []Listener) {
+	sort.Slice(ls, func(i, j int) bool {
+		a, b := ls[i], ls[j]
+		if a.Proto != b.Proto {
+			return a.Proto < b.Proto
+		}
+		if a.Port != b.Port {
+			return a.Port < b.Port
+		}
+		return a.Addr < b.Addr
+	})
+}
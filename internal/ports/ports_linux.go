@@ -0,0 +1,152 @@
+package ports
+
+import (
+	"bufio"
+	"encoding/hex"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	tcpListen = "0A"
+	udpClose  = "07" // TCP_CLOSE: how an unconnected UDP socket shows up
+)
+
+// List reads /proc/net/{tcp,tcp6,udp,udp6} and resolves socket owners
+// through /proc/<pid>/fd (processes of other users need root). Unconnected
+// UDP sockets on ephemeral ports (ip_local_port_range) are client sockets
+// and skipped.
+func List() ([]Listener, error) {
+	lo, hi := ephemeralRange()
+	var out []Listener
+	inodes := map[string][]int{} // inode -> indexes into out
+	found := false
+	for _, proto := range []string{"tcp", "tcp6", "udp", "udp6"} {
+		f, err := os.Open("/proc/net/" + proto)
+		if err != nil {
+			continue
+		}
+		found = true
+		sc := bufio.NewScanner(f)
+		sc.Scan() // header
+		for sc.Scan() {
+			// sl local_address rem_address st tx:rx tr:when retrnsmt uid timeout inode
+			p := strings.Fields(sc.Text())
+			if len(p) < 10 {
+				continue
+			}
+			udp := proto[0] == 'u'
+			if (!udp && p[3] != tcpListen) || (udp && (p[3] != udpClose || !zeroAddr(p[2]))) {
+				continue
+			}
+			ip, port, ok := parseAddr(p[1])
+			if !ok {
+				continue
+			}
+			if udp && port >= lo && port <= hi {
+				continue
+			}
+			out = append(out, Listener{Proto: proto, Addr: ip, Port: port})
+			if p[9] != "0" {
+				inodes[p[9]] = append(inodes[p[9]], len(out)-1)
+			}
+		}
+		f.Close()
+	}
+	if !found {
+		return nil, os.ErrNotExist
+	}
+	resolveOwners(out, inodes)
+	out = dedup(out)
+	sortListeners(out)
+	return out, nil
+}
+
+// dedup folds SO_REUSEPORT groups (several sockets, same proto/addr/port).
+func dedup(ls []Listener) []Listener {
+	seen := make(map[string]bool, len(ls))
+	out := ls[:0]
+	for _, l := range ls {
+		k := l.Key()
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		out = append(out, l)
+	}
+	return out
+}
+
+// resolveOwners fills PID/Process by matching socket inodes against the
+// fd links of every process.
+func resolveOwners(out []Listener, inodes map[string][]int) {
+	if len(inodes) == 0 {
+		return
+	}
+	procs, _ := filepath.Glob("/proc/[0-9]*")
+	for _, dir := range procs {
+		fds, err := os.ReadDir(filepath.Join(dir, "fd"))
+		if err != nil {
+			continue
+		}
+		pid, _ := strconv.Atoi(filepath.Base(dir))
+		comm := ""
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(dir, "fd", fd.Name()))
+			if err != nil || !strings.HasPrefix(link, "socket:[") {
+				continue
+			}
+			idx, ok := inodes[strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]")]
+			if !ok {
+				continue
+			}
+			if comm == "" {
+				b, _ := os.ReadFile(filepath.Join(dir, "comm"))
+				comm = strings.TrimSpace(string(b))
+			}
+			for _, i := range idx {
+				if out[i].PID == 0 {
+					out[i].PID, out[i].Process = pid, comm
+				}
+			}
+		}
+	}
+}
+
+// parseAddr decodes "0100007F:0035" (IPv4) or the 32-hex-digit IPv6 form;
+// the address is printed as 32-bit words in host (little-endian) order.
+func parseAddr(s string) (string, int, bool) {
+	i := strings.IndexByte(s, ':')
+	if i < 0 {
+		return "", 0, false
+	}
+	b, err := hex.DecodeString(s[:i])
+	if err != nil || (len(b) != 4 && len(b) != 16) {
+		return "", 0, false
+	}
+	for w := 0; w < len(b); w += 4 {
+		b[w], b[w+1], b[w+2], b[w+3] = b[w+3], b[w+2], b[w+1], b[w]
+	}
+	port, err := strconv.ParseUint(s[i+1:], 16, 16)
+	if err != nil {
+		return "", 0, false
+	}
+	return net.IP(b).String(), int(port), true
+}
+
+func zeroAddr(s string) bool {
+	return strings.Trim(strings.Replace(s, ":", "", 1), "0") == ""
+}
+
+func ephemeralRange() (int, int) {
+	b, err := os.ReadFile("/proc/sys/net/ipv4/ip_local_port_range")
+	if f := strings.Fields(string(b)); err == nil && len(f) == 2 {
+		lo, _ := strconv.Atoi(f[0])
+		hi, _ := strconv.Atoi(f[1])
+		return lo, hi
+	}
+	return 32768, 60999
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package ports
+
+import "errors"
+
+// List needs /proc/net.
+func List() ([]Listener, error) {
+	return nil, errors.New("listening port inventory not supported on this platform")
+}
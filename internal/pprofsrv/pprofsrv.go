@@ -0,0 +1,50 @@
+package pprofsrv
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"time"
+)
+
+// DefaultAddr is used when debug_pprof_addr is empty.
+const DefaultAddr = "127.0.0.1:6060"
+
+// Start serves net/http/pprof on addr in the background. Only loopback
+// addresses are accepted: profiles expose memory contents and must never be
+// reachable from the network (use an SSH tunnel to fetch them).
+func Start(addr string) error {
+	if addr == "" {
+		addr = DefaultAddr
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("debug_pprof_addr %q: %w", addr, err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("debug_pprof_addr %q: must be a loopback address", addr)
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			slog.Error("pprof server stopped", "err", err)
+		}
+	}()
+	slog.Info("pprof listening", "addr", ln.Addr().String())
+	return nil
+}
@@ -0,0 +1,110 @@
+package preflight
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+)
+
+// Result is the outcome of one capability's prerequisite check.
+type Result struct {
+	Cap    string `json:"cap"`
+	OK     bool   `json:"ok"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Options carries the bits of config the checks depend on.
+type Options struct {
+	StateDir       string
+	TCPPingWorkers int
+}
+
+// Run checks every built-in capability once. Failures don't stop the agent;
+// they are reported in hello so the master can show a degraded node.
+func Run(opt Options) []Result {
+	return []Result{
+		checkMetrics(),
+		checkTCPPing(opt.TCPPingWorkers),
+		checkState(opt.StateDir),
+	}
+}
+
+// Degraded returns cap -> reason for failed checks (nil when all passed).
+func Degraded(rs []Result) map[string]string {
+	var out map[string]string
+	for _, r := range rs {
+		if r.OK {
+			continue
+		}
+		if out == nil {
+			out = map[string]string{}
+		}
+		out[r.Cap] = r.Reason
+	}
+	return out
+}
+
+func checkMetrics() Result {
+	r := Result{Cap: "metrics", OK: true}
+	if runtime.GOOS != "linux" {
+		r.OK = false
+		r.Reason = "stub collector on " + runtime.GOOS + " (disk + runtime stats only)"
+		return r
+	}
+	for _, p := range []string{"/proc/stat", "/proc/meminfo", "/proc/net/dev"} {
+		f, err := os.Open(p)
+		if err != nil {
+			r.OK = false
+			r.Reason = fmt.Sprintf("cannot read %s: %v", p, err)
+			return r
+		}
+		_ = f.Close()
+	}
+	return r
+}
+
+func checkTCPPing(workers int) Result {
+	r := Result{Cap: "tcpping", OK: true}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		r.OK = false
+		r.Reason = fmt.Sprintf("cannot open sockets: %v", err)
+		return r
+	}
+	_ = pc.Close()
+
+	// each in-flight probe holds one fd; leave room for the rest of the agent
+	if workers <= 0 {
+		workers = 16
+	}
+	if lim := fdLimit(); lim > 0 && lim < uint64(workers)+32 {
+		r.OK = false
+		r.Reason = fmt.Sprintf("RLIMIT_NOFILE=%d too low for %d workers", lim, workers)
+	}
+	return r
+}
+
+func checkState(dir string) Result {
+	r := Result{Cap: "state", OK: true}
+	if dir == "" {
+		r.OK = false
+		r.Reason = "state_dir not set"
+		return r
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		r.OK = false
+		r.Reason = fmt.Sprintf("cannot create %s: %v", dir, err)
+		return r
+	}
+	f, err := os.CreateTemp(dir, ".preflight-*")
+	if err != nil {
+		r.OK = false
+		r.Reason = fmt.Sprintf("%s not writable: %v", dir, err)
+		return r
+	}
+	name := f.Name()
+	_ = f.Close()
+	_ = os.Remove(name)
+	return r
+}
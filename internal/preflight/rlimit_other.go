@@ -0,0 +1,5 @@
+//go:build !unix
+
+package preflight
+
+func fdLimit() uint64 { return 0 }
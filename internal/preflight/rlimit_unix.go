@@ -0,0 +1,13 @@
+//go:build unix
+
+package preflight
+
+import "syscall"
+
+func fdLimit() uint64 {
+	var lim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &lim); err != nil {
+		return 0
+	}
+	return uint64(lim.Cur)
+}
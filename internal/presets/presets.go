@@ -0,0 +1,118 @@
+// Package presets is a versioned catalog of common measurement targets
+// (public DNS, CDN edges, carrier landmarks) that config and config_push can
+// refer to by name instead of listing targets. A copy ships in the binary;
+// the master can send a newer catalog, which is kept in state_dir.
+package presets
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/Vincentkeio/agent/internal/tcpping"
+	"github.com/Vincentkeio/agent/internal/util"
+)
+
+//go:embed presets.json
+var builtinJSON []byte
+
+// FileName is the updated catalog inside state_dir.
+const FileName = "presets.json"
+
+type Preset struct {
+	Description string           `json:"description,omitempty"`
+	Targets     []tcpping.Target `json:"targets"`
+}
+
+type Catalog struct {
+	Version int               `json:"version"`
+	Presets map[string]Preset `json:"presets"`
+}
+
+// Builtin returns the catalog compiled into the binary.
+func Builtin() *Catalog {
+	c, err := Parse(builtinJSON)
+	if err != nil {
+		panic("presets: bad embedded catalog: " + err.Error())
+	}
+	return c
+}
+
+// Parse decodes and checks a catalog.
+func Parse(b []byte) (*Catalog, error) {
+	var c Catalog
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, err
+	}
+	if c.Version <= 0 {
+		return nil, errors.New("presets: missing version")
+	}
+	for name, p := range c.Presets {
+		for i, t := range p.Targets {
+			if t.Host == "" || t.Port <= 0 || t.Port > 65535 {
+				return nil, fmt.Errorf("presets: %s target %d: host and port are required", name, i)
+			}
+		}
+	}
+	return &c, nil
+}
+
+// Load returns the catalog stored in dir when it is newer than the built-in
+// one, otherwise the built-in catalog.
+func Load(dir string) *Catalog {
+	c := Builtin()
+	b, err := os.ReadFile(filepath.Join(dir, FileName))
+	if err != nil {
+		return c
+	}
+	if st, err := Parse(b); err == nil && st.Version > c.Version {
+		return st
+	}
+	return c
+}
+
+// Save persists c in dir for the next start.
+func Save(dir string, c *Catalog) error {
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return util.WriteFileAtomic(filepath.Join(dir, FileName), b, 0644)
+}
+
+// Names lists the presets in c.
+func (c *Catalog) Names() []string {
+	out := make([]string, 0, len(c.Presets))
+	for n := range c.Presets {
+		out = append(out, n)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Expand returns the targets of the named presets. Target IDs are prefixed
+// with "preset:<name>:" so results can be told apart from pushed targets.
+// Unknown names are returned in missing.
+func (c *Catalog) Expand(names []string) (targets []tcpping.Target, missing []string) {
+	seen := map[string]bool{}
+	for _, n := range names {
+		if seen[n] {
+			continue
+		}
+		seen[n] = true
+		p, ok := c.Presets[n]
+		if !ok {
+			missing = append(missing, n)
+			continue
+		}
+		for _, t := range p.Targets {
+			t.ID = "preset:" + n + ":" + t.ID
+			targets = append(targets, t)
+		}
+	}
+	return targets, missing
+}
@@ -0,0 +1,69 @@
+package privdrop
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	prSetKeepcaps = 8          // linux/prctl.h
+	capVersion3   = 0x20080522 // _LINUX_CAPABILITY_VERSION_3
+)
+
+type capHeader struct {
+	version uint32
+	pid     int32
+}
+
+type capData struct {
+	effective, permitted, inheritable uint32
+}
+
+// Drop switches every thread to uid/gid, with gid as the only group, and
+// keeps the capabilities in keep (effective and permitted; none are
+// inherited by child processes). Keeping any needs a build without cgo,
+// which can't change all threads' capabilities. Once Drop returns nil the
+// process can't get root back.
+func Drop(uid, gid int, keep []Cap) error {
+	if os.Geteuid() != 0 {
+		return ErrNotRoot
+	}
+	if len(keep) > 0 {
+		if _, _, e := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, prSetKeepcaps, 1, 0); e != 0 {
+			if e == syscall.ENOTSUP {
+				return errors.New("keeping capabilities needs a build without cgo")
+			}
+			return fmt.Errorf("prctl(PR_SET_KEEPCAPS): %w", e)
+		}
+	}
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return fmt.Errorf("setgroups: %w", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("setgid %d: %w", gid, err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("setuid %d: %w", uid, err)
+	}
+	if len(keep) > 0 {
+		// after setuid the kept capabilities are only permitted; narrow
+		// them down and make them effective
+		hdr := &capHeader{version: capVersion3}
+		data := new([2]capData)
+		for _, c := range keep {
+			data[c/32].effective |= 1 << (c % 32)
+			data[c/32].permitted |= 1 << (c % 32)
+		}
+		if _, _, e := syscall.AllThreadsSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(hdr)), uintptr(unsafe.Pointer(data)), 0); e != 0 {
+			return fmt.Errorf("capset: %w", e)
+		}
+		_, _, _ = syscall.AllThreadsSyscall(syscall.SYS_PRCTL, prSetKeepcaps, 0, 0)
+	}
+	if syscall.Setuid(0) == nil {
+		return errors.New("root could be regained after dropping it")
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package privdrop
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// TestDrop runs Drop in a child process: the test binary can't get root
+// back once it is gone.
+func TestDrop(t *testing.T) {
+	if os.Getenv("PRIVDROP_CHILD") != "" {
+		dropChild()
+		return
+	}
+	if os.Geteuid() != 0 {
+		if err := Drop(65534, 65534, nil); !errors.Is(err, ErrNotRoot) {
+			t.Errorf("got %v, want ErrNotRoot", err)
+		}
+		return
+	}
+	tests := []struct {
+		name, keep string
+		want       string
+	}{
+		{"no capabilities", "", "uid=65534 gid=65534 groups=[65534] caps=0"},
+		{"keep net_raw", "13", "uid=65534 gid=65534 groups=[65534] caps=2000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := exec.Command(os.Args[0], "-test.run=^TestDrop$")
+			cmd.Env = append(os.Environ(), "PRIVDROP_CHILD=1", "PRIVDROP_KEEP="+tt.keep)
+			out, err := cmd.CombinedOutput()
+			got := strings.TrimSpace(string(out))
+			if err != nil {
+				if strings.Contains(got, "without cgo") {
+					t.Skip(got)
+				}
+				t.Fatalf("%v: %s", err, got)
+			}
+			if !strings.Contains(got, tt.want) {
+				t.Errorf("child reported %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func dropChild() {
+	var keep []Cap
+	if k := os.Getenv("PRIVDROP_KEEP"); k != "" {
+		n, _ := strconv.Atoi(k)
+		keep = append(keep, Cap(n))
+	}
+	if err := Drop(65534, 65534, keep); err != nil {
+		fmt.Println("drop:", err)
+		os.Exit(1)
+	}
+	groups, _ := syscall.Getgroups()
+	fmt.Printf("uid=%d gid=%d groups=%v caps=%s\n", os.Getuid(), os.Getgid(), groups, capEff())
+	os.Exit(0)
+}
+
+// capEff is the effective capability mask from /proc/self/status, in hex
+// without leading zeros.
+func capEff() string {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return err.Error()
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if v, ok := strings.CutPrefix(sc.Text(), "CapEff:"); ok {
+			n, _ := strconv.ParseUint(strings.TrimSpace(v), 16, 64)
+			return strconv.FormatUint(n, 16)
+		}
+	}
+	return "?"
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package privdrop
+
+import "errors"
+
+// Drop is Linux only.
+func Drop(uid, gid int, keep []Cap) error {
+	return errors.New("run_as_user is only supported on linux")
+}
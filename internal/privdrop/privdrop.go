@@ -0,0 +1,71 @@
+// Package privdrop switches a process started as root to an unprivileged
+// user, keeping only the capabilities it still needs (raw sockets for
+// packet capture, fwmark, low ports).
+package privdrop
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+)
+
+// Cap is a Linux capability number (linux/capability.h).
+type Cap int
+
+const (
+	CapNetBindService Cap = 10
+	CapNetAdmin       Cap = 12
+	CapNetRaw         Cap = 13
+)
+
+func (c Cap) String() string {
+	switch c {
+	case CapNetBindService:
+		return "CAP_NET_BIND_SERVICE"
+	case CapNetAdmin:
+		return "CAP_NET_ADMIN"
+	case CapNetRaw:
+		return "CAP_NET_RAW"
+	}
+	return "cap(" + strconv.Itoa(int(c)) + ")"
+}
+
+// ErrNotRoot is returned by Drop when there is no root to drop.
+var ErrNotRoot = errors.New("not running as root")
+
+// Lookup resolves a user name or numeric uid to its uid and primary gid.
+func Lookup(name string) (uid, gid int, err error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		if _, nerr := strconv.Atoi(name); nerr != nil {
+			return 0, 0, err
+		}
+		if u, err = user.LookupId(name); err != nil {
+			return 0, 0, err
+		}
+	}
+	if uid, err = strconv.Atoi(u.Uid); err != nil {
+		return 0, 0, err
+	}
+	if gid, err = strconv.Atoi(u.Gid); err != nil {
+		return 0, 0, err
+	}
+	return uid, gid, nil
+}
+
+// Chown hands dir and everything in it to uid/gid, creating dir if
+// needed. Symlinks are changed themselves, not followed.
+func Chown(dir string, uid, gid int) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	return filepath.WalkDir(dir, func(path string, _ fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(path, uid, gid)
+	})
+}
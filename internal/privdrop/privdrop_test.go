@@ -0,0 +1,103 @@
+//go:build unix
+
+package privdrop
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestCapString(t *testing.T) {
+	tests := []struct {
+		c    Cap
+		want string
+	}{
+		{CapNetBindService, "CAP_NET_BIND_SERVICE"},
+		{CapNetAdmin, "CAP_NET_ADMIN"},
+		{CapNetRaw, "CAP_NET_RAW"},
+		{21, "cap(21)"},
+	}
+	for _, tt := range tests {
+		if got := tt.c.String(); got != tt.want {
+			t.Errorf("Cap(%d) = %s, want %s", int(tt.c), got, tt.want)
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	tests := []struct {
+		name     string
+		uid, gid int
+		ok       bool
+	}{
+		{"root", 0, 0, true},
+		{"0", 0, 0, true},
+		{"no-such-user-kokoro", 0, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			uid, gid, err := Lookup(tt.name)
+			if !tt.ok {
+				if err == nil {
+					t.Errorf("got uid %d", uid)
+				}
+				return
+			}
+			if err != nil {
+				t.Skip(err) // no passwd entry for root in some containers
+			}
+			if uid != tt.uid || gid != tt.gid {
+				t.Errorf("got %d:%d, want %d:%d", uid, gid, tt.uid, tt.gid)
+			}
+		})
+	}
+}
+
+func TestChown(t *testing.T) {
+	base := t.TempDir()
+	outside := filepath.Join(base, "outside")
+	if err := os.WriteFile(outside, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(base, "state", "new") // created by Chown
+	if err := os.MkdirAll(filepath.Join(dir, "sub"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{"a.json", "sub/b.json"} {
+		if err := os.WriteFile(filepath.Join(dir, f), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(outside, filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	uid, gid := os.Getuid(), os.Getgid()
+	if uid == 0 {
+		uid, gid = 65534, 65534
+	}
+	if err := Chown(dir, uid, gid); err != nil {
+		t.Fatal(err)
+	}
+	owner := func(p string) (int, int) {
+		var st syscall.Stat_t
+		if err := syscall.Lstat(p, &st); err != nil {
+			t.Fatal(err)
+		}
+		return int(st.Uid), int(st.Gid)
+	}
+	for _, f := range []string{"", "a.json", "sub", "sub/b.json", "link"} {
+		if u, g := owner(filepath.Join(dir, f)); u != uid || g != gid {
+			t.Errorf("%s owned by %d:%d, want %d:%d", f, u, g, uid, gid)
+		}
+	}
+	if u, _ := owner(outside); os.Getuid() == 0 && u != 0 {
+		t.Errorf("symlink target changed to uid %d", u)
+	}
+
+	if err := Chown(filepath.Join(outside, "x"), uid, gid); err == nil {
+		t.Error("Chown under a file succeeded")
+	}
+}
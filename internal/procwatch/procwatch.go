@@ -0,0 +1,282 @@
+// Package procwatch checks that critical processes are running, by name or
+// pidfile, counts their restarts and decides when to run a restart command:
+// a small monit inside the agent.
+package procwatch
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Watch is one process to keep an eye on:
+//
+//	{"name":"nginx"}
+//	{"name":"db","pidfile":"/run/postgresql/14-main.pid"}
+//	{"name":"web","process":"gunicorn","restart":["systemctl","restart","web"]}
+//
+// Process matches a process's comm or the base name of its argv[0] and
+// defaults to Name; a Pidfile is checked instead when set. Restart runs
+// once the process has been down for RestartAfter checks in a row.
+type Watch struct {
+	Name         string   `json:"name"`
+	Process      string   `json:"process,omitempty"`
+	Pidfile      string   `json:"pidfile,omitempty"`
+	Restart      []string `json:"restart,omitempty"`
+	RestartAfter int      `json:"restart_after,omitempty"` // default 2
+}
+
+// MaxWatches bounds a watch list.
+const MaxWatches = 64
+
+// Check validates a single watch.
+func (w Watch) Check() error {
+	if w.Name == "" || len(w.Name) > 64 {
+		return errors.New("watch needs a name of up to 64 characters")
+	}
+	if w.Process != "" && w.Pidfile != "" {
+		return fmt.Errorf("watch %s: process and pidfile are exclusive", w.Name)
+	}
+	if strings.ContainsRune(w.Process, '/') {
+		return fmt.Errorf("watch %s: process %q: want a name, not a path", w.Name, w.Process)
+	}
+	if w.Pidfile != "" && !strings.HasPrefix(w.Pidfile, "/") {
+		return fmt.Errorf("watch %s: pidfile %q: want an absolute path", w.Name, w.Pidfile)
+	}
+	if w.RestartAfter < 0 {
+		return fmt.Errorf("watch %s: restart_after %d: want >= 1", w.Name, w.RestartAfter)
+	}
+	return nil
+}
+
+// CheckList validates a watch list: each watch, unique names, MaxWatches.
+func CheckList(ws []Watch) error {
+	if len(ws) > MaxWatches {
+		return fmt.Errorf("%d watches: at most %d", len(ws), MaxWatches)
+	}
+	seen := make(map[string]bool, len(ws))
+	for _, w := range ws {
+		if err := w.Check(); err != nil {
+			return err
+		}
+		if seen[w.Name] {
+			return fmt.Errorf("duplicate watch %q", w.Name)
+		}
+		seen[w.Name] = true
+	}
+	return nil
+}
+
+func (w Watch) restartAfter() int {
+	if w.RestartAfter > 0 {
+		return w.RestartAfter
+	}
+	return 2
+}
+
+// Status is a watch's state as reported in proc_status.
+type Status struct {
+	Name  string `json:"name"`
+	Up    bool   `json:"up"`
+	PIDs  []int  `json:"pids,omitempty"`  // main processes (parent not matched)
+	Procs int    `json:"procs,omitempty"` // all matching processes
+	Since int64  `json:"since"`           // last up/down change, unix seconds
+	// Restarts counts how often the process came back up or its main pid
+	// changed since the agent started; AutoRestarts the restart commands
+	// the agent ran itself.
+	Restarts     int    `json:"restarts"`
+	AutoRestarts int    `json:"auto_restarts,omitempty"`
+	RestartErr   string `json:"restart_err,omitempty"` // last restart command failure
+	Err          string `json:"err,omitempty"`         // the check itself failed
+}
+
+const (
+	restartBackoffMin = 30 * time.Second
+	restartBackoffMax = 10 * time.Minute
+)
+
+type entry struct {
+	st          Status
+	seen        bool // checked at least once
+	wasUp       bool // seen up at least once
+	downChecks  int
+	nextRestart time.Time
+	backoff     time.Duration
+	restarting  bool
+}
+
+// Watcher keeps the state of the watches between checks. It is not safe
+// for concurrent use.
+type Watcher struct {
+	state map[string]*entry
+}
+
+// Check looks at every watch once. It returns the statuses in watch order,
+// whether any of them changed since the last check (up/down, main pids,
+// counters, errors) and the watches whose restart command is due; report
+// each of those back with Restarted.
+func (w *Watcher) Check(ws []Watch, now time.Time) (all []Status, changed bool, due []Watch) {
+	if w.state == nil {
+		w.state = map[string]*entry{}
+	}
+	live := make(map[string]bool, len(ws))
+	var procs []proc
+	var listErr error
+	listed := false
+	for _, wt := range ws {
+		live[wt.Name] = true
+		e := w.state[wt.Name]
+		if e == nil {
+			e = &entry{st: Status{Name: wt.Name}}
+			w.state[wt.Name] = e
+			changed = true
+		}
+
+		var pids []int
+		var n int
+		var err error
+		if wt.Pidfile != "" {
+			pids, err = pidfileAlive(wt.Pidfile)
+			n = len(pids)
+		} else {
+			if !listed {
+				procs, listErr = list()
+				listed = true
+			}
+			err = listErr
+			name := wt.Process
+			if name == "" {
+				name = wt.Name
+			}
+			pids, n = match(procs, name)
+		}
+
+		prev := e.st
+		e.st.Err = ""
+		if err != nil {
+			e.st.Err = err.Error()
+		} else {
+			up := len(pids) > 0
+			switch {
+			case !e.seen:
+				e.st.Since = now.Unix()
+			case up != prev.Up:
+				e.st.Since = now.Unix()
+				if up && e.wasUp {
+					e.st.Restarts++
+				}
+			case up && !slices.Equal(pids, prev.PIDs):
+				e.st.Restarts++
+			}
+			e.st.Up, e.st.PIDs, e.st.Procs = up, pids, n
+			e.seen = true
+			e.wasUp = e.wasUp || up
+			if up {
+				e.downChecks, e.backoff, e.nextRestart = 0, 0, time.Time{}
+			} else {
+				e.downChecks++
+			}
+		}
+		if !statusEqual(prev, e.st) {
+			changed = true
+		}
+		if len(wt.Restart) > 0 && e.seen && !e.st.Up && e.st.Err == "" && !e.restarting &&
+			e.downChecks >= wt.restartAfter() && !now.Before(e.nextRestart) {
+			e.restarting = true
+			due = append(due, wt)
+		}
+		all = append(all, e.st)
+	}
+	for name := range w.state {
+		if !live[name] {
+			delete(w.state, name)
+			changed = true
+		}
+	}
+	return all, changed, due
+}
+
+// Restarted records the outcome of a due restart command. The next one
+// for the same watch waits a backoff that doubles from 30s to 10m while
+// the process stays down.
+func (w *Watcher) Restarted(name string, err error, now time.Time) {
+	e := w.state[name]
+	if e == nil {
+		return
+	}
+	e.restarting = false
+	e.st.AutoRestarts++
+	e.st.RestartErr = ""
+	if err != nil {
+		e.st.RestartErr = err.Error()
+	}
+	switch {
+	case e.backoff == 0:
+		e.backoff = restartBackoffMin
+	case e.backoff < restartBackoffMax:
+		e.backoff = min(2*e.backoff, restartBackoffMax)
+	}
+	e.nextRestart = now.Add(e.backoff)
+	e.downChecks = 0
+}
+
+func statusEqual(a, b Status) bool {
+	return a.Up == b.Up && slices.Equal(a.PIDs, b.PIDs) && a.Restarts == b.Restarts &&
+		a.AutoRestarts == b.AutoRestarts && a.RestartErr == b.RestartErr && a.Err == b.Err
+}
+
+// proc is one running process.
+type proc struct {
+	pid, ppid int
+	comm      string
+	argv0     string // base name
+}
+
+// match returns the main pids (those whose parent doesn't match too) of
+// the processes named name, and how many match in all. comm is cut to 15
+// bytes by the kernel, so a longer name matches its prefix there.
+func match(procs []proc, name string) ([]int, int) {
+	comm := name
+	if len(comm) > 15 {
+		comm = comm[:15]
+	}
+	set := map[int]int{} // pid -> ppid
+	for _, p := range procs {
+		if p.comm == comm || p.argv0 == name {
+			set[p.pid] = p.ppid
+		}
+	}
+	var mains []int
+	for pid, ppid := range set {
+		if _, ok := set[ppid]; !ok {
+			mains = append(mains, pid)
+		}
+	}
+	sort.Ints(mains)
+	return mains, len(set)
+}
+
+// pidfileAlive returns the pid in path if that process is running.
+func pidfileAlive(path string) ([]int, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil // not running (or never started)
+	}
+	if err != nil {
+		return nil, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil || pid <= 0 {
+		return nil, fmt.Errorf("pidfile %s: no pid in it", path)
+	}
+	ok, err := alive(pid)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return []int{pid}, nil
+}
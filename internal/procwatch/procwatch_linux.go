@@ -0,0 +1,69 @@
+package procwatch
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// list reads comm, the parent pid and argv[0] of every process in /proc.
+// Kernel threads (empty cmdline) are kept: they can only match by comm.
+func list() ([]proc, error) {
+	dirs, err := filepath.Glob("/proc/[0-9]*")
+	if err != nil {
+		return nil, err
+	}
+	if len(dirs) == 0 {
+		return nil, os.ErrNotExist
+	}
+	self := os.Getpid()
+	out := make([]proc, 0, len(dirs))
+	for _, dir := range dirs {
+		pid, err := strconv.Atoi(filepath.Base(dir))
+		if err != nil || pid == self {
+			continue
+		}
+		stat, err := os.ReadFile(filepath.Join(dir, "stat"))
+		if err != nil {
+			continue // exited meanwhile
+		}
+		// pid (comm) state ppid ...; comm may contain spaces and parens
+		i, j := bytes.IndexByte(stat, '('), bytes.LastIndexByte(stat, ')')
+		if i < 0 || j < i {
+			continue
+		}
+		f := strings.Fields(string(stat[j+1:]))
+		if len(f) < 2 {
+			continue
+		}
+		p := proc{pid: pid, comm: string(stat[i+1 : j])}
+		p.ppid, _ = strconv.Atoi(f[1])
+		if cmd, err := os.ReadFile(filepath.Join(dir, "cmdline")); err == nil && len(cmd) > 0 {
+			if k := bytes.IndexByte(cmd, 0); k >= 0 {
+				cmd = cmd[:k]
+			}
+			p.argv0 = filepath.Base(string(cmd))
+		}
+		out = append(out, p)
+	}
+	return out, nil
+}
+
+// alive reports whether pid exists and isn't a zombie.
+func alive(pid int) (bool, error) {
+	stat, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	j := bytes.LastIndexByte(stat, ')')
+	if j < 0 || j+2 >= len(stat) {
+		return false, nil
+	}
+	return stat[j+2] != 'Z', nil
+}
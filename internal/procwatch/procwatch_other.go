@@ -0,0 +1,16 @@
+//go:build !linux
+
+package procwatch
+
+import "errors"
+
+var errUnsupported = errors.New("process watch not supported on this platform")
+
+// list and alive need /proc.
+func list() ([]proc, error) {
+	return nil, errUnsupported
+}
+
+func alive(int) (bool, error) {
+	return false, errUnsupported
+}
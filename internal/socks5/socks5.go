@@ -0,0 +1,161 @@
+// Package socks5 is the server side of a SOCKS5 CONNECT (RFC 1928) without
+// authentication: enough to let a client pick where a relayed connection
+// goes.
+package socks5
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// ErrNotAllowed is returned by a Dialer for destinations it refuses; the
+// client gets "connection not allowed by ruleset".
+var ErrNotAllowed = errors.New("destination not allowed")
+
+// Dialer connects to host (a name or an IP) and port for the client.
+type Dialer func(ctx context.Context, host string, port int) (net.Conn, error)
+
+// DialTimeout bounds the dial of a CONNECT.
+const DialTimeout = 15 * time.Second
+
+const (
+	version = 5
+
+	cmdConnect = 1
+
+	atypIPv4   = 1
+	atypDomain = 3
+	atypIPv6   = 4
+
+	repOK            = 0
+	repFailure       = 1
+	repNotAllowed    = 2
+	repHostUnreach   = 4
+	repRefused       = 5
+	repCmdUnsupp     = 7
+	repAtypUnsupp    = 8
+	methodNoAuth     = 0
+	methodNoAccepted = 0xff
+)
+
+// Accept runs the handshake on c, connects through dial and answers the
+// client. It returns the connection to the destination and the address
+// the client asked for ("host:port"); on error the client has been told
+// why where possible. A client that stalls blocks Accept: the caller
+// bounds it, e.g. by closing c.
+func Accept(c io.ReadWriter, dial Dialer) (net.Conn, string, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(c, hdr[:]); err != nil {
+		return nil, "", err
+	}
+	if hdr[0] != version {
+		return nil, "", errors.New("not a SOCKS5 client")
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(c, methods); err != nil {
+		return nil, "", err
+	}
+	noAuth := false
+	for _, m := range methods {
+		noAuth = noAuth || m == methodNoAuth
+	}
+	if !noAuth {
+		_, _ = c.Write([]byte{version, methodNoAccepted})
+		return nil, "", errors.New("client offers no method without authentication")
+	}
+	if _, err := c.Write([]byte{version, methodNoAuth}); err != nil {
+		return nil, "", err
+	}
+
+	var req [4]byte // ver cmd rsv atyp
+	if _, err := io.ReadFull(c, req[:]); err != nil {
+		return nil, "", err
+	}
+	var host string
+	switch req[3] {
+	case atypIPv4, atypIPv6:
+		ip := make(net.IP, 4)
+		if req[3] == atypIPv6 {
+			ip = make(net.IP, 16)
+		}
+		if _, err := io.ReadFull(c, ip); err != nil {
+			return nil, "", err
+		}
+		host = ip.String()
+	case atypDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(c, n[:]); err != nil {
+			return nil, "", err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(c, name); err != nil {
+			return nil, "", err
+		}
+		host = string(name)
+	default:
+		reply(c, repAtypUnsupp, nil)
+		return nil, "", errors.New("unsupported address type")
+	}
+	var pb [2]byte
+	if _, err := io.ReadFull(c, pb[:]); err != nil {
+		return nil, "", err
+	}
+	port := int(binary.BigEndian.Uint16(pb[:]))
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	if req[1] != cmdConnect {
+		reply(c, repCmdUnsupp, nil)
+		return nil, addr, errors.New("only CONNECT is supported")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DialTimeout)
+	defer cancel()
+	dst, err := dial(ctx, host, port)
+	if err != nil {
+		reply(c, replyCode(err), nil)
+		return nil, addr, err
+	}
+	if err := reply(c, repOK, dst.LocalAddr()); err != nil {
+		dst.Close()
+		return nil, addr, err
+	}
+	return dst, addr, nil
+}
+
+func reply(c io.Writer, code byte, bound net.Addr) error {
+	b := []byte{version, code, 0, atypIPv4, 0, 0, 0, 0, 0, 0}
+	if ta, ok := bound.(*net.TCPAddr); ok {
+		if ip4 := ta.IP.To4(); ip4 != nil {
+			copy(b[4:8], ip4)
+		} else {
+			b = append([]byte{version, code, 0, atypIPv6}, ta.IP.To16()...)
+			b = append(b, 0, 0)
+		}
+		binary.BigEndian.PutUint16(b[len(b)-2:], uint16(ta.Port))
+	}
+	_, err := c.Write(b)
+	return err
+}
+
+func replyCode(err error) byte {
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, ErrNotAllowed):
+		return repNotAllowed
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return repRefused
+	case errors.As(err, &dnsErr), errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return repHostUnreach
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return repHostUnreach
+	}
+	return repFailure
+}
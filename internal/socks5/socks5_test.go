@@ -0,0 +1,200 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// client is the other end of a pipe: it writes req and reads back what
+// Accept answered until Accept returns.
+type client struct {
+	req  []byte
+	resp bytes.Buffer
+}
+
+func (c *client) Read(b []byte) (int, error) {
+	if len(c.req) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, c.req)
+	c.req = c.req[n:]
+	return n, nil
+}
+
+func (c *client) Write(b []byte) (int, error) { return c.resp.Write(b) }
+
+func hello() []byte { return []byte{5, 1, 0} }
+
+func connect(atyp byte, addr []byte, port uint16) []byte {
+	b := append([]byte{5, 1, 0, atyp}, addr...)
+	return append(b, byte(port>>8), byte(port))
+}
+
+func TestAccept(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	lnPort := ln.Addr().(*net.TCPAddr).Port
+
+	var asked string
+	dialer := func(err error) Dialer {
+		return func(ctx context.Context, host string, port int) (net.Conn, error) {
+			asked = net.JoinHostPort(host, fmt.Sprint(port))
+			if err != nil {
+				return nil, err
+			}
+			return net.Dial("tcp", ln.Addr().String())
+		}
+	}
+	okReply := []byte{5, 0, 0, 1, 127, 0, 0, 1}
+
+	tests := []struct {
+		name   string
+		req    []byte
+		dial   Dialer
+		addr   string // destination asked for, "" when not reached
+		resp   []byte // prefix of what the client gets
+		wantOK bool
+	}{
+		{"ipv4", append(hello(), connect(1, []byte{192, 0, 2, 1}, 443)...), dialer(nil), "192.0.2.1:443", append([]byte{5, 0}, okReply...), true},
+		{"domain", append(hello(), connect(3, append([]byte{11}, "example.com"...), 80)...), dialer(nil), "example.com:80", append([]byte{5, 0}, okReply...), true},
+		{"ipv6", append(hello(), connect(4, net.ParseIP("2001:db8::1"), 22)...), dialer(nil), "[2001:db8::1]:22", append([]byte{5, 0}, okReply...), true},
+		{"no-auth among others", append([]byte{5, 3, 2, 1, 0}, connect(1, []byte{192, 0, 2, 1}, 1)...), dialer(nil), "192.0.2.1:1", []byte{5, 0, 5, 0}, true},
+		{"socks4", []byte{4, 1, 0, 80, 1, 2, 3, 4, 0}, dialer(nil), "", nil, false},
+		{"auth only", []byte{5, 1, 2}, dialer(nil), "", []byte{5, 0xff}, false},
+		{"bad address type", append(hello(), 5, 1, 0, 9), dialer(nil), "", []byte{5, 0, 5, 8}, false},
+		{"bind", append(hello(), 5, 2, 0, 1, 192, 0, 2, 1, 0, 80), dialer(nil), "", []byte{5, 0, 5, 7}, false},
+		{"udp associate", append(hello(), 5, 3, 0, 1, 192, 0, 2, 1, 0, 80), dialer(nil), "", []byte{5, 0, 5, 7}, false},
+		{"not allowed", append(hello(), connect(1, []byte{10, 0, 0, 1}, 22)...), dialer(ErrNotAllowed), "10.0.0.1:22", []byte{5, 0, 5, 2}, false},
+		{"refused", append(hello(), connect(1, []byte{192, 0, 2, 1}, 1)...), dialer(syscall.ECONNREFUSED), "192.0.2.1:1", []byte{5, 0, 5, 5}, false},
+		{"no such host", append(hello(), connect(3, append([]byte{3}, "x.y"...), 1)...), dialer(&net.DNSError{Err: "no such host", Name: "x.y"}), "x.y:1", []byte{5, 0, 5, 4}, false},
+		{"dial timeout", append(hello(), connect(1, []byte{192, 0, 2, 1}, 1)...), dialer(context.DeadlineExceeded), "192.0.2.1:1", []byte{5, 0, 5, 4}, false},
+		{"other failure", append(hello(), connect(1, []byte{192, 0, 2, 1}, 1)...), dialer(errors.New("boom")), "192.0.2.1:1", []byte{5, 0, 5, 1}, false},
+		{"truncated greeting", []byte{5, 2, 0}, dialer(nil), "", nil, false},
+		{"truncated request", append(hello(), 5, 1, 0, 1, 192, 0), dialer(nil), "", []byte{5, 0}, false},
+		{"truncated domain", append(hello(), 5, 1, 0, 3, 10, 'a'), dialer(nil), "", []byte{5, 0}, false},
+		{"empty", nil, dialer(nil), "", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			asked = ""
+			c := &client{req: tt.req}
+			conn, addr, err := Accept(c, tt.dial)
+			if conn != nil {
+				defer conn.Close()
+			}
+			if tt.wantOK != (err == nil) {
+				t.Fatalf("err %v", err)
+			}
+			if tt.addr != "" && (addr != tt.addr || asked != tt.addr) {
+				t.Errorf("address %q (dialed %q), want %q", addr, asked, tt.addr)
+			}
+			if tt.addr == "" && asked != "" {
+				t.Errorf("dialed %q", asked)
+			}
+			if got := c.resp.Bytes(); !bytes.HasPrefix(got, tt.resp) || tt.resp == nil && len(got) > 0 {
+				t.Errorf("client got % x, want % x", got, tt.resp)
+			}
+			if tt.wantOK {
+				got := c.resp.Bytes()
+				bound := int(got[len(got)-2])<<8 | int(got[len(got)-1])
+				if bound == 0 || bound == lnPort {
+					t.Errorf("bound port %d is not the agent's side", bound)
+				}
+			}
+		})
+	}
+}
+
+func TestAcceptRelays(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		_, _ = io.Copy(c, c)
+	}()
+	srv, cli := net.Pipe()
+	defer cli.Close()
+	_ = cli.SetDeadline(time.Now().Add(5 * time.Second))
+	port := ln.Addr().(*net.TCPAddr).Port
+	go func() {
+		_, _ = cli.Write(append(hello(), connect(1, []byte{127, 0, 0, 1}, uint16(port))...))
+	}()
+	done := make(chan net.Conn, 1)
+	go func() {
+		dst, _, err := Accept(srv, func(ctx context.Context, host string, port int) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "tcp", net.JoinHostPort(host, fmt.Sprint(port)))
+		})
+		if err != nil {
+			t.Error(err)
+		}
+		done <- dst
+	}()
+	resp := make([]byte, 12)
+	if _, err := io.ReadFull(cli, resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp[3] != 0 {
+		t.Fatalf("reply % x", resp)
+	}
+	dst := <-done
+	if dst == nil {
+		return
+	}
+	defer dst.Close()
+	if _, err := dst.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	echo := make([]byte, 4)
+	if _, err := io.ReadFull(dst, echo); err != nil || string(echo) != "ping" {
+		t.Errorf("echo %q, %v", echo, err)
+	}
+}
+
+func TestReplyCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		want byte
+	}{
+		{ErrNotAllowed, repNotAllowed},
+		{fmt.Errorf("dial: %w", ErrNotAllowed), repNotAllowed},
+		{&net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, repRefused},
+		{&net.OpError{Op: "dial", Err: syscall.EHOSTUNREACH}, repHostUnreach},
+		{syscall.ENETUNREACH, repHostUnreach},
+		{&net.DNSError{Err: "no such host"}, repHostUnreach},
+		{&net.DNSError{Err: "timeout", IsTimeout: true}, repHostUnreach},
+		{context.DeadlineExceeded, repHostUnreach},
+		{errors.New("other"), repFailure},
+	}
+	for _, tt := range tests {
+		if got := replyCode(tt.err); got != tt.want {
+			t.Errorf("replyCode(%v) = %d, want %d", tt.err, got, tt.want)
+		}
+	}
+}
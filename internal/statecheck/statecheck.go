@@ -0,0 +1,102 @@
+package statecheck
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// QuarantineDir is where corrupted files are moved, relative to the state dir.
+const QuarantineDir = "quarantine"
+
+// Leftover temp files from an interrupted atomic write younger than this may
+// still be in flight and are left alone.
+const staleTmpAge = 10 * time.Minute
+
+// Issue describes one problem found (and handled) in the state dir.
+type Issue struct {
+	File   string `json:"file"`
+	Action string `json:"action"` // quarantined|removed_tmp|error
+	Reason string `json:"reason"`
+	TS     int64  `json:"ts"`
+}
+
+// Check scans dir for state files. Every *.json file must be a complete JSON
+// document; anything else (typically a file truncated by power loss) is moved
+// to dir/quarantine so the owner starts fresh instead of wedging. Stale
+// *.tmp.* files left by WriteFileAtomic are removed. A missing dir is fine.
+func Check(dir string) []Issue {
+	if dir == "" {
+		return nil
+	}
+	ents, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return []Issue{{File: dir, Action: "error", Reason: err.Error(), TS: time.Now().Unix()}}
+	}
+
+	var out []Issue
+	for _, e := range ents {
+		if !e.Type().IsRegular() {
+			continue
+		}
+		name := e.Name()
+		p := filepath.Join(dir, name)
+		switch {
+		case strings.Contains(name, ".tmp."):
+			fi, err := e.Info()
+			if err != nil || time.Since(fi.ModTime()) < staleTmpAge {
+				continue
+			}
+			if err := os.Remove(p); err != nil {
+				out = append(out, issue(name, "error", err.Error()))
+			} else {
+				out = append(out, issue(name, "removed_tmp", "leftover from interrupted write"))
+			}
+		case strings.HasSuffix(name, ".json"):
+			why := validateJSON(p)
+			if why == "" {
+				continue
+			}
+			if dst, err := quarantine(dir, name); err != nil {
+				out = append(out, issue(name, "error", fmt.Sprintf("%s; quarantine failed: %v", why, err)))
+			} else {
+				out = append(out, issue(name, "quarantined", why+" -> "+dst))
+			}
+		}
+	}
+	return out
+}
+
+func issue(file, action, reason string) Issue {
+	return Issue{File: file, Action: action, Reason: reason, TS: time.Now().Unix()}
+}
+
+// validateJSON returns why p is not a usable JSON state file ("" if it is).
+func validateJSON(p string) string {
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return "unreadable: " + err.Error()
+	}
+	if len(strings.TrimSpace(string(b))) == 0 {
+		return "empty file"
+	}
+	if !json.Valid(b) {
+		return "invalid json"
+	}
+	return ""
+}
+
+func quarantine(dir, name string) (string, error) {
+	qdir := filepath.Join(dir, QuarantineDir)
+	if err := os.MkdirAll(qdir, 0755); err != nil {
+		return "", err
+	}
+	dst := filepath.Join(QuarantineDir, fmt.Sprintf("%s.%d", name, time.Now().Unix()))
+	return dst, os.Rename(filepath.Join(dir, name), filepath.Join(dir, dst))
+}
@@ -0,0 +1,210 @@
+// Package tasks runs scheduled commands: each task names a command from a
+// local allowlist and a cron schedule, and every run yields a Result with
+// its exit code, duration and the tail of its output.
+package tasks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Vincentkeio/agent/internal/cron"
+)
+
+const (
+	// MaxTasks bounds a task list.
+	MaxTasks = 64
+	// DefaultTimeout applies when a task sets no timeout_sec.
+	DefaultTimeout = 5 * time.Minute
+	// maxOutput is how much of the end of a run's output is kept.
+	maxOutput = 4096
+)
+
+// Task runs Command (a name from task_commands) on Schedule:
+//
+//	{"id":"certs","schedule":"17 3 * * *","command":"cert-check"}
+//	{"id":"warm","schedule":"*/15 * * * *","command":"cache-warm","timeout_sec":60}
+type Task struct {
+	ID         string `json:"id"`
+	Schedule   string `json:"schedule"`
+	Command    string `json:"command"`
+	TimeoutSec int    `json:"timeout_sec,omitempty"`
+}
+
+// Check validates a single task.
+func (t Task) Check() error {
+	if t.ID == "" || len(t.ID) > 64 {
+		return errors.New("task needs an id of up to 64 characters")
+	}
+	if t.Command == "" {
+		return fmt.Errorf("task %s: needs a command", t.ID)
+	}
+	if _, err := cron.Parse(t.Schedule); err != nil {
+		return fmt.Errorf("task %s: schedule: %v", t.ID, err)
+	}
+	if t.TimeoutSec < 0 {
+		return fmt.Errorf("task %s: timeout_sec %d: want >= 0", t.ID, t.TimeoutSec)
+	}
+	return nil
+}
+
+// CheckList validates a task list: each task, unique ids, MaxTasks.
+func CheckList(ts []Task) error {
+	if len(ts) > MaxTasks {
+		return fmt.Errorf("%d tasks: at most %d", len(ts), MaxTasks)
+	}
+	seen := make(map[string]bool, len(ts))
+	for _, t := range ts {
+		if err := t.Check(); err != nil {
+			return err
+		}
+		if seen[t.ID] {
+			return fmt.Errorf("duplicate task %q", t.ID)
+		}
+		seen[t.ID] = true
+	}
+	return nil
+}
+
+// Result is one run of a task, sent as task_result.
+type Result struct {
+	Type       string `json:"type"` // task_result
+	TaskID     string `json:"task_id"`
+	Command    string `json:"command"`
+	Start      int64  `json:"start"` // unix seconds
+	DurationMS int64  `json:"duration_ms"`
+	ExitCode   int    `json:"exit_code"`        // -1 when it didn't start or was killed
+	Output     string `json:"output,omitempty"` // last 4 KiB of stdout and stderr
+	Err        string `json:"err,omitempty"`    // "timeout", "still running", start failures
+	TS         int64  `json:"ts"`               // when it finished
+}
+
+// Runner starts due tasks and keeps a task from overlapping itself.
+type Runner struct {
+	mu      sync.Mutex
+	running map[string]bool
+	scheds  map[string]*cron.Schedule
+	last    time.Time // last minute looked at
+}
+
+// Due returns the tasks whose schedule matches now's minute. Each minute is
+// only looked at once, so call it as often as you like; the minute of the
+// first call is skipped, as it has already begun.
+func (r *Runner) Due(ts []Task, now time.Time) []Task {
+	m := now.Truncate(time.Minute)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !m.After(r.last) {
+		return nil
+	}
+	first := r.last.IsZero()
+	r.last = m
+	if first {
+		return nil
+	}
+	if r.scheds == nil {
+		r.scheds = map[string]*cron.Schedule{}
+	}
+	var due []Task
+	for _, t := range ts {
+		sc, ok := r.scheds[t.Schedule]
+		if !ok {
+			sc, _ = cron.Parse(t.Schedule) // checked by CheckList
+			r.scheds[t.Schedule] = sc
+		}
+		if sc != nil && sc.Match(m) {
+			due = append(due, t)
+		}
+	}
+	return due
+}
+
+// Run runs t's command argv and waits for it. A task still running from
+// its previous start isn't started again; that run is reported with Err
+// "still running". An empty argv means the command isn't allowlisted.
+func (r *Runner) Run(t Task, argv []string) Result {
+	start := time.Now()
+	res := Result{Type: "task_result", TaskID: t.ID, Command: t.Command, Start: start.Unix(), ExitCode: -1}
+	if len(argv) == 0 {
+		res.Err = fmt.Sprintf("command %q is not in task_commands", t.Command)
+		res.TS = start.Unix()
+		return res
+	}
+	r.mu.Lock()
+	if r.running == nil {
+		r.running = map[string]bool{}
+	}
+	if r.running[t.ID] {
+		r.mu.Unlock()
+		res.Err = "still running"
+		res.TS = start.Unix()
+		return res
+	}
+	r.running[t.ID] = true
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		delete(r.running, t.ID)
+		r.mu.Unlock()
+	}()
+
+	timeout := DefaultTimeout
+	if t.TimeoutSec > 0 {
+		timeout = time.Duration(t.TimeoutSec) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var out tail
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.Stdout, cmd.Stderr = &out, &out
+	cmd.WaitDelay = time.Second // don't hang on pipes held by children
+	err := cmd.Run()
+	res.DurationMS = time.Since(start).Milliseconds()
+	res.Output = strings.TrimSpace(out.String())
+	res.TS = time.Now().Unix()
+	var ee *exec.ExitError
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		res.Err = "timeout"
+	case errors.As(err, &ee):
+		res.ExitCode = ee.ExitCode()
+	case errors.Is(err, exec.ErrWaitDelay):
+		res.ExitCode = cmd.ProcessState.ExitCode() // a background child kept the output open
+	case err != nil:
+		res.Err = err.Error()
+	default:
+		res.ExitCode = 0
+	}
+	return res
+}
+
+// tail keeps the last maxOutput bytes written to it.
+type tail struct {
+	mu  sync.Mutex
+	buf []byte
+	cut bool
+}
+
+func (t *tail) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.buf = append(t.buf, p...)
+	if n := len(t.buf); n > maxOutput {
+		t.buf = append(t.buf[:0], t.buf[n-maxOutput:]...)
+		t.cut = true
+	}
+	return len(p), nil
+}
+
+func (t *tail) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.cut {
+		return "…" + string(t.buf)
+	}
+	return string(t.buf)
+}
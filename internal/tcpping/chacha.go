@@ -0,0 +1,145 @@
+package tcpping
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"math/big"
+	"math/bits"
+)
+
+// ChaCha20-Poly1305 (RFC 8439) for quic probes against servers that pick
+// TLS_CHACHA20_POLY1305_SHA256: the standard library only has it
+// internally. A handshake is a few packets, so this favours brevity over
+// speed (Poly1305 runs on math/big).
+
+// chachaBlock computes one 64-byte keystream block.
+func chachaBlock(out *[64]byte, key []byte, counter uint32, nonce []byte) {
+	var s [16]uint32
+	s[0], s[1], s[2], s[3] = 0x61707865, 0x3320646e, 0x79622d32, 0x6b206574
+	for i := 0; i < 8; i++ {
+		s[4+i] = binary.LittleEndian.Uint32(key[4*i:])
+	}
+	s[12] = counter
+	for i := 0; i < 3; i++ {
+		s[13+i] = binary.LittleEndian.Uint32(nonce[4*i:])
+	}
+	x := s
+	for i := 0; i < 10; i++ {
+		quarterRound(&x, 0, 4, 8, 12)
+		quarterRound(&x, 1, 5, 9, 13)
+		quarterRound(&x, 2, 6, 10, 14)
+		quarterRound(&x, 3, 7, 11, 15)
+		quarterRound(&x, 0, 5, 10, 15)
+		quarterRound(&x, 1, 6, 11, 12)
+		quarterRound(&x, 2, 7, 8, 13)
+		quarterRound(&x, 3, 4, 9, 14)
+	}
+	for i := range x {
+		binary.LittleEndian.PutUint32(out[4*i:], x[i]+s[i])
+	}
+}
+
+func quarterRound(x *[16]uint32, a, b, c, d int) {
+	x[a] += x[b]
+	x[d] = bits.RotateLeft32(x[d]^x[a], 16)
+	x[c] += x[d]
+	x[b] = bits.RotateLeft32(x[b]^x[c], 12)
+	x[a] += x[b]
+	x[d] = bits.RotateLeft32(x[d]^x[a], 8)
+	x[c] += x[d]
+	x[b] = bits.RotateLeft32(x[b]^x[c], 7)
+}
+
+// chachaXOR encrypts src into dst (same length) starting at block counter.
+func chachaXOR(dst, src, key []byte, counter uint32, nonce []byte) {
+	var ks [64]byte
+	for i := 0; i < len(src); i += 64 {
+		chachaBlock(&ks, key, counter, nonce)
+		counter++
+		for j := 0; j < 64 && i+j < len(src); j++ {
+			dst[i+j] = src[i+j] ^ ks[j]
+		}
+	}
+}
+
+var poly1305P = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 130), big.NewInt(5))
+
+// leInt reads b as a little-endian number.
+func leInt(b []byte) *big.Int {
+	r := make([]byte, len(b))
+	for i, c := range b {
+		r[len(b)-1-i] = c
+	}
+	return new(big.Int).SetBytes(r)
+}
+
+func poly1305(key, msg []byte) []byte {
+	rb := append([]byte(nil), key[:16]...)
+	rb[3] &= 15
+	rb[7] &= 15
+	rb[11] &= 15
+	rb[15] &= 15
+	rb[4] &= 252
+	rb[8] &= 252
+	rb[12] &= 252
+	r := leInt(rb)
+
+	acc := new(big.Int)
+	var block [17]byte
+	for len(msg) > 0 {
+		n := copy(block[:16], msg)
+		block[n] = 1
+		acc.Add(acc, leInt(block[:n+1]))
+		acc.Mul(acc, r)
+		acc.Mod(acc, poly1305P)
+		msg = msg[n:]
+	}
+	acc.Add(acc, leInt(key[16:32]))
+
+	be := acc.Bytes()
+	tag := make([]byte, 16)
+	for i := 0; i < 16 && i < len(be); i++ {
+		tag[i] = be[len(be)-1-i]
+	}
+	return tag
+}
+
+// chachaAEAD is AEAD_CHACHA20_POLY1305; it implements cipher.AEAD.
+type chachaAEAD []byte
+
+func (chachaAEAD) NonceSize() int { return 12 }
+func (chachaAEAD) Overhead() int  { return 16 }
+
+func (k chachaAEAD) tag(nonce, ad, ct []byte) []byte {
+	var otk [64]byte
+	chachaBlock(&otk, k, 0, nonce)
+	pad := func(b []byte) []byte { return append(b, make([]byte, (16-len(b)%16)%16)...) }
+	mac := pad(append([]byte(nil), ad...))
+	mac = pad(append(mac, ct...))
+	mac = binary.LittleEndian.AppendUint64(mac, uint64(len(ad)))
+	mac = binary.LittleEndian.AppendUint64(mac, uint64(len(ct)))
+	return poly1305(otk[:32], mac)
+}
+
+func (k chachaAEAD) Seal(dst, nonce, plaintext, ad []byte) []byte {
+	ct := make([]byte, len(plaintext))
+	chachaXOR(ct, plaintext, k, 1, nonce)
+	dst = append(dst, ct...)
+	return append(dst, k.tag(nonce, ad, ct)...)
+}
+
+var errOpen = errors.New("message authentication failed")
+
+func (k chachaAEAD) Open(dst, nonce, ciphertext, ad []byte) ([]byte, error) {
+	if len(ciphertext) < 16 {
+		return nil, errOpen
+	}
+	ct, tag := ciphertext[:len(ciphertext)-16], ciphertext[len(ciphertext)-16:]
+	if subtle.ConstantTimeCompare(k.tag(nonce, ad, ct), tag) != 1 {
+		return nil, errOpen
+	}
+	pt := make([]byte, len(ct))
+	chachaXOR(pt, ct, k, 1, nonce)
+	return append(dst, pt...), nil
+}
@@ -0,0 +1,49 @@
+package tcpping
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/Vincentkeio/agent/internal/cron"
+)
+
+// Check reports the first problem that would make t fail on every round.
+func (t Target) Check() error {
+	switch {
+	case t.Host == "":
+		return errors.New("host is required")
+	case t.Port <= 0 || t.Port > 65535:
+		return fmt.Errorf("port %d out of range", t.Port)
+	case t.IPVer != 0 && t.IPVer != 4 && t.IPVer != 6:
+		return fmt.Errorf("ip_ver %d: want 4, 6 or 0", t.IPVer)
+	case t.TimeoutMS < 0 || t.TimeoutMS > 60000:
+		return fmt.Errorf("timeout_ms %d: want 0-60000", t.TimeoutMS)
+	case t.Count < 0 || t.Count > maxCount:
+		return fmt.Errorf("count %d: want 0-%d", t.Count, maxCount)
+	case t.IntervalSec < 0:
+		return fmt.Errorf("interval_sec %d is negative", t.IntervalSec)
+	}
+	switch t.Proto {
+	case "", "tcp", "udp", "quic":
+	default:
+		return fmt.Errorf("proto %q: want tcp, udp or quic", t.Proto)
+	}
+	if t.TLS && t.Proto != "" && t.Proto != "tcp" {
+		return errors.New("tls is only supported for tcp")
+	}
+	switch t.ResolveMode {
+	case "", "cache", "per-round", "pinned":
+	default:
+		return fmt.Errorf("resolve_mode %q: want cache, per-round or pinned", t.ResolveMode)
+	}
+	if t.IP != "" && net.ParseIP(t.IP) == nil {
+		return fmt.Errorf("ip %q is not an IP address", t.IP)
+	}
+	if t.Schedule != "" {
+		if _, err := cron.Parse(t.Schedule); err != nil {
+			return err
+		}
+	}
+	return nil
+}
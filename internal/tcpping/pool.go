@@ -0,0 +1,61 @@
+package tcpping
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const DefaultWorkers = 16
+
+// PingAll probes targets through a bounded worker pool. Each target gets its
+// own deadline (timeout x count, plus slack) so one slow host can't eat the
+// budget of the rest. Samples are returned in target order.
+func PingAll(ctx context.Context, targets []Target, workers int) []Sample {
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+	if workers > len(targets) {
+		workers = len(targets)
+	}
+
+	out := make([]Sample, len(targets))
+	idx := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range idx {
+				tctx, cancel := context.WithTimeout(ctx, budget(targets[i]))
+				out[i] = Ping(tctx, targets[i])
+				cancel()
+			}
+		}()
+	}
+	for i := range targets {
+		idx <- i
+	}
+	close(idx)
+	wg.Wait()
+	return out
+}
+
+// budget is the worst-case time one target may take.
+func budget(t Target) time.Duration {
+	timeout := time.Duration(t.TimeoutMS) * time.Millisecond
+	if timeout <= 0 {
+		timeout = 1500 * time.Millisecond
+	}
+	if t.TLS {
+		timeout *= 2 // connect + handshake each get the full timeout
+	}
+	n := t.Count
+	if n < 1 {
+		n = 1
+	}
+	if n > maxCount {
+		n = maxCount
+	}
+	return time.Duration(n)*timeout + 500*time.Millisecond
+}
@@ -0,0 +1,407 @@
+package tcpping
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"net"
+	"time"
+)
+
+const (
+	// quicDatagram is the size client datagrams carrying Initial packets
+	// are padded to (RFC 9000 section 14.1), and the most any of ours takes.
+	quicDatagram = 1200
+	// quicMaxPending bounds out-of-order CRYPTO data held per level.
+	quicMaxPending = 64 << 10
+)
+
+var errQUICVersion = errors.New("quic: server doesn't support QUIC v1")
+
+// pingQUIC runs a QUIC v1 handshake: a client Initial carrying a TLS 1.3
+// ClientHello, then the server's Initial and Handshake flights. It's OK
+// only once crypto/tls reports the handshake done, so the certificate was
+// verified (unless tls_skip_verify) and the ALPN accepted. rtt_ms is the
+// time until the server's first reply, tls_rtt_ms the whole handshake.
+// Version Negotiation fails the probe with "quic_version"; a Retry is
+// answered once with its token, as a client would. The connection is
+// closed right after, without any stream opened.
+func pingQUIC(ctx context.Context, t Target, s Sample, addr string, timeout time.Duration) Sample {
+	start := time.Now()
+	conn, err := dial(ctx, family("udp", t.IPVer), addr, timeout)
+	if err != nil {
+		s.Err = shortErr(err)
+		return s
+	}
+	defer conn.Close()
+
+	deadline := start.Add(timeout)
+	if dl, ok := ctx.Deadline(); ok && dl.Before(deadline) {
+		deadline = dl
+	}
+	_ = conn.SetDeadline(deadline)
+	hctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+
+	c, err := newQUICClient(hctx, t, conn)
+	if err != nil {
+		s.Err = "tls"
+		return s
+	}
+	defer c.qc.Close()
+
+	start = time.Now()
+	buf := make([]byte, 1500)
+	for {
+		if err = c.flush(); err != nil {
+			break
+		}
+		if c.done {
+			break
+		}
+		var n int
+		if n, err = conn.Read(buf); err != nil {
+			break
+		}
+		if err = c.handle(buf[:n]); err != nil {
+			break
+		}
+	}
+	if !c.replied.IsZero() {
+		s.RTTMS = c.replied.Sub(start).Milliseconds()
+	}
+	if !c.done {
+		s.Err = quicErr(err, !c.replied.IsZero())
+		return s
+	}
+	s.OK = true
+	s.rtt = c.replied.Sub(start)
+	s.tlsRTT = time.Since(start)
+	s.TLSRTTMS = round2(ms(s.tlsRTT))
+	s.TLSVersion = "1.3"
+	s.ALPN = c.qc.ConnectionState().NegotiatedProtocol
+	return s
+}
+
+// quicErr maps why a handshake stopped to a sample error; replied is
+// whether the server answered at all.
+func quicErr(err error, replied bool) string {
+	var ce *quicCloseError
+	switch {
+	case errors.Is(err, errQUICVersion):
+		return "quic_version"
+	case errors.As(err, &ce):
+		if ce.code >= 0x100 && ce.code <= 0x1ff {
+			return "tls" // a TLS alert
+		}
+		return "closed"
+	case !replied:
+		return shortErr(err)
+	}
+	return tlsErr(err)
+}
+
+// quicSpace is one packet number space, Initial or Handshake.
+type quicSpace struct {
+	level       tls.QUICEncryptionLevel
+	typ         byte // long header packet type
+	read, write *quicKeys
+
+	pn      uint64   // next packet number to send
+	largest int64    // largest received, -1 before any
+	acks    []uint64 // received packets to acknowledge
+
+	in      uint64            // CRYPTO offset handed to TLS so far
+	pending map[uint64][]byte // CRYPTO data past a gap
+	stream  []byte            // CRYPTO data from TLS
+	sent    int               // how much of stream went out
+}
+
+type quicClient struct {
+	conn net.Conn
+	qc   *tls.QUICConn
+
+	dcid, scid []byte
+	token      []byte // from a Retry
+	gotInitial bool   // the server's Initial came: dcid is its SCID
+
+	initial, handshake quicSpace
+	replied            time.Time
+	done, closed       bool
+}
+
+func newQUICClient(ctx context.Context, t Target, conn net.Conn) (*quicClient, error) {
+	sni := t.SNI
+	if sni == "" && net.ParseIP(t.Host) == nil {
+		sni = t.Host
+	}
+	alpn := t.ALPN
+	if alpn == "" {
+		alpn = "h3"
+	}
+	c := &quicClient{
+		conn:      conn,
+		dcid:      make([]byte, 8),
+		scid:      make([]byte, 8),
+		initial:   quicSpace{level: tls.QUICEncryptionLevelInitial, typ: quicInitial, largest: -1},
+		handshake: quicSpace{level: tls.QUICEncryptionLevelHandshake, typ: quicHandshake, largest: -1},
+	}
+	_, _ = rand.Read(c.dcid)
+	_, _ = rand.Read(c.scid)
+	c.initial.write, c.initial.read = quicInitialKeys(c.dcid)
+
+	c.qc = tls.QUICClient(&tls.QUICConfig{TLSConfig: &tls.Config{
+		ServerName:         sni,
+		NextProtos:         []string{alpn},
+		MinVersion:         tls.VersionTLS13,
+		InsecureSkipVerify: t.TLSSkipVerify || sni == "",
+	}})
+	var tp []byte
+	tp = appendTransportParam(tp, 0x01, appendVarint(nil, 30000)) // max_idle_timeout
+	tp = appendTransportParam(tp, 0x03, appendVarint(nil, 1500))  // max_udp_payload_size: our read buffer
+	tp = appendTransportParam(tp, 0x04, appendVarint(nil, 1<<20)) // initial_max_data
+	tp = appendTransportParam(tp, 0x0f, c.scid)                   // initial_source_connection_id
+	c.qc.SetTransportParameters(tp)
+	if err := c.qc.Start(ctx); err != nil {
+		c.qc.Close()
+		return nil, err
+	}
+	if err := c.events(); err != nil {
+		c.qc.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *quicClient) space(level tls.QUICEncryptionLevel) *quicSpace {
+	switch level {
+	case tls.QUICEncryptionLevelInitial:
+		return &c.initial
+	case tls.QUICEncryptionLevelHandshake:
+		return &c.handshake
+	}
+	return nil // 0-RTT and 1-RTT keys aren't needed
+}
+
+// events applies what crypto/tls asks for: new keys, CRYPTO data to send
+// and the end of the handshake.
+func (c *quicClient) events() error {
+	for {
+		ev := c.qc.NextEvent()
+		sp := c.space(ev.Level)
+		switch ev.Kind {
+		case tls.QUICNoEvent:
+			return nil
+		case tls.QUICSetReadSecret, tls.QUICSetWriteSecret:
+			if sp == nil {
+				continue
+			}
+			k, err := newQUICKeys(ev.Suite, ev.Data)
+			if err != nil {
+				return err
+			}
+			if ev.Kind == tls.QUICSetReadSecret {
+				sp.read = k
+			} else {
+				sp.write = k
+			}
+		case tls.QUICWriteData:
+			if sp != nil {
+				sp.stream = append(sp.stream, ev.Data...)
+			}
+		case tls.QUICHandshakeDone:
+			c.done = true
+		}
+	}
+}
+
+// handle processes one datagram from the server.
+func (c *quicClient) handle(b []byte) error {
+	// coalesced long header packets; a short header one (1-RTT) ends the
+	// datagram and isn't needed
+	for len(b) > 0 && b[0]&0x80 != 0 {
+		h, err := parseLong(b)
+		if err != nil {
+			return nil
+		}
+		pkt := b[:h.end]
+		b = b[h.end:]
+		if !bytes.Equal(h.dcid, c.scid) {
+			continue
+		}
+		if c.replied.IsZero() {
+			c.replied = time.Now()
+		}
+		switch {
+		case h.version == 0:
+			// a list naming v1 can't be a reply to our v1 Initial (RFC 9000
+			// section 6.2): ignore it
+			for v := h.versions; len(v) >= 4; v = v[4:] {
+				if v[0] == 0 && v[1] == 0 && v[2] == 0 && v[3] == 1 {
+					return nil
+				}
+			}
+			if c.gotInitial {
+				return nil
+			}
+			return errQUICVersion
+		case h.version != 1:
+			return nil
+		case h.typ == quicRetry:
+			c.retry(h, pkt)
+		case h.typ == quicInitial || h.typ == quicHandshake:
+			sp := &c.initial
+			if h.typ == quicHandshake {
+				sp = &c.handshake
+			}
+			if sp.read == nil {
+				continue
+			}
+			pn, payload, err := openLong(pkt, h.pnOff, sp.read, sp.largest)
+			if err != nil {
+				continue
+			}
+			if h.typ == quicInitial && !c.gotInitial {
+				c.dcid, c.gotInitial = append([]byte(nil), h.scid...), true
+			}
+			sp.largest = max(sp.largest, int64(pn))
+			eliciting, err := parseFrames(payload, func(off uint64, data []byte) error {
+				return c.crypto(sp, off, data)
+			})
+			var ce *quicCloseError
+			if errors.As(err, &ce) {
+				return err
+			}
+			if err != nil && !errors.Is(err, errQUICPacket) {
+				return err // from crypto/tls
+			}
+			if eliciting && len(sp.acks) < 64 {
+				sp.acks = append(sp.acks, pn)
+			}
+			if err := c.events(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// retry restarts the Initial exchange with the token and connection ID of
+// a Retry; only the first valid one is followed.
+func (c *quicClient) retry(h longHeader, pkt []byte) {
+	if c.gotInitial || c.token != nil || len(h.token) == 0 {
+		return
+	}
+	tag := retryTag(c.dcid, pkt[:len(pkt)-16])
+	if !bytes.Equal(tag, pkt[len(pkt)-16:]) {
+		return
+	}
+	c.token = append([]byte(nil), h.token...)
+	c.dcid = append([]byte(nil), h.scid...)
+	c.initial.write, c.initial.read = quicInitialKeys(c.dcid)
+	c.initial.sent = 0
+}
+
+// crypto hands CRYPTO data to crypto/tls in order.
+func (c *quicClient) crypto(sp *quicSpace, off uint64, data []byte) error {
+	end := off + uint64(len(data))
+	switch {
+	case end <= sp.in:
+		return nil // retransmission
+	case off > sp.in:
+		if sp.pending == nil {
+			sp.pending = map[uint64][]byte{}
+		}
+		size := 0
+		for _, d := range sp.pending {
+			size += len(d)
+		}
+		if size+len(data) <= quicMaxPending {
+			sp.pending[off] = append([]byte(nil), data...)
+		}
+		return nil
+	}
+	if err := c.qc.HandleData(sp.level, data[sp.in-off:]); err != nil {
+		return err
+	}
+	sp.in = end
+	for off, d := range sp.pending {
+		if off <= sp.in {
+			delete(sp.pending, off)
+			return c.crypto(sp, off, d)
+		}
+	}
+	return nil
+}
+
+// frames takes what's due in sp (an ACK, then CRYPTO data) up to room
+// bytes; nil means nothing.
+func (sp *quicSpace) frames(room int) []byte {
+	if sp.write == nil {
+		return nil
+	}
+	var b []byte
+	if len(sp.acks) > 0 {
+		b = appendACK(b, sp.acks)
+		sp.acks = sp.acks[:0]
+	}
+	if rest := len(sp.stream) - sp.sent; rest > 0 {
+		hdr := 1 + len(appendVarint(nil, uint64(sp.sent))) + 2
+		if n := min(rest, room-len(b)-hdr); n > 0 {
+			b = append(b, 0x06)
+			b = appendVarint(b, uint64(sp.sent))
+			b = append(b, byte(0x40|n>>8), byte(n))
+			b = append(b, sp.stream[sp.sent:sp.sent+n]...)
+			sp.sent += n
+		}
+	}
+	return b
+}
+
+func (c *quicClient) seal(sp *quicSpace, payload []byte) []byte {
+	pkt := sealLong(sp.typ, c.dcid, c.scid, c.token, sp.write, sp.pn, payload)
+	sp.pn++
+	return pkt
+}
+
+// flush sends everything due, Initial and Handshake packets coalesced,
+// and a CONNECTION_CLOSE once the handshake is done. The first Handshake
+// packet sent retires the Initial keys (RFC 9001 section 4.9.1).
+func (c *quicClient) flush() error {
+	for {
+		initOverhead := quicOverhead(quicInitial, c.dcid, c.scid, c.token)
+		initFrames := c.initial.frames(quicDatagram - initOverhead)
+		room := quicDatagram - quicOverhead(quicHandshake, c.dcid, c.scid, nil)
+		if initFrames != nil {
+			room -= initOverhead + len(initFrames)
+		}
+		hsFrames := c.handshake.frames(room)
+		if c.done && !c.closed && c.handshake.write != nil && room-len(hsFrames) >= 4 {
+			// NO_ERROR, no frame type, no reason
+			hsFrames = append(hsFrames, 0x1c, 0, 0, 0)
+			c.closed = true
+		}
+		if initFrames == nil && hsFrames == nil {
+			return nil
+		}
+
+		var hsPkt, dgram []byte
+		if hsFrames != nil {
+			hsPkt = c.seal(&c.handshake, hsFrames)
+		}
+		if initFrames != nil {
+			if pad := quicDatagram - len(hsPkt) - initOverhead - len(initFrames); pad > 0 {
+				initFrames = append(initFrames, make([]byte, pad)...)
+			}
+			dgram = c.seal(&c.initial, initFrames)
+		}
+		if _, err := c.conn.Write(append(dgram, hsPkt...)); err != nil {
+			return err
+		}
+		if hsPkt != nil {
+			c.initial.read, c.initial.write = nil, nil
+		}
+	}
+}
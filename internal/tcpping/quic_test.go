@@ -0,0 +1,419 @@
+package tcpping
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// RFC 9001 appendix A.
+const (
+	rfcDCID           = "8394c8f03e515708"
+	rfcServerInitial  = "cf000000010008f067a5502a4262b500 4075c0d95a482cd0991cd25b0aac406a 5816b6394100f37a1c69797554780bb3 8cc5a99f5ede4cf73c3ec2493a1839b3 dbcba3f6ea46c5b7684df3548e7ddeb9 c3bf9c73cc3f3bded74b562bfb19fb84 022f8ef4cdd93795d77d06edbb7aaf2f 58891850abbdca3d20398c276456cbc4 2158407dd074ee"
+	rfcServerPayload  = "02000000000600405a020000560303ee fce7f7b37ba1d1632e96677825ddf739 88cfc79825df566dc5430b9a045a1200 130100002e00330024001d00209d3c94 0d89690b84d08a60993c144eca684d10 81287c834d5311bcf32bb9da1a002b00 020304"
+	rfcRetry          = "ff000000010008f067a5502a4262b574 6f6b656e04a265ba2eff4d829058fb3f 0f2496ba"
+	rfcChaChaSecret   = "9ac312a7f877468ebe69422748ad00a1 5443f18203a07d6060f688f30f21632b"
+	rfcChaChaSample   = "5e5cd55c41f69080575d7999c25a5bfb"
+	rfcChaChaSealed   = "655e5cd55c41f69080575d7999c25a5bfb"
+	rfcChaChaHeader   = "4200bff4"
+	rfcChaChaPN       = 654360564
+	rfcChaChaMask     = "aefefe7d03"
+	rfcClientIV       = "fa044b2f42a3fd3b46fb255c"
+	rfcInitialHPInput = "d1b1c98dd7689fb8ec11d242b123dc9b" // sample of the client Initial
+	rfcInitialHPMask  = "437b9aec36"
+)
+
+func TestQUICInitialKeys(t *testing.T) {
+	client, server := quicInitialKeys(unhex(t, rfcDCID))
+	// cipher.AEAD hides the packet keys: opening the RFC's server Initial
+	// below checks the server's
+	if !bytes.Equal(client.iv, unhex(t, rfcClientIV)) {
+		t.Errorf("client iv %x", client.iv)
+	}
+	if m := client.mask(unhex(t, rfcInitialHPInput)); !bytes.Equal(m, unhex(t, rfcInitialHPMask)) {
+		t.Errorf("client hp mask %x", m)
+	}
+	if !bytes.Equal(server.iv, unhex(t, "0ac1493ca1905853b0bba03e")) {
+		t.Errorf("server iv %x", server.iv)
+	}
+
+	pkt := unhex(t, rfcServerInitial)
+	h, err := parseLong(pkt)
+	if err != nil || h.typ != quicInitial || h.end != len(pkt) {
+		t.Fatalf("parseLong: %+v %v", h, err)
+	}
+	pn, payload, err := openLong(pkt, h.pnOff, server, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pn != 1 || !bytes.Equal(payload, unhex(t, rfcServerPayload)) {
+		t.Errorf("pn %d, payload %x", pn, payload)
+	}
+	// with the client's keys it doesn't open
+	if _, _, err := openLong(pkt, h.pnOff, client, -1); err == nil {
+		t.Error("opened with the wrong keys")
+	}
+
+	// what sealLong builds, openLong reads back
+	sealed := sealLong(quicHandshake, []byte{1, 2}, []byte{3}, nil, client, 7, []byte("hello"))
+	h, err = parseLong(sealed)
+	if err != nil || h.typ != quicHandshake || !bytes.Equal(h.dcid, []byte{1, 2}) {
+		t.Fatalf("parseLong: %+v %v", h, err)
+	}
+	if pn, payload, err := openLong(sealed, h.pnOff, client, 5); err != nil || pn != 7 || string(payload) != "hello" {
+		t.Errorf("round trip: %d %q %v", pn, payload, err)
+	}
+}
+
+func TestRetryTag(t *testing.T) {
+	pkt := unhex(t, rfcRetry)
+	h, err := parseLong(pkt)
+	if err != nil || h.typ != quicRetry || string(h.token) != "token" {
+		t.Fatalf("parseLong: %+v %v", h, err)
+	}
+	if tag := retryTag(unhex(t, rfcDCID), pkt[:len(pkt)-16]); !bytes.Equal(tag, pkt[len(pkt)-16:]) {
+		t.Errorf("tag %x", tag)
+	}
+}
+
+func TestQUICChaCha(t *testing.T) {
+	k, err := newQUICKeys(tls.TLS_CHACHA20_POLY1305_SHA256, unhex(t, rfcChaChaSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ct := k.aead.Seal(nil, k.nonce(rfcChaChaPN), []byte{0x01}, unhex(t, rfcChaChaHeader))
+	if !bytes.Equal(ct, unhex(t, rfcChaChaSealed)) {
+		t.Errorf("sealed %x", ct)
+	}
+	if m := k.mask(unhex(t, rfcChaChaSample)); !bytes.Equal(m, unhex(t, rfcChaChaMask)) {
+		t.Errorf("mask %x", m)
+	}
+	pt, err := k.aead.Open(nil, k.nonce(rfcChaChaPN), ct, unhex(t, rfcChaChaHeader))
+	if err != nil || !bytes.Equal(pt, []byte{0x01}) {
+		t.Errorf("open %x %v", pt, err)
+	}
+	ct[0] ^= 1
+	if _, err := k.aead.Open(nil, k.nonce(rfcChaChaPN), ct, unhex(t, rfcChaChaHeader)); err == nil {
+		t.Error("opened a corrupted packet")
+	}
+
+	// RFC 8439 section 2.5.2
+	tag := poly1305(unhex(t, "85d6be7857556d337f4452fe42d506a8 0103808afb0db2fd4abff6af4149f51b"), []byte("Cryptographic Forum Research Group"))
+	if !bytes.Equal(tag, unhex(t, "a8061dc1305136c6c22b8baf0c0127a9")) {
+		t.Errorf("poly1305 %x", tag)
+	}
+}
+
+func TestDecodePacketNumber(t *testing.T) {
+	tests := []struct {
+		largest   int64
+		truncated uint64
+		bits      int
+		want      uint64
+	}{
+		{0xa82f30ea, 0x9b32, 16, 0xa82f9b32}, // RFC 9000 appendix A.3
+		{-1, 0, 32, 0},
+		{-1, 3, 8, 3},
+		{0xff, 0x02, 8, 0x102},
+		{0x102, 0xff, 8, 0xff},
+	}
+	for _, tt := range tests {
+		if got := decodePacketNumber(tt.largest, tt.truncated, tt.bits); got != tt.want {
+			t.Errorf("decode(%x, %x) = %x, want %x", tt.largest, tt.truncated, got, tt.want)
+		}
+	}
+}
+
+func TestFrames(t *testing.T) {
+	ack := appendACK(nil, []uint64{1, 0, 5, 4, 4, 9})
+	// largest 9, 0 ranges below it: [9], gap 2 to [4,5], gap 1 to [0,1]
+	if want := []byte{0x02, 9, 0, 2, 0, 2, 1, 1, 1}; !bytes.Equal(ack, want) {
+		t.Errorf("ack % x, want % x", ack, want)
+	}
+
+	var got []string
+	payload := append(append([]byte{0x00, 0x01}, ack...), 0x06, 0x05, 0x02, 'h', 'i', 0x00)
+	eliciting, err := parseFrames(payload, func(off uint64, data []byte) error {
+		got = append(got, string(data))
+		if off != 5 {
+			t.Errorf("offset %d", off)
+		}
+		return nil
+	})
+	if err != nil || !eliciting || len(got) != 1 || got[0] != "hi" {
+		t.Errorf("got %v %v %v", got, eliciting, err)
+	}
+	if eliciting, err := parseFrames(append(ack, 0, 0), nil); err != nil || eliciting {
+		t.Errorf("ack only: %v %v", eliciting, err)
+	}
+
+	_, err = parseFrames([]byte{0x1c, 0x02, 0x00, 0x03, 'b', 'y', 'e'}, nil)
+	var ce *quicCloseError
+	if !errors.As(err, &ce) || ce.code != 2 || ce.reason != "bye" {
+		t.Errorf("close: %v", err)
+	}
+	for _, bad := range [][]byte{{0x06, 0x00, 0x05, 'x'}, {0x08, 0x00}, {0x02, 0x01}} {
+		if _, err := parseFrames(bad, func(uint64, []byte) error { return nil }); !errors.Is(err, errQUICPacket) {
+			t.Errorf("% x: %v", bad, err)
+		}
+	}
+}
+
+// fakeQUIC is a QUIC server just good enough to run handshakes with
+// pingQUIC, one client at a time.
+type fakeQUIC struct {
+	t    *testing.T
+	conn net.PacketConn
+	cert tls.Certificate
+	mode string // "", "vn", "retry", "retry-always", "close"
+
+	closed chan struct{} // the client sent CONNECTION_CLOSE
+}
+
+func startFakeQUIC(t *testing.T, mode string) (*fakeQUIC, Target) {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	f := &fakeQUIC{t: t, conn: pc, cert: selfSigned(t), mode: mode, closed: make(chan struct{}, 1)}
+	go f.serve()
+	port := pc.LocalAddr().(*net.UDPAddr).Port
+	return f, Target{Host: "127.0.0.1", Port: port, Proto: "quic", TLSSkipVerify: true, TimeoutMS: 2000}
+}
+
+func selfSigned(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"quic.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// fakeConn is the server side of one connection.
+type fakeConn struct {
+	qs                 *tls.QUICConn
+	scid, dcid         []byte
+	initial, handshake quicSpace
+}
+
+func (f *fakeQUIC) serve() {
+	var c *fakeConn
+	retried := false
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := f.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		b := buf[:n]
+		for len(b) > 0 {
+			h, err := parseLong(b)
+			if err != nil {
+				break
+			}
+			pkt := b[:h.end]
+			b = b[h.end:]
+			send := func(p []byte) { _, _ = f.conn.WriteTo(p, addr) }
+
+			if c == nil && h.typ == quicInitial {
+				switch {
+				case f.mode == "vn":
+					vn := []byte{0x80, 0, 0, 0, 0, byte(len(h.scid))}
+					vn = append(vn, h.scid...)
+					vn = append(vn, byte(len(h.dcid)))
+					vn = append(vn, h.dcid...)
+					send(append(vn, 0x1a, 0x2a, 0x3a, 0x4a))
+					return
+				case f.mode == "retry-always" || f.mode == "retry" && !retried:
+					retried = true
+					r := []byte{0xf0, 0, 0, 0, 1, byte(len(h.scid))}
+					r = append(r, h.scid...)
+					r = append(r, 8, 9, 9, 9, 9, 9, 9, 9, 9)
+					r = append(r, "token"...)
+					send(append(r, retryTag(h.dcid, r)...))
+					continue
+				case f.mode == "retry" && string(h.token) != "token":
+					continue
+				}
+				c = f.accept(h)
+			}
+			if c == nil {
+				continue
+			}
+			sp := &c.initial
+			if h.typ == quicHandshake {
+				sp = &c.handshake
+			}
+			if sp.read == nil {
+				continue
+			}
+			_, payload, err := openLong(pkt, h.pnOff, sp.read, sp.largest)
+			if err != nil {
+				continue
+			}
+			if f.mode == "close" {
+				send(sealLong(quicInitial, c.dcid, c.scid, nil, c.initial.write, 0, []byte{0x1c, 0x02, 0x00, 0x00}))
+				return
+			}
+			_, err = parseFrames(payload, func(off uint64, data []byte) error {
+				return c.qs.HandleData(sp.level, data)
+			})
+			var ce *quicCloseError
+			if errors.As(err, &ce) {
+				f.closed <- struct{}{}
+				return
+			}
+			var alert tls.AlertError
+			if errors.As(err, &alert) {
+				send(sealLong(quicInitial, c.dcid, c.scid, nil, c.initial.write, 1, []byte{0x1c, 0x41, byte(alert), 0x06, 0x00}))
+				return
+			}
+			c.events(f.t)
+			for _, sp := range []*quicSpace{&c.initial, &c.handshake} {
+				for sp.sent < len(sp.stream) {
+					send(sealLong(sp.typ, c.dcid, c.scid, nil, sp.write, sp.pn, sp.frames(1000)))
+					sp.pn++
+				}
+			}
+		}
+	}
+}
+
+func (f *fakeQUIC) accept(h longHeader) *fakeConn {
+	c := &fakeConn{
+		scid:      []byte{7, 7, 7, 7},
+		dcid:      append([]byte(nil), h.scid...),
+		initial:   quicSpace{level: tls.QUICEncryptionLevelInitial, typ: quicInitial, largest: -1},
+		handshake: quicSpace{level: tls.QUICEncryptionLevelHandshake, typ: quicHandshake, largest: -1},
+	}
+	c.initial.read, c.initial.write = quicInitialKeys(h.dcid)
+	c.qs = tls.QUICServer(&tls.QUICConfig{TLSConfig: &tls.Config{
+		Certificates: []tls.Certificate{f.cert},
+		NextProtos:   []string{"h3"},
+		MinVersion:   tls.VersionTLS13,
+	}})
+	if err := c.qs.Start(context.Background()); err != nil {
+		f.t.Error(err)
+	}
+	return c
+}
+
+func (c *fakeConn) events(t *testing.T) {
+	for {
+		ev := c.qs.NextEvent()
+		sp := &c.initial
+		if ev.Level == tls.QUICEncryptionLevelHandshake {
+			sp = &c.handshake
+		} else if ev.Level != tls.QUICEncryptionLevelInitial {
+			sp = nil
+		}
+		switch ev.Kind {
+		case tls.QUICNoEvent:
+			return
+		case tls.QUICTransportParametersRequired:
+			c.qs.SetTransportParameters(appendTransportParam(nil, 0x0f, c.scid))
+		case tls.QUICSetReadSecret, tls.QUICSetWriteSecret:
+			if sp == nil {
+				continue
+			}
+			k, err := newQUICKeys(ev.Suite, ev.Data)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if ev.Kind == tls.QUICSetReadSecret {
+				sp.read = k
+			} else {
+				sp.write = k
+			}
+		case tls.QUICWriteData:
+			if sp != nil {
+				sp.stream = append(sp.stream, ev.Data...)
+			}
+		}
+	}
+}
+
+func TestPingQUIC(t *testing.T) {
+	tests := []struct {
+		name, mode string
+		edit       func(*Target)
+		err        string
+	}{
+		{"handshake", "", nil, ""},
+		{"retry", "retry", nil, ""},
+		{"retry again", "retry-always", func(t *Target) { t.TimeoutMS = 300 }, "tls_timeout"},
+		{"version negotiation", "vn", nil, "quic_version"},
+		{"connection close", "close", nil, "closed"},
+		{"alpn refused", "", func(t *Target) { t.ALPN = "hq-interop" }, "tls"},
+		{"unverified cert", "", func(t *Target) { t.TLSSkipVerify, t.SNI = false, "quic.test" }, "cert"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, target := startFakeQUIC(t, tt.mode)
+			if tt.edit != nil {
+				tt.edit(&target)
+			}
+			s := pingOnce(context.Background(), target, "127.0.0.1")
+			if tt.err == "" {
+				if !s.OK || s.Err != "" || s.ALPN != "h3" || s.TLSVersion != "1.3" || s.TLSRTTMS <= 0 {
+					t.Fatalf("sample %+v", s)
+				}
+				select {
+				case <-f.closed:
+				case <-time.After(2 * time.Second):
+					t.Error("no CONNECTION_CLOSE after the handshake")
+				}
+				return
+			}
+			if s.OK || s.Err != tt.err {
+				t.Errorf("ok %v, err %q; want %q", s.OK, s.Err, tt.err)
+			}
+		})
+	}
+
+	// nothing listening: the port unreachable comes back as refused
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := pc.LocalAddr().(*net.UDPAddr).Port
+	pc.Close()
+	s := pingOnce(context.Background(), Target{Host: "127.0.0.1", Port: port, Proto: "quic", TimeoutMS: 500}, "127.0.0.1")
+	if s.OK || s.Err != "refused" {
+		t.Errorf("closed port: ok %v, err %q", s.OK, s.Err)
+	}
+}
@@ -0,0 +1,426 @@
+package tcpping
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"sort"
+)
+
+// QUIC v1 packet protection (RFC 9001 section 5) and just enough of the
+// RFC 9000 framing to run a handshake: long-header packets, CRYPTO, ACK,
+// PADDING, PING and CONNECTION_CLOSE.
+
+// Long header packet types.
+const (
+	quicInitial   = 0
+	quicZeroRTT   = 1
+	quicHandshake = 2
+	quicRetry     = 3
+)
+
+// QUIC v1 initial salt (RFC 9001 section 5.2).
+var quicInitialSalt = []byte{
+	0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17,
+	0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a,
+}
+
+// Retry integrity key and nonce (RFC 9001 section 5.8).
+var (
+	quicRetryKey   = []byte{0xbe, 0x0c, 0x69, 0x0b, 0x9f, 0x66, 0x57, 0x5a, 0x1d, 0x76, 0x6b, 0x54, 0xe3, 0x68, 0xc8, 0x4e}
+	quicRetryNonce = []byte{0x46, 0x15, 0x99, 0xd3, 0x5d, 0x63, 0x2b, 0xf2, 0x23, 0x98, 0x25, 0xbb}
+)
+
+var errQUICPacket = errors.New("quic: malformed packet")
+
+// quicCloseError is a CONNECTION_CLOSE received from the peer.
+type quicCloseError struct {
+	code   uint64
+	reason string
+}
+
+func (e *quicCloseError) Error() string {
+	return fmt.Sprintf("quic: connection closed by peer (0x%x %q)", e.code, e.reason)
+}
+
+// quicKeys protects one direction of one encryption level.
+type quicKeys struct {
+	aead cipher.AEAD
+	iv   []byte
+	mask func(sample []byte) []byte // header protection mask, 5 bytes
+}
+
+func newQUICKeys(suite uint16, secret []byte) (*quicKeys, error) {
+	h, keyLen := sha256.New, 16
+	switch suite {
+	case tls.TLS_AES_128_GCM_SHA256:
+	case tls.TLS_AES_256_GCM_SHA384:
+		h, keyLen = sha512.New384, 32
+	case tls.TLS_CHACHA20_POLY1305_SHA256:
+		keyLen = 32
+	default:
+		return nil, fmt.Errorf("quic: unsupported cipher suite 0x%04x", suite)
+	}
+	key := hkdfExpandLabel(h, secret, "quic key", keyLen)
+	hp := hkdfExpandLabel(h, secret, "quic hp", keyLen)
+	k := &quicKeys{iv: hkdfExpandLabel(h, secret, "quic iv", 12)}
+
+	if suite == tls.TLS_CHACHA20_POLY1305_SHA256 {
+		k.aead = chachaAEAD(key)
+		k.mask = func(sample []byte) []byte {
+			mask := make([]byte, 5)
+			chachaXOR(mask, mask, hp, binary.LittleEndian.Uint32(sample), sample[4:16])
+			return mask
+		}
+		return k, nil
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if k.aead, err = cipher.NewGCM(block); err != nil {
+		return nil, err
+	}
+	hpBlock, err := aes.NewCipher(hp)
+	if err != nil {
+		return nil, err
+	}
+	k.mask = func(sample []byte) []byte {
+		mask := make([]byte, 16)
+		hpBlock.Encrypt(mask, sample)
+		return mask[:5]
+	}
+	return k, nil
+}
+
+// quicInitialKeys derives the Initial keys of both sides from the
+// client's first Destination Connection ID.
+func quicInitialKeys(dcid []byte) (client, server *quicKeys) {
+	initial := hkdfExtract(quicInitialSalt, dcid)
+	// AES-128-GCM with a 32-byte secret can't fail
+	client, _ = newQUICKeys(tls.TLS_AES_128_GCM_SHA256, hkdfExpandLabel(sha256.New, initial, "client in", 32))
+	server, _ = newQUICKeys(tls.TLS_AES_128_GCM_SHA256, hkdfExpandLabel(sha256.New, initial, "server in", 32))
+	return client, server
+}
+
+func (k *quicKeys) nonce(pn uint64) []byte {
+	n := append([]byte(nil), k.iv...)
+	for i := 0; i < 8; i++ {
+		n[len(n)-1-i] ^= byte(pn >> (8 * i))
+	}
+	return n
+}
+
+// longHeader is a parsed long header. For Initial, 0-RTT and Handshake
+// packets pnOff is where the (protected) packet number starts.
+type longHeader struct {
+	typ        byte
+	version    uint32
+	dcid, scid []byte
+	token      []byte // Initial and Retry
+	pnOff      int
+	end        int    // length of this packet within the datagram
+	versions   []byte // Version Negotiation: the supported versions
+}
+
+// parseLong parses the long header packet at the start of a datagram.
+func parseLong(b []byte) (longHeader, error) {
+	var h longHeader
+	if len(b) < 7 || b[0]&0x80 == 0 {
+		return h, errQUICPacket
+	}
+	h.version = binary.BigEndian.Uint32(b[1:5])
+	p := 5
+	for _, cid := range []*[]byte{&h.dcid, &h.scid} {
+		if p >= len(b) || int(b[p]) > 20 || p+1+int(b[p]) > len(b) {
+			return h, errQUICPacket
+		}
+		*cid = b[p+1 : p+1+int(b[p])]
+		p += 1 + int(b[p])
+	}
+	if h.version == 0 {
+		h.versions, h.end = b[p:], len(b)
+		return h, nil
+	}
+	if h.version != 1 {
+		// the rest of the header depends on the version
+		h.end = len(b)
+		return h, nil
+	}
+	h.typ = b[0] >> 4 & 3
+	if h.typ == quicRetry {
+		if len(b)-p < 16 {
+			return h, errQUICPacket
+		}
+		h.token, h.end = b[p:len(b)-16], len(b)
+		return h, nil
+	}
+	if h.typ == quicInitial {
+		n, l := readVarint(b[p:])
+		if l == 0 || uint64(len(b)-p-l) < n {
+			return h, errQUICPacket
+		}
+		h.token = b[p+l : p+l+int(n)]
+		p += l + int(n)
+	}
+	n, l := readVarint(b[p:])
+	if l == 0 || uint64(len(b)-p-l) < n || n < 20 {
+		return h, errQUICPacket
+	}
+	h.pnOff = p + l
+	h.end = h.pnOff + int(n)
+	return h, nil
+}
+
+// sealLong builds a protected long header packet with a 4-byte packet
+// number. payload must keep the packet under 16 KiB.
+func sealLong(typ byte, dcid, scid, token []byte, k *quicKeys, pn uint64, payload []byte) []byte {
+	const pnLen = 4
+	b := []byte{0xc0 | typ<<4 | (pnLen - 1), 0, 0, 0, 1}
+	b = append(b, byte(len(dcid)))
+	b = append(b, dcid...)
+	b = append(b, byte(len(scid)))
+	b = append(b, scid...)
+	if typ == quicInitial {
+		b = appendVarint(b, uint64(len(token)))
+		b = append(b, token...)
+	}
+	length := pnLen + len(payload) + k.aead.Overhead()
+	b = append(b, byte(0x40|length>>8), byte(length))
+	pnOff := len(b)
+	b = binary.BigEndian.AppendUint32(b, uint32(pn))
+	b = append(b, k.aead.Seal(nil, k.nonce(pn), payload, b)...)
+
+	mask := k.mask(b[pnOff+4 : pnOff+20])
+	b[0] ^= mask[0] & 0x0f
+	for i := 0; i < pnLen; i++ {
+		b[pnOff+i] ^= mask[1+i]
+	}
+	return b
+}
+
+// quicOverhead is what sealLong adds to a payload.
+func quicOverhead(typ byte, dcid, scid, token []byte) int {
+	n := 7 + len(dcid) + len(scid) + 2 + 4 + 16
+	if typ == quicInitial {
+		n += len(appendVarint(nil, uint64(len(token)))) + len(token)
+	}
+	return n
+}
+
+// openLong removes header protection from pkt (one whole packet, parsed
+// by parseLong) and decrypts it; largest is the largest packet number
+// received so far at that level, -1 if none.
+func openLong(pkt []byte, pnOff int, k *quicKeys, largest int64) (uint64, []byte, error) {
+	if pnOff+20 > len(pkt) {
+		return 0, nil, errQUICPacket
+	}
+	b := append([]byte(nil), pkt...)
+	mask := k.mask(b[pnOff+4 : pnOff+20])
+	b[0] ^= mask[0] & 0x0f
+	pnLen := int(b[0]&3) + 1
+	var truncated uint64
+	for i := 0; i < pnLen; i++ {
+		b[pnOff+i] ^= mask[1+i]
+		truncated = truncated<<8 | uint64(b[pnOff+i])
+	}
+	if b[0]&0x0c != 0 {
+		return 0, nil, errQUICPacket // reserved bits
+	}
+	pn := decodePacketNumber(largest, truncated, pnLen*8)
+	payload, err := k.aead.Open(nil, k.nonce(pn), b[pnOff+pnLen:], b[:pnOff+pnLen])
+	if err != nil {
+		return 0, nil, err
+	}
+	return pn, payload, nil
+}
+
+// decodePacketNumber is RFC 9000 appendix A.3.
+func decodePacketNumber(largest int64, truncated uint64, bits int) uint64 {
+	expected := uint64(largest + 1)
+	win := uint64(1) << bits
+	hwin, mask := win/2, win-1
+	candidate := expected&^mask | truncated
+	switch {
+	case candidate+hwin <= expected && candidate < 1<<62-win:
+		return candidate + win
+	case candidate > expected+hwin && candidate >= win:
+		return candidate - win
+	}
+	return candidate
+}
+
+// retryTag is the Retry Integrity Tag of a Retry packet (without its
+// tag) sent in reply to an Initial for odcid.
+func retryTag(odcid, retry []byte) []byte {
+	block, _ := aes.NewCipher(quicRetryKey)
+	aead, _ := cipher.NewGCM(block)
+	pseudo := append([]byte{byte(len(odcid))}, odcid...)
+	pseudo = append(pseudo, retry...)
+	return aead.Seal(nil, quicRetryNonce, nil, pseudo)
+}
+
+// parseFrames walks a decrypted payload, handing CRYPTO data to crypto.
+// It reports whether the packet needs acknowledging; a CONNECTION_CLOSE
+// comes back as a *quicCloseError.
+func parseFrames(b []byte, crypto func(off uint64, data []byte) error) (bool, error) {
+	eliciting := false
+	for len(b) > 0 {
+		typ, l := readVarint(b)
+		if l == 0 {
+			return eliciting, errQUICPacket
+		}
+		b = b[l:]
+		var f [4]uint64
+		switch typ {
+		case 0x00: // PADDING
+			continue
+		case 0x01: // PING
+			eliciting = true
+			continue
+		case 0x02, 0x03: // ACK: largest, delay, range count, first range
+			if b, l = readVarints(b, f[:4]); l == 0 {
+				return eliciting, errQUICPacket
+			}
+			n := 2 * f[2] // gap and length per range
+			if typ == 0x03 {
+				n += 3 // ECN counts
+			}
+			for ; n > 0; n-- {
+				if b, l = readVarints(b, f[:1]); l == 0 {
+					return eliciting, errQUICPacket
+				}
+			}
+		case 0x06: // CRYPTO
+			if b, l = readVarints(b, f[:2]); l == 0 || uint64(len(b)) < f[1] {
+				return eliciting, errQUICPacket
+			}
+			eliciting = true
+			if err := crypto(f[0], b[:f[1]]); err != nil {
+				return eliciting, err
+			}
+			b = b[f[1]:]
+		case 0x1c, 0x1d: // CONNECTION_CLOSE
+			n := 3 // error code, frame type, reason length
+			if typ == 0x1d {
+				n = 2
+			}
+			if b, l = readVarints(b, f[:n]); l == 0 || uint64(len(b)) < f[n-1] {
+				return eliciting, errQUICPacket
+			}
+			return eliciting, &quicCloseError{code: f[0], reason: string(b[:f[n-1]])}
+		default:
+			// nothing else is allowed in Initial and Handshake packets
+			return eliciting, errQUICPacket
+		}
+	}
+	return eliciting, nil
+}
+
+// appendACK appends an ACK frame for the packet numbers in pns.
+func appendACK(b []byte, pns []uint64) []byte {
+	pns = append([]uint64(nil), pns...)
+	sort.Slice(pns, func(i, j int) bool { return pns[i] > pns[j] })
+	type span struct{ hi, lo uint64 }
+	var spans []span
+	for _, pn := range pns {
+		switch {
+		case len(spans) > 0 && pn == spans[len(spans)-1].lo:
+		case len(spans) > 0 && pn+1 == spans[len(spans)-1].lo:
+			spans[len(spans)-1].lo = pn
+		default:
+			spans = append(spans, span{pn, pn})
+		}
+	}
+	b = append(b, 0x02)
+	b = appendVarint(b, spans[0].hi)
+	b = appendVarint(b, 0) // ack delay
+	b = appendVarint(b, uint64(len(spans)-1))
+	b = appendVarint(b, spans[0].hi-spans[0].lo)
+	for i := 1; i < len(spans); i++ {
+		b = appendVarint(b, spans[i-1].lo-spans[i].hi-2)
+		b = appendVarint(b, spans[i].hi-spans[i].lo)
+	}
+	return b
+}
+
+func hkdfExtract(salt, ikm []byte) []byte {
+	m := hmac.New(sha256.New, salt)
+	m.Write(ikm)
+	return m.Sum(nil)
+}
+
+// hkdfExpandLabel implements TLS 1.3 HKDF-Expand-Label with an empty context.
+func hkdfExpandLabel(h func() hash.Hash, secret []byte, label string, length int) []byte {
+	full := "tls13 " + label
+	info := []byte{byte(length >> 8), byte(length), byte(len(full))}
+	info = append(info, full...)
+	info = append(info, 0x00)
+
+	var out, prev []byte
+	for i := byte(1); len(out) < length; i++ {
+		m := hmac.New(h, secret)
+		m.Write(prev)
+		m.Write(info)
+		m.Write([]byte{i})
+		prev = m.Sum(nil)
+		out = append(out, prev...)
+	}
+	return out[:length]
+}
+
+func appendVarint(b []byte, v uint64) []byte {
+	switch {
+	case v < 1<<6:
+		return append(b, byte(v))
+	case v < 1<<14:
+		return append(b, byte(0x40|v>>8), byte(v))
+	case v < 1<<30:
+		return append(b, byte(0x80|v>>24), byte(v>>16), byte(v>>8), byte(v))
+	default:
+		return append(b, byte(0xc0|v>>56), byte(v>>48), byte(v>>40), byte(v>>32),
+			byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	}
+}
+
+// readVarint decodes a variable-length integer; n is 0 if b is too short.
+func readVarint(b []byte) (v uint64, n int) {
+	if len(b) == 0 {
+		return 0, 0
+	}
+	n = 1 << (b[0] >> 6)
+	if len(b) < n {
+		return 0, 0
+	}
+	v = uint64(b[0] & 0x3f)
+	for _, c := range b[1:n] {
+		v = v<<8 | uint64(c)
+	}
+	return v, n
+}
+
+// readVarints decodes len(out) varints and returns the rest of b; n is 0
+// if b is too short.
+func readVarints(b []byte, out []uint64) (rest []byte, n int) {
+	for i := range out {
+		v, l := readVarint(b)
+		if l == 0 {
+			return b, 0
+		}
+		out[i], b, n = v, b[l:], n+l
+	}
+	return b, n
+}
+
+func appendTransportParam(b []byte, id uint64, val []byte) []byte {
+	b = appendVarint(b, id)
+	b = appendVarint(b, uint64(len(val)))
+	return append(b, val...)
+}
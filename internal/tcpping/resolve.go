@@ -0,0 +1,88 @@
+package tcpping
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const dnsCacheTTL = 5 * time.Minute
+
+type dnsEntry struct {
+	ip      string
+	expires time.Time // zero = never (pinned)
+}
+
+var (
+	dnsMu    sync.Mutex
+	dnsCache = map[string]dnsEntry{}
+)
+
+var errNoAddr = errors.New("no address for family")
+
+// resolve picks the IP to dial for t according to its resolve_mode and
+// returns how long an actual lookup took (0 when served from cache).
+func resolve(ctx context.Context, t Target) (string, time.Duration, error) {
+	if ip := net.ParseIP(t.Host); ip != nil {
+		return t.Host, 0, nil
+	}
+	if t.IP != "" && net.ParseIP(t.IP) != nil {
+		return t.IP, 0, nil
+	}
+
+	mode := t.ResolveMode
+	if mode == "" {
+		mode = "cache"
+	}
+	key := t.Host + "/" + itoa(t.IPVer)
+
+	if mode != "per-round" {
+		dnsMu.Lock()
+		e, ok := dnsCache[key]
+		dnsMu.Unlock()
+		if ok && (e.expires.IsZero() || time.Now().Before(e.expires)) {
+			return e.ip, 0, nil
+		}
+	}
+
+	start := time.Now()
+	ip, err := lookup(ctx, t.Host, t.IPVer)
+	took := time.Since(start)
+	if err != nil {
+		return "", took, err
+	}
+
+	if mode != "per-round" {
+		e := dnsEntry{ip: ip}
+		if mode != "pinned" {
+			e.expires = time.Now().Add(dnsCacheTTL)
+		}
+		dnsMu.Lock()
+		dnsCache[key] = e
+		dnsMu.Unlock()
+	}
+	return ip, took, nil
+}
+
+// Resolve returns the address probes of t dial, from the same cache.
+func Resolve(ctx context.Context, t Target) (string, error) {
+	ip, _, err := resolve(ctx, t)
+	return ip, err
+}
+
+func lookup(ctx context.Context, host string, ipVer int) (string, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	for _, a := range addrs {
+		is4 := a.IP.To4() != nil
+		if ipVer == 4 && !is4 || ipVer == 6 && is4 {
+			continue
+		}
+		return a.IP.String(), nil
+	}
+	return "", errNoAddr
+}
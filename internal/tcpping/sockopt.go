@@ -0,0 +1,94 @@
+package tcpping
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// SocketOptions applies to every probe socket so policy routing and
+// firewalls can pick agent probes out of other traffic.
+type SocketOptions struct {
+	// Bind to a random source port in [SrcPortMin, SrcPortMax] (0 = any).
+	SrcPortMin int
+	SrcPortMax int
+	// Mark sets SO_MARK (fwmark) on Linux; needs CAP_NET_ADMIN.
+	Mark int
+}
+
+var sockOpts atomic.Pointer[SocketOptions]
+
+// SetSocketOptions replaces the options used by subsequent probes.
+func SetSocketOptions(o SocketOptions) {
+	sockOpts.Store(&o)
+}
+
+func currentSocketOptions() SocketOptions {
+	if o := sockOpts.Load(); o != nil {
+		return *o
+	}
+	return SocketOptions{}
+}
+
+// ParsePortRange parses "40000-40999" (or a single port). "" means any.
+func ParsePortRange(s string) (lo, hi int, err error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, 0, nil
+	}
+	a, b, found := strings.Cut(s, "-")
+	if lo, err = strconv.Atoi(strings.TrimSpace(a)); err != nil {
+		return 0, 0, fmt.Errorf("bad port range %q", s)
+	}
+	hi = lo
+	if found {
+		if hi, err = strconv.Atoi(strings.TrimSpace(b)); err != nil {
+			return 0, 0, fmt.Errorf("bad port range %q", s)
+		}
+	}
+	if lo < 1 || hi > 65535 || lo > hi {
+		return 0, 0, fmt.Errorf("bad port range %q", s)
+	}
+	return lo, hi, nil
+}
+
+// Binding a random port from a small range can collide with a socket still
+// in TIME_WAIT towards the same target; try a few ports before giving up.
+const srcPortAttempts = 4
+
+// dial opens a probe socket honouring the current SocketOptions.
+func dial(ctx context.Context, network, addr string, timeout time.Duration) (net.Conn, error) {
+	o := currentSocketOptions()
+	d := net.Dialer{Timeout: timeout}
+	if o.Mark != 0 || o.SrcPortMin > 0 {
+		d.Control = control(o.Mark, o.SrcPortMin > 0)
+	}
+	if o.SrcPortMin <= 0 {
+		return d.DialContext(ctx, network, addr)
+	}
+
+	var err error
+	for i := 0; i < srcPortAttempts; i++ {
+		port := o.SrcPortMin + rand.Intn(o.SrcPortMax-o.SrcPortMin+1)
+		if strings.HasPrefix(network, "udp") {
+			d.LocalAddr = &net.UDPAddr{Port: port}
+		} else {
+			d.LocalAddr = &net.TCPAddr{Port: port}
+		}
+		var c net.Conn
+		if c, err = d.DialContext(ctx, network, addr); err == nil {
+			return c, nil
+		}
+		if !errors.Is(err, syscall.EADDRINUSE) && !errors.Is(err, syscall.EADDRNOTAVAIL) {
+			return nil, err
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package tcpping
+
+import (
+	"errors"
+	"syscall"
+)
+
+var errNoMark = errors.New("fwmark (SO_MARK) is only supported on linux")
+
+func control(mark int, _ bool) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		if mark != 0 {
+			return errNoMark
+		}
+		return nil
+	}
+}
@@ -0,0 +1,85 @@
+package tcpping
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// aggregate folds several attempts against one target into a single Sample
+// carrying min/avg/max/p95 RTT, jitter (mean delta between consecutive RTTs)
+// and loss. Attempts that never ran (context expired) count as lost.
+func aggregate(t Target, sent int, attempts []Sample) Sample {
+	s := newSample(t)
+	s.Sent = sent
+
+	rtts := make([]float64, 0, len(attempts))
+	var tlsSum time.Duration
+	for _, a := range attempts {
+		if a.OK {
+			rtts = append(rtts, ms(a.rtt))
+			tlsSum += a.tlsRTT
+			s.TLSVersion, s.ALPN = a.TLSVersion, a.ALPN
+		} else if a.Err != "" {
+			s.Err = a.Err
+		}
+	}
+	if len(attempts) < sent && s.Err == "" {
+		s.Err = "timeout"
+	}
+
+	s.Recv = len(rtts)
+	s.rtts = rtts
+	s.LossPct = round2(float64(sent-s.Recv) * 100.0 / float64(sent))
+	if s.Recv == 0 {
+		return s
+	}
+	s.OK = true
+	s.Err = ""
+
+	var sum, jit float64
+	for i, v := range rtts {
+		sum += v
+		if i > 0 {
+			jit += math.Abs(v - rtts[i-1])
+		}
+	}
+	if len(rtts) > 1 {
+		s.JitterMS = round2(jit / float64(len(rtts)-1))
+	}
+
+	sorted := append([]float64(nil), rtts...)
+	sort.Float64s(sorted)
+	s.RTTMinMS = round2(sorted[0])
+	s.RTTMaxMS = round2(sorted[len(sorted)-1])
+	s.RTTAvgMS = round2(sum / float64(len(rtts)))
+	s.RTTP95MS = round2(percentile(sorted, 95))
+	s.RTTMS = int64(math.Round(s.RTTAvgMS))
+	if tlsSum > 0 {
+		s.TLSRTTMS = round2(ms(tlsSum) / float64(len(rtts)))
+	}
+	return s
+}
+
+// percentile uses nearest-rank on an already sorted slice.
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100.0 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	if rank > len(sorted) {
+		rank = len(sorted)
+	}
+	return sorted[rank-1]
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func round2(v float64) float64 {
+	return math.Round(v*100) / 100
+}
@@ -0,0 +1,153 @@
+package tcpping
+
+import (
+	"math"
+	"sort"
+)
+
+// DefaultHistogramMS are the upper bounds (ms) of the RTT histogram
+// buckets of a Summary; one more bucket counts everything slower.
+var DefaultHistogramMS = []float64{5, 10, 20, 50, 100, 200, 500, 1000}
+
+// Summary folds the samples of one target over a window: how many rounds
+// ran and answered, attempts sent and received, RTT percentiles over every
+// answered attempt, a histogram of them, and the errors seen.
+type Summary struct {
+	ID       string `json:"id,omitempty"`
+	Province string `json:"province,omitempty"`
+	Carrier  string `json:"carrier,omitempty"`
+	IPVer    int    `json:"ip_ver,omitempty"`
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Label    string `json:"label,omitempty"`
+	Proto    string `json:"proto,omitempty"`
+	IP       string `json:"ip,omitempty"` // the address last dialed
+
+	Rounds   int     `json:"rounds"`
+	OKRounds int     `json:"ok_rounds"`
+	Sent     int     `json:"sent"`
+	Recv     int     `json:"recv"`
+	LossPct  float64 `json:"loss_pct"`
+
+	RTTMinMS float64 `json:"rtt_min_ms,omitempty"`
+	RTTAvgMS float64 `json:"rtt_avg_ms,omitempty"`
+	RTTP50MS float64 `json:"rtt_p50_ms,omitempty"`
+	RTTP95MS float64 `json:"rtt_p95_ms,omitempty"`
+	RTTP99MS float64 `json:"rtt_p99_ms,omitempty"`
+	RTTMaxMS float64 `json:"rtt_max_ms,omitempty"`
+	JitterMS float64 `json:"jitter_ms,omitempty"`
+
+	// Hist counts answered attempts per bucket of the histogram bounds.
+	Hist []int `json:"hist,omitempty"`
+	// Errs counts the failed rounds by error.
+	Errs map[string]int `json:"errs,omitempty"`
+}
+
+// Aggregator collects samples per target until Flush.
+type Aggregator struct {
+	bounds []float64
+	order  []string
+	acc    map[string]*summaryAcc
+}
+
+type summaryAcc struct {
+	s    Summary
+	rtts []float64 // in the order measured, for jitter
+}
+
+// NewAggregator returns an empty Aggregator with the given ascending
+// histogram bounds (DefaultHistogramMS when empty).
+func NewAggregator(bounds []float64) *Aggregator {
+	if len(bounds) == 0 {
+		bounds = DefaultHistogramMS
+	}
+	return &Aggregator{bounds: bounds, acc: map[string]*summaryAcc{}}
+}
+
+// Bounds are the histogram bounds of the summaries.
+func (g *Aggregator) Bounds() []float64 { return g.bounds }
+
+// Len is the number of targets with samples.
+func (g *Aggregator) Len() int { return len(g.order) }
+
+// Add folds in one round's sample of the target known as key.
+func (g *Aggregator) Add(key string, s Sample) {
+	a := g.acc[key]
+	if a == nil {
+		a = &summaryAcc{s: Summary{
+			ID: s.ID, Province: s.Province, Carrier: s.Carrier, IPVer: s.IPVer,
+			Host: s.Host, Port: s.Port, Label: s.Label, Proto: s.Proto,
+		}}
+		g.acc[key] = a
+		g.order = append(g.order, key)
+	}
+	sum := &a.s
+	if s.IP != "" {
+		sum.IP = s.IP
+	}
+	sum.Rounds++
+	switch {
+	case s.Sent > 0:
+		sum.Sent += s.Sent
+		sum.Recv += s.Recv
+		a.rtts = append(a.rtts, s.rtts...)
+	default:
+		sum.Sent++
+		if s.OK {
+			sum.Recv++
+			a.rtts = append(a.rtts, ms(s.rtt))
+		}
+	}
+	if s.OK {
+		sum.OKRounds++
+	} else if s.Err != "" {
+		if sum.Errs == nil {
+			sum.Errs = map[string]int{}
+		}
+		sum.Errs[s.Err]++
+	}
+}
+
+// Flush returns the summaries, in the order targets were first added, and
+// empties g.
+func (g *Aggregator) Flush() []Summary {
+	out := make([]Summary, 0, len(g.order))
+	for _, k := range g.order {
+		out = append(out, g.acc[k].summary(g.bounds))
+	}
+	g.order, g.acc = nil, map[string]*summaryAcc{}
+	return out
+}
+
+func (a *summaryAcc) summary(bounds []float64) Summary {
+	s := a.s
+	if s.Sent > 0 {
+		s.LossPct = round2(float64(s.Sent-s.Recv) * 100 / float64(s.Sent))
+	}
+	if len(a.rtts) == 0 {
+		return s
+	}
+	var sum, jit float64
+	for i, v := range a.rtts {
+		sum += v
+		if i > 0 {
+			jit += math.Abs(v - a.rtts[i-1])
+		}
+	}
+	if len(a.rtts) > 1 {
+		s.JitterMS = round2(jit / float64(len(a.rtts)-1))
+	}
+	sorted := append([]float64(nil), a.rtts...)
+	sort.Float64s(sorted)
+	s.RTTMinMS = round2(sorted[0])
+	s.RTTMaxMS = round2(sorted[len(sorted)-1])
+	s.RTTAvgMS = round2(sum / float64(len(sorted)))
+	s.RTTP50MS = round2(percentile(sorted, 50))
+	s.RTTP95MS = round2(percentile(sorted, 95))
+	s.RTTP99MS = round2(percentile(sorted, 99))
+	s.Hist = make([]int, len(bounds)+1)
+	for _, v := range sorted {
+		s.Hist[sort.SearchFloat64s(bounds, v)]++
+	}
+	return s
+}
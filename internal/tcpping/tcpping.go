@@ -15,6 +15,35 @@ type Target struct {
 	Port     int    `json:"port"`
 	Label    string `json:"label,omitempty"`
 	TimeoutMS int   `json:"timeout_ms,omitempty"`
+
+	// Proto selects the probe kind: "tcp" (default), "udp" or "quic" (a
+	// full QUIC handshake, verified like a tls one).
+	Proto string `json:"proto,omitempty"`
+	// Payload is sent as-is for udp probes (default: "kokoro-ping").
+	Payload string `json:"payload,omitempty"`
+	// ALPN used by quic probes (default: "h3").
+	ALPN string `json:"alpn,omitempty"`
+
+	// Count is the number of attempts per round (default 1, max 20).
+	Count int `json:"count,omitempty"`
+
+	// ResolveMode: "cache" (default, reuse answers for 5m), "per-round"
+	// (resolve every round) or "pinned" (always dial IP, or the first answer).
+	ResolveMode string `json:"resolve_mode,omitempty"`
+	IP          string `json:"ip,omitempty"`
+
+	// TLS completes a TLS handshake after the TCP connect (tcp only).
+	// ALPN, when set, is offered instead of h2/http1.1. TLSSkipVerify and
+	// SNI apply to quic probes too.
+	TLS           bool   `json:"tls,omitempty"`
+	TLSSkipVerify bool   `json:"tls_skip_verify,omitempty"`
+	SNI           string `json:"sni,omitempty"` // default: host
+
+	// Scheduling (used by the agent loop): own interval instead of the
+	// global one, and an optional 5-field cron window, e.g. "* 1-5 * * *"
+	// to probe only between 01:00 and 05:59.
+	IntervalSec int    `json:"interval_sec,omitempty"`
+	Schedule    string `json:"schedule,omitempty"`
 }
 
 type Sample struct {
@@ -25,46 +54,131 @@ type Sample struct {
 	Host     string `json:"host"`
 	Port     int    `json:"port"`
 	Label    string `json:"label,omitempty"`
+	Proto    string `json:"proto,omitempty"`
+
+	// DNS: the address actually dialed and how long resolving took (0 on cache hit)
+	IP        string  `json:"ip,omitempty"`
+	ResolveMS float64 `json:"resolve_ms,omitempty"`
 
 	OK    bool   `json:"ok"`
-	RTTMS int64  `json:"rtt_ms,omitempty"`
+	RTTMS int64  `json:"rtt_ms,omitempty"` // avg when count > 1
 	Err   string `json:"err,omitempty"`
+
+	// TLS mode: handshake time on top of connect, and what was negotiated
+	TLSRTTMS   float64 `json:"tls_rtt_ms,omitempty"`
+	TLSVersion string  `json:"tls_version,omitempty"`
+	ALPN       string  `json:"alpn,omitempty"`
+
+	// Multi-attempt stats (only when count > 1)
+	Sent     int     `json:"sent,omitempty"`
+	Recv     int     `json:"recv,omitempty"`
+	LossPct  float64 `json:"loss_pct,omitempty"`
+	RTTMinMS float64 `json:"rtt_min_ms,omitempty"`
+	RTTAvgMS float64 `json:"rtt_avg_ms,omitempty"`
+	RTTMaxMS float64 `json:"rtt_max_ms,omitempty"`
+	RTTP95MS float64 `json:"rtt_p95_ms,omitempty"`
+	JitterMS float64 `json:"jitter_ms,omitempty"`
+
+	rtt    time.Duration // exact RTT of a single attempt
+	tlsRTT time.Duration
+	rtts   []float64 // RTTs (ms) of the answered attempts, when count > 1
 }
 
+const maxCount = 20
+
+// Ping probes a target once, or Count times with loss/jitter stats.
+// The host is resolved up front so DNS time never lands in the RTT.
 func Ping(ctx context.Context, t Target) Sample {
-	s := Sample{
+	ip, took, err := resolve(ctx, t)
+	if err != nil {
+		s := newSample(t)
+		s.Err = "dns"
+		s.ResolveMS = ms(took)
+		return s
+	}
+
+	var s Sample
+	n := t.Count
+	if n <= 1 {
+		s = pingOnce(ctx, t, ip)
+	} else {
+		if n > maxCount {
+			n = maxCount
+		}
+		attempts := make([]Sample, 0, n)
+		for i := 0; i < n; i++ {
+			if ctx.Err() != nil {
+				break
+			}
+			attempts = append(attempts, pingOnce(ctx, t, ip))
+		}
+		s = aggregate(t, n, attempts)
+	}
+	s.IP = ip
+	s.ResolveMS = round2(ms(took))
+	return s
+}
+
+func newSample(t Target) Sample {
+	return Sample{
 		ID: t.ID, Province: t.Province, Carrier: t.Carrier, IPVer: t.IPVer,
-		Host: t.Host, Port: t.Port, Label: t.Label,
+		Host: t.Host, Port: t.Port, Label: t.Label, Proto: t.Proto,
 	}
+}
+
+func pingOnce(ctx context.Context, t Target, ip string) Sample {
+	s := newSample(t)
 
 	timeout := time.Duration(t.TimeoutMS) * time.Millisecond
 	if timeout <= 0 {
 		timeout = 1500 * time.Millisecond
 	}
 
-	network := "tcp"
-	if t.IPVer == 4 {
-		network = "tcp4"
-	} else if t.IPVer == 6 {
-		network = "tcp6"
+	addr := net.JoinHostPort(ip, itoa(t.Port))
+
+	switch t.Proto {
+	case "", "tcp":
+	case "udp":
+		return pingUDP(ctx, t, s, addr, timeout)
+	case "quic":
+		return pingQUIC(ctx, t, s, addr, timeout)
+	default:
+		s.Err = "badproto"
+		return s
 	}
 
-	addr := net.JoinHostPort(t.Host, itoa(t.Port))
+	network := family("tcp", t.IPVer)
 
-	d := net.Dialer{Timeout: timeout}
 	start := time.Now()
-	conn, err := d.DialContext(ctx, network, addr)
+	conn, err := dial(ctx, network, addr, timeout)
 	if err != nil {
 		s.OK = false
 		s.Err = shortErr(err)
 		return s
 	}
+	s.rtt = time.Since(start)
+	s.RTTMS = s.rtt.Milliseconds()
+	if t.TLS {
+		s = handshakeTLS(ctx, t, s, conn, timeout)
+		_ = conn.Close()
+		return s
+	}
 	_ = conn.Close()
 	s.OK = true
-	s.RTTMS = time.Since(start).Milliseconds()
 	return s
 }
 
+// family appends the address family suffix ("4"/"6") for ip_ver-pinned targets.
+func family(base string, ipVer int) string {
+	switch ipVer {
+	case 4:
+		return base + "4"
+	case 6:
+		return base + "6"
+	}
+	return base
+}
+
 func itoa(i int) string {
 	// tiny int->string without fmt
 	if i == 0 {
@@ -111,6 +225,9 @@ func shortErr(err error) string {
 	if contains(msg, "too many open files") {
 		return "fdlimit"
 	}
+	if contains(msg, "operation not permitted") || contains(msg, "only supported on linux") {
+		return "sockopt" // fwmark without CAP_NET_ADMIN / unsupported OS
+	}
 	return "error"
 }
 
@@ -0,0 +1,80 @@
+package tcpping
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"time"
+)
+
+// handshakeTLS runs a client handshake over an already connected socket and
+// records its duration separately from the TCP connect RTT already in s.
+func handshakeTLS(ctx context.Context, t Target, s Sample, conn net.Conn, timeout time.Duration) Sample {
+	sni := t.SNI
+	if sni == "" && net.ParseIP(t.Host) == nil {
+		sni = t.Host
+	}
+	protos := []string{"h2", "http/1.1"}
+	if t.ALPN != "" {
+		protos = []string{t.ALPN}
+	}
+	tc := tls.Client(conn, &tls.Config{
+		ServerName:         sni,
+		NextProtos:         protos,
+		InsecureSkipVerify: t.TLSSkipVerify || sni == "",
+	})
+
+	hctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	if err := tc.HandshakeContext(hctx); err != nil {
+		s.Err = tlsErr(err)
+		return s
+	}
+	s.tlsRTT = time.Since(start)
+	s.TLSRTTMS = round2(ms(s.tlsRTT))
+
+	st := tc.ConnectionState()
+	s.TLSVersion = tlsVersionName(st.Version)
+	s.ALPN = st.NegotiatedProtocol
+	s.OK = true
+	return s
+}
+
+func tlsErr(err error) string {
+	var (
+		unknownAuth x509.UnknownAuthorityError
+		hostErr     x509.HostnameError
+		invalid     x509.CertificateInvalidError
+		verifyErr   *tls.CertificateVerificationError
+	)
+	switch {
+	case errors.As(err, &unknownAuth), errors.As(err, &hostErr),
+		errors.As(err, &invalid), errors.As(err, &verifyErr):
+		return "cert"
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return "tls_timeout"
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return "tls_timeout"
+	}
+	return "tls"
+}
+
+func tlsVersionName(v uint16) string {
+	switch v {
+	case tls.VersionTLS10:
+		return "1.0"
+	case tls.VersionTLS11:
+		return "1.1"
+	case tls.VersionTLS12:
+		return "1.2"
+	case tls.VersionTLS13:
+		return "1.3"
+	}
+	return ""
+}
@@ -0,0 +1,51 @@
+package tcpping
+
+import (
+	"context"
+	"time"
+)
+
+// pingUDP sends one datagram and waits for any reply.
+// A reply counts as OK; an ICMP port-unreachable surfaces as "refused"
+// (host reachable, port closed) and still carries the RTT.
+func pingUDP(ctx context.Context, t Target, s Sample, addr string, timeout time.Duration) Sample {
+	payload := t.Payload
+	if payload == "" {
+		payload = "kokoro-ping"
+	}
+
+	start := time.Now()
+	conn, err := dial(ctx, family("udp", t.IPVer), addr, timeout)
+	if err != nil {
+		s.Err = shortErr(err)
+		return s
+	}
+	defer conn.Close()
+
+	deadline := start.Add(timeout)
+	if dl, ok := ctx.Deadline(); ok && dl.Before(deadline) {
+		deadline = dl
+	}
+	_ = conn.SetDeadline(deadline)
+
+	start = time.Now()
+	if _, err := conn.Write([]byte(payload)); err != nil {
+		s.Err = shortErr(err)
+		return s
+	}
+
+	buf := make([]byte, 1500)
+	_, err = conn.Read(buf)
+	rtt := time.Since(start)
+	if err != nil {
+		s.Err = shortErr(err)
+		if s.Err == "refused" {
+			s.RTTMS = rtt.Milliseconds()
+		}
+		return s
+	}
+	s.OK = true
+	s.rtt = rtt
+	s.RTTMS = rtt.Milliseconds()
+	return s
+}
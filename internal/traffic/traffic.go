@@ -0,0 +1,257 @@
+// Package traffic keeps vnstat-like interface byte accounting: counters are
+// accumulated per day across restarts and reboots, persisted in state_dir,
+// and summed into billing months that start on a configurable day.
+package traffic
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Vincentkeio/agent/internal/util"
+)
+
+// keepDays bounds the persisted history.
+const keepDays = 400
+
+const dayLayout = "2006-01-02"
+
+// Counter is bytes received/sent.
+type Counter struct {
+	RX uint64 `json:"rx"`
+	TX uint64 `json:"tx"`
+}
+
+type state struct {
+	Iface  string `json:"iface"`
+	BootID string `json:"boot_id,omitempty"`
+	LastRX uint64 `json:"last_rx"`
+	LastTX uint64 `json:"last_tx"`
+	Since  int64  `json:"since"` // first sample, unix seconds
+
+	Days map[string]*Counter `json:"days"`
+
+	// cap actions already taken in FiredPeriod (by Action.Key)
+	FiredPeriod string          `json:"fired_period,omitempty"`
+	Fired       map[string]bool `json:"fired,omitempty"`
+}
+
+// Store accumulates counter readings of one interface.
+type Store struct {
+	mu    sync.Mutex
+	path  string
+	st    state
+	dirty bool
+}
+
+// Open loads the history from path. A missing or unreadable file starts
+// empty.
+func Open(path string) *Store {
+	s := &Store{path: path}
+	if b, err := os.ReadFile(path); err == nil {
+		_ = json.Unmarshal(b, &s.st)
+	}
+	if s.st.Days == nil {
+		s.st.Days = map[string]*Counter{}
+	}
+	return s
+}
+
+// Add accounts a reading of iface's cumulative counters. The first reading
+// (or the first after switching interfaces) only sets the baseline. After
+// a reboot (new boot id) or a counter reset the new counters count from 0.
+func (s *Store) Add(iface string, rx, tx uint64, now time.Time) {
+	boot := bootID()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := &s.st
+	defer func() {
+		st.Iface, st.BootID, st.LastRX, st.LastTX = iface, boot, rx, tx
+		s.dirty = true
+	}()
+	if st.Since == 0 {
+		st.Since = now.Unix()
+	}
+	if st.Iface != iface {
+		return
+	}
+	drx, dtx := rx-st.LastRX, tx-st.LastTX
+	if (boot != "" && boot != st.BootID) || rx < st.LastRX || tx < st.LastTX {
+		drx, dtx = rx, tx
+	}
+	if drx == 0 && dtx == 0 {
+		return
+	}
+	key := now.Format(dayLayout)
+	c := st.Days[key]
+	if c == nil {
+		c = &Counter{}
+		st.Days[key] = c
+		cut := now.AddDate(0, 0, -keepDays).Format(dayLayout)
+		for k := range st.Days {
+			if k < cut {
+				delete(st.Days, k)
+			}
+		}
+	}
+	c.RX += drx
+	c.TX += dtx
+}
+
+// Usage is the traffic of one billing period.
+type Usage struct {
+	Iface    string `json:"iface"`
+	Start    string `json:"period_start"` // first day, local time
+	End      string `json:"period_end"`   // first day of the next period
+	ResetDay int    `json:"reset_day"`
+	RX       uint64 `json:"rx_bytes"`
+	TX       uint64 `json:"tx_bytes"`
+	Total    uint64 `json:"total_bytes"`
+	Since    int64  `json:"since"` // accounting started (unix seconds)
+}
+
+// Period returns the billing period containing now; resetDay (1-28,
+// anything else means 1) is the day of month it starts on.
+func Period(now time.Time, resetDay int) (start, end time.Time) {
+	if resetDay < 1 || resetDay > 28 {
+		resetDay = 1
+	}
+	y, m, d := now.Date()
+	if d < resetDay {
+		m--
+	}
+	start = time.Date(y, m, resetDay, 0, 0, 0, 0, now.Location())
+	return start, start.AddDate(0, 1, 0)
+}
+
+// Usage sums the days of the billing period containing now.
+func (s *Store) Usage(now time.Time, resetDay int) Usage {
+	start, end := Period(now, resetDay)
+	from, to := start.Format(dayLayout), end.Format(dayLayout)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := Usage{Iface: s.st.Iface, Start: from, End: to, ResetDay: resetDay, Since: s.st.Since}
+	if resetDay < 1 || resetDay > 28 {
+		u.ResetDay = 1
+	}
+	for k, c := range s.st.Days {
+		if k >= from && k < to {
+			u.RX += c.RX
+			u.TX += c.TX
+		}
+	}
+	u.Total = u.RX + u.TX
+	return u
+}
+
+// Counted is the usage a cap applies to: "total" (default), "rx", "tx" or
+// "max" (the larger direction, as some providers bill).
+func (u Usage) Counted(count string) uint64 {
+	switch count {
+	case "rx":
+		return u.RX
+	case "tx":
+		return u.TX
+	case "max":
+		return max(u.RX, u.TX)
+	}
+	return u.Total
+}
+
+// Action is what to do once a monthly cap is AtPct percent used:
+// "warn" (log), "throttle" (stretch the metrics interval for the rest of
+// the period) or "script" (run a command once). A script action from
+// config.json may carry its Command; a pushed one can only name a Script
+// of the local traffic.scripts (see CheckPushed).
+type Action struct {
+	AtPct   float64  `json:"at_pct"`
+	Do      string   `json:"action"`
+	Command []string `json:"command,omitempty"`
+	Script  string   `json:"script,omitempty"`
+}
+
+// Check validates a single action.
+func (a Action) Check() error {
+	if a.AtPct <= 0 {
+		return fmt.Errorf("at_pct %g: want > 0", a.AtPct)
+	}
+	switch a.Do {
+	case "warn", "throttle":
+	case "script":
+		if (len(a.Command) == 0) == (a.Script == "") {
+			return errors.New(`action "script" needs either a command or a script name`)
+		}
+		if len(a.Command) > 0 && a.Command[0] == "" {
+			return errors.New("empty command")
+		}
+	default:
+		return fmt.Errorf("action %q: want warn, throttle or script", a.Do)
+	}
+	return nil
+}
+
+// CheckPushed validates an action from the master: besides Check, a
+// script must be one of the locally configured scripts, by name.
+func (a Action) CheckPushed(scripts map[string][]string) error {
+	if err := a.Check(); err != nil {
+		return err
+	}
+	if len(a.Command) > 0 {
+		return errors.New("a pushed action can't carry a command; name one of traffic.scripts")
+	}
+	if _, ok := scripts[a.Script]; a.Script != "" && !ok {
+		return fmt.Errorf("script %q is not in traffic.scripts", a.Script)
+	}
+	return nil
+}
+
+// Key identifies a for MarkFired.
+func (a Action) Key() string {
+	return strconv.FormatFloat(a.AtPct, 'g', -1, 64) + ":" + a.Do
+}
+
+// MarkFired records that the action with key ran in the period starting
+// at period; it returns false if it already had (also before a restart).
+func (s *Store) MarkFired(period, key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.st.FiredPeriod != period {
+		s.st.FiredPeriod, s.st.Fired = period, map[string]bool{}
+	}
+	if s.st.Fired[key] {
+		return false
+	}
+	s.st.Fired[key] = true
+	s.dirty = true
+	return true
+}
+
+// Save writes the history if it changed since the last save.
+func (s *Store) Save() error {
+	s.mu.Lock()
+	if !s.dirty || s.path == "" {
+		s.mu.Unlock()
+		return nil
+	}
+	b, err := json.Marshal(s.st)
+	s.dirty = false
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return util.WriteFileAtomic(s.path, b, 0644)
+}
+
+// bootID identifies the current boot on Linux ("" elsewhere).
+func bootID() string {
+	b, err := os.ReadFile("/proc/sys/kernel/random/boot_id")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
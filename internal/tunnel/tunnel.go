@@ -0,0 +1,39 @@
+// Package tunnel reports the state of VPN and tunnel interfaces:
+// WireGuard peers (from `wg show all dump`) and the byte counters of
+// tun/tap, GRE, IPIP, SIT, ip6tnl and VXLAN interfaces.
+package tunnel
+
+// staleHandshakeSec is how old a WireGuard handshake may get before the peer
+// is reported stale: a live session re-handshakes every 2 minutes.
+const staleHandshakeSec = 180
+
+// Tunnel is one tunnel interface.
+type Tunnel struct {
+	Name    string `json:"name"`
+	Kind    string `json:"kind"`            // wireguard, tun, tap, gre, ipip, sit, ip6tnl, ip6gre, vxlan
+	State   string `json:"state,omitempty"` // operstate: up, down, unknown
+	RxBytes uint64 `json:"rx_bytes"`
+	TxBytes uint64 `json:"tx_bytes"`
+	RxBPS   uint64 `json:"rx_bps,omitempty"`
+	TxBPS   uint64 `json:"tx_bps,omitempty"`
+
+	// WireGuard only
+	PublicKey  string `json:"public_key,omitempty"`
+	ListenPort int    `json:"listen_port,omitempty"`
+	Peers      []Peer `json:"peers,omitempty"`
+	Err        string `json:"err,omitempty"` // peers unavailable (wg missing, no permission)
+}
+
+// Peer is a WireGuard peer.
+type Peer struct {
+	PublicKey       string   `json:"public_key"`
+	Endpoint        string   `json:"endpoint,omitempty"`
+	AllowedIPs      []string `json:"allowed_ips,omitempty"`
+	LatestHandshake int64    `json:"latest_handshake"` // unix seconds, 0 = never
+	HandshakeAgeSec int64    `json:"handshake_age_sec,omitempty"`
+	RxBytes         uint64   `json:"rx_bytes"`
+	TxBytes         uint64   `json:"tx_bytes"`
+	KeepaliveSec    int      `json:"keepalive_sec,omitempty"`
+	// Stale: no handshake yet, or none for staleHandshakeSec.
+	Stale bool `json:"stale,omitempty"`
+}
@@ -0,0 +1,171 @@
+package tunnel
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const wgTimeout = 5 * time.Second
+
+// arphrdKinds maps /sys/class/net/*/type (ARPHRD_*) to a tunnel kind.
+var arphrdKinds = map[string]string{
+	"768": "ipip",
+	"769": "ip6tnl",
+	"776": "sit",
+	"778": "gre",
+	"823": "ip6gre",
+}
+
+// Collect lists the tunnel interfaces with WireGuard peers filled in.
+func Collect(now time.Time) ([]Tunnel, error) {
+	names, err := filepath.Glob("/sys/class/net/*")
+	if err != nil {
+		return nil, err
+	}
+	var out []Tunnel
+	wg := false
+	for _, p := range names {
+		kind := kindOf(p)
+		if kind == "" {
+			continue
+		}
+		t := Tunnel{
+			Name:    filepath.Base(p),
+			Kind:    kind,
+			State:   readString(filepath.Join(p, "operstate")),
+			RxBytes: readUint(filepath.Join(p, "statistics/rx_bytes")),
+			TxBytes: readUint(filepath.Join(p, "statistics/tx_bytes")),
+		}
+		wg = wg || kind == "wireguard"
+		out = append(out, t)
+	}
+	if wg {
+		peers, err := wgDump(now)
+		for i := range out {
+			if out[i].Kind != "wireguard" {
+				continue
+			}
+			if err != nil {
+				out[i].Err = err.Error()
+				continue
+			}
+			d := peers[out[i].Name]
+			out[i].PublicKey = d.PublicKey
+			out[i].ListenPort = d.ListenPort
+			out[i].Peers = d.Peers
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, nil
+}
+
+// kindOf classifies the interface at /sys/class/net/<name>, or returns ""
+// for non-tunnel interfaces.
+func kindOf(p string) string {
+	for _, l := range strings.Split(readString(filepath.Join(p, "uevent")), "\n") {
+		switch l {
+		case "DEVTYPE=wireguard":
+			return "wireguard"
+		case "DEVTYPE=vxlan":
+			return "vxlan"
+		}
+	}
+	if flags := readString(filepath.Join(p, "tun_flags")); flags != "" {
+		// IFF_TAP = 0x2
+		if v, err := strconv.ParseUint(strings.TrimPrefix(flags, "0x"), 16, 32); err == nil && v&0x2 != 0 {
+			return "tap"
+		}
+		return "tun"
+	}
+	return arphrdKinds[readString(filepath.Join(p, "type"))]
+}
+
+type wgIface struct {
+	PublicKey  string
+	ListenPort int
+	Peers      []Peer
+}
+
+// wgDump parses `wg show all dump`: per interface one line
+//
+//	iface private-key public-key listen-port fwmark
+//
+// followed by one line per peer
+//
+//	iface public-key preshared-key endpoint allowed-ips latest-handshake rx tx keepalive
+func wgDump(now time.Time) (map[string]*wgIface, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), wgTimeout)
+	defer cancel()
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "wg", "show", "all", "dump")
+	cmd.Stderr = &stderr
+	b, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("wg show: %v: %s", err, msg)
+		}
+		return nil, fmt.Errorf("wg show: %v", err)
+	}
+	out := map[string]*wgIface{}
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for sc.Scan() {
+		f := strings.Split(sc.Text(), "\t")
+		switch len(f) {
+		case 5:
+			port, _ := strconv.Atoi(f[3])
+			out[f[0]] = &wgIface{PublicKey: f[2], ListenPort: port}
+		case 9:
+			w := out[f[0]]
+			if w == nil {
+				continue
+			}
+			p := Peer{PublicKey: f[1], Endpoint: none(f[3])}
+			if ips := none(f[4]); ips != "" {
+				p.AllowedIPs = strings.Split(ips, ",")
+			}
+			p.LatestHandshake, _ = strconv.ParseInt(f[5], 10, 64)
+			p.RxBytes, _ = strconv.ParseUint(f[6], 10, 64)
+			p.TxBytes, _ = strconv.ParseUint(f[7], 10, 64)
+			p.KeepaliveSec, _ = strconv.Atoi(f[8]) // "off" -> 0
+			if p.LatestHandshake > 0 {
+				p.HandshakeAgeSec = now.Unix() - p.LatestHandshake
+				if p.HandshakeAgeSec < 0 {
+					p.HandshakeAgeSec = 0
+				}
+			}
+			p.Stale = p.LatestHandshake == 0 || p.HandshakeAgeSec > staleHandshakeSec
+			w.Peers = append(w.Peers, p)
+		}
+	}
+	return out, nil
+}
+
+// none maps wg's "(none)" placeholder to "".
+func none(s string) string {
+	if s == "(none)" {
+		return ""
+	}
+	return s
+}
+
+func readString(path string) string {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+func readUint(path string) uint64 {
+	v, _ := strconv.ParseUint(readString(path), 10, 64)
+	return v
+}
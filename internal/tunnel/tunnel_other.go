@@ -0,0 +1,8 @@
+//go:build !linux
+
+package tunnel
+
+import "time"
+
+// Collect finds nothing without /sys/class/net.
+func Collect(now time.Time) ([]Tunnel, error) { return nil, nil }
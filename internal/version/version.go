@@ -0,0 +1,51 @@
+package version
+
+import (
+	"runtime/debug"
+	"sync"
+)
+
+// Version is the agent release; override with
+// -ldflags "-X github.com/Vincentkeio/agent/internal/version.Version=0.2.0".
+var Version = "0.1.0"
+
+// Commit may be set the same way; otherwise it comes from the Go build info.
+var Commit = ""
+
+var buildOnce sync.Once
+
+// Build returns a short build hash: the VCS revision (12 chars, "+dirty" for
+// modified trees) or "unknown" for builds without VCS stamping.
+func Build() string {
+	buildOnce.Do(func() {
+		if Commit != "" {
+			return
+		}
+		Commit = "unknown"
+		bi, ok := debug.ReadBuildInfo()
+		if !ok {
+			return
+		}
+		var rev string
+		var dirty bool
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				rev = s.Value
+			case "vcs.modified":
+				dirty = s.Value == "true"
+			}
+		}
+		if rev == "" {
+			return
+		}
+		if len(rev) > 12 {
+			rev = rev[:12]
+		}
+		if dirty {
+			rev += "+dirty"
+		}
+		Commit = rev
+	})
+	return Commit
+}
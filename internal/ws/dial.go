@@ -0,0 +1,233 @@
+package ws
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// fallbackDelay is how long an address gets before the next one is tried
+// in parallel (RFC 8305 recommends 250ms).
+const fallbackDelay = 250 * time.Millisecond
+
+// Options tune DialWith.
+type Options struct {
+	InsecureSkipVerify bool
+
+	// ServerName is sent as SNI and verified against the certificate
+	// instead of the URL's host, e.g. to reach the master through a CDN
+	// domain. The HTTP Host header still follows the URL (or Headers).
+	ServerName string
+
+	// ECHConfigList, if set, enables Encrypted Client Hello (TLS 1.3) so
+	// ServerName isn't visible on the wire; the outer SNI becomes the
+	// ECH config's public name. It's the "ech" value of the master's DNS
+	// HTTPS record, decoded.
+	ECHConfigList []byte
+
+	// Pins, if set, must match a certificate of the verified chain (see
+	// Pin) or, with InsecureSkipVerify, the leaf certificate itself.
+	Pins []Pin
+
+	// PreferIP picks the address family tried first: "v4", "v6", or
+	// "auto"/"" (the resolver's order). Either way both families are
+	// raced Happy-Eyeballs style, so a broken one costs fallbackDelay
+	// rather than a full connect timeout.
+	PreferIP string
+
+	// Resolve, if set, returns static addresses for a host name; DNS is
+	// only used when it returns none.
+	Resolve func(host string) []string
+
+	// Subprotocols are offered in Sec-WebSocket-Protocol, most preferred
+	// first. A server that answers without the header is accepted (it
+	// predates negotiation); one that picks something not offered is not.
+	Subprotocols []string
+
+	// KeepAlive is the TCP keepalive period, as net.Dialer.KeepAlive: 0
+	// means 15s, negative turns keepalives off.
+	KeepAlive time.Duration
+
+	// UserTimeout sets TCP_USER_TIMEOUT (linux): the connection fails once
+	// sent data stays unacknowledged this long, instead of after the
+	// kernel's ~15 minutes of retransmits. 0 leaves the system default.
+	UserTimeout time.Duration
+
+	// TLSSessions, if set, caches TLS session tickets so a reconnect can
+	// resume the previous session (one round trip, no certificate
+	// exchange). Share one cache across dials.
+	TLSSessions tls.ClientSessionCache
+
+	// Headers are added to the upgrade request (Authorization, access
+	// proxy tokens, ...). Host replaces the URL's host name and User-Agent
+	// the default; the WebSocket handshake headers themselves can't be
+	// set (see CheckHeaders).
+	Headers map[string]string
+
+	// Trace, if set, receives every dial step.
+	Trace Trace
+}
+
+// CheckECH validates a base64 ECHConfigList (Options.ECHConfigList) and
+// returns it decoded.
+func CheckECH(s string) ([]byte, error) {
+	if s == "" {
+		return nil, nil
+	}
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("not base64: %v", err)
+	}
+	if len(b) < 2 || int(b[0])<<8|int(b[1]) != len(b)-2 {
+		return nil, errors.New("not an ECHConfigList")
+	}
+	return b, setECH(&tls.Config{}, b)
+}
+
+// CheckPreferIP validates an Options.PreferIP value.
+func CheckPreferIP(s string) error {
+	switch s {
+	case "", "auto", "v4", "v6":
+		return nil
+	}
+	return fmt.Errorf("%q: want auto, v4 or v6", s)
+}
+
+// reservedHeaders belong to the handshake itself.
+var reservedHeaders = map[string]bool{
+	"Upgrade":                  true,
+	"Connection":               true,
+	"Sec-Websocket-Key":        true,
+	"Sec-Websocket-Version":    true,
+	"Sec-Websocket-Protocol":   true,
+	"Sec-Websocket-Extensions": true,
+	"Content-Length":           true,
+	"Transfer-Encoding":        true,
+}
+
+// CheckHeaders validates Options.Headers.
+func CheckHeaders(h map[string]string) error {
+	for k, v := range h {
+		if k == "" || strings.IndexFunc(k, notTokenChar) >= 0 {
+			return fmt.Errorf("%q is not a valid header name", k)
+		}
+		if reservedHeaders[http.CanonicalHeaderKey(k)] {
+			return fmt.Errorf("%s is set by the WebSocket handshake", k)
+		}
+		if strings.ContainsAny(v, "\r\n\x00") {
+			return fmt.Errorf("%s: value contains a line break", k)
+		}
+	}
+	return nil
+}
+
+// notTokenChar reports bytes not allowed in a header name (RFC 7230 token).
+func notTokenChar(r rune) bool {
+	if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+		return false
+	}
+	return !strings.ContainsRune("!#$%&'*+-.^_`|~", r)
+}
+
+// orderAddrs interleaves the families (RFC 8305 section 4), starting with
+// the preferred one.
+func orderAddrs(addrs []string, prefer string) []string {
+	var v4, v6 []string
+	for _, a := range addrs {
+		if ip := net.ParseIP(a); ip != nil && ip.To4() == nil {
+			v6 = append(v6, a)
+		} else {
+			v4 = append(v4, a)
+		}
+	}
+	first, second := v4, v6
+	switch prefer {
+	case "v6":
+		first, second = v6, v4
+	case "v4":
+	default:
+		if len(addrs) > 0 && len(v6) > 0 && addrs[0] == v6[0] {
+			first, second = v6, v4
+		}
+	}
+	out := make([]string, 0, len(addrs))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			out = append(out, first[i])
+		}
+		if i < len(second) {
+			out = append(out, second[i])
+		}
+	}
+	return out
+}
+
+// dialAddrs connects to the first address that answers: each attempt gets
+// a head start of fallbackDelay before the next one starts (sooner if it
+// fails), and the losers are cancelled. It returns the first error when
+// every attempt fails.
+func dialAddrs(ctx context.Context, d *net.Dialer, addrs []string, port string) (net.Conn, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("no addresses")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		c   net.Conn
+		err error
+	}
+	results := make(chan result, len(addrs))
+	start := func(addr string) {
+		go func() {
+			c, err := d.DialContext(ctx, "tcp", net.JoinHostPort(addr, port))
+			results <- result{c, err}
+		}()
+	}
+
+	timer := time.NewTimer(fallbackDelay)
+	defer timer.Stop()
+	start(addrs[0])
+	next, running := 1, 1
+	var firstErr error
+	for {
+		select {
+		case <-timer.C:
+		case r := <-results:
+			running--
+			if r.err == nil {
+				cancel()
+				// close connections that complete after the winner
+				go func(n int) {
+					for ; n > 0; n-- {
+						if r := <-results; r.c != nil {
+							r.c.Close()
+						}
+					}
+				}(running)
+				return r.c, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if next >= len(addrs) {
+				if running == 0 {
+					return nil, firstErr
+				}
+				continue
+			}
+		}
+		if next < len(addrs) {
+			start(addrs[next])
+			next++
+			running++
+			timer.Reset(fallbackDelay)
+		}
+	}
+}
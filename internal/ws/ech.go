@@ -0,0 +1,27 @@
+//go:build go1.23
+
+package ws
+
+import (
+	"crypto/tls"
+	"errors"
+)
+
+func setECH(c *tls.Config, list []byte) error {
+	c.EncryptedClientHelloConfigList = list
+	return nil
+}
+
+func echAccepted(st tls.ConnectionState) bool {
+	return st.ECHAccepted
+}
+
+// ECHRetryConfig returns the ECHConfigList a server sent along with
+// rejecting ours (the one to configure instead), or nil.
+func ECHRetryConfig(err error) []byte {
+	var re *tls.ECHRejectionError
+	if errors.As(err, &re) {
+		return re.RetryConfigList
+	}
+	return nil
+}
@@ -0,0 +1,21 @@
+//go:build !go1.23
+
+package ws
+
+import (
+	"crypto/tls"
+	"errors"
+)
+
+var errNoECH = errors.New("ECH needs an agent built with Go 1.23 or newer")
+
+func setECH(c *tls.Config, list []byte) error {
+	if len(list) > 0 {
+		return errNoECH
+	}
+	return nil
+}
+
+func echAccepted(tls.ConnectionState) bool { return false }
+
+func ECHRetryConfig(error) []byte { return nil }
@@ -0,0 +1,91 @@
+package ws
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Pin is a certificate the master's TLS chain must contain, by the SHA-256
+// of its SubjectPublicKeyInfo ("sha256/<base64>", as HPKP and curl's
+// --pinnedpubkey) or of the whole certificate ("cert-sha256/<base64>").
+// An SPKI pin survives re-issuing a certificate for the same key.
+type Pin struct {
+	Cert bool // hash of the DER certificate, not its public key
+	Hash [sha256.Size]byte
+}
+
+// ErrPinMismatch fails a handshake whose chain matches none of the pins.
+var ErrPinMismatch = errors.New("tls: no certificate matches the pinned keys")
+
+// ParsePin reads a pin in either form.
+func ParsePin(s string) (Pin, error) {
+	var p Pin
+	kind, b64, ok := strings.Cut(s, "/")
+	switch {
+	case !ok:
+		return p, fmt.Errorf("%q: want sha256/<base64> or cert-sha256/<base64>", s)
+	case kind == "cert-sha256":
+		p.Cert = true
+	case kind != "sha256":
+		return p, fmt.Errorf("%q: unknown pin type %q", s, kind)
+	}
+	h, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil || len(h) != sha256.Size {
+		return p, fmt.Errorf("%q: not a base64 SHA-256 hash", s)
+	}
+	copy(p.Hash[:], h)
+	return p, nil
+}
+
+// String is the pin in the form ParsePin reads.
+func (p Pin) String() string {
+	kind := "sha256"
+	if p.Cert {
+		kind = "cert-sha256"
+	}
+	return kind + "/" + base64.StdEncoding.EncodeToString(p.Hash[:])
+}
+
+// PinOf returns the pin of c's public key, or of c itself.
+func PinOf(c *x509.Certificate, cert bool) Pin {
+	if cert {
+		return Pin{Cert: true, Hash: sha256.Sum256(c.Raw)}
+	}
+	return Pin{Hash: sha256.Sum256(c.RawSubjectPublicKeyInfo)}
+}
+
+// verifyPins is a tls.Config.VerifyConnection. With verification on, only
+// certificates of a verified chain count (so an intermediate or the root
+// can be pinned): extra certificates a server sends prove nothing, since
+// anyone can append the master's public leaf to their own chain. With
+// insecure set there is no chain, and only the leaf counts. It runs for
+// resumed sessions too.
+func verifyPins(pins []Pin, insecure bool) func(tls.ConnectionState) error {
+	return func(st tls.ConnectionState) error {
+		var certs []*x509.Certificate
+		if insecure {
+			if len(st.PeerCertificates) > 0 {
+				certs = st.PeerCertificates[:1]
+			}
+		} else {
+			for _, chain := range st.VerifiedChains {
+				certs = append(certs, chain...)
+			}
+		}
+		for _, c := range certs {
+			for _, p := range pins {
+				got := PinOf(c, p.Cert)
+				if bytes.Equal(got.Hash[:], p.Hash[:]) {
+					return nil
+				}
+			}
+		}
+		return ErrPinMismatch
+	}
+}
@@ -0,0 +1,24 @@
+package ws
+
+import (
+	"syscall"
+	"time"
+)
+
+// tcpUserTimeout is TCP_USER_TIMEOUT (linux/tcp.h), missing from syscall.
+const tcpUserTimeout = 0x12
+
+// control sets TCP_USER_TIMEOUT: the kernel gives up on the connection
+// once sent data has gone unacknowledged for d.
+func control(d time.Duration) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var serr error
+		err := c.Control(func(fd uintptr) {
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpUserTimeout, int(d.Milliseconds()))
+		})
+		if err != nil {
+			return err
+		}
+		return serr
+	}
+}
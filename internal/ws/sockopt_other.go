@@ -0,0 +1,13 @@
+//go:build !linux
+
+package ws
+
+import (
+	"syscall"
+	"time"
+)
+
+// control is a no-op: TCP_USER_TIMEOUT is linux-only.
+func control(time.Duration) func(network, address string, c syscall.RawConn) error {
+	return nil
+}
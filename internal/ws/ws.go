@@ -7,30 +7,88 @@ import (
 	"crypto/sha1"
 	"crypto/tls"
 	"encoding/base64"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/url"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var (
 	ErrBadHandshake = errors.New("websocket handshake failed")
+	ErrSubprotocol  = errors.New("server chose a subprotocol that was not offered")
+	// ErrUnauthorized comes with ErrBadHandshake when the upgrade is
+	// answered 401 or 403 (missing or rejected Options.Headers credentials).
+	ErrUnauthorized = errors.New("server requires authentication")
 )
 
 type Conn struct {
 	c  net.Conn
 	br *bufio.Reader
 	mu sync.Mutex
+
+	onPong func(payload []byte)
+
+	maskKey [4]byte // writer only, under mu
+	rbuf    []byte  // reader only: reused payload buffer
+
+	lastRead atomic.Int64 // unix ns of the last frame of any kind
+
+	subprotocol string
+}
+
+// maxPooledFrame bounds the buffers kept for reuse; larger frames get a
+// one-off allocation so a rare big message doesn't pin memory.
+const maxPooledFrame = 64 << 10
+
+var framePool = sync.Pool{New: func() any {
+	b := make([]byte, 0, 512)
+	return &b
+}}
+
+// maskBytes XORs b in place with the repeating 4-byte key, a word at a
+// time.
+func maskBytes(key [4]byte, b []byte) {
+	k := uint64(binary.LittleEndian.Uint32(key[:]))
+	k |= k << 32
+	i := 0
+	for ; i+8 <= len(b); i += 8 {
+		binary.LittleEndian.PutUint64(b[i:], binary.LittleEndian.Uint64(b[i:])^k)
+	}
+	for ; i < len(b); i++ {
+		b[i] ^= key[i%4]
+	}
 }
 
+// Trace receives each connection step ("dns", "tcp", "tls", "upgrade")
+// with its duration, a short detail (addresses, TLS version, status) and
+// the error that ended the dial, if any.
+type Trace func(step string, took time.Duration, detail string, err error)
+
 // Dial establishes a ws:// or wss:// client connection with a minimal RFC6455 implementation.
 // Supports: Text frames, Ping/Pong, Close. Client->server frames are masked.
 func Dial(ctx context.Context, rawURL string, insecureSkipVerify bool) (*Conn, *http.Response, error) {
+	return DialTrace(ctx, rawURL, insecureSkipVerify, nil)
+}
+
+// DialTrace is Dial reporting every step to tr (which may be nil).
+func DialTrace(ctx context.Context, rawURL string, insecureSkipVerify bool, tr Trace) (*Conn, *http.Response, error) {
+	return DialWith(ctx, rawURL, Options{InsecureSkipVerify: insecureSkipVerify, Trace: tr})
+}
+
+// DialWith is Dial with Options.
+func DialWith(ctx context.Context, rawURL string, o Options) (*Conn, *http.Response, error) {
+	tr := o.Trace
+	if tr == nil {
+		tr = func(string, time.Duration, string, error) {}
+	}
 	u, err := url.Parse(rawURL)
 	if err != nil {
 		return nil, nil, err
@@ -48,27 +106,83 @@ func Dial(ctx context.Context, rawURL string, insecureSkipVerify bool) (*Conn, *
 		}
 	}
 
-	var d net.Dialer
+	d := net.Dialer{KeepAlive: o.KeepAlive}
 	if deadline, ok := ctx.Deadline(); ok {
 		d.Timeout = time.Until(deadline)
 	} else {
 		d.Timeout = 8 * time.Second
 	}
-	rawConn, err := d.DialContext(ctx, "tcp", host)
+	if o.UserTimeout > 0 {
+		d.Control = control(o.UserTimeout)
+	}
+	hostname, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return nil, nil, err
+	}
+	start := time.Now()
+	var addrs []string
+	if o.Resolve != nil {
+		addrs = o.Resolve(hostname)
+	}
+	if len(addrs) > 0 {
+		tr("dns", time.Since(start), "static "+strings.Join(addrs, ", "), nil)
+	} else {
+		if addrs, err = net.DefaultResolver.LookupHost(ctx, hostname); err != nil {
+			tr("dns", time.Since(start), hostname, err)
+			return nil, nil, err
+		}
+		tr("dns", time.Since(start), strings.Join(addrs, ", "), nil)
+	}
+
+	start = time.Now()
+	rawConn, err := dialAddrs(ctx, &d, orderAddrs(addrs, o.PreferIP), port)
 	if err != nil {
+		tr("tcp", time.Since(start), host, err)
 		return nil, nil, err
 	}
+	tr("tcp", time.Since(start), rawConn.RemoteAddr().String(), nil)
 
 	var conn net.Conn = rawConn
 	if u.Scheme == "wss" {
-		tlsConn := tls.Client(rawConn, &tls.Config{
-			ServerName:         stripPort(u.Host),
-			InsecureSkipVerify: insecureSkipVerify,
-		})
+		sni := o.ServerName
+		if sni == "" {
+			sni = stripPort(u.Host)
+		}
+		tc := &tls.Config{
+			ServerName:         sni,
+			InsecureSkipVerify: o.InsecureSkipVerify,
+			ClientSessionCache: o.TLSSessions,
+		}
+		if len(o.Pins) > 0 {
+			tc.VerifyConnection = verifyPins(o.Pins, o.InsecureSkipVerify)
+		}
+		if err := setECH(tc, o.ECHConfigList); err != nil {
+			tr("tls", 0, sni, err)
+			_ = rawConn.Close()
+			return nil, nil, err
+		}
+		tlsConn := tls.Client(rawConn, tc)
+		start = time.Now()
 		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			tr("tls", time.Since(start), sni, err)
 			_ = rawConn.Close()
 			return nil, nil, err
 		}
+		st := tlsConn.ConnectionState()
+		detail := tls.VersionName(st.Version) + " " + tls.CipherSuiteName(st.CipherSuite)
+		if sni != stripPort(u.Host) {
+			detail += " sni=" + sni
+		}
+		if echAccepted(st) {
+			detail += " ech"
+		}
+		if st.DidResume {
+			detail += " resumed"
+		}
+		if len(o.Pins) > 0 {
+			detail += " pinned"
+		}
+		tr("tls", time.Since(start), detail, nil)
 		conn = tlsConn
 	}
 
@@ -81,37 +195,86 @@ func Dial(ctx context.Context, rawURL string, insecureSkipVerify bool) (*Conn, *
 		path = "/"
 	}
 
-	req := fmt.Sprintf("GET %s HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\nUser-Agent: kokoro-agent/0.1\r\n\r\n",
-		path, stripPort(u.Host), key)
-
-	if _, err := conn.Write([]byte(req)); err != nil {
+	hostHdr, ua := stripPort(u.Host), "kokoro-agent/0.1"
+	var extra strings.Builder
+	if len(o.Subprotocols) > 0 {
+		extra.WriteString("Sec-WebSocket-Protocol: " + strings.Join(o.Subprotocols, ", ") + "\r\n")
+	}
+	names := make([]string, 0, len(o.Headers))
+	for k := range o.Headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		switch v := o.Headers[k]; http.CanonicalHeaderKey(k) {
+		case "Host":
+			hostHdr = v
+		case "User-Agent":
+			ua = v
+		default:
+			extra.WriteString(k + ": " + v + "\r\n")
+		}
+	}
+	req := fmt.Sprintf("GET %s HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n%sUser-Agent: %s\r\n\r\n",
+		path, hostHdr, key, extra.String(), ua)
+
+	start = time.Now()
+	upgradeErr := func(resp *http.Response, err error) (*Conn, *http.Response, error) {
+		detail := path
+		if resp != nil {
+			detail = resp.Status
+		}
+		tr("upgrade", time.Since(start), detail, err)
 		_ = conn.Close()
-		return nil, nil, err
+		return nil, resp, err
+	}
+	if _, err := conn.Write([]byte(req)); err != nil {
+		return upgradeErr(nil, err)
 	}
 
 	br := bufio.NewReader(conn)
 	resp, err := http.ReadResponse(br, &http.Request{Method: "GET"})
 	if err != nil {
-		_ = conn.Close()
-		return nil, nil, err
+		return upgradeErr(nil, err)
 	}
-	if resp.StatusCode != 101 {
-		_ = conn.Close()
-		return nil, resp, ErrBadHandshake
+	switch resp.StatusCode {
+	case 101:
+	case 401, 403:
+		return upgradeErr(resp, fmt.Errorf("%w: %w", ErrBadHandshake, ErrUnauthorized))
+	default:
+		return upgradeErr(resp, ErrBadHandshake)
 	}
 
 	accept := resp.Header.Get("Sec-WebSocket-Accept")
 	if accept == "" {
-		_ = conn.Close()
-		return nil, resp, ErrBadHandshake
+		return upgradeErr(resp, ErrBadHandshake)
 	}
 	want := computeAccept(key)
 	if accept != want {
-		_ = conn.Close()
-		return nil, resp, ErrBadHandshake
+		return upgradeErr(resp, ErrBadHandshake)
+	}
+	sub := resp.Header.Get("Sec-WebSocket-Protocol")
+	if sub != "" && !offered(o.Subprotocols, sub) {
+		return upgradeErr(resp, fmt.Errorf("%w: %q (offered %q)", ErrSubprotocol, sub, o.Subprotocols))
+	}
+	detail := resp.Status
+	if sub != "" {
+		detail += " " + sub
 	}
+	tr("upgrade", time.Since(start), detail, nil)
+
+	c := &Conn{c: conn, br: br, subprotocol: sub}
+	c.lastRead.Store(time.Now().UnixNano())
+	return c, resp, nil
+}
 
-	return &Conn{c: conn, br: br}, resp, nil
+func offered(protos []string, p string) bool {
+	for _, o := range protos {
+		if o == p {
+			return true
+		}
+	}
+	return false
 }
 
 func stripPort(host string) string {
@@ -132,14 +295,45 @@ func (w *Conn) Close() error {
 	return w.c.Close()
 }
 
+// LocalAddr is the local end of the underlying connection.
+func (w *Conn) LocalAddr() net.Addr {
+	return w.c.LocalAddr()
+}
+
+// LastRead is when the peer last sent a frame (data, ping, pong or close),
+// or when the connection was established.
+func (w *Conn) LastRead() time.Time {
+	return time.Unix(0, w.lastRead.Load())
+}
+
+// Subprotocol is the Sec-WebSocket-Protocol the server accepted, or ""
+// when it didn't negotiate one.
+func (w *Conn) Subprotocol() string {
+	return w.subprotocol
+}
+
 func (w *Conn) SetDeadline(t time.Time) error {
 	return w.c.SetDeadline(t)
 }
 
+func (w *Conn) SetWriteDeadline(t time.Time) error {
+	return w.c.SetWriteDeadline(t)
+}
+
+// SetPongHandler registers f to be called from ReadMessage for every pong.
+// Set it before the read loop starts.
+func (w *Conn) SetPongHandler(f func(payload []byte)) {
+	w.onPong = f
+}
+
 func (w *Conn) WriteText(payload []byte) error {
 	return w.writeFrame(0x1, payload)
 }
 
+func (w *Conn) WriteBinary(payload []byte) error {
+	return w.writeFrame(0x2, payload)
+}
+
 func (w *Conn) WritePing(payload []byte) error {
 	return w.writeFrame(0x9, payload)
 }
@@ -161,42 +355,44 @@ func (w *Conn) writeFrame(opcode byte, payload []byte) error {
 	defer w.mu.Unlock()
 
 	// client must mask
-	maskKey := make([]byte, 4)
-	_, _ = rand.Read(maskKey)
+	if _, err := rand.Read(w.maskKey[:]); err != nil {
+		return err
+	}
 
-	header := make([]byte, 0, 14)
-	finOpcode := byte(0x80) | (opcode & 0x0f)
-	header = append(header, finOpcode)
+	// header and masked payload go out in one write from a pooled buffer
+	bp := framePool.Get().(*[]byte)
+	buf := (*bp)[:0]
+	buf = append(buf, 0x80|(opcode&0x0f))
 
 	n := len(payload)
 	switch {
 	case n <= 125:
-		header = append(header, byte(0x80|byte(n)))
+		buf = append(buf, byte(0x80|byte(n)))
 	case n <= 65535:
-		header = append(header, byte(0x80|126), byte(n>>8), byte(n))
+		buf = append(buf, byte(0x80|126), byte(n>>8), byte(n))
 	default:
 		// 64-bit length
-		header = append(header, byte(0x80|127))
+		buf = append(buf, byte(0x80|127))
 		for i := 7; i >= 0; i-- {
-			header = append(header, byte(uint64(n)>>(8*i)))
+			buf = append(buf, byte(uint64(n)>>(8*i)))
 		}
 	}
-	header = append(header, maskKey...)
-
-	masked := make([]byte, n)
-	for i := 0; i < n; i++ {
-		masked[i] = payload[i] ^ maskKey[i%4]
-	}
-
-	if _, err := w.c.Write(header); err != nil {
-		return err
+	buf = append(buf, w.maskKey[:]...)
+	off := len(buf)
+	buf = append(buf, payload...)
+	maskBytes(w.maskKey, buf[off:])
+
+	_, err := w.c.Write(buf)
+	if cap(buf) <= maxPooledFrame {
+		*bp = buf
+		framePool.Put(bp)
 	}
-	_, err := w.c.Write(masked)
 	return err
 }
 
 // ReadMessage reads next data frame; it auto-replies to Ping with Pong.
-// Returns opcode, payload.
+// Returns opcode, payload. The payload (and the one passed to the pong
+// handler) is only valid until the next ReadMessage call.
 func (w *Conn) ReadMessage() (byte, []byte, error) {
 	for {
 		op, payload, err := w.readFrame()
@@ -208,6 +404,9 @@ func (w *Conn) ReadMessage() (byte, []byte, error) {
 			_ = w.WritePong(payload)
 			continue
 		case 0xA: // pong
+			if w.onPong != nil {
+				w.onPong(payload)
+			}
 			continue
 		case 0x8: // close
 			// reply close and exit
@@ -229,6 +428,8 @@ func (w *Conn) readFrame() (byte, []byte, error) {
 		return 0, nil, err
 	}
 
+	w.lastRead.Store(time.Now().UnixNano())
+
 	fin := (b1 & 0x80) != 0
 	_ = fin // we only support FIN frames (no fragmentation)
 	opcode := b1 & 0x0f
@@ -265,14 +466,21 @@ func (w *Conn) readFrame() (byte, []byte, error) {
 		return 0, nil, fmt.Errorf("frame too large: %d", length)
 	}
 
-	payload := make([]byte, length)
+	// small frames reuse one buffer per connection
+	var payload []byte
+	if length <= maxPooledFrame {
+		if int64(cap(w.rbuf)) < length {
+			w.rbuf = make([]byte, 0, max(length, 4096))
+		}
+		payload = w.rbuf[:length]
+	} else {
+		payload = make([]byte, length)
+	}
 	if _, err := io.ReadFull(w.br, payload); err != nil {
 		return 0, nil, err
 	}
 	if masked {
-		for i := int64(0); i < length; i++ {
-			payload[i] ^= maskKey[i%4]
-		}
+		maskBytes(maskKey, payload)
 	}
 
 	if !fin {
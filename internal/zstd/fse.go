@@ -0,0 +1,108 @@
+package zstd
+
+import "math/bits"
+
+// Predefined distributions (RFC 8878, 3.1.1.3.2.2); -1 is "less than 1".
+var (
+	llTable = newFSETable([]int16{
+		4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1,
+		2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 2, 1, 1, 1, 1, 1,
+		-1, -1, -1, -1,
+	}, 6)
+	mlTable = newFSETable([]int16{
+		1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1,
+		-1, -1, -1, -1, -1,
+	}, 6)
+	ofTable = newFSETable([]int16{
+		1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1,
+	}, 5)
+)
+
+// fseTable is the encoding side of an FSE table: the decoder's state
+// table, spread the same way, inverted per symbol.
+type fseTable struct {
+	log     uint8
+	states  []uint16 // next state by symbol slot, offset by the table size
+	symbols []symbolTransform
+}
+
+type symbolTransform struct {
+	deltaNbBits    uint32
+	deltaFindState int32
+}
+
+func newFSETable(norm []int16, log uint8) *fseTable {
+	size := 1 << log
+	high := size - 1
+	spread := make([]uint8, size)
+	cumul := make([]int, len(norm)+1)
+	for s, p := range norm {
+		if p == -1 {
+			spread[high] = uint8(s)
+			high--
+			cumul[s+1] = cumul[s] + 1
+		} else {
+			cumul[s+1] = cumul[s] + int(p)
+		}
+	}
+	step := size>>1 + size>>3 + 3
+	pos := 0
+	for s, p := range norm {
+		for i := 0; i < int(p); i++ {
+			spread[pos] = uint8(s)
+			pos = (pos + step) & (size - 1)
+			for pos > high {
+				pos = (pos + step) & (size - 1)
+			}
+		}
+	}
+
+	t := &fseTable{log: log, states: make([]uint16, size), symbols: make([]symbolTransform, len(norm))}
+	next := append([]int(nil), cumul[:len(norm)]...)
+	for u, s := range spread {
+		t.states[next[s]] = uint16(size + u)
+		next[s]++
+	}
+	for s, p := range norm {
+		switch p {
+		case 0:
+		case -1, 1:
+			t.symbols[s] = symbolTransform{uint32(log)<<16 - uint32(size), int32(cumul[s]) - 1}
+		default:
+			maxBitsOut := uint32(log) - uint32(bits.Len32(uint32(p-1))-1)
+			minStatePlus := uint32(p) << maxBitsOut
+			t.symbols[s] = symbolTransform{maxBitsOut<<16 - minStatePlus, int32(cumul[s]) - int32(p)}
+		}
+	}
+	return t
+}
+
+// fseState is an encoder state in [size, 2*size).
+type fseState struct {
+	t     *fseTable
+	value uint32
+}
+
+// init starts with sym without writing bits.
+func (st *fseState) init(t *fseTable, sym uint8) {
+	st.t = t
+	tt := t.symbols[sym]
+	nb := (tt.deltaNbBits + 1<<15) >> 16
+	v := nb<<16 - tt.deltaNbBits
+	st.value = uint32(t.states[int32(v>>nb)+tt.deltaFindState])
+}
+
+func (st *fseState) encode(w *bitWriter, sym uint8) {
+	tt := st.t.symbols[sym]
+	nb := (st.value + tt.deltaNbBits) >> 16
+	w.add(uint64(st.value), uint(nb))
+	st.value = uint32(st.t.states[int32(st.value>>nb)+tt.deltaFindState])
+}
+
+// flush writes the final state, which the decoder reads first.
+func (st *fseState) flush(w *bitWriter) {
+	w.add(uint64(st.value), uint(st.t.log))
+}
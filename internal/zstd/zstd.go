@@ -0,0 +1,272 @@
+// Package zstd writes Zstandard frames (RFC 8878) with the standard
+// library only. It is a small encoder for replaying buffered messages:
+// greedy LZ77 matching over the whole input, sequences coded with the
+// predefined FSE tables and literals stored as they are (no Huffman). Any
+// zstd decoder reads the output; repetitive JSON shrinks well, if not as
+// far as with the reference encoder.
+package zstd
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/bits"
+)
+
+const (
+	magic        = 0xFD2FB528
+	maxBlockSize = 128 << 10
+	minMatch     = 4
+	hashLog      = 16
+
+	blockRaw        = 0
+	blockCompressed = 2
+)
+
+// MaxInput bounds what Compress takes. Frames are single-segment, so a
+// decoder needs the whole content as its window.
+const MaxInput = 8 << 20
+
+// ErrTooLarge is returned for inputs over MaxInput.
+var ErrTooLarge = errors.New("zstd: input too large")
+
+// Compress returns src as one zstd frame with its content size set and no
+// checksum.
+func Compress(src []byte) ([]byte, error) {
+	if len(src) > MaxInput {
+		return nil, ErrTooLarge
+	}
+	dst := make([]byte, 0, len(src)/4+32)
+	dst = binary.LittleEndian.AppendUint32(dst, magic)
+	dst = appendFrameHeader(dst, len(src))
+	if len(src) == 0 {
+		return appendBlockHeader(dst, true, blockRaw, 0), nil
+	}
+	e := encoder{src: src, table: make([]int32, 1<<hashLog)}
+	for pos := 0; pos < len(src); pos += maxBlockSize {
+		end := min(pos+maxBlockSize, len(src))
+		dst = e.block(dst, pos, end, end == len(src))
+	}
+	return dst, nil
+}
+
+// appendFrameHeader writes a single-segment header: no window descriptor,
+// the content size is the window.
+func appendFrameHeader(dst []byte, n int) []byte {
+	switch {
+	case n < 256:
+		return append(dst, 0x20, byte(n))
+	case n < 65536+256:
+		return binary.LittleEndian.AppendUint16(append(dst, 0x60), uint16(n-256))
+	}
+	return binary.LittleEndian.AppendUint32(append(dst, 0xA0), uint32(n))
+}
+
+func appendBlockHeader(dst []byte, last bool, typ, size int) []byte {
+	h := size<<3 | typ<<1
+	if last {
+		h |= 1
+	}
+	return append(dst, byte(h), byte(h>>8), byte(h>>16))
+}
+
+type sequence struct {
+	litLen, matchLen, offset uint32
+}
+
+// encoder finds matches anywhere in src before the current position; table
+// holds the last position+1 of each hashed 4-byte prefix.
+type encoder struct {
+	src   []byte
+	table []int32
+}
+
+// block appends src[start:end] as a compressed block, or a raw one when
+// that doesn't come out smaller.
+func (e *encoder) block(dst []byte, start, end int, last bool) []byte {
+	seqs, lits := e.parse(start, end)
+	if len(seqs) > 0 {
+		b := appendLiterals(nil, lits)
+		b = appendSequences(b, seqs)
+		if len(b) < end-start {
+			return append(appendBlockHeader(dst, last, blockCompressed, len(b)), b...)
+		}
+	}
+	return append(appendBlockHeader(dst, last, blockRaw, end-start), e.src[start:end]...)
+}
+
+// parse splits src[start:end] into sequences (literals followed by a
+// match) and the literals they carry, trailing literals included.
+func (e *encoder) parse(start, end int) ([]sequence, []byte) {
+	src := e.src
+	var seqs []sequence
+	lits := make([]byte, 0, end-start)
+	anchor, i := start, start
+	for i+minMatch <= end {
+		h := hash4(src[i:])
+		cand := int(e.table[h]) - 1
+		e.table[h] = int32(i + 1)
+		if cand < 0 || load32(src[cand:]) != load32(src[i:]) {
+			i++
+			continue
+		}
+		n := minMatch
+		for i+n < end && src[cand+n] == src[i+n] {
+			n++
+		}
+		for i > anchor && cand > 0 && src[i-1] == src[cand-1] {
+			i, cand, n = i-1, cand-1, n+1
+		}
+		seqs = append(seqs, sequence{litLen: uint32(i - anchor), matchLen: uint32(n), offset: uint32(i - cand)})
+		lits = append(lits, src[anchor:i]...)
+		for j := i + 1; j < i+n && j+minMatch <= len(src); j++ {
+			e.table[hash4(src[j:])] = int32(j + 1)
+		}
+		i += n
+		anchor = i
+	}
+	return seqs, append(lits, src[anchor:end]...)
+}
+
+func load32(b []byte) uint32 { return binary.LittleEndian.Uint32(b) }
+
+func hash4(b []byte) uint32 { return load32(b) * 2654435761 >> (32 - hashLog) }
+
+// appendLiterals writes a Raw_Literals_Block.
+func appendLiterals(dst, lits []byte) []byte {
+	n := len(lits)
+	switch {
+	case n < 32:
+		dst = append(dst, byte(n<<3))
+	case n < 4096:
+		dst = append(dst, byte(n<<4)|0x4, byte(n>>4))
+	default:
+		dst = append(dst, byte(n<<4)|0xC, byte(n>>4), byte(n>>12))
+	}
+	return append(dst, lits...)
+}
+
+// appendSequences writes the sequences section with all three codes in
+// Predefined_Mode. The bitstream is read backwards, so the last sequence
+// goes in first.
+func appendSequences(dst []byte, seqs []sequence) []byte {
+	n := len(seqs)
+	switch {
+	case n < 128:
+		dst = append(dst, byte(n))
+	case n < 0x7F00:
+		dst = append(dst, byte(n>>8)+128, byte(n))
+	default:
+		dst = binary.LittleEndian.AppendUint16(append(dst, 0xFF), uint16(n-0x7F00))
+	}
+	dst = append(dst, 0) // compression modes: predefined
+
+	codes := make([]seqCodes, n)
+	for i, s := range seqs {
+		codes[i] = codesOf(s)
+	}
+	w := bitWriter{out: dst}
+	var ll, of, ml fseState
+	c := codes[n-1]
+	ll.init(llTable, c.ll)
+	of.init(ofTable, c.of)
+	ml.init(mlTable, c.ml)
+	w.addExtra(c)
+	for i := n - 2; i >= 0; i-- {
+		c := codes[i]
+		of.encode(&w, c.of)
+		ml.encode(&w, c.ml)
+		ll.encode(&w, c.ll)
+		w.addExtra(c)
+	}
+	ml.flush(&w)
+	of.flush(&w)
+	ll.flush(&w)
+	return w.close()
+}
+
+// seqCodes is a sequence as FSE symbols plus their extra bits.
+type seqCodes struct {
+	ll, ml, of                uint8
+	llExtra, mlExtra, ofExtra uint32
+	llBits, mlBits, ofBits    uint8
+}
+
+func codesOf(s sequence) seqCodes {
+	var c seqCodes
+	c.ll = codeFor(llBase[:], s.litLen)
+	c.llBits, c.llExtra = llExtraBits[c.ll], s.litLen-llBase[c.ll]
+	c.ml = codeFor(mlBase[:], s.matchLen)
+	c.mlBits, c.mlExtra = mlExtraBits[c.ml], s.matchLen-mlBase[c.ml]
+	// offsets 1-3 would be repeat codes
+	off := s.offset + 3
+	c.of = uint8(bits.Len32(off) - 1)
+	c.ofBits, c.ofExtra = c.of, off-1<<c.of
+	return c
+}
+
+// codeFor is the last code whose baseline is at most v.
+func codeFor(base []uint32, v uint32) uint8 {
+	c := len(base) - 1
+	for base[c] > v {
+		c--
+	}
+	return uint8(c)
+}
+
+var (
+	llBase = [36]uint32{
+		0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+		16, 18, 20, 22, 24, 28, 32, 40, 48, 64, 128, 256, 512, 1024, 2048, 4096,
+		8192, 16384, 32768, 65536,
+	}
+	llExtraBits = [36]uint8{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 6, 7, 8, 9, 10, 11, 12,
+		13, 14, 15, 16,
+	}
+	mlBase = [53]uint32{
+		3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18,
+		19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32, 33, 34,
+		35, 37, 39, 41, 43, 47, 51, 59, 67, 83, 99, 131, 259, 515, 1027, 2051,
+		4099, 8195, 16387, 32771, 65539,
+	}
+	mlExtraBits = [53]uint8{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 4, 5, 7, 8, 9, 10, 11,
+		12, 13, 14, 15, 16,
+	}
+)
+
+// bitWriter fills bytes from the least significant bit up.
+type bitWriter struct {
+	out []byte
+	acc uint64
+	n   uint
+}
+
+func (w *bitWriter) add(v uint64, nb uint) {
+	w.acc |= (v & (1<<nb - 1)) << w.n
+	w.n += nb
+	for w.n >= 8 {
+		w.out = append(w.out, byte(w.acc))
+		w.acc >>= 8
+		w.n -= 8
+	}
+}
+
+func (w *bitWriter) addExtra(c seqCodes) {
+	w.add(uint64(c.llExtra), uint(c.llBits))
+	w.add(uint64(c.mlExtra), uint(c.mlBits))
+	w.add(uint64(c.ofExtra), uint(c.ofBits))
+}
+
+// close ends the stream with a 1 bit, which the reader looks for in the
+// last byte.
+func (w *bitWriter) close() []byte {
+	w.add(1, 1)
+	if w.n > 0 {
+		w.out = append(w.out, byte(w.acc))
+	}
+	return w.out
+}
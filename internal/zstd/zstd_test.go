@@ -0,0 +1,116 @@
+package zstd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func testInputs() []struct {
+	name string
+	b    []byte
+} {
+	rnd := rand.New(rand.NewSource(1))
+	random := make([]byte, 300<<10)
+	rnd.Read(random)
+	var js strings.Builder
+	for i := 0; js.Len() < 400<<10; i++ {
+		fmt.Fprintf(&js, `{"type":"metrics","seq":%d,"cpu":%d.%d,"mem":%d}`+"\n", i, rnd.Intn(100), rnd.Intn(10), rnd.Intn(1<<30))
+	}
+	return []struct {
+		name string
+		b    []byte
+	}{
+		{"empty", nil},
+		{"one byte", []byte{'x'}},
+		{"short", []byte("abc")},
+		{"255 bytes", bytes.Repeat([]byte{'a'}, 255)},
+		{"256 bytes", bytes.Repeat([]byte{'a'}, 256)},
+		{"two-byte size limit", bytes.Repeat([]byte("ab"), (65536+256)/2)},
+		{"repetitive", bytes.Repeat([]byte("hello, world "), 1000)},
+		{"long match", append(bytes.Repeat([]byte{0}, 100000), 'z')},
+		{"block size", bytes.Repeat([]byte("0123456789"), maxBlockSize/10+1)[:maxBlockSize]},
+		{"block size plus one", bytes.Repeat([]byte("0123456789"), maxBlockSize/10+1)[:maxBlockSize+1]},
+		{"random", random},
+		{"random then repeated", append(random[:50000:50000], random[:50000]...)},
+		{"json lines", []byte(js.String())},
+	}
+}
+
+func TestFrameHeader(t *testing.T) {
+	tests := []struct {
+		n    int
+		want []byte // after the magic
+	}{
+		{0, []byte{0x20, 0}},
+		{255, []byte{0x20, 255}},
+		{256, []byte{0x60, 0, 0}},
+		{65535 + 256, []byte{0x60, 0xff, 0xff}},
+		{65536 + 256, []byte{0xa0, 0x00, 0x01, 0x01, 0x00}},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.n), func(t *testing.T) {
+			out, err := Compress(make([]byte, tt.n))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := binary.LittleEndian.Uint32(out); got != magic {
+				t.Fatalf("magic %#x", got)
+			}
+			if got := out[4 : 4+len(tt.want)]; !bytes.Equal(got, tt.want) {
+				t.Errorf("header % x, want % x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompressTooLarge(t *testing.T) {
+	if _, err := Compress(make([]byte, MaxInput+1)); err != ErrTooLarge {
+		t.Errorf("got %v, want ErrTooLarge", err)
+	}
+	if _, err := Compress(make([]byte, MaxInput)); err != nil {
+		t.Errorf("MaxInput: %v", err)
+	}
+}
+
+func TestCompressShrinks(t *testing.T) {
+	src := bytes.Repeat([]byte(`{"type":"metrics","cpu":1.5}`), 1000)
+	out, err := Compress(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) > len(src)/10 {
+		t.Errorf("%d bytes compressed to %d", len(src), len(out))
+	}
+}
+
+// TestRoundTrip decodes the output with the reference zstd tool.
+func TestRoundTrip(t *testing.T) {
+	bin, err := exec.LookPath("zstd")
+	if err != nil {
+		t.Skip("zstd not installed")
+	}
+	for _, tt := range testInputs() {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := Compress(tt.b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cmd := exec.Command(bin, "-d", "-c", "-q")
+			cmd.Stdin = bytes.NewReader(out)
+			var stderr bytes.Buffer
+			cmd.Stderr = &stderr
+			got, err := cmd.Output()
+			if err != nil {
+				t.Fatalf("zstd -d: %v: %s", err, stderr.String())
+			}
+			if !bytes.Equal(got, tt.b) {
+				t.Errorf("decoded %d bytes differ from the %d compressed", len(got), len(tt.b))
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+// Package agentplugin is the sidecar protocol between kokoro-agent and
+// collector plugins, and a helper for writing such plugins in Go.
+//
+// The agent starts each configured plugin binary once and keeps it
+// running. They talk over the plugin's stdin and stdout in frames: a
+// 4-byte big-endian length, then that many bytes of one JSON object. The
+// agent opens with a hello; the plugin answers with its own hello (name
+// and version). After that, once per interval, the agent sends collect
+// and the plugin answers with a result carrying the same id:
+//
+//	agent -> plugin  {"type":"hello","proto":1,"agent_version":"1.8.0"}
+//	plugin -> agent  {"type":"hello","proto":1,"name":"proxmox","version":"0.3.0"}
+//	agent -> plugin  {"type":"collect","id":1}
+//	plugin -> agent  {"type":"result","id":1,"data":{"vms_running":12}}
+//
+// data is any JSON object and is forwarded to the master as is; err
+// reports a failed collection instead. Whatever the plugin writes to
+// stderr ends up in the agent's log. The plugin should exit when its
+// stdin is closed. Plugins in other languages only need the framing.
+package agentplugin
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Proto is the protocol version sent in hello.
+const Proto = 1
+
+// MaxFrame bounds the JSON of one frame.
+const MaxFrame = 1 << 20
+
+// Message types.
+const (
+	TypeHello   = "hello"
+	TypeCollect = "collect"
+	TypeResult  = "result"
+)
+
+// Message is any frame; which fields are set depends on Type.
+type Message struct {
+	Type string `json:"type"`
+
+	// hello
+	Proto        int    `json:"proto,omitempty"`
+	Name         string `json:"name,omitempty"`          // plugin -> agent
+	Version      string `json:"version,omitempty"`       // plugin -> agent
+	AgentVersion string `json:"agent_version,omitempty"` // agent -> plugin
+
+	// collect, result
+	ID   uint64          `json:"id,omitempty"`
+	Data json.RawMessage `json:"data,omitempty"`
+	Err  string          `json:"err,omitempty"`
+}
+
+// WriteFrame writes v as one frame.
+func WriteFrame(w io.Writer, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if len(b) > MaxFrame {
+		return fmt.Errorf("frame of %d bytes: at most %d", len(b), MaxFrame)
+	}
+	buf := make([]byte, 4+len(b))
+	binary.BigEndian.PutUint32(buf, uint32(len(b)))
+	copy(buf[4:], b)
+	_, err = w.Write(buf)
+	return err
+}
+
+// ReadFrame reads one frame into v. It returns io.EOF when r ends between
+// frames.
+func ReadFrame(r io.Reader, v any) error {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return err
+	}
+	n := binary.BigEndian.Uint32(hdr[:])
+	if n > MaxFrame {
+		return fmt.Errorf("frame of %d bytes: at most %d", n, MaxFrame)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// CollectFunc gathers one result; its value is marshalled to JSON and
+// should be an object.
+type CollectFunc func(ctx context.Context) (any, error)
+
+// Serve runs a plugin named name on stdin and stdout until the agent
+// closes stdin. collect is called once for every collect request.
+func Serve(name, version string, collect CollectFunc) error {
+	return ServeIO(context.Background(), os.Stdin, os.Stdout, name, version, collect)
+}
+
+// ServeIO is Serve over r and w; it also returns when ctx is done (before
+// the next request).
+func ServeIO(ctx context.Context, r io.Reader, w io.Writer, name, version string, collect CollectFunc) error {
+	br := bufio.NewReader(r)
+	for ctx.Err() == nil {
+		var m Message
+		if err := ReadFrame(br, &m); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		var reply Message
+		switch m.Type {
+		case TypeHello:
+			reply = Message{Type: TypeHello, Proto: Proto, Name: name, Version: version}
+		case TypeCollect:
+			reply = Message{Type: TypeResult, ID: m.ID}
+			v, err := collect(ctx)
+			if err == nil {
+				reply.Data, err = json.Marshal(v)
+			}
+			if err != nil {
+				reply.Data, reply.Err = nil, err.Error()
+			}
+		default:
+			continue // newer agents may send more
+		}
+		if err := WriteFrame(w, reply); err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
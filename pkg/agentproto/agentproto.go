@@ -0,0 +1,714 @@
+// Package agentproto describes the kokoro-agent <-> master WebSocket protocol
+// and offers helpers for writing a master (or any other collector) that
+// talks to stock agents.
+//
+// Every message is a JSON object with a "type" field. The agent sends hello
+// first and waits for hello_ok; after that it streams metrics, tcpping_batch,
+// agent_stats etc. Agent -> master messages after hello may use another
+// encoding (see Hello.Encodings and HelloOK.Encoding); master -> agent
+// messages are always JSON text frames.
+package agentproto
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Protocol versioning. The agent offers Subprotocol in the WebSocket
+// handshake and sends ProtoVersion as hello.proto_ver; a master answers with
+// the version the session uses in hello_ok.proto_ver (see NegotiateProto).
+// Agents and masters that predate versioning send neither and speak
+// version 1. A breaking change (binary framing, another envelope) bumps
+// ProtoVersion and adds "kokoro.v<N>" ahead of the older subprotocols, so
+// either side can fall back to the highest version both know.
+const (
+	ProtoVersion = 1
+	Subprotocol  = "kokoro.v1"
+)
+
+// Message types, agent -> master.
+const (
+	TypeHello          = "hello"
+	TypeMetrics        = "metrics"
+	TypeTCPPingBatch   = "tcpping_batch"
+	TypeTCPPingSummary = "tcpping_summary"
+	TypeAgentStats     = "agent_stats"
+	TypeConfigAck      = "config_ack"
+	TypePauseState     = "pause_state"
+	TypeLogLevel       = "log_level"
+	TypeStateEvent     = "state_event"
+	TypeNetProbeUpdate = "netprobe_update"
+	TypeResendResult   = "tcpping_resend_result"
+	TypeCapState       = "cap_state"
+	TypeClockEvent     = "clock_event"
+	TypeTokenRotateAck = "token_rotate_ack"
+	TypePresetsState   = "presets_state"
+	TypeBatch          = "batch"
+	TypeAlertFire      = "alert_fire"
+	TypeAlertResolve   = "alert_resolve"
+	TypeTunnelStatus   = "tunnel_status"
+	TypePorts          = "ports"
+	TypeConfigRequest  = "config_request"
+	TypeProcStatus     = "proc_status"
+	TypeTaskResult     = "task_result"
+)
+
+// Message types, master -> agent.
+const (
+	TypeHelloOK     = "hello_ok"
+	TypeHelloAck    = "hello_ack" // accepted alias of hello_ok
+	TypeAuthErr     = "auth_err"
+	TypeConfigPush  = "config_push"
+	TypePause       = "pause"
+	TypeResume      = "resume"
+	TypeSetLogLevel = "set_log_level"
+	TypeKick        = "kick"
+	TypeTokenRotate = "token_rotate"
+	// presets_update carries a newer target preset catalog
+	// ({"catalog":{"version":N,"presets":{...}}}); answered by presets_state.
+	TypePresetsUpdate = "presets_update"
+
+	// tcpping_batch acks (drop from the agent's re-send cache) and re-send
+	// requests for batches the master failed to persist.
+	TypeTCPPingAck    = "tcpping_ack"
+	TypeTCPPingResend = "tcpping_resend"
+
+	// Asks for a full metrics snapshot when delta metrics are on and a
+	// delta can't be applied.
+	TypeMetricsKeyframe = "metrics_keyframe"
+)
+
+// Target is one tcpping target as pushed in Config.TCPPing.Targets.
+type Target struct {
+	ID        string `json:"id,omitempty"`
+	Province  string `json:"province,omitempty"`
+	Carrier   string `json:"carrier,omitempty"` // telecom/mobile/unicom
+	IPVer     int    `json:"ip_ver,omitempty"`  // 4/6/0
+	Host      string `json:"host"`
+	Port      int    `json:"port"`
+	Label     string `json:"label,omitempty"`
+	TimeoutMS int    `json:"timeout_ms,omitempty"`
+
+	// Proto is "tcp" (default), "udp" or "quic". A udp probe sends Payload
+	// (default "kokoro-ping"); an ICMP port unreachable fails it with
+	// "refused", RTT included. A quic probe completes a QUIC handshake:
+	// rtt_ms is the server's first reply, tls_rtt_ms the handshake. ALPN is
+	// offered by quic probes (default "h3") and by tcp ones with TLS.
+	Proto   string `json:"proto,omitempty"`
+	Payload string `json:"payload,omitempty"`
+	ALPN    string `json:"alpn,omitempty"`
+
+	Count int `json:"count,omitempty"` // attempts per round (default 1, max 20)
+
+	// ResolveMode is "cache" (default), "per-round" or "pinned" (dial IP,
+	// or the first answer).
+	ResolveMode string `json:"resolve_mode,omitempty"`
+	IP          string `json:"ip,omitempty"`
+
+	// TLS completes a TLS handshake after the TCP connect (tcp only);
+	// TLSSkipVerify and SNI apply to quic probes too.
+	TLS           bool   `json:"tls,omitempty"`
+	TLSSkipVerify bool   `json:"tls_skip_verify,omitempty"`
+	SNI           string `json:"sni,omitempty"` // default: host
+
+	// IntervalSec replaces the global interval for this target; Schedule
+	// is a 5-field cron window it is probed in.
+	IntervalSec int    `json:"interval_sec,omitempty"`
+	Schedule    string `json:"schedule,omitempty"`
+}
+
+// Config is the runtime config a master pushes in hello_ok and config_push.
+// Zero fields leave the agent's current value alone, except TCPPing.Enabled.
+type Config struct {
+	MetricsIntervalMS  int           `json:"metrics_interval_ms,omitempty"`
+	LogLevel           string        `json:"log_level,omitempty"`
+	NetProbeRefreshSec int           `json:"netprobe_refresh_sec,omitempty"`
+	BatchMS            int           `json:"batch_ms,omitempty"`   // < 0 turns batching off
+	RollupSec          int           `json:"rollup_sec,omitempty"` // > 0 adds metrics_rollup (MetricsRollup); < 0 turns it off
+	IPEcho             *IPEcho       `json:"ip_echo,omitempty"`
+	Traffic            *Traffic      `json:"traffic,omitempty"`
+	AlertRules         []AlertRule   `json:"alert_rules,omitempty"` // [] removes all rules
+	Tags               []string      `json:"tags,omitempty"`        // [] removes all tags
+	Watch              []Watch       `json:"watch,omitempty"`       // [] removes all watches
+	Tasks              []Task        `json:"tasks,omitempty"`       // [] removes all tasks
+	TCPPing            TCPPingConfig `json:"tcpping"`
+}
+
+// Traffic replaces the agent's monthly traffic cap. CapGB 0 removes the
+// cap; Actions default to a warning at 80% and 100%.
+type Traffic struct {
+	ResetDay int             `json:"reset_day,omitempty"`
+	CapGB    float64         `json:"cap_gb"`
+	CapCount string          `json:"cap_count,omitempty"` // total, rx, tx, max
+	Actions  []TrafficAction `json:"actions,omitempty"`
+}
+
+// TrafficAction is taken once per month at AtPct of the cap: Do is "warn",
+// "throttle" or "script". A pushed script action names one of the agent's
+// traffic.scripts in Script; Command only works in the agent's own config.
+type TrafficAction struct {
+	AtPct   float64  `json:"at_pct"`
+	Do      string   `json:"action"`
+	Command []string `json:"command,omitempty"`
+	Script  string   `json:"script,omitempty"`
+}
+
+// AlertRule is evaluated by the agent, which sends alert_fire and
+// alert_resolve (AlertEvent) as the rule starts and stops matching. A rule
+// watches either a Metric against Value, for ForSec, or a tcpping Target
+// (id or host:port) failing DownRounds rounds in a row (default 3).
+type AlertRule struct {
+	ID       string `json:"id"`
+	Severity string `json:"severity,omitempty"`
+
+	Metric string  `json:"metric,omitempty"`
+	Op     string  `json:"op,omitempty"` // > >= < <= == != (default >)
+	Value  float64 `json:"value,omitempty"`
+	ForSec int     `json:"for_sec,omitempty"`
+
+	Target     string `json:"target,omitempty"`
+	DownRounds int    `json:"down_rounds,omitempty"`
+}
+
+// AlertEvent is alert_fire or alert_resolve. Value is the metric's value,
+// or the failed rounds of a target rule; Since is the first breach.
+type AlertEvent struct {
+	Type     string  `json:"type"`
+	AgentID  string  `json:"agent_id"`
+	RuleID   string  `json:"rule_id"`
+	Severity string  `json:"severity,omitempty"`
+	Metric   string  `json:"metric,omitempty"`
+	Target   string  `json:"target,omitempty"`
+	Value    float64 `json:"value"`
+	Limit    float64 `json:"threshold,omitempty"` // metric rules
+	Since    int64   `json:"since"`
+	TS       int64   `json:"ts"`
+	Reason   string  `json:"reason,omitempty"` // resolve: "rule_removed"
+}
+
+// IPEcho lists public-IP echo URLs per family, tried in order:
+//
+//	{"ipv4":[{"url":"https://ip.example/v4","format":"text"}],"ipv6":[...]}
+type IPEcho struct {
+	IPv4 []EchoEndpoint `json:"ipv4,omitempty"`
+	IPv6 []EchoEndpoint `json:"ipv6,omitempty"`
+}
+
+// EchoEndpoint is an IP-echo URL. Format "json" (default) expects
+// {"ip":"..."}; "text" takes the whole trimmed body.
+type EchoEndpoint struct {
+	URL    string `json:"url"`
+	Format string `json:"format,omitempty"`
+}
+
+type TCPPingConfig struct {
+	Enabled     bool     `json:"enabled"`
+	IntervalSec int      `json:"interval_sec,omitempty"`
+	Targets     []Target `json:"targets,omitempty"`
+	Concurrency int      `json:"concurrency,omitempty"`
+	// AggregateSec > 0 sends tcpping_summary (TCPPingSummary) every so
+	// many seconds instead of tcpping_batch; < 0 turns it off.
+	AggregateSec int `json:"aggregate_sec,omitempty"`
+	// Preset/Presets add targets from the agent's preset catalog by name
+	// (e.g. "cn-three-carriers"); hello reports the catalog version.
+	Preset  string   `json:"preset,omitempty"`
+	Presets []string `json:"presets,omitempty"`
+}
+
+// PresetNames merges Preset and Presets.
+func (c TCPPingConfig) PresetNames() []string {
+	out := []string{}
+	if c.Preset != "" {
+		out = append(out, c.Preset)
+	}
+	return append(out, c.Presets...)
+}
+
+// Geo is the agent's self-reported location/ASN (when geoip is configured).
+type Geo struct {
+	IP          string `json:"ip"`
+	CountryCode string `json:"country_code,omitempty"`
+	Country     string `json:"country,omitempty"`
+	City        string `json:"city,omitempty"`
+	ASN         uint64 `json:"asn,omitempty"`
+	ASOrg       string `json:"as_org,omitempty"`
+	Source      string `json:"source"` // mmdb|http
+	Err         string `json:"err,omitempty"`
+}
+
+// Tunnel is a WireGuard or other tunnel interface in TunnelStatus. Kind is
+// wireguard, tun, tap, gre, ipip, sit, ip6tnl, ip6gre or vxlan; the
+// PublicKey, ListenPort and Peers are WireGuard only, and Err says why the
+// peers are missing (no wg tool, no permission).
+type Tunnel struct {
+	Name    string `json:"name"`
+	Kind    string `json:"kind"`
+	State   string `json:"state,omitempty"` // operstate: up, down, unknown
+	RxBytes uint64 `json:"rx_bytes"`
+	TxBytes uint64 `json:"tx_bytes"`
+	RxBPS   uint64 `json:"rx_bps,omitempty"`
+	TxBPS   uint64 `json:"tx_bps,omitempty"`
+
+	PublicKey  string       `json:"public_key,omitempty"`
+	ListenPort int          `json:"listen_port,omitempty"`
+	Peers      []TunnelPeer `json:"peers,omitempty"`
+	Err        string       `json:"err,omitempty"`
+}
+
+// TunnelPeer is a WireGuard peer. Stale is set when it never shook hands,
+// or not for a while.
+type TunnelPeer struct {
+	PublicKey       string   `json:"public_key"`
+	Endpoint        string   `json:"endpoint,omitempty"`
+	AllowedIPs      []string `json:"allowed_ips,omitempty"`
+	LatestHandshake int64    `json:"latest_handshake"` // unix seconds, 0 = never
+	HandshakeAgeSec int64    `json:"handshake_age_sec,omitempty"`
+	RxBytes         uint64   `json:"rx_bytes"`
+	TxBytes         uint64   `json:"tx_bytes"`
+	KeepaliveSec    int      `json:"keepalive_sec,omitempty"`
+	Stale           bool     `json:"stale,omitempty"`
+}
+
+// TunnelStatus lists the host's tunnel interfaces, every
+// tunnel_interval_sec while there are any.
+type TunnelStatus struct {
+	Type    string   `json:"type"`
+	AgentID string   `json:"agent_id"`
+	TS      int64    `json:"ts"`
+	Tunnels []Tunnel `json:"tunnels"`
+}
+
+// Listener is a listening socket in Ports; Process is the owner's comm.
+type Listener struct {
+	Proto   string `json:"proto"` // tcp, tcp6, udp, udp6
+	Addr    string `json:"addr"`
+	Port    int    `json:"port"`
+	PID     int    `json:"pid,omitempty"`
+	Process string `json:"process,omitempty"`
+}
+
+// Ports is the listening socket inventory: sent on the first scan of a
+// session and whenever it changes. Opened/Closed are relative to the last
+// inventory the agent saw (nil on the first scan after start).
+type Ports struct {
+	Type    string     `json:"type"`
+	AgentID string     `json:"agent_id"`
+	TS      int64      `json:"ts"`
+	Ports   []Listener `json:"ports"`
+	Opened  []Listener `json:"opened,omitempty"`
+	Closed  []Listener `json:"closed,omitempty"`
+}
+
+// Watch is a process the agent watches, by Process name or Pidfile. A
+// pushed Restart command is ignored: the agent only runs the one
+// configured locally for the name, after RestartAfter failed checks.
+type Watch struct {
+	Name         string   `json:"name"`
+	Process      string   `json:"process,omitempty"`
+	Pidfile      string   `json:"pidfile,omitempty"`
+	Restart      []string `json:"restart,omitempty"`
+	RestartAfter int      `json:"restart_after,omitempty"` // default 2
+}
+
+// ProcState is one watch in ProcStatus. PIDs are the main processes,
+// Procs counts all matching ones. Restarts counts how often the process
+// came back or changed its main pid since the agent started, AutoRestarts
+// the restart commands the agent ran.
+type ProcState struct {
+	Name         string `json:"name"`
+	Up           bool   `json:"up"`
+	PIDs         []int  `json:"pids,omitempty"`
+	Procs        int    `json:"procs,omitempty"`
+	Since        int64  `json:"since"` // last up/down change, unix seconds
+	Restarts     int    `json:"restarts"`
+	AutoRestarts int    `json:"auto_restarts,omitempty"`
+	RestartErr   string `json:"restart_err,omitempty"` // last restart command failure
+	Err          string `json:"err,omitempty"`         // the check itself failed
+}
+
+// ProcStatus reports the watched processes: sent on the first check of a
+// session and whenever a process goes up or down, restarts or is
+// restarted by the agent.
+type ProcStatus struct {
+	Type    string      `json:"type"`
+	AgentID string      `json:"agent_id"`
+	TS      int64       `json:"ts"`
+	Procs   []ProcState `json:"procs"`
+}
+
+// Task is a scheduled task on a 5-field cron Schedule. Its Command must
+// name one of the agent's configured task_commands; the master can't push
+// the command line itself.
+type Task struct {
+	ID         string `json:"id"`
+	Schedule   string `json:"schedule"`
+	Command    string `json:"command"`
+	TimeoutSec int    `json:"timeout_sec,omitempty"`
+}
+
+// TaskResult is one run of a Task. Runs that finish while the agent is
+// disconnected are queued and sent on reconnect. ExitCode is -1 when the
+// command didn't start or was killed; Output is the last 4 KiB of stdout
+// and stderr.
+type TaskResult struct {
+	Type       string `json:"type"`
+	AgentID    string `json:"agent_id"`
+	TaskID     string `json:"task_id"`
+	Command    string `json:"command"`
+	Start      int64  `json:"start"` // unix seconds
+	DurationMS int64  `json:"duration_ms"`
+	ExitCode   int    `json:"exit_code"`
+	Output     string `json:"output,omitempty"`
+	Err        string `json:"err,omitempty"` // "timeout", "still running", start failures
+	TS         int64  `json:"ts"`            // when it finished
+}
+
+// Hello is the agent's first frame.
+type Hello struct {
+	Type        string            `json:"type"`
+	AgentID     string            `json:"agent_id"`
+	Token       string            `json:"token"`
+	AgentVer    string            `json:"agent_ver"`
+	ClientTS    int64             `json:"client_ts"`
+	Cap         []string          `json:"cap"`
+	Encodings   []string          `json:"encodings,omitempty"`
+	Sign        []string          `json:"sign,omitempty"`
+	SignKeyID   string            `json:"sign_key_id,omitempty"` // SignKeyID of the agent's sign_key
+	Delta       []string          `json:"delta,omitempty"`       // metrics delta schemes
+	Compress    []string          `json:"compress,omitempty"`    // replay compression, see CompressZstd
+	Presets     int               `json:"presets,omitempty"`     // preset catalog version
+	Sys         map[string]any    `json:"sys,omitempty"`
+	Alias       string            `json:"alias,omitempty"`
+	Tags        []string          `json:"tags,omitempty"`
+	NetProbe    json.RawMessage   `json:"net_probe,omitempty"`
+	Geo         *Geo              `json:"geo,omitempty"`
+	CapDegraded map[string]string `json:"cap_degraded,omitempty"`
+	ProtoVer    int               `json:"proto_ver,omitempty"` // 0: version 1
+	MaxFrame    int               `json:"max_frame,omitempty"` // chunk larger messages to the agent
+	// ConfigVersion is the runtime config the agent has applied (from an
+	// earlier session or its cache in state_dir).
+	ConfigVersion int64 `json:"config_version,omitempty"`
+}
+
+// HelloOK accepts a hello. ServerTSMS lets the agent measure its clock
+// offset; Encoding picks one of Hello.Encodings for the rest of the session.
+type HelloOK struct {
+	Type          string  `json:"type"`
+	ServerTSMS    int64   `json:"server_ts_ms,omitempty"`
+	Encoding      string  `json:"encoding,omitempty"`
+	Sign          string  `json:"sign,omitempty"`     // "hmac-sha256" enables SignedFrame
+	Delta         string  `json:"delta,omitempty"`    // "metrics-v1" enables delta metrics
+	Compress      string  `json:"compress,omitempty"` // "zstd" enables compressed replays
+	ProtoVer      int     `json:"proto_ver,omitempty"`
+	MaxFrame      int     `json:"max_frame,omitempty"` // agent chunks larger messages
+	ConfigVersion int64   `json:"config_version,omitempty"`
+	Config        *Config `json:"config,omitempty"`
+	// Caps switches capabilities on/off ({"tcpping": false}); unlisted ones
+	// stay enabled. The agent answers with cap_state.
+	Caps map[string]bool `json:"caps,omitempty"`
+}
+
+// ConfigPush replaces the agent's runtime config; the agent answers with
+// ConfigAck. A ConfigVersion below the one the agent has applied is
+// refused (ConfigAck.OK false, then a ConfigRequest) unless Full is set:
+// a full push is the master's whole state, applied whatever its version,
+// and resets anything it leaves out to the agent's config.json.
+type ConfigPush struct {
+	Type          string `json:"type"`
+	ConfigVersion int64  `json:"config_version,omitempty"`
+	Full          bool   `json:"full,omitempty"`
+	Config        Config `json:"config"`
+}
+
+type ConfigAck struct {
+	Type          string `json:"type"`
+	AgentID       string `json:"agent_id"`
+	ConfigVersion int64  `json:"config_version"` // applied after this push
+	OK            bool   `json:"ok"`
+	Err           string `json:"err,omitempty"`
+	TS            int64  `json:"ts"`
+}
+
+// ConfigRequest asks for a full ConfigPush: after a hello_ok without
+// config (Reason "connect") and after refusing a stale push
+// ("stale_push"). ConfigVersion is what the agent has applied.
+type ConfigRequest struct {
+	Type          string `json:"type"`
+	AgentID       string `json:"agent_id"`
+	TS            int64  `json:"ts"`
+	ConfigVersion int64  `json:"config_version"`
+	Reason        string `json:"reason"`
+}
+
+// Summary is one target's line in TCPPingSummary: the target's fields, IP
+// last dialed, then the window's rounds and attempts. Hist counts the
+// answered attempts per TCPPingSummary.HistMS bucket; Errs counts the
+// failed rounds by error.
+type Summary struct {
+	ID       string `json:"id,omitempty"`
+	Province string `json:"province,omitempty"`
+	Carrier  string `json:"carrier,omitempty"`
+	IPVer    int    `json:"ip_ver,omitempty"`
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Label    string `json:"label,omitempty"`
+	Proto    string `json:"proto,omitempty"`
+	IP       string `json:"ip,omitempty"`
+
+	Rounds   int     `json:"rounds"`
+	OKRounds int     `json:"ok_rounds"`
+	Sent     int     `json:"sent"`
+	Recv     int     `json:"recv"`
+	LossPct  float64 `json:"loss_pct"`
+	RTTMinMS float64 `json:"rtt_min_ms,omitempty"`
+	RTTAvgMS float64 `json:"rtt_avg_ms,omitempty"`
+	RTTP50MS float64 `json:"rtt_p50_ms,omitempty"`
+	RTTP95MS float64 `json:"rtt_p95_ms,omitempty"`
+	RTTP99MS float64 `json:"rtt_p99_ms,omitempty"`
+	RTTMaxMS float64 `json:"rtt_max_ms,omitempty"`
+	JitterMS float64 `json:"jitter_ms,omitempty"`
+
+	Hist []int          `json:"hist,omitempty"`
+	Errs map[string]int `json:"errs,omitempty"`
+}
+
+// TCPPingSummary replaces tcpping_batch while tcpping aggregation is on:
+// the rounds of [From, To) folded per target. Hist counts in each Summary
+// use the bucket upper bounds HistMS, plus one bucket above the last.
+// Partial is set for a window cut short by shutdown or by turning
+// aggregation off. It is seq-numbered, acked and re-sent like a batch.
+type TCPPingSummary struct {
+	Type      string    `json:"type"`
+	AgentID   string    `json:"agent_id"`
+	Seq       uint64    `json:"seq"`
+	TS        int64     `json:"ts"`
+	From      int64     `json:"from"`
+	To        int64     `json:"to"`
+	HistMS    []float64 `json:"hist_ms"`
+	Summaries []Summary `json:"summaries"`
+	Partial   bool      `json:"partial,omitempty"`
+	Resent    bool      `json:"resent,omitempty"`
+}
+
+// Batch carries several metrics / tcpping_batch messages, each unchanged
+// (own type and seq), in the order they were produced. Agents send it only
+// when batch_ms is set locally or in a pushed Config.
+type Batch struct {
+	Type    string            `json:"type"`
+	AgentID string            `json:"agent_id"`
+	TS      int64             `json:"ts"`
+	Count   int               `json:"count"`
+	Items   []json.RawMessage `json:"items"`
+}
+
+// Pause stops metrics and probes without disconnecting; MaintenanceUntil
+// (unix seconds) resumes automatically.
+type Pause struct {
+	Type             string `json:"type"`
+	Reason           string `json:"reason,omitempty"`
+	MaintenanceUntil int64  `json:"maintenance_until,omitempty"`
+}
+
+// SetLogLevel changes the agent's log level; an empty Level reverts it.
+type SetLogLevel struct {
+	Type        string `json:"type"`
+	Level       string `json:"level"`
+	DurationSec int    `json:"duration_sec,omitempty"`
+}
+
+// TokenRotate hands the agent a new token. The agent persists it and uses
+// it from the next hello on; the current session (and its signing key) is
+// unaffected. Keep accepting the old token until TokenRotateAck arrives
+// with OK set.
+type TokenRotate struct {
+	Type     string `json:"type"`
+	Token    string `json:"token"`
+	RotateID string `json:"rotate_id,omitempty"`
+}
+
+type TokenRotateAck struct {
+	Type     string `json:"type"`
+	AgentID  string `json:"agent_id"`
+	RotateID string `json:"rotate_id,omitempty"`
+	OK       bool   `json:"ok"`
+	Err      string `json:"err,omitempty"`
+	TS       int64  `json:"ts"`
+}
+
+// TCPPingAck lets the agent forget batches: the listed Seqs and every seq
+// up to and including UpTo.
+type TCPPingAck struct {
+	Type string   `json:"type"`
+	Seqs []uint64 `json:"seqs,omitempty"`
+	UpTo uint64   `json:"up_to,omitempty"`
+}
+
+// TCPPingResend asks for cached batches again (kept ~15 min).
+type TCPPingResend struct {
+	Type string   `json:"type"`
+	Seqs []uint64 `json:"seqs"`
+}
+
+// SignedFrame wraps every agent message once signing is on. Payload is the
+// message in encoding Enc, base64-encoded; see Verify.
+type SignedFrame struct {
+	Type    string `json:"type"` // "signed"
+	Enc     string `json:"enc"`
+	Seq     uint64 `json:"seq"`
+	TSMS    int64  `json:"ts_ms"`
+	Nonce   string `json:"nonce"`
+	Payload string `json:"payload"`
+	Sig     string `json:"sig"`
+}
+
+const TypeSigned = "signed"
+
+// SignKeyID names a sign_key without revealing it: the first 8 bytes of
+// SHA-256("kokoro-sign-key:" + key), hex. Hello carries it so a master
+// holding several keys (say, during a rotation) knows which one to use.
+func SignKeyID(key string) string {
+	h := sha256.Sum256([]byte("kokoro-sign-key:" + key))
+	return hex.EncodeToString(h[:8])
+}
+
+// Verify checks f against the agent's sign_key and returns the decoded
+// payload. Replay protection is up to the caller: reject Seq <= the last
+// one accepted from this agent and TSMS outside the allowed clock window.
+func (f SignedFrame) Verify(key string) ([]byte, error) {
+	payload, err := base64.StdEncoding.DecodeString(f.Payload)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(strconv.FormatUint(f.Seq, 10) + "." + strconv.FormatInt(f.TSMS, 10) + "." + f.Nonce + "."))
+	mac.Write(payload)
+	want := mac.Sum(nil)
+	got, err := hex.DecodeString(f.Sig)
+	if err != nil || !hmac.Equal(got, want) {
+		return nil, errors.New("agentproto: bad signature")
+	}
+	return payload, nil
+}
+
+// Envelope holds the fields common to agent data messages.
+type Envelope struct {
+	Type    string `json:"type"`
+	AgentID string `json:"agent_id,omitempty"`
+	Seq     uint64 `json:"seq,omitempty"`
+	TS      int64  `json:"ts,omitempty"`
+}
+
+var ErrNoType = errors.New("agentproto: message has no type")
+
+// Peek decodes only the envelope of a JSON message.
+func Peek(data []byte) (Envelope, error) {
+	var e Envelope
+	if err := json.Unmarshal(data, &e); err != nil {
+		return e, err
+	}
+	if e.Type == "" {
+		return e, ErrNoType
+	}
+	return e, nil
+}
+
+// ParseHello decodes and sanity-checks a hello frame. Checking the token is
+// left to the caller.
+func ParseHello(data []byte) (Hello, error) {
+	var h Hello
+	if err := json.Unmarshal(data, &h); err != nil {
+		return h, err
+	}
+	switch {
+	case h.Type != TypeHello:
+		return h, fmt.Errorf("agentproto: expected hello, got %q", h.Type)
+	case h.AgentID == "":
+		return h, errors.New("agentproto: hello without agent_id")
+	case h.Token == "":
+		return h, errors.New("agentproto: hello without token")
+	}
+	return h, nil
+}
+
+// NewHelloOK builds a hello_ok stamped with the current server time. Set
+// ProtoVer to NegotiateProto(hello) before sending it to an older agent.
+func NewHelloOK(cfg *Config, version int64) HelloOK {
+	return HelloOK{Type: TypeHelloOK, ServerTSMS: time.Now().UnixMilli(), ProtoVer: ProtoVersion, Config: cfg, ConfigVersion: version}
+}
+
+// NegotiateProto returns the protocol version to use with the agent that
+// sent h: the lower of its proto_ver and ProtoVersion.
+func NegotiateProto(h Hello) int {
+	v := h.ProtoVer
+	if v <= 0 {
+		v = 1
+	}
+	if v > ProtoVersion {
+		v = ProtoVersion
+	}
+	return v
+}
+
+// AcceptSubprotocol picks the Sec-WebSocket-Protocol to answer an upgrade
+// request with: Subprotocol if the agent offered it, else "" (send no
+// header; the agent then treats the master as unversioned).
+func AcceptSubprotocol(r *http.Request) string {
+	for _, v := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, p := range strings.Split(v, ",") {
+			if strings.TrimSpace(p) == Subprotocol {
+				return Subprotocol
+			}
+		}
+	}
+	return ""
+}
+
+func NewConfigPush(cfg Config, version int64) ConfigPush {
+	return ConfigPush{Type: TypeConfigPush, Config: cfg, ConfigVersion: version}
+}
+
+func NewPause(reason string, until time.Time) Pause {
+	p := Pause{Type: TypePause, Reason: reason}
+	if !until.IsZero() {
+		p.MaintenanceUntil = until.Unix()
+	}
+	return p
+}
+
+// TextWriter is satisfied by most WebSocket connection types.
+type TextWriter interface {
+	WriteText(payload []byte) error
+}
+
+// Send marshals v as JSON and writes it as one text frame.
+func Send(w TextWriter, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return w.WriteText(b)
+}
+
+// Kick asks the agent to disconnect (it reconnects after backoff).
+func Kick(w TextWriter) error {
+	return Send(w, map[string]string{"type": TypeKick})
+}
+
+// Resume ends a Pause.
+func Resume(w TextWriter) error {
+	return Send(w, map[string]string{"type": TypeResume})
+}
+
+// AuthErr rejects a hello; the agent treats it as fatal for that session.
+func AuthErr(w TextWriter) error {
+	return Send(w, map[string]string{"type": TypeAuthErr})
+}
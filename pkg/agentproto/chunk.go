@@ -0,0 +1,145 @@
+package agentproto
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// TypeChunk carries one part of a message too large for the peer's
+// max_frame, in either direction. Each side announces the largest frame it
+// wants to receive (Hello.MaxFrame, HelloOK.MaxFrame); the sender splits
+// anything bigger into Chunks and the receiver reassembles them (see
+// Reassembler). A side that doesn't announce max_frame never gets chunks.
+const TypeChunk = "chunk"
+
+// Chunk is one part of a chunked message. Data is the part's slice of the
+// message exactly as it would have gone out in one frame (JSON, another
+// encoding, or a signed frame); Bin marks a message that would have been a
+// binary frame. Parts of a message share MsgID and may be interleaved with
+// other messages, but arrive in order.
+type Chunk struct {
+	Type  string `json:"type"`
+	MsgID string `json:"msg_id"`
+	Part  int    `json:"part"` // 0-based
+	Total int    `json:"total"`
+	Bin   bool   `json:"bin,omitempty"`
+	Data  []byte `json:"data"` // base64 in JSON
+}
+
+// MinMaxFrame is the smallest max_frame honoured; smaller values are raised
+// to it so chunk overhead stays small.
+const MinMaxFrame = 4096
+
+// chunkOverhead is room left in each frame for the JSON envelope.
+const chunkOverhead = 256
+
+// SplitChunks splits msg into Chunks whose JSON encoding fits maxFrame
+// bytes. It returns nil when msg fits as it is.
+func SplitChunks(msg []byte, bin bool, maxFrame int) []Chunk {
+	if maxFrame < MinMaxFrame {
+		maxFrame = MinMaxFrame
+	}
+	if len(msg) <= maxFrame {
+		return nil
+	}
+	part := (maxFrame - chunkOverhead) / 4 * 3 // base64 grows by 4/3
+	var id [8]byte
+	_, _ = rand.Read(id[:])
+	total := (len(msg) + part - 1) / part
+	out := make([]Chunk, 0, total)
+	for i := 0; i < total; i++ {
+		end := min((i+1)*part, len(msg))
+		out = append(out, Chunk{Type: TypeChunk, MsgID: hex.EncodeToString(id[:]), Part: i, Total: total, Bin: bin, Data: msg[i*part : end]})
+	}
+	return out
+}
+
+// Reassembler limits; zero Reassembler fields take these.
+const (
+	DefaultChunkMaxBytes   = 64 << 20
+	DefaultChunkMaxPending = 4
+	DefaultChunkTimeout    = time.Minute
+)
+
+var (
+	ErrChunkTooLarge  = errors.New("chunked message exceeds the size limit")
+	ErrChunkSequence  = errors.New("chunk out of sequence")
+	ErrChunkTooMany   = errors.New("too many chunked messages in flight")
+	ErrChunkMalformed = errors.New("malformed chunk")
+)
+
+// Reassembler collects Chunks back into messages for one connection. It is
+// not safe for concurrent use.
+type Reassembler struct {
+	MaxBytes   int           // largest reassembled message
+	MaxPending int           // messages being reassembled at once
+	Timeout    time.Duration // an incomplete message is dropped after this
+
+	pending map[string]*partial
+}
+
+type partial struct {
+	buf   []byte
+	next  int
+	total int
+	bin   bool
+	start time.Time
+}
+
+// Add takes the next chunk. When it completes a message, Add returns the
+// message and whether it was binary; until then it returns nil. An error
+// drops the chunk's message (later parts of it are rejected too).
+func (r *Reassembler) Add(c Chunk) ([]byte, bool, error) {
+	maxBytes, maxPending, timeout := r.MaxBytes, r.MaxPending, r.Timeout
+	if maxBytes <= 0 {
+		maxBytes = DefaultChunkMaxBytes
+	}
+	if maxPending <= 0 {
+		maxPending = DefaultChunkMaxPending
+	}
+	if timeout <= 0 {
+		timeout = DefaultChunkTimeout
+	}
+	if r.pending == nil {
+		r.pending = map[string]*partial{}
+	}
+	now := time.Now()
+	for id, p := range r.pending {
+		if now.Sub(p.start) > timeout {
+			delete(r.pending, id)
+		}
+	}
+
+	if c.MsgID == "" || c.Total <= 0 || c.Part < 0 || c.Part >= c.Total {
+		return nil, false, ErrChunkMalformed
+	}
+	p := r.pending[c.MsgID]
+	if p == nil {
+		if c.Part != 0 {
+			return nil, false, fmt.Errorf("%w: %s part %d without part 0", ErrChunkSequence, c.MsgID, c.Part)
+		}
+		if len(r.pending) >= maxPending {
+			return nil, false, ErrChunkTooMany
+		}
+		p = &partial{total: c.Total, bin: c.Bin, start: now}
+		r.pending[c.MsgID] = p
+	}
+	if c.Part != p.next || c.Total != p.total {
+		delete(r.pending, c.MsgID)
+		return nil, false, fmt.Errorf("%w: %s part %d/%d, want %d/%d", ErrChunkSequence, c.MsgID, c.Part, c.Total, p.next, p.total)
+	}
+	if len(p.buf)+len(c.Data) > maxBytes {
+		delete(r.pending, c.MsgID)
+		return nil, false, ErrChunkTooLarge
+	}
+	p.buf = append(p.buf, c.Data...)
+	p.next++
+	if p.next < p.total {
+		return nil, false, nil
+	}
+	delete(r.pending, c.MsgID)
+	return p.buf, p.bin, nil
+}
@@ -0,0 +1,154 @@
+package agentproto
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSplitChunks(t *testing.T) {
+	msg := bytes.Repeat([]byte("0123456789abcdef"), 4096) // 64 KiB
+	tests := []struct {
+		name     string
+		size     int
+		maxFrame int
+		chunks   bool
+	}{
+		{"fits", 100, 8192, false},
+		{"exactly max_frame", 8192, 8192, false},
+		{"one over", 8193, 8192, true},
+		{"small max_frame raised", 4000, 100, false},
+		{"small max_frame chunks", 5000, 100, true},
+		{"many parts", len(msg), MinMaxFrame, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := msg[:tt.size]
+			chunks := SplitChunks(in, true, tt.maxFrame)
+			if !tt.chunks {
+				if chunks != nil {
+					t.Fatalf("got %d chunks, want none", len(chunks))
+				}
+				return
+			}
+			if len(chunks) < 2 {
+				t.Fatalf("got %d chunks", len(chunks))
+			}
+			limit := max(tt.maxFrame, MinMaxFrame)
+			var r Reassembler
+			for i, c := range chunks {
+				if c.Part != i || c.Total != len(chunks) || c.MsgID != chunks[0].MsgID || !c.Bin {
+					t.Fatalf("chunk %d: %+v", i, c)
+				}
+				b, err := json.Marshal(c)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(b) > limit {
+					t.Errorf("chunk %d encodes to %d bytes, over %d", i, len(b), limit)
+				}
+				var back Chunk
+				if err := json.Unmarshal(b, &back); err != nil {
+					t.Fatal(err)
+				}
+				out, bin, err := r.Add(back)
+				if err != nil {
+					t.Fatalf("chunk %d: %v", i, err)
+				}
+				if i < len(chunks)-1 {
+					if out != nil {
+						t.Fatalf("chunk %d completed the message", i)
+					}
+					continue
+				}
+				if !bytes.Equal(out, in) || !bin {
+					t.Errorf("reassembled %d bytes (bin %v), want %d", len(out), bin, len(in))
+				}
+			}
+		})
+	}
+}
+
+func TestReassemblerErrors(t *testing.T) {
+	c := func(id string, part, total int, data string) Chunk {
+		return Chunk{Type: TypeChunk, MsgID: id, Part: part, Total: total, Data: []byte(data)}
+	}
+	tests := []struct {
+		name   string
+		r      Reassembler
+		chunks []Chunk
+		err    error // from the last chunk
+	}{
+		{"no id", Reassembler{}, []Chunk{c("", 0, 1, "x")}, ErrChunkMalformed},
+		{"zero total", Reassembler{}, []Chunk{c("a", 0, 0, "x")}, ErrChunkMalformed},
+		{"negative part", Reassembler{}, []Chunk{c("a", -1, 2, "x")}, ErrChunkMalformed},
+		{"part past total", Reassembler{}, []Chunk{c("a", 2, 2, "x")}, ErrChunkMalformed},
+		{"no part 0", Reassembler{}, []Chunk{c("a", 1, 2, "x")}, ErrChunkSequence},
+		{"skipped part", Reassembler{}, []Chunk{c("a", 0, 3, "x"), c("a", 2, 3, "x")}, ErrChunkSequence},
+		{"repeated part", Reassembler{}, []Chunk{c("a", 0, 3, "x"), c("a", 0, 3, "x")}, ErrChunkSequence},
+		{"total changed", Reassembler{}, []Chunk{c("a", 0, 3, "x"), c("a", 1, 4, "x")}, ErrChunkSequence},
+		{"dropped after error", Reassembler{}, []Chunk{c("a", 0, 3, "x"), c("a", 2, 3, "x"), c("a", 1, 3, "x")}, ErrChunkSequence},
+		{"too large", Reassembler{MaxBytes: 4}, []Chunk{c("a", 0, 2, "abc"), c("a", 1, 2, "de")}, ErrChunkTooLarge},
+		{"too many", Reassembler{MaxPending: 2}, []Chunk{c("a", 0, 2, "x"), c("b", 0, 2, "x"), c("c", 0, 2, "x")}, ErrChunkTooMany},
+		{"default pending limit", Reassembler{}, []Chunk{c("a", 0, 2, ""), c("b", 0, 2, ""), c("c", 0, 2, ""), c("d", 0, 2, ""), c("e", 0, 2, "")}, ErrChunkTooMany},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var err error
+			for _, ch := range tt.chunks {
+				_, _, err = tt.r.Add(ch)
+			}
+			if !errors.Is(err, tt.err) {
+				t.Errorf("got %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestReassemblerInterleaved(t *testing.T) {
+	var r Reassembler
+	steps := []struct {
+		c    Chunk
+		want string
+	}{
+		{Chunk{MsgID: "a", Part: 0, Total: 2, Data: []byte("he")}, ""},
+		{Chunk{MsgID: "b", Part: 0, Total: 2, Data: []byte("wo"), Bin: true}, ""},
+		{Chunk{MsgID: "b", Part: 1, Total: 2, Data: []byte("rld")}, "world"},
+		{Chunk{MsgID: "a", Part: 1, Total: 2, Data: []byte("llo")}, "hello"},
+		{Chunk{MsgID: "a", Part: 0, Total: 1, Data: []byte("again")}, "again"},
+	}
+	for i, s := range steps {
+		out, bin, err := r.Add(s.c)
+		if err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+		if string(out) != s.want {
+			t.Errorf("step %d: got %q, want %q", i, out, s.want)
+		}
+		if s.want == "world" && !bin {
+			t.Errorf("step %d: bin flag of part 0 lost", i)
+		}
+	}
+	if len(r.pending) != 0 {
+		t.Errorf("%d messages left pending", len(r.pending))
+	}
+}
+
+func TestReassemblerTimeout(t *testing.T) {
+	r := Reassembler{MaxPending: 1, Timeout: time.Second}
+	if _, _, err := r.Add(Chunk{MsgID: "a", Part: 0, Total: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := r.Add(Chunk{MsgID: "b", Part: 0, Total: 2}); !errors.Is(err, ErrChunkTooMany) {
+		t.Fatalf("got %v, want ErrChunkTooMany", err)
+	}
+	r.pending["a"].start = time.Now().Add(-2 * time.Second)
+	if _, _, err := r.Add(Chunk{MsgID: "b", Part: 0, Total: 2}); err != nil {
+		t.Fatalf("expired message still pending: %v", err)
+	}
+	if _, _, err := r.Add(Chunk{MsgID: "a", Part: 1, Total: 2}); !errors.Is(err, ErrChunkSequence) {
+		t.Errorf("part of an expired message: got %v, want ErrChunkSequence", err)
+	}
+}
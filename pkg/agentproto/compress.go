@@ -0,0 +1,35 @@
+package agentproto
+
+// Compressed replay (capability replay_zstd). An agent that offers
+// "compress": ["zstd"] in hello and gets "compress": "zstd" in hello_ok
+// answers a tcpping_resend of several batches with binary frames built by
+// CompressedFrame instead of one message per batch. The frame's content
+// is a `batch` message in the session's encoding whose items are the
+// re-sent tcpping_batch messages ("resent": true). Signed sessions never
+// get compressed frames.
+const CompressZstd = "zstd"
+
+// CompressedHeaderLen is the size of a compressed frame header.
+const CompressedHeaderLen = 2
+
+// CompressedFrame builds a binary compressed frame:
+//
+//	'K' 'Z' zstd frame
+//
+// Like stream frames ('K' 'T'), it can't be mistaken for an encoded
+// message.
+func CompressedFrame(zst []byte) []byte {
+	b := make([]byte, CompressedHeaderLen+len(zst))
+	b[0], b[1] = 'K', 'Z'
+	copy(b[CompressedHeaderLen:], zst)
+	return b
+}
+
+// ParseCompressedFrame returns the zstd frame of a binary frame built by
+// CompressedFrame; ok is false for anything else.
+func ParseCompressedFrame(b []byte) (zst []byte, ok bool) {
+	if len(b) < CompressedHeaderLen || b[0] != 'K' || b[1] != 'Z' {
+		return nil, false
+	}
+	return b[CompressedHeaderLen:], true
+}
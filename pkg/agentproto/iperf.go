@@ -0,0 +1,65 @@
+package agentproto
+
+// Throughput tests (capability iperf, off unless the agent's config
+// enables it), over the iperf3 protocol so either side may also be a
+// stock iperf3. For a test between two agents the master sends
+// iperf_request with role "server" to one, waits for its iperf_ready,
+// then sends role "client" with the server's address to the other. Each
+// side answers with iperf_result when the test is over.
+const (
+	TypeIperfRequest = "iperf_request"
+	TypeIperfReady   = "iperf_ready"
+	TypeIperfResult  = "iperf_result"
+)
+
+// IperfRequest starts one side of a test. A server listens on the agent's
+// iperf.port for WaitSec (default 30) and runs one test; a client
+// connects to Host:Port (default 5201) and sends for Duration seconds
+// (default 10, capped by iperf.max_duration_sec) over Parallel streams,
+// or receives with Reverse.
+type IperfRequest struct {
+	Type     string `json:"type"`
+	ID       string `json:"id,omitempty"` // echoed in the replies
+	Role     string `json:"role"`         // server or client
+	Host     string `json:"host,omitempty"`
+	Port     int    `json:"port,omitempty"`
+	Duration int    `json:"duration,omitempty"`
+	Parallel int    `json:"parallel,omitempty"`
+	Reverse  bool   `json:"reverse,omitempty"`
+	WaitSec  int    `json:"wait_sec,omitempty"`
+}
+
+// IperfReady tells the master a server listens.
+type IperfReady struct {
+	Type    string `json:"type"`
+	AgentID string `json:"agent_id"`
+	ID      string `json:"id,omitempty"`
+	Port    int    `json:"port"`
+	TS      int64  `json:"ts"`
+}
+
+// IperfResult is one side's account of a test. Bytes and Mbps are what the
+// receiving side got; Retransmits are the sending side's (-1 unknown).
+// CPUPct is the agent's own CPU use over the transfer, in percent of one
+// CPU, PeerCPUPct the other side's as it reported it. The figures are
+// only sent with OK.
+type IperfResult struct {
+	Type        string  `json:"type"`
+	AgentID     string  `json:"agent_id"`
+	ID          string  `json:"id,omitempty"`
+	Role        string  `json:"role"`
+	OK          bool    `json:"ok"`
+	Err         string  `json:"err,omitempty"`
+	Peer        string  `json:"peer,omitempty"`
+	Sender      bool    `json:"sender,omitempty"`
+	Reverse     bool    `json:"reverse,omitempty"`
+	Parallel    int     `json:"parallel,omitempty"`
+	DurationMS  int64   `json:"duration_ms,omitempty"`
+	Bytes       int64   `json:"bytes"`
+	SentBytes   int64   `json:"sent_bytes"`
+	Mbps        float64 `json:"mbps"`
+	Retransmits int     `json:"retransmits"`
+	CPUPct      float64 `json:"cpu_pct"`
+	PeerCPUPct  float64 `json:"peer_cpu_pct,omitempty"`
+	TS          int64   `json:"ts"`
+}
@@ -0,0 +1,41 @@
+package agentproto
+
+// Looking glass (capability netinfo): netinfo_request runs one read-only
+// routing query on the agent, answered by netinfo_result.
+const (
+	TypeNetinfoRequest = "netinfo_request"
+	TypeNetinfoResult  = "netinfo_result"
+)
+
+// NetinfoRequest is one query:
+//   - "route_get": the kernel's route to Target, an IP (ip route get).
+//   - "routes": the main routing table, Family "4" (default) or "6".
+//   - "bgp_route": the BGP daemon's routes for Target, an IP or prefix
+//     (birdc -r show route for Target all, or FRR's vtysh).
+type NetinfoRequest struct {
+	Type   string `json:"type"`
+	ID     string `json:"id,omitempty"` // echoed in the result
+	Query  string `json:"query"`
+	Target string `json:"target,omitempty"`
+	Family string `json:"family,omitempty"`
+}
+
+// NetinfoResult answers NetinfoRequest. Data is ip's JSON (a route object
+// for route_get, a list for routes), FRR's JSON, or BIRD's routes as
+// {"version", "routes": [{"table", "prefix", "type", "protocol", "since",
+// "primary", "pref", "origin", "via": [{"gateway", "dev"}], "as_path",
+// "attrs"}]}. Source names the command that answered.
+type NetinfoResult struct {
+	Type      string `json:"type"`
+	AgentID   string `json:"agent_id"`
+	ID        string `json:"id,omitempty"`
+	Query     string `json:"query"`
+	Target    string `json:"target,omitempty"`
+	Family    string `json:"family,omitempty"`
+	OK        bool   `json:"ok"`
+	Err       string `json:"err,omitempty"`
+	Source    string `json:"source,omitempty"` // ip, birdc or vtysh
+	Data      any    `json:"data,omitempty"`
+	Truncated bool   `json:"truncated,omitempty"` // cut at 1000 routes
+	TS        int64  `json:"ts"`
+}
@@ -0,0 +1,35 @@
+package agentproto
+
+// Path watch (capability path_watch): the agent traces the first hops
+// towards every tcpping target's address and sends path_change when they
+// move.
+const TypePathChange = "path_change"
+
+// Hop is one TTL of a trace; IP is empty when nothing answered. ASN is
+// set when the agent has an ASN database.
+type Hop struct {
+	TTL   int     `json:"ttl"`
+	IP    string  `json:"ip,omitempty"`
+	RTTMS float64 `json:"rtt_ms,omitempty"`
+	ASN   uint64  `json:"asn,omitempty"`
+}
+
+// PathChange reports that hops at TTLs answered from other addresses than
+// in the previous trace (confirmed by a second trace). ASPath and
+// PrevASPath are the distinct ASNs along the hops, only when the agent
+// has an ASN database (geoip.asn_mmdb).
+type PathChange struct {
+	Type       string   `json:"type"`
+	AgentID    string   `json:"agent_id"`
+	TS         int64    `json:"ts"`
+	Target     string   `json:"target"` // the target's id, or proto/host:port/ip_ver
+	Host       string   `json:"host"`
+	IP         string   `json:"ip"`
+	TTLs       []int    `json:"ttls"`
+	Hops       []Hop    `json:"hops"`
+	PrevHops   []Hop    `json:"prev_hops"`
+	Reached    bool     `json:"reached,omitempty"` // the target answered within the hops
+	ASPath     []uint64 `json:"as_path,omitempty"`
+	PrevASPath []uint64 `json:"prev_as_path,omitempty"`
+	ASChanged  bool     `json:"as_changed,omitempty"`
+}
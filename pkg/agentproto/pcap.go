@@ -0,0 +1,42 @@
+package agentproto
+
+// Packet capture (capability pcap, off unless the agent's config enables
+// it): pcap_request (PcapRequest) takes a short capture on one interface,
+// answered by pcap_result (PcapResult) when it is done.
+const (
+	TypePcapRequest = "pcap_request"
+	TypePcapResult  = "pcap_result"
+)
+
+// PcapRequest captures on Iface for Duration seconds (default 10) or
+// until MaxBytes of pcap (default and cap: the agent's pcap.max_bytes).
+// BPF is a tcpdump filter expression; it needs tcpdump on the node.
+// Duration is capped by the agent's pcap.max_duration_sec.
+type PcapRequest struct {
+	Type     string `json:"type"`
+	ID       string `json:"id,omitempty"` // echoed in the result
+	Iface    string `json:"iface"`
+	BPF      string `json:"bpf,omitempty"`
+	Duration int    `json:"duration,omitempty"`
+	MaxBytes int    `json:"max_bytes,omitempty"`
+}
+
+// PcapResult answers PcapRequest. Data is the base64 of a classic pcap
+// file, cut at a packet boundary when Truncated. A capture that fails
+// midway has both Err and the packets it got.
+type PcapResult struct {
+	Type       string `json:"type"`
+	AgentID    string `json:"agent_id"`
+	ID         string `json:"id,omitempty"`
+	Iface      string `json:"iface"`
+	BPF        string `json:"bpf,omitempty"`
+	OK         bool   `json:"ok"`
+	Err        string `json:"err,omitempty"`
+	Method     string `json:"method,omitempty"` // tcpdump or af_packet
+	Duration   int    `json:"duration"`         // seconds allowed
+	DurationMS int64  `json:"duration_ms"`      // time taken
+	Packets    int    `json:"packets"`
+	Truncated  bool   `json:"truncated,omitempty"`
+	Data       []byte `json:"data,omitempty"`
+	TS         int64  `json:"ts"`
+}
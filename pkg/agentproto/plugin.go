@@ -0,0 +1,22 @@
+package agentproto
+
+import "encoding/json"
+
+// Collector plugins (capability plugins, on when the agent's config lists
+// any): every plugin interval the agent sends plugin_metrics with what the
+// plugin returned. Plugins are written against pkg/agentplugin.
+const TypePluginMetrics = "plugin_metrics"
+
+// PluginMetrics is one collection of one plugin: Data is the object the
+// plugin returned, or Err says why there is none (the plugin failed,
+// timed out, or is being restarted).
+type PluginMetrics struct {
+	Type       string          `json:"type"`
+	AgentID    string          `json:"agent_id"`
+	TS         int64           `json:"ts"`
+	Plugin     string          `json:"plugin"`            // the name in the agent's config
+	Version    string          `json:"version,omitempty"` // as announced by the plugin
+	DurationMS int64           `json:"duration_ms"`
+	Data       json.RawMessage `json:"data,omitempty"`
+	Err        string          `json:"err,omitempty"`
+}
@@ -0,0 +1,26 @@
+package agentproto
+
+import "encoding/json"
+
+// Metrics rollups (Config.RollupSec): next to the raw metrics stream the
+// agent folds every sample of a window into one metrics_rollup, so a
+// master can keep raw samples in hot storage and rollups long-term without
+// rolling them up itself.
+const TypeMetricsRollup = "metrics_rollup"
+
+// MetricsRollup covers the samples of [From, To), windows aligned to
+// multiples of the rollup interval. Metrics has the shape of a metrics
+// snapshot: numbers are the averages of the samples, except counters
+// (*_total, uptime_sec) and everything that isn't a number, which are the
+// last sample's. Max has the highest value of each top-level number.
+type MetricsRollup struct {
+	Type    string             `json:"type"`
+	AgentID string             `json:"agent_id"`
+	Seq     uint64             `json:"seq"`
+	TS      int64              `json:"ts"` // = To
+	From    int64              `json:"from"`
+	To      int64              `json:"to"`
+	Samples int                `json:"samples"`
+	Metrics json.RawMessage    `json:"metrics"`
+	Max     map[string]float64 `json:"max,omitempty"`
+}
@@ -0,0 +1,107 @@
+package agentproto
+
+import "encoding/binary"
+
+// Reverse tunnels (capability port_forward). The master relays TCP
+// connections to a target on the agent's side, e.g. an admin panel on a
+// node behind NAT:
+//
+//   - tunnel_open (TunnelOpen) names the target, which must be in the
+//     agent's port_forward list; answered by tunnel_open_result.
+//   - stream_open (StreamOpen) opens one connection through a tunnel, say
+//     for each client the master accepted on LocalPort; answered by
+//     stream_open_result once the agent has connected.
+//   - The bytes of a stream flow in binary frames both ways (StreamFrame).
+//   - tunnel_close closes a tunnel and its streams. Everything is closed
+//     when the session ends.
+//
+// A tunnel opened with SOCKS5 (capability socks5_egress) has no fixed
+// target: each of its streams is a SOCKS5 client, and the agent connects
+// wherever the client's CONNECT asks.
+const (
+	TypeTunnelOpen       = "tunnel_open"
+	TypeTunnelClose      = "tunnel_close"
+	TypeStreamOpen       = "stream_open"
+	TypeTunnelOpenResult = "tunnel_open_result"
+	TypeStreamOpenResult = "stream_open_result"
+)
+
+// TunnelOpen asks the agent to accept streams to RemoteTarget (host:port
+// as listed in port_forward), or SOCKS5 streams. LocalPort is where the
+// master listens; the agent only echoes it.
+type TunnelOpen struct {
+	Type         string `json:"type"`
+	TunnelID     string `json:"tunnel_id"`
+	LocalPort    int    `json:"local_port,omitempty"`
+	RemoteTarget string `json:"remote_target,omitempty"`
+	SOCKS5       bool   `json:"socks5,omitempty"`
+}
+
+// TunnelOpenResult answers TunnelOpen.
+type TunnelOpenResult struct {
+	Type         string `json:"type"`
+	AgentID      string `json:"agent_id"`
+	TunnelID     string `json:"tunnel_id"`
+	LocalPort    int    `json:"local_port,omitempty"`
+	RemoteTarget string `json:"remote_target,omitempty"`
+	SOCKS5       bool   `json:"socks5,omitempty"`
+	OK           bool   `json:"ok"`
+	Err          string `json:"err,omitempty"`
+}
+
+// TunnelClose closes a tunnel and resets its streams.
+type TunnelClose struct {
+	Type     string `json:"type"`
+	TunnelID string `json:"tunnel_id"`
+}
+
+// StreamOpen opens stream StreamID (non-zero, unique in the session)
+// through a tunnel. Data frames for it may follow right away.
+type StreamOpen struct {
+	Type     string `json:"type"`
+	TunnelID string `json:"tunnel_id"`
+	StreamID uint32 `json:"stream_id"`
+}
+
+// StreamOpenResult answers StreamOpen; on failure the stream is gone.
+type StreamOpenResult struct {
+	Type     string `json:"type"`
+	AgentID  string `json:"agent_id"`
+	TunnelID string `json:"tunnel_id"`
+	StreamID uint32 `json:"stream_id"`
+	OK       bool   `json:"ok"`
+	Err      string `json:"err,omitempty"`
+}
+
+// Stream frame ops.
+const (
+	StreamData  byte = 1 // payload is stream bytes
+	StreamFin   byte = 2 // the sender won't send more; the other way stays open
+	StreamReset byte = 3 // the stream is gone
+)
+
+// StreamHeaderLen is the size of a stream frame header.
+const StreamHeaderLen = 7
+
+// StreamFrame builds a binary stream frame:
+//
+//	'K' 'T' op stream_id(4 bytes, big endian) payload
+//
+// No message encoding starts with "KT", so an agent's binary messages
+// (msgpack, cbor, protobuf) and stream frames can't be confused.
+func StreamFrame(op byte, id uint32, payload []byte) []byte {
+	b := make([]byte, StreamHeaderLen+len(payload))
+	b[0], b[1], b[2] = 'K', 'T', op
+	binary.BigEndian.PutUint32(b[3:], id)
+	copy(b[StreamHeaderLen:], payload)
+	return b
+}
+
+// ParseStreamFrame splits a binary frame built by StreamFrame; ok is false
+// for anything else.
+func ParseStreamFrame(b []byte) (op byte, id uint32, payload []byte, ok bool) {
+	if len(b) < StreamHeaderLen || b[0] != 'K' || b[1] != 'T' {
+		return 0, 0, nil, false
+	}
+	return b[2], binary.BigEndian.Uint32(b[3:]), b[StreamHeaderLen:], true
+}
@@ -0,0 +1,71 @@
+package agentproto
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+)
+
+// Certificate pinning. An agent with tls_pins only connects to a master
+// whose TLS chain contains one of them. To rotate the master's certificate
+// without losing pinned agents, send a TLSPinUpdate with the new pins
+// ahead of time: the agent stores them and keeps accepting the old ones
+// for GraceSec, so the switch can happen any time in that window.
+const (
+	TypeTLSPinUpdate    = "tls_pin_update"     // master -> agent
+	TypeTLSPinUpdateAck = "tls_pin_update_ack" // agent -> master
+)
+
+// DefaultPinGraceSec is the grace period of a TLSPinUpdate without one
+// (7 days); MaxPinGraceSec is the longest accepted (90 days).
+const (
+	DefaultPinGraceSec = 7 * 86400
+	MaxPinGraceSec     = 90 * 86400
+)
+
+// TLSPinUpdate replaces the agent's pins ("sha256/<base64>" SPKI or
+// "cert-sha256/<base64>" certificate hashes). Version must be higher than
+// any update the agent applied before, so an old update can't be replayed
+// to bring back retired pins. GraceSec 0 means DefaultPinGraceSec; a
+// negative one drops the old pins at once. Sig is SignPinUpdate with the
+// agent's sign_key, never the token (hello carries that in the clear).
+// Agents without pins or a sign_key configured refuse updates.
+type TLSPinUpdate struct {
+	Type     string   `json:"type"`
+	Version  int64    `json:"version"`
+	Pins     []string `json:"pins"`
+	GraceSec int64    `json:"grace_sec,omitempty"`
+	Sig      string   `json:"sig"`
+}
+
+// TLSPinUpdateAck answers TLSPinUpdate. GraceUntil (unix seconds) is when
+// the previous pins stop being accepted.
+type TLSPinUpdateAck struct {
+	Type       string `json:"type"`
+	AgentID    string `json:"agent_id"`
+	Version    int64  `json:"version"`
+	OK         bool   `json:"ok"`
+	Err        string `json:"err,omitempty"`
+	GraceUntil int64  `json:"grace_until,omitempty"`
+	TS         int64  `json:"ts"`
+}
+
+// SignPinUpdate is the hex HMAC-SHA256, keyed by the agent's sign_key, of
+// "tls_pin_update.<version>.<grace_sec>.<pins joined by ','>".
+func SignPinUpdate(key string, version, graceSec int64, pins []string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(TypeTLSPinUpdate + "." + strconv.FormatInt(version, 10) + "." +
+		strconv.FormatInt(graceSec, 10) + "." + strings.Join(pins, ",")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyPinUpdate checks u.Sig against key; an empty key never verifies.
+func VerifyPinUpdate(key string, u TLSPinUpdate) bool {
+	if key == "" {
+		return false
+	}
+	want := SignPinUpdate(key, u.Version, u.GraceSec, u.Pins)
+	return hmac.Equal([]byte(u.Sig), []byte(want))
+}